@@ -0,0 +1,285 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// The BGP-4 messages we exchange with neighbours (RFC 4271), just as
+// much of them as a speaker which only announces needs.
+
+const (
+	Port          = 179
+	version       = 4
+	headerLen     = 19
+	maxMessageLen = 4096
+
+	msgOpen         = 1
+	msgUpdate       = 2
+	msgNotification = 3
+	msgKeepalive    = 4
+
+	attrOrigin    = 1
+	attrASPath    = 2
+	attrNextHop   = 3
+	attrLocalPref = 5
+
+	flagTransitive = 0x40
+
+	originIGP        = 0
+	asSequence       = 2
+	defaultLocalPref = 100
+
+	// Where our AS doesn't fit in two octets (RFC 6793)
+	asTrans = 23456
+
+	paramCapabilities = 2
+	capMultiprotocol  = 1
+	capFourOctetAS    = 65
+	afiIPv4           = 1
+	safiUnicast       = 1
+
+	errOpen      = 2
+	errHoldTimer = 4
+	errFSM       = 5
+	errCease     = 6
+
+	ceaseAdminShutdown = 2
+)
+
+var marker = bytes.Repeat([]byte{0xff}, 16)
+
+type openMsg struct {
+	as        uint32 // the four-octet AS where it told us one
+	holdTime  uint16 // in seconds
+	id        net.IP
+	fourOctet bool
+}
+
+func formMessage(msgType byte, body []byte) []byte {
+	msg := make([]byte, headerLen, headerLen+len(body))
+	copy(msg, marker)
+	binary.BigEndian.PutUint16(msg[16:], uint16(headerLen+len(body)))
+	msg[18] = msgType
+	return append(msg, body...)
+}
+
+// Read a message, returning its type and body
+func readMessage(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	if !bytes.Equal(header[:16], marker) {
+		return 0, nil, fmt.Errorf("message without marker")
+	}
+	length := int(binary.BigEndian.Uint16(header[16:]))
+	if length < headerLen || length > maxMessageLen {
+		return 0, nil, fmt.Errorf("message of bad length %d", length)
+	}
+	body := make([]byte, length-headerLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[18], body, nil
+}
+
+func formOpen(as uint32, holdTime uint16, id net.IP) []byte {
+	as2 := uint16(as)
+	if as > 0xffff {
+		as2 = asTrans
+	}
+	caps := []byte{capMultiprotocol, 4, 0, afiIPv4, 0, safiUnicast, capFourOctetAS, 4}
+	caps = append(caps, uint32Bytes(as)...)
+	params := append([]byte{paramCapabilities, byte(len(caps))}, caps...)
+	body := []byte{version, byte(as2 >> 8), byte(as2), byte(holdTime >> 8), byte(holdTime)}
+	body = append(body, id.To4()...)
+	body = append(append(body, byte(len(params))), params...)
+	return formMessage(msgOpen, body)
+}
+
+func parseOpen(body []byte) (*openMsg, error) {
+	if len(body) < 10 {
+		return nil, fmt.Errorf("OPEN too short")
+	}
+	if body[0] != version {
+		return nil, fmt.Errorf("BGP version %d rather than %d", body[0], version)
+	}
+	open := &openMsg{
+		as:       uint32(binary.BigEndian.Uint16(body[1:])),
+		holdTime: binary.BigEndian.Uint16(body[3:]),
+		id:       net.IP(body[5:9])}
+	params := body[10:]
+	if len(params) != int(body[9]) {
+		return nil, fmt.Errorf("OPEN of bad length")
+	}
+	for len(params) > 0 {
+		if len(params) < 2 || len(params) < 2+int(params[1]) {
+			return nil, fmt.Errorf("OPEN with truncated parameter")
+		}
+		param := params[2 : 2+params[1]]
+		if params[0] == paramCapabilities {
+			if err := open.parseCapabilities(param); err != nil {
+				return nil, err
+			}
+		}
+		params = params[2+len(param):]
+	}
+	if open.holdTime == 1 || open.holdTime == 2 {
+		return nil, fmt.Errorf("unacceptable hold time %d", open.holdTime)
+	}
+	return open, nil
+}
+
+func (open *openMsg) parseCapabilities(caps []byte) error {
+	for len(caps) > 0 {
+		if len(caps) < 2 || len(caps) < 2+int(caps[1]) {
+			return fmt.Errorf("OPEN with truncated capability")
+		}
+		value := caps[2 : 2+caps[1]]
+		if caps[0] == capFourOctetAS && len(value) == 4 {
+			open.fourOctet = true
+			open.as = binary.BigEndian.Uint32(value)
+		}
+		caps = caps[2+len(value):]
+	}
+	return nil
+}
+
+func formKeepalive() []byte {
+	return formMessage(msgKeepalive, nil)
+}
+
+func formNotification(code, subcode byte) []byte {
+	return formMessage(msgNotification, []byte{code, subcode})
+}
+
+func parseNotification(body []byte) string {
+	if len(body) < 2 {
+		return "NOTIFICATION too short"
+	}
+	return fmt.Sprintf("NOTIFICATION code %d, subcode %d", body[0], body[1])
+}
+
+// The path attributes of our announcements: AS_PATH has our AS towards
+// other ASes and is empty within ours, where LOCAL_PREF goes instead.
+type pathAttrs struct {
+	localAS   uint32
+	ibgp      bool
+	fourOctet bool
+	nextHop   net.IP
+}
+
+func (attrs pathAttrs) encode() []byte {
+	buf := []byte{flagTransitive, attrOrigin, 1, originIGP}
+	var path []byte
+	if !attrs.ibgp {
+		path = []byte{asSequence, 1}
+		if attrs.fourOctet {
+			path = append(path, uint32Bytes(attrs.localAS)...)
+		} else {
+			path = append(path, byte(attrs.localAS>>8), byte(attrs.localAS))
+		}
+	}
+	buf = append(append(buf, flagTransitive, attrASPath, byte(len(path))), path...)
+	buf = append(append(buf, flagTransitive, attrNextHop, 4), attrs.nextHop.To4()...)
+	if attrs.ibgp {
+		buf = append(append(buf, flagTransitive, attrLocalPref, 4), uint32Bytes(defaultLocalPref)...)
+	}
+	return buf
+}
+
+// UPDATEs withdrawing and announcing the prefixes, as many as it takes
+// to keep each within the maximum message length.
+func formUpdates(withdrawn, announced []*net.IPNet, attrs pathAttrs) [][]byte {
+	var msgs [][]byte
+	room := maxMessageLen - headerLen - 4
+	var prefixes []byte
+	for _, prefix := range withdrawn {
+		if len(prefixes)+5 > room {
+			msgs = append(msgs, formUpdate(prefixes, nil, nil))
+			prefixes = nil
+		}
+		prefixes = append(prefixes, encodePrefix(prefix)...)
+	}
+	if len(prefixes) > 0 {
+		msgs = append(msgs, formUpdate(prefixes, nil, nil))
+	}
+	encodedAttrs := attrs.encode()
+	room -= len(encodedAttrs)
+	prefixes = nil
+	for _, prefix := range announced {
+		if len(prefixes)+5 > room {
+			msgs = append(msgs, formUpdate(nil, encodedAttrs, prefixes))
+			prefixes = nil
+		}
+		prefixes = append(prefixes, encodePrefix(prefix)...)
+	}
+	if len(prefixes) > 0 {
+		msgs = append(msgs, formUpdate(nil, encodedAttrs, prefixes))
+	}
+	return msgs
+}
+
+func formUpdate(withdrawn, attrs, nlri []byte) []byte {
+	body := append(uint16Bytes(len(withdrawn)), withdrawn...)
+	body = append(append(body, uint16Bytes(len(attrs))...), attrs...)
+	return formMessage(msgUpdate, append(body, nlri...))
+}
+
+// The withdrawn and announced prefixes of an UPDATE
+func parseUpdate(body []byte) ([]*net.IPNet, []*net.IPNet, error) {
+	if len(body) < 2 {
+		return nil, nil, fmt.Errorf("UPDATE too short")
+	}
+	withdrawnLen := int(binary.BigEndian.Uint16(body))
+	if len(body) < 4+withdrawnLen {
+		return nil, nil, fmt.Errorf("UPDATE too short")
+	}
+	withdrawn, err := decodePrefixes(body[2 : 2+withdrawnLen])
+	if err != nil {
+		return nil, nil, err
+	}
+	body = body[2+withdrawnLen:]
+	attrsLen := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+attrsLen {
+		return nil, nil, fmt.Errorf("UPDATE too short")
+	}
+	announced, err := decodePrefixes(body[2+attrsLen:])
+	return withdrawn, announced, err
+}
+
+// A prefix in an UPDATE: its length, then as many octets as it needs
+func encodePrefix(prefix *net.IPNet) []byte {
+	ones, _ := prefix.Mask.Size()
+	return append([]byte{byte(ones)}, prefix.IP.To4()[:(ones+7)/8]...)
+}
+
+func decodePrefixes(buf []byte) ([]*net.IPNet, error) {
+	var prefixes []*net.IPNet
+	for len(buf) > 0 {
+		ones := int(buf[0])
+		octets := (ones + 7) / 8
+		if ones > 32 || len(buf) < 1+octets {
+			return nil, fmt.Errorf("bad prefix in UPDATE")
+		}
+		ip := make(net.IP, 4)
+		copy(ip, buf[1:1+octets])
+		prefixes = append(prefixes, &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, 32)})
+		buf = buf[1+octets:]
+	}
+	return prefixes, nil
+}
+
+func uint16Bytes(n int) []byte {
+	return []byte{byte(n >> 8), byte(n)}
+}
+
+func uint32Bytes(n uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, n)
+	return buf
+}
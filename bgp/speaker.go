@@ -0,0 +1,417 @@
+package bgp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A BGP speaker announcing prefixes, e.g. the parts of the IPAM range
+// we own, to neighbours such as top-of-rack routers, so that they can
+// route to the containers on this host directly rather than through
+// the overlay. It only ever connects out, to each neighbour in turn
+// retrying every ConnectRetry while it can't, and ignores whatever the
+// neighbours announce. Every Refresh it asks the source of prefixes
+// again, announcing what's new and withdrawing what's gone; on Stop it
+// withdraws the lot before closing the sessions, so that neighbours
+// stop routing to us straight away rather than once the hold timer
+// expires.
+
+const (
+	HoldTime     = 90 * time.Second
+	ConnectRetry = 30 * time.Second
+	Refresh      = 5 * time.Second
+	dialTimeout  = 10 * time.Second
+	writeTimeout = 10 * time.Second
+	stopTimeout  = 5 * time.Second
+	// How long we wait for the neighbour's OPEN (RFC 4271 8.2.2)
+	openHoldTime = 4 * time.Minute
+)
+
+var errStopped = errors.New("stopped")
+
+type Neighbour struct {
+	Addr string // <ip>:<port>
+	AS   uint32
+}
+
+func (neighbour Neighbour) String() string {
+	return fmt.Sprintf("%s AS %d", neighbour.Addr, neighbour.AS)
+}
+
+// Parse a comma-separated list of neighbours, each <ip>[:<port>]=<AS>
+func ParseNeighbours(spec string) ([]Neighbour, error) {
+	var neighbours []Neighbour
+	for _, field := range strings.Split(spec, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid BGP neighbour %q; expected <ip>[:<port>]=<AS>", field)
+		}
+		addr := parts[0]
+		if net.ParseIP(addr) != nil {
+			addr = net.JoinHostPort(addr, strconv.Itoa(Port))
+		} else if host, _, err := net.SplitHostPort(addr); err != nil || net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("invalid BGP neighbour address %q", parts[0])
+		}
+		as, err := ParseAS(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		neighbours = append(neighbours, Neighbour{addr, as})
+	}
+	return neighbours, nil
+}
+
+func ParseAS(s string) (uint32, error) {
+	as, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || as == 0 {
+		return 0, fmt.Errorf("invalid AS number %q", s)
+	}
+	return uint32(as), nil
+}
+
+type Speaker struct {
+	as       uint32
+	routerID net.IP // nil for the local address of each session
+	nextHop  net.IP // likewise
+	prefixes func() []*net.IPNet
+	sessions []*session
+	refresh  time.Duration
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+type session struct {
+	sync.Mutex
+	speaker   *Speaker
+	neighbour Neighbour
+	state     string
+	lastErr   error
+	announced map[string]*net.IPNet
+}
+
+// A speaker in the AS, announcing the prefixes the source gives it,
+// IPv4 only, to the neighbours. The router ID and next hop default to
+// the local address of each session, which won't do behind NAT.
+func NewSpeaker(as uint32, routerID, nextHop net.IP, neighbours []Neighbour, prefixes func() []*net.IPNet) *Speaker {
+	speaker := &Speaker{
+		as:       as,
+		routerID: routerID,
+		nextHop:  nextHop,
+		prefixes: prefixes,
+		refresh:  Refresh,
+		stop:     make(chan struct{})}
+	for _, neighbour := range neighbours {
+		speaker.sessions = append(speaker.sessions, &session{speaker: speaker, neighbour: neighbour, state: "idle"})
+	}
+	return speaker
+}
+
+func (speaker *Speaker) Start() {
+	for _, sess := range speaker.sessions {
+		speaker.wg.Add(1)
+		go sess.run()
+	}
+}
+
+// Withdraw everything we announced and close the sessions, waiting for
+// a little while for that to get through.
+func (speaker *Speaker) Stop() {
+	close(speaker.stop)
+	done := make(chan struct{})
+	go func() {
+		speaker.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(stopTimeout):
+	}
+}
+
+func (speaker *Speaker) String() string {
+	var buf bytes.Buffer
+	routerID := "local address"
+	if speaker.routerID != nil {
+		routerID = speaker.routerID.String()
+	}
+	nextHop := "local address"
+	if speaker.nextHop != nil {
+		nextHop = speaker.nextHop.String()
+	}
+	buf.WriteString(fmt.Sprintf("AS %d, router ID %s, next hop %s\n", speaker.as, routerID, nextHop))
+	for _, sess := range speaker.sessions {
+		buf.WriteString(sess.String())
+	}
+	return buf.String()
+}
+
+func (sess *session) String() string {
+	sess.Lock()
+	defer sess.Unlock()
+	switch {
+	case sess.state == "established":
+		return fmt.Sprintf("%s: established, %d prefixes announced\n", sess.neighbour, len(sess.announced))
+	case sess.lastErr != nil:
+		return fmt.Sprintf("%s: %s, last error: %v\n", sess.neighbour, sess.state, sess.lastErr)
+	}
+	return fmt.Sprintf("%s: %s\n", sess.neighbour, sess.state)
+}
+
+func (sess *session) setState(state string, err error) {
+	sess.Lock()
+	sess.state = state
+	if err != nil {
+		sess.lastErr = err
+	}
+	if state != "established" {
+		sess.announced = nil
+	}
+	sess.Unlock()
+}
+
+func (sess *session) run() {
+	defer sess.speaker.wg.Done()
+	for {
+		err := sess.connect()
+		if err == errStopped {
+			sess.setState("stopped", nil)
+			return
+		}
+		log.Printf("BGP session with %s: %v", sess.neighbour, err)
+		sess.setState("idle", err)
+		select {
+		case <-sess.speaker.stop:
+			return
+		case <-time.After(ConnectRetry):
+		}
+	}
+}
+
+func (sess *session) connect() error {
+	sess.setState("connecting", nil)
+	conn, err := net.DialTimeout("tcp", sess.neighbour.Addr, dialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP.To4()
+	if localIP == nil {
+		return fmt.Errorf("only IPv4 sessions are supported")
+	}
+	routerID, nextHop := sess.speaker.routerID, sess.speaker.nextHop
+	if routerID == nil {
+		routerID = localIP
+	}
+	if nextHop == nil {
+		nextHop = localIP
+	}
+	if err := send(conn, formOpen(sess.speaker.as, uint16(HoldTime/time.Second), routerID)); err != nil {
+		return err
+	}
+	sess.setState("open sent", nil)
+	open, err := sess.receiveOpen(conn)
+	if err != nil {
+		return err
+	}
+	holdTime := HoldTime
+	if theirs := time.Duration(open.holdTime) * time.Second; theirs < holdTime {
+		holdTime = theirs
+	}
+	if err := send(conn, formKeepalive()); err != nil {
+		return err
+	}
+	if err := sess.receiveKeepalive(conn, holdTime); err != nil {
+		return err
+	}
+	log.Printf("BGP session with %s established", sess.neighbour)
+	sess.setState("established", nil)
+	attrs := pathAttrs{
+		localAS:   sess.speaker.as,
+		ibgp:      open.as == sess.speaker.as,
+		fourOctet: open.fourOctet,
+		nextHop:   nextHop}
+	return sess.established(conn, holdTime, attrs)
+}
+
+func (sess *session) receiveOpen(conn net.Conn) (*openMsg, error) {
+	conn.SetReadDeadline(time.Now().Add(openHoldTime))
+	msgType, body, err := readMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	switch msgType {
+	case msgOpen:
+	case msgNotification:
+		return nil, fmt.Errorf("neighbour sent %s", parseNotification(body))
+	default:
+		send(conn, formNotification(errFSM, 0))
+		return nil, fmt.Errorf("expected OPEN, got message of type %d", msgType)
+	}
+	open, err := parseOpen(body)
+	if err != nil {
+		send(conn, formNotification(errOpen, 0))
+		return nil, err
+	}
+	if open.as != sess.neighbour.AS {
+		send(conn, formNotification(errOpen, 2)) // bad peer AS
+		return nil, fmt.Errorf("neighbour is in AS %d", open.as)
+	}
+	if !open.fourOctet && sess.speaker.as > 0xffff {
+		send(conn, formNotification(errCease, 0))
+		return nil, fmt.Errorf("neighbour lacks the four-octet AS capability our AS %d needs", sess.speaker.as)
+	}
+	return open, nil
+}
+
+func (sess *session) receiveKeepalive(conn net.Conn, holdTime time.Duration) error {
+	setReadDeadline(conn, holdTime)
+	msgType, body, err := readMessage(conn)
+	if err != nil {
+		return err
+	}
+	switch msgType {
+	case msgKeepalive:
+		return nil
+	case msgNotification:
+		return fmt.Errorf("neighbour sent %s", parseNotification(body))
+	}
+	send(conn, formNotification(errFSM, 0))
+	return fmt.Errorf("expected KEEPALIVE, got message of type %d", msgType)
+}
+
+func (sess *session) established(conn net.Conn, holdTime time.Duration, attrs pathAttrs) error {
+	received := make(chan error, 1)
+	go func() { received <- receive(conn, holdTime) }()
+	var keepalive <-chan time.Time
+	if holdTime > 0 {
+		ticker := time.NewTicker(holdTime / 3)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+	refresh := time.NewTicker(sess.speaker.refresh)
+	defer refresh.Stop()
+	if err := sess.update(conn, attrs, sess.speaker.prefixes()); err != nil {
+		return err
+	}
+	for {
+		select {
+		case err := <-received:
+			if err == errHoldTimerExpired {
+				send(conn, formNotification(errHoldTimer, 0))
+			}
+			return err
+		case <-keepalive:
+			if err := send(conn, formKeepalive()); err != nil {
+				return err
+			}
+		case <-refresh.C:
+			if err := sess.update(conn, attrs, sess.speaker.prefixes()); err != nil {
+				return err
+			}
+		case <-sess.speaker.stop:
+			if err := sess.update(conn, attrs, nil); err == nil {
+				send(conn, formNotification(errCease, ceaseAdminShutdown))
+			}
+			return errStopped
+		}
+	}
+}
+
+var errHoldTimerExpired = errors.New("hold timer expired")
+
+// Read messages from the neighbour until something goes wrong,
+// ignoring what it announces.
+func receive(conn net.Conn, holdTime time.Duration) error {
+	for {
+		setReadDeadline(conn, holdTime)
+		msgType, body, err := readMessage(conn)
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			return errHoldTimerExpired
+		} else if err != nil {
+			return err
+		}
+		switch msgType {
+		case msgNotification:
+			return fmt.Errorf("neighbour sent %s", parseNotification(body))
+		case msgUpdate:
+			if _, _, err := parseUpdate(body); err != nil {
+				return err
+			}
+		case msgKeepalive:
+		default:
+			return fmt.Errorf("unexpected message of type %d", msgType)
+		}
+	}
+}
+
+// Announce the prefixes we haven't yet, and withdraw those we did but
+// which have gone.
+func (sess *session) update(conn net.Conn, attrs pathAttrs, prefixes []*net.IPNet) error {
+	current := make(map[string]*net.IPNet)
+	for _, prefix := range prefixes {
+		if prefix.IP.To4() != nil {
+			current[prefix.String()] = prefix
+		}
+	}
+	sess.Lock()
+	announced := sess.announced
+	sess.Unlock()
+	withdrawn := missing(announced, current)
+	added := missing(current, announced)
+	if len(withdrawn) == 0 && len(added) == 0 {
+		return nil
+	}
+	if err := send(conn, formUpdates(withdrawn, added, attrs)...); err != nil {
+		return err
+	}
+	sess.Lock()
+	sess.announced = current
+	sess.Unlock()
+	return nil
+}
+
+// The prefixes of set1 which aren't in set2, in order
+func missing(set1, set2 map[string]*net.IPNet) []*net.IPNet {
+	var keys []string
+	for key := range set1 {
+		if _, found := set2[key]; !found {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	prefixes := make([]*net.IPNet, len(keys))
+	for i, key := range keys {
+		prefixes[i] = set1[key]
+	}
+	return prefixes
+}
+
+func send(conn net.Conn, msgs ...[]byte) error {
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	for _, msg := range msgs {
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A hold time of zero means no hold timer, and no keepalives
+func setReadDeadline(conn net.Conn, holdTime time.Duration) {
+	if holdTime > 0 {
+		conn.SetReadDeadline(time.Now().Add(holdTime))
+	} else {
+		conn.SetReadDeadline(time.Time{})
+	}
+}
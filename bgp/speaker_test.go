@@ -0,0 +1,190 @@
+package bgp
+
+import (
+	"bytes"
+	"fmt"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func parseCIDRs(t *testing.T, cidrs ...string) []*net.IPNet {
+	var prefixes []*net.IPNet
+	for _, cidr := range cidrs {
+		_, prefix, err := net.ParseCIDR(cidr)
+		wt.AssertNoErr(t, err)
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+func TestParseNeighbours(t *testing.T) {
+	neighbours, err := ParseNeighbours("10.0.0.1=65000, 10.0.0.2:1179=4200000000")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, fmt.Sprint(neighbours), "[10.0.0.1:179 AS 65000 10.0.0.2:1179 AS 4200000000]", "neighbours")
+	for _, spec := range []string{"10.0.0.1", "10.0.0.1=0", "router=65000", "10.0.0.1=as1"} {
+		if _, err := ParseNeighbours(spec); err == nil {
+			wt.Fatalf(t, "Expected %q to be invalid", spec)
+		}
+	}
+}
+
+func TestUpdates(t *testing.T) {
+	attrs := pathAttrs{localAS: 65001, nextHop: net.ParseIP("192.168.0.1")}
+	// Enough /32s to take three messages
+	var announced []*net.IPNet
+	for i := 0; i < 1600; i++ {
+		announced = append(announced, &net.IPNet{IP: net.IPv4(10, 0, byte(i>>8), byte(i)).To4(), Mask: net.CIDRMask(32, 32)})
+	}
+	withdrawn := parseCIDRs(t, "10.32.0.0/12", "10.48.1.0/24")
+	msgs := formUpdates(withdrawn, announced, attrs)
+	wt.AssertEqualInt(t, len(msgs), 3, "UPDATEs")
+	var gotWithdrawn, gotAnnounced []*net.IPNet
+	for _, msg := range msgs {
+		if len(msg) > maxMessageLen {
+			wt.Fatalf(t, "UPDATE of %d bytes is too long", len(msg))
+		}
+		msgType, body, err := readMessage(&readBuffer{msg})
+		wt.AssertNoErr(t, err)
+		wt.AssertEqualInt(t, int(msgType), msgUpdate, "message type")
+		w, a, err := parseUpdate(body)
+		wt.AssertNoErr(t, err)
+		gotWithdrawn, gotAnnounced = append(gotWithdrawn, w...), append(gotAnnounced, a...)
+	}
+	wt.AssertEqualString(t, fmt.Sprint(gotWithdrawn), fmt.Sprint(withdrawn), "withdrawn")
+	wt.AssertEqualString(t, fmt.Sprint(gotAnnounced), fmt.Sprint(announced), "announced")
+}
+
+type readBuffer struct {
+	buf []byte
+}
+
+func (r *readBuffer) Read(p []byte) (int, error) {
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// A neighbour which accepts one session, and records what it's told
+type testNeighbour struct {
+	sync.Mutex
+	listener  net.Listener
+	open      *openMsg
+	announced map[string]bool
+	ceased    chan struct{}
+}
+
+func newTestNeighbour(t *testing.T) *testNeighbour {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	wt.AssertNoErr(t, err)
+	neighbour := &testNeighbour{listener: listener, announced: make(map[string]bool), ceased: make(chan struct{})}
+	go neighbour.accept()
+	return neighbour
+}
+
+func (neighbour *testNeighbour) accept() {
+	conn, err := neighbour.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	for {
+		msgType, body, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		switch msgType {
+		case msgOpen:
+			open, err := parseOpen(body)
+			if err != nil {
+				return
+			}
+			neighbour.Lock()
+			neighbour.open = open
+			neighbour.Unlock()
+			send(conn, formOpen(65000, 30, net.ParseIP("192.168.0.2")), formKeepalive())
+		case msgUpdate:
+			withdrawn, announced, err := parseUpdate(body)
+			if err != nil {
+				return
+			}
+			if len(announced) > 0 && !bytes.Contains(body, []byte{flagTransitive, attrNextHop, 4, 192, 168, 0, 1}) {
+				return
+			}
+			neighbour.Lock()
+			for _, prefix := range withdrawn {
+				delete(neighbour.announced, prefix.String())
+			}
+			for _, prefix := range announced {
+				neighbour.announced[prefix.String()] = true
+			}
+			neighbour.Unlock()
+		case msgNotification:
+			if body[0] == errCease {
+				close(neighbour.ceased)
+			}
+			return
+		}
+	}
+}
+
+func (neighbour *testNeighbour) awaitAnnounced(t *testing.T, expected int) {
+	for i := 0; ; i++ {
+		neighbour.Lock()
+		announced := len(neighbour.announced)
+		neighbour.Unlock()
+		if announced == expected {
+			return
+		}
+		if i == 100 {
+			wt.Fatalf(t, "Expected %d prefixes announced, got %d", expected, announced)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestSpeaker(t *testing.T) {
+	neighbour := newTestNeighbour(t)
+	defer neighbour.listener.Close()
+
+	var lock sync.Mutex
+	prefixes := parseCIDRs(t, "10.32.0.0/13", "10.40.0.0/14", "fd00::/64")
+	source := func() []*net.IPNet {
+		lock.Lock()
+		defer lock.Unlock()
+		return prefixes
+	}
+	speaker := NewSpeaker(65000, nil, net.ParseIP("192.168.0.1").To4(), []Neighbour{{neighbour.listener.Addr().String(), 65000}}, source)
+	speaker.refresh = 50 * time.Millisecond
+	speaker.Start()
+
+	// IPv4 prefixes only
+	neighbour.awaitAnnounced(t, 2)
+	neighbour.Lock()
+	if !neighbour.announced["10.40.0.0/14"] || neighbour.open.as != 65000 || !neighbour.open.fourOctet ||
+		!neighbour.open.id.Equal(net.ParseIP("127.0.0.1")) {
+		wt.Fatalf(t, "Unexpected OPEN %+v or prefixes %v", neighbour.open, neighbour.announced)
+	}
+	neighbour.Unlock()
+
+	lock.Lock()
+	prefixes = parseCIDRs(t, "10.32.0.0/13", "10.44.0.0/14", "10.48.0.0/16")
+	lock.Unlock()
+	neighbour.awaitAnnounced(t, 3)
+	neighbour.Lock()
+	if neighbour.announced["10.40.0.0/14"] {
+		wt.Fatalf(t, "Expected 10.40.0.0/14 to be withdrawn")
+	}
+	neighbour.Unlock()
+
+	// Stopping withdraws the lot
+	speaker.Stop()
+	select {
+	case <-neighbour.ceased:
+	case <-time.After(time.Second):
+		wt.Fatalf(t, "Expected the session to cease")
+	}
+	neighbour.awaitAnnounced(t, 0)
+}
@@ -0,0 +1,238 @@
+package discovery
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EC2 instances with a tag, found with the EC2 API in the region we
+// run in. Credentials come from the usual environment variables, or
+// else the instance's IAM role, which needs ec2:DescribeInstances.
+
+const (
+	awsMetadataURL = "http://169.254.169.254/latest"
+	awsAPIVersion  = "2016-11-15"
+)
+
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	Token           string
+}
+
+type AWS struct {
+	tagKey      string
+	tagValue    string
+	metadataURL string
+	endpoint    string // of the EC2 API; derived from the region if empty
+}
+
+func NewAWS(selector string) (*AWS, error) {
+	parts := strings.SplitN(selector, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, fmt.Errorf("invalid AWS selector %q; expected <tag key>=<tag value>", selector)
+	}
+	return &AWS{tagKey: parts[0], tagValue: parts[1], metadataURL: awsMetadataURL}, nil
+}
+
+func (aws *AWS) String() string {
+	return fmt.Sprintf("aws:%s=%s", aws.tagKey, aws.tagValue)
+}
+
+type describeInstancesResponse struct {
+	Reservations []struct {
+		Instances []struct {
+			PrivateIP string `xml:"privateIpAddress"`
+		} `xml:"instancesSet>item"`
+	} `xml:"reservationSet>item"`
+	NextToken string `xml:"nextToken"`
+}
+
+func (aws *AWS) Addresses() ([]string, error) {
+	token, err := aws.metadataToken()
+	if err != nil {
+		return nil, err
+	}
+	zone, err := aws.metadata(token, "/meta-data/placement/availability-zone")
+	if err != nil {
+		return nil, err
+	}
+	region := strings.TrimRight(zone, "abcdefghijklmnopqrstuvwxyz")
+	creds, err := aws.credentials(token)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := aws.endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://ec2.%s.amazonaws.com/", region)
+	}
+	var addresses []string
+	for nextToken := ""; ; {
+		query := url.Values{
+			"Action":           {"DescribeInstances"},
+			"Version":          {awsAPIVersion},
+			"Filter.1.Name":    {"tag:" + aws.tagKey},
+			"Filter.1.Value.1": {aws.tagValue},
+			"Filter.2.Name":    {"instance-state-name"},
+			"Filter.2.Value.1": {"running"}}
+		if nextToken != "" {
+			query.Set("NextToken", nextToken)
+		}
+		req, err := http.NewRequest("GET", endpoint+"?"+awsQuery(query), nil)
+		if err != nil {
+			return nil, err
+		}
+		signAWSv4(req, creds, region, "ec2", time.Now())
+		resp, err := checkResponse(httpClient.Do(req))
+		if err != nil {
+			return nil, err
+		}
+		var result describeInstancesResponse
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, reservation := range result.Reservations {
+			for _, instance := range reservation.Instances {
+				if instance.PrivateIP != "" {
+					addresses = append(addresses, instance.PrivateIP)
+				}
+			}
+		}
+		if nextToken = result.NextToken; nextToken == "" {
+			return addresses, nil
+		}
+	}
+}
+
+// A session token for the instance metadata service (IMDSv2).
+func (aws *AWS) metadataToken() (string, error) {
+	req, err := http.NewRequest("PUT", aws.metadataURL+"/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	return readBody(checkResponse(httpClient.Do(req)))
+}
+
+func (aws *AWS) metadata(token, path string) (string, error) {
+	req, err := http.NewRequest("GET", aws.metadataURL+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	return readBody(checkResponse(httpClient.Do(req)))
+}
+
+func (aws *AWS) credentials(token string) (*awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &awsCredentials{AccessKeyID: id, SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"), Token: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	role, err := aws.metadata(token, "/meta-data/iam/security-credentials/")
+	if err != nil {
+		return nil, fmt.Errorf("no AWS credentials in the environment, nor an IAM role: %v", err)
+	}
+	role = strings.TrimSpace(strings.SplitN(role, "\n", 2)[0])
+	body, err := aws.metadata(token, "/meta-data/iam/security-credentials/"+role)
+	if err != nil {
+		return nil, err
+	}
+	var creds awsCredentials
+	if err := json.Unmarshal([]byte(body), &creds); err != nil {
+		return nil, err
+	}
+	return &creds, nil
+}
+
+func readBody(resp *http.Response, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+// Query strings as AWS signs them: sorted, with RFC 3986 escaping.
+func awsQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			params = append(params, awsEscape(key)+"="+awsEscape(value))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+func awsEscape(s string) string {
+	return strings.Replace(strings.Replace(url.QueryEscape(s), "+", "%20", -1), "%7E", "~", -1)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Sign a request without a body with AWS Signature Version 4, over
+// its host and the headers it already has. The query must already be
+// in canonical form; see awsQuery.
+func signAWSv4(req *http.Request, creds *awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{req.Method, path, req.URL.RawQuery,
+		canonicalHeaders, signedHeaders, sha256Hex(nil)}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
@@ -0,0 +1,68 @@
+package discovery
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The example from the AWS Signature Version 4 documentation
+func TestSignAWSv4(t *testing.T) {
+	req, err := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	wt.AssertNoErr(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	creds := &awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	signAWSv4(req, creds, "us-east-1", "iam", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	wt.AssertEqualString(t, req.Header.Get("Authorization"),
+		"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7",
+		"authorization")
+}
+
+func TestAWSAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/token":
+			w.Write([]byte("token"))
+		case r.Header.Get("X-aws-ec2-metadata-token") != "token":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/meta-data/placement/availability-zone":
+			w.Write([]byte("eu-west-1b"))
+		case r.URL.Path == "/meta-data/iam/security-credentials/":
+			w.Write([]byte("weave-role"))
+		case r.URL.Path == "/meta-data/iam/security-credentials/weave-role":
+			w.Write([]byte(`{"AccessKeyId":"AKID","SecretAccessKey":"secret","Token":"session"}`))
+		}
+	}))
+	defer server.Close()
+	var queries []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/ec2/aws4_request") || r.Header.Get("X-Amz-Security-Token") != "session" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		queries = append(queries, r.URL.RawQuery)
+		if r.URL.Query().Get("NextToken") == "" {
+			w.Write([]byte(`<DescribeInstancesResponse><reservationSet><item><instancesSet>
+<item><privateIpAddress>10.0.0.1</privateIpAddress></item><item><privateIpAddress>10.0.0.2</privateIpAddress></item>
+</instancesSet></item></reservationSet><nextToken>more</nextToken></DescribeInstancesResponse>`))
+			return
+		}
+		w.Write([]byte(`<DescribeInstancesResponse><reservationSet><item><instancesSet>
+<item><privateIpAddress>10.0.0.3</privateIpAddress></item></instancesSet></item></reservationSet></DescribeInstancesResponse>`))
+	}))
+	defer api.Close()
+
+	aws, err := NewAWS("weave cluster=prod")
+	wt.AssertNoErr(t, err)
+	aws.metadataURL, aws.endpoint = server.URL, api.URL+"/"
+	addresses, err := aws.Addresses()
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, strings.Join(addresses, " "), "10.0.0.1 10.0.0.2 10.0.0.3", "addresses")
+	wt.AssertEqualInt(t, len(queries), 2, "pages")
+	if !strings.Contains(queries[0], "Filter.1.Name=tag%3Aweave%20cluster") {
+		wt.Fatalf(t, "Expected query to filter by tag, got %s", queries[0])
+	}
+}
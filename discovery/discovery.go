@@ -0,0 +1,169 @@
+package discovery
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Peers can find each other through the APIs of the cloud they run
+// in, rather than from a static list of addresses, so that clusters
+// bootstrap the mesh by themselves. Providers list the addresses of
+// the instances that should be peers, e.g. those with some tag, and
+// we poll them, connecting to the addresses which show up and
+// forgetting those which go away. Peers we find that way then tell us
+// about any others through gossip as usual.
+
+const (
+	DefaultInterval = 1 * time.Minute
+	requestTimeout  = 10 * time.Second
+)
+
+type Provider interface {
+	// The IP addresses of the instances that should be peers, which
+	// may include ourselves.
+	Addresses() ([]string, error)
+	String() string
+}
+
+// Parse a comma-separated list of provider specs:
+//
+//	aws:<tag key>=<tag value>     EC2 instances with the tag, in our region
+//	gce:<zone>/<instance group>   members of the GCE instance group
+//	lan[:<network name>]          peers announcing themselves on our LANs
+func ParseProviders(spec string) ([]Provider, error) {
+	var providers []Provider
+	for _, field := range strings.Split(spec, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		if field == "lan" {
+			field = "lan:"
+		}
+		parts := strings.SplitN(field, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid discovery provider %q; expected <provider>:<selector>", field)
+		}
+		var provider Provider
+		var err error
+		switch parts[0] {
+		case "aws":
+			provider, err = NewAWS(parts[1])
+		case "gce":
+			provider, err = NewGCE(parts[1])
+		case "lan":
+			provider, err = NewLAN(parts[1])
+		default:
+			err = fmt.Errorf("unknown discovery provider %q; expected aws, gce or lan", parts[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, provider)
+	}
+	return providers, nil
+}
+
+type Discoverer struct {
+	providers []Provider
+	interval  time.Duration
+	port      int
+	connect   func(address string)
+	forget    func(address string)
+	local     func() map[string]bool
+	known     map[string]bool // addresses we asked to connect to
+}
+
+// connect and forget get peer addresses of the form <ip>:<port>.
+func NewDiscoverer(providers []Provider, interval time.Duration, port int, connect, forget func(string)) *Discoverer {
+	return &Discoverer{
+		providers: providers,
+		interval:  interval,
+		port:      port,
+		connect:   connect,
+		forget:    forget,
+		local:     localAddresses,
+		known:     make(map[string]bool)}
+}
+
+func (d *Discoverer) Start() {
+	go func() {
+		for {
+			d.poll()
+			time.Sleep(d.interval)
+		}
+	}()
+}
+
+func (d *Discoverer) poll() {
+	found := make(map[string]bool)
+	local := d.local()
+	for _, provider := range d.providers {
+		addresses, err := provider.Addresses()
+		if err != nil {
+			// Keep what we know, rather than forgetting peers while
+			// the API is unavailable.
+			log.Printf("Unable to discover peers with %v: %v", provider, err)
+			return
+		}
+		for _, address := range addresses {
+			if !local[address] {
+				found[net.JoinHostPort(address, fmt.Sprint(d.port))] = true
+			}
+		}
+	}
+	for _, address := range sortedKeys(found) {
+		if !d.known[address] {
+			log.Println("Discovered peer at", address)
+			d.connect(address)
+		}
+	}
+	for _, address := range sortedKeys(d.known) {
+		if !found[address] {
+			log.Println("Peer at", address, "no longer discovered")
+			d.forget(address)
+		}
+	}
+	d.known = found
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Our own addresses, which we don't want to connect to.
+func localAddresses() map[string]bool {
+	local := make(map[string]bool)
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return local
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			local[ipNet.IP.String()] = true
+		}
+	}
+	return local
+}
+
+var httpClient = &http.Client{Timeout: requestTimeout}
+
+func checkResponse(resp *http.Response, err error) (*http.Response, error) {
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", resp.Request.Method, resp.Request.URL, resp.Status)
+	}
+	return resp, nil
+}
@@ -0,0 +1,51 @@
+package discovery
+
+import (
+	"fmt"
+	wt "github.com/zettio/weave/testing"
+	"strings"
+	"testing"
+)
+
+type staticProvider struct {
+	addresses []string
+	err       error
+}
+
+func (p *staticProvider) Addresses() ([]string, error) { return p.addresses, p.err }
+func (p *staticProvider) String() string               { return "static" }
+
+func TestParseProviders(t *testing.T) {
+	providers, err := ParseProviders("aws:weave=prod, gce:europe-west1-b/weave")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(providers), 2, "providers")
+	wt.AssertEqualString(t, providers[1].String(), "gce:europe-west1-b/weave", "provider")
+	for _, spec := range []string{"aws", "aws:weave", "gce:weave", "azure:weave=prod"} {
+		if _, err := ParseProviders(spec); err == nil {
+			wt.Fatalf(t, "Expected an error parsing %q", spec)
+		}
+	}
+}
+
+func TestDiscovererPoll(t *testing.T) {
+	provider := &staticProvider{addresses: []string{"10.0.0.1", "10.0.0.2", "10.0.0.9"}}
+	var events []string
+	d := NewDiscoverer([]Provider{provider}, DefaultInterval, 6783,
+		func(address string) { events = append(events, "+"+address) },
+		func(address string) { events = append(events, "-"+address) })
+	d.local = func() map[string]bool { return map[string]bool{"10.0.0.9": true} }
+
+	d.poll()
+	wt.AssertEqualString(t, strings.Join(events, " "), "+10.0.0.1:6783 +10.0.0.2:6783", "first poll")
+
+	events = nil
+	provider.addresses = []string{"10.0.0.2", "10.0.0.3"}
+	d.poll()
+	wt.AssertEqualString(t, strings.Join(events, " "), "+10.0.0.3:6783 -10.0.0.1:6783", "second poll")
+
+	// Failures don't make us forget anybody
+	events = nil
+	provider.err = fmt.Errorf("unavailable")
+	d.poll()
+	wt.AssertEqualInt(t, len(events), 0, "events")
+}
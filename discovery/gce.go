@@ -0,0 +1,115 @@
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Running members of a GCE instance group, found with the Compute
+// Engine API in our project, using the instance's service account,
+// which needs read access to Compute Engine.
+
+const (
+	gceMetadataURL = "http://metadata.google.internal/computeMetadata/v1"
+	gceComputeURL  = "https://compute.googleapis.com/compute/v1"
+)
+
+type GCE struct {
+	zone        string
+	group       string
+	metadataURL string
+	computeURL  string
+}
+
+func NewGCE(selector string) (*GCE, error) {
+	parts := strings.SplitN(selector, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid GCE selector %q; expected <zone>/<instance group>", selector)
+	}
+	return &GCE{zone: parts[0], group: parts[1], metadataURL: gceMetadataURL, computeURL: gceComputeURL}, nil
+}
+
+func (gce *GCE) String() string {
+	return fmt.Sprintf("gce:%s/%s", gce.zone, gce.group)
+}
+
+func (gce *GCE) Addresses() ([]string, error) {
+	project, err := gce.metadata("/project/project-id")
+	if err != nil {
+		return nil, err
+	}
+	tokenJSON, err := gce.metadata("/instance/service-accounts/default/token")
+	if err != nil {
+		return nil, err
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal([]byte(tokenJSON), &token); err != nil {
+		return nil, err
+	}
+	groupURL := fmt.Sprintf("%s/projects/%s/zones/%s/instanceGroups/%s/listInstances",
+		gce.computeURL, url.QueryEscape(project), url.QueryEscape(gce.zone), url.QueryEscape(gce.group))
+	var addresses []string
+	for pageToken := ""; ; {
+		listURL := groupURL
+		if pageToken != "" {
+			listURL += "?pageToken=" + url.QueryEscape(pageToken)
+		}
+		var members struct {
+			Items []struct {
+				Instance string `json:"instance"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := gce.call("POST", listURL, token.AccessToken, `{"instanceState":"RUNNING"}`, &members); err != nil {
+			return nil, err
+		}
+		for _, member := range members.Items {
+			var instance struct {
+				NetworkInterfaces []struct {
+					NetworkIP string `json:"networkIP"`
+				} `json:"networkInterfaces"`
+			}
+			if err := gce.call("GET", member.Instance, token.AccessToken, "", &instance); err != nil {
+				return nil, err
+			}
+			if len(instance.NetworkInterfaces) > 0 {
+				addresses = append(addresses, instance.NetworkInterfaces[0].NetworkIP)
+			}
+		}
+		if pageToken = members.NextPageToken; pageToken == "" {
+			return addresses, nil
+		}
+	}
+}
+
+func (gce *GCE) metadata(path string) (string, error) {
+	req, err := http.NewRequest("GET", gce.metadataURL+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	return readBody(checkResponse(httpClient.Do(req)))
+}
+
+func (gce *GCE) call(method, target, accessToken, body string, result interface{}) error {
+	req, err := http.NewRequest(method, target, bytes.NewBufferString(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := checkResponse(httpClient.Do(req))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(result)
+}
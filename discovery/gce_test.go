@@ -0,0 +1,44 @@
+package discovery
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGCEAddresses(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metadata/project/project-id":
+			w.Write([]byte("proj"))
+		case "/metadata/instance/service-accounts/default/token":
+			w.Write([]byte(`{"access_token":"tok"}`))
+		default:
+			if r.Header.Get("Authorization") != "Bearer tok" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			switch r.URL.Path {
+			case "/compute/projects/proj/zones/us-central1-a/instanceGroups/weave/listInstances":
+				w.Write([]byte(`{"items":[{"instance":"` + server.URL + `/compute/instances/a"},{"instance":"` + server.URL + `/compute/instances/b"}]}`))
+			case "/compute/instances/a":
+				w.Write([]byte(`{"networkInterfaces":[{"networkIP":"10.128.0.2"}]}`))
+			case "/compute/instances/b":
+				w.Write([]byte(`{"networkInterfaces":[{"networkIP":"10.128.0.3"}]}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}
+	}))
+	defer server.Close()
+
+	gce, err := NewGCE("us-central1-a/weave")
+	wt.AssertNoErr(t, err)
+	gce.metadataURL, gce.computeURL = server.URL+"/metadata", server.URL+"/compute"
+	addresses, err := gce.Addresses()
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, strings.Join(addresses, " "), "10.128.0.2 10.128.0.3", "addresses")
+}
@@ -0,0 +1,150 @@
+package discovery
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Peers on the same LAN can find each other without any API: every
+// peer announces itself with a UDP broadcast on LANPort to each of its
+// IPv4 subnets, and hears the announcements of the others. Peers are
+// the senders of the announcements we heard lately, for the same
+// network name, so that separate meshes on a LAN stay apart. When
+// running in a container, that needs the host's network.
+
+const (
+	LANPort         = 6785
+	lanMagic        = "weave-lan"
+	lanVersion      = "1"
+	lanAnnounceIntv = 10 * time.Second
+	lanMaxAge       = 3 * lanAnnounceIntv // after which we forget peers we no longer hear from
+)
+
+type LAN struct {
+	sync.Mutex
+	network string
+	conn    *net.UDPConn
+	heard   map[string]time.Time // when we last heard from each address
+	now     func() time.Time
+}
+
+func NewLAN(network string) (*LAN, error) {
+	if strings.ContainsAny(network, " \t\n") {
+		return nil, fmt.Errorf("invalid LAN network name %q", network)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: LANPort})
+	if err != nil {
+		return nil, err
+	}
+	lan := newLAN(network)
+	lan.conn = conn
+	go lan.listen()
+	go lan.announce()
+	return lan, nil
+}
+
+func newLAN(network string) *LAN {
+	return &LAN{network: network, heard: make(map[string]time.Time), now: time.Now}
+}
+
+func (lan *LAN) String() string {
+	if lan.network == "" {
+		return "lan"
+	}
+	return "lan:" + lan.network
+}
+
+func (lan *LAN) message() []byte {
+	return []byte(strings.TrimSpace(fmt.Sprintf("%s %s %s", lanMagic, lanVersion, lan.network)))
+}
+
+func (lan *LAN) announce() {
+	for {
+		for _, addr := range broadcastAddresses() {
+			if _, err := lan.conn.WriteToUDP(lan.message(), &net.UDPAddr{IP: addr, Port: LANPort}); err != nil {
+				log.Printf("Unable to announce ourselves to %v: %v", addr, err)
+			}
+		}
+		time.Sleep(lanAnnounceIntv)
+	}
+}
+
+func (lan *LAN) listen() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := lan.conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Println("Unable to receive LAN announcements:", err)
+			return
+		}
+		lan.received(buf[:n], addr.IP)
+	}
+}
+
+func (lan *LAN) received(msg []byte, from net.IP) {
+	fields := strings.Fields(string(msg))
+	network := ""
+	if len(fields) > 2 {
+		network = fields[2]
+	}
+	if len(fields) < 2 || fields[0] != lanMagic || fields[1] != lanVersion || network != lan.network {
+		return
+	}
+	lan.Lock()
+	defer lan.Unlock()
+	lan.heard[from.String()] = lan.now()
+}
+
+func (lan *LAN) Addresses() ([]string, error) {
+	lan.Lock()
+	defer lan.Unlock()
+	addresses := []string{}
+	for address, last := range lan.heard {
+		if lan.now().Sub(last) > lanMaxAge {
+			delete(lan.heard, address)
+			continue
+		}
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+// The broadcast addresses of our IPv4 subnets, other than loopback.
+func broadcastAddresses() []net.IP {
+	var addrs []net.IP
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagBroadcast == 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range ifaceAddrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+			ip, mask := ipNet.IP.To4(), ipNet.Mask
+			if len(mask) == net.IPv6len {
+				mask = mask[12:]
+			}
+			broadcast := make(net.IP, net.IPv4len)
+			for i := range ip {
+				broadcast[i] = ip[i] | ^mask[i]
+			}
+			addrs = append(addrs, broadcast)
+		}
+	}
+	return addrs
+}
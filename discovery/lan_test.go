@@ -0,0 +1,28 @@
+package discovery
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLANAnnouncements(t *testing.T) {
+	now := time.Now()
+	lan := newLAN("lab")
+	lan.now = func() time.Time { return now }
+	lan.received(lan.message(), net.ParseIP("10.0.0.2"))
+	lan.received([]byte("weave-lan 1 other"), net.ParseIP("10.0.0.3"))
+	lan.received([]byte("weave-lan 1"), net.ParseIP("10.0.0.4"))
+	lan.received([]byte("something else"), net.ParseIP("10.0.0.5"))
+	now = now.Add(lanAnnounceIntv)
+	lan.received([]byte("weave-lan 1 lab"), net.ParseIP("10.0.0.1"))
+	addresses, _ := lan.Addresses()
+	wt.AssertEqualString(t, strings.Join(addresses, " "), "10.0.0.1 10.0.0.2", "addresses")
+
+	// Peers we no longer hear from go
+	now = now.Add(lanMaxAge)
+	addresses, _ = lan.Addresses()
+	wt.AssertEqualString(t, strings.Join(addresses, " "), "10.0.0.1", "addresses")
+}
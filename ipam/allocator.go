@@ -0,0 +1,520 @@
+package ipam
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/zettio/weave/router"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Hands out addresses from the allocation range to containers on this
+// peer, identified by their container IDs, from the blocks of the ring
+// we own. When we run out, we ask the peer advertising the most free
+// addresses to give us some, and it splits off part of one of its
+// blocks for us. While the ring is empty, the peer with the lowest name
+// we know of claims the whole range when first asked, whether by
+// ourselves or by another peer.
+//
+// With a state file, the ring and our allocations survive restarts;
+// without one we still learn which blocks are ours from the other
+// peers, but forget which addresses we handed out.
+//
+// All peers need the same allocation range; we ignore ring gossip from
+// peers with a different one.
+
+const (
+	AllocateTimeout = 30 * time.Second
+	RequestInterval = 2 * time.Second // between requests for addresses while we wait for some
+	msgSpaceRequest = 1
+)
+
+var ErrNoRange = errors.New("no allocation range configured")
+
+type Allocator struct {
+	sync.Mutex
+	ourName   router.PeerName
+	peers     *router.Peers
+	gossip    router.Gossip
+	universe  *net.IPNet
+	ring      *Ring             // nil without an allocation range
+	owned     map[string]uint32 // container -> address
+	inUse     map[uint32]string // address -> container
+	changed   chan struct{}     // closed, and replaced, when the ring changes
+	statePath string
+}
+
+// What we keep in the state file
+type allocatorState struct {
+	Range       string
+	Ring        RingState
+	Allocations map[string]string // container -> address
+}
+
+// Set up an allocator for the range, which may be nil for peers which
+// don't allocate addresses but still need to take part in the gossip,
+// restoring its state from the file at statePath, if given and there.
+func NewAllocator(ourName router.PeerName, peers *router.Peers, universe *net.IPNet, statePath string) (*Allocator, error) {
+	alloc := &Allocator{
+		ourName:   ourName,
+		peers:     peers,
+		universe:  universe,
+		owned:     make(map[string]uint32),
+		inUse:     make(map[uint32]string),
+		changed:   make(chan struct{}),
+		statePath: statePath}
+	if universe == nil {
+		return alloc, nil
+	}
+	block, err := rangeBlock(universe)
+	if err != nil {
+		return nil, err
+	}
+	alloc.ring = NewRing(block, ourName)
+	// The network and broadcast addresses are never free
+	alloc.inUse[block.Start] = ""
+	alloc.inUse[block.End-1] = ""
+	if statePath != "" {
+		if err := alloc.load(); err != nil {
+			return nil, err
+		}
+	}
+	return alloc, nil
+}
+
+func rangeBlock(universe *net.IPNet) (Block, error) {
+	ones, bits := universe.Mask.Size()
+	if universe.IP.To4() == nil || bits != 32 {
+		return Block{}, fmt.Errorf("allocation range %v is not IPv4", universe)
+	}
+	if ones < 8 || ones > 30 {
+		return Block{}, fmt.Errorf("allocation range %v must have a prefix length between 8 and 30", universe)
+	}
+	start := ipToUint32(universe.IP.Mask(universe.Mask))
+	end := start + 1<<uint(32-ones)
+	if end < start {
+		return Block{}, fmt.Errorf("allocation range %v reaches the end of the address space", universe)
+	}
+	return Block{start, end}, nil
+}
+
+func (alloc *Allocator) SetGossip(gossip router.Gossip) {
+	alloc.Lock()
+	defer alloc.Unlock()
+	alloc.gossip = gossip
+}
+
+// Hand the container an address, or the one it has already, waiting up
+// to timeout for another peer to give us some if we have none free.
+func (alloc *Allocator) Allocate(ident string, timeout time.Duration) (*net.IPNet, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		alloc.Lock()
+		if alloc.ring == nil {
+			alloc.Unlock()
+			return nil, ErrNoRange
+		}
+		if addr, found := alloc.owned[ident]; found {
+			alloc.Unlock()
+			return alloc.ipNet(addr), nil
+		}
+		if addr, found := alloc.freeAddress(); found {
+			update := alloc.record(ident, addr)
+			alloc.Unlock()
+			alloc.broadcast(update)
+			return alloc.ipNet(addr), nil
+		}
+		donor, found := alloc.donor()
+		if found && donor == alloc.ourName {
+			// Allocating from it tells everyone
+			alloc.ring.ClaimAll()
+			alloc.Unlock()
+			continue
+		}
+		changed, gossip := alloc.changed, alloc.gossip
+		alloc.Unlock()
+		if found && gossip != nil {
+			checkWarn(gossip.GossipUnicast(donor, []byte{msgSpaceRequest}))
+		}
+		wait := deadline.Sub(time.Now())
+		if wait <= 0 {
+			return nil, fmt.Errorf("no free addresses in %v after waiting %v", alloc.universe, timeout)
+		}
+		if wait > RequestInterval {
+			wait = RequestInterval
+		}
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Record that the container has the address, which must be ours, e.g.
+// because it had it before we restarted without a state file.
+func (alloc *Allocator) Claim(ident string, ip net.IP) error {
+	alloc.Lock()
+	update, err := alloc.claim(ident, ip)
+	alloc.Unlock()
+	alloc.broadcast(update)
+	return err
+}
+
+func (alloc *Allocator) claim(ident string, ip net.IP) ([]byte, error) {
+	if alloc.ring == nil {
+		return nil, ErrNoRange
+	}
+	if ip.To4() == nil || !alloc.universe.Contains(ip) {
+		return nil, fmt.Errorf("address %s is outside the allocation range %v", ip, alloc.universe)
+	}
+	addr := ipToUint32(ip)
+	if owner, found := alloc.inUse[addr]; found && owner != ident {
+		return nil, fmt.Errorf("address %s is in use", ip)
+	}
+	if existing, found := alloc.owned[ident]; found && existing != addr {
+		return nil, fmt.Errorf("%s already has address %s", ident, uint32ToIP(existing))
+	}
+	if owner, found := alloc.ring.Owner(addr); !found || owner != alloc.ourName {
+		return nil, fmt.Errorf("address %s belongs to another peer", ip)
+	}
+	return alloc.record(ident, addr), nil
+}
+
+// Take back the container's address.
+func (alloc *Allocator) Free(ident string) error {
+	alloc.Lock()
+	update, err := alloc.free(ident)
+	alloc.Unlock()
+	alloc.broadcast(update)
+	return err
+}
+
+func (alloc *Allocator) free(ident string) ([]byte, error) {
+	addr, found := alloc.owned[ident]
+	if !found {
+		return nil, fmt.Errorf("%s has no address", ident)
+	}
+	delete(alloc.owned, ident)
+	delete(alloc.inUse, addr)
+	return alloc.allocationsChanged(), nil
+}
+
+// Take back the address, whoever has it; for clients which keep track
+// of addresses rather than containers.
+func (alloc *Allocator) FreeAddress(ip net.IP) error {
+	alloc.Lock()
+	var ident string
+	if alloc.ring != nil && ip.To4() != nil {
+		ident = alloc.inUse[ipToUint32(ip)]
+	}
+	if ident == "" {
+		alloc.Unlock()
+		return fmt.Errorf("address %s is not allocated", ip)
+	}
+	update, err := alloc.free(ident)
+	alloc.Unlock()
+	alloc.broadcast(update)
+	return err
+}
+
+// The allocation range, or nil without one
+func (alloc *Allocator) Universe() *net.IPNet {
+	return alloc.universe
+}
+
+// The prefixes of the blocks of the range we own, e.g. for advertising
+// routes to them, or none without an allocation range.
+func (alloc *Allocator) OwnedPrefixes() []*net.IPNet {
+	alloc.Lock()
+	defer alloc.Unlock()
+	if alloc.ring == nil {
+		return nil
+	}
+	var prefixes []*net.IPNet
+	for _, block := range alloc.ring.OwnedBlocks() {
+		prefixes = append(prefixes, block.Prefixes()...)
+	}
+	return prefixes
+}
+
+func (alloc *Allocator) Lookup(ident string) (*net.IPNet, bool) {
+	alloc.Lock()
+	defer alloc.Unlock()
+	addr, found := alloc.owned[ident]
+	if !found {
+		return nil, false
+	}
+	return alloc.ipNet(addr), true
+}
+
+func (alloc *Allocator) ipNet(addr uint32) *net.IPNet {
+	return &net.IPNet{IP: uint32ToIP(addr), Mask: alloc.universe.Mask}
+}
+
+func (alloc *Allocator) record(ident string, addr uint32) []byte {
+	alloc.owned[ident] = addr
+	alloc.inUse[addr] = ident
+	return alloc.allocationsChanged()
+}
+
+// The first address not in use in the blocks we own
+func (alloc *Allocator) freeAddress() (uint32, bool) {
+	for _, block := range alloc.ring.OwnedBlocks() {
+		for addr := block.Start; addr < block.End; addr++ {
+			if _, found := alloc.inUse[addr]; !found {
+				return addr, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// The peer to ask for addresses: whoever advertises the most free
+// ones, or, while the ring is empty, the peer with the lowest name,
+// which may be ourselves.
+func (alloc *Allocator) donor() (router.PeerName, bool) {
+	var (
+		donor router.PeerName
+		found bool
+	)
+	if alloc.ring.Empty() {
+		alloc.peers.ForEach(func(name router.PeerName, _ *router.Peer) {
+			if !found || name < donor {
+				donor, found = name, true
+			}
+		})
+		return donor, found
+	}
+	var most uint32
+	for name, free := range alloc.ring.FreeByPeer() {
+		if _, known := alloc.peers.Fetch(name); known && name != alloc.ourName && free > most {
+			donor, most, found = name, free, true
+		}
+	}
+	return donor, found
+}
+
+func (alloc *Allocator) sortedInUse() []uint32 {
+	addrs := make([]uint32, 0, len(alloc.inUse))
+	for addr := range alloc.inUse {
+		addrs = append(addrs, addr)
+	}
+	sort.Sort(uint32Slice(addrs))
+	return addrs
+}
+
+// Recount our free addresses, returning the ring to tell everyone
+// about if the counts changed.
+func (alloc *Allocator) allocationsChanged() []byte {
+	if alloc.ring.UpdateFree(alloc.sortedInUse()) {
+		return alloc.ringChanged()
+	}
+	alloc.save()
+	return nil
+}
+
+// Wake up anyone waiting for addresses after a change to the ring,
+// returning the ring to tell everyone about.
+func (alloc *Allocator) ringChanged() []byte {
+	alloc.save()
+	close(alloc.changed)
+	alloc.changed = make(chan struct{})
+	return alloc.encode()
+}
+
+// Send our changes to the ring to everyone. Like other gossipers, we
+// don't do that while holding our lock.
+func (alloc *Allocator) broadcast(update []byte) {
+	alloc.Lock()
+	gossip := alloc.gossip
+	alloc.Unlock()
+	if update != nil && gossip != nil {
+		checkWarn(gossip.GossipBroadcast(update))
+	}
+}
+
+func (alloc *Allocator) OnGossipUnicast(sender router.PeerName, msg []byte) error {
+	if len(msg) != 1 || msg[0] != msgSpaceRequest {
+		return fmt.Errorf("unexpected ipam gossip unicast from %s", sender)
+	}
+	alloc.Lock()
+	if alloc.ring == nil {
+		alloc.Unlock()
+		return nil
+	}
+	// We only get asked while the ring is empty when we have the
+	// lowest name the sender knows of
+	claimed := alloc.ring.ClaimAll()
+	var update []byte
+	if alloc.ring.Donate(sender, alloc.sortedInUse()) || claimed {
+		alloc.ring.UpdateFree(alloc.sortedInUse())
+		update = alloc.ringChanged()
+	}
+	alloc.Unlock()
+	alloc.broadcast(update)
+	return nil
+}
+
+// Broadcasts get relayed for us, but any changes to our own tokens
+// they lead to need sending separately.
+func (alloc *Allocator) OnGossipBroadcast(msg []byte) error {
+	alloc.Lock()
+	changed, ours, err := alloc.merge(msg)
+	var update []byte
+	if changed && ours {
+		update = alloc.encode()
+	}
+	alloc.Unlock()
+	alloc.broadcast(update)
+	return err
+}
+
+func (alloc *Allocator) Gossip() []byte {
+	alloc.Lock()
+	defer alloc.Unlock()
+	if alloc.ring == nil {
+		return nil
+	}
+	return alloc.encode()
+}
+
+func (alloc *Allocator) OnGossip(buf []byte) ([]byte, error) {
+	alloc.Lock()
+	defer alloc.Unlock()
+	if changed, _, err := alloc.merge(buf); err != nil || !changed {
+		return nil, err
+	}
+	return alloc.encode(), nil
+}
+
+// Merge the received ring into ours, returning whether that changed
+// anything, and whether it changed our own tokens, in which case the
+// change needs gossiping.
+func (alloc *Allocator) merge(buf []byte) (changed bool, ours bool, err error) {
+	if alloc.ring == nil || len(buf) == 0 {
+		return false, false, nil
+	}
+	var state RingState
+	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&state); err != nil {
+		return false, false, err
+	}
+	if changed, err = alloc.ring.Merge(state); err != nil {
+		// Peers with a different range are misconfigured, which is
+		// no reason to drop our connections to them
+		log.Println("Ignoring ipam gossip:", err)
+		return false, false, nil
+	}
+	if !changed {
+		return false, false, nil
+	}
+	alloc.checkAllocations()
+	ours = alloc.ring.UpdateFree(alloc.sortedInUse())
+	alloc.ringChanged()
+	return true, ours, nil
+}
+
+// Complain about addresses we handed out which now belong to someone
+// else, after losing a conflicting claim.
+func (alloc *Allocator) checkAllocations() {
+	for ident, addr := range alloc.owned {
+		if owner, _ := alloc.ring.Owner(addr); owner != alloc.ourName {
+			log.Printf("Address %s of %s now belongs to %s", uint32ToIP(addr), ident, owner)
+		}
+	}
+}
+
+func (alloc *Allocator) encode() []byte {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(alloc.ring.State()); err != nil {
+		log.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func (alloc *Allocator) save() {
+	if alloc.statePath == "" {
+		return
+	}
+	state := allocatorState{Range: alloc.universe.String(), Ring: alloc.ring.State(), Allocations: make(map[string]string)}
+	for ident, addr := range alloc.owned {
+		state.Allocations[ident] = uint32ToIP(addr).String()
+	}
+	data, err := json.Marshal(state)
+	if err == nil {
+		// Write to a new file and rename it, so we never leave a
+		// partly written one behind
+		tmpPath := alloc.statePath + ".tmp"
+		if err = ioutil.WriteFile(tmpPath, data, 0600); err == nil {
+			err = os.Rename(tmpPath, alloc.statePath)
+		}
+	}
+	checkWarn(err)
+}
+
+func (alloc *Allocator) load() error {
+	data, err := ioutil.ReadFile(alloc.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var state allocatorState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("Unable to parse allocator state in %s: %v", alloc.statePath, err)
+	}
+	if state.Range != alloc.universe.String() {
+		return fmt.Errorf("Allocator state in %s is for range %s, not %v", alloc.statePath, state.Range, alloc.universe)
+	}
+	if _, err := alloc.ring.Merge(state.Ring); err != nil {
+		return err
+	}
+	for ident, ipStr := range state.Allocations {
+		ip := net.ParseIP(ipStr)
+		if ip == nil || ip.To4() == nil || !alloc.universe.Contains(ip) {
+			return fmt.Errorf("Invalid address %s in allocator state in %s", ipStr, alloc.statePath)
+		}
+		alloc.owned[ident] = ipToUint32(ip)
+		alloc.inUse[ipToUint32(ip)] = ident
+	}
+	return nil
+}
+
+func (alloc *Allocator) String() string {
+	alloc.Lock()
+	defer alloc.Unlock()
+	if alloc.ring == nil {
+		return "No allocation range\n"
+	}
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintln("Allocation range", alloc.universe))
+	buf.WriteString(alloc.ring.String())
+	idents := make([]string, 0, len(alloc.owned))
+	for ident := range alloc.owned {
+		idents = append(idents, ident)
+	}
+	sort.Strings(idents)
+	for _, ident := range idents {
+		buf.WriteString(fmt.Sprintln(ident, uint32ToIP(alloc.owned[ident])))
+	}
+	return buf.String()
+}
+
+type uint32Slice []uint32
+
+func (s uint32Slice) Len() int           { return len(s) }
+func (s uint32Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func checkWarn(err error) {
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,124 @@
+package ipam
+
+import (
+	"github.com/zettio/weave/router"
+	wt "github.com/zettio/weave/testing"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Delivers gossip between allocators directly
+type mockGossip struct {
+	sender *Allocator
+	peers  map[router.PeerName]*Allocator
+}
+
+func (g *mockGossip) GossipUnicast(dst router.PeerName, buf []byte) error {
+	return g.peers[dst].OnGossipUnicast(g.sender.ourName, buf)
+}
+
+func (g *mockGossip) GossipBroadcast(buf []byte) error {
+	for name, alloc := range g.peers {
+		if name != g.sender.ourName {
+			if err := alloc.OnGossipBroadcast(buf); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func makePeers(names ...router.PeerName) *router.Peers {
+	peers := router.NewPeers(router.NewPeer(names[0], 0, 0), func(*router.Peer) {}, func(*router.Peer) {})
+	for _, name := range names {
+		peers.FetchWithDefault(router.NewPeer(name, 0, 0))
+	}
+	return peers
+}
+
+func TestAllocate(t *testing.T) {
+	name1, _ := router.PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := router.PeerNameFromString("02:00:00:01:00:00")
+	_, universe, _ := net.ParseCIDR("10.0.0.0/29")
+	alloc1, err := NewAllocator(name1, makePeers(name1, name2), universe, "")
+	wt.AssertNoErr(t, err)
+	alloc2, err := NewAllocator(name2, makePeers(name2, name1), universe, "")
+	wt.AssertNoErr(t, err)
+	peers := map[router.PeerName]*Allocator{name1: alloc1, name2: alloc2}
+	alloc1.SetGossip(&mockGossip{alloc1, peers})
+	alloc2.SetGossip(&mockGossip{alloc2, peers})
+
+	// The peer with the lower name claims the range on being asked,
+	// and hands half of it over
+	addr, err := alloc2.Allocate("a", time.Second)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, addr.String(), "10.0.0.4/29", "address")
+	addr, err = alloc2.Allocate("a", time.Second)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, addr.String(), "10.0.0.4/29", "address of the same container")
+	addr, err = alloc1.Allocate("b", time.Second)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, addr.String(), "10.0.0.1/29", "address")
+
+	wt.AssertNoErr(t, alloc1.Claim("c", net.ParseIP("10.0.0.3")))
+	if err := alloc1.Claim("d", net.ParseIP("10.0.0.3")); err == nil {
+		wt.Fatalf(t, "Expected claiming an address in use to fail")
+	}
+	if err := alloc1.Claim("d", net.ParseIP("10.0.0.5")); err == nil {
+		wt.Fatalf(t, "Expected claiming an address of another peer to fail")
+	}
+
+	// alloc1 has 10.0.0.2 left, then has to ask alloc2
+	addr, err = alloc1.Allocate("d", time.Second)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, addr.String(), "10.0.0.2/29", "address")
+	addr, err = alloc1.Allocate("e", time.Second)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, addr.String(), "10.0.0.6/29", "address")
+	addr, err = alloc2.Allocate("f", time.Second)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, addr.String(), "10.0.0.5/29", "address")
+	if _, err := alloc2.Allocate("g", 100*time.Millisecond); err == nil {
+		wt.Fatalf(t, "Expected the range to be exhausted")
+	}
+
+	wt.AssertNoErr(t, alloc2.Free("a"))
+	if err := alloc2.Free("a"); err == nil {
+		wt.Fatalf(t, "Expected freeing twice to fail")
+	}
+	addr, err = alloc2.Allocate("g", time.Second)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, addr.String(), "10.0.0.4/29", "address")
+}
+
+func TestAllocatorPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipam")
+	wt.AssertNoErr(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ipam.json")
+	name1, _ := router.PeerNameFromString("01:00:00:01:00:00")
+	_, universe, _ := net.ParseCIDR("10.0.0.0/24")
+
+	alloc, err := NewAllocator(name1, makePeers(name1), universe, path)
+	wt.AssertNoErr(t, err)
+	addr, err := alloc.Allocate("a", time.Second)
+	wt.AssertNoErr(t, err)
+
+	alloc, err = NewAllocator(name1, makePeers(name1), universe, path)
+	wt.AssertNoErr(t, err)
+	restored, found := alloc.Lookup("a")
+	if !found {
+		wt.Fatalf(t, "Expected the allocation to survive")
+	}
+	wt.AssertEqualString(t, restored.String(), addr.String(), "address")
+	wt.AssertEqualInt(t, len(alloc.ring.OwnedBlocks()), 1, "blocks")
+
+	_, other, _ := net.ParseCIDR("10.0.1.0/24")
+	if _, err := NewAllocator(name1, makePeers(name1), other, path); err == nil {
+		wt.Fatalf(t, "Expected an error restoring the state of another range")
+	}
+}
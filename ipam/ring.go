@@ -0,0 +1,265 @@
+package ipam
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/zettio/weave/router"
+	"net"
+	"sort"
+)
+
+// The addresses of the allocation range are divided up between peers
+// by a ring of tokens: each token marks the start of a block of
+// addresses, which runs up to the next token, or the end of the range,
+// and belongs to the token's owner. Only the owner of a block ever
+// changes it, either by handing part of it to another peer, which it
+// does by inserting tokens, or by updating the count of free addresses
+// in it, and every change bumps the version of the token. So rings
+// merge like other gossiped state: we take on tokens we don't have,
+// and tokens with a higher version than ours.
+//
+// The one conflict is when peers find the ring empty and claim the
+// whole range at the same time. All peers resolve it the same way,
+// keeping the token with the higher version or, failing that, the
+// token of the peer with the lower name, so they end up with the same
+// ring, though the losers may have handed out addresses which now
+// belong to someone else.
+
+type token struct {
+	Start   uint32
+	Owner   router.PeerName
+	Version uint32
+	Free    uint32 // addresses in the block not in use, as last counted by the owner
+}
+
+// A block of addresses, from Start up to, but excluding, End
+type Block struct {
+	Start, End uint32
+}
+
+func (block Block) Size() uint32 {
+	return block.End - block.Start
+}
+
+func (block Block) Contains(addr uint32) bool {
+	return addr >= block.Start && addr < block.End
+}
+
+type Ring struct {
+	Block   // the whole range
+	ourName router.PeerName
+	tokens  []*token // ordered by Start
+}
+
+// What we gossip
+type RingState struct {
+	Start, End uint32
+	Tokens     []token
+}
+
+func NewRing(universe Block, ourName router.PeerName) *Ring {
+	return &Ring{Block: universe, ourName: ourName}
+}
+
+func (ring *Ring) Empty() bool {
+	return len(ring.tokens) == 0
+}
+
+// Claim the whole range, if nobody has yet.
+func (ring *Ring) ClaimAll() bool {
+	if !ring.Empty() {
+		return false
+	}
+	ring.tokens = []*token{{Start: ring.Start, Owner: ring.ourName, Version: 1}}
+	return true
+}
+
+// The block the token at index i starts
+func (ring *Ring) block(i int) Block {
+	end := ring.End
+	if i+1 < len(ring.tokens) {
+		end = ring.tokens[i+1].Start
+	}
+	return Block{ring.tokens[i].Start, end}
+}
+
+func (ring *Ring) Owner(addr uint32) (router.PeerName, bool) {
+	if !ring.Contains(addr) {
+		return router.UnknownPeerName, false
+	}
+	i := sort.Search(len(ring.tokens), func(i int) bool { return ring.tokens[i].Start > addr }) - 1
+	if i < 0 {
+		return router.UnknownPeerName, false
+	}
+	return ring.tokens[i].Owner, true
+}
+
+// The blocks we own, in order
+func (ring *Ring) OwnedBlocks() []Block {
+	var blocks []Block
+	for i, tok := range ring.tokens {
+		if tok.Owner == ring.ourName {
+			blocks = append(blocks, ring.block(i))
+		}
+	}
+	return blocks
+}
+
+// Free addresses advertised by each peer
+func (ring *Ring) FreeByPeer() map[router.PeerName]uint32 {
+	free := make(map[router.PeerName]uint32)
+	for _, tok := range ring.tokens {
+		free[tok.Owner] += tok.Free
+	}
+	return free
+}
+
+// Update the counts of free addresses in the blocks we own, given the
+// addresses in use, ordered. Returns whether any count changed.
+func (ring *Ring) UpdateFree(inUse []uint32) bool {
+	changed := false
+	for i, tok := range ring.tokens {
+		if tok.Owner != ring.ourName {
+			continue
+		}
+		block := ring.block(i)
+		free := block.Size() - uint32(len(inBlock(inUse, block)))
+		if free != tok.Free {
+			tok.Free = free
+			tok.Version++
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Hand the upper half of the longest run of free addresses in the
+// blocks we own to another peer, given the addresses in use, ordered.
+// Returns whether there was a run worth splitting.
+func (ring *Ring) Donate(to router.PeerName, inUse []uint32) bool {
+	var longest, longestIn Block
+	for _, block := range ring.OwnedBlocks() {
+		start := block.Start
+		for _, addr := range append(inBlock(inUse, block), block.End) {
+			if run := (Block{start, addr}); run.Size() > longest.Size() {
+				longest, longestIn = run, block
+			}
+			start = addr + 1
+		}
+	}
+	if longest.Size() < 2 {
+		return false
+	}
+	mid := longest.Start + longest.Size()/2
+	ring.insert(&token{Start: mid, Owner: to, Version: 1, Free: longest.End - mid})
+	// Whatever follows the run in its block stays ours
+	if longest.End < longestIn.End {
+		ring.insert(&token{Start: longest.End, Owner: ring.ourName, Version: 1})
+	}
+	ring.UpdateFree(inUse)
+	return true
+}
+
+// Index of the token starting at addr, or -1
+func (ring *Ring) find(addr uint32) int {
+	i := sort.Search(len(ring.tokens), func(i int) bool { return ring.tokens[i].Start >= addr })
+	if i < len(ring.tokens) && ring.tokens[i].Start == addr {
+		return i
+	}
+	return -1
+}
+
+func (ring *Ring) insert(tok *token) {
+	i := sort.Search(len(ring.tokens), func(i int) bool { return ring.tokens[i].Start >= tok.Start })
+	ring.tokens = append(ring.tokens, nil)
+	copy(ring.tokens[i+1:], ring.tokens[i:])
+	ring.tokens[i] = tok
+}
+
+// Whether the received token should replace ours
+func (tok *token) supersededBy(received *token) bool {
+	return received.Version > tok.Version ||
+		(received.Version == tok.Version && received.Owner != tok.Owner && received.Owner < tok.Owner)
+}
+
+// Take on the tokens of the other ring which are new to us, returning
+// whether there were any.
+func (ring *Ring) Merge(state RingState) (bool, error) {
+	if state.Start != ring.Start || state.End != ring.End {
+		return false, fmt.Errorf("allocation range %v differs from ours, %v", Block{state.Start, state.End}, ring.Block)
+	}
+	changed := false
+	for i := range state.Tokens {
+		received := state.Tokens[i]
+		if !ring.Contains(received.Start) {
+			return changed, fmt.Errorf("token %v outside allocation range %v", ipString(received.Start), ring.Block)
+		}
+		if j := ring.find(received.Start); j < 0 {
+			ring.insert(&received)
+			changed = true
+		} else if ring.tokens[j].supersededBy(&received) {
+			ring.tokens[j] = &received
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+func (ring *Ring) State() RingState {
+	state := RingState{Start: ring.Start, End: ring.End, Tokens: make([]token, len(ring.tokens))}
+	for i, tok := range ring.tokens {
+		state.Tokens[i] = *tok
+	}
+	return state
+}
+
+func (ring *Ring) String() string {
+	var buf bytes.Buffer
+	for i, tok := range ring.tokens {
+		buf.WriteString(fmt.Sprintf("%v -> %s, %d free, version %d\n", ring.block(i), tok.Owner, tok.Free, tok.Version))
+	}
+	return buf.String()
+}
+
+// The CIDR prefixes which make up the block, largest first where
+// they can, e.g. for routing to it.
+func (block Block) Prefixes() []*net.IPNet {
+	var prefixes []*net.IPNet
+	for start := uint64(block.Start); start < uint64(block.End); {
+		bits := uint(0)
+		for bits < 32 {
+			size := uint64(1) << (bits + 1)
+			if start&(size-1) != 0 || start+size > uint64(block.End) {
+				break
+			}
+			bits++
+		}
+		prefixes = append(prefixes, &net.IPNet{IP: uint32ToIP(uint32(start)).To4(), Mask: net.CIDRMask(32-int(bits), 32)})
+		start += uint64(1) << bits
+	}
+	return prefixes
+}
+
+func (block Block) String() string {
+	return fmt.Sprintf("%s-%s", ipString(block.Start), ipString(block.End-1))
+}
+
+// The addresses in the block, out of the ordered ones given
+func inBlock(addrs []uint32, block Block) []uint32 {
+	from := sort.Search(len(addrs), func(i int) bool { return addrs[i] >= block.Start })
+	to := sort.Search(len(addrs), func(i int) bool { return addrs[i] >= block.End })
+	return addrs[from:to]
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	ip = ip.To4()
+	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+}
+
+func uint32ToIP(addr uint32) net.IP {
+	return net.IPv4(byte(addr>>24), byte(addr>>16), byte(addr>>8), byte(addr))
+}
+
+func ipString(addr uint32) string {
+	return uint32ToIP(addr).String()
+}
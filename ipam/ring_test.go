@@ -0,0 +1,113 @@
+package ipam
+
+import (
+	"fmt"
+	"github.com/zettio/weave/router"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+)
+
+func parseBlock(t *testing.T, cidr string) Block {
+	_, universe, err := net.ParseCIDR(cidr)
+	wt.AssertNoErr(t, err)
+	block, err := rangeBlock(universe)
+	wt.AssertNoErr(t, err)
+	return block
+}
+
+func TestRingDonate(t *testing.T) {
+	name1, _ := router.PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := router.PeerNameFromString("02:00:00:01:00:00")
+	universe := parseBlock(t, "10.0.0.0/24")
+	ring := NewRing(universe, name1)
+	if !ring.ClaimAll() || ring.ClaimAll() {
+		wt.Fatalf(t, "Expected to claim the empty ring once")
+	}
+	// 10.0.0.0, .1 and .255 in use leave .2-.254 as the longest run
+	inUse := []uint32{universe.Start, universe.Start + 1, universe.End - 1}
+	ring.UpdateFree(inUse)
+	if !ring.Donate(name2, inUse) {
+		wt.Fatalf(t, "Expected to donate")
+	}
+	wt.AssertEqualString(t, ring.String(),
+		"10.0.0.0-10.0.0.127 -> 01:00:00:01:00:00, 126 free, version 3\n"+
+			"10.0.0.128-10.0.0.254 -> 02:00:00:01:00:00, 127 free, version 1\n"+
+			"10.0.0.255-10.0.0.255 -> 01:00:00:01:00:00, 0 free, version 1\n", "ring")
+	owner, found := ring.Owner(ipToUint32(net.ParseIP("10.0.0.200")))
+	if !found || owner != name2 {
+		wt.Fatalf(t, "Expected 10.0.0.200 to belong to %s, not %s", name2, owner)
+	}
+	// Nothing left to give away
+	full := []uint32{}
+	for addr := universe.Start; addr < universe.Start+128; addr++ {
+		full = append(full, addr)
+	}
+	if ring.Donate(name2, append(full, universe.End-1)) {
+		wt.Fatalf(t, "Expected nothing to donate")
+	}
+}
+
+func TestRingMerge(t *testing.T) {
+	name1, _ := router.PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := router.PeerNameFromString("02:00:00:01:00:00")
+	name3, _ := router.PeerNameFromString("03:00:00:01:00:00")
+	universe := parseBlock(t, "10.0.0.0/24")
+	ring1 := NewRing(universe, name1)
+	ring2 := NewRing(universe, name2)
+	ring3 := NewRing(universe, name3)
+
+	// Conflicting claims of the whole range go to the lower name,
+	// whichever way round they get merged
+	ring2.ClaimAll()
+	ring3.ClaimAll()
+	changed, err := ring2.Merge(ring3.State())
+	wt.AssertNoErr(t, err)
+	if changed {
+		wt.Fatalf(t, "Expected the claim of %s to lose", name3)
+	}
+	changed, err = ring3.Merge(ring2.State())
+	wt.AssertNoErr(t, err)
+	if !changed {
+		wt.Fatalf(t, "Expected the claim of %s to win", name2)
+	}
+	wt.AssertEqualString(t, ring3.String(), ring2.String(), "rings")
+
+	// Changes by owners propagate
+	ring2.UpdateFree(nil)
+	ring2.Donate(name1, nil)
+	changed, err = ring1.Merge(ring2.State())
+	wt.AssertNoErr(t, err)
+	if !changed || len(ring1.OwnedBlocks()) != 1 {
+		wt.Fatalf(t, "Expected %s to learn of its block", name1)
+	}
+	changed, err = ring3.Merge(ring1.State())
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, ring3.String(), ring2.String(), "rings")
+	changed, err = ring2.Merge(ring3.State())
+	wt.AssertNoErr(t, err)
+	if changed {
+		wt.Fatalf(t, "Expected nothing new")
+	}
+
+	other := NewRing(parseBlock(t, "10.0.1.0/24"), name3)
+	other.ClaimAll()
+	if _, err := ring1.Merge(other.State()); err == nil {
+		wt.Fatalf(t, "Expected an error merging a ring for another range")
+	}
+}
+
+func TestBlockPrefixes(t *testing.T) {
+	universe := parseBlock(t, "10.0.0.0/24")
+	for _, c := range []struct {
+		block    Block
+		prefixes string
+	}{
+		{universe, "[10.0.0.0/24]"},
+		{Block{universe.Start, universe.End - 1},
+			"[10.0.0.0/25 10.0.0.128/26 10.0.0.192/27 10.0.0.224/28 10.0.0.240/29 10.0.0.248/30 10.0.0.252/31 10.0.0.254/32]"},
+		{Block{universe.Start + 3, universe.Start + 16}, "[10.0.0.3/32 10.0.0.4/30 10.0.0.8/29]"},
+	} {
+		wt.AssertEqualString(t, fmt.Sprint(c.block.Prefixes()), c.prefixes, "prefixes of "+c.block.String())
+	}
+}
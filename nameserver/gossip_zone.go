@@ -0,0 +1,123 @@
+package nameserver
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/zettio/weave/router"
+	"net"
+)
+
+// A zone shared between weave routers: each router keeps the records
+// of its own containers, registered with it over HTTP, and tells all
+// the others about them by gossip, so any router can answer queries
+// for any container. The records of each router go in a gossip table;
+// see router/gossip_table.go.
+type GossipZone struct {
+	*router.GossipTable
+	ourName router.PeerName
+}
+
+// What we gossip about each peer
+type PeerRecords struct {
+	Records []Record
+}
+
+func NewGossipZone(ourName router.PeerName) *GossipZone {
+	gz := &GossipZone{ourName: ourName}
+	gz.GossipTable = router.NewGossipTable(ourName, "DNS", gz, new(ZoneDb))
+	return gz
+}
+
+func (gz *GossipZone) AddRecord(ident string, name string, ip net.IP) error {
+	return gz.update(func(zone *ZoneDb) error { return zone.AddRecord(ident, name, ip) })
+}
+
+func (gz *GossipZone) DeleteRecord(ident string, ip net.IP) error {
+	return gz.update(func(zone *ZoneDb) error { return zone.DeleteRecord(ident, ip) })
+}
+
+func (gz *GossipZone) DeleteRecordsFor(ident string) error {
+	return gz.update(func(zone *ZoneDb) error { return zone.DeleteRecordsFor(ident) })
+}
+
+// Apply a change to our records and, unless it failed, tell everyone.
+func (gz *GossipZone) update(change func(*ZoneDb) error) error {
+	var err error
+	gz.Update(func(ours interface{}) bool {
+		err = change(ours.(*ZoneDb))
+		return err == nil
+	})
+	return err
+}
+
+func (gz *GossipZone) LookupName(name string) (net.IP, error) {
+	for _, zone := range gz.zones() {
+		if ip, err := zone.LookupName(name); err == nil {
+			return ip, nil
+		}
+	}
+	return nil, LookupError(name)
+}
+
+func (gz *GossipZone) LookupInaddr(inaddr string) (string, error) {
+	for _, zone := range gz.zones() {
+		if name, err := zone.LookupInaddr(inaddr); err == nil {
+			return name, nil
+		}
+	}
+	return "", LookupError(inaddr)
+}
+
+// The records of all peers, ours first, since they take precedence.
+func (gz *GossipZone) zones() []*ZoneDb {
+	gz.RLock()
+	defer gz.RUnlock()
+	zones := []*ZoneDb{gz.Ours().(*ZoneDb)}
+	gz.ForEach(func(name router.PeerName, entry interface{}) {
+		if name != gz.ourName {
+			zones = append(zones, entry.(*ZoneDb))
+		}
+	})
+	return zones
+}
+
+func (gz *GossipZone) EncodeEntries(entries map[router.PeerName]interface{}) interface{} {
+	update := make(map[router.PeerName]PeerRecords, len(entries))
+	for name, entry := range entries {
+		zone := entry.(*ZoneDb)
+		zone.mx.RLock()
+		recs := make([]Record, len(zone.recs))
+		copy(recs, zone.recs)
+		zone.mx.RUnlock()
+		update[name] = PeerRecords{Records: recs}
+	}
+	return update
+}
+
+func (gz *GossipZone) DecodeEntries(decoder *gob.Decoder) (map[router.PeerName]interface{}, error) {
+	var update map[router.PeerName]PeerRecords
+	if err := decoder.Decode(&update); err != nil {
+		return nil, err
+	}
+	entries := make(map[router.PeerName]interface{}, len(update))
+	for name, received := range update {
+		entries[name] = &ZoneDb{recs: received.Records}
+	}
+	return entries, nil
+}
+
+func (gz *GossipZone) String() string {
+	var buf bytes.Buffer
+	gz.RLock()
+	defer gz.RUnlock()
+	gz.ForEach(func(name router.PeerName, entry interface{}) {
+		zone := entry.(*ZoneDb)
+		zone.mx.RLock()
+		for _, r := range zone.recs {
+			buf.WriteString(fmt.Sprintln(r.Name, r.IP, r.Ident, name))
+		}
+		zone.mx.RUnlock()
+	})
+	return buf.String()
+}
@@ -0,0 +1,66 @@
+package nameserver
+
+import (
+	"github.com/zettio/weave/router"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+)
+
+func TestGossipZone(t *testing.T) {
+	name1, _ := router.PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := router.PeerNameFromString("02:00:00:01:00:00")
+	gz1 := NewGossipZone(name1)
+	gz2 := NewGossipZone(name2)
+	ip1 := net.ParseIP("10.0.2.1")
+	ip2 := net.ParseIP("10.0.2.2")
+
+	wt.AssertNoErr(t, gz1.AddRecord("deadbeef", "test1.weave.local.", ip1))
+	update, err := gz2.OnGossip(gz1.Gossip())
+	wt.AssertNoErr(t, err)
+	if update == nil {
+		wt.Fatalf(t, "Expected new records to be passed on")
+	}
+	update, err = gz2.OnGossip(gz1.Gossip())
+	wt.AssertNoErr(t, err)
+	if update != nil {
+		wt.Fatalf(t, "Expected nothing new")
+	}
+	foundIP, err := gz2.LookupName("test1.weave.local.")
+	wt.AssertNoErr(t, err)
+	if !foundIP.Equal(ip1) {
+		wt.Fatalf(t, "Unexpected address %s for test1.weave.local.", foundIP)
+	}
+	foundName, err := gz2.LookupInaddr("1.2.0.10.in-addr.arpa.")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, foundName, "test1.weave.local.", "name")
+
+	// Our own records win over those of other peers
+	wt.AssertNoErr(t, gz2.AddRecord("cowjuice", "test1.weave.local.", ip2))
+	foundIP, err = gz2.LookupName("test1.weave.local.")
+	wt.AssertNoErr(t, err)
+	if !foundIP.Equal(ip2) {
+		wt.Fatalf(t, "Expected our own record, not %s", foundIP)
+	}
+
+	wt.AssertNoErr(t, gz1.DeleteRecordsFor("deadbeef"))
+	wt.AssertNoErr(t, gz2.OnGossipBroadcast(gz1.Gossip()))
+	if _, err := gz2.LookupInaddr("1.2.0.10.in-addr.arpa."); err == nil {
+		wt.Fatalf(t, "Expected deleted record to be gone")
+	}
+
+	// Peers can't tell us about our own records
+	_, err = gz1.OnGossip(gz2.Gossip())
+	wt.AssertNoErr(t, err)
+	wt.AssertNoErr(t, gz1.AddRecord("abcdef", "test2.weave.local.", ip1))
+	_, err = gz1.OnGossip(gz2.Gossip())
+	wt.AssertNoErr(t, err)
+	if _, err := gz1.LookupName("test2.weave.local."); err != nil {
+		wt.Fatalf(t, "Expected our record to survive gossip")
+	}
+
+	gz1.DeletePeer(name2)
+	if _, err := gz1.LookupName("test1.weave.local."); err == nil {
+		wt.Fatalf(t, "Expected records of removed peer to be gone")
+	}
+}
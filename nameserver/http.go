@@ -37,6 +37,17 @@ func ListenHttp(domain string, db Zone, port int) {
 		}
 	})
 
+	HandleNames(domain, db)
+
+	address := fmt.Sprintf(":%d", port)
+	if err := http.ListenAndServe(address, nil); err != nil {
+		Error.Fatal("[http] Unable to create http listener: ", err)
+	}
+}
+
+// Register the handler for adding and deleting records, for servers
+// with other things to serve over HTTP too.
+func HandleNames(domain string, db Zone) {
 	http.HandleFunc("/name/", func(w http.ResponseWriter, r *http.Request) {
 
 		reqError := func(msg string, logmsg string, logargs ...interface{}) {
@@ -100,9 +111,4 @@ func ListenHttp(domain string, db Zone, port int) {
 			return
 		}
 	})
-
-	address := fmt.Sprintf(":%d", port)
-	if err := http.ListenAndServe(address, nil); err != nil {
-		Error.Fatal("[http] Unable to create http listener: ", err)
-	}
 }
@@ -94,8 +94,8 @@ func (s *MDNSServer) makeHandler(qtype uint16, lookup LookupFunc) dns.HandlerFun
 					Debug.Printf("[mdns msgid %d] Found local answer to mDNS query %s",
 						r.MsgHdr.Id, q.Name)
 					if err := s.sendResponse(m); err != nil {
-						Warning.Printf("[mdns msgid %d] Error writing to %s",
-							r.MsgHdr.Id, s.sendconn)
+						Warning.Printf("[mdns msgid %d] Error writing to %s: %s",
+							r.MsgHdr.Id, ipv4Addr, err)
 					}
 				} else {
 					Debug.Printf("[mdns msgid %d] No local answer for mDNS query %s",
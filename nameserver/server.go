@@ -122,21 +122,32 @@ func startServerWithConfig(config *dns.ClientConfig, zone Zone, iface *net.Inter
 	err = mdnsClient.Start(iface)
 	checkFatal(err)
 
-	LocalServeMux := dns.NewServeMux()
-	LocalServeMux.HandleFunc(LOCAL_DOMAIN, queryHandler([]Lookup{zone, mdnsClient}))
-	LocalServeMux.HandleFunc(RDNS_DOMAIN, rdnsHandler(config, []Lookup{zone, mdnsClient}))
-	LocalServeMux.HandleFunc(".", notUsHandler(config))
-
 	mdnsServer, err := NewMDNSServer(zone)
 	checkFatal(err)
 
 	err = mdnsServer.Start(iface)
 	checkFatal(err)
 
+	return listenAndServe(config, []Lookup{zone, mdnsClient}, dnsPort)
+}
+
+// Answer queries from the zone alone, e.g. a GossipZone, which knows
+// about all containers without needing mDNS.
+func StartZoneServer(zone Zone, dnsPort int) error {
+	config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return err
+	}
+	return listenAndServe(config, []Lookup{zone}, dnsPort)
+}
+
+func listenAndServe(config *dns.ClientConfig, lookups []Lookup, dnsPort int) error {
+	LocalServeMux := dns.NewServeMux()
+	LocalServeMux.HandleFunc(LOCAL_DOMAIN, queryHandler(lookups))
+	LocalServeMux.HandleFunc(RDNS_DOMAIN, rdnsHandler(config, lookups))
+	LocalServeMux.HandleFunc(".", notUsHandler(config))
+
 	address := fmt.Sprintf(":%d", dnsPort)
 	Info.Printf("Listening for DNS on %s", address)
-	err = dns.ListenAndServe(address, "udp", LocalServeMux)
-	checkFatal(err)
-
-	return nil
+	return dns.ListenAndServe(address, "udp", LocalServeMux)
 }
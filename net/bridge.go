@@ -0,0 +1,101 @@
+package net
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// Create a bridge, with a random locally administered MAC, and the
+// MTU, and bring it up; the equivalent of
+//
+//	ip link add name <name> type bridge
+//	ip link set dev <name> address 7a:<random>
+//	ip link set dev <name> mtu <mtu> up
+func CreateBridge(name string, mtu int) error {
+	mac := make([]byte, 6)
+	if _, err := rand.Read(mac[1:]); err != nil {
+		return err
+	}
+	mac[0] = 0x7a
+	linkInfo := NetlinkAttr(iflaInfoKind, []byte("bridge"))
+	body := append(ifInfomsg(0, 0, 0), nameAttr(name)...)
+	body = append(body, NetlinkAttr(syscall.IFLA_ADDRESS, mac)...)
+	body = append(body, NetlinkAttr(syscall.IFLA_LINKINFO, linkInfo)...)
+	if err := NetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, body); err != nil {
+		return fmt.Errorf("Unable to create bridge %s: %v", name, err)
+	}
+	if err := SetBridgeMTU(name, mtu); err != nil {
+		DeleteLink(name)
+		return err
+	}
+	return SetLinkUp(name)
+}
+
+// Older kernels refuse to set the MTU of a bridge higher than that of
+// its lowest port, or than the default when it has none. There we
+// attach a dummy device with the MTU to it, which the bridge takes on,
+// and then remove that again.
+func SetBridgeMTU(name string, mtu int) error {
+	if err := SetLinkMTU(name, mtu); err == nil {
+		return nil
+	}
+	dummy := fmt.Sprintf("v%sdu", name)
+	if len(dummy) >= syscall.IFNAMSIZ {
+		dummy = dummy[len(dummy)-syscall.IFNAMSIZ+1:]
+	}
+	body := append(ifInfomsg(0, 0, 0), nameAttr(dummy)...)
+	body = append(body, uint32Attr(syscall.IFLA_MTU, uint32(mtu))...)
+	body = append(body, NetlinkAttr(syscall.IFLA_LINKINFO, NetlinkAttr(iflaInfoKind, []byte("dummy")))...)
+	if err := NetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, body); err != nil {
+		return fmt.Errorf("Unable to create dummy device to set MTU of %s: %v", name, err)
+	}
+	err := SetLinkMaster(dummy, name)
+	DeleteLink(dummy)
+	if err != nil {
+		return fmt.Errorf("Unable to set MTU of %s: %v", name, err)
+	}
+	return nil
+}
+
+func SetLinkMTU(name string, mtu int) error {
+	return setLink(name, 0, 0, uint32Attr(syscall.IFLA_MTU, uint32(mtu)))
+}
+
+// Attach the device to the bridge; the equivalent of
+// 'ip link set <name> master <bridge>'.
+func SetLinkMaster(name, bridge string) error {
+	bridgeIface, err := net.InterfaceByName(bridge)
+	if err != nil {
+		return err
+	}
+	return setLink(name, 0, 0, uint32Attr(syscall.IFLA_MASTER, uint32(bridgeIface.Index)))
+}
+
+// The index of the bridge the device is attached to, or 0 if none.
+// Asks the kernel rather than sysfs, which shows the devices of the
+// namespace it was mounted in rather than ours.
+func LinkMaster(name string) (int, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, err
+	}
+	replies, err := netlinkExchange(syscall.NETLINK_ROUTE, syscall.RTM_GETLINK, 0, ifInfomsg(iface.Index, 0, 0))
+	if err != nil {
+		return 0, err
+	}
+	for i := range replies {
+		attrs, err := syscall.ParseNetlinkRouteAttr(&replies[i])
+		if err != nil {
+			return 0, err
+		}
+		for _, attr := range attrs {
+			if attr.Attr.Type == syscall.IFLA_MASTER && len(attr.Value) >= 4 {
+				return int(*(*uint32)(unsafe.Pointer(&attr.Value[0]))), nil
+			}
+		}
+	}
+	return 0, nil
+}
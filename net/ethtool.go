@@ -0,0 +1,41 @@
+package net
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// From <linux/sockios.h> and <linux/ethtool.h>; not defined in the
+// syscall package
+const (
+	siocEthtool     = 0x8946 // SIOCETHTOOL
+	ethtoolSTxCsum  = 0x17   // ETHTOOL_STXCSUM
+	ifreqDataOffset = 16     // of ifr_data in struct ifreq
+	ifreqSize       = 40     // sizeof(struct ifreq)
+)
+
+// struct ethtool_value
+type ethtoolValue struct {
+	cmd  uint32
+	data uint32
+}
+
+// Turn off checksum offload for packets the device sends, so they
+// carry their checksums when captured; the equivalent of
+// 'ethtool -K <name> tx off'.
+func SetTxChecksumOff(name string) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	defer syscall.Close(fd)
+	value := ethtoolValue{cmd: ethtoolSTxCsum}
+	var ifreq [ifreqSize]byte
+	copy(ifreq[:syscall.IFNAMSIZ-1], name)
+	*(*uintptr)(unsafe.Pointer(&ifreq[ifreqDataOffset])) = uintptr(unsafe.Pointer(&value))
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), siocEthtool, uintptr(unsafe.Pointer(&ifreq[0]))); errno != 0 {
+		return os.NewSyscallError("ioctl SIOCETHTOOL", errno)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package net
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// Just enough generic netlink to configure the devices of families
+// such as WireGuard with.
+
+// From <linux/genetlink.h>; not defined in the syscall package
+const (
+	genlIDCtrl         = 0x10
+	genlHdrLen         = 4
+	ctrlCmdGetFamily   = 3
+	ctrlAttrFamilyID   = 1
+	ctrlAttrFamilyName = 2
+	netlinkGeneric     = 16
+	genlCtrlVersion    = 1
+)
+
+// The ID of the generic netlink family with the given name, which is
+// only there once its module is loaded.
+func GenlFamily(name string) (uint16, error) {
+	replies, err := netlinkExchange(netlinkGeneric, genlIDCtrl, 0,
+		genlMsg(ctrlCmdGetFamily, genlCtrlVersion, NetlinkAttr(ctrlAttrFamilyName, append([]byte(name), 0))))
+	if err != nil {
+		return 0, fmt.Errorf("Unable to find generic netlink family %s: %v", name, err)
+	}
+	for _, reply := range replies {
+		if len(reply.Data) < genlHdrLen {
+			continue
+		}
+		attrs := reply.Data[genlHdrLen:]
+		for len(attrs) >= syscall.SizeofRtAttr {
+			attrLen := int(*(*uint16)(unsafe.Pointer(&attrs[0])))
+			attrType := *(*uint16)(unsafe.Pointer(&attrs[2]))
+			if attrLen < syscall.SizeofRtAttr || attrLen > len(attrs) {
+				break
+			}
+			if attrType == ctrlAttrFamilyID && attrLen >= syscall.SizeofRtAttr+2 {
+				return *(*uint16)(unsafe.Pointer(&attrs[syscall.SizeofRtAttr])), nil
+			}
+			if attrLen = (attrLen + syscall.RTA_ALIGNTO - 1) & ^(syscall.RTA_ALIGNTO - 1); attrLen > len(attrs) {
+				break
+			}
+			attrs = attrs[attrLen:]
+		}
+	}
+	return 0, fmt.Errorf("No ID for generic netlink family %s", name)
+}
+
+// Send a command to the generic netlink family and wait for the
+// kernel's acknowledgement.
+func GenlRequest(family uint16, cmd, version uint8, attrs ...[]byte) error {
+	_, err := netlinkExchange(netlinkGeneric, family, 0, genlMsg(cmd, version, attrs...))
+	return err
+}
+
+func genlMsg(cmd, version uint8, attrs ...[]byte) []byte {
+	body := make([]byte, genlHdrLen)
+	body[0], body[1] = cmd, version
+	for _, attr := range attrs {
+		body = append(body, attr...)
+	}
+	return body
+}
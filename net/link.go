@@ -0,0 +1,122 @@
+package net
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// From <linux/if_link.h> and <linux/veth.h>; not defined in the
+// syscall package
+const (
+	iflaInfoKind = 1
+	iflaInfoData = 2
+	iflaNetNSFd  = 28
+	vethInfoPeer = 1
+)
+
+func ifInfomsg(index int, flags, change uint32) []byte {
+	msg := make([]byte, syscall.SizeofIfInfomsg)
+	msg[0] = syscall.AF_UNSPEC
+	*(*int32)(unsafe.Pointer(&msg[4])) = int32(index)
+	*(*uint32)(unsafe.Pointer(&msg[8])) = flags
+	*(*uint32)(unsafe.Pointer(&msg[12])) = change
+	return msg
+}
+
+func uint32Attr(attrType uint16, value uint32) []byte {
+	data := make([]byte, 4)
+	*(*uint32)(unsafe.Pointer(&data[0])) = value
+	return NetlinkAttr(attrType, data)
+}
+
+func nameAttr(name string) []byte {
+	return NetlinkAttr(syscall.IFLA_IFNAME, append([]byte(name), 0))
+}
+
+func setLink(name string, flags, change uint32, attrs ...[]byte) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	body := ifInfomsg(iface.Index, flags, change)
+	for _, attr := range attrs {
+		body = append(body, attr...)
+	}
+	return NetlinkRequest(syscall.RTM_NEWLINK, 0, body)
+}
+
+// Delete the device, and with a veth device, its peer.
+func DeleteLink(name string) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	return NetlinkRequest(syscall.RTM_DELLINK, 0, ifInfomsg(iface.Index, 0, 0))
+}
+
+func SetLinkUp(name string) error {
+	return setLink(name, syscall.IFF_UP, syscall.IFF_UP)
+}
+
+// Rename the device, which has to be down.
+func RenameLink(name, newName string) error {
+	return setLink(name, 0, 0, nameAttr(newName))
+}
+
+// Move the device into another network namespace, e.g. that of a
+// container, where it keeps its name but is down.
+func SetLinkNetNS(name string, ns *os.File) error {
+	return setLink(name, 0, 0, uint32Attr(iflaNetNSFd, uint32(ns.Fd())))
+}
+
+// Give the device an IPv4 address, with a route to the addresses in its
+// subnet; the equivalent of 'ip addr add <addr> dev <name>'.
+func AddAddress(name string, addr *net.IPNet) error {
+	ip := addr.IP.To4()
+	if ip == nil {
+		return fmt.Errorf("Not an IPv4 address: %v", addr)
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	prefixLen, _ := addr.Mask.Size()
+	body := make([]byte, syscall.SizeofIfAddrmsg)
+	body[0] = syscall.AF_INET
+	body[1] = byte(prefixLen)
+	*(*uint32)(unsafe.Pointer(&body[4])) = uint32(iface.Index)
+	body = append(body, NetlinkAttr(syscall.IFA_LOCAL, ip)...)
+	body = append(body, NetlinkAttr(syscall.IFA_ADDRESS, ip)...)
+	return NetlinkRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, body)
+}
+
+// Route the IPv4 destination out of the device, through the gateway
+// unless it is nil; the equivalent of
+//
+//	ip route add <dst> [via <gw>] dev <name>
+func AddRoute(dst *net.IPNet, gw net.IP, name string) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	prefixLen, _ := dst.Mask.Size()
+	body := make([]byte, syscall.SizeofRtMsg)
+	body[0] = syscall.AF_INET
+	body[1] = byte(prefixLen)
+	body[4] = syscall.RT_TABLE_MAIN
+	body[5] = syscall.RTPROT_BOOT
+	body[6] = syscall.RT_SCOPE_LINK
+	body[7] = syscall.RTN_UNICAST
+	if prefixLen > 0 {
+		body = append(body, NetlinkAttr(syscall.RTA_DST, dst.IP.To4())...)
+	}
+	if gw != nil {
+		body[6] = syscall.RT_SCOPE_UNIVERSE
+		body = append(body, NetlinkAttr(syscall.RTA_GATEWAY, gw.To4())...)
+	}
+	body = append(body, uint32Attr(syscall.RTA_OIF, uint32(iface.Index))...)
+	return NetlinkRequest(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, body)
+}
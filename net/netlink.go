@@ -0,0 +1,88 @@
+package net
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// Just enough rtnetlink to configure interfaces with, since the
+// syscall package only covers reading from it.
+
+func NetlinkAttr(attrType uint16, data []byte) []byte {
+	attrLen := syscall.SizeofRtAttr + len(data)
+	attr := make([]byte, (attrLen+syscall.RTA_ALIGNTO-1) & ^(syscall.RTA_ALIGNTO-1))
+	*(*uint16)(unsafe.Pointer(&attr[0])) = uint16(attrLen)
+	*(*uint16)(unsafe.Pointer(&attr[2])) = attrType
+	copy(attr[syscall.SizeofRtAttr:], data)
+	return attr
+}
+
+// Send a netlink request and wait for the kernel's acknowledgement.
+func NetlinkRequest(msgType uint16, flags uint16, body []byte) error {
+	_, err := netlinkExchange(syscall.NETLINK_ROUTE, msgType, flags, body)
+	return err
+}
+
+// Nest the attributes in one of the given type.
+func NetlinkNestedAttr(attrType uint16, attrs ...[]byte) []byte {
+	var data []byte
+	for _, attr := range attrs {
+		data = append(data, attr...)
+	}
+	return NetlinkAttr(attrType|nlaFNested, data)
+}
+
+const nlaFNested = 0x8000
+
+// Send a request over the netlink protocol, and return the kernel's
+// replies to it up to its acknowledgement.
+func netlinkExchange(proto int, msgType uint16, flags uint16, body []byte) ([]syscall.NetlinkMessage, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, proto)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(body))
+	msg = append(msg, body...)
+	hdr := (*syscall.NlMsghdr)(unsafe.Pointer(&msg[0]))
+	hdr.Len = uint32(len(msg))
+	hdr.Type = msgType
+	hdr.Flags = syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | flags
+	hdr.Seq = 1
+	if err := syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+	var replies []syscall.NetlinkMessage
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != 1 {
+				continue
+			}
+			if m.Header.Type != syscall.NLMSG_ERROR {
+				replies = append(replies, m)
+				continue
+			}
+			if len(m.Data) < 4 {
+				return nil, fmt.Errorf("netlink error message truncated")
+			}
+			if errno := int32(binary.LittleEndian.Uint32(m.Data[:4])); errno != 0 {
+				return nil, syscall.Errno(-errno)
+			}
+			return replies, nil
+		}
+	}
+}
@@ -0,0 +1,4 @@
+package net
+
+// setns(2) is missing from the syscall package
+const sysSetns = 268
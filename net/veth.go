@@ -0,0 +1,78 @@
+package net
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// Create a pair of veth devices, attaching the local end to the bridge
+// and bringing it up, and leaving the other end for whoever moves it
+// into a container; the equivalent of
+//
+//	ip link add <local> mtu <mtu> type veth peer name <guest> mtu <mtu>
+//	ip link set <local> master <bridge> up
+func CreateVeth(local, guest string, mtu int, bridge string) error {
+	bridgeIface, err := net.InterfaceByName(bridge)
+	if err != nil {
+		return fmt.Errorf("Unable to find bridge %s: %v", bridge, err)
+	}
+	peer := append(ifInfomsg(0, 0, 0), nameAttr(guest)...)
+	peer = append(peer, uint32Attr(syscall.IFLA_MTU, uint32(mtu))...)
+	linkInfo := append(NetlinkAttr(iflaInfoKind, []byte("veth")),
+		NetlinkAttr(iflaInfoData, NetlinkAttr(vethInfoPeer, peer))...)
+	body := append(ifInfomsg(0, 0, 0), nameAttr(local)...)
+	body = append(body, uint32Attr(syscall.IFLA_MTU, uint32(mtu))...)
+	body = append(body, NetlinkAttr(syscall.IFLA_LINKINFO, linkInfo)...)
+	if err := NetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, body); err != nil {
+		return fmt.Errorf("Unable to create veth %s: %v", local, err)
+	}
+	if err := setLink(local, syscall.IFF_UP, syscall.IFF_UP, uint32Attr(syscall.IFLA_MASTER, uint32(bridgeIface.Index))); err != nil {
+		DeleteLink(local)
+		return fmt.Errorf("Unable to attach veth %s to %s: %v", local, bridge, err)
+	}
+	return nil
+}
+
+// Run the function in the network namespace at the path, e.g. a bind
+// mount of /proc/1/ns/net, or in our own for an empty path. Only the
+// calling thread switches namespaces, so the function mustn't start
+// goroutines which expect to be in the namespace.
+func WithNetNS(path string, f func() error) error {
+	if path == "" {
+		return f()
+	}
+	target, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	runtime.LockOSThread()
+	ours, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer ours.Close()
+	if err := setns(target); err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	result := f()
+	if err := setns(ours); err != nil {
+		// Leave the thread locked, so it dies with the goroutine
+		// rather than running others in the wrong namespace
+		return err
+	}
+	runtime.UnlockOSThread()
+	return result
+}
+
+func setns(ns *os.File) error {
+	if _, _, errno := syscall.Syscall(sysSetns, ns.Fd(), syscall.CLONE_NEWNET, 0); errno != 0 {
+		return os.NewSyscallError("setns", errno)
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package plugin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/zettio/weave/ipam"
+	weavenet "github.com/zettio/weave/net"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// A Docker network plugin, speaking libnetwork's remote driver
+// protocol, so that
+//
+//   docker network create -d weave --ipam-driver weave weave
+//   docker run --net=weave ...
+//
+// attaches containers to the weave network, with addresses from our
+// allocator, much as 'weave run' does. Docker calls the plugin over
+// HTTP on a unix socket in /run/docker/plugins, which it finds by name.
+//
+// Docker expects the devices it moves into containers to be in its
+// own network namespace, which is where the weave bridge is too, so
+// when we run in another one, we create them in the namespace given.
+//
+// We leave the default route of containers alone, so Docker attaches
+// them to its gateway bridge for external connectivity.
+
+const (
+	PluginContentType = "application/vnd.docker.plugins.v1+json"
+	ContainerIfPrefix = "ethwe" // as with 'weave attach'
+	VethMTU           = 65535
+	poolID            = "weave"
+)
+
+type Driver struct {
+	sync.Mutex
+	allocator *ipam.Allocator
+	bridge    string
+	hostNetNS string            // path of the namespace to create devices in; empty for ours
+	veths     map[string]string // endpoint ID -> local end of its veth
+}
+
+func NewDriver(allocator *ipam.Allocator, bridge string, hostNetNS string) *Driver {
+	return &Driver{
+		allocator: allocator,
+		bridge:    bridge,
+		hostNetNS: hostNetNS,
+		veths:     make(map[string]string)}
+}
+
+// Serve Docker's requests on the socket at the path, e.g.
+// /run/docker/plugins/weave.sock, replacing any left behind.
+func (driver *Driver) Listen(socketPath string) error {
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	log.Println("Serving Docker network plugin on", socketPath)
+	return http.Serve(listener, driver.Handler())
+}
+
+// Requests and responses; only the fields we use
+type createEndpointRequest struct {
+	NetworkID  string
+	EndpointID string
+	Interface  *struct{ Address string }
+}
+
+type endpointRequest struct {
+	NetworkID  string
+	EndpointID string
+}
+
+type interfaceName struct {
+	SrcName   string
+	DstPrefix string
+}
+
+type staticRoute struct {
+	Destination string
+	RouteType   int
+}
+
+type joinResponse struct {
+	InterfaceName interfaceName
+	StaticRoutes  []staticRoute
+}
+
+type requestPoolRequest struct {
+	Pool string
+	V6   bool
+}
+
+type requestAddressRequest struct {
+	PoolID  string
+	Address string
+}
+
+// Routes to devices, rather than through gateways
+const routeConnected = 1
+
+func (driver *Driver) Handler() http.Handler {
+	mux := http.NewServeMux()
+	handle := func(method string, f func(*http.Request) (interface{}, error)) {
+		mux.HandleFunc("/"+method, func(w http.ResponseWriter, r *http.Request) {
+			result, err := f(r)
+			if err != nil {
+				log.Printf("[plugin] %s: %v", method, err)
+				result = map[string]string{"Err": err.Error()}
+			}
+			w.Header().Set("Content-Type", PluginContentType)
+			if err := json.NewEncoder(w).Encode(result); err != nil {
+				log.Printf("[plugin] %s: error writing response: %v", method, err)
+			}
+		})
+	}
+	nothing := func(*http.Request) (interface{}, error) { return struct{}{}, nil }
+
+	handle("Plugin.Activate", func(*http.Request) (interface{}, error) {
+		return map[string][]string{"Implements": {"NetworkDriver", "IpamDriver"}}, nil
+	})
+
+	handle("NetworkDriver.GetCapabilities", func(*http.Request) (interface{}, error) {
+		return map[string]string{"Scope": "local"}, nil
+	})
+	handle("NetworkDriver.CreateNetwork", nothing)
+	handle("NetworkDriver.DeleteNetwork", nothing)
+	handle("NetworkDriver.CreateEndpoint", func(r *http.Request) (interface{}, error) {
+		var req createEndpointRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, err
+		}
+		if req.Interface == nil || req.Interface.Address == "" {
+			return nil, fmt.Errorf("no IPv4 address for endpoint %s", req.EndpointID)
+		}
+		return struct{}{}, nil
+	})
+	handle("NetworkDriver.DeleteEndpoint", nothing)
+	handle("NetworkDriver.EndpointOperInfo", func(*http.Request) (interface{}, error) {
+		return map[string]interface{}{"Value": struct{}{}}, nil
+	})
+	handle("NetworkDriver.Join", func(r *http.Request) (interface{}, error) {
+		var req endpointRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, err
+		}
+		guest, err := driver.join(req.EndpointID)
+		if err != nil {
+			return nil, err
+		}
+		return joinResponse{
+			InterfaceName: interfaceName{SrcName: guest, DstPrefix: ContainerIfPrefix},
+			// Route multicast packets across the weave network
+			StaticRoutes: []staticRoute{{Destination: "224.0.0.0/4", RouteType: routeConnected}}}, nil
+	})
+	handle("NetworkDriver.Leave", func(r *http.Request) (interface{}, error) {
+		var req endpointRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, err
+		}
+		return struct{}{}, driver.leave(req.EndpointID)
+	})
+	handle("NetworkDriver.DiscoverNew", nothing)
+	handle("NetworkDriver.DiscoverDelete", nothing)
+	handle("NetworkDriver.ProgramExternalConnectivity", nothing)
+	handle("NetworkDriver.RevokeExternalConnectivity", nothing)
+
+	handle("IpamDriver.GetCapabilities", func(*http.Request) (interface{}, error) {
+		return map[string]bool{"RequiresMACAddress": false}, nil
+	})
+	handle("IpamDriver.GetDefaultAddressSpaces", func(*http.Request) (interface{}, error) {
+		return map[string]string{"LocalDefaultAddressSpace": "weavelocal", "GlobalDefaultAddressSpace": "weaveglobal"}, nil
+	})
+	handle("IpamDriver.RequestPool", func(r *http.Request) (interface{}, error) {
+		var req requestPoolRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, err
+		}
+		universe := driver.allocator.Universe()
+		switch {
+		case universe == nil:
+			return nil, ipam.ErrNoRange
+		case req.V6:
+			return nil, fmt.Errorf("weave only allocates IPv4 addresses")
+		case req.Pool != "" && req.Pool != universe.String():
+			return nil, fmt.Errorf("weave allocates addresses from %v, not %s", universe, req.Pool)
+		}
+		return map[string]interface{}{"PoolID": poolID, "Pool": universe.String(), "Data": struct{}{}}, nil
+	})
+	handle("IpamDriver.ReleasePool", nothing)
+	handle("IpamDriver.RequestAddress", func(r *http.Request) (interface{}, error) {
+		var req requestAddressRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, err
+		}
+		addr, err := driver.requestAddress(req.Address)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"Address": addr.String(), "Data": struct{}{}}, nil
+	})
+	handle("IpamDriver.ReleaseAddress", func(r *http.Request) (interface{}, error) {
+		var req requestAddressRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(req.Address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %s", req.Address)
+		}
+		return struct{}{}, driver.allocator.FreeAddress(ip)
+	})
+	return mux
+}
+
+// Docker asks for addresses before there are containers to give them
+// to, so we make up identities for them, and Docker gives them back by
+// address.
+func (driver *Driver) requestAddress(address string) (*net.IPNet, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+	ident := "docker-" + hex.EncodeToString(idBytes)
+	if address == "" {
+		return driver.allocator.Allocate(ident, ipam.AllocateTimeout)
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %s", address)
+	}
+	if err := driver.allocator.Claim(ident, ip); err != nil {
+		return nil, err
+	}
+	return &net.IPNet{IP: ip, Mask: driver.allocator.Universe().Mask}, nil
+}
+
+// Create a veth for the endpoint, returning the name of the end Docker
+// moves into the container.
+func (driver *Driver) join(endpointID string) (string, error) {
+	if len(endpointID) < 9 {
+		return "", fmt.Errorf("invalid endpoint ID %s", endpointID)
+	}
+	// Interface names are limited to 15 characters
+	local, guest := "vethwl"+endpointID[:9], "vethwg"+endpointID[:9]
+	if err := weavenet.WithNetNS(driver.hostNetNS, func() error {
+		return weavenet.CreateVeth(local, guest, VethMTU, driver.bridge)
+	}); err != nil {
+		return "", err
+	}
+	driver.Lock()
+	driver.veths[endpointID] = local
+	driver.Unlock()
+	return guest, nil
+}
+
+func (driver *Driver) leave(endpointID string) error {
+	driver.Lock()
+	local, found := driver.veths[endpointID]
+	delete(driver.veths, endpointID)
+	driver.Unlock()
+	if !found {
+		// We may have restarted since the join; Docker deletes the
+		// guest end, and with it ours, when the container goes anyway
+		return nil
+	}
+	return weavenet.WithNetNS(driver.hostNetNS, func() error {
+		return weavenet.DeleteLink(local)
+	})
+}
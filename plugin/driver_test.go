@@ -0,0 +1,70 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/zettio/weave/ipam"
+	"github.com/zettio/weave/router"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func call(t *testing.T, server *httptest.Server, method string, req interface{}) map[string]interface{} {
+	body, err := json.Marshal(req)
+	wt.AssertNoErr(t, err)
+	resp, err := http.Post(server.URL+"/"+method, PluginContentType, bytes.NewReader(body))
+	wt.AssertNoErr(t, err)
+	defer resp.Body.Close()
+	wt.AssertStatus(t, resp.StatusCode, http.StatusOK, method)
+	var result map[string]interface{}
+	wt.AssertNoErr(t, json.NewDecoder(resp.Body).Decode(&result))
+	return result
+}
+
+func TestIpamDriver(t *testing.T) {
+	ourName, _ := router.PeerNameFromString("01:00:00:01:00:00")
+	ourself := router.NewPeer(ourName, 0, 0)
+	peers := router.NewPeers(ourself, func(*router.Peer) {}, func(*router.Peer) {})
+	peers.FetchWithDefault(ourself)
+	_, universe, _ := net.ParseCIDR("10.2.0.0/24")
+	allocator, err := ipam.NewAllocator(ourName, peers, universe, "")
+	wt.AssertNoErr(t, err)
+	server := httptest.NewServer(NewDriver(allocator, "weave", "").Handler())
+	defer server.Close()
+
+	result := call(t, server, "Plugin.Activate", nil)
+	if len(result["Implements"].([]interface{})) != 2 {
+		wt.Fatalf(t, "Expected to implement two plugin types, got %v", result)
+	}
+
+	result = call(t, server, "IpamDriver.RequestPool", map[string]interface{}{"Pool": "10.3.0.0/24"})
+	if result["Err"] == nil {
+		wt.Fatalf(t, "Expected an error for a pool other than our range")
+	}
+	result = call(t, server, "IpamDriver.RequestPool", map[string]interface{}{})
+	wt.AssertEqualString(t, result["Pool"].(string), "10.2.0.0/24", "pool")
+
+	result = call(t, server, "IpamDriver.RequestAddress", map[string]string{"PoolID": poolID})
+	wt.AssertEqualString(t, result["Address"].(string), "10.2.0.1/24", "address")
+	result = call(t, server, "IpamDriver.RequestAddress", map[string]string{"PoolID": poolID, "Address": "10.2.0.9"})
+	wt.AssertEqualString(t, result["Address"].(string), "10.2.0.9/24", "address")
+	result = call(t, server, "IpamDriver.RequestAddress", map[string]string{"PoolID": poolID, "Address": "10.2.0.9"})
+	if result["Err"] == nil {
+		wt.Fatalf(t, "Expected an error claiming an address in use")
+	}
+
+	result = call(t, server, "IpamDriver.ReleaseAddress", map[string]string{"PoolID": poolID, "Address": "10.2.0.1"})
+	if result["Err"] != nil {
+		wt.Fatalf(t, "Unexpected error releasing address: %v", result["Err"])
+	}
+	result = call(t, server, "IpamDriver.RequestAddress", map[string]string{"PoolID": poolID})
+	wt.AssertEqualString(t, result["Address"].(string), "10.2.0.1/24", "address")
+
+	result = call(t, server, "NetworkDriver.CreateEndpoint", map[string]interface{}{"EndpointID": "0123456789ab"})
+	if result["Err"] == nil {
+		wt.Fatalf(t, "Expected an error creating an endpoint without an address")
+	}
+}
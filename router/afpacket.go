@@ -0,0 +1,314 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// As an alternative to libpcap, we can capture frames with AF_PACKET
+// sockets using TPACKET_V3 rings: the kernel writes frames into
+// blocks of memory we share with it, and hands us a block at a time,
+// so reading a frame needs no syscall and no copy. Several sockets,
+// each with its own ring and sniffing goroutine, can join a fanout
+// group, across which the kernel spreads frames by flow hash, so the
+// frames of a flow are always read, and forwarded, in order.
+//
+// The kernel hands over a block when it is full or, failing that,
+// after afpBlockTimeout, which bounds the latency added at low frame
+// rates.
+
+// How to capture frames
+type CaptureBackend int
+
+const (
+	CapturePcap CaptureBackend = iota
+	CaptureAFPacket
+)
+
+var captureBackendNames = map[CaptureBackend]string{
+	CapturePcap:     "pcap",
+	CaptureAFPacket: "afpacket"}
+
+func ParseCaptureBackend(name string) (CaptureBackend, error) {
+	for backend, backendName := range captureBackendNames {
+		if backendName == name {
+			return backend, nil
+		}
+	}
+	return CapturePcap, fmt.Errorf("Unknown capture backend: %s", name)
+}
+
+func (backend CaptureBackend) String() string {
+	return captureBackendNames[backend]
+}
+
+// From <linux/if_packet.h> and <linux/if_ether.h>; not defined in the
+// syscall package
+const (
+	solPacket          = 263 // SOL_PACKET
+	packetRxRing       = 5   // PACKET_RX_RING
+	packetVersion      = 10  // PACKET_VERSION
+	packetFanout       = 18  // PACKET_FANOUT
+	packetIgnoreOut    = 23  // PACKET_IGNORE_OUTGOING
+	tpacketV3          = 2   // TPACKET_V3
+	fanoutHashDefrag   = 0x8000
+	packetOutgoing     = 4 // PACKET_OUTGOING
+	tpStatusUser       = 1 // TP_STATUS_USER
+	tpStatusVLANValid  = 0x10
+	tpStatusTPIDValid  = 0x40
+	ethPAll            = 0x0003 // ETH_P_ALL
+	ethP8021Q          = 0x8100
+	tpacket3HdrLen     = 48 // sizeof(struct tpacket3_hdr)
+	sockaddrLLLen      = 20 // sizeof(struct sockaddr_ll)
+	afpBlockSize       = 1 << 18
+	afpFrameSize       = 1 << 11
+	afpBlockTimeout    = 1 // ms
+	afpMinBlocks       = 2
+	afpBlockStatusOff  = 8  // of block_status in struct tpacket_block_desc
+	afpBlockNumPktsOff = 12 // of num_pkts
+	afpBlockFirstOff   = 16 // of offset_to_first_pkt
+)
+
+// struct tpacket_req3
+type tpacketReq3 struct {
+	blockSize      uint32
+	blockNr        uint32
+	frameSize      uint32
+	frameNr        uint32
+	retireBlkTov   uint32
+	sizeofPriv     uint32
+	featureReqWord uint32
+}
+
+// Captures frames from, and injects them into, an interface through an
+// AF_PACKET socket. Frames returned by ReadPacket are only valid until
+// the next call. Not thread-safe, except for WritePacket.
+type AFPacketIO struct {
+	fd      int
+	ring    []byte
+	blocks  int
+	block   int  // the block we are reading, or will read next
+	held    bool // whether the kernel has handed us that block
+	next    int  // offset of the next frame in the block
+	pending int  // frames left in the block
+}
+
+// Open a socket with a ring of about the given size, capturing frames
+// coming in on the interface. When fanoutGroup is non-zero the socket
+// joins that fanout group on the interface.
+func NewAFPacketIO(iface *net.Interface, ringSize int, fanoutGroup uint16) (*AFPacketIO, error) {
+	fd, err := openPacketSocket(iface, ethPAll)
+	if err != nil {
+		return nil, err
+	}
+	afp := &AFPacketIO{fd: fd, blocks: ringSize / afpBlockSize}
+	if afp.blocks < afpMinBlocks {
+		afp.blocks = afpMinBlocks
+	}
+	if err := afp.setup(fanoutGroup); err != nil {
+		afp.Close()
+		return nil, err
+	}
+	return afp, nil
+}
+
+// Open a socket for injecting frames into the interface only
+func NewAFPacketO(iface *net.Interface) (*AFPacketIO, error) {
+	fd, err := openPacketSocket(iface, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &AFPacketIO{fd: fd}, nil
+}
+
+// Open a packet socket bound to the interface, capturing frames of the
+// protocol, if any.
+func openPacketSocket(iface *net.Interface, protocol uint16) (int, error) {
+	proto := htons(protocol)
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(proto))
+	if err != nil {
+		return -1, os.NewSyscallError("socket", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: proto, Ifindex: iface.Index}); err != nil {
+		syscall.Close(fd)
+		return -1, os.NewSyscallError("bind", err)
+	}
+	return fd, nil
+}
+
+func (afp *AFPacketIO) setup(fanoutGroup uint16) error {
+	if err := syscall.SetsockoptInt(afp.fd, solPacket, packetVersion, tpacketV3); err != nil {
+		return os.NewSyscallError("setsockopt PACKET_VERSION", err)
+	}
+	// Only kernels from 4.20 let us leave out the frames we send;
+	// ReadPacket skips them on others.
+	syscall.SetsockoptInt(afp.fd, solPacket, packetIgnoreOut, 1)
+	req := tpacketReq3{
+		blockSize:    afpBlockSize,
+		blockNr:      uint32(afp.blocks),
+		frameSize:    afpFrameSize,
+		frameNr:      uint32(afp.blocks * afpBlockSize / afpFrameSize),
+		retireBlkTov: afpBlockTimeout}
+	// SetsockoptString is the only way the syscall package offers of
+	// passing a struct on all platforms.
+	reqBytes := (*[unsafe.Sizeof(req)]byte)(unsafe.Pointer(&req))[:]
+	if err := syscall.SetsockoptString(afp.fd, solPacket, packetRxRing, string(reqBytes)); err != nil {
+		return os.NewSyscallError("setsockopt PACKET_RX_RING", err)
+	}
+	ring, err := syscall.Mmap(afp.fd, 0, afp.blocks*afpBlockSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return os.NewSyscallError("mmap", err)
+	}
+	afp.ring = ring
+	if fanoutGroup != 0 {
+		if err := syscall.SetsockoptInt(afp.fd, solPacket, packetFanout, int(fanoutGroup)|fanoutHashDefrag<<16); err != nil {
+			return os.NewSyscallError("setsockopt PACKET_FANOUT", err)
+		}
+	}
+	return nil
+}
+
+func (afp *AFPacketIO) ReadPacket() ([]byte, error) {
+	for {
+		if afp.pending > 0 {
+			if frame, ok := afp.nextFrame(); ok {
+				return frame, nil
+			}
+			continue
+		}
+		if afp.held {
+			// Hand the block back to the kernel
+			atomic.StoreUint32(afp.blockField(afpBlockStatusOff), 0)
+			afp.held = false
+			afp.block = (afp.block + 1) % afp.blocks
+		}
+		if atomic.LoadUint32(afp.blockField(afpBlockStatusOff))&tpStatusUser == 0 {
+			if err := afp.wait(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		afp.held = true
+		afp.pending = int(*afp.blockField(afpBlockNumPktsOff))
+		afp.next = int(*afp.blockField(afpBlockFirstOff))
+	}
+}
+
+// Take the next frame from the block we hold, unless it's one we
+// sent.
+func (afp *AFPacketIO) nextFrame() ([]byte, bool) {
+	hdr := afp.ring[afp.block*afpBlockSize+afp.next:]
+	afp.next += int(nativeUint32(hdr[0:]))
+	afp.pending--
+	if hdr[tpacket3HdrLen+10] == packetOutgoing { // sll_pkttype
+		return nil, false
+	}
+	snapLen := int(nativeUint32(hdr[12:]))
+	status := nativeUint32(hdr[20:])
+	mac := int(*(*uint16)(unsafe.Pointer(&hdr[24])))
+	// The kernel strips VLAN tags, leaving them in the header. There
+	// is always room to put them back in front of the frame.
+	if status&tpStatusVLANValid != 0 && mac >= tpacket3HdrLen+sockaddrLLLen+4 {
+		tpid := uint16(ethP8021Q)
+		if status&tpStatusTPIDValid != 0 {
+			tpid = *(*uint16)(unsafe.Pointer(&hdr[36]))
+		}
+		tci := uint16(nativeUint32(hdr[32:]))
+		copy(hdr[mac-4:], hdr[mac:mac+12])
+		mac -= 4
+		snapLen += 4
+		hdr[mac+12], hdr[mac+13] = byte(tpid>>8), byte(tpid)
+		hdr[mac+14], hdr[mac+15] = byte(tci>>8), byte(tci)
+	}
+	return hdr[mac : mac+snapLen], true
+}
+
+func (afp *AFPacketIO) blockField(offset int) *uint32 {
+	return (*uint32)(unsafe.Pointer(&afp.ring[afp.block*afpBlockSize+offset]))
+}
+
+// Wait for the kernel to hand over a block
+func (afp *AFPacketIO) wait() error {
+	var fds syscall.FdSet
+	bits := 8 * int(unsafe.Sizeof(fds.Bits[0]))
+	fds.Bits[afp.fd/bits] |= 1 << uint(afp.fd%bits)
+	for {
+		_, err := syscall.Select(afp.fd+1, &fds, nil, nil, nil)
+		if err != syscall.EINTR {
+			return os.NewSyscallError("select", err)
+		}
+	}
+}
+
+func (afp *AFPacketIO) WritePacket(data []byte) error {
+	_, err := syscall.Write(afp.fd, data)
+	return os.NewSyscallError("write", err)
+}
+
+// Have the kernel only hand us the frames the filter accepts
+func (afp *AFPacketIO) SetCaptureFilter(filter *CaptureFilter) error {
+	prog, err := filter.Program()
+	if err != nil {
+		return err
+	}
+	return os.NewSyscallError("setsockopt SO_ATTACH_FILTER", syscall.AttachLsf(afp.fd, prog))
+}
+
+func (afp *AFPacketIO) Close() error {
+	if afp.ring != nil {
+		syscall.Munmap(afp.ring)
+		afp.ring = nil
+	}
+	return syscall.Close(afp.fd)
+}
+
+// Open sockets to capture frames on the interface with, one per
+// reader, in a fanout group if there are several, and one to inject
+// frames with. The sockets share the ring size between them.
+func openAFPacket(iface *net.Interface, ringSize int, readers int) ([]PacketSourceSink, PacketSink, error) {
+	if readers < 1 {
+		readers = 1
+	}
+	var fanoutGroup uint16
+	if readers > 1 {
+		// Groups are per network namespace, so we need one nobody
+		// else is likely to use
+		fanoutGroup = uint16(os.Getpid())
+		if fanoutGroup == 0 {
+			fanoutGroup = 1
+		}
+	}
+	var sources []PacketSourceSink
+	closeAll := func() {
+		for _, source := range sources {
+			source.(*AFPacketIO).Close()
+		}
+	}
+	for i := 0; i < readers; i++ {
+		afp, err := NewAFPacketIO(iface, ringSize/readers, fanoutGroup)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		sources = append(sources, afp)
+	}
+	po, err := NewAFPacketO(iface)
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	return sources, po, nil
+}
+
+func nativeUint32(b []byte) uint32 {
+	return *(*uint32)(unsafe.Pointer(&b[0]))
+}
+
+// We only run on little-endian platforms
+func htons(n uint16) uint16 {
+	return n<<8 | n>>8
+}
@@ -0,0 +1,64 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+)
+
+func TestParseCaptureBackend(t *testing.T) {
+	for _, name := range []string{"pcap", "afpacket"} {
+		backend, err := ParseCaptureBackend(name)
+		wt.AssertNoErr(t, err)
+		wt.AssertEqualString(t, backend.String(), name, "backend name")
+	}
+	if _, err := ParseCaptureBackend("bogus"); err == nil {
+		wt.Fatalf(t, "Expected error parsing bogus backend")
+	}
+}
+
+// Lay out a frame in the ring as the kernel would, returning the
+// offset of the next one.
+func putTestFrame(ring []byte, offset int, frame []byte, pktType byte, vlanTCI uint16) int {
+	hdr := ring[offset:]
+	mac := 82
+	next := (mac + len(frame) + 15) &^ 15
+	*(*uint32)(unsafe.Pointer(&hdr[0])) = uint32(next)
+	*(*uint32)(unsafe.Pointer(&hdr[12])) = uint32(len(frame))
+	if vlanTCI != 0 {
+		*(*uint32)(unsafe.Pointer(&hdr[20])) = tpStatusUser | tpStatusVLANValid
+		*(*uint32)(unsafe.Pointer(&hdr[32])) = uint32(vlanTCI)
+	}
+	*(*uint16)(unsafe.Pointer(&hdr[24])) = uint16(mac)
+	hdr[tpacket3HdrLen+10] = pktType
+	copy(hdr[mac:], frame)
+	return offset + next
+}
+
+func TestAFPacketRead(t *testing.T) {
+	afp := &AFPacketIO{ring: make([]byte, 2*afpBlockSize), blocks: 2}
+	frame := []byte("0123456789ab\x08\x00payload")
+	offset := putTestFrame(afp.ring, 48, frame, 0, 0)
+	offset = putTestFrame(afp.ring, offset, []byte("sent by us"), packetOutgoing, 0)
+	putTestFrame(afp.ring, offset, frame, 0, 42)
+	*afp.blockField(afpBlockNumPktsOff) = 3
+	*afp.blockField(afpBlockFirstOff) = 48
+	atomic.StoreUint32(afp.blockField(afpBlockStatusOff), tpStatusUser)
+
+	pkt, err := afp.ReadPacket()
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, string(pkt), string(frame), "frame")
+	pkt, err = afp.ReadPacket()
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, string(pkt), "0123456789ab\x81\x00\x00\x2a\x08\x00payload", "frame with VLAN tag restored")
+
+	// The next read hands the block back, and moves on to the next one
+	block := afp.ring[afpBlockSize:]
+	putTestFrame(block, 48, []byte("next block"), 0, 0)
+	block[afpBlockNumPktsOff], block[afpBlockFirstOff], block[afpBlockStatusOff] = 1, 48, tpStatusUser
+	pkt, err = afp.ReadPacket()
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, string(pkt), "next block", "frame from next block")
+	wt.AssertEqualInt(t, int(afp.ring[afpBlockStatusOff]), 0, "status of block handed back")
+}
@@ -0,0 +1,151 @@
+package router
+
+import (
+	"fmt"
+	weavenet "github.com/zettio/weave/net"
+	"net"
+	"os"
+)
+
+// Attaching containers to the bridge, given their network namespace,
+// all done by us rather than by the weave script with 'ip' commands:
+// we create a veth pair with one end on the bridge, move the other end
+// into the container's namespace under the name the container is to
+// see, give it the container's address, and route multicast through
+// it. The veths get the names the CNI plugin gives them, after the
+// container's ID, so either can detach what the other attached, and
+// like the veths attached over /bridge/attach, we keep their local
+// ends attached to the bridge.
+//
+// Attaching a container which has the device already just gives it
+// the address too, if it doesn't have it, as 'weave attach' does.
+
+const DefaultContainerIfName = "ethwe"
+
+var multicastRoute = &net.IPNet{IP: net.IPv4(224, 0, 0, 0), Mask: net.CIDRMask(4, 32)}
+
+// The path of the network namespace of the process, which has to be in
+// our PID namespace, e.g. with the router in one sharing the host's.
+func ProcessNetNS(pid int) string {
+	return fmt.Sprintf("/proc/%d/ns/net", pid)
+}
+
+// The names of the local and guest ends of the container's veth;
+// interface names are limited to 15 characters.
+func ContainerVethNames(containerID string) (string, string) {
+	if len(containerID) > 7 {
+		containerID = containerID[:7]
+	}
+	return "vethwepl" + containerID, "vethwepg" + containerID
+}
+
+// Attach the container, in the network namespace at the path, to the
+// bridge, as ifName with the address.
+func (bridge *Bridge) AttachContainer(containerID, netNS, ifName string, addr *net.IPNet) error {
+	if err := bridge.checkContainerNetNS(netNS); err != nil {
+		return err
+	}
+	attached := false
+	err := weavenet.WithNetNS(netNS, func() error {
+		if _, err := net.InterfaceByName(ifName); err != nil {
+			return nil
+		}
+		attached = true
+		return addAddress(ifName, addr)
+	})
+	if err != nil || attached {
+		return err
+	}
+
+	local, guest := ContainerVethNames(containerID)
+	if err := bridge.AttachVeth(local, guest); err != nil {
+		return err
+	}
+	if err := bridge.moveVeth(guest, netNS); err != nil {
+		bridge.DetachVeth(local)
+		return err
+	}
+	err = weavenet.WithNetNS(netNS, func() error {
+		if err := weavenet.RenameLink(guest, ifName); err != nil {
+			return err
+		}
+		if err := addAddress(ifName, addr); err != nil {
+			return err
+		}
+		if err := weavenet.SetLinkUp(ifName); err != nil {
+			return err
+		}
+		// The container may route multicast elsewhere already
+		if err := weavenet.AddRoute(multicastRoute, nil, ifName); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("Unable to add route to %s: %v", multicastRoute, err)
+		}
+		return nil
+	})
+	if err != nil {
+		// Takes the guest end with it, wherever that is
+		bridge.DetachVeth(local)
+		return err
+	}
+	return nil
+}
+
+// Detach the container, deleting its veth, should it still have one.
+func (bridge *Bridge) DetachContainer(containerID string) error {
+	local, _ := ContainerVethNames(containerID)
+	bridge.Lock()
+	defer bridge.Unlock()
+	delete(bridge.veths, local)
+	return weavenet.WithNetNS(bridge.hostNetNS, func() error {
+		if _, err := net.InterfaceByName(local); err != nil {
+			// gone with its container
+			return nil
+		}
+		return weavenet.DeleteLink(local)
+	})
+}
+
+// Refuse containers sharing the network namespace of the host, i.e.
+// of the bridge, since moving the veth there would leave it where it
+// is.
+func (bridge *Bridge) checkContainerNetNS(netNS string) error {
+	hostNetNS := bridge.hostNetNS
+	if hostNetNS == "" {
+		hostNetNS = "/proc/self/ns/net"
+	}
+	container, err := os.Stat(netNS)
+	if err != nil {
+		return err
+	}
+	host, err := os.Stat(hostNetNS)
+	if err != nil {
+		return err
+	}
+	if os.SameFile(container, host) {
+		return fmt.Errorf("container is in the host's network namespace, e.g. started with --net=host, and so can't be attached")
+	}
+	return nil
+}
+
+// Move the guest end of a veth into the container's network namespace,
+// with checksum offload off, so the frames the container sends carry
+// their checksums when we capture them.
+func (bridge *Bridge) moveVeth(guest, netNS string) error {
+	ns, err := os.Open(netNS)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+	return weavenet.WithNetNS(bridge.hostNetNS, func() error {
+		if err := weavenet.SetTxChecksumOff(guest); err != nil {
+			return err
+		}
+		return weavenet.SetLinkNetNS(guest, ns)
+	})
+}
+
+func addAddress(ifName string, addr *net.IPNet) error {
+	if err := weavenet.AddAddress(ifName, addr); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Unable to add address %v to %s: %v", addr, ifName, err)
+	}
+	return nil
+}
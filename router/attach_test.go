@@ -0,0 +1,29 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestContainerVethNames(t *testing.T) {
+	local, guest := ContainerVethNames("3f4e5d6c7b8a9f0e")
+	wt.AssertEqualString(t, local, "vethwepl3f4e5d6", "local end")
+	wt.AssertEqualString(t, guest, "vethwepg3f4e5d6", "guest end")
+	local, _ = ContainerVethNames("abc")
+	wt.AssertEqualString(t, local, "vethweplabc", "local end")
+	wt.AssertEqualString(t, ProcessNetNS(42), "/proc/42/ns/net", "network namespace")
+}
+
+func TestAttachHostNetNS(t *testing.T) {
+	bridge := NewBridge("weave", 1410, false, "")
+	addr := &net.IPNet{IP: net.IPv4(10, 2, 0, 1), Mask: net.CIDRMask(16, 32)}
+	// Our own process shares our network namespace
+	if err := bridge.AttachContainer("abc", ProcessNetNS(os.Getpid()), DefaultContainerIfName, addr); err == nil {
+		wt.Fatalf(t, "Expected attaching a container in the host's network namespace to fail")
+	}
+	if err := bridge.AttachContainer("abc", "/nonexistent/ns/net", DefaultContainerIfName, addr); err == nil {
+		wt.Fatalf(t, "Expected attaching a container without a network namespace to fail")
+	}
+}
@@ -0,0 +1,67 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Peers may be told to keep their traffic with each other to one of
+// the host's addresses, e.g. that of a NIC dedicated to replication.
+// With BindAddr, we listen for peers on that address only, UDP and
+// TCP alike, and connect to them from it, so the raw sockets we send
+// DF packets on, which follow the control connection, send from it
+// too, and so does the UDP listener, which we send all other packets
+// on. Peers' addresses of the other family are then out of reach.
+
+// Parse the address to bind to: an IP address, or the name of an
+// interface, which stands for its first IPv4 address, or failing that
+// its first global unicast IPv6 one. Empty for none.
+func ParseBindAddr(s string) (net.IP, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		return ip, nil
+	}
+	iface, err := net.InterfaceByName(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid bind address %q: neither an IP address nor an interface", s)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ipv6 net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		switch {
+		case !ok:
+		case ipNet.IP.To4() != nil:
+			return ipNet.IP, nil
+		case ipv6 == nil && ipNet.IP.IsGlobalUnicast():
+			ipv6 = ipNet.IP
+		}
+	}
+	if ipv6 == nil {
+		return nil, fmt.Errorf("Interface %s has no address to bind to", s)
+	}
+	return ipv6, nil
+}
+
+// The host:port to listen on the port at
+func (router *Router) listenAddr(port int) string {
+	host := ""
+	if router.BindAddr != nil {
+		host = router.BindAddr.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// The address to connect to peers from; nil for any
+func (router *Router) localTCPAddr() *net.TCPAddr {
+	if router.BindAddr == nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: router.BindAddr}
+}
@@ -0,0 +1,50 @@
+package router
+
+import (
+	"fmt"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+)
+
+func TestParseBindAddr(t *testing.T) {
+	ip, err := ParseBindAddr("")
+	wt.AssertNoErr(t, err)
+	if ip != nil {
+		wt.Fatalf(t, "Expected no bind address, got %s", ip)
+	}
+	ip, err = ParseBindAddr("10.0.0.1")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, ip.String(), "10.0.0.1", "bind address")
+	ip, err = ParseBindAddr("lo")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, ip.String(), "127.0.0.1", "bind address of interface")
+	if _, err = ParseBindAddr("nosuchiface0"); err == nil {
+		wt.Fatalf(t, "Expected error for unknown interface")
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	router := &Router{}
+	wt.AssertEqualString(t, router.listenAddr(Port), fmt.Sprint(":", Port), "listen address")
+	router.BindAddr = net.ParseIP("fd00::1")
+	wt.AssertEqualString(t, router.listenAddr(Port), fmt.Sprint("[fd00::1]:", Port), "listen address")
+}
+
+func TestDialPeerFromBindAddr(t *testing.T) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	wt.AssertNoErr(t, err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}
+	conn, err := dialPeer(listener.Addr().String(), local)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, conn.LocalAddr().(*net.TCPAddr).IP.String(), "127.0.0.2", "local address")
+	conn.Close()
+
+	// Addresses of the other family are out of reach
+	if _, err := dialPeer(fmt.Sprint("[::1]:", port), local); err == nil {
+		wt.Fatalf(t, "Expected error dialing an IPv6 address from an IPv4 one")
+	}
+}
@@ -0,0 +1,198 @@
+package router
+
+import (
+	"fmt"
+	weavenet "github.com/zettio/weave/net"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The weave bridge, on the host, which the router can create and keep
+// configured itself, rather than leave it all to the weave script.
+// Every BridgeCheck it repairs any drift in the configuration: it
+// recreates the bridge should it have gone, brings it back up,
+// restores its MTU, and re-attaches the host ends of the container
+// veths it attached, should they have come loose, forgetting those
+// which have gone with their containers.
+//
+// With an automatic MTU, the bridge and veths get the lowest effective
+// PMTU of our established connections, so that containers don't send
+// frames larger than the peers can take without fragmenting, or the
+// configured MTU while there are none. Containers keep the MTU their
+// end of the veth had when they were attached, though.
+//
+// The devices live in the host's network namespace, which needn't be
+// ours, e.g. with the router in a container of its own.
+type Bridge struct {
+	sync.Mutex
+	name      string
+	mtu       int  // as configured
+	autoMTU   bool // follow the effective PMTUs of our connections
+	hostNetNS string
+	router    *Router
+	veths     map[string]bool // host ends of the veths we attached
+	current   int             // the MTU we last set
+	gateway   []*net.IPNet    // addresses to give the bridge, to route to their subnets; see gateway.go
+}
+
+// A manager of the named bridge, in the network namespace at the path,
+// or ours for an empty path. With autoMTU, the MTU only applies while
+// we have no established connections.
+func NewBridge(name string, mtu int, autoMTU bool, hostNetNS string) *Bridge {
+	return &Bridge{
+		name:      name,
+		mtu:       mtu,
+		autoMTU:   autoMTU,
+		hostNetNS: hostNetNS,
+		veths:     make(map[string]bool)}
+}
+
+// Parse an MTU setting: a number, or "auto".
+func ParseBridgeMTU(s string, defaultMTU int) (int, bool, error) {
+	if s == "auto" {
+		return defaultMTU, true, nil
+	}
+	mtu, err := strconv.Atoi(s)
+	if err != nil || mtu < MinPathMTU || mtu > DefaultPMTU {
+		return 0, false, fmt.Errorf("bridge MTU must be auto, or between %d and %d", MinPathMTU, DefaultPMTU)
+	}
+	return mtu, false, nil
+}
+
+// Set the bridge up now, failing if we can't, and then keep it so.
+func (bridge *Bridge) Start(router *Router) error {
+	bridge.router = router
+	if err := bridge.check(); err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(BridgeCheck) {
+			if err := bridge.check(); err != nil {
+				logRouter.Warn("Unable to repair bridge", bridge.name, "-", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// The MTU the bridge and veths should have
+func (bridge *Bridge) desiredMTU() int {
+	if !bridge.autoMTU || bridge.router == nil {
+		return bridge.mtu
+	}
+	if mtu := bridge.router.effectivePMTU(nil); mtu > 0 {
+		return mtu
+	}
+	return bridge.mtu
+}
+
+// Repair whatever drifted from how we configured it
+func (bridge *Bridge) check() error {
+	mtu := bridge.desiredMTU()
+	bridge.Lock()
+	defer bridge.Unlock()
+	return weavenet.WithNetNS(bridge.hostNetNS, func() error {
+		iface, err := net.InterfaceByName(bridge.name)
+		if err != nil {
+			logRouter.Info("Creating bridge", bridge.name, "with MTU", mtu)
+			if err := weavenet.CreateBridge(bridge.name, mtu); err != nil {
+				return err
+			}
+			bridge.current = mtu
+			if iface, err = net.InterfaceByName(bridge.name); err != nil {
+				return err
+			}
+		}
+		if iface.Flags&net.FlagUp == 0 {
+			logRouter.Info("Bringing bridge", bridge.name, "back up")
+			if err := weavenet.SetLinkUp(bridge.name); err != nil {
+				return err
+			}
+		}
+		if mtu != bridge.current {
+			logRouter.Info("Setting MTU of bridge", bridge.name, "and its veths to", mtu)
+		}
+		// Ports come first, since the bridge can't go above the lowest
+		for veth := range bridge.veths {
+			if err := bridge.checkVeth(veth, iface.Index, mtu); err != nil {
+				return err
+			}
+		}
+		if iface.MTU != mtu || mtu != bridge.current {
+			if err := weavenet.SetBridgeMTU(bridge.name, mtu); err != nil {
+				return err
+			}
+		}
+		bridge.current = mtu
+		return bridge.checkGateway()
+	})
+}
+
+func (bridge *Bridge) checkVeth(veth string, bridgeIndex int, mtu int) error {
+	iface, err := net.InterfaceByName(veth)
+	if err != nil {
+		// gone with its container
+		delete(bridge.veths, veth)
+		return nil
+	}
+	master, err := weavenet.LinkMaster(veth)
+	if err != nil {
+		return err
+	}
+	if master != bridgeIndex {
+		logRouter.Info("Re-attaching", veth, "to bridge", bridge.name)
+		if err := weavenet.SetLinkMaster(veth, bridge.name); err != nil {
+			return err
+		}
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		if err := weavenet.SetLinkUp(veth); err != nil {
+			return err
+		}
+	}
+	if iface.MTU != mtu {
+		return weavenet.SetLinkMTU(veth, mtu)
+	}
+	return nil
+}
+
+// Create a veth pair with the local end attached to the bridge, and
+// the other end left for moving into a container.
+func (bridge *Bridge) AttachVeth(local, guest string) error {
+	mtu := bridge.desiredMTU()
+	bridge.Lock()
+	defer bridge.Unlock()
+	return weavenet.WithNetNS(bridge.hostNetNS, func() error {
+		if err := weavenet.CreateVeth(local, guest, mtu, bridge.name); err != nil {
+			return err
+		}
+		bridge.veths[local] = true
+		return nil
+	})
+}
+
+// Delete a veth pair we created, from either end.
+func (bridge *Bridge) DetachVeth(local string) error {
+	bridge.Lock()
+	defer bridge.Unlock()
+	delete(bridge.veths, local)
+	return weavenet.WithNetNS(bridge.hostNetNS, func() error {
+		return weavenet.DeleteLink(local)
+	})
+}
+
+func (bridge *Bridge) String() string {
+	bridge.Lock()
+	defer bridge.Unlock()
+	mode := ""
+	if bridge.autoMTU {
+		mode = " (auto)"
+	}
+	gateway := ""
+	if len(bridge.gateway) > 0 {
+		gateway = ", gateway " + gatewayString(bridge.gateway)
+	}
+	return fmt.Sprintf("%s, MTU %d%s, %d veths%s\n", bridge.name, bridge.current, mode, len(bridge.veths), gateway)
+}
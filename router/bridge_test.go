@@ -0,0 +1,51 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"testing"
+)
+
+func TestParseBridgeMTU(t *testing.T) {
+	mtu, auto, err := ParseBridgeMTU("1410", DefaultPMTU)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, mtu, 1410, "MTU")
+	if auto {
+		wt.Fatalf(t, "expected a fixed MTU")
+	}
+	mtu, auto, err = ParseBridgeMTU("auto", DefaultPMTU)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, mtu, DefaultPMTU, "MTU")
+	if !auto {
+		wt.Fatalf(t, "expected an automatic MTU")
+	}
+	for _, s := range []string{"", "jumbo", "100", "70000"} {
+		if _, _, err := ParseBridgeMTU(s, DefaultPMTU); err == nil {
+			wt.Fatalf(t, "expected an error parsing %q", s)
+		}
+	}
+}
+
+func TestBridgeDesiredMTU(t *testing.T) {
+	bridge := NewBridge("weave", 1410, false, "")
+	wt.AssertEqualInt(t, bridge.desiredMTU(), 1410, "MTU")
+	// Without a router, there are no connections to follow
+	bridge = NewBridge("weave", DefaultPMTU, true, "")
+	wt.AssertEqualInt(t, bridge.desiredMTU(), DefaultPMTU, "MTU")
+}
+
+func TestParseGatewayAddrs(t *testing.T) {
+	addrs, err := ParseGatewayAddrs("10.2.0.254/16, 10.3.1.1/24")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(addrs), 2, "gateway addresses")
+	wt.AssertEqualString(t, addrs[0].String(), "10.2.0.254/16", "gateway address")
+	bridge := NewBridge("weave", 1410, false, "")
+	bridge.SetGateway(addrs)
+	subnets := bridge.GatewaySubnets()
+	wt.AssertEqualString(t, subnets[0].String(), "10.2.0.0/16", "gateway subnet")
+	wt.AssertEqualString(t, subnets[1].String(), "10.3.1.0/24", "gateway subnet")
+	for _, spec := range []string{"10.2.0.254", "fd00::1/64", "10.2.0.0/16", "10.2.0.254/16,10.2.1.1/24"} {
+		if _, err := ParseGatewayAddrs(spec); err == nil {
+			wt.Fatalf(t, "expected an error parsing %q", spec)
+		}
+	}
+}
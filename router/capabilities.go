@@ -0,0 +1,214 @@
+package router
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Peers tell each other in the handshake which range of protocol
+// versions they speak, and which optional features they support, as
+// a bitmap. A connection speaks the highest version both ends do, and
+// uses the features both ends support, so that new features can be
+// rolled out across a cluster one peer at a time.
+//
+// Older peers insist on an exact protocol version, and announce their
+// features as individual handshake fields, which we still send and
+// understand.
+
+type Capabilities uint64
+
+const (
+	CapRekey Capabilities = 1 << iota
+	CapEncryptionStreams
+	CapPasswordRotation
+	CapPadding
+	CapTCPFallback
+	CapNATTraversal
+	CapDirectionalControlKeys
+	CapCompression
+	CapLinkQuality
+	CapTenants
+	CapVXLAN
+	CapGeneve
+	CapWireGuard
+	CapThroughputTests
+	CapConnUIDs
+	CapRoaming
+	CapJoinTokens
+	CapECN
+	CapStandby
+	CapMultiPath
+	CapKeepalives
+	CapPlaintext
+	CapGossipCompression
+	CapGossipDeltas
+	CapHopLimits
+	CapHandshakeMAC
+)
+
+// Capabilities as announced by older peers, in individual fields
+var capabilityFields = []struct {
+	capability   Capabilities
+	field, value string
+}{
+	{CapRekey, "Rekey", fmt.Sprint(true)},
+	{CapEncryptionStreams, "EncryptionStreams", fmt.Sprint(true)},
+	{CapPasswordRotation, "PasswordRotation", fmt.Sprint(true)},
+	{CapPadding, "Padding", fmt.Sprint(true)},
+	{CapTCPFallback, "TCPFallback", fmt.Sprint(true)},
+	{CapNATTraversal, "NATTraversal", fmt.Sprint(true)},
+	{CapDirectionalControlKeys, "ControlKeys", "directional"}}
+
+var capabilityNames = map[Capabilities]string{
+	CapRekey:                  "rekey",
+	CapEncryptionStreams:      "encryption-streams",
+	CapPasswordRotation:       "password-rotation",
+	CapPadding:                "padding",
+	CapTCPFallback:            "tcp-fallback",
+	CapNATTraversal:           "nat-traversal",
+	CapDirectionalControlKeys: "directional-control-keys",
+	CapCompression:            "compression",
+	CapLinkQuality:            "link-quality",
+	CapTenants:                "tenants",
+	CapVXLAN:                  "vxlan",
+	CapGeneve:                 "geneve",
+	CapWireGuard:              "wireguard",
+	CapThroughputTests:        "throughput-tests",
+	CapConnUIDs:               "conn-uids",
+	CapRoaming:                "roaming",
+	CapJoinTokens:             "join-tokens",
+	CapECN:                    "ecn",
+	CapStandby:                "standby",
+	CapMultiPath:              "multipath",
+	CapKeepalives:             "nat-keepalives",
+	CapPlaintext:              "plaintext",
+	CapGossipCompression:      "gossip-compression",
+	CapGossipDeltas:           "gossip-deltas",
+	CapHopLimits:              "hop-limits",
+	CapHandshakeMAC:           "handshake-mac"}
+
+func (caps Capabilities) Has(capability Capabilities) bool {
+	return caps&capability == capability
+}
+
+func (caps Capabilities) Names() []string {
+	names := []string{}
+	for capability := Capabilities(1); capability != 0; capability <<= 1 {
+		if !caps.Has(capability) {
+			continue
+		}
+		if name, found := capabilityNames[capability]; found {
+			names = append(names, name)
+		} else {
+			names = append(names, fmt.Sprintf("0x%x", uint64(capability)))
+		}
+	}
+	return names
+}
+
+func (caps Capabilities) String() string {
+	return strings.Join(caps.Names(), ",")
+}
+
+// What we offer on a connection. Features which only make sense with
+// encryption are only on offer with a password.
+func (router *Router) capabilities() Capabilities {
+	caps := CapDirectionalControlKeys | CapLinkQuality | CapTenants | CapThroughputTests | CapConnUIDs | CapKeepalives |
+		CapGossipCompression | CapGossipDeltas | CapHopLimits | CapHandshakeMAC
+	if router.UsingPassword() {
+		caps |= CapRekey | CapEncryptionStreams | CapPasswordRotation | CapPadding | CapCompression | CapRoaming
+	}
+	if router.UsingPassword() && router.JoinAuth != nil {
+		caps |= CapJoinTokens
+	}
+	if router.UsingPassword() && !router.Plaintext.Empty() {
+		caps |= CapPlaintext
+	}
+	if router.TCPFallback {
+		caps |= CapTCPFallback
+	}
+	if router.NATTraversal {
+		caps |= CapNATTraversal
+	}
+	if router.ECN {
+		caps |= CapECN
+	}
+	if router.Standby {
+		caps |= CapStandby
+	}
+	if router.MultiPath {
+		caps |= CapMultiPath
+	}
+	if router.WireGuard != nil {
+		caps |= CapWireGuard
+	}
+	if !router.UsingPassword() {
+		switch router.Encap {
+		case EncapVXLAN:
+			caps |= CapVXLAN
+		case EncapGeneve:
+			caps |= CapGeneve
+		}
+	}
+	return caps
+}
+
+// Add our capabilities and supported versions to the handshake.
+func sendCapabilities(handshakeSend map[string]string, caps Capabilities) {
+	handshakeSend["ProtocolMinVersion"] = fmt.Sprint(ProtocolMinVersion)
+	handshakeSend["Capabilities"] = strconv.FormatUint(uint64(caps), 10)
+	for _, cf := range capabilityFields {
+		if caps.Has(cf.capability) {
+			handshakeSend[cf.field] = cf.value
+		}
+	}
+}
+
+// The protocol version to speak with the remote, and the capabilities
+// it announced.
+func receiveCapabilities(handshakeRecv map[string]string) (int, Capabilities, error) {
+	fv := NewFieldValidator(handshakeRecv)
+	remoteVersionStr, _ := fv.Value("ProtocolVersion")
+	if err := fv.Err(); err != nil {
+		return 0, 0, err
+	}
+	remoteVersion, err := strconv.Atoi(remoteVersionStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	remoteMinVersion := remoteVersion
+	if minVersionStr, found := handshakeRecv["ProtocolMinVersion"]; found {
+		if remoteMinVersion, err = strconv.Atoi(minVersionStr); err != nil {
+			return 0, 0, err
+		}
+	}
+	version, err := negotiateVersion(remoteMinVersion, remoteVersion)
+	if err != nil {
+		return 0, 0, err
+	}
+	if capsStr, found := handshakeRecv["Capabilities"]; found {
+		caps, err := strconv.ParseUint(capsStr, 10, 64)
+		return version, Capabilities(caps), err
+	}
+	var caps Capabilities
+	for _, cf := range capabilityFields {
+		if handshakeRecv[cf.field] == cf.value {
+			caps |= cf.capability
+		}
+	}
+	return version, caps, nil
+}
+
+// The highest version in both our range and the remote's
+func negotiateVersion(remoteMin, remoteMax int) (int, error) {
+	version := ProtocolVersion
+	if remoteMax < version {
+		version = remoteMax
+	}
+	if version < ProtocolMinVersion || version < remoteMin {
+		return 0, fmt.Errorf("No protocol version in common; we speak %d to %d, remote speaks %d to %d",
+			ProtocolMinVersion, ProtocolVersion, remoteMin, remoteMax)
+	}
+	return version, nil
+}
@@ -0,0 +1,50 @@
+package router
+
+import (
+	"fmt"
+	wt "github.com/zettio/weave/testing"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	version, err := negotiateVersion(ProtocolMinVersion, ProtocolVersion+2)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, version, ProtocolVersion, "version with newer peer")
+	version, err = negotiateVersion(ProtocolMinVersion, ProtocolMinVersion)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, version, ProtocolMinVersion, "version with oldest peer")
+	if _, err = negotiateVersion(ProtocolVersion+1, ProtocolVersion+2); err == nil {
+		wt.Fatalf(t, "Expected no version in common with a much newer peer")
+	}
+	if _, err = negotiateVersion(ProtocolMinVersion-2, ProtocolMinVersion-1); err == nil {
+		wt.Fatalf(t, "Expected no version in common with a much older peer")
+	}
+}
+
+func TestReceiveCapabilities(t *testing.T) {
+	caps := CapRekey | CapTCPFallback | Capabilities(1<<40)
+	handshake := map[string]string{"ProtocolVersion": fmt.Sprint(ProtocolVersion)}
+	sendCapabilities(handshake, caps)
+	_, received, err := receiveCapabilities(handshake)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualuint64(t, uint64(received), uint64(caps), "capabilities")
+	wt.AssertEqualString(t, received.String(), "rekey,tcp-fallback,0x10000000000", "capability names")
+
+	// Older peers announce their capabilities in individual fields
+	legacy := map[string]string{
+		"ProtocolVersion":   fmt.Sprint(ProtocolVersion),
+		"Rekey":             fmt.Sprint(true),
+		"NATTraversal":      fmt.Sprint(false),
+		"ControlKeys":       "directional",
+		"EncryptionStreams": fmt.Sprint(true)}
+	version, received, err := receiveCapabilities(legacy)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, version, ProtocolVersion, "version")
+	wt.AssertEqualuint64(t, uint64(received), uint64(CapRekey|CapDirectionalControlKeys|CapEncryptionStreams),
+		"legacy capabilities")
+
+	legacy["ProtocolVersion"] = fmt.Sprint(ProtocolVersion + 1)
+	if _, _, err = receiveCapabilities(legacy); err == nil {
+		wt.Fatalf(t, "Expected older peer with a different version to be rejected")
+	}
+}
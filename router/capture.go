@@ -0,0 +1,239 @@
+package router
+
+import (
+	"bytes"
+	"code.google.com/p/gopacket"
+	"code.google.com/p/gopacket/layers"
+	"code.google.com/p/gopacket/pcapgo"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Captures write out what taps get (see tap.go): as a pcap file on the
+// host, until stopped, or as pcapng, which records which way each
+// frame went, to a writer such as an HTTP response. Frames are
+// Ethernet; packets are IP datagrams, with the UDP header of how they
+// travel, or would travel for connections falling back to TCP.
+
+type CaptureFormat int
+
+const (
+	PcapFormat CaptureFormat = iota
+	PcapngFormat
+)
+
+var captureFormatNames = map[CaptureFormat]string{
+	PcapFormat:   "pcap",
+	PcapngFormat: "pcapng"}
+
+func ParseCaptureFormat(name string) (CaptureFormat, error) {
+	for format, formatName := range captureFormatNames {
+		if formatName == name {
+			return format, nil
+		}
+	}
+	return PcapFormat, fmt.Errorf("Unknown capture format: %s", name)
+}
+
+func (format CaptureFormat) String() string {
+	return captureFormatNames[format]
+}
+
+func (stage TapStage) linkType() layers.LinkType {
+	if stage == TapPackets {
+		return layers.LinkTypeRaw
+	}
+	return layers.LinkTypeEthernet
+}
+
+type captureWriter interface {
+	WriteFrame(tf tappedFrame) error
+}
+
+// Write the frames the tap gets to w in the format, until told to
+// stop. Writers which can flush, such as HTTP responses, get flushed
+// after every frame, so the frames go out as they arrive.
+func (tap *FrameTap) WriteCapture(w io.Writer, format CaptureFormat, stop <-chan time.Time) error {
+	var (
+		cw  captureWriter
+		err error
+	)
+	if format == PcapngFormat {
+		cw, err = newPcapngWriter(w, tap.stage.linkType())
+	} else {
+		cw, err = newPcapWriter(w, tap.stage.linkType())
+	}
+	if err != nil {
+		return err
+	}
+	flusher, canFlush := w.(interface {
+		Flush()
+	})
+	for {
+		select {
+		case tf := <-tap.frames:
+			if err := cw.WriteFrame(tf); err != nil {
+				return err
+			}
+			if canFlush {
+				flusher.Flush()
+			}
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+type pcapWriter struct {
+	w *pcapgo.Writer
+}
+
+func newPcapWriter(w io.Writer, linkType layers.LinkType) (*pcapWriter, error) {
+	pw := pcapgo.NewWriter(w)
+	if err := pw.WriteFileHeader(MaxUDPPacketSize, linkType); err != nil {
+		return nil, err
+	}
+	return &pcapWriter{pw}, nil
+}
+
+func (pw *pcapWriter) WriteFrame(tf tappedFrame) error {
+	ci := gopacket.CaptureInfo{Timestamp: tf.time, CaptureLength: len(tf.frame), Length: len(tf.frame)}
+	return pw.w.WritePacket(ci, tf.frame)
+}
+
+// Just enough pcapng for one interface, with timestamps in
+// microseconds, and the direction of each packet.
+
+const (
+	pcapngSectionHeader    = 0x0a0d0d0a
+	pcapngInterface        = 1
+	pcapngEnhancedPacket   = 6
+	pcapngByteOrderMagic   = 0x1a2b3c4d
+	pcapngOptEPBFlags      = 2
+	pcapngFlagInbound      = 1
+	pcapngFlagOutbound     = 2
+	pcapngEnhancedOverhead = 7*4 + 8 + 4 + 4 // fields, flags option, end of options, length
+)
+
+type pcapngWriter struct {
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func newPcapngWriter(w io.Writer, linkType layers.LinkType) (*pcapngWriter, error) {
+	pw := &pcapngWriter{w: w}
+	// Version 1.0, and a section of unknown length
+	pw.put(pcapngSectionHeader, 28, pcapngByteOrderMagic, 1, 0xffffffff, 0xffffffff, 28)
+	pw.put(pcapngInterface, 20, uint32(linkType), MaxUDPPacketSize, 20)
+	return pw, pw.flush()
+}
+
+func (pw *pcapngWriter) WriteFrame(tf tappedFrame) error {
+	padded := (len(tf.frame) + 3) &^ 3
+	blockLen := uint32(pcapngEnhancedOverhead + padded)
+	micros := uint64(tf.time.UnixNano() / int64(time.Microsecond))
+	pw.put(pcapngEnhancedPacket, blockLen, 0, uint32(micros>>32), uint32(micros), uint32(len(tf.frame)), uint32(len(tf.frame)))
+	pw.buf.Write(tf.frame)
+	pw.buf.Write(make([]byte, padded-len(tf.frame)))
+	flags := uint32(pcapngFlagInbound)
+	if tf.outbound {
+		flags = pcapngFlagOutbound
+	}
+	pw.put(pcapngOptEPBFlags|4<<16, flags, 0, blockLen)
+	return pw.flush()
+}
+
+func (pw *pcapngWriter) put(words ...uint32) {
+	for _, word := range words {
+		binary.Write(&pw.buf, binary.LittleEndian, word)
+	}
+}
+
+func (pw *pcapngWriter) flush() error {
+	_, err := pw.w.Write(pw.buf.Bytes())
+	pw.buf.Reset()
+	return err
+}
+
+// A capture to a pcap file, which runs until stopped.
+type FileCapture struct {
+	ID   int
+	Path string
+	tap  *FrameTap
+	stop chan time.Time
+}
+
+// Start capturing what the tap of the peer would get into a new pcap
+// file at the path.
+func (taps *FrameTaps) StartFileCapture(peer PeerName, stage TapStage, filter *PolicyRule, path string) (*FileCapture, error) {
+	tap, err := taps.Add(peer, stage, filter)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		taps.Remove(tap)
+		return nil, err
+	}
+	taps.Lock()
+	taps.lastID++
+	fc := &FileCapture{ID: taps.lastID, Path: path, tap: tap, stop: make(chan time.Time, 1)}
+	taps.files[fc.ID] = fc
+	taps.Unlock()
+	go func() {
+		if err := tap.WriteCapture(file, PcapFormat, fc.stop); err != nil {
+			logRouter.Warn("Error writing capture to", path, err)
+		}
+		checkWarn(file.Close())
+		taps.Remove(tap)
+		taps.Lock()
+		delete(taps.files, fc.ID)
+		taps.Unlock()
+	}()
+	return fc, nil
+}
+
+func (taps *FrameTaps) StopFileCapture(id int) error {
+	taps.Lock()
+	defer taps.Unlock()
+	fc, found := taps.files[id]
+	if !found {
+		return fmt.Errorf("no capture %d", id)
+	}
+	delete(taps.files, id)
+	fc.stop <- time.Now()
+	return nil
+}
+
+func (fc *FileCapture) String() string {
+	peer := "all peers"
+	if fc.tap.peer != UnknownPeerName {
+		peer = fc.tap.peer.String()
+	}
+	filter := ""
+	if fc.tap.filter != nil {
+		filter = " " + strings.TrimPrefix(fc.tap.filter.String(), "allow ")
+	}
+	return fmt.Sprintf("%d: %s of %s%s to %s, %d missed", fc.ID, fc.tap.stage, peer, filter, fc.Path, fc.tap.Dropped())
+}
+
+// The file captures running.
+func (taps *FrameTaps) String() string {
+	taps.RLock()
+	defer taps.RUnlock()
+	ids := []int{}
+	for id := range taps.files {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	var buf bytes.Buffer
+	for _, id := range ids {
+		buf.WriteString(fmt.Sprintln(taps.files[id]))
+	}
+	return buf.String()
+}
@@ -0,0 +1,291 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// With -capture-filter, we have the kernel leave out captured frames
+// we would only throw away, so they never reach userspace: those
+// between two of the MACs we learnt on our bridge, which the bridge
+// delivers itself (see local_macs.go), and the UDP packets we send to
+// peers ourselves, should the route to them go via the bridge. The
+// filter is a pcap expression, or a classic BPF program for AF_PACKET
+// sockets, which we regenerate every CaptureFilterTick while MACs
+// come, go and move, and each sniffing goroutine installs before
+// reading its next frame.
+//
+// Only IP frames between local MACs get left out, so that we still
+// see the ARP traffic between them, and none while we count flows.
+// With more than CaptureFilterMacs local MACs, frames between them
+// all reach us again, since the program would get too long. Nor do we
+// see the frames a MAC sends to other local MACs only, so we forget it
+// after the usual time, and take a frame to learn it again.
+
+type CaptureFilter struct {
+	macs  []net.HardwareAddr // local; frames between them are left to the bridge
+	ips   []net.IP           // ours on the underlay, IPv4 only
+	ports []int              // we send UDP packets to peers from
+}
+
+// Capture handles which can leave out frames
+type filteredPacketSource interface {
+	SetCaptureFilter(*CaptureFilter) error
+}
+
+func NewCaptureFilter(macs []net.HardwareAddr, ips []net.IP, ports []int) *CaptureFilter {
+	filter := &CaptureFilter{ports: ports}
+	if len(macs) <= CaptureFilterMacs {
+		filter.macs = append(filter.macs, macs...)
+		sort.Sort(macsByValue(filter.macs))
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			filter.ips = append(filter.ips, ip4)
+		}
+	}
+	return filter
+}
+
+type macsByValue []net.HardwareAddr
+
+func (macs macsByValue) Len() int           { return len(macs) }
+func (macs macsByValue) Swap(i, j int)      { macs[i], macs[j] = macs[j], macs[i] }
+func (macs macsByValue) Less(i, j int) bool { return macint(macs[i]) < macint(macs[j]) }
+
+// The filter as a pcap expression, including leaving out the frames
+// we inject.
+func (filter *CaptureFilter) Expression() string {
+	expr := "inbound"
+	if len(filter.macs) > 0 {
+		var srcs, dsts []string
+		for _, mac := range filter.macs {
+			srcs = append(srcs, "ether src "+mac.String())
+			dsts = append(dsts, "ether dst "+mac.String())
+		}
+		expr += fmt.Sprintf(" and not ((ip or ip6) and (%s) and (%s))",
+			strings.Join(srcs, " or "), strings.Join(dsts, " or "))
+	}
+	if len(filter.ips) > 0 && len(filter.ports) > 0 {
+		var ips, ports []string
+		for _, ip := range filter.ips {
+			ips = append(ips, "ip src "+ip.String())
+		}
+		for _, port := range filter.ports {
+			ports = append(ports, fmt.Sprint("udp src port ", port))
+		}
+		expr += fmt.Sprintf(" and not ((%s) and (%s))", strings.Join(ips, " or "), strings.Join(ports, " or "))
+	}
+	return expr
+}
+
+// The filter as a classic BPF program, for AF_PACKET sockets:
+//
+//	        ldh [12]                        ; EtherType
+//	        jeq #0x800, src, 0
+//	        jeq #0x86dd, src, 0
+//	        ja own                          ; since jeq can only jump 255 instructions
+//	src:    ld [6]                          ; for each MAC, the source
+//	        jeq #<first 4 bytes>, 0, src2
+//	        ldh [10]
+//	        jeq #<last 2 bytes>, dst, src2
+//	src2:   ...
+//	        ja own
+//	dst:    ld [0]                          ; for each MAC, the destination
+//	        ...                             ; as above, jumping to drop
+//	own:    ldh [12]
+//	        jeq #0x800, 0, accept
+//	        ldb [23]                        ; IP protocol
+//	        jeq #17, 0, accept
+//	        ldh [20]                        ; fragment offset
+//	        jset #0x1fff, accept, 0
+//	        ld [26]                         ; for each of our IPs, the source
+//	        jeq #<ip>, ours, 0
+//	        ...
+//	        ja accept
+//	ours:   ldxb 4*([14]&0xf)               ; the IP header length
+//	        ldh [x+14]                      ; for each port, the source
+//	        jeq #<port>, drop, 0
+//	        ...
+//	accept: ret #262144
+//	drop:   ret #0
+func (filter *CaptureFilter) Program() ([]syscall.SockFilter, error) {
+	prog := newCBPFProgram()
+	if len(filter.macs) > 0 {
+		prog.stmt(syscall.BPF_LD|syscall.BPF_H|syscall.BPF_ABS, 12)
+		prog.jump(syscall.BPF_JEQ, ethTypeIPv4, "src", "")
+		prog.jump(syscall.BPF_JEQ, ethTypeIPv6, "src", "")
+		prog.goTo("own")
+		prog.label("src")
+		prog.matchMACs(6, filter.macs, "src", "dst")
+		prog.goTo("own")
+		prog.label("dst")
+		prog.matchMACs(0, filter.macs, "dst", "drop")
+	}
+	prog.label("own")
+	if len(filter.ips) > 0 && len(filter.ports) > 0 {
+		prog.stmt(syscall.BPF_LD|syscall.BPF_H|syscall.BPF_ABS, 12)
+		prog.jump(syscall.BPF_JEQ, ethTypeIPv4, "", "accept")
+		prog.stmt(syscall.BPF_LD|syscall.BPF_B|syscall.BPF_ABS, 14+9)
+		prog.jump(syscall.BPF_JEQ, syscall.IPPROTO_UDP, "", "accept")
+		prog.stmt(syscall.BPF_LD|syscall.BPF_H|syscall.BPF_ABS, 14+6)
+		prog.jump(syscall.BPF_JSET, 0x1fff, "accept", "")
+		prog.stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, 14+12)
+		for _, ip := range filter.ips {
+			prog.jump(syscall.BPF_JEQ, uint32(ip[0])<<24|uint32(ip[1])<<16|uint32(ip[2])<<8|uint32(ip[3]), "ours", "")
+		}
+		prog.goTo("accept")
+		prog.label("ours")
+		prog.stmt(syscall.BPF_LDX|syscall.BPF_B|syscall.BPF_MSH, 14)
+		prog.stmt(syscall.BPF_LD|syscall.BPF_H|syscall.BPF_IND, 14)
+		for _, port := range filter.ports {
+			prog.jump(syscall.BPF_JEQ, uint32(port), "drop", "")
+		}
+	}
+	prog.label("accept")
+	prog.stmt(syscall.BPF_RET|syscall.BPF_K, 1<<18)
+	prog.label("drop")
+	prog.stmt(syscall.BPF_RET|syscall.BPF_K, 0)
+	return prog.assemble()
+}
+
+const (
+	ethTypeIPv4 = 0x0800
+	ethTypeIPv6 = 0x86dd
+)
+
+func (filter *CaptureFilter) String() string {
+	return fmt.Sprintf("%d local MACs, our UDP packets from %v, ports %v\n", len(filter.macs), filter.ips, filter.ports)
+}
+
+// A classic BPF program, with jumps to labels, which get resolved on
+// assembly.
+type cbpfProgram struct {
+	insns  []syscall.SockFilter
+	labels map[string]int
+	jumps  map[int][2]string // instruction -> labels to jump to if true and if false; "" for the next
+}
+
+func newCBPFProgram() *cbpfProgram {
+	return &cbpfProgram{labels: make(map[string]int), jumps: make(map[int][2]string)}
+}
+
+func (prog *cbpfProgram) stmt(code uint16, k uint32) {
+	prog.insns = append(prog.insns, syscall.SockFilter{Code: code, K: k})
+}
+
+func (prog *cbpfProgram) jump(op uint16, k uint32, jt, jf string) {
+	prog.jumps[len(prog.insns)] = [2]string{jt, jf}
+	prog.stmt(syscall.BPF_JMP|op|syscall.BPF_K, k)
+}
+
+func (prog *cbpfProgram) goTo(label string) {
+	prog.jumps[len(prog.insns)] = [2]string{label, ""}
+	prog.stmt(syscall.BPF_JMP|syscall.BPF_JA, 0)
+}
+
+func (prog *cbpfProgram) label(name string) {
+	prog.labels[name] = len(prog.insns)
+}
+
+// Jump to match if the MAC at the offset in the frame is one of macs
+func (prog *cbpfProgram) matchMACs(offset uint32, macs []net.HardwareAddr, prefix, match string) {
+	for i, mac := range macs {
+		next := fmt.Sprintf("%s%d", prefix, i+1)
+		prog.stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, offset)
+		prog.jump(syscall.BPF_JEQ, uint32(mac[0])<<24|uint32(mac[1])<<16|uint32(mac[2])<<8|uint32(mac[3]), "", next)
+		prog.stmt(syscall.BPF_LD|syscall.BPF_H|syscall.BPF_ABS, offset+4)
+		prog.jump(syscall.BPF_JEQ, uint32(mac[4])<<8|uint32(mac[5]), match, next)
+		prog.label(next)
+	}
+}
+
+func (prog *cbpfProgram) assemble() ([]syscall.SockFilter, error) {
+	offset := func(from int, label string) (uint32, error) {
+		if label == "" {
+			return 0, nil
+		}
+		to, found := prog.labels[label]
+		if !found {
+			return 0, fmt.Errorf("BPF program jumps to unknown label %s", label)
+		}
+		return uint32(to - from - 1), nil
+	}
+	insns := make([]syscall.SockFilter, len(prog.insns))
+	copy(insns, prog.insns)
+	for i, labels := range prog.jumps {
+		jt, err := offset(i, labels[0])
+		if err != nil {
+			return nil, err
+		}
+		jf, err := offset(i, labels[1])
+		if err != nil {
+			return nil, err
+		}
+		if insns[i].Code == syscall.BPF_JMP|syscall.BPF_JA {
+			insns[i].K = jt
+			continue
+		}
+		if jt > 255 || jf > 255 {
+			return nil, fmt.Errorf("BPF program jumps too far at instruction %d", i)
+		}
+		insns[i].Jt, insns[i].Jf = uint8(jt), uint8(jf)
+	}
+	return insns, nil
+}
+
+// Regenerate the filter every CaptureFilterTick, should the MACs at
+// our peer, or our addresses, have changed. The MACs only get looked
+// at again when the MAC caches move to a new generation.
+func (router *Router) filterCapture() {
+	var (
+		macs       []net.HardwareAddr
+		generation uint64
+	)
+	ports := []int{Port}
+	if router.EncapListener != nil {
+		ports = append(ports, router.EncapPort)
+	}
+	update := func() {
+		if router.CaptureFilter() == nil || router.Tenants.Generation() != generation {
+			macs, generation = router.Tenants.PeerMacs(router.Ourself.Peer)
+			if router.FlowAccounting {
+				macs = nil
+			}
+		}
+		filter := NewCaptureFilter(macs, router.underlayIPs(), ports)
+		if old := router.CaptureFilter(); old == nil || old.Expression() != filter.Expression() {
+			router.captureFilter.Store(filter)
+		}
+	}
+	update()
+	for range time.Tick(CaptureFilterTick) {
+		update()
+	}
+}
+
+// The filter the sniffing goroutines should have installed; nil for
+// none.
+func (router *Router) CaptureFilter() *CaptureFilter {
+	filter, _ := router.captureFilter.Load().(*CaptureFilter)
+	return filter
+}
+
+// Install the current filter on the capture handle, if it isn't the
+// installed one already, returning the one now installed.
+func (router *Router) installCaptureFilter(pio PacketSourceSink, installed *CaptureFilter) *CaptureFilter {
+	filter := router.CaptureFilter()
+	if filter == installed {
+		return installed
+	}
+	if source, ok := pio.(filteredPacketSource); ok {
+		// Trying again wouldn't do any better, so we carry on as if
+		// we had installed it.
+		checkWarn(source.SetCaptureFilter(filter))
+	}
+	return filter
+}
@@ -0,0 +1,139 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// Run the classic BPF program over the frame, as far as our programs
+// need, returning what it returns.
+func runCBPF(t *testing.T, prog []syscall.SockFilter, frame []byte) uint32 {
+	var a, x uint32
+	load := func(offset uint32, size uint32) uint32 {
+		if int(offset+size) > len(frame) {
+			wt.Fatalf(t, "Load beyond the end of the frame at %d", offset)
+		}
+		var v uint32
+		for _, b := range frame[offset : offset+size] {
+			v = v<<8 | uint32(b)
+		}
+		return v
+	}
+	sizes := map[uint16]uint32{syscall.BPF_W: 4, syscall.BPF_H: 2, syscall.BPF_B: 1}
+	for pc := 0; pc < len(prog); pc++ {
+		insn := prog[pc]
+		switch insn.Code &^ 0x18 {
+		case syscall.BPF_LD | syscall.BPF_ABS:
+			a = load(insn.K, sizes[insn.Code&0x18])
+			continue
+		case syscall.BPF_LD | syscall.BPF_IND:
+			a = load(x+insn.K, sizes[insn.Code&0x18])
+			continue
+		}
+		switch insn.Code {
+		case syscall.BPF_LDX | syscall.BPF_B | syscall.BPF_MSH:
+			x = 4 * (load(insn.K, 1) & 0xf)
+		case syscall.BPF_JMP | syscall.BPF_JA:
+			pc += int(insn.K)
+		case syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K:
+			if a == insn.K {
+				pc += int(insn.Jt)
+			} else {
+				pc += int(insn.Jf)
+			}
+		case syscall.BPF_JMP | syscall.BPF_JSET | syscall.BPF_K:
+			if a&insn.K != 0 {
+				pc += int(insn.Jt)
+			} else {
+				pc += int(insn.Jf)
+			}
+		case syscall.BPF_RET | syscall.BPF_K:
+			return insn.K
+		default:
+			wt.Fatalf(t, "Unexpected instruction %v", insn)
+		}
+	}
+	wt.Fatalf(t, "Program ran off the end")
+	return 0
+}
+
+func testFrame(src, dst string, ethType uint16, ip []byte) []byte {
+	srcMAC, _ := net.ParseMAC(src)
+	dstMAC, _ := net.ParseMAC(dst)
+	frame := append(append([]byte{}, dstMAC...), srcMAC...)
+	return append(append(frame, byte(ethType>>8), byte(ethType)), ip...)
+}
+
+// An IPv4 header without options, and a UDP header
+func testUDP(src net.IP, srcPort int, fragOffset uint16) []byte {
+	ip := make([]byte, 28)
+	ip[0] = 0x45
+	ip[6], ip[7] = byte(fragOffset>>8), byte(fragOffset)
+	ip[9] = syscall.IPPROTO_UDP
+	copy(ip[12:16], src.To4())
+	ip[20], ip[21] = byte(srcPort>>8), byte(srcPort)
+	return ip
+}
+
+func TestCaptureFilter(t *testing.T) {
+	local1, _ := net.ParseMAC("00:00:00:00:00:01")
+	local2, _ := net.ParseMAC("00:00:00:00:00:02")
+	ourIP := net.ParseIP("192.168.0.1")
+	filter := NewCaptureFilter([]net.HardwareAddr{local2, local1}, []net.IP{ourIP, net.ParseIP("fe80::1")}, []int{Port, VXLANPort})
+	prog, err := filter.Program()
+	wt.AssertNoErr(t, err)
+
+	otherIP := net.ParseIP("192.168.0.2")
+	for _, c := range []struct {
+		frame    []byte
+		accepted bool
+		desc     string
+	}{
+		{testFrame("00:00:00:00:00:01", "00:00:00:00:00:02", ethTypeIPv4, testUDP(otherIP, 53, 0)), false, "IPv4 between local MACs"},
+		{testFrame("00:00:00:00:00:02", "00:00:00:00:00:01", ethTypeIPv6, make([]byte, 40)), false, "IPv6 between local MACs"},
+		{testFrame("00:00:00:00:00:01", "00:00:00:00:00:02", 0x0806, make([]byte, 28)), true, "ARP between local MACs"},
+		{testFrame("00:00:00:00:00:01", "00:00:00:00:00:03", ethTypeIPv4, testUDP(otherIP, 53, 0)), true, "to a MAC elsewhere"},
+		{testFrame("00:00:00:00:00:03", "00:00:00:00:00:01", ethTypeIPv4, testUDP(otherIP, 53, 0)), true, "from a MAC elsewhere"},
+		{testFrame("00:00:00:00:00:01", "ff:ff:ff:ff:ff:ff", ethTypeIPv4, testUDP(otherIP, 53, 0)), true, "broadcast"},
+		{testFrame("00:00:00:00:00:03", "00:00:00:00:00:04", ethTypeIPv4, testUDP(ourIP, Port, 0)), false, "our UDP packet"},
+		{testFrame("00:00:00:00:00:03", "00:00:00:00:00:04", ethTypeIPv4, testUDP(ourIP, VXLANPort, 0)), false, "our VXLAN packet"},
+		{testFrame("00:00:00:00:00:03", "00:00:00:00:00:04", ethTypeIPv4, testUDP(ourIP, Port, 100)), true, "fragment from us"},
+		{testFrame("00:00:00:00:00:03", "00:00:00:00:00:04", ethTypeIPv4, testUDP(ourIP, 53, 0)), true, "from us to another port"},
+		{testFrame("00:00:00:00:00:03", "00:00:00:00:00:04", ethTypeIPv4, testUDP(otherIP, Port, 0)), true, "from another IP"},
+	} {
+		if accepted := runCBPF(t, prog, c.frame) != 0; accepted != c.accepted {
+			wt.Fatalf(t, "%s: expected accepted %v, got %v", c.desc, c.accepted, accepted)
+		}
+	}
+
+	expr := filter.Expression()
+	for _, part := range []string{"inbound", "ether src 00:00:00:00:00:01 or ether src 00:00:00:00:00:02", "ip src 192.168.0.1", "udp src port 6783 or udp src port 4789"} {
+		if !strings.Contains(expr, part) {
+			wt.Fatalf(t, "Expected %q in filter expression %q", part, expr)
+		}
+	}
+
+	// Too many MACs to compare each frame's with
+	var macs []net.HardwareAddr
+	for i := 0; i <= CaptureFilterMacs; i++ {
+		macs = append(macs, net.HardwareAddr{0, 0, 0, 0, 1, byte(i)})
+	}
+	filter = NewCaptureFilter(macs, nil, nil)
+	wt.AssertEqualString(t, filter.Expression(), "inbound", "filter expression")
+	prog, err = filter.Program()
+	wt.AssertNoErr(t, err)
+	if runCBPF(t, prog, testFrame("00:00:00:00:01:01", "00:00:00:00:01:02", ethTypeIPv4, testUDP(otherIP, 53, 0))) == 0 {
+		wt.Fatalf(t, "Expected frames between local MACs to be accepted with too many to filter")
+	}
+
+	// As many as we filter still fit jumps
+	filter = NewCaptureFilter(macs[:CaptureFilterMacs], []net.IP{ourIP}, []int{Port})
+	prog, err = filter.Program()
+	wt.AssertNoErr(t, err)
+	if runCBPF(t, prog, testFrame("00:00:00:00:01:00", "00:00:00:00:01:2f", ethTypeIPv6, make([]byte, 40))) != 0 {
+		wt.Fatalf(t, "Expected frame between local MACs to be dropped")
+	}
+}
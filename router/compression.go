@@ -0,0 +1,160 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/bkaradzic/go-lz4"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Encrypted packets can carry their frames compressed with LZ4, which
+// saves bandwidth on overlays spanning WANs at the cost of some CPU.
+//
+// Where both peers can decompress, the plaintext of every encrypted
+// packet in either direction starts with a flag saying whether the
+// frames after it are compressed. Each peer decides for itself
+// whether to compress what it sends: always, never, or only where the
+// round trip time is long enough for the link to likely be a WAN one.
+// Packets which don't get any smaller go out uncompressed.
+//
+// Compression before encryption means the packet lengths say
+// something about the contents; padding (see padding.go) hides some
+// of that.
+
+type CompressionMode int
+
+const (
+	CompressionOff CompressionMode = iota
+	CompressionOn
+	CompressionAuto
+)
+
+var compressionModeNames = map[CompressionMode]string{
+	CompressionOff:  "off",
+	CompressionOn:   "on",
+	CompressionAuto: "auto"}
+
+func ParseCompressionMode(name string) (CompressionMode, error) {
+	for mode, modeName := range compressionModeNames {
+		if modeName == name {
+			return mode, nil
+		}
+	}
+	return CompressionOff, fmt.Errorf("Unknown compression mode: %s", name)
+}
+
+func (mode CompressionMode) String() string {
+	return compressionModeNames[mode]
+}
+
+const (
+	uncompressedFlag = 0
+	compressedFlag   = 1
+)
+
+// Whether to compress what we send over a connection with the given
+// round trip time, 0 if unknown.
+func (router *Router) shouldCompress(rtt time.Duration) bool {
+	switch router.Compression {
+	case CompressionOn:
+		return true
+	case CompressionAuto:
+		return rtt >= CompressionRTT
+	}
+	return false
+}
+
+// The kernel's smoothed estimate of the round trip time of a TCP
+// connection; 0 if unknown, e.g. for WebSocket connections.
+func tcpRTT(conn net.Conn) time.Duration {
+	if tlsConn, ok := conn.(*peerTLSConn); ok {
+		conn = tlsConn.conn
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return 0
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	var info syscall.TCPInfo
+	var errno syscall.Errno
+	rawConn.Control(func(fd uintptr) {
+		size := uint32(syscall.SizeofTCPInfo)
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if errno != 0 {
+		return 0
+	}
+	return time.Duration(info.Rtt) * time.Microsecond
+}
+
+// Compress the frames in the packet being assembled, if that makes it
+// smaller, returning their length before and after.
+func (ne *NonEncryptor) Compress() (int, int) {
+	frames := ne.buf[ne.prefixLen:ne.buffered]
+	if !ne.compressed || len(frames) == 0 {
+		return 0, 0
+	}
+	if ne.scratch == nil {
+		ne.scratch = make([]byte, lz4.CompressBound(MaxUDPPacketSize))
+	}
+	compressed, err := lz4.Encode(ne.scratch, frames)
+	if err != nil || len(compressed) >= len(frames) {
+		return len(frames), len(frames)
+	}
+	copy(frames, compressed)
+	ne.buf[0] = compressedFlag
+	ne.buffered = ne.prefixLen + len(compressed)
+	ne.bufTail = ne.buf[ne.buffered:]
+	return len(frames), len(compressed)
+}
+
+func (conn *LocalConnection) decompress(plaintext []byte) ([]byte, error) {
+	if !conn.compressed {
+		return plaintext, nil
+	}
+	if len(plaintext) < 1 {
+		return nil, PacketDecodingError{Desc: "too short for compression flag"}
+	}
+	switch plaintext[0] {
+	case uncompressedFlag:
+		return plaintext[1:], nil
+	case compressedFlag:
+		// LZ4 blocks start with their decompressed length, which
+		// mustn't get us to allocate more than any packet could hold
+		if len(plaintext) < 5 || binary.LittleEndian.Uint32(plaintext[1:5]) > MaxUDPPacketSize {
+			return nil, PacketDecodingError{Desc: "bad compressed length"}
+		}
+		frames, err := lz4.Decode(nil, plaintext[1:])
+		if err != nil {
+			return nil, PacketDecodingError{Desc: fmt.Sprint("decompression failed; ", err)}
+		}
+		return frames, nil
+	}
+	return nil, PacketDecodingError{Desc: fmt.Sprintf("unknown compression flag %d", plaintext[0])}
+}
+
+func (fwd *Forwarder) compress() {
+	if !fwd.compressing {
+		return
+	}
+	before, after := fwd.enc.Compress()
+	atomic.AddUint64(&fwd.conn.stats.CompressionIn, uint64(before))
+	atomic.AddUint64(&fwd.conn.stats.CompressionOut, uint64(after))
+}
+
+// Compressed bytes as a proportion of the uncompressed; 1 if nothing
+// has been compressed.
+func (stats ConnectionStats) CompressionRatio() float64 {
+	if stats.CompressionIn == 0 {
+		return 1
+	}
+	return float64(stats.CompressionOut) / float64(stats.CompressionIn)
+}
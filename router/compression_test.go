@@ -0,0 +1,45 @@
+package router
+
+import (
+	"bytes"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	conn1, conn2 := newTestGCMConnPair()
+	conn1.compressed, conn2.compressed = true, true
+	conn1.padded, conn2.padded = true, true
+	enc := NewGCMEncryptor(conn1.local.NameByte, conn1, false, 0)
+	dec := NewGCMDecryptor(conn2)
+	compressible := &ForwardedFrame{srcPeer: conn1.local, dstPeer: conn1.remote, frame: bytes.Repeat([]byte("weave"), 200)}
+	incompressible := &ForwardedFrame{srcPeer: conn1.local, dstPeer: conn1.remote, frame: randBytes(100)}
+	for _, frame := range []*ForwardedFrame{compressible, incompressible, compressible} {
+		enc.AppendFrame(frame)
+		uncompressedLen := enc.TotalLen()
+		before, after := enc.Compress()
+		wt.AssertEqualInt(t, before, enc.FrameOverhead()+len(frame.frame), "length before compression")
+		wt.AssertEqualInt(t, enc.TotalLen(), uncompressedLen-before+after, "encryptor length")
+		if frame == compressible && after >= before {
+			wt.Fatalf(t, "Expected compressible frame to get smaller; got %d from %d", after, before)
+		} else if frame == incompressible && after != before {
+			wt.Fatalf(t, "Expected incompressible frame to go as it is; got %d from %d", after, before)
+		}
+		enc.Pad(10)
+		packet := enc.Bytes()
+		received := 0
+		err := dec.IterateFrames(func(_ *LocalConnection, _ *net.UDPAddr, _, _ []byte, _ uint16, _ uint8, _ uint16, payload []byte) error {
+			wt.AssertEqualString(t, string(payload), string(frame.frame), "frame")
+			received++
+			return nil
+		}, &UDPPacket{Packet: Concat(packet[NameSize:])})
+		wt.AssertNoErr(t, err)
+		wt.AssertEqualInt(t, received, 1, "frames received")
+	}
+
+	// A block claiming to decompress to more than any packet could hold
+	if _, err := conn2.decompress([]byte{compressedFlag, 0, 0, 0, 1, 0}); err == nil {
+		wt.Fatalf(t, "Expected error for oversized compressed block")
+	}
+}
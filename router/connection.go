@@ -1,12 +1,14 @@
 package router
 
 import (
+	"crypto/x509"
 	"encoding/binary"
 	"encoding/gob"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -37,27 +39,137 @@ type RemoteConnection struct {
 type LocalConnection struct {
 	sync.RWMutex
 	RemoteConnection
-	TCPConn            *net.TCPConn
+	TCPConn            net.Conn // a *net.TCPConn, or a WebSocket
 	tcpSender          TCPSender
+	tcpReceiver        TCPReceiver
 	remoteUDPAddr      *net.UDPAddr
 	receivedHeartbeat  bool
+	lastHeartbeat      time.Time // when we last received a heartbeat
+	establishedAt      time.Time
 	stackFrag          bool
 	effectivePMTU      int
+	maxPMTU            int    // lower of the two sides' interface MTUs; 0 if unknown
+	fastPathIP         net.IP // remote's underlay IP for the kernel fast path; nil if not in use
+	wireGuard          bool   // whether both sides have a WireGuard device for the fast path to go through
+	throughputTests    bool   // whether both sides understand throughput test frames
+	connUIDs           bool   // whether packets carry the connection's UID; see packet_prefix.go
+	ecn                bool   // whether both sides mark packets ECN capable and report congestion marks; see ecn.go
+	roaming            bool   // whether the connection survives losing its control connection; see roaming.go
+	outbound           bool   // whether we dialed the remote
+	target             string // the address we dialed, as the connection maker knows it; see dial.go
+	canFallBack        bool   // whether both sides can carry frames over TCP
+	tcpFallback        bool   // whether frames travel over TCP rather than UDP
+	sendingOverTCP     bool   // whether our forwarders have switched to TCP
+	tcpFrameConsumer   FrameConsumer
+	canPunch           bool  // whether both sides do NAT traversal
+	udpChecksums       int32 // set atomically once the path turns out to need UDP checksums
+	largeFrames        int32 // set atomically when frames only a PMTU above MinPathMTU carries get sent
+	punchCandidates    []*net.UDPAddr
+	punchDeadline      time.Time
+	punch              *time.Ticker
 	SessionKey         *[32]byte
+	password           []byte // the one we agreed on in the handshake
+	canRotatePassword  bool   // whether both sides can change passwords on the fly
+	padded             bool   // whether encrypted packets in both directions carry padding
+	compressed         bool   // whether encrypted packets in both directions carry a compression flag
+	compressing        bool   // whether we compress the packets we send
+	EncryptionScheme   *EncryptionScheme
+	version            int          // protocol version agreed in the handshake
+	capabilities       Capabilities // those both sides have
+	measuringQuality   bool         // whether heartbeats in both directions carry link quality measurements
+	quality            linkQuality
+	tenantTags         bool          // whether frames in both directions carry the ID of their tenant
+	encap              Encapsulation // standard encapsulation we send the remote frames in where we can
 	establishedTimeout *time.Timer
+	fallbackTimeout    *time.Timer
 	heartbeatFrame     *ForwardedFrame
 	heartbeat          *time.Ticker
 	fragTest           *time.Ticker
-	forwardChan        chan<- *ForwardedFrame
-	forwardChanDF      chan<- *ForwardedFrame
-	stopForward        chan<- interface{}
-	stopForwardDF      chan<- interface{}
+	rekeyCheck         *time.Ticker
+	canRekey           bool
+	rekeyPrivate       *[32]byte // our half of a rekey we started
+	rekeyPending       *[32]byte // key we agreed to, awaiting commit
+	lastRekey          time.Time
+	lastRekeyBytes     uint64
+	rekeyChans         []chan<- *[32]byte
+	rateLimiter        *TokenBucket    // nil when unlimited
+	forwardChans       []forwardQueues // not send-only, so that DropOldest can drop
+	forwardChansDF     []forwardQueues
+	forwarders         int // number of forwarders of each kind
+	dropPolicy         DropPolicy
+	stopForward        []chan<- interface{}
+	forwardersFinished []<-chan struct{}
 	verifyPMTU         chan<- int
+	pinPMTU            chan<- int
 	Decryptor          Decryptor
 	Router             *Router
 	uid                uint64
 	queryChan          chan<- *ConnectionInteraction
 	finished           <-chan struct{} // closed to signal that queryLoop has finished
+	stats              *ConnectionStats
+	resumes            *LocalConnection // the connection we resume, if that's what this one is for
+	handedOver         bool             // whether we handed our TCP connection to the one we resume
+	detached           int32            // set atomically while the control connection is down
+	roamTimeout        *time.Timer
+	newSendersDF       []chan<- UDPSender
+	forwardOverTCP     chan struct{}     // closed to switch the forwarders to TCP; see tcp_fallback.go
+	joinTokenID        string            // of the token the remote peer presented
+	peerCert           *x509.Certificate // of the remote peer, with mutual TLS
+	tooBigDrops        *DropLog
+	state              ConnectionState
+	stateSince         time.Time
+	congestion         *congestionControl // nil without ECN
+	ecnUnreported      uint32             // congestion marks received, atomically, to report to the remote
+	naclCounters       *naclCounters      // of the packets we send, with nacl-ctr encryption
+	gcmCounters        *gcmCounters       // likewise, with aes-gcm
+	receiving          sync.Mutex         // held while handling a packet from the remote, which can arrive on any of several sockets
+	remoteAddrs        []*net.UDPAddr     // all the remote's underlay addresses, as it told us in the handshake
+	failedOverAt       time.Time
+	standbyPaths       bool          // whether both sides answer probes of standby paths; see standby.go
+	standby            *standbyPaths // nil while we keep no standby path
+	multiPath          bool          // whether both sides spread flows over all the paths between them; see multipath.go
+	paths              []*net.UDPAddr
+	keepalives         bool // whether both sides understand NAT keepalives; see keepalive.go
+	keepalive          *time.Ticker
+	plaintext          bool // whether frames go unencrypted despite the password; see plaintext.go
+	gossipCompression  bool // whether both sides understand compressed gossip; see gossip_compression.go
+	gossipDeltas       *gossipDeltas
+	hopLimits          bool // whether frames in both directions carry their hop limit; see hop_limit.go
+}
+
+// Forwarding statistics of a local connection. The fields are
+// updated atomically by several processes, so use
+// LocalConnection.ConnectionStats() to obtain a consistent copy.
+type ConnectionStats struct {
+	FramesForwarded uint64 // frames handed to the forwarders' encryptors
+	BytesForwarded  uint64 // sum of the lengths of those frames
+	PMTUDrops       uint64 // frames dropped because they exceeded the PMTU
+	ENOBUFS         uint64 // UDP sends failing with ENOBUFS
+	Fragmentations  uint64 // frames we had to fragment ourselves
+	QueueDrops      uint64 // frames dropped by the drop policy
+	Rekeys          uint64 // session key rotations
+	PacingTime      uint64 // nanoseconds spent backing off after ENOBUFS
+	SndBufGrowths   uint64 // times we enlarged a socket's send buffer
+	PacketsSent     uint64 // UDP packets handed to the senders
+	BytesSent       uint64 // sum of the lengths of those packets
+	Overhead        uint64 // bytes of those not carrying frames: headers, encryption, probes
+	RateLimitDrops  uint64 // frames dropped for exceeding the rate limit
+	DuplicateDrops  uint64 // broadcast frames received which we had already received
+	TenantDrops     uint64 // frames of tenants other than the default not sent because the remote can't tag them
+	CompressionIn   uint64 // bytes of frames we tried to compress
+	CompressionOut  uint64 // bytes of those after compression, or as they were if it didn't help
+	PMTUBlackholes  uint64 // times frames as large as the verified PMTU stopped getting through
+	CongestionMarks uint64 // packets received marked congestion experienced, with ECN
+	ECNBackoffs     uint64 // times we slowed down for congestion marks the remote reported
+	TimedFlushes    uint64 // times frames had waited the flush delay, and were sent before the queues drained
+	Failovers       uint64 // times we switched to another of the remote's addresses for want of heartbeats
+	GossipIn        uint64 // bytes of gossip messages we tried to compress
+	GossipOut       uint64 // bytes of those after compression, or as they were if it didn't help
+	HopLimitDrops   uint64 // frames received which we dropped rather than relay, having reached their hop limit
+
+	// Frames sent and received, by size; see FrameSizeBounds
+	SentBySize     [FrameSizeBuckets]uint64
+	ReceivedBySize [FrameSizeBuckets]uint64
 }
 
 type ConnectionInteraction struct {
@@ -108,17 +220,29 @@ func (conn *RemoteConnection) String() string {
 	return fmt.Sprint("Connection ", from, "->", to)
 }
 
-func NewLocalConnection(connRemote *RemoteConnection, tcpConn *net.TCPConn, udpAddr *net.UDPAddr, router *Router) *LocalConnection {
+func NewLocalConnection(connRemote *RemoteConnection, tcpConn net.Conn, udpAddr *net.UDPAddr, router *Router) *LocalConnection {
 	if connRemote.local != router.Ourself.Peer {
 		log.Fatal("Attempt to create local connection from a peer which is not ourself")
 	}
 	// NB, we're taking a copy of connRemote here.
-	return &LocalConnection{
+	conn := &LocalConnection{
 		RemoteConnection: *connRemote,
 		Router:           router,
 		TCPConn:          tcpConn,
 		remoteUDPAddr:    udpAddr,
-		effectivePMTU:    DefaultPMTU}
+		effectivePMTU:    DefaultPMTU,
+		dropPolicy:       router.DropPolicy,
+		forwarders:       router.Forwarders,
+		tooBigDrops:      NewDropLog("too big frames"),
+		stateSince:       time.Now(),
+		stats:            &ConnectionStats{}}
+	// Where we need WebSockets, UDP won't get through either, so
+	// they carry frames from the start.
+	if _, ok := tcpConn.(*webSocketConn); ok {
+		conn.tcpFallback = true
+		conn.sendingOverTCP = true
+	}
+	return conn
 }
 
 // Async. Does not return anything. If the connection is successful,
@@ -128,6 +252,7 @@ func (conn *LocalConnection) Start(acceptNewPeer bool) {
 	conn.queryChan = queryChan
 	finished := make(chan struct{})
 	conn.finished = finished
+	conn.Router.ConnStates.add(conn)
 	go conn.run(queryChan, finished, acceptNewPeer)
 }
 
@@ -151,6 +276,29 @@ func (conn *LocalConnection) RemoteUDPAddr() *net.UDPAddr {
 	return conn.remoteUDPAddr
 }
 
+// How long ago we last received a heartbeat from the remote peer;
+// false if we never have.
+func (conn *LocalConnection) SinceLastHeartbeat() (time.Duration, bool) {
+	conn.RLock()
+	defer conn.RUnlock()
+	if conn.lastHeartbeat.IsZero() {
+		return 0, false
+	}
+	return time.Since(conn.lastHeartbeat), true
+}
+
+func (conn *LocalConnection) EffectivePMTU() int {
+	conn.RLock()
+	defer conn.RUnlock()
+	return conn.effectivePMTU
+}
+
+func (conn *LocalConnection) RateLimiter() *TokenBucket {
+	conn.RLock()
+	defer conn.RUnlock()
+	return conn.rateLimiter
+}
+
 func (conn *LocalConnection) Established() bool {
 	conn.RLock()
 	defer conn.RUnlock()
@@ -164,7 +312,8 @@ func (conn *LocalConnection) setEffectivePMTU(pmtu int) {
 	defer conn.Unlock()
 	if conn.effectivePMTU != pmtu {
 		conn.effectivePMTU = pmtu
-		conn.log("Effective PMTU set to", pmtu)
+		conn.logger(logPMTU).Info("Effective PMTU set to", pmtu)
+		conn.publishEvent(EventPMTUChanged, pmtu, "")
 	}
 }
 
@@ -177,8 +326,50 @@ func (conn *LocalConnection) setStackFrag(frag bool) {
 	conn.stackFrag = frag
 }
 
+func (conn *LocalConnection) ConnectionStats() ConnectionStats {
+	return ConnectionStats{
+		FramesForwarded: atomic.LoadUint64(&conn.stats.FramesForwarded),
+		BytesForwarded:  atomic.LoadUint64(&conn.stats.BytesForwarded),
+		PMTUDrops:       atomic.LoadUint64(&conn.stats.PMTUDrops),
+		ENOBUFS:         atomic.LoadUint64(&conn.stats.ENOBUFS),
+		Fragmentations:  atomic.LoadUint64(&conn.stats.Fragmentations),
+		QueueDrops:      atomic.LoadUint64(&conn.stats.QueueDrops),
+		Rekeys:          atomic.LoadUint64(&conn.stats.Rekeys),
+		PacingTime:      atomic.LoadUint64(&conn.stats.PacingTime),
+		SndBufGrowths:   atomic.LoadUint64(&conn.stats.SndBufGrowths),
+		PacketsSent:     atomic.LoadUint64(&conn.stats.PacketsSent),
+		BytesSent:       atomic.LoadUint64(&conn.stats.BytesSent),
+		Overhead:        atomic.LoadUint64(&conn.stats.Overhead),
+		RateLimitDrops:  atomic.LoadUint64(&conn.stats.RateLimitDrops),
+		DuplicateDrops:  atomic.LoadUint64(&conn.stats.DuplicateDrops),
+		TenantDrops:     atomic.LoadUint64(&conn.stats.TenantDrops),
+		CompressionIn:   atomic.LoadUint64(&conn.stats.CompressionIn),
+		CompressionOut:  atomic.LoadUint64(&conn.stats.CompressionOut),
+		PMTUBlackholes:  atomic.LoadUint64(&conn.stats.PMTUBlackholes),
+		CongestionMarks: atomic.LoadUint64(&conn.stats.CongestionMarks),
+		ECNBackoffs:     atomic.LoadUint64(&conn.stats.ECNBackoffs),
+		TimedFlushes:    atomic.LoadUint64(&conn.stats.TimedFlushes),
+		Failovers:       atomic.LoadUint64(&conn.stats.Failovers),
+		GossipIn:        atomic.LoadUint64(&conn.stats.GossipIn),
+		GossipOut:       atomic.LoadUint64(&conn.stats.GossipOut),
+		HopLimitDrops:   atomic.LoadUint64(&conn.stats.HopLimitDrops),
+		SentBySize:      loadFrameSizes(&conn.stats.SentBySize),
+		ReceivedBySize:  loadFrameSizes(&conn.stats.ReceivedBySize)}
+}
+
+func (stats ConnectionStats) String() string {
+	return fmt.Sprintf("frames %d, bytes %d, PMTU drops %d, ENOBUFS %d, fragmentations %d, queue drops %d, rekeys %d, pacing %v, sndbuf growths %d, packets sent %d, bytes sent %d, overhead %d, rate limit drops %d, duplicate drops %d, tenant drops %d, compression ratio %.2f, PMTU blackholes %d",
+		stats.FramesForwarded, stats.BytesForwarded, stats.PMTUDrops, stats.ENOBUFS, stats.Fragmentations, stats.QueueDrops,
+		stats.Rekeys, time.Duration(stats.PacingTime), stats.SndBufGrowths, stats.PacketsSent, stats.BytesSent, stats.Overhead, stats.RateLimitDrops, stats.DuplicateDrops, stats.TenantDrops, stats.CompressionRatio(), stats.PMTUBlackholes)
+}
+
 func (conn *LocalConnection) log(args ...interface{}) {
-	log.Println(append(append([]interface{}{}, fmt.Sprintf("->[%s]:", conn.remote.Name)), args...)...)
+	conn.logger(logConnection).Info(args...)
+}
+
+// The subsystem's logger, adding the remote peer to messages.
+func (conn *LocalConnection) logger(lg Logger) Logger {
+	return lg.With("peer", conn.remote.Name)
 }
 
 // ACTOR client API
@@ -187,6 +378,17 @@ const (
 	CSendProtocolMsg = iota
 	CSetEstablished
 	CReceivedHeartbeat
+	CReceivedRekeyMsg
+	CRekeyNow
+	CTCPFallback
+	CStartPunching
+	CPunchedThrough
+	CPasswordChanged
+	CRetune
+	CGoAway
+	CControlLost
+	CResume
+	CProbeAnswered
 	CShutdown
 )
 
@@ -201,6 +403,23 @@ func (conn *LocalConnection) sendQuery(code int, payload interface{}) {
 	}
 }
 
+type goAwayRequest struct {
+	deadline time.Time
+	done     chan<- struct{}
+}
+
+// Sync. Shuts the connection down gracefully, sending the frames
+// still queued for the forwarders, as far as the deadline permits, and
+// telling the remote peer we are going away.
+func (conn *LocalConnection) GoAway(deadline time.Time) {
+	done := make(chan struct{})
+	conn.sendQuery(CGoAway, &goAwayRequest{deadline: deadline, done: done})
+	select {
+	case <-done:
+	case <-conn.finished:
+	}
+}
+
 // Async
 func (conn *LocalConnection) Shutdown(err error) {
 	conn.sendQuery(CShutdown, err)
@@ -218,11 +437,21 @@ func (conn *LocalConnection) ReceivedHeartbeat(remoteUDPAddr *net.UDPAddr, connU
 	conn.sendQuery(CReceivedHeartbeat, remoteUDPAddr)
 }
 
+// Async. Picks up changed heartbeat intervals.
+func (conn *LocalConnection) Retune() {
+	conn.sendQuery(CRetune, nil)
+}
+
 // Async
 func (conn *LocalConnection) SetEstablished() {
 	conn.sendQuery(CSetEstablished, nil)
 }
 
+// Async
+func (conn *LocalConnection) ReceivedRekeyMsg(m ProtocolMsg) {
+	conn.sendQuery(CReceivedRekeyMsg, m)
+}
+
 // Async
 func (conn *LocalConnection) SendProtocolMsg(m ProtocolMsg) {
 	conn.sendQuery(CSendProtocolMsg, m)
@@ -234,16 +463,26 @@ func (conn *LocalConnection) run(queryChan <-chan *ConnectionInteraction, finish
 	defer conn.handleShutdown()
 	defer close(finished)
 
-	tcpConn := conn.TCPConn
-	tcpConn.SetLinger(0)
-	enc := gob.NewEncoder(tcpConn)
-	dec := gob.NewDecoder(tcpConn)
-
-	if err := conn.handshake(enc, dec, acceptNewPeer); err != nil {
-		log.Printf("->[%s] connection shutting down due to error during handshake: %v\n", conn.remoteTCPAddr, err)
+	setLinger(conn.TCPConn, 0)
+	var enc *gob.Encoder
+	var dec *gob.Decoder
+	err := conn.startTLS()
+	if err == nil {
+		conn.setState(ConnHandshaking, "")
+		enc, dec = gob.NewEncoder(conn.TCPConn), gob.NewDecoder(conn.TCPConn)
+		err = conn.handshake(enc, dec, acceptNewPeer)
+	}
+	if err != nil {
+		logConnection.With("addr", conn.remoteTCPAddr).Info("connection shutting down due to error during handshake:", err)
+		conn.Router.Events.Publish(Event{Type: EventConnectionFailed, Address: conn.remoteTCPAddr, Reason: err.Error()})
+		return
+	}
+	logConnection.With("addr", conn.remoteTCPAddr).Info("completed handshake with", conn.remote.Name)
+	if conn.resumes != nil {
+		conn.handedOver = conn.resumes.Resume(conn, dec)
 		return
 	}
-	log.Printf("->[%s] completed handshake with %s\n", conn.remoteTCPAddr, conn.remote.Name)
+	conn.setState(ConnAwaitingUDP, "")
 
 	// We invoke AddConnection in the same goroutine that subsequently
 	// becomes the tcp receive loop, rather than outside, because a)
@@ -251,31 +490,56 @@ func (conn *LocalConnection) run(queryChan <-chan *ConnectionInteraction, finish
 	// matters [1], b) it prevents unnecessary delays in entering the
 	// main connection loop, and c) it guards against potential
 	// deadlocks.
+	tcpConn := conn.TCPConn
 	go func() {
 		conn.Router.Ourself.AddConnection(conn)
-		conn.receiveTCP(dec)
+		conn.receiveTCP(tcpConn, dec)
 	}()
 
-	heartbeatFrameBytes := make([]byte, EthernetOverhead+8)
+	heartbeatFrameBytes := make([]byte, EthernetOverhead+heartbeatUIDSize)
+	if conn.measuringQuality {
+		heartbeatFrameBytes = make([]byte, EthernetOverhead+heartbeatQualitySize)
+	}
 	binary.BigEndian.PutUint64(heartbeatFrameBytes[EthernetOverhead:], conn.uid)
 	conn.heartbeatFrame = &ForwardedFrame{
-		srcPeer: conn.local,
-		dstPeer: conn.remote,
-		frame:   heartbeatFrameBytes}
+		srcPeer:   conn.local,
+		dstPeer:   conn.remote,
+		frame:     heartbeatFrameBytes,
+		heartbeat: true}
 
-	if conn.remoteUDPAddr != nil {
+	if conn.remoteUDPAddr != nil || conn.sendingOverTCP {
 		if err := conn.sendFastHeartbeats(); err != nil {
 			conn.log("connection shutting down due to error:", err)
+			conn.publishEvent(EventConnectionClosed, 0, err.Error())
+			return
+		}
+	}
+	if conn.canPunch && !conn.sendingOverTCP {
+		if err := conn.sendCandidates(); err != nil {
+			conn.log("connection shutting down due to error:", err)
+			conn.publishEvent(EventConnectionClosed, 0, err.Error())
+			return
+		}
+	}
+	if conn.wireGuard {
+		if err := conn.sendWireGuardKey(); err != nil {
+			conn.log("connection shutting down due to error:", err)
+			conn.publishEvent(EventConnectionClosed, 0, err.Error())
 			return
 		}
 	}
 
 	conn.establishedTimeout = time.NewTimer(EstablishedTimeout)
+	if conn.canFallBack {
+		conn.fallbackTimeout = time.NewTimer(TCPFallbackTimeout)
+	}
 
 	if err := conn.queryLoop(queryChan); err != nil {
 		conn.log("connection shutting down due to error:", err)
+		conn.publishEvent(EventConnectionClosed, 0, err.Error())
 	} else {
 		conn.log("connection shutting down")
+		conn.publishEvent(EventConnectionClosed, 0, "")
 	}
 }
 
@@ -306,19 +570,58 @@ func (conn *LocalConnection) queryLoop(queryChan <-chan *ConnectionInteraction)
 				err = conn.handleReceivedHeartbeat(query.payload.(*net.UDPAddr))
 			case CSetEstablished:
 				conn.establishedTimeout.Stop()
+				stopTimer(conn.fallbackTimeout)
 				err = conn.handleSetEstablished()
 			case CSendProtocolMsg:
 				err = conn.handleSendProtocolMsg(query.payload.(ProtocolMsg))
+			case CReceivedRekeyMsg:
+				err = conn.handleRekeyMsg(query.payload.(ProtocolMsg))
+			case CRekeyNow:
+				err = conn.handleRekeyNow()
+			case CTCPFallback:
+				err = conn.handleTCPFallback()
+			case CStartPunching:
+				conn.handleStartPunching(query.payload.([]*net.UDPAddr))
+			case CPunchedThrough:
+				err = conn.handlePunchedThrough(query.payload.(*net.UDPAddr))
+			case CPasswordChanged:
+				err = conn.handlePasswordChanged()
+			case CRetune:
+				conn.handleRetune()
+			case CGoAway:
+				err = conn.handleGoAway(query.payload.(*goAwayRequest))
+				terminate = true
+			case CControlLost:
+				err = conn.handleControlLost(query.payload.(*controlLoss))
+			case CResume:
+				err = conn.handleResume(query.payload.(*resumption))
+			case CProbeAnswered:
+				err = conn.handleProbeAnswered(query.payload.(*net.UDPAddr))
 			}
 		case <-conn.establishedTimeout.C:
 			if !conn.established {
 				err = fmt.Errorf("failed to establish UDP connectivity")
 			}
+		case <-timerChan(conn.roamTimeout):
+			err = fmt.Errorf("control connection not resumed within %v", RoamingTimeout)
+		case <-timerChan(conn.fallbackTimeout):
+			if !conn.established {
+				err = conn.startTCPFallback()
+			}
 		case <-tickerChan(conn.heartbeat):
 			conn.Forward(true, conn.heartbeatFrame, nil)
+			err = conn.checkHeartbeats()
+		case <-tickerChan(conn.punch):
+			conn.sendPunches()
 		case <-tickerChan(conn.fragTest):
 			conn.setStackFrag(false)
 			err = conn.handleSendSimpleProtocolMsg(ProtocolStartFragmentationTest)
+		case <-tickerChan(conn.rekeyCheck):
+			err = conn.handleRekeyCheck()
+		case <-tickerChan(conn.standbyProbe()):
+			conn.probePaths()
+		case <-tickerChan(conn.keepalive):
+			conn.sendKeepalive()
 		}
 	}
 	return
@@ -332,11 +635,15 @@ func (conn *LocalConnection) queryLoop(queryChan <-chan *ConnectionInteraction)
 // other processes.
 
 func (conn *LocalConnection) handleReceivedHeartbeat(remoteUDPAddr *net.UDPAddr) error {
+	if conn.pathUnanswered(remoteUDPAddr) || (conn.knownPath(remoteUDPAddr) && conn.remoteUDPAddr != nil) {
+		remoteUDPAddr = conn.remoteUDPAddr
+	}
 	oldRemoteUDPAddr := conn.remoteUDPAddr
 	old := conn.receivedHeartbeat
 	conn.Lock()
 	conn.remoteUDPAddr = remoteUDPAddr
 	conn.receivedHeartbeat = true
+	conn.lastHeartbeat = time.Now()
 	conn.Unlock()
 	if !old {
 		if err := conn.handleSendSimpleProtocolMsg(ProtocolConnectionEstablished); err != nil {
@@ -346,7 +653,10 @@ func (conn *LocalConnection) handleReceivedHeartbeat(remoteUDPAddr *net.UDPAddr)
 	if oldRemoteUDPAddr == nil {
 		return conn.sendFastHeartbeats()
 	} else if oldRemoteUDPAddr.String() != remoteUDPAddr.String() {
-		log.Println("Peer", conn.remote.Name, "moved from", old, "to", remoteUDPAddr)
+		conn.logger(logConnection).Info("Peer moved from", oldRemoteUDPAddr, "to", remoteUDPAddr)
+		if !oldRemoteUDPAddr.IP.Equal(remoteUDPAddr.IP) {
+			return conn.handleRemoteMoved(oldRemoteUDPAddr)
+		}
 	}
 	return nil
 }
@@ -360,7 +670,10 @@ func (conn *LocalConnection) handleSetEstablished() error {
 	if old {
 		return nil
 	}
+	conn.establishedAt = time.Now()
+	conn.setState(conn.establishedState(), "")
 	conn.Router.Ourself.ConnectionEstablished(conn)
+	conn.publishEvent(EventConnectionEstablished, 0, "")
 	if err := conn.ensureForwarders(); err != nil {
 		return err
 	}
@@ -371,8 +684,14 @@ func (conn *LocalConnection) handleSetEstablished() error {
 		dstPeer: conn.remote,
 		frame:   PMTUDiscovery},
 		nil)
-	conn.heartbeat = time.NewTicker(SlowHeartbeat)
+	conn.heartbeat = time.NewTicker(conn.Router.CurrentTuning().SlowHeartbeat)
 	conn.fragTest = time.NewTicker(FragTestInterval)
+	if conn.canRekey && (conn.Router.RekeyInterval > 0 || conn.Router.RekeyBytes > 0) {
+		conn.lastRekey = time.Now()
+		conn.rekeyCheck = time.NewTicker(RekeyCheckInterval)
+	}
+	conn.startStandby()
+	conn.startKeepalives()
 	// avoid initial waits for timers to fire
 	conn.Forward(true, conn.heartbeatFrame, nil)
 	conn.setStackFrag(false)
@@ -387,11 +706,34 @@ func (conn *LocalConnection) handleSendSimpleProtocolMsg(tag ProtocolTag) error
 }
 
 func (conn *LocalConnection) handleSendProtocolMsg(m ProtocolMsg) error {
+	m = conn.compressGossip(m)
 	return conn.tcpSender.Send(Concat([]byte{byte(m.tag)}, m.msg))
 }
 
+func (conn *LocalConnection) handleGoAway(req *goAwayRequest) error {
+	defer close(req.done)
+	conn.log("draining connection")
+	conn.setState(ConnClosing, "draining")
+	conn.drainForwarders(req.deadline)
+	// Make sure closing the connection doesn't discard our goodbye
+	setLinger(conn.TCPConn, -1)
+	return conn.handleSendSimpleProtocolMsg(ProtocolGoingAway)
+}
+
 func (conn *LocalConnection) handleShutdown() {
-	if conn.TCPConn != nil {
+	conn.setState(ConnClosing, "")
+	if conn.Decryptor != nil {
+		conn.Decryptor.Shutdown()
+	}
+	if conn.handedOver {
+		// The connection we resumed carries on with our TCP
+		// connection, and everything else is still to be set up.
+		conn.remote.DecrementLocalRefCount()
+		return
+	}
+	atomic.StoreInt32(&conn.detached, 0)
+	// While detached, we have closed the TCP connection already
+	if conn.TCPConn != nil && conn.roamTimeout == nil {
 		checkWarn(conn.TCPConn.Close())
 	}
 
@@ -403,33 +745,55 @@ func (conn *LocalConnection) handleShutdown() {
 	if conn.establishedTimeout != nil {
 		conn.establishedTimeout.Stop()
 	}
+	stopTimer(conn.fallbackTimeout)
+	stopTimer(conn.roamTimeout)
 
 	stopTicker(conn.heartbeat)
 	stopTicker(conn.fragTest)
+	stopTicker(conn.rekeyCheck)
+	stopTicker(conn.punch)
+	stopTicker(conn.keepalive)
+	conn.stopStandby()
+
+	if ip := conn.fastPathDst(); ip != nil {
+		checkWarn(conn.Router.FastPath.DeletePeer(ip))
+	}
+	if conn.wireGuard {
+		checkWarn(conn.Router.WireGuard.DeletePeer(conn.remote.Name, conn.uid))
+	}
 
-	// blank out the forwardChan so that the router processes don't
+	// blank out the forwardChans so that the router processes don't
 	// try to send any more
 	conn.stopForwarders()
 
-	conn.Router.ConnectionMaker.ConnectionTerminated(conn.remoteTCPAddr)
+	// Connections for resuming others aren't any the connection
+	// maker made
+	if conn.resumes == nil {
+		conn.Router.ConnectionMaker.ConnectionTerminated(conn.targetAddr())
+	}
 }
 
 // Helpers
 
-func (conn *LocalConnection) receiveTCP(decoder *gob.Decoder) {
-	defer conn.Decryptor.Shutdown()
-	usingPassword := conn.SessionKey != nil
-	var receiver TCPReceiver
-	if usingPassword {
-		receiver = NewEncryptedTCPReceiver(conn)
-	} else {
-		receiver = NewSimpleTCPReceiver()
+// The address the connection maker knows the connection by.
+func (conn *LocalConnection) targetAddr() string {
+	if conn.target != "" {
+		return conn.target
 	}
+	return conn.remoteTCPAddr
+}
+
+func (conn *LocalConnection) receiveTCP(tcpConn net.Conn, decoder *gob.Decoder) {
+	receiver := conn.tcpReceiver
 	var err error
 	for {
 		var msg []byte
-		conn.extendReadDeadline()
+		tcpConn.SetReadDeadline(time.Now().Add(ReadTimeout))
 		if err = decoder.Decode(&msg); err != nil {
+			if conn.roaming {
+				conn.controlLost(tcpConn, err)
+				return
+			}
 			break
 		}
 		msg, err = receiver.Decode(msg)
@@ -464,7 +828,7 @@ func (conn *LocalConnection) handleProtocolMsg(tag ProtocolTag, payload []byte)
 	case ProtocolFragmentationReceived:
 		conn.setStackFrag(true)
 	case ProtocolNonce:
-		if conn.SessionKey == nil {
+		if conn.SessionKey == nil || conn.plaintext {
 			return fmt.Errorf("unexpected nonce on unencrypted connection")
 		}
 		conn.Decryptor.ReceiveNonce(payload)
@@ -476,6 +840,68 @@ func (conn *LocalConnection) handleProtocolMsg(tag ProtocolTag, payload []byte)
 		return conn.Router.handleGossip(payload, deliverGossipBroadcast)
 	case ProtocolGossip:
 		return conn.Router.handleGossip(payload, deliverGossip)
+	case ProtocolGoingAway:
+		return fmt.Errorf("remote peer is going away")
+	case ProtocolTCPFallback:
+		if !conn.canFallBack {
+			return fmt.Errorf("unexpected TCP fallback request")
+		}
+		conn.setTCPFallback()
+		conn.sendQuery(CTCPFallback, nil)
+	case ProtocolTCPFrames:
+		return conn.handleTCPFrames(payload)
+	case ProtocolNATCandidates:
+		if !conn.canPunch {
+			return fmt.Errorf("unexpected NAT traversal candidates")
+		}
+		candidates, err := decodeCandidates(payload)
+		if err != nil {
+			return err
+		}
+		conn.sendQuery(CStartPunching, candidates)
+	case ProtocolPasswordChanged:
+		if !conn.canRotatePassword {
+			return fmt.Errorf("unexpected password change")
+		}
+		conn.receivedPasswordChanged(payload)
+	case ProtocolWireGuardKey:
+		if !conn.wireGuard {
+			return fmt.Errorf("unexpected WireGuard key")
+		}
+		return conn.receivedWireGuardKey(payload)
+	case ProtocolThroughputQuery:
+		if !conn.throughputTests {
+			return fmt.Errorf("unexpected throughput query")
+		}
+		report, err := conn.Router.Throughput.report(conn.remote.Name, payload)
+		if err != nil {
+			return err
+		}
+		conn.SendProtocolMsg(ProtocolMsg{ProtocolThroughputReport, report})
+	case ProtocolThroughputReport:
+		if !conn.throughputTests {
+			return fmt.Errorf("unexpected throughput report")
+		}
+		return conn.Router.Throughput.receivedReport(payload)
+	case ProtocolCongestion:
+		if !conn.ecn {
+			return fmt.Errorf("unexpected congestion report")
+		}
+		conn.receivedCongestion(payload)
+	case ProtocolCompressed:
+		if !conn.gossipCompression {
+			return fmt.Errorf("unexpected compressed message")
+		}
+		tag, msg, err := decompressGossip(payload, conn.Router.Limits.gossipSize())
+		if err != nil {
+			return err
+		}
+		return conn.handleProtocolMsg(tag, msg)
+	case ProtocolRekeyRequest, ProtocolRekeyResponse, ProtocolRekeyCommit:
+		if !conn.canRekey {
+			return fmt.Errorf("unexpected rekey message")
+		}
+		conn.ReceivedRekeyMsg(ProtocolMsg{tag, payload})
 	default:
 		conn.log("ignoring unknown protocol tag:", tag)
 	}
@@ -486,15 +912,57 @@ func (conn *LocalConnection) extendReadDeadline() {
 	conn.TCPConn.SetReadDeadline(time.Now().Add(ReadTimeout))
 }
 
+// Restart heartbeating, if we have started, at the current interval.
+func (conn *LocalConnection) handleRetune() {
+	conn.startKeepalives()
+	if conn.heartbeat == nil {
+		return
+	}
+	stopTicker(conn.heartbeat)
+	tuning := conn.Router.CurrentTuning()
+	if conn.established {
+		conn.heartbeat = time.NewTicker(tuning.SlowHeartbeat)
+	} else {
+		conn.heartbeat = time.NewTicker(tuning.FastHeartbeat)
+	}
+}
+
+// Give up on the remote peer when we have gone without heartbeats from
+// it for too long, so the topology can route around it rather than
+// wait for the TCP connection to time out. Before then, try its other
+// addresses; see checkFailover.
+func (conn *LocalConnection) checkHeartbeats() error {
+	tuning := conn.Router.CurrentTuning()
+	if !conn.established {
+		return nil
+	}
+	last := conn.lastHeartbeat
+	if last.Before(conn.establishedAt) {
+		last = conn.establishedAt
+	}
+	silence := time.Since(last)
+	if tuning.HeartbeatLoss > 0 && silence > time.Duration(tuning.HeartbeatLoss)*tuning.SlowHeartbeat {
+		return fmt.Errorf("no heartbeat from remote peer for %v", silence)
+	}
+	conn.checkFailover(silence, tuning.SlowHeartbeat)
+	return nil
+}
+
 func (conn *LocalConnection) sendFastHeartbeats() error {
 	err := conn.ensureForwarders()
 	if err == nil {
-		conn.heartbeat = time.NewTicker(FastHeartbeat)
+		conn.heartbeat = time.NewTicker(conn.Router.CurrentTuning().FastHeartbeat)
 		conn.Forward(true, conn.heartbeatFrame, nil) // avoid initial wait
 	}
 	return err
 }
 
+func setLinger(conn net.Conn, sec int) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(sec)
+	}
+}
+
 func tickerChan(ticker *time.Ticker) <-chan time.Time {
 	if ticker != nil {
 		return ticker.C
@@ -507,3 +975,16 @@ func stopTicker(ticker *time.Ticker) {
 		ticker.Stop()
 	}
 }
+
+func timerChan(timer *time.Timer) <-chan time.Time {
+	if timer != nil {
+		return timer.C
+	}
+	return nil
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
@@ -12,6 +12,7 @@ import (
 const (
 	InitialInterval = 5 * time.Second
 	MaxInterval     = 10 * time.Minute
+	BackoffFactor   = 1.5
 )
 
 const (
@@ -19,13 +20,62 @@ const (
 	CMTerminated
 	CMRefresh
 	CMStatus
+	CMTargets
+	CMRetry
+	CMForget
+	CMRemember
+	CMForgetPeer
 )
 
+// How to back off from addresses we fail to connect to. The first
+// retry comes after a random interval up to InitialInterval, and each
+// one after that waits on average Multiplier times as long as the
+// previous one, up to MaxInterval. Zero values stand for the
+// defaults.
+type ReconnectPolicy struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	MaxAttempts     int // failed attempts in a row after which we give up on an address; 0 to never
+}
+
+func (policy ReconnectPolicy) withDefaults() ReconnectPolicy {
+	if policy.InitialInterval == 0 {
+		policy.InitialInterval = InitialInterval
+	}
+	if policy.MaxInterval == 0 {
+		policy.MaxInterval = MaxInterval
+	}
+	if policy.Multiplier == 0 {
+		policy.Multiplier = BackoffFactor
+	}
+	return policy
+}
+
+func (policy ReconnectPolicy) Validate() error {
+	switch {
+	case policy.InitialInterval < 0 || policy.MaxInterval < 0:
+		return fmt.Errorf("reconnect intervals must not be negative")
+	case policy.Multiplier != 0 && policy.Multiplier < 1:
+		return fmt.Errorf("reconnect backoff multiplier must be at least 1")
+	case policy.MaxAttempts < 0:
+		return fmt.Errorf("maximum reconnect attempts must not be negative")
+	}
+	if defaulted := policy.withDefaults(); defaulted.InitialInterval > defaulted.MaxInterval {
+		return fmt.Errorf("initial reconnect interval %v exceeds maximum %v", defaulted.InitialInterval, defaulted.MaxInterval)
+	}
+	return nil
+}
+
 type ConnectionMaker struct {
 	ourself        *LocalPeer
 	peers          *Peers
+	policy         ReconnectPolicy
 	targets        map[string]*Target
 	cmdLineAddress map[string]bool
+	forgotten      map[string]bool         // addresses not to connect to, even when we hear of them
+	forgottenPeers map[PeerName]Connection // peers not to connect to at any address we hear of, with the connection we had then, if any
+	remembered     map[string]bool         // addresses of the mesh we were part of before restarting; see peer_store.go
 	queryChan      chan<- *ConnectionMakerInteraction
 }
 
@@ -34,18 +84,25 @@ type Target struct {
 	attempting  bool          // are we currently attempting to connect there?
 	tryAfter    time.Time     // next time to try this address
 	tryInterval time.Duration // backoff time on next failure
+	failures    int           // failed attempts in a row
 }
 
 type ConnectionMakerInteraction struct {
 	Interaction
 	address string
+	peer    PeerName
+	conn    Connection
 }
 
 func NewConnectionMaker(ourself *LocalPeer, peers *Peers) *ConnectionMaker {
 	return &ConnectionMaker{
 		ourself:        ourself,
 		peers:          peers,
+		policy:         ReconnectPolicy{}.withDefaults(),
 		cmdLineAddress: make(map[string]bool),
+		forgotten:      make(map[string]bool),
+		forgottenPeers: make(map[PeerName]Connection),
+		remembered:     make(map[string]bool),
 		targets:        make(map[string]*Target)}
 }
 
@@ -67,6 +124,47 @@ func (cm *ConnectionMaker) ConnectionTerminated(address string) {
 		address:     address}
 }
 
+// Try connecting to the address straight away, and back off from it
+// afresh should that fail, even if we had given up on it. Retries all
+// addresses for "". Returns whether there was anything to retry.
+func (cm *ConnectionMaker) RetryNow(address string) bool {
+	resultChan := make(chan interface{}, 0)
+	cm.queryChan <- &ConnectionMakerInteraction{
+		Interaction: Interaction{code: CMRetry, resultChan: resultChan},
+		address:     address}
+	result := <-resultChan
+	return result.(bool)
+}
+
+// Stop connecting to the address, whether given on the command line
+// or heard of from other peers, until asked to connect to it again.
+// Does not close any connection we have to the address.
+func (cm *ConnectionMaker) ForgetConnection(address string) {
+	cm.queryChan <- &ConnectionMakerInteraction{
+		Interaction: Interaction{code: CMForget},
+		address:     address}
+}
+
+// Stop connecting to the peer at the addresses we hear of from other
+// peers, until we have a connection to it other than the one given,
+// if any, e.g. because it connected to us, or we were asked to connect
+// to an address of it.
+func (cm *ConnectionMaker) ForgetPeer(name PeerName, conn Connection) {
+	cm.queryChan <- &ConnectionMakerInteraction{
+		Interaction: Interaction{code: CMForgetPeer},
+		peer:        name,
+		conn:        conn}
+}
+
+// Connect to the address, which we knew before restarting, until we
+// are connected to any peer, from when on we hear of the addresses of
+// the mesh as usual.
+func (cm *ConnectionMaker) Remember(address string) {
+	cm.queryChan <- &ConnectionMakerInteraction{
+		Interaction: Interaction{code: CMRemember},
+		address:     address}
+}
+
 func (cm *ConnectionMaker) Refresh() {
 	cm.queryChan <- &ConnectionMakerInteraction{
 		Interaction: Interaction{code: CMRefresh}}
@@ -80,6 +178,14 @@ func (cm *ConnectionMaker) String() string {
 	return result.(string)
 }
 
+func (cm *ConnectionMaker) Targets() []TargetStatus {
+	resultChan := make(chan interface{}, 0)
+	cm.queryChan <- &ConnectionMakerInteraction{
+		Interaction: Interaction{code: CMTargets, resultChan: resultChan}}
+	result := <-resultChan
+	return result.([]TargetStatus)
+}
+
 func (cm *ConnectionMaker) queryLoop(queryChan <-chan *ConnectionMakerInteraction) {
 	timer := time.NewTimer(MaxDuration)
 	run := func() { timer.Reset(cm.checkStateAndAttemptConnections()) }
@@ -91,19 +197,40 @@ func (cm *ConnectionMaker) queryLoop(queryChan <-chan *ConnectionMakerInteractio
 			}
 			switch query.code {
 			case CMInitiate:
-				cm.cmdLineAddress[NormalisePeerAddr(query.address)] = true
+				address := NormalisePeerAddr(query.address)
+				cm.cmdLineAddress[address] = true
+				delete(cm.forgotten, address)
+				cm.retry(address)
+				run()
+			case CMForget:
+				address := NormalisePeerAddr(query.address)
+				delete(cm.cmdLineAddress, address)
+				cm.forgotten[address] = true
+				run()
+			case CMForgetPeer:
+				cm.forgottenPeers[query.peer] = query.conn
 				run()
 			case CMTerminated:
 				if target, found := cm.targets[query.address]; found {
 					target.attempting = false
-					target.tryAfter, target.tryInterval = tryAfter(target.tryInterval)
+					target.failures++
+					target.tryAfter, target.tryInterval = cm.policy.tryAfter(target.tryInterval)
 				}
 				run()
+			case CMRemember:
+				cm.remembered[NormalisePeerAddr(query.address)] = true
+				run()
+			case CMRetry:
+				query.resultChan <- cm.retry(query.address)
+				run()
 			case CMRefresh:
 				run()
 			case CMStatus:
 				run()
 				query.resultChan <- cm.status()
+			case CMTargets:
+				run()
+				query.resultChan <- cm.targetStatuses()
 			default:
 				log.Fatal("Unexpected connection maker query:", query)
 			}
@@ -121,11 +248,18 @@ func (cm *ConnectionMaker) checkStateAndAttemptConnections() time.Duration {
 	ourConnectedTargets := make(map[string]bool)
 	cm.ourself.ForEachConnection(func(peer PeerName, conn Connection) {
 		ourConnectedPeers[peer] = true
+		if forgottenConn, found := cm.forgottenPeers[peer]; found && forgottenConn != conn {
+			delete(cm.forgottenPeers, peer)
+		}
 		ourConnectedTargets[conn.RemoteTCPAddr()] = true
+		// which may be a hostname rather than the address it resolved to
+		if localConn, ok := conn.(*LocalConnection); ok {
+			ourConnectedTargets[localConn.targetAddr()] = true
+		}
 	})
 
 	addTarget := func(address string) {
-		if !ourConnectedTargets[address] {
+		if !ourConnectedTargets[address] && !cm.forgotten[address] {
 			validTarget[address] = true
 			cm.addTarget(address)
 		}
@@ -136,11 +270,19 @@ func (cm *ConnectionMaker) checkStateAndAttemptConnections() time.Duration {
 		addTarget(address)
 	}
 
+	// Add the addresses we remember until we are connected at all
+	if len(ourConnectedPeers) == 0 {
+		for address := range cm.remembered {
+			addTarget(address)
+		}
+	}
+
 	// Add targets for peers that someone else is connected to, but we
 	// aren't
 	cm.peers.ForEach(func(name PeerName, peer *Peer) {
 		peer.ForEachConnection(func(otherPeer PeerName, conn Connection) {
-			if otherPeer == cm.ourself.Name || ourConnectedPeers[otherPeer] {
+			_, forgotten := cm.forgottenPeers[otherPeer]
+			if otherPeer == cm.ourself.Name || ourConnectedPeers[otherPeer] || forgotten || !cm.mayConnectTo(conn.Remote()) {
 				return
 			}
 			address := conn.RemoteTCPAddr()
@@ -159,7 +301,7 @@ func (cm *ConnectionMaker) checkStateAndAttemptConnections() time.Duration {
 			delete(cm.targets, address)
 			continue
 		}
-		if target.attempting {
+		if target.attempting || cm.gaveUp(target) {
 			continue
 		}
 		if !validTarget[address] {
@@ -169,7 +311,7 @@ func (cm *ConnectionMaker) checkStateAndAttemptConnections() time.Duration {
 		switch duration := target.tryAfter.Sub(now); {
 		case duration <= 0:
 			target.attempting = true
-			go cm.attemptConnection(address, cm.cmdLineAddress[address])
+			go cm.attemptConnection(address, cm.cmdLineAddress[address] || cm.remembered[address])
 		case duration < after:
 			after = duration
 		}
@@ -180,42 +322,123 @@ func (cm *ConnectionMaker) checkStateAndAttemptConnections() time.Duration {
 func (cm *ConnectionMaker) addTarget(address string) {
 	if _, found := cm.targets[address]; !found {
 		target := &Target{}
-		target.tryAfter, target.tryInterval = tryImmediately()
+		target.tryAfter, target.tryInterval = cm.policy.tryImmediately()
 		cm.targets[address] = target
 	}
 }
 
+func (cm *ConnectionMaker) gaveUp(target *Target) bool {
+	return cm.policy.MaxAttempts > 0 && target.failures >= cm.policy.MaxAttempts
+}
+
+func (cm *ConnectionMaker) retry(address string) bool {
+	found := false
+	for targetAddress, target := range cm.targets {
+		if (address == "" || targetAddress == address) && !target.attempting {
+			target.failures = 0
+			target.tryAfter, target.tryInterval = cm.policy.tryImmediately()
+			found = true
+		}
+	}
+	return found
+}
+
+func (cm *ConnectionMaker) targetStatuses() []TargetStatus {
+	statuses := []TargetStatus{}
+	for address, target := range cm.targets {
+		statuses = append(statuses, TargetStatus{
+			Address:    address,
+			Attempting: target.attempting,
+			TryAfter:   target.tryAfter,
+			Failures:   target.failures,
+			GaveUp:     cm.gaveUp(target)})
+	}
+	return statuses
+}
+
 func (cm *ConnectionMaker) status() string {
 	var buf bytes.Buffer
 	for address, target := range cm.targets {
-		var fmtStr string
-		if target.attempting {
-			fmtStr = "%s (trying since %v)\n"
-		} else {
-			fmtStr = "%s (next try at %v)\n"
+		switch {
+		case target.attempting:
+			buf.WriteString(fmt.Sprintf("%s (trying since %v)\n", address, target.tryAfter))
+		case cm.gaveUp(target):
+			buf.WriteString(fmt.Sprintf("%s (gave up after %d attempts)\n", address, target.failures))
+		default:
+			buf.WriteString(fmt.Sprintf("%s (next try at %v)\n", address, target.tryAfter))
 		}
-		buf.WriteString(fmt.Sprintf(fmtStr, address, target.tryAfter))
 	}
 	return buf.String()
 }
 
 func (cm *ConnectionMaker) attemptConnection(address string, acceptNewPeer bool) {
-	log.Printf("->[%s] attempting connection\n", address)
+	logConnection.With("addr", address).Info("attempting connection")
 	if err := cm.ourself.CreateConnection(address, acceptNewPeer); err != nil {
-		log.Printf("->[%s] error during connection attempt: %v\n", address, err)
+		logConnection.With("addr", address).Info("error during connection attempt:", err)
 		cm.ConnectionTerminated(address)
 	}
 }
 
-func tryImmediately() (time.Time, time.Duration) {
-	interval := time.Duration(rand.Int63n(int64(InitialInterval)))
+func (policy ReconnectPolicy) tryImmediately() (time.Time, time.Duration) {
+	interval := time.Duration(rand.Int63n(int64(policy.InitialInterval)))
 	return time.Now(), interval
 }
 
-func tryAfter(interval time.Duration) (time.Time, time.Duration) {
-	interval += time.Duration(rand.Int63n(int64(interval)))
-	if interval > MaxInterval {
-		interval = MaxInterval
+func (policy ReconnectPolicy) tryAfter(interval time.Duration) (time.Time, time.Duration) {
+	if spread := int64(float64(interval) * (policy.Multiplier - 1) * 2); spread > 0 {
+		interval += time.Duration(rand.Int63n(spread))
+	}
+	if interval > policy.MaxInterval {
+		interval = policy.MaxInterval
 	}
 	return time.Now().Add(interval), interval
 }
+
+// Stop connecting to the peer with the name or address, and close any
+// connections we have to it, so it goes from the topology unless
+// others are connected to it. The peer may still connect to us.
+// Returns whether we had a connection to close.
+//
+// Only addresses we would dial get forgotten: the one given, and those
+// of connections we dialed. The remote addresses of connections the
+// peer made to us are ephemeral, and may later be another peer's.
+func (router *Router) ForgetPeer(peer string) bool {
+	address := NormalisePeerAddr(peer)
+	isAddress := isDialablePeerAddr(address)
+	// Peer names can look like host names, so something that could be
+	// either is a name when there is a peer of that name.
+	name, nameErr := PeerNameFromUserInput(peer)
+	isName := nameErr == nil && !isAddress
+	if nameErr == nil && isAddress {
+		_, isName = router.Peers.Fetch(name)
+	}
+	var conns []*LocalConnection
+	router.Ourself.ForEachConnection(func(remote PeerName, conn Connection) {
+		if localConn, ok := conn.(*LocalConnection); ok &&
+			((isName && remote == name) || (isAddress && (conn.RemoteTCPAddr() == address || localConn.targetAddr() == address))) {
+			conns = append(conns, localConn)
+		}
+	})
+	addresses := make(map[string]bool)
+	if isAddress {
+		addresses[address] = true
+	}
+	if isName {
+		conn, _ := router.Ourself.ConnectionTo(name)
+		router.ConnectionMaker.ForgetPeer(name, conn)
+		router.Partitions.Forget(name)
+	}
+	for _, conn := range conns {
+		if conn.outbound {
+			addresses[conn.targetAddr()] = true
+			addresses[conn.RemoteTCPAddr()] = true
+		}
+	}
+	for address := range addresses {
+		router.ConnectionMaker.ForgetConnection(address)
+	}
+	for _, conn := range conns {
+		conn.Shutdown(fmt.Errorf("peer forgotten"))
+	}
+	return len(conns) > 0
+}
@@ -0,0 +1,199 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"testing"
+	"time"
+)
+
+func TestReconnectPolicyValidate(t *testing.T) {
+	for _, policy := range []ReconnectPolicy{
+		{},
+		{InitialInterval: time.Second, MaxInterval: time.Minute, Multiplier: 2, MaxAttempts: 5},
+		{Multiplier: 1}} {
+		wt.AssertNoErr(t, policy.Validate())
+	}
+	for _, policy := range []ReconnectPolicy{
+		{InitialInterval: -1},
+		{Multiplier: 0.5},
+		{MaxAttempts: -1},
+		{InitialInterval: time.Hour}} {
+		if policy.Validate() == nil {
+			wt.Fatalf(t, "Expected %+v to be invalid", policy)
+		}
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	policy := ReconnectPolicy{InitialInterval: time.Second, MaxInterval: 10 * time.Second, Multiplier: 2}.withDefaults()
+	_, interval := policy.tryImmediately()
+	if interval >= time.Second {
+		wt.Fatalf(t, "Expected initial interval below 1s, got %v", interval)
+	}
+	interval = time.Second
+	for i := 0; i < 10; i++ {
+		var next time.Duration
+		_, next = policy.tryAfter(interval)
+		if next < interval || next > policy.MaxInterval {
+			wt.Fatalf(t, "Expected interval between %v and %v, got %v", interval, policy.MaxInterval, next)
+		}
+		interval = next
+	}
+	// Without a multiplier above 1, intervals stay the same
+	policy.Multiplier = 1
+	_, next := policy.tryAfter(time.Second)
+	wt.AssertEqualInt(t, int(next), int(time.Second), "interval")
+}
+
+func TestReconnectGiveUp(t *testing.T) {
+	cm := &ConnectionMaker{
+		policy:  ReconnectPolicy{MaxAttempts: 2}.withDefaults(),
+		targets: make(map[string]*Target)}
+	cm.addTarget("10.0.0.1:6783")
+	target := cm.targets["10.0.0.1:6783"]
+	target.failures = 2
+	if !cm.gaveUp(target) {
+		wt.Fatalf(t, "Expected to give up after 2 failures")
+	}
+	if cm.retry("10.0.0.2:6783") {
+		wt.Fatalf(t, "Expected nothing to retry for unknown address")
+	}
+	if !cm.retry("") || cm.gaveUp(target) {
+		wt.Fatalf(t, "Expected retry to start afresh")
+	}
+	statuses := cm.targetStatuses()
+	wt.AssertEqualInt(t, len(statuses), 1, "targets")
+	wt.AssertEqualInt(t, statuses[0].Failures, 0, "failures")
+}
+
+func targetAddresses(cm *ConnectionMaker) map[string]bool {
+	addresses := make(map[string]bool)
+	for _, target := range cm.Targets() {
+		addresses[target.Address] = true
+	}
+	return addresses
+}
+
+// Wait for the connection maker to have the target, or not
+func waitForTarget(t *testing.T, cm *ConnectionMaker, address string, wanted bool) {
+	for start := time.Now(); targetAddresses(cm)[address] != wanted; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			wt.Fatalf(t, "Expected target %s present: %v; got targets %v", address, wanted, cm.Targets())
+		}
+	}
+}
+
+func TestConnectionMakerForget(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	name3, _ := PeerNameFromString("03:00:00:01:00:00")
+	name4, _ := PeerNameFromString("04:00:00:01:00:00")
+	router := NewRouter(RouterConfig{ConnLimit: 10}, name1)
+	cm := router.ConnectionMaker
+	cm.Start()
+	// Addresses where connections get refused
+	const address, unrelated = "127.0.0.1:1", "127.0.0.1:2"
+
+	cm.InitiateConnection(address)
+	waitForTarget(t, cm, address, true)
+	cm.ForgetConnection(address)
+	waitForTarget(t, cm, address, false)
+	// Hearing of the address again doesn't bring it back...
+	cm.Remember(address)
+	cm.Refresh()
+	waitForTarget(t, cm, address, false)
+	// ...nor does it keep us from others...
+	cm.InitiateConnection(unrelated)
+	waitForTarget(t, cm, unrelated, true)
+	// ...but being asked to connect to it does
+	cm.InitiateConnection(address)
+	waitForTarget(t, cm, address, true)
+
+	// Peer 2 tells us of peers 3 and 4, and we forget peer 3
+	peer2 := router.Peers.FetchWithDefault(NewPeer(name2, 0, 0))
+	peer3 := router.Peers.FetchWithDefault(NewPeer(name3, 0, 0))
+	peer4 := router.Peers.FetchWithDefault(NewPeer(name4, 0, 0))
+	peer2.SetVersionAndConnections(peer2.Version()+1, map[PeerName]Connection{
+		name3: NewRemoteConnection(peer2, peer3, "127.0.0.3:1", true),
+		name4: NewRemoteConnection(peer2, peer4, "127.0.0.4:1", true)})
+	cm.Refresh()
+	waitForTarget(t, cm, "127.0.0.3:1", true)
+	cm.ForgetPeer(name3, nil)
+	waitForTarget(t, cm, "127.0.0.3:1", false)
+	waitForTarget(t, cm, "127.0.0.4:1", true)
+}
+
+func TestForgetPeer(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	name3, _ := PeerNameFromString("03:00:00:01:00:00")
+	router := NewTestRouter(name1)
+	cmQueries := make(chan *ConnectionMakerInteraction, ChannelSize)
+	router.ConnectionMaker.queryChan = cmQueries
+	// Peer 2 connected to us, from an ephemeral port; we dialed peer 3
+	connQueries2 := make(chan *ConnectionInteraction, ChannelSize)
+	conn2 := &LocalConnection{
+		RemoteConnection: RemoteConnection{local: router.Ourself.Peer, remote: NewPeer(name2, 0, 0), remoteTCPAddr: "10.0.0.2:45678", established: true},
+		queryChan:        connQueries2}
+	connQueries3 := make(chan *ConnectionInteraction, ChannelSize)
+	conn3 := &LocalConnection{
+		RemoteConnection: RemoteConnection{local: router.Ourself.Peer, remote: NewPeer(name3, 0, 0), remoteTCPAddr: "10.0.0.3:6783", established: true},
+		queryChan:        connQueries3, outbound: true, target: "host3:6783"}
+	router.Ourself.Peer.SetVersionAndConnections(router.Ourself.Peer.Version()+1, map[PeerName]Connection{name2: conn2, name3: conn3})
+	// The addresses forgotten, and the peers with their connections
+	forgotten := func() (map[string]bool, map[PeerName]Connection) {
+		addresses, peers := make(map[string]bool), make(map[PeerName]Connection)
+		for len(cmQueries) > 0 {
+			switch query := <-cmQueries; query.code {
+			case CMForget:
+				addresses[query.address] = true
+			case CMForgetPeer:
+				peers[query.peer] = query.conn
+			default:
+				wt.Fatalf(t, "Unexpected connection maker query %d", query.code)
+			}
+		}
+		return addresses, peers
+	}
+	shutDown := func(connQueries chan *ConnectionInteraction) bool {
+		return len(connQueries) == 1 && (<-connQueries).code == CShutdown
+	}
+
+	if router.ForgetPeer("10.0.0.9") {
+		wt.Fatalf(t, "Expected no connection to forget at an address we aren't connected to")
+	}
+	if addresses, peers := forgotten(); len(addresses) != 1 || !addresses["10.0.0.9:6783"] || len(peers) != 0 {
+		wt.Fatalf(t, "Expected to forget just the address given; got %v, %v", addresses, peers)
+	}
+
+	// The ephemeral address of a connection the peer made is no
+	// address to forget, so we forget the peer instead
+	if !router.ForgetPeer(name2.String()) {
+		wt.Fatalf(t, "Expected a connection to forget")
+	}
+	if addresses, peers := forgotten(); len(addresses) != 0 || len(peers) != 1 || peers[name2] != conn2 {
+		wt.Fatalf(t, "Expected to forget only peer 2, with its connection; got %v, %v", addresses, peers)
+	}
+	if !shutDown(connQueries2) {
+		wt.Fatalf(t, "Expected the connection to peer 2 to be shut down")
+	}
+
+	// We forget where we dialed, by address...
+	if !router.ForgetPeer("host3") {
+		wt.Fatalf(t, "Expected a connection to forget at the address we dialed")
+	}
+	if addresses, peers := forgotten(); len(addresses) != 2 || !addresses["host3:6783"] || !addresses["10.0.0.3:6783"] || len(peers) != 0 {
+		wt.Fatalf(t, "Expected to forget the addresses we dialed; got %v, %v", addresses, peers)
+	}
+	if !shutDown(connQueries3) {
+		wt.Fatalf(t, "Expected the connection to peer 3 to be shut down")
+	}
+	// ...and by name
+	router.ForgetPeer(name3.String())
+	if addresses, peers := forgotten(); len(addresses) != 2 || !addresses["host3:6783"] || peers[name3] != conn3 {
+		wt.Fatalf(t, "Expected to forget peer 3 and the addresses we dialed; got %v, %v", addresses, peers)
+	}
+	if !shutDown(connQueries3) {
+		wt.Fatalf(t, "Expected the connection to peer 3 to be shut down")
+	}
+}
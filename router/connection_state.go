@@ -0,0 +1,174 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The lifecycle of a local connection. It starts out connecting, while
+// we set up what the handshake goes over, e.g. TLS; handshakes; then
+// awaits UDP connectivity, which heartbeats establish. An established
+// connection is degraded while it carries frames over TCP, because UDP
+// doesn't get through, or while it has lost its control connection and
+// waits for that to resume. Any state can move on to closing, which is
+// the last. Only the connection's actor process changes the state;
+// others may read it, and subsystems which care can register hooks to
+// hear of every transition.
+
+type ConnectionState int
+
+const (
+	ConnConnecting ConnectionState = iota
+	ConnHandshaking
+	ConnAwaitingUDP
+	ConnEstablished
+	ConnDegraded
+	ConnClosing
+)
+
+var connectionStateNames = []string{"connecting", "handshaking", "awaiting-udp", "established", "degraded", "closing"}
+
+// The states each state may move on to, other than closing
+var connectionTransitions = map[ConnectionState][]ConnectionState{
+	ConnConnecting:  {ConnHandshaking},
+	ConnHandshaking: {ConnAwaitingUDP},
+	ConnAwaitingUDP: {ConnEstablished, ConnDegraded},
+	ConnEstablished: {ConnDegraded},
+	ConnDegraded:    {ConnEstablished}}
+
+func (state ConnectionState) String() string {
+	return connectionStateNames[state]
+}
+
+func (state ConnectionState) canMoveTo(next ConnectionState) bool {
+	if next == ConnClosing {
+		return state != ConnClosing
+	}
+	for _, allowed := range connectionTransitions[state] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// Called on the connection's actor process with every transition, so
+// hooks had better not block.
+type ConnectionStateHook func(conn *LocalConnection, from, to ConnectionState)
+
+// The local connections which have yet to close, in whatever state.
+type ConnectionStates struct {
+	sync.Mutex
+	conns map[*LocalConnection]bool
+	hooks []ConnectionStateHook
+}
+
+func NewConnectionStates() *ConnectionStates {
+	return &ConnectionStates{conns: make(map[*LocalConnection]bool)}
+}
+
+func (states *ConnectionStates) OnTransition(hook ConnectionStateHook) {
+	states.Lock()
+	defer states.Unlock()
+	states.hooks = append(states.hooks, hook)
+}
+
+func (states *ConnectionStates) add(conn *LocalConnection) {
+	states.Lock()
+	defer states.Unlock()
+	states.conns[conn] = true
+}
+
+func (states *ConnectionStates) transition(conn *LocalConnection, from, to ConnectionState) {
+	states.Lock()
+	if to == ConnClosing {
+		delete(states.conns, conn)
+	} else {
+		states.conns[conn] = true
+	}
+	hooks := states.hooks
+	states.Unlock()
+	for _, hook := range hooks {
+		hook(conn, from, to)
+	}
+}
+
+// How many connections are in each state
+func (states *ConnectionStates) Counts() map[ConnectionState]int {
+	states.Lock()
+	defer states.Unlock()
+	counts := make(map[ConnectionState]int)
+	for conn := range states.conns {
+		state, _ := conn.State()
+		counts[state]++
+	}
+	return counts
+}
+
+func (states *ConnectionStates) String() string {
+	states.Lock()
+	lines := make([]string, 0, len(states.conns))
+	for conn := range states.conns {
+		state, since := conn.State()
+		name := "unknown peer"
+		if state > ConnHandshaking {
+			name = conn.remote.Name.String()
+		}
+		lines = append(lines, fmt.Sprintf("%s (%s): %s for %v\n", conn.remoteTCPAddr, name, state, time.Now().Sub(since)))
+	}
+	states.Unlock()
+	sort.Strings(lines)
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line)
+	}
+	return buf.String()
+}
+
+// The connection's state, and since when it has been in it
+func (conn *LocalConnection) State() (ConnectionState, time.Time) {
+	conn.RLock()
+	defer conn.RUnlock()
+	return conn.state, conn.stateSince
+}
+
+// Called by the connection's actor process.
+func (conn *LocalConnection) setState(state ConnectionState, reason string) {
+	conn.Lock()
+	old := conn.state
+	if old == state || !old.canMoveTo(state) {
+		conn.Unlock()
+		if old != state {
+			logConnection.With("addr", conn.remoteTCPAddr).Warn("ignoring connection state transition from", old, "to", state)
+		}
+		return
+	}
+	conn.state, conn.stateSince = state, time.Now()
+	conn.Unlock()
+	logConnection.With("addr", conn.remoteTCPAddr).Debug("connection", old, "->", state, reason)
+	if conn.Router == nil {
+		return
+	}
+	conn.Router.ConnStates.transition(conn, old, state)
+	// Before the handshake, we don't know who the remote is
+	if old > ConnHandshaking || state == ConnAwaitingUDP {
+		conn.Router.Events.Publish(Event{
+			Type:    EventConnectionState,
+			Peer:    conn.remote.Name.String(),
+			Address: conn.remoteTCPAddr,
+			State:   state.String(),
+			Reason:  reason})
+	}
+}
+
+// The state of an established connection, depending on whether it is
+// degraded.
+func (conn *LocalConnection) establishedState() ConnectionState {
+	if conn.sendingOverTCP || conn.roamTimeout != nil {
+		return ConnDegraded
+	}
+	return ConnEstablished
+}
@@ -0,0 +1,44 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"strings"
+	"testing"
+)
+
+func TestConnectionStateTransitions(t *testing.T) {
+	peer1 := NewPeer(PeerName(1), 0, 0)
+	peer2 := NewPeer(PeerName(2), 0, 0)
+	router := &Router{ConnStates: NewConnectionStates(), Events: NewEvents()}
+	events := router.Events.Subscribe()
+	var transitions []string
+	router.ConnStates.OnTransition(func(_ *LocalConnection, from, to ConnectionState) {
+		transitions = append(transitions, from.String()+"->"+to.String())
+	})
+	conn := &LocalConnection{RemoteConnection: RemoteConnection{local: peer1, remote: peer2, remoteTCPAddr: "10.0.0.2:6783"}, Router: router}
+	router.ConnStates.add(conn)
+
+	conn.setState(ConnHandshaking, "")
+	conn.setState(ConnAwaitingUDP, "")
+	// Not without going through established
+	conn.setState(ConnConnecting, "")
+	conn.sendingOverTCP = true
+	conn.setState(conn.establishedState(), "")
+	if !strings.Contains(router.ConnStates.String(), "degraded") {
+		wt.Fatalf(t, "Expected the connection to be listed as degraded: %s", router.ConnStates)
+	}
+	wt.AssertEqualInt(t, router.ConnStates.Counts()[ConnDegraded], 1, "degraded connections")
+	conn.setState(ConnClosing, "")
+	conn.setState(ConnEstablished, "")
+
+	wt.AssertEqualString(t, strings.Join(transitions, " "),
+		"connecting->handshaking handshaking->awaiting-udp awaiting-udp->degraded degraded->closing", "transitions")
+	state, _ := conn.State()
+	wt.AssertEqualString(t, state.String(), "closing", "state")
+	wt.AssertEqualString(t, router.ConnStates.String(), "", "connections")
+	// Only once we know the remote do we publish events
+	for _, expected := range []string{"awaiting-udp", "degraded", "closing"} {
+		event := <-events
+		wt.AssertEqualString(t, event.State, expected, "event state")
+	}
+}
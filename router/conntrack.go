@@ -0,0 +1,352 @@
+package router
+
+import (
+	"bytes"
+	"code.google.com/p/gopacket/layers"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Connection tracking: a table of the connections between our local
+// hosts and those at other peers, by protocol, addresses and ports, so
+// that policy rules can go by the state of the connection a frame
+// belongs to, e.g. allowing replies to connections local hosts opened
+// while denying connections to them; see policy.go. A connection is new
+// until frames have gone both ways, when it becomes established, and
+// ICMP errors about it are related to it. Connections local hosts open
+// get tracked as we capture their first frame, and those from other
+// peers only once policy allows their first frame, so that frames it
+// denies don't take up room. Connections are forgotten once idle for
+// ConntrackTimeout, ConntrackUnreplied while still new, or
+// ConntrackClosing after a TCP FIN or RST. Beyond ConntrackMax we
+// track no more, and their frames stay new.
+//
+// Tracking costs a lookup under a lock for every unicast IP frame, so
+// it is optional; without it, every frame is new.
+
+type TrackedState uint8
+
+const (
+	TrackedNew TrackedState = iota
+	TrackedEstablished
+	TrackedRelated // ICMP errors about a tracked connection
+)
+
+var trackedStateNames = map[TrackedState]string{
+	TrackedNew:         "new",
+	TrackedEstablished: "established",
+	TrackedRelated:     "related"}
+
+func ParseTrackedState(name string) (TrackedState, error) {
+	for state, stateName := range trackedStateNames {
+		if stateName == name {
+			return state, nil
+		}
+	}
+	return TrackedNew, fmt.Errorf("Unknown connection state: %s", name)
+}
+
+func (state TrackedState) String() string {
+	return trackedStateNames[state]
+}
+
+// A connection, in the direction it was opened in
+type connKey struct {
+	src, dst     [net.IPv6len]byte
+	proto        uint8
+	sport, dport uint16 // the identifier, both ways, for ICMP echoes
+}
+
+func (key connKey) reverse() connKey {
+	return connKey{src: key.dst, dst: key.src, proto: key.proto, sport: key.dport, dport: key.sport}
+}
+
+func (key connKey) String() string {
+	src, dst := net.IP(key.src[:]), net.IP(key.dst[:])
+	if key.sport == 0 && key.dport == 0 {
+		return fmt.Sprintf("%s -> %s", src, dst)
+	}
+	return fmt.Sprintf("%s -> %s", net.JoinHostPort(src.String(), strconv.Itoa(int(key.sport))),
+		net.JoinHostPort(dst.String(), strconv.Itoa(int(key.dport))))
+}
+
+type trackedConn struct {
+	peer     PeerName // where the hosts at the other end are
+	inbound  bool     // opened by a host at the peer
+	state    TrackedState
+	closing  bool // after a TCP FIN or RST
+	since    time.Time
+	lastSeen time.Time
+	frames   [2]uint64 // in the direction it was opened in, and back
+}
+
+func (conn *trackedConn) expired(now time.Time) bool {
+	timeout := ConntrackTimeout
+	switch {
+	case conn.closing:
+		timeout = ConntrackClosing
+	case conn.state == TrackedNew:
+		timeout = ConntrackUnreplied
+	}
+	return now.Sub(conn.lastSeen) > timeout
+}
+
+type ConnTracker struct {
+	sync.Mutex
+	conns     map[connKey]*trackedConn
+	lastSweep time.Time
+}
+
+func NewConnTracker() *ConnTracker {
+	return &ConnTracker{conns: make(map[connKey]*trackedConn), lastSweep: time.Now()}
+}
+
+// The connection of a unicast IP frame, but not of a later fragment of
+// a packet, which carries no ports; for ICMP errors, also that of the
+// packet they are about; and the TCP flags, if any.
+func frameConnKey(dec *EthernetDecoder) (key connKey, related *connKey, flags uint8, ok bool) {
+	if dec.eth.DstMAC[0]&1 != 0 {
+		return
+	}
+	var proto layers.IPProtocol
+	var payload []byte
+	switch {
+	case dec.IsIPv4() && dec.ip.FragOffset == 0:
+		proto, payload = dec.ip.Protocol, dec.ip.Payload
+		key, ok = ipConnKey(dec.ip.SrcIP, dec.ip.DstIP, uint8(proto), payload)
+	case dec.IsIPv6():
+		proto, payload = dec.ip6.NextHeader, dec.ip6.Payload
+		key, ok = ipConnKey(dec.ip6.SrcIP, dec.ip6.DstIP, uint8(proto), payload)
+	}
+	if !ok {
+		return
+	}
+	switch proto {
+	case layers.IPProtocolTCP:
+		if len(payload) >= 14 {
+			flags = payload[13]
+		}
+	case layers.IPProtocolICMPv4:
+		// Destination unreachable, source quench, redirect, time
+		// exceeded and parameter problem
+		if icmpType := payload[0]; icmpType == 3 || icmpType == 4 || icmpType == 5 || icmpType == 11 || icmpType == 12 {
+			related = embeddedConnKey(payload[8:])
+		}
+	case layers.IPProtocolICMPv6:
+		if payload[0] < 128 {
+			related = embeddedConnKey(payload[8:])
+		}
+	}
+	return
+}
+
+func ipConnKey(srcIP, dstIP net.IP, proto uint8, payload []byte) (connKey, bool) {
+	key := connKey{proto: proto}
+	copy(key.src[:], srcIP.To16())
+	copy(key.dst[:], dstIP.To16())
+	switch layers.IPProtocol(proto) {
+	case layers.IPProtocolTCP, layers.IPProtocolUDP:
+		if len(payload) < 4 {
+			return key, false
+		}
+		key.sport, key.dport = binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:])
+	case layers.IPProtocolICMPv4, layers.IPProtocolICMPv6:
+		if len(payload) < 8 {
+			return key, false
+		}
+		// Echo requests and replies
+		if icmpType := payload[0]; icmpType == 0 || icmpType == 8 || icmpType == 128 || icmpType == 129 {
+			key.sport = binary.BigEndian.Uint16(payload[4:])
+			key.dport = key.sport
+		}
+	}
+	return key, true
+}
+
+// The connection of the start of a packet, as ICMP errors carry it
+func embeddedConnKey(packet []byte) *connKey {
+	var key connKey
+	var ok bool
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		ihl := int(packet[0]&0xf) * 4
+		if len(packet) < ihl {
+			return nil
+		}
+		key, ok = ipConnKey(net.IP(packet[12:16]), net.IP(packet[16:20]), packet[9], packet[ihl:])
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		key, ok = ipConnKey(net.IP(packet[8:24]), net.IP(packet[24:40]), packet[6], packet[40:])
+	}
+	if !ok {
+		return nil
+	}
+	return &key
+}
+
+// The connection and whether the key is in the direction it was opened in
+func (tracker *ConnTracker) find(key connKey, now time.Time) (*trackedConn, bool) {
+	if conn, found := tracker.conns[key]; found && !conn.expired(now) {
+		return conn, true
+	}
+	if conn, found := tracker.conns[key.reverse()]; found && !conn.expired(now) {
+		return conn, false
+	}
+	return nil, false
+}
+
+// The state of the connection of a frame arriving from a peer for our
+// local hosts, for policy to decide on.
+func (tracker *ConnTracker) Inbound(dec *EthernetDecoder) TrackedState {
+	key, related, _, ok := frameConnKey(dec)
+	if !ok {
+		return TrackedNew
+	}
+	now := time.Now()
+	tracker.Lock()
+	defer tracker.Unlock()
+	if related != nil {
+		if conn, _ := tracker.find(*related, now); conn != nil {
+			return TrackedRelated
+		}
+		return TrackedNew
+	}
+	conn, forward := tracker.find(key, now)
+	switch {
+	case conn == nil:
+		return TrackedNew
+	case forward:
+		return conn.state
+	}
+	return TrackedEstablished
+}
+
+// Track the frame, which policy allowed, from a host at the peer.
+func (tracker *ConnTracker) Allowed(peer PeerName, dec *EthernetDecoder) {
+	tracker.track(peer, true, dec)
+}
+
+// Track the frame we captured from a local host, for a host at the peer.
+func (tracker *ConnTracker) Outbound(peer PeerName, dec *EthernetDecoder) {
+	tracker.track(peer, false, dec)
+}
+
+func (tracker *ConnTracker) track(peer PeerName, inbound bool, dec *EthernetDecoder) {
+	key, related, flags, ok := frameConnKey(dec)
+	if !ok || related != nil {
+		// ICMP errors are no connections of their own
+		return
+	}
+	now := time.Now()
+	tracker.Lock()
+	defer tracker.Unlock()
+	tracker.sweep(now)
+	conn, forward := tracker.find(key, now)
+	if conn == nil {
+		if len(tracker.conns) >= ConntrackMax {
+			return
+		}
+		conn = &trackedConn{peer: peer, inbound: inbound, since: now}
+		tracker.conns[key] = conn
+		forward = true
+	}
+	if forward {
+		conn.frames[0]++
+	} else {
+		conn.frames[1]++
+		conn.state = TrackedEstablished
+	}
+	conn.lastSeen = now
+	if flags&0x05 != 0 { // FIN or RST
+		conn.closing = true
+	}
+}
+
+// Forget expired connections, every ConntrackSweep
+func (tracker *ConnTracker) sweep(now time.Time) {
+	if now.Sub(tracker.lastSweep) < ConntrackSweep {
+		return
+	}
+	for key, conn := range tracker.conns {
+		if conn.expired(now) {
+			delete(tracker.conns, key)
+		}
+	}
+	tracker.lastSweep = now
+}
+
+type TrackedConnection struct {
+	Peer     string
+	Proto    int
+	Flow     string // <source> -> <destination>, as opened
+	State    string
+	Inbound  bool      // opened by a host at the peer
+	Closing  bool      // after a TCP FIN or RST
+	Since    time.Time // when we first saw it
+	LastSeen time.Time
+	Frames   [2]uint64 // in the direction it was opened in, and back
+}
+
+// The connections we track, by peer
+func (tracker *ConnTracker) Connections() []TrackedConnection {
+	now := time.Now()
+	tracker.Lock()
+	conns := make([]TrackedConnection, 0, len(tracker.conns))
+	for key, conn := range tracker.conns {
+		if conn.expired(now) {
+			continue
+		}
+		conns = append(conns, TrackedConnection{
+			Peer:     conn.peer.String(),
+			Proto:    int(key.proto),
+			Flow:     key.String(),
+			State:    conn.state.String(),
+			Inbound:  conn.inbound,
+			Closing:  conn.closing,
+			Since:    conn.since,
+			LastSeen: conn.lastSeen,
+			Frames:   conn.frames})
+	}
+	tracker.Unlock()
+	sort.Sort(trackedConnectionsByPeer(conns))
+	return conns
+}
+
+type trackedConnectionsByPeer []TrackedConnection
+
+func (s trackedConnectionsByPeer) Len() int      { return len(s) }
+func (s trackedConnectionsByPeer) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s trackedConnectionsByPeer) Less(i, j int) bool {
+	if s[i].Peer != s[j].Peer {
+		return s[i].Peer < s[j].Peer
+	}
+	if !s[i].Since.Equal(s[j].Since) {
+		return s[i].Since.Before(s[j].Since)
+	}
+	return s[i].Flow < s[j].Flow
+}
+
+// How many connections we track with the hosts at each peer
+func (tracker *ConnTracker) String() string {
+	var buf bytes.Buffer
+	var peers []string
+	total := make(map[string]int)
+	established := make(map[string]int)
+	for _, conn := range tracker.Connections() {
+		if total[conn.Peer] == 0 {
+			peers = append(peers, conn.Peer)
+		}
+		total[conn.Peer]++
+		if conn.State == TrackedEstablished.String() {
+			established[conn.Peer]++
+		}
+	}
+	for _, peer := range peers {
+		buf.WriteString(fmt.Sprintf("%s: %d connections, %d established\n", peer, total[peer], established[peer]))
+	}
+	return buf.String()
+}
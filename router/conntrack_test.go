@@ -0,0 +1,82 @@
+package router
+
+import (
+	"code.google.com/p/gopacket/layers"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+	"time"
+)
+
+func conntrackTestFrame(t *testing.T, src, dst string, proto layers.IPProtocol, payload []byte) *EthernetDecoder {
+	dec := decodeTestFrame(t, &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: proto,
+		SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}, layers.EthernetTypeIPv4, len(payload))
+	dec.ip.Payload = payload
+	return dec
+}
+
+func tcpTestHeader(sport, dport uint16, flags byte) []byte {
+	return []byte{byte(sport >> 8), byte(sport), byte(dport >> 8), byte(dport), 0, 0, 0, 0, 0, 0, 0, 0, 0x50, flags, 0, 0, 0, 0, 0, 0}
+}
+
+func assertTrackedState(t *testing.T, tracker *ConnTracker, dec *EthernetDecoder, state TrackedState, desc string) {
+	wt.AssertEqualString(t, tracker.Inbound(dec).String(), state.String(), desc)
+}
+
+func TestConntrack(t *testing.T) {
+	peer, _ := PeerNameFromString("02:00:00:01:00:00")
+	tracker := NewConnTracker()
+
+	// A local host connects to one at the peer, which replies
+	syn := conntrackTestFrame(t, "10.0.0.1", "10.0.0.2", layers.IPProtocolTCP, tcpTestHeader(40000, 80, 0x02))
+	reply := conntrackTestFrame(t, "10.0.0.2", "10.0.0.1", layers.IPProtocolTCP, tcpTestHeader(80, 40000, 0x12))
+	assertTrackedState(t, tracker, reply, TrackedNew, "reply before the connection")
+	tracker.Outbound(peer, syn)
+	assertTrackedState(t, tracker, reply, TrackedEstablished, "reply")
+	tracker.Allowed(peer, reply)
+
+	// ICMP errors about it are related
+	embedded := append([]byte{0x45, 0, 0, 40, 0, 0, 0, 0, 64, 6, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2}, tcpTestHeader(40000, 80, 0x02)[:8]...)
+	unreachable := conntrackTestFrame(t, "10.0.0.9", "10.0.0.1", layers.IPProtocolICMPv4, append([]byte{3, 1, 0, 0, 0, 0, 0, 0}, embedded...))
+	assertTrackedState(t, tracker, unreachable, TrackedRelated, "ICMP error")
+
+	// A host at the peer connects to a local one; frames policy
+	// denies don't get tracked
+	ssh := conntrackTestFrame(t, "10.0.0.2", "10.0.0.1", layers.IPProtocolTCP, tcpTestHeader(50000, 22, 0x02))
+	sshReply := conntrackTestFrame(t, "10.0.0.1", "10.0.0.2", layers.IPProtocolTCP, tcpTestHeader(22, 50000, 0x12))
+	assertTrackedState(t, tracker, ssh, TrackedNew, "inbound connection")
+	wt.AssertEqualInt(t, len(tracker.Connections()), 1, "tracked connections")
+	tracker.Allowed(peer, ssh)
+	assertTrackedState(t, tracker, ssh, TrackedNew, "unreplied inbound connection")
+	tracker.Outbound(peer, sshReply)
+	assertTrackedState(t, tracker, ssh, TrackedEstablished, "replied inbound connection")
+
+	conns := tracker.Connections()
+	wt.AssertEqualInt(t, len(conns), 2, "tracked connections")
+	wt.AssertEqualString(t, conns[0].Flow, "10.0.0.1:40000 -> 10.0.0.2:80", "first connection")
+	wt.AssertEqualString(t, conns[1].Flow, "10.0.0.2:50000 -> 10.0.0.1:22", "second connection")
+	if conns[0].Inbound || !conns[1].Inbound || conns[0].Frames != [2]uint64{1, 1} {
+		wt.Fatalf(t, "Unexpected connections %+v", conns)
+	}
+	wt.AssertEqualString(t, tracker.String(), peer.String()+": 2 connections, 2 established\n", "summary")
+
+	// Closed connections go soon after
+	tracker.Outbound(peer, conntrackTestFrame(t, "10.0.0.1", "10.0.0.2", layers.IPProtocolTCP, tcpTestHeader(40000, 80, 0x04)))
+	for _, conn := range tracker.conns {
+		conn.lastSeen = conn.lastSeen.Add(-ConntrackClosing - time.Second)
+	}
+	assertTrackedState(t, tracker, reply, TrackedNew, "reply after RST")
+	assertTrackedState(t, tracker, ssh, TrackedEstablished, "open connection")
+
+	// Policy goes by the state
+	rules, err := ParsePolicyRules("allow state=established,related\ndeny")
+	wt.AssertNoErr(t, err)
+	policy := NewPolicy(peer)
+	policy.SetLocalRules(rules)
+	for _, dec := range []*EthernetDecoder{ssh, reply} {
+		dec.state = tracker.Inbound(dec)
+	}
+	if !policy.Allow(peer, ssh) || policy.Allow(peer, reply) {
+		wt.Fatalf(t, "Expected only frames of established connections to be allowed")
+	}
+}
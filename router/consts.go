@@ -8,8 +8,10 @@ import (
 const (
 	EthernetOverhead   = 14
 	UDPOverhead        = 28 // 20 bytes for IPv4, 8 bytes for UDP
+	UDPOverheadIPv6    = 48 // 40 bytes for IPv6, 8 bytes for UDP
 	Port               = 6783
 	HttpPort           = Port + 1
+	WebSocketPort      = 443
 	DefaultPMTU        = 65535
 	MaxUDPPacketSize   = 65536
 	ChannelSize        = 16
@@ -18,12 +20,99 @@ const (
 	PMTUDiscoverySize  = 60000
 	FastHeartbeat      = 500 * time.Millisecond
 	SlowHeartbeat      = 10 * time.Second
+	FailoverHeartbeats = 3                      // slow heartbeats an established connection may miss before we try the remote's other addresses
+	StandbyProbe       = 100 * time.Millisecond // how often to probe the active and standby paths to a peer
+	StandbyTimeout     = 500 * time.Millisecond // how long the active path may go unanswered before we switch to the standby one
 	FragTestInterval   = 5 * time.Minute
 	EstablishedTimeout = 30 * time.Second
+	TCPFallbackTimeout = 10 * time.Second // how long to wait for UDP connectivity before falling back to TCP
+	WebSocketTimeout   = 30 * time.Second // for setting up WebSocket connections
+	PunchInterval      = 200 * time.Millisecond
+	PunchTimeout       = TCPFallbackTimeout // how long to keep punching holes through NATs
+	STUNInterval       = 5 * time.Minute    // how often to ask STUN servers for our reflexive address
 	ReadTimeout        = 1 * time.Minute
 	PMTUVerifyAttempts = 8
 	PMTUVerifyTimeout  = 10 * time.Millisecond // gets doubled with every attempt
+	PMTUProbeInterval  = 10 * time.Minute      // how often to look for a larger PMTU
+	PMTUCheckInterval  = 15 * time.Second      // how often to check the PMTU still holds, while large frames are being sent
+	MinPinnedPMTU      = 576
+	MinPathMTU         = 576                    // IP packets of this size get through any path
+	DedupTTL           = 200 * time.Millisecond // how long to suppress duplicate broadcast frames for
+	DedupMaxEntries    = 65536
+	EventBufferSize    = 64
+	RehandshakeDelay   = 2 * time.Second // between re-handshakes of connections for a new password
+	MaxRehandshakes    = 1024
+	HandshakeTokenTTL  = 1 * time.Minute
+	PeerCertRecheck    = 1 * time.Minute
+	PasswordGrace      = 1 * time.Hour // how long to accept the old password for after changing it
 	MaxDuration        = time.Duration(math.MaxInt64)
+	PMTUCacheMaxAge    = 10 * time.Minute
+	RekeyCheckInterval = 1 * time.Minute
+	MinPaceDelay       = 50 * time.Microsecond // gets doubled with every consecutive ENOBUFS
+	MaxPaceDelay       = 20 * time.Millisecond
+	ENOBUFSRetries     = 4
+	MaxForwarders      = gcmMaxStreams          // each needs its own encryption stream
+	DrainTimeout       = 5 * time.Second        // how long to keep sending queued frames when stopping
+	RateLimitBurst     = 100 * time.Millisecond // how much sending at the rate limit a connection may save up
+	CompressionRTT     = 20 * time.Millisecond  // round trip time from which to compress in auto mode
+	LinkQualityPeriod  = 1 * time.Minute        // how often to gossip link quality measurements
+	LinkRTTWeight      = 8                      // of the existing smoothed RTT against a new sample
+	LinkLossWeight     = 16                     // likewise for loss
+	UnknownLinkRTT     = 10 * time.Millisecond
+	LinkHopCost        = 1 * time.Millisecond // added to the RTT, so that we prefer fewer hops when all else is equal
+	MinLinkDelivery    = 0.01
+	MaxQueueSize       = 65536
+	MinHeartbeat       = 10 * time.Millisecond
+	NATKeepalive       = 15 * time.Second // well within the UDP timeouts of NATs
+	MinKeepalive       = 1 * time.Second
+	SealWindow         = 64 // packets each forwarder may have waiting to be sealed
+	RedialInterval     = 2 * time.Second
+	HappyEyeballsDelay = 250 * time.Millisecond
+	RoamingTimeout     = 2 * time.Minute // how long a connection which lost its control channel waits for it to resume
+	MaxDetachedMsgs    = 1024            // control messages to hold on to while the control channel is down
+	DropLogBurst       = 5               // drops to log in each DropLogInterval before only summarising them
+	DropLogInterval    = 10 * time.Second
+	DropLogFlows       = 8 // flows to name in a summary of drops
+	PeerStoreInterval  = 30 * time.Second
+	PartitionCheck     = 10 * time.Second // how often to check which peers we can reach
+	PartitionTimeout   = 1 * time.Minute  // how long a peer must stay unreachable for us to count it as split from us
+	PartitionMaxAge    = 1 * time.Hour    // how long to remember unreachable peers for
+	FlowWindow         = 1 * time.Minute  // how long to count flows for before starting afresh
+	BridgeCheck        = 10 * time.Second // how often to repair drift in the configuration of the bridge
+	MaxFlows           = 4096             // flows to count in each FlowWindow
+	SFlowHeaderSize    = 128              // bytes of each sampled frame to send the collector
+	SFlowMaxSamples    = 8                // samples to send in each datagram
+	SFlowInterval      = 1 * time.Second  // how long samples may wait for others to fill a datagram
+	SFlowQueueSize     = 256
+	RateWindow         = 250 * time.Millisecond // how long to measure the rate we send at over
+	ECNFeedbackDelay   = 20 * time.Millisecond  // how long to gather congestion marks for before reporting them
+	ECNHoldoff         = 200 * time.Millisecond // how long after slowing down to ignore further reports
+	ECNBackoff         = 0.7                    // proportion of the rate to slow down to on a report
+	ECNMinRate         = 128 * 1024             // bytes per second not to slow down below
+	ECNRecoverySteps   = 10
+	ECNRecoveryTick    = 1 * time.Second
+	FlushDelay         = 1 * time.Millisecond // longest a frame may wait for others to fill its packet
+	MinFlushDelay      = 50 * time.Microsecond
+	MaxFlushDelay      = 100 * time.Millisecond
+	CryptoBenchTime    = 200 * time.Millisecond // to measure each scheme and frame size for
+	NaClRekeyAt        = 1 << 32                // packets to send with a nacl-ctr key before asking for a new one
+	GossipCompressMin  = 1024                   // bytes from which to compress gossip messages
+	MaxGossipSize      = 64 << 20               // bytes a gossip message may have, decompressed; see TopologyLimits
+	GossipFullEvery    = 10                     // periodic topology gossip rounds of which one tells peers everything
+	FrameHopLimit      = 32                     // most links a frame may go over on its way between peers
+	LoopSignatureSize  = 128                    // bytes of the frames we inject to remember, to recognise them should they come back
+	LoopMemory         = 1 * time.Second        // how long to remember them for
+	LoopThreshold      = 3                      // frames coming back within LoopWindow which make a loop
+	LoopWindow         = 10 * time.Second
+	LoopHoldoff        = 1 * time.Minute // how long to stop forwarding captured frames for, on detecting a loop
+	LocalMacsSize      = 1024            // local MACs each decoder remembers; see local_macs.go
+	CaptureFilterMacs  = 48              // most local MACs to leave frames between out of the capture
+	CaptureFilterTick  = 1 * time.Second
+	ConntrackMax       = 16384            // connections to track; see conntrack.go
+	ConntrackTimeout   = 5 * time.Minute  // how long to remember idle connections for
+	ConntrackUnreplied = 30 * time.Second // likewise for those which never got a reply
+	ConntrackClosing   = 10 * time.Second // likewise for TCP connections after a FIN or RST
+	ConntrackSweep     = 10 * time.Second
 )
 
 var (
@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strings"
 	"sync"
 )
 
@@ -28,6 +29,14 @@ func FormSessionKey(remotePublicKey, localPrivateKey *[32]byte, secretKey *[]byt
 	return &sessionKey
 }
 
+// Derive the key used for the control channel messages sent by the
+// named peer. Using different keys for the two directions prevents an
+// attacker from reflecting a peer's messages back at it.
+func FormDirectionalKey(key *[32]byte, senderName []byte) *[32]byte {
+	directionalKey := sha256.Sum256(Concat(key[:], senderName))
+	return &directionalKey
+}
+
 func GenerateRandomNonce() ([24]byte, error) {
 	var nonce [24]byte
 	n, err := rand.Read(nonce[:])
@@ -100,6 +109,153 @@ func DecodeNonce(msg []byte) (bool, *[24]byte) {
 	return df, &nonce
 }
 
+// Encryption schemes
+//
+// An encryption scheme supplies the encryptors and decryptors for the
+// UDP data plane of connections that use a password. Schemes are
+// registered in order of preference; during the handshake both sides
+// advertise the schemes they support and pick one deterministically.
+
+// Schemes supporting streams allow several encryptors of each kind
+// (DF and non-DF) per connection, distinguished by stream number, as
+// used by parallel forwarders. Other schemes only support stream 0.
+// Packets of detachable schemes can be decrypted without anything
+// from the control channel, so connections using them can survive
+// losing it for a while; see roaming.go. The self-test, if any, checks
+// the scheme's construction against test vectors; see crypto_bench.go.
+type EncryptionScheme struct {
+	Name         string
+	Streams      bool
+	Detachable   bool
+	NewEncryptor func(prefix []byte, conn *LocalConnection, df bool, stream int) Encryptor
+	NewDecryptor func(conn *LocalConnection) Decryptor
+	SelfTest     func() error
+}
+
+// The scheme used by peers which don't advertise any schemes in the
+// handshake.
+const DefaultEncryptionScheme = "nacl"
+
+var encryptionSchemes []*EncryptionScheme
+
+func RegisterEncryptionScheme(scheme *EncryptionScheme) {
+	if _, found := LookupEncryptionScheme(scheme.Name); found {
+		log.Fatal("Encryption scheme registered twice: ", scheme.Name)
+	}
+	encryptionSchemes = append(encryptionSchemes, scheme)
+}
+
+func LookupEncryptionScheme(name string) (*EncryptionScheme, bool) {
+	for _, scheme := range encryptionSchemes {
+		if scheme.Name == name {
+			return scheme, true
+		}
+	}
+	return nil, false
+}
+
+func EncryptionSchemeNames() []string {
+	names := make([]string, len(encryptionSchemes))
+	for i, scheme := range encryptionSchemes {
+		names[i] = scheme.Name
+	}
+	return names
+}
+
+// Parse a comma-separated list of the names of registered schemes
+func ParseEncryptionSchemes(spec string) ([]string, error) {
+	names := []string{}
+	for _, name := range strings.Split(spec, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if _, found := LookupEncryptionScheme(name); !found {
+			return nil, fmt.Errorf("Unknown encryption scheme %q: expected one of %s", name, strings.Join(EncryptionSchemeNames(), ", "))
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// The schemes we offer peers, in order of preference
+func (router *Router) encryptionSchemeNames() []string {
+	if len(router.Encryption) > 0 {
+		return router.Encryption
+	}
+	return EncryptionSchemeNames()
+}
+
+// Pick the first scheme in the leader's list that the other side
+// supports too. Both sides of a connection agree on who leads, and
+// thus arrive at the same choice.
+func ChooseEncryptionScheme(leader, follower []string) (*EncryptionScheme, error) {
+	for _, name := range leader {
+		for _, otherName := range follower {
+			if name != otherName {
+				continue
+			}
+			if scheme, found := LookupEncryptionScheme(name); found {
+				return scheme, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("No common encryption scheme (%v vs %v)", leader, follower)
+}
+
+func init() {
+	RegisterEncryptionScheme(&EncryptionScheme{
+		Name:       "aes-gcm",
+		Streams:    true,
+		Detachable: true,
+		NewEncryptor: func(prefix []byte, conn *LocalConnection, df bool, stream int) Encryptor {
+			return NewGCMEncryptor(prefix, conn, df, stream)
+		},
+		NewDecryptor: func(conn *LocalConnection) Decryptor {
+			return NewGCMDecryptor(conn)
+		},
+		SelfTest: gcmSelfTest})
+	RegisterEncryptionScheme(&EncryptionScheme{
+		Name:       "nacl-ctr",
+		Detachable: true,
+		NewEncryptor: func(prefix []byte, conn *LocalConnection, df bool, stream int) Encryptor {
+			return NewNaClCtrEncryptor(prefix, conn, df)
+		},
+		NewDecryptor: func(conn *LocalConnection) Decryptor {
+			return NewNaClCtrDecryptor(conn)
+		},
+		SelfTest: naclCtrSelfTest})
+	RegisterEncryptionScheme(&EncryptionScheme{
+		Name: "nacl",
+		NewEncryptor: func(prefix []byte, conn *LocalConnection, df bool, stream int) Encryptor {
+			return NewNaClEncryptor(prefix, conn, df)
+		},
+		NewDecryptor: func(conn *LocalConnection) Decryptor {
+			return NewNaClDecryptor(conn)
+		},
+		SelfTest: naclSelfTest})
+}
+
+// The plaintext of the test vectors, and the key they are sealed with
+var (
+	selfTestPlaintext = []byte("weave encryption self-test")
+	selfTestKey       = &[32]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+)
+
+const naclTestVector = "42788a2bd905614982c871d3db41fc8a91534c0619c2de25112f185c0d7b3b9e1ca1d5a2437dcdeba578"
+
+// The nonce is as we'd send it the remote, with the offset of the
+// packet in the low bits.
+func naclSelfTest() error {
+	nonce := [24]byte{}
+	for i := range nonce {
+		nonce[i] = byte(0x40 + i)
+	}
+	SetNonceLow15Bits(&nonce, 3)
+	sealed := secretbox.Seal(nil, selfTestPlaintext, &nonce, selfTestKey)
+	opened, _ := secretbox.Open(nil, sealed, &nonce, selfTestKey)
+	return checkVector(sealed, naclTestVector, opened, selfTestPlaintext)
+}
+
 // Frame Encryptors
 
 type Encryptor interface {
@@ -108,14 +264,23 @@ type Encryptor interface {
 	IsEmpty() bool
 	Bytes() []byte
 	AppendFrame(*ForwardedFrame)
+	Compress() (int, int)
+	Pad(int)
 	TotalLen() int
+	Rekey(*[32]byte)
 }
 
 type NonEncryptor struct {
-	buf       []byte
-	bufTail   []byte
-	buffered  int
-	prefixLen int
+	buf        []byte
+	bufTail    []byte
+	buffered   int
+	prefixLen  int
+	padded     bool   // whether packets end in the length of their padding
+	padding    int    // bytes of padding in the packet being assembled
+	compressed bool   // whether packets start with a compression flag
+	tenants    bool   // whether frames carry the ID of their tenant
+	hopLimits  bool   // whether frames carry their hop limit
+	scratch    []byte // for compressing into
 }
 
 type NaClEncryptor struct {
@@ -127,6 +292,7 @@ type NaClEncryptor struct {
 	flags     uint16
 	prefixLen int
 	conn      *LocalConnection
+	key       *[32]byte
 	df        bool
 }
 
@@ -141,11 +307,21 @@ func NewNonEncryptor(prefix []byte) *NonEncryptor {
 }
 
 func (ne *NonEncryptor) PacketOverhead() int {
+	if ne.padded {
+		return ne.prefixLen + 2
+	}
 	return ne.prefixLen
 }
 
 func (ne *NonEncryptor) FrameOverhead() int {
-	return NameSize + NameSize + 2
+	overhead := NameSize + NameSize + 2
+	if ne.tenants {
+		overhead += 2
+	}
+	if ne.hopLimits {
+		overhead++
+	}
+	return overhead
 }
 
 func (ne *NonEncryptor) IsEmpty() bool {
@@ -153,6 +329,11 @@ func (ne *NonEncryptor) IsEmpty() bool {
 }
 
 func (ne *NonEncryptor) Bytes() []byte {
+	if ne.padded {
+		binary.BigEndian.PutUint16(ne.bufTail, uint16(ne.padding))
+		ne.buffered += 2
+		ne.padding = 0
+	}
 	buf := ne.buf[:ne.buffered]
 	ne.buffered = ne.prefixLen
 	ne.bufTail = ne.buf[ne.prefixLen:]
@@ -160,23 +341,41 @@ func (ne *NonEncryptor) Bytes() []byte {
 }
 
 func (ne *NonEncryptor) AppendFrame(frame *ForwardedFrame) {
+	if ne.compressed && ne.IsEmpty() {
+		ne.buf[0] = uncompressedFlag
+	}
 	bufTail := ne.bufTail
 	srcLen := copy(bufTail, frame.srcPeer.NameByte)
 	bufTail = bufTail[srcLen:]
 	dstLen := copy(bufTail, frame.dstPeer.NameByte)
 	bufTail = bufTail[dstLen:]
+	tenantLen := 0
+	if ne.tenants {
+		binary.BigEndian.PutUint16(bufTail, frame.tenant)
+		bufTail = bufTail[2:]
+		tenantLen = 2
+	}
+	hopsLen := 0
+	if ne.hopLimits {
+		bufTail[0] = frame.hops
+		bufTail = bufTail[1:]
+		hopsLen = 1
+	}
 	frameLen := len(frame.frame)
 	binary.BigEndian.PutUint16(bufTail, uint16(frameLen))
 	bufTail = bufTail[2:]
 	copy(bufTail, frame.frame)
 	ne.bufTail = bufTail[frameLen:]
-	ne.buffered += srcLen + dstLen + 2 + frameLen
+	ne.buffered += srcLen + dstLen + tenantLen + hopsLen + 2 + frameLen
 }
 
 func (ne *NonEncryptor) TotalLen() int {
 	return ne.buffered
 }
 
+func (ne *NonEncryptor) Rekey(key *[32]byte) {
+}
+
 func NewNaClEncryptor(prefix []byte, conn *LocalConnection, df bool) *NaClEncryptor {
 	buf := make([]byte, MaxUDPPacketSize)
 	prefixLen := copy(buf, prefix)
@@ -185,7 +384,7 @@ func NewNaClEncryptor(prefix []byte, conn *LocalConnection, df bool) *NaClEncryp
 		flags = flags | (1 << 15)
 	}
 	return &NaClEncryptor{
-		NonEncryptor: *NewNonEncryptor([]byte{}),
+		NonEncryptor: *newPlaintextEncryptor(conn),
 		buf:          buf,
 		offset:       0,
 		nonce:        nil,
@@ -193,29 +392,57 @@ func NewNaClEncryptor(prefix []byte, conn *LocalConnection, df bool) *NaClEncryp
 		flags:        flags,
 		prefixLen:    prefixLen,
 		conn:         conn,
+		key:          conn.SessionKey,
 		df:           df}
 }
 
 func (ne *NaClEncryptor) Bytes() []byte {
 	plaintext := ne.NonEncryptor.Bytes()
-	offsetFlags := ne.offset | ne.flags
+	nonce, offsetFlags, ok := ne.nextNonce()
+	if !ok {
+		return []byte{}
+	}
 	ciphertext := ne.buf
 	binary.BigEndian.PutUint16(ciphertext[ne.prefixLen:], offsetFlags)
-	nonce := ne.nonce
-	if nonce == nil {
+	// Seal *appends* to ciphertext
+	return secretbox.Seal(ciphertext[:ne.prefixLen+2], plaintext, &nonce, ne.key)
+}
+
+// Like Bytes, but leaves the sealing, which is the costly part, to
+// the function returned, so that it can happen elsewhere while we
+// assemble the next packet. Everything the sealing needs gets copied.
+func (ne *NaClEncryptor) DeferredBytes() func() []byte {
+	plaintext := append([]byte{}, ne.NonEncryptor.Bytes()...)
+	nonce, offsetFlags, ok := ne.nextNonce()
+	if !ok {
+		return func() []byte { return []byte{} }
+	}
+	header := make([]byte, ne.prefixLen+2, ne.prefixLen+2+len(plaintext)+secretbox.Overhead)
+	copy(header, ne.buf[:ne.prefixLen])
+	binary.BigEndian.PutUint16(header[ne.prefixLen:], offsetFlags)
+	key := ne.key
+	return func() []byte {
+		return secretbox.Seal(header, plaintext, &nonce, key)
+	}
+}
+
+// The nonce and offset/flags field for the next packet. We move on to
+// a fresh nonce when we run out of offsets, having sent it to the
+// remote peer half way through.
+func (ne *NaClEncryptor) nextNonce() ([24]byte, uint16, bool) {
+	offsetFlags := ne.offset | ne.flags
+	if ne.nonce == nil {
 		freshNonce, encodedNonce, err := EncodeNonce(ne.df)
 		if err != nil {
 			ne.conn.Shutdown(err)
-			return []byte{}
+			return [24]byte{}, 0, false
 		}
 		ne.conn.SendProtocolMsg(ProtocolMsg{ProtocolNonce, encodedNonce})
 		ne.nonce = freshNonce
-		nonce = freshNonce
 	}
 	offset := ne.offset
-	SetNonceLow15Bits(nonce, offset)
-	// Seal *appends* to ciphertext
-	ciphertext = secretbox.Seal(ciphertext[:ne.prefixLen+2], plaintext, nonce, ne.conn.SessionKey)
+	nonce := *ne.nonce
+	SetNonceLow15Bits(&nonce, offset)
 
 	offset = (offset + 1) & ((1 << 15) - 1)
 	if offset == 0 {
@@ -225,14 +452,13 @@ func (ne *NaClEncryptor) Bytes() []byte {
 		nonce, encodedNonce, err := EncodeNonce(ne.df)
 		if err != nil {
 			ne.conn.Shutdown(err)
-			return []byte{}
+			return [24]byte{}, 0, false
 		}
 		ne.nonceChan <- nonce
 		ne.conn.SendProtocolMsg(ProtocolMsg{ProtocolNonce, encodedNonce})
 	}
 	ne.offset = offset
-
-	return ciphertext
+	return nonce, offsetFlags, true
 }
 
 func (ne *NaClEncryptor) PacketOverhead() int {
@@ -243,13 +469,20 @@ func (ne *NaClEncryptor) TotalLen() int {
 	return ne.PacketOverhead() + ne.NonEncryptor.TotalLen()
 }
 
+// The nonces are independent of the key, so we carry on with the
+// current one.
+func (ne *NaClEncryptor) Rekey(key *[32]byte) {
+	ne.key = key
+}
+
 // Frame Decryptors
 
-type FrameConsumer func(*LocalConnection, *net.UDPAddr, []byte, []byte, uint16, []byte) error
+type FrameConsumer func(*LocalConnection, *net.UDPAddr, []byte, []byte, uint16, uint8, uint16, []byte) error
 
 type Decryptor interface {
 	IterateFrames(FrameConsumer, *UDPPacket) error
 	ReceiveNonce([]byte)
+	AddKey(*[32]byte)
 	Shutdown()
 }
 
@@ -259,6 +492,7 @@ type NonDecryptor struct {
 
 type NaClDecryptor struct {
 	NonDecryptor
+	keys       *KeyRing
 	instance   *NaClDecryptorInstance
 	instanceDF *NaClDecryptorInstance
 }
@@ -283,11 +517,28 @@ func NewNonDecryptor(conn *LocalConnection) *NonDecryptor {
 
 func (nd *NonDecryptor) IterateFrames(fun FrameConsumer, packet *UDPPacket) error {
 	buf := packet.Packet
-	for len(buf) >= (2 + NameSize + NameSize) {
+	headerLen := NameSize + NameSize + 2
+	if nd.conn.tenantTags {
+		headerLen += 2
+	}
+	if nd.conn.hopLimits {
+		headerLen++
+	}
+	for len(buf) >= headerLen {
 		srcNameByte := buf[:NameSize]
 		buf = buf[NameSize:]
 		dstNameByte := buf[:NameSize]
 		buf = buf[NameSize:]
+		tenant := uint16(0)
+		if nd.conn.tenantTags {
+			tenant = binary.BigEndian.Uint16(buf[:2])
+			buf = buf[2:]
+		}
+		hops := uint8(0)
+		if nd.conn.hopLimits {
+			hops = buf[0]
+			buf = buf[1:]
+		}
 		length := binary.BigEndian.Uint16(buf[:2])
 		buf = buf[2:]
 		if len(buf) < int(length) {
@@ -295,7 +546,7 @@ func (nd *NonDecryptor) IterateFrames(fun FrameConsumer, packet *UDPPacket) erro
 		}
 		frame := buf[:length]
 		buf = buf[length:]
-		err := fun(nd.conn, packet.Sender, srcNameByte, dstNameByte, length, frame)
+		err := fun(nd.conn, packet.Sender, srcNameByte, dstNameByte, tenant, hops, length, frame)
 		if err != nil {
 			return err
 		}
@@ -310,7 +561,10 @@ func (nd *NonDecryptor) Shutdown() {
 }
 
 func (nd *NonDecryptor) ReceiveNonce(msg []byte) {
-	log.Println("Received Nonce on non-encrypted channel. Ignoring.")
+	logCrypto.Warn("Received Nonce on non-encrypted channel. Ignoring.")
+}
+
+func (nd *NonDecryptor) AddKey(key *[32]byte) {
 }
 
 func NewNaClDecryptor(conn *LocalConnection) *NaClDecryptor {
@@ -330,6 +584,7 @@ func NewNaClDecryptor(conn *LocalConnection) *NaClDecryptor {
 		nonceChan:           make(chan *[24]byte, ChannelSize)}
 	return &NaClDecryptor{
 		NonDecryptor: *NewNonDecryptor(conn),
+		keys:         NewKeyRing(conn.SessionKey, func(key *[32]byte) interface{} { return key }),
 		instance:     &inst,
 		instanceDF:   &instDF}
 }
@@ -348,11 +603,21 @@ func (nd *NaClDecryptor) ReceiveNonce(msg []byte) {
 	}
 }
 
+func (nd *NaClDecryptor) AddKey(key *[32]byte) {
+	nd.keys.Add(key)
+}
+
 func (nd *NaClDecryptor) IterateFrames(fun FrameConsumer, packet *UDPPacket) error {
 	buf, err := nd.decrypt(packet.Packet)
 	if err != nil {
 		return PacketDecodingError{Fatal: true, Desc: fmt.Sprint("decryption failed; ", err)}
 	}
+	if buf, err = nd.conn.stripPadding(buf); err != nil {
+		return err
+	}
+	if buf, err = nd.conn.decompress(buf); err != nil {
+		return err
+	}
 	packet.Packet = buf
 	return nd.NonDecryptor.IterateFrames(fun, packet)
 }
@@ -432,7 +697,12 @@ func (nd *NaClDecryptor) decrypt(buf []byte) ([]byte, error) {
 		return nil, fmt.Errorf("Suspected replay attack detected when decrypting UDP packet")
 	}
 	SetNonceLow15Bits(nonce, offsetNoFlags)
-	result, success := secretbox.Open(nil, buf[2:], nonce, nd.conn.SessionKey)
+	var result []byte
+	success := nd.keys.Try(func(key interface{}) bool {
+		var ok bool
+		result, ok = secretbox.Open(nil, buf[2:], nonce, key.(*[32]byte))
+		return ok
+	})
 	if success {
 		usedOffsets.Add(offsetNoFlagsInt)
 		return result, nil
@@ -448,6 +718,7 @@ type TCPSender interface {
 }
 
 type SimpleTCPSender struct {
+	sync.Mutex
 	encoder *gob.Encoder
 }
 
@@ -456,7 +727,7 @@ type EncryptedTCPSender struct {
 	outerEncoder *gob.Encoder
 	innerEncoder *gob.Encoder
 	buffer       *bytes.Buffer
-	conn         *LocalConnection
+	key          *[32]byte
 	msgCount     int
 }
 
@@ -470,16 +741,18 @@ func NewSimpleTCPSender(encoder *gob.Encoder) *SimpleTCPSender {
 }
 
 func (sender *SimpleTCPSender) Send(msg []byte) error {
+	sender.Lock()
+	defer sender.Unlock()
 	return sender.encoder.Encode(msg)
 }
 
-func NewEncryptedTCPSender(encoder *gob.Encoder, conn *LocalConnection) *EncryptedTCPSender {
+func NewEncryptedTCPSender(encoder *gob.Encoder, key *[32]byte) *EncryptedTCPSender {
 	buffer := new(bytes.Buffer)
 	return &EncryptedTCPSender{
 		outerEncoder: encoder,
 		innerEncoder: gob.NewEncoder(buffer),
 		buffer:       buffer,
-		conn:         conn,
+		key:          key,
 		msgCount:     0}
 }
 
@@ -499,7 +772,7 @@ func (sender *EncryptedTCPSender) Send(msg []byte) error {
 	}
 	sender.msgCount = sender.msgCount + 1
 	return sender.outerEncoder.Encode(
-		EncryptPrefixNonce(buffer.Bytes(), &nonce, sender.conn.SessionKey))
+		EncryptPrefixNonce(buffer.Bytes(), &nonce, sender.key))
 }
 
 // TCP Receivers
@@ -512,7 +785,7 @@ type SimpleTCPReceiver struct {
 }
 
 type EncryptedTCPReceiver struct {
-	conn     *LocalConnection
+	key      *[32]byte
 	decoder  *gob.Decoder
 	buffer   *bytes.Buffer
 	msgCount int
@@ -526,17 +799,17 @@ func (receiver *SimpleTCPReceiver) Decode(msg []byte) ([]byte, error) {
 	return msg, nil
 }
 
-func NewEncryptedTCPReceiver(conn *LocalConnection) *EncryptedTCPReceiver {
+func NewEncryptedTCPReceiver(key *[32]byte) *EncryptedTCPReceiver {
 	buffer := new(bytes.Buffer)
 	return &EncryptedTCPReceiver{
-		conn:     conn,
+		key:      key,
 		decoder:  gob.NewDecoder(buffer),
 		buffer:   buffer,
 		msgCount: 0}
 }
 
 func (receiver *EncryptedTCPReceiver) Decode(msg []byte) ([]byte, error) {
-	plaintext, success := DecryptPrefixNonce(msg, receiver.conn.SessionKey)
+	plaintext, success := DecryptPrefixNonce(msg, receiver.key)
 	if !success {
 		return msg, fmt.Errorf("Unable to decrypt TCP msg")
 	}
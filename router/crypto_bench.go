@@ -0,0 +1,217 @@
+package router
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"runtime"
+	"time"
+)
+
+// Measurement of how fast this machine encrypts and decrypts packets
+// with each encryption scheme, to size the forwarders and sealing
+// workers by, and a self-test of the schemes, run at startup, so that
+// a broken cipher implementation, e.g. on an unusual CPU, shows up
+// before it garbles traffic with peers.
+//
+// Both run the schemes' actual encryptors and decryptors, between a
+// pair of connections which exist only in memory. Schemes may supply
+// a further self-test, checking their construction against a packet
+// every implementation must seal and open alike.
+
+var CryptoBenchFrameSizes = []int{64, 512, 1410, 8950}
+
+const (
+	cryptoBenchBatch = 256 // packets to seal before opening them
+	cryptoMaxBatch   = 64  // UDP packets per syscall worth recommending
+)
+
+type CryptoBenchResult struct {
+	Scheme    string
+	FrameSize int
+	Overhead  int     // bytes added to each packet carrying one such frame
+	SealRate  float64 // bytes of frames per second one core seals
+	OpenRate  float64 // likewise opens
+}
+
+// A connection from one peer to another, and the remote's side of it
+type cryptoPair struct {
+	enc     Encryptor
+	dec     Decryptor
+	frame   *ForwardedFrame
+	queries chan *ConnectionInteraction // what the encryptor sends the remote over the control channel
+}
+
+func newCryptoPair(scheme *EncryptionScheme, key *[32]byte) *cryptoPair {
+	peer1, peer2 := cryptoPeer(1), cryptoPeer(2)
+	queries := make(chan *ConnectionInteraction, ChannelSize)
+	conn1 := &LocalConnection{RemoteConnection: RemoteConnection{local: peer1, remote: peer2}, SessionKey: key, queryChan: queries}
+	conn2 := &LocalConnection{RemoteConnection: RemoteConnection{local: peer2, remote: peer1}, SessionKey: key}
+	return &cryptoPair{
+		enc:     scheme.NewEncryptor(conn1.packetPrefix(), conn1, false, 0),
+		dec:     scheme.NewDecryptor(conn2),
+		frame:   &ForwardedFrame{srcPeer: peer1, dstPeer: peer2},
+		queries: queries}
+}
+
+func cryptoPeer(id byte) *Peer {
+	name := make([]byte, NameSize)
+	name[NameSize-1] = id
+	return NewPeer(PeerNameFromBin(name), 0, 0)
+}
+
+func (pair *cryptoPair) seal(frame []byte) []byte {
+	pair.frame.frame = frame
+	pair.enc.AppendFrame(pair.frame)
+	return append([]byte{}, pair.enc.Bytes()...)
+}
+
+// Hand the remote the nonces the encryptor sent it, and open the
+// packet, checking it carries the frame.
+func (pair *cryptoPair) open(packet []byte, frame []byte) error {
+	for len(pair.queries) > 0 {
+		query := <-pair.queries
+		if msg, ok := query.payload.(ProtocolMsg); ok && msg.tag == ProtocolNonce {
+			pair.dec.ReceiveNonce(msg.msg)
+		}
+	}
+	received := 0
+	err := pair.dec.IterateFrames(func(_ *LocalConnection, _ *net.UDPAddr, _, _ []byte, _ uint16, _ uint8, _ uint16, payload []byte) error {
+		if !bytes.Equal(payload, frame) {
+			return fmt.Errorf("frame garbled")
+		}
+		received++
+		return nil
+	}, &UDPPacket{Packet: packet[NameSize:]})
+	if err == nil && received != 1 {
+		err = fmt.Errorf("%d frames in a packet of one", received)
+	}
+	return err
+}
+
+// Check each encryption scheme opens what it seals, and passes its own
+// self-test.
+func SelfTestEncryption() error {
+	key := &[32]byte{}
+	frame := []byte("weave encryption self-test")
+	for _, scheme := range encryptionSchemes {
+		if scheme.SelfTest != nil {
+			if err := scheme.SelfTest(); err != nil {
+				return fmt.Errorf("%s: %s", scheme.Name, err)
+			}
+		}
+		pair := newCryptoPair(scheme, key)
+		for i := 0; i < 3; i++ {
+			if err := pair.open(pair.seal(frame), frame); err != nil {
+				return fmt.Errorf("%s: unable to open packet %d: %s", scheme.Name, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Seal and open packets of one frame, of each of the sizes, with each
+// scheme, for about the duration each.
+func BenchmarkEncryption(duration time.Duration, frameSizes []int) ([]CryptoBenchResult, error) {
+	key := &[32]byte{}
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, err
+	}
+	results := []CryptoBenchResult{}
+	for _, scheme := range encryptionSchemes {
+		for _, size := range frameSizes {
+			pair := newCryptoPair(scheme, key)
+			frame := make([]byte, size)
+			packets := make([][]byte, cryptoBenchBatch)
+			var sealing, opening time.Duration
+			frameBytes := 0
+			for sealing+opening < duration {
+				start := time.Now()
+				for i := range packets {
+					packets[i] = pair.seal(frame)
+				}
+				sealed := time.Now()
+				for _, packet := range packets {
+					if err := pair.open(packet, frame); err != nil {
+						return nil, fmt.Errorf("%s: unable to open packet: %s", scheme.Name, err)
+					}
+				}
+				sealing += sealed.Sub(start)
+				opening += time.Since(sealed)
+				frameBytes += size * len(packets)
+			}
+			results = append(results, CryptoBenchResult{
+				Scheme:    scheme.Name,
+				FrameSize: size,
+				Overhead:  len(packets[0]) - size,
+				SealRate:  float64(frameBytes) / sealing.Seconds(),
+				OpenRate:  float64(frameBytes) / opening.Seconds()})
+		}
+	}
+	return results, nil
+}
+
+type CryptoSettings struct {
+	Scheme    string
+	Workers   int // -forwarder-workers for schemes with streams, otherwise -encryption-workers
+	BatchSize int
+}
+
+// Settings to send at the rate, in bits per second, with each scheme,
+// going by how fast it seals the largest frames which fit in a
+// typical path MTU.
+func RecommendCryptoSettings(results []CryptoBenchResult, rate float64) []CryptoSettings {
+	settings := []CryptoSettings{}
+	for _, scheme := range encryptionSchemes {
+		var typical *CryptoBenchResult
+		for i, result := range results {
+			if result.Scheme == scheme.Name && result.FrameSize+result.Overhead <= 1500 &&
+				(typical == nil || result.FrameSize > typical.FrameSize) {
+				typical = &results[i]
+			}
+		}
+		if typical == nil {
+			continue
+		}
+		cores := int(math.Ceil(rate / 8 / typical.SealRate))
+		maxWorkers := runtime.NumCPU()
+		if scheme.Streams && maxWorkers > MaxForwarders {
+			maxWorkers = MaxForwarders
+		}
+		workers := cores
+		if workers > maxWorkers {
+			workers = maxWorkers
+		}
+		if workers < 1 {
+			workers = 1
+		}
+		if !scheme.Streams && workers == 1 {
+			workers = 0 // the forwarders keep up sealing themselves
+		}
+		// Enough packets to fill a batch within the flush delay
+		packetRate := rate / 8 / float64(typical.FrameSize+typical.Overhead)
+		batchSize := int(packetRate * FlushDelay.Seconds())
+		if batchSize < 1 {
+			batchSize = 1
+		} else if batchSize > cryptoMaxBatch {
+			batchSize = cryptoMaxBatch
+		}
+		settings = append(settings, CryptoSettings{Scheme: scheme.Name, Workers: workers, BatchSize: batchSize})
+	}
+	return settings
+}
+
+// Check what a scheme sealed, given in hex, and opened again against
+// its test vector.
+func checkVector(sealed []byte, expected string, opened []byte, plaintext []byte) error {
+	if hex.EncodeToString(sealed) != expected {
+		return fmt.Errorf("sealed packet differs from test vector")
+	}
+	if !bytes.Equal(opened, plaintext) {
+		return fmt.Errorf("unable to open test vector")
+	}
+	return nil
+}
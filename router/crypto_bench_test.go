@@ -0,0 +1,40 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"testing"
+	"time"
+)
+
+func TestSelfTestEncryption(t *testing.T) {
+	wt.AssertNoErr(t, SelfTestEncryption())
+	if checkVector([]byte{1, 2}, "0103", []byte("x"), []byte("x")) == nil {
+		wt.Fatalf(t, "Expected a sealed packet differing from its vector to fail")
+	}
+}
+
+func TestBenchmarkEncryption(t *testing.T) {
+	results, err := BenchmarkEncryption(10*time.Millisecond, []int{64, 1400})
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(results), 2*len(encryptionSchemes), "results")
+	for _, result := range results {
+		if result.SealRate <= 0 || result.OpenRate <= 0 || result.Overhead <= 0 {
+			wt.Fatalf(t, "Expected positive rates and overhead, got %+v", result)
+		}
+	}
+
+	// Schemes which seal a Gbit/s on one core need one worker for it,
+	// and more for more
+	results = []CryptoBenchResult{
+		{Scheme: "aes-gcm", FrameSize: 1400, Overhead: 50, SealRate: 125e6},
+		{Scheme: "nacl", FrameSize: 1400, Overhead: 50, SealRate: 125e6},
+		{Scheme: "nacl", FrameSize: 8950, Overhead: 50, SealRate: 1e9}}
+	settings := RecommendCryptoSettings(results, 1e9)
+	wt.AssertEqualInt(t, len(settings), 2, "settings")
+	for _, s := range settings {
+		wt.AssertEqualInt(t, s.Workers, map[string]int{"aes-gcm": 1, "nacl": 0}[s.Scheme], s.Scheme+" workers")
+		wt.AssertEqualInt(t, s.BatchSize, 64, s.Scheme+" batch size")
+	}
+	settings = RecommendCryptoSettings(results, 1e7)
+	wt.AssertEqualInt(t, settings[0].BatchSize, 1, "batch size at a low rate")
+}
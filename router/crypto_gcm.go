@@ -0,0 +1,263 @@
+package router
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// AES-GCM encryption of UDP packets.
+//
+// Unlike the NaCl scheme, this does not need any nonces exchanged
+// over TCP. Every packet carries an explicit 64-bit header: the top
+// bit is the DF flag, the next seven bits the stream number of the
+// encryptor, and the remaining bits a counter incremented for every
+// packet. Each (DF flag, stream) pair gets its own replay window at
+// the receiver. The header forms the lower 8 bytes of the GCM nonce.
+//
+// That keeps nonces unique per stream, and so under each key: both
+// directions of a connection share the session key, so each side
+// derives its own key from the session key and its peer name; and the
+// counters belong to the connection rather than its encryptors, and
+// keep going up across keys and across forwarders being restarted, so
+// no header is ever sent twice.
+
+const (
+	gcmOverhead    = 16 // size of the GCM tag
+	gcmHeaderSize  = 8
+	gcmDFFlag      = 1 << 63
+	gcmStreamShift = 56
+	gcmMaxStreams  = 1 << (63 - gcmStreamShift)
+	gcmMaxCounter  = 1<<gcmStreamShift - 1
+)
+
+func newGCM(sessionKey *[32]byte, senderName []byte) cipher.AEAD {
+	key := sha256.Sum256(Concat(sessionKey[:], senderName))
+	block, err := aes.NewCipher(key[:])
+	checkFatal(err)
+	aead, err := cipher.NewGCM(block)
+	checkFatal(err)
+	return aead
+}
+
+func gcmNonce(header []byte) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce[4:], header)
+	return nonce
+}
+
+const gcmTestVector = "2b87494dd429f65b26c3b915bf9b6115a5a71a6072bcf5dd5fecef40712ca1d0dc295282a7e15dd8370a"
+
+// The sender's key is derived from its name, which also goes in as
+// additional data, and the header as we'd send it, for DF stream 1,
+// makes the nonce.
+func gcmSelfTest() error {
+	sender := []byte("sender")
+	header := []byte{0x81, 0, 0, 0, 0, 0, 0, 5}
+	sealed := newGCM(selfTestKey, sender).Seal(nil, gcmNonce(header), selfTestPlaintext, sender)
+	opened, _ := newGCM(selfTestKey, sender).Open(nil, gcmNonce(header), sealed, sender)
+	return checkVector(sealed, gcmTestVector, opened, selfTestPlaintext)
+}
+
+// The counters of a connection's packets, by DF flag and stream, and
+// the session key we currently send with. They belong to the
+// connection rather than its encryptors, so that the encryptors of
+// forwarders started afresh carry on counting from where those before
+// them left off, rather than reusing nonces.
+type gcmCounters struct {
+	sync.Mutex
+	sessionKey *[32]byte
+	next       [2 * gcmMaxStreams]uint64 // indexed like the receiver's replay windows
+}
+
+func newGCMCounters(key *[32]byte) *gcmCounters {
+	return &gcmCounters{sessionKey: key}
+}
+
+func (counters *gcmCounters) key() *[32]byte {
+	counters.Lock()
+	defer counters.Unlock()
+	return counters.sessionKey
+}
+
+func (counters *gcmCounters) setKey(key *[32]byte) {
+	counters.Lock()
+	defer counters.Unlock()
+	counters.sessionKey = key
+}
+
+// The counter for the next packet of the DF flag and stream. Old and
+// new encryptors for the same stream may run side by side for a while,
+// hence the atomic.
+func (counters *gcmCounters) take(i uint64) uint64 {
+	return atomic.AddUint64(&counters.next[i], 1) - 1
+}
+
+type GCMEncryptor struct {
+	NonEncryptor
+	buf       []byte
+	prefixLen int
+	aead      cipher.AEAD
+	counters  *gcmCounters
+	flags     uint64
+	conn      *LocalConnection
+}
+
+// Called by the connection actor process, which creates the
+// connection's counters along with its first encryptor.
+func NewGCMEncryptor(prefix []byte, conn *LocalConnection, df bool, stream int) *GCMEncryptor {
+	buf := make([]byte, MaxUDPPacketSize)
+	prefixLen := copy(buf, prefix)
+	flags := uint64(stream) << gcmStreamShift
+	if df {
+		flags |= gcmDFFlag
+	}
+	if conn.gcmCounters == nil {
+		conn.gcmCounters = newGCMCounters(conn.SessionKey)
+	}
+	return &GCMEncryptor{
+		NonEncryptor: *newPlaintextEncryptor(conn),
+		buf:          buf,
+		prefixLen:    prefixLen,
+		aead:         newGCM(conn.gcmCounters.key(), conn.local.NameByte),
+		counters:     conn.gcmCounters,
+		flags:        flags,
+		conn:         conn}
+}
+
+func (ge *GCMEncryptor) Bytes() []byte {
+	plaintext := ge.NonEncryptor.Bytes()
+	counter := ge.counters.take(ge.flags >> gcmStreamShift)
+	if counter > gcmMaxCounter {
+		ge.conn.Shutdown(fmt.Errorf("AES-GCM packet counter exhausted"))
+		return []byte{}
+	}
+	header := ge.buf[ge.prefixLen : ge.prefixLen+gcmHeaderSize]
+	binary.BigEndian.PutUint64(header, counter|ge.flags)
+	// Seal *appends* to the header
+	return ge.aead.Seal(ge.buf[:ge.prefixLen+gcmHeaderSize], gcmNonce(header), plaintext, ge.conn.local.NameByte)
+}
+
+// The counters carry on across keys, which keeps the receiver's replay
+// windows valid. Encryptors made from now on start with the new key.
+func (ge *GCMEncryptor) Rekey(key *[32]byte) {
+	ge.counters.setKey(key)
+	ge.aead = newGCM(key, ge.conn.local.NameByte)
+}
+
+func (ge *GCMEncryptor) PacketOverhead() int {
+	return ge.prefixLen + gcmHeaderSize + ge.aead.Overhead() + ge.NonEncryptor.PacketOverhead()
+}
+
+func (ge *GCMEncryptor) TotalLen() int {
+	return ge.PacketOverhead() + ge.NonEncryptor.TotalLen()
+}
+
+// Replay detection, tolerating some amount of reordering. Cf. the
+// anti-replay window of RFC 4303, section 3.4.3.
+
+const replayWindowSize = 64
+
+type ReplayWindow struct {
+	highest uint64
+	seen    uint64 // bit i set <=> highest-i has been seen
+	started bool
+}
+
+func (w *ReplayWindow) Check(counter uint64) bool {
+	switch {
+	case !w.started || counter > w.highest:
+		return true
+	case w.highest-counter >= replayWindowSize:
+		return false
+	default:
+		return w.seen&(1<<(w.highest-counter)) == 0
+	}
+}
+
+// Only to be called for packets which have passed Check and have been
+// authenticated.
+func (w *ReplayWindow) Update(counter uint64) {
+	switch {
+	case !w.started:
+		w.started = true
+		w.highest = counter
+		w.seen = 1
+	case counter > w.highest:
+		if shift := counter - w.highest; shift < replayWindowSize {
+			w.seen = (w.seen << shift) | 1
+		} else {
+			w.seen = 1
+		}
+		w.highest = counter
+	default:
+		w.seen |= 1 << (w.highest - counter)
+	}
+}
+
+type GCMDecryptor struct {
+	NonDecryptor
+	aeads   *KeyRing
+	windows [2 * gcmMaxStreams]ReplayWindow // indexed by DF flag and stream
+}
+
+func NewGCMDecryptor(conn *LocalConnection) *GCMDecryptor {
+	remoteName := conn.remote.NameByte
+	return &GCMDecryptor{
+		NonDecryptor: *NewNonDecryptor(conn),
+		aeads: NewKeyRing(conn.SessionKey, func(key *[32]byte) interface{} {
+			return newGCM(key, remoteName)
+		})}
+}
+
+func (gd *GCMDecryptor) AddKey(key *[32]byte) {
+	gd.aeads.Add(key)
+}
+
+func (gd *GCMDecryptor) ReceiveNonce(msg []byte) {
+	logCrypto.Warn("Received Nonce on AES-GCM channel. Ignoring.")
+}
+
+func (gd *GCMDecryptor) IterateFrames(fun FrameConsumer, packet *UDPPacket) error {
+	buf, err := gd.decrypt(packet.Packet)
+	if err != nil {
+		return err
+	}
+	if buf, err = gd.conn.stripPadding(buf); err != nil {
+		return err
+	}
+	if buf, err = gd.conn.decompress(buf); err != nil {
+		return err
+	}
+	packet.Packet = buf
+	return gd.NonDecryptor.IterateFrames(fun, packet)
+}
+
+func (gd *GCMDecryptor) decrypt(buf []byte) ([]byte, error) {
+	if len(buf) < gcmHeaderSize+gcmOverhead {
+		return nil, PacketDecodingError{Desc: fmt.Sprintf("too short for AES-GCM; got %d octets", len(buf))}
+	}
+	header := binary.BigEndian.Uint64(buf[:gcmHeaderSize])
+	counter := header & gcmMaxCounter
+	window := &gd.windows[header>>gcmStreamShift]
+	if !window.Check(counter) {
+		// Could be a replay attack, but far more likely to be
+		// reordering beyond the window. Either way, drop it.
+		return nil, PacketDecodingError{Desc: fmt.Sprint("stale or replayed AES-GCM packet ", counter)}
+	}
+	var result []byte
+	success := gd.aeads.Try(func(aead interface{}) bool {
+		var err error
+		result, err = aead.(cipher.AEAD).Open(nil, gcmNonce(buf[:gcmHeaderSize]), buf[gcmHeaderSize:], gd.conn.remote.NameByte)
+		return err == nil
+	})
+	if !success {
+		return nil, PacketDecodingError{Fatal: true, Desc: "decryption failed"}
+	}
+	window.Update(counter)
+	return result, nil
+}
@@ -0,0 +1,236 @@
+package router
+
+import (
+	"bytes"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestGCMConnPair() (*LocalConnection, *LocalConnection) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	peer1, peer2 := NewPeer(name1, 0, 0), NewPeer(name2, 0, 0)
+	key := &[32]byte{1, 2, 3}
+	conn1 := &LocalConnection{RemoteConnection: RemoteConnection{local: peer1, remote: peer2}, SessionKey: key}
+	conn2 := &LocalConnection{RemoteConnection: RemoteConnection{local: peer2, remote: peer1}, SessionKey: key}
+	return conn1, conn2
+}
+
+func TestGCMRoundTrip(t *testing.T) {
+	conn1, conn2 := newTestGCMConnPair()
+	for _, df := range []bool{false, true} {
+		enc := NewGCMEncryptor(conn1.local.NameByte, conn1, df, 0)
+		dec := NewGCMDecryptor(conn2)
+		frame := &ForwardedFrame{srcPeer: conn1.local, dstPeer: conn1.remote, frame: []byte("hello world")}
+		for i := 0; i < 3; i++ {
+			enc.AppendFrame(frame)
+			wt.AssertEqualInt(t, enc.TotalLen(), enc.PacketOverhead()+enc.FrameOverhead()+len(frame.frame), "encryptor length")
+			packet := enc.Bytes()
+			wt.AssertEqualInt(t, len(packet), enc.PacketOverhead()+enc.FrameOverhead()+len(frame.frame), "packet length")
+			received := 0
+			err := dec.IterateFrames(func(_ *LocalConnection, _ *net.UDPAddr, src, dst []byte, _ uint16, _ uint8, _ uint16, payload []byte) error {
+				if !bytes.Equal(src, conn1.local.NameByte) || !bytes.Equal(dst, conn1.remote.NameByte) {
+					wt.Fatalf(t, "Unexpected src/dst %v/%v", src, dst)
+				}
+				wt.AssertEqualString(t, string(payload), string(frame.frame), "frame")
+				received++
+				return nil
+			}, &UDPPacket{Packet: Concat(packet[NameSize:])})
+			wt.AssertNoErr(t, err)
+			wt.AssertEqualInt(t, received, 1, "frames received")
+
+			// replaying the packet must fail, non-fatally
+			err = dec.IterateFrames(nil, &UDPPacket{Packet: Concat(packet[NameSize:])})
+			if pde, ok := err.(PacketDecodingError); !ok || pde.Fatal {
+				wt.Fatalf(t, "Expected non-fatal decoding error on replay, got %v", err)
+			}
+		}
+	}
+}
+
+func TestGCMWrongDirection(t *testing.T) {
+	conn1, _ := newTestGCMConnPair()
+	enc := NewGCMEncryptor(conn1.local.NameByte, conn1, false, 0)
+	// A decryptor for the wrong direction uses a different key
+	dec := NewGCMDecryptor(conn1)
+	enc.AppendFrame(&ForwardedFrame{srcPeer: conn1.local, dstPeer: conn1.remote, frame: []byte("x")})
+	err := dec.IterateFrames(nil, &UDPPacket{Packet: Concat(enc.Bytes()[NameSize:])})
+	if pde, ok := err.(PacketDecodingError); !ok || !pde.Fatal {
+		wt.Fatalf(t, "Expected fatal decoding error, got %v", err)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w ReplayWindow
+	accept := func(counter uint64, expected bool) {
+		if w.Check(counter) != expected {
+			wt.Fatalf(t, "Expected Check(%d) to be %v", counter, expected)
+		}
+		if expected {
+			w.Update(counter)
+		}
+	}
+	accept(5, true)
+	accept(5, false)
+	accept(3, true)
+	accept(3, false)
+	accept(100, true)
+	accept(37, true)
+	accept(36, false) // outside the window
+	accept(99, true)
+	accept(1000, true)
+	accept(100, false)
+}
+
+func TestChooseEncryptionScheme(t *testing.T) {
+	scheme, err := ChooseEncryptionScheme([]string{"nacl", "aes-gcm"}, []string{"aes-gcm", "nacl"})
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, scheme.Name, "nacl", "scheme")
+	scheme, err = ChooseEncryptionScheme([]string{"foo", "aes-gcm"}, []string{"nacl", "aes-gcm"})
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, scheme.Name, "aes-gcm", "scheme")
+	if _, err = ChooseEncryptionScheme([]string{"foo"}, []string{"nacl"}); err == nil {
+		wt.Fatalf(t, "Expected error when there is no common scheme")
+	}
+}
+
+func TestGCMRekey(t *testing.T) {
+	conn1, conn2 := newTestGCMConnPair()
+	enc := NewGCMEncryptor(conn1.local.NameByte, conn1, false, 0)
+	dec := NewGCMDecryptor(conn2)
+	frame := &ForwardedFrame{srcPeer: conn1.local, dstPeer: conn1.remote, frame: []byte("hello")}
+	packet := func() []byte {
+		enc.AppendFrame(frame)
+		return Concat(enc.Bytes()[NameSize:])
+	}
+	decrypt := func(packet []byte) error {
+		return dec.IterateFrames(func(*LocalConnection, *net.UDPAddr, []byte, []byte, uint16, uint8, uint16, []byte) error {
+			return nil
+		}, &UDPPacket{Packet: packet})
+	}
+	wt.AssertNoErr(t, decrypt(packet()))
+	inFlight := packet()
+
+	newKey := &[32]byte{4, 5, 6}
+	dec.AddKey(newKey)
+	enc.Rekey(newKey)
+	wt.AssertNoErr(t, decrypt(packet()))
+	// packets encrypted with the old key may still arrive
+	wt.AssertNoErr(t, decrypt(inFlight))
+
+	// whereas those encrypted with keys we don't know are rejected
+	enc.Rekey(&[32]byte{7, 8, 9})
+	if pde, ok := decrypt(packet()).(PacketDecodingError); !ok || !pde.Fatal {
+		wt.Fatalf(t, "Expected fatal decoding error with unknown key")
+	}
+}
+
+// Each stream has its own counter and replay window, so one stream
+// racing ahead of another doesn't get the other's packets rejected.
+func TestGCMStreams(t *testing.T) {
+	conn1, conn2 := newTestGCMConnPair()
+	enc0 := NewGCMEncryptor(conn1.local.NameByte, conn1, false, 0)
+	enc1 := NewGCMEncryptor(conn1.local.NameByte, conn1, false, 1)
+	dec := NewGCMDecryptor(conn2)
+	frame := &ForwardedFrame{srcPeer: conn1.local, dstPeer: conn1.remote, frame: []byte("hello")}
+	packet := func(enc *GCMEncryptor) []byte {
+		enc.AppendFrame(frame)
+		return Concat(enc.Bytes()[NameSize:])
+	}
+	decrypt := func(packet []byte) error {
+		return dec.IterateFrames(func(*LocalConnection, *net.UDPAddr, []byte, []byte, uint16, uint8, uint16, []byte) error {
+			return nil
+		}, &UDPPacket{Packet: packet})
+	}
+	delayed := packet(enc0)
+	for i := 0; i < 2*replayWindowSize; i++ {
+		wt.AssertNoErr(t, decrypt(packet(enc1)))
+	}
+	wt.AssertNoErr(t, decrypt(delayed))
+	// the same counter in different streams yields different nonces
+	enc0 = NewGCMEncryptor(conn1.local.NameByte, conn1, false, 0)
+	enc1 = NewGCMEncryptor(conn1.local.NameByte, conn1, false, 1)
+	if bytes.Equal(packet(enc0)[:gcmHeaderSize], packet(enc1)[:gcmHeaderSize]) {
+		wt.Fatalf(t, "Expected streams to use distinct headers")
+	}
+}
+
+// A TCP sender handing over what forwarders send it
+type chanTCPSender chan []byte
+
+func (sender chanTCPSender) Send(msg []byte) error {
+	sender <- msg
+	return nil
+}
+
+// A connection with AES-GCM encryption, ready to start forwarders
+// sending over TCP to the channel returned, or over UDP from a
+// listener of the router, and one to decrypt what they send. The
+// function returned closes the sockets.
+func newTestForwardingConn(t *testing.T) (*LocalConnection, *LocalConnection, chanTCPSender, func()) {
+	conn1, conn2 := newTestGCMConnPair()
+	loopback := net.IPv4(127, 0, 0, 1)
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: loopback})
+	wt.AssertNoErr(t, err)
+	conn1.TCPConn, err = net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	wt.AssertNoErr(t, err)
+	conn1.Router = NewRouter(RouterConfig{}, conn1.local.Name)
+	conn1.Router.UDPListener, err = net.ListenUDP("udp4", &net.UDPAddr{IP: loopback})
+	wt.AssertNoErr(t, err)
+	conn1.EncryptionScheme, _ = LookupEncryptionScheme("aes-gcm")
+	conn1.stats = &ConnectionStats{}
+	conn1.multiPath = true // which sends DF from the listener too, rather than a raw socket
+	sent := make(chanTCPSender, ChannelSize)
+	conn1.tcpSender = sent
+	return conn1, conn2, sent, func() {
+		conn1.Router.UDPListener.Close()
+		conn1.TCPConn.Close()
+		ln.Close()
+	}
+}
+
+// The next packet sent over TCP, without the sender's name
+func receiveTCPPacket(t *testing.T, sent chanTCPSender) []byte {
+	select {
+	case msg := <-sent:
+		return msg[1+NameSize:]
+	case <-time.After(time.Second):
+		wt.Fatalf(t, "Expected a packet over TCP")
+	}
+	return nil
+}
+
+// Likewise over UDP
+func receiveUDPPacket(t *testing.T, conn *net.UDPConn) []byte {
+	buf := make([]byte, MaxUDPPacketSize)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFromUDP(buf)
+	wt.AssertNoErr(t, err)
+	return buf[NameSize:n]
+}
+
+// Forwarders started afresh carry on counting from where those before
+// them left off, so no nonce gets used twice under the session key.
+func TestGCMForwarderRestart(t *testing.T) {
+	conn1, conn2, sent, closeConn := newTestForwardingConn(t)
+	defer closeConn()
+	conn1.sendingOverTCP = true
+	dec := NewGCMDecryptor(conn2)
+	headers := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		wt.AssertNoErr(t, conn1.ensureForwarders())
+		conn1.Forward(false, &ForwardedFrame{srcPeer: conn1.local, dstPeer: conn1.remote, frame: []byte("hello")}, nil)
+		packet := receiveTCPPacket(t, sent)
+		conn1.stopForwarders()
+		header := string(packet[:gcmHeaderSize])
+		if headers[header] {
+			wt.Fatalf(t, "Header % x repeated after restarting the forwarders", packet[:gcmHeaderSize])
+		}
+		headers[header] = true
+		// and the remote still accepts them
+		_, err := dec.decrypt(packet)
+		wt.AssertNoErr(t, err)
+	}
+}
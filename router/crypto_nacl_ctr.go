@@ -0,0 +1,293 @@
+package router
+
+import (
+	"code.google.com/p/go.crypto/nacl/secretbox"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// NaCl encryption of UDP packets with explicit counters.
+//
+// The original NaCl scheme sends the remote fresh random nonces over
+// the control channel, and only carries a 15-bit offset from the
+// current one in each packet, which takes guesswork on receipt and
+// ties the data plane to the control channel. Here every packet
+// carries a flags byte, holding the DF flag, and a 64-bit counter,
+// which together make its nonce. As with AES-GCM, each side derives
+// its own key from the session key and its peer name, so that both
+// directions can count from zero.
+//
+// The counters belong to the connection rather than its encryptors,
+// so that restarting the forwarders, e.g. on falling back to TCP,
+// carries on counting rather than reusing nonces; they only go back
+// to zero with a new key. Once a counter reaches NaClRekeyAt we ask
+// for a new key, and should it run out regardless, we shut the
+// connection down.
+//
+// The receiver only accepts a packet with a higher counter than any
+// it opened with the same key and DF flag, which rules out replays
+// without having to remember which counters it has seen, at the cost
+// of dropping packets the network reorders.
+
+const (
+	naclCtrHeaderSize = 1 + 8
+	naclCtrDFFlag     = 1
+)
+
+func naclCtrKey(sessionKey *[32]byte, senderName []byte) *[32]byte {
+	key := sha256.Sum256(Concat([]byte("nacl-ctr"), sessionKey[:], senderName))
+	return &key
+}
+
+func naclCtrNonce(header []byte) *[24]byte {
+	nonce := [24]byte{}
+	copy(nonce[24-naclCtrHeaderSize:], header)
+	return &nonce
+}
+
+func naclCtrDF(df bool) int {
+	if df {
+		return 1
+	}
+	return 0
+}
+
+// The counters of a connection's packets, without and with DF, and
+// the session keys they count for
+type naclCounters struct {
+	sync.Mutex
+	keys     [2]*[32]byte
+	next     [2]uint64
+	rekeying [2]bool // whether we asked for a new key
+	rekeyAt  uint64
+	limit    uint64
+}
+
+func newNaClCounters(key *[32]byte) *naclCounters {
+	return &naclCounters{keys: [2]*[32]byte{key, key}, rekeyAt: NaClRekeyAt, limit: math.MaxUint64}
+}
+
+func (counters *naclCounters) key(df bool) *[32]byte {
+	counters.Lock()
+	defer counters.Unlock()
+	return counters.keys[naclCtrDF(df)]
+}
+
+var errNaClKeySuperseded = fmt.Errorf("NaCl session key superseded")
+
+// The counter for the next packet sent with the key, and whether it's
+// time to ask for a new one. Fails for keys we've moved on from, e.g.
+// in forwarders being replaced, and once the counter has run out.
+func (counters *naclCounters) take(df bool, key *[32]byte) (uint64, bool, error) {
+	counters.Lock()
+	defer counters.Unlock()
+	i := naclCtrDF(df)
+	switch {
+	case key != counters.keys[i]:
+		return 0, false, errNaClKeySuperseded
+	case counters.next[i] >= counters.limit:
+		return 0, false, fmt.Errorf("NaCl packet counter exhausted")
+	}
+	counter := counters.next[i]
+	counters.next[i]++
+	rekey := counter >= counters.rekeyAt && !counters.rekeying[i]
+	counters.rekeying[i] = counters.rekeying[i] || rekey
+	return counter, rekey, nil
+}
+
+func (counters *naclCounters) rekey(df bool, key *[32]byte) {
+	counters.Lock()
+	defer counters.Unlock()
+	i := naclCtrDF(df)
+	if key != counters.keys[i] {
+		counters.keys[i], counters.next[i], counters.rekeying[i] = key, 0, false
+	}
+}
+
+type NaClCtrEncryptor struct {
+	NonEncryptor
+	buf        []byte
+	prefixLen  int
+	conn       *LocalConnection
+	counters   *naclCounters
+	sessionKey *[32]byte
+	key        *[32]byte // derived from the session key
+	df         bool
+}
+
+// Called by the connection actor process, which creates the
+// connection's counters along with its first encryptor.
+func NewNaClCtrEncryptor(prefix []byte, conn *LocalConnection, df bool) *NaClCtrEncryptor {
+	buf := make([]byte, MaxUDPPacketSize)
+	prefixLen := copy(buf, prefix)
+	if conn.naclCounters == nil {
+		conn.naclCounters = newNaClCounters(conn.SessionKey)
+	}
+	sessionKey := conn.naclCounters.key(df)
+	return &NaClCtrEncryptor{
+		NonEncryptor: *newPlaintextEncryptor(conn),
+		buf:          buf,
+		prefixLen:    prefixLen,
+		conn:         conn,
+		counters:     conn.naclCounters,
+		sessionKey:   sessionKey,
+		key:          naclCtrKey(sessionKey, conn.local.NameByte),
+		df:           df}
+}
+
+// The header of the next packet
+func (ne *NaClCtrEncryptor) nextHeader() ([]byte, bool) {
+	counter, rekey, err := ne.counters.take(ne.df, ne.sessionKey)
+	if err == errNaClKeySuperseded {
+		return nil, false
+	} else if err != nil {
+		ne.conn.Shutdown(err)
+		return nil, false
+	}
+	if rekey {
+		ne.conn.logger(logCrypto).Info("Asking for a new session key after", counter, "packets")
+		ne.conn.RequestRekey()
+	}
+	header := make([]byte, naclCtrHeaderSize)
+	if ne.df {
+		header[0] = naclCtrDFFlag
+	}
+	binary.BigEndian.PutUint64(header[1:], counter)
+	return header, true
+}
+
+func (ne *NaClCtrEncryptor) Bytes() []byte {
+	plaintext := ne.NonEncryptor.Bytes()
+	header, ok := ne.nextHeader()
+	if !ok {
+		return []byte{}
+	}
+	copy(ne.buf[ne.prefixLen:], header)
+	// Seal *appends* to the header
+	return secretbox.Seal(ne.buf[:ne.prefixLen+naclCtrHeaderSize], plaintext, naclCtrNonce(header), ne.key)
+}
+
+// Like Bytes, but leaves the sealing to the function returned. The
+// counter is taken now, so that packets go out in its order.
+func (ne *NaClCtrEncryptor) DeferredBytes() func() []byte {
+	plaintext := append([]byte{}, ne.NonEncryptor.Bytes()...)
+	header, ok := ne.nextHeader()
+	if !ok {
+		return func() []byte { return []byte{} }
+	}
+	packet := make([]byte, ne.prefixLen, ne.prefixLen+naclCtrHeaderSize+len(plaintext)+secretbox.Overhead)
+	copy(packet, ne.buf[:ne.prefixLen])
+	packet = append(packet, header...)
+	key := ne.key
+	return func() []byte {
+		return secretbox.Seal(packet, plaintext, naclCtrNonce(header), key)
+	}
+}
+
+func (ne *NaClCtrEncryptor) PacketOverhead() int {
+	return ne.prefixLen + naclCtrHeaderSize + secretbox.Overhead + ne.NonEncryptor.PacketOverhead()
+}
+
+func (ne *NaClCtrEncryptor) TotalLen() int {
+	return ne.PacketOverhead() + ne.NonEncryptor.TotalLen()
+}
+
+// A new key starts the counter from zero.
+func (ne *NaClCtrEncryptor) Rekey(key *[32]byte) {
+	ne.counters.rekey(ne.df, key)
+	ne.sessionKey = key
+	ne.key = naclCtrKey(key, ne.conn.local.NameByte)
+}
+
+type NaClCtrDecryptor struct {
+	NonDecryptor
+	keys *KeyRing
+}
+
+// A key the decryptor accepts, and the highest counters it opened
+// packets with, without and with DF
+type naclCtrRemoteKey struct {
+	key     *[32]byte
+	highest [2]uint64
+	seen    [2]bool
+}
+
+func NewNaClCtrDecryptor(conn *LocalConnection) *NaClCtrDecryptor {
+	remoteName := conn.remote.NameByte
+	return &NaClCtrDecryptor{
+		NonDecryptor: *NewNonDecryptor(conn),
+		keys: NewKeyRing(conn.SessionKey, func(key *[32]byte) interface{} {
+			return &naclCtrRemoteKey{key: naclCtrKey(key, remoteName)}
+		})}
+}
+
+func (nd *NaClCtrDecryptor) AddKey(key *[32]byte) {
+	nd.keys.Add(key)
+}
+
+func (nd *NaClCtrDecryptor) ReceiveNonce(msg []byte) {
+	logCrypto.Warn("Received Nonce on NaCl counter channel. Ignoring.")
+}
+
+func (nd *NaClCtrDecryptor) IterateFrames(fun FrameConsumer, packet *UDPPacket) error {
+	buf, err := nd.decrypt(packet.Packet)
+	if err != nil {
+		return err
+	}
+	if buf, err = nd.conn.stripPadding(buf); err != nil {
+		return err
+	}
+	if buf, err = nd.conn.decompress(buf); err != nil {
+		return err
+	}
+	packet.Packet = buf
+	return nd.NonDecryptor.IterateFrames(fun, packet)
+}
+
+func (nd *NaClCtrDecryptor) decrypt(buf []byte) ([]byte, error) {
+	if len(buf) < naclCtrHeaderSize+secretbox.Overhead {
+		return nil, PacketDecodingError{Desc: fmt.Sprintf("too short for NaCl; got %d octets", len(buf))}
+	}
+	header := buf[:naclCtrHeaderSize]
+	df := int(header[0] & naclCtrDFFlag)
+	counter := binary.BigEndian.Uint64(header[1:])
+	nonce := naclCtrNonce(header)
+	var result []byte
+	stale := false
+	success := nd.keys.Try(func(key interface{}) bool {
+		remoteKey := key.(*naclCtrRemoteKey)
+		var ok bool
+		if result, ok = secretbox.Open(nil, buf[naclCtrHeaderSize:], nonce, remoteKey.key); !ok {
+			return false
+		}
+		if remoteKey.seen[df] && counter <= remoteKey.highest[df] {
+			stale = true
+		} else {
+			remoteKey.highest[df], remoteKey.seen[df] = counter, true
+		}
+		return true
+	})
+	switch {
+	case !success:
+		return nil, PacketDecodingError{Fatal: true, Desc: "decryption failed"}
+	case stale:
+		// A replay, or reordered by the network. Either way, drop it.
+		return nil, PacketDecodingError{Desc: fmt.Sprint("stale or replayed NaCl packet ", counter)}
+	}
+	return result, nil
+}
+
+const naclCtrTestVector = "1ce5d597109f8a8f43f6ee3215fa807c2e10a3c6e88dbc89f6f9f6de28869facc00a71b8611e582d2f29"
+
+// The key is derived as the sender's, and the header, as we'd send
+// it for a DF packet, makes the nonce.
+func naclCtrSelfTest() error {
+	key := naclCtrKey(selfTestKey, []byte("sender"))
+	header := []byte{naclCtrDFFlag, 0, 0, 0, 0, 0, 0, 0, 5}
+	sealed := secretbox.Seal(nil, selfTestPlaintext, naclCtrNonce(header), key)
+	opened, _ := secretbox.Open(nil, sealed, naclCtrNonce(header), key)
+	return checkVector(sealed, naclCtrTestVector, opened, selfTestPlaintext)
+}
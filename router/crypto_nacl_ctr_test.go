@@ -0,0 +1,166 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+)
+
+func newTestNaClCtrEncryptor(conn *LocalConnection, df bool) *NaClCtrEncryptor {
+	return NewNaClCtrEncryptor(conn.local.NameByte, conn, df)
+}
+
+func naclCtrPacket(enc Encryptor, conn *LocalConnection) []byte {
+	enc.AppendFrame(&ForwardedFrame{srcPeer: conn.local, dstPeer: conn.remote, frame: []byte("hello")})
+	return Concat(enc.Bytes()[NameSize:])
+}
+
+func naclCtrDecrypt(dec Decryptor, packet []byte) error {
+	return dec.IterateFrames(func(*LocalConnection, *net.UDPAddr, []byte, []byte, uint16, uint8, uint16, []byte) error {
+		return nil
+	}, &UDPPacket{Packet: packet})
+}
+
+func assertNonFatal(t *testing.T, err error, desc string) {
+	if pde, ok := err.(PacketDecodingError); !ok || pde.Fatal {
+		wt.Fatalf(t, "Expected non-fatal decoding error on %s, got %v", desc, err)
+	}
+}
+
+func assertFatal(t *testing.T, err error, desc string) {
+	if pde, ok := err.(PacketDecodingError); !ok || !pde.Fatal {
+		wt.Fatalf(t, "Expected fatal decoding error on %s, got %v", desc, err)
+	}
+}
+
+func TestNaClCtrRoundTrip(t *testing.T) {
+	conn1, conn2 := newTestGCMConnPair()
+	dec := NewNaClCtrDecryptor(conn2)
+	for _, df := range []bool{false, true} {
+		enc := newTestNaClCtrEncryptor(conn1, df)
+		var previous []byte
+		for i := 0; i < 3; i++ {
+			packet := naclCtrPacket(enc, conn1)
+			wt.AssertEqualInt(t, len(packet)+NameSize, enc.PacketOverhead()+enc.FrameOverhead()+len("hello"), "packet length")
+			wt.AssertNoErr(t, naclCtrDecrypt(dec, packet))
+			// replays, and packets the network reordered, are dropped
+			assertNonFatal(t, naclCtrDecrypt(dec, packet), "replay")
+			if previous != nil {
+				assertNonFatal(t, naclCtrDecrypt(dec, previous), "lower counter")
+			}
+			previous = packet
+		}
+	}
+}
+
+func TestNaClCtrWrongDirection(t *testing.T) {
+	conn1, _ := newTestGCMConnPair()
+	enc := newTestNaClCtrEncryptor(conn1, false)
+	// A decryptor for the wrong direction uses a different key
+	dec := NewNaClCtrDecryptor(conn1)
+	assertFatal(t, naclCtrDecrypt(dec, naclCtrPacket(enc, conn1)), "wrong direction")
+}
+
+// Forwarders restart, e.g. on falling back to TCP, with the same
+// session key; their encryptors must carry on from where the old ones
+// got to, rather than reuse nonces.
+func TestNaClCtrForwarderRestart(t *testing.T) {
+	conn1, conn2 := newTestGCMConnPair()
+	dec := NewNaClCtrDecryptor(conn2)
+	enc := newTestNaClCtrEncryptor(conn1, false)
+	sent := [][]byte{naclCtrPacket(enc, conn1), naclCtrPacket(enc, conn1)}
+	wt.AssertNoErr(t, naclCtrDecrypt(dec, sent[0]))
+
+	enc = newTestNaClCtrEncryptor(conn1, false)
+	packet := naclCtrPacket(enc, conn1)
+	for _, old := range sent {
+		if string(packet[:naclCtrHeaderSize]) == string(old[:naclCtrHeaderSize]) {
+			wt.Fatalf(t, "Restarted encryptor reused a nonce")
+		}
+	}
+	// the remote still takes what the old encryptor had in flight
+	wt.AssertNoErr(t, naclCtrDecrypt(dec, sent[1]))
+	wt.AssertNoErr(t, naclCtrDecrypt(dec, packet))
+}
+
+// Reconnecting brings a new session key, and a new connection with
+// counters from zero; packets from the old one mustn't open.
+func TestNaClCtrReconnect(t *testing.T) {
+	conn1, conn2 := newTestGCMConnPair()
+	old := naclCtrPacket(newTestNaClCtrEncryptor(conn1, false), conn1)
+
+	conn1, conn2 = newTestGCMConnPair()
+	conn1.SessionKey, conn2.SessionKey = &[32]byte{4, 5, 6}, &[32]byte{4, 5, 6}
+	dec := NewNaClCtrDecryptor(conn2)
+	packet := naclCtrPacket(newTestNaClCtrEncryptor(conn1, false), conn1)
+	wt.AssertEqualString(t, string(packet[:naclCtrHeaderSize]), string(old[:naclCtrHeaderSize]), "header")
+	assertFatal(t, naclCtrDecrypt(dec, old), "packet from old connection")
+	wt.AssertNoErr(t, naclCtrDecrypt(dec, packet))
+}
+
+func TestNaClCtrRekey(t *testing.T) {
+	conn1, conn2 := newTestGCMConnPair()
+	enc := newTestNaClCtrEncryptor(conn1, false)
+	dec := NewNaClCtrDecryptor(conn2)
+	wt.AssertNoErr(t, naclCtrDecrypt(dec, naclCtrPacket(enc, conn1)))
+	inFlight := naclCtrPacket(enc, conn1)
+
+	newKey := &[32]byte{4, 5, 6}
+	dec.AddKey(newKey)
+	enc.Rekey(newKey)
+	packet := naclCtrPacket(enc, conn1)
+	wt.AssertEqualInt(t, int(packet[naclCtrHeaderSize-1]), 0, "counter after rekey")
+	wt.AssertNoErr(t, naclCtrDecrypt(dec, packet))
+	// packets encrypted with the old key may still arrive
+	wt.AssertNoErr(t, naclCtrDecrypt(dec, inFlight))
+
+	// encryptors started since carry on with the new key
+	enc = newTestNaClCtrEncryptor(conn1, false)
+	wt.AssertNoErr(t, naclCtrDecrypt(dec, naclCtrPacket(enc, conn1)))
+}
+
+// Nearing the end of the counter we ask for a new key; reaching it, we
+// give up on the connection rather than wrap around.
+func TestNaClCtrOverflow(t *testing.T) {
+	conn1, _ := newTestGCMConnPair()
+	queries := make(chan *ConnectionInteraction, 4)
+	conn1.queryChan = queries
+	enc := newTestNaClCtrEncryptor(conn1, false)
+	conn1.naclCounters.rekeyAt, conn1.naclCounters.limit = 1, 3
+	expectQuery := func(code int) {
+		select {
+		case query := <-queries:
+			wt.AssertEqualInt(t, query.code, code, "query")
+		default:
+			wt.Fatalf(t, "Expected query %d", code)
+		}
+	}
+	expectNone := func() {
+		if len(queries) > 0 {
+			wt.Fatalf(t, "Unexpected query %d", (<-queries).code)
+		}
+	}
+
+	naclCtrPacket(enc, conn1)
+	expectNone()
+	naclCtrPacket(enc, conn1)
+	expectQuery(CRekeyNow)
+	naclCtrPacket(enc, conn1)
+	expectNone() // we asked already
+
+	enc.AppendFrame(&ForwardedFrame{srcPeer: conn1.local, dstPeer: conn1.remote, frame: []byte("hello")})
+	wt.AssertEqualInt(t, len(enc.Bytes()), 0, "packet length with the counter exhausted")
+	expectQuery(CShutdown)
+}
+
+func TestParseEncryptionSchemes(t *testing.T) {
+	names, err := ParseEncryptionSchemes("nacl-ctr, aes-gcm")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, names[0]+","+names[1], "nacl-ctr,aes-gcm", "schemes")
+	names, err = ParseEncryptionSchemes("")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(names), 0, "schemes")
+	if _, err = ParseEncryptionSchemes("aes-gcm,rot13"); err == nil {
+		wt.Fatalf(t, "Expected error for unknown scheme")
+	}
+}
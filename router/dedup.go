@@ -0,0 +1,80 @@
+package router
+
+import (
+	"sync"
+	"time"
+)
+
+// While the topology changes, peers may disagree about the broadcast
+// routes, and with redundant links a broadcast or multicast frame can
+// then reach us more than once, over different connections. So we
+// remember a hash of each such frame, together with the peer it
+// originates from, for a short while, and suppress any frame we have
+// seen recently. The cache is shared by all connections, since
+// duplicates usually arrive over different ones.
+//
+// Hashes live in two generations, which we rotate every DedupTTL, so
+// a hash is remembered for between one and two DedupTTLs, without
+// keeping a timestamp per frame. A generation filling up rotates it
+// early, bounding the memory we use.
+
+type DedupCache struct {
+	sync.Mutex
+	current  map[uint64]struct{}
+	previous map[uint64]struct{}
+	rotated  time.Time
+	ttl      time.Duration
+	now      func() time.Time
+}
+
+func NewDedupCache(ttl time.Duration) *DedupCache {
+	return &DedupCache{
+		current:  make(map[uint64]struct{}),
+		previous: make(map[uint64]struct{}),
+		rotated:  time.Now(),
+		ttl:      ttl,
+		now:      time.Now}
+}
+
+// Whether we have seen the frame from the peer recently, noting it if
+// not.
+func (cache *DedupCache) Seen(srcNameByte, frame []byte) bool {
+	return cache.check(fnv64Add(fnv64Add(fnv64Offset, srcNameByte), frame), true)
+}
+
+// Whether we noted the key recently, noting it if asked to.
+func (cache *DedupCache) check(key uint64, note bool) bool {
+	cache.Lock()
+	defer cache.Unlock()
+	if now := cache.now(); now.Sub(cache.rotated) >= cache.ttl || len(cache.current) >= DedupMaxEntries {
+		if now.Sub(cache.rotated) >= 2*cache.ttl {
+			cache.current = make(map[uint64]struct{})
+		}
+		cache.previous, cache.current = cache.current, make(map[uint64]struct{})
+		cache.rotated = now
+	}
+	if _, found := cache.current[key]; found {
+		return true
+	}
+	if _, found := cache.previous[key]; found {
+		return true
+	}
+	if note {
+		cache.current[key] = struct{}{}
+	}
+	return false
+}
+
+// 64-bit FNV-1a; collisions between frames would lose us one
+const (
+	fnv64Offset = 14695981039346656037
+	fnv64Prime  = 1099511628211
+)
+
+func fnv64Add(h uint64, data []byte) uint64 {
+	for _, b := range data {
+		h ^= uint64(b)
+		h *= fnv64Prime
+	}
+	return h
+}
@@ -0,0 +1,36 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"testing"
+	"time"
+)
+
+func TestDedupCache(t *testing.T) {
+	now := time.Now()
+	cache := NewDedupCache(DedupTTL)
+	cache.now = func() time.Time { return now }
+	src1, src2, frame := []byte{1}, []byte{2}, []byte("broadcast frame")
+
+	if cache.Seen(src1, frame) {
+		wt.Fatalf(t, "Expected new frame not to have been seen")
+	}
+	if !cache.Seen(src1, frame) {
+		wt.Fatalf(t, "Expected duplicate frame to have been seen")
+	}
+	if cache.Seen(src2, frame) {
+		wt.Fatalf(t, "Expected same frame from another peer not to have been seen")
+	}
+
+	// Remembered for at least DedupTTL, across a rotation
+	now = now.Add(DedupTTL * 3 / 4)
+	cache.Seen(src1, []byte("other frame"))
+	now = now.Add(DedupTTL / 2)
+	if !cache.Seen(src2, frame) {
+		wt.Fatalf(t, "Expected frame to be remembered after rotation")
+	}
+	now = now.Add(DedupTTL * 2)
+	if cache.Seen(src1, frame) {
+		wt.Fatalf(t, "Expected frame to be forgotten after two TTLs")
+	}
+}
@@ -0,0 +1,157 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Peers may be given by hostnames with both IPv6 and IPv4 addresses,
+// of which either family may not work from here. Rather than trying
+// the addresses one after the other, waiting for each to time out, we
+// race them, as in Happy Eyeballs (RFC 8305): we try the addresses in
+// turn, alternating between the families, starting with IPv6, and
+// start the next attempt each HappyEyeballsDelay, or as soon as an
+// attempt fails, while the earlier ones carry on. The first to
+// connect wins, and we close the others. The connection's remote
+// address, and thus the family that won, is what we gossip.
+
+type dialResult struct {
+	conn *net.TCPConn
+	err  error
+}
+
+// Connect to the peer at host:port, where host is an IP address or a
+// hostname, from the local address, if given, and thus only at
+// addresses of its family.
+func dialPeer(addrStr string, local *net.TCPAddr) (*net.TCPConn, error) {
+	host, portStr, err := net.SplitHostPort(addrStr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.LookupPort("tcp", portStr)
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if ips, err = net.LookupIP(host); err != nil {
+			return nil, err
+		}
+	}
+	var addrs []*net.TCPAddr
+	for _, ip := range sortDialIPs(ips) {
+		if local == nil || (local.IP.To4() == nil) == (ip.To4() == nil) {
+			addrs = append(addrs, &net.TCPAddr{IP: ip, Port: port})
+		}
+	}
+	return dialRace(addrs, local, HappyEyeballsDelay)
+}
+
+// Interleave the families, starting with IPv6, keeping the order of
+// the addresses within each.
+func sortDialIPs(ips []net.IP) []net.IP {
+	var ipv6, ipv4 []net.IP
+	for _, ip := range ips {
+		if ip.To4() == nil {
+			ipv6 = append(ipv6, ip)
+		} else {
+			ipv4 = append(ipv4, ip)
+		}
+	}
+	sorted := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(ipv6) || i < len(ipv4); i++ {
+		if i < len(ipv6) {
+			sorted = append(sorted, ipv6[i])
+		}
+		if i < len(ipv4) {
+			sorted = append(sorted, ipv4[i])
+		}
+	}
+	return sorted
+}
+
+func dialRace(addrs []*net.TCPAddr, local *net.TCPAddr, delay time.Duration) (*net.TCPConn, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses to connect to")
+	}
+	results := make(chan dialResult, len(addrs))
+	dial := func(addr *net.TCPAddr) {
+		conn, err := net.DialTCP("tcp", local, addr)
+		results <- dialResult{conn, err}
+	}
+	go dial(addrs[0])
+	next, pending := 1, 1
+	var err error
+	for pending > 0 {
+		var nextAttempt <-chan time.Time
+		if next < len(addrs) {
+			nextAttempt = time.After(delay)
+		}
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				go closeDialLosers(results, pending)
+				return result.conn, nil
+			}
+			err = result.err
+		case <-nextAttempt:
+		}
+		if next < len(addrs) {
+			go dial(addrs[next])
+			next++
+			pending++
+		}
+	}
+	return nil, err
+}
+
+func closeDialLosers(results <-chan dialResult, pending int) {
+	for ; pending > 0; pending-- {
+		if result := <-results; result.err == nil {
+			result.conn.Close()
+		}
+	}
+}
+
+// The family of the IP address in host:port, for reporting.
+func addressFamily(addrStr string) string {
+	host, _, err := net.SplitHostPort(addrStr)
+	if err != nil {
+		return ""
+	}
+	switch ip := net.ParseIP(host); {
+	case ip == nil:
+		return ""
+	case ip.To4() == nil:
+		return "ipv6"
+	default:
+		return "ipv4"
+	}
+}
+
+// Keep hostnames, so that each connection attempt picks from all their
+// current addresses, but check they resolve.
+func resolveHostPort(addrStr string) (string, error) {
+	host, portStr, err := net.SplitHostPort(addrStr)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		addr, err := net.ResolveTCPAddr("tcp", addrStr)
+		if err != nil {
+			return "", err
+		}
+		return addr.String(), nil
+	}
+	port, err := net.LookupPort("tcp", portStr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := net.LookupIP(host); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
@@ -0,0 +1,46 @@
+package router
+
+import (
+	"fmt"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSortDialIPs(t *testing.T) {
+	var ips []net.IP
+	for _, s := range []string{"10.0.0.1", "10.0.0.2", "fd00::1", "10.0.0.3", "fd00::2"} {
+		ips = append(ips, net.ParseIP(s))
+	}
+	var sorted []string
+	for _, ip := range sortDialIPs(ips) {
+		sorted = append(sorted, ip.String())
+	}
+	wt.AssertEqualString(t, fmt.Sprint(sorted), "[fd00::1 10.0.0.1 fd00::2 10.0.0.2 10.0.0.3]", "order")
+}
+
+func TestDialRace(t *testing.T) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	wt.AssertNoErr(t, err)
+	defer listener.Close()
+	closed, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	wt.AssertNoErr(t, err)
+	closed.Close()
+
+	// A refused attempt moves on to the next address straight away
+	conn, err := dialRace([]*net.TCPAddr{closed.Addr().(*net.TCPAddr), listener.Addr().(*net.TCPAddr)}, nil, time.Minute)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, conn.RemoteAddr().String(), listener.Addr().String(), "winner")
+	conn.Close()
+
+	if _, err := dialRace([]*net.TCPAddr{closed.Addr().(*net.TCPAddr)}, nil, time.Minute); err == nil {
+		wt.Fatalf(t, "Expected dialing a closed port to fail")
+	}
+}
+
+func TestAddressFamily(t *testing.T) {
+	wt.AssertEqualString(t, addressFamily("10.0.0.1:6783"), "ipv4", "IPv4")
+	wt.AssertEqualString(t, addressFamily("[fd00::1]:6783"), "ipv6", "IPv6")
+	wt.AssertEqualString(t, addressFamily("example.com:6783"), "", "hostname")
+}
@@ -0,0 +1,102 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logging of dropped frames, sampled so that a steady stream of drops,
+// e.g. of frames too big for a misconfigured MTU, doesn't flood the
+// logs. We log the first DropLogBurst drops in each DropLogInterval,
+// and at the end of the interval one summary of the rest: how many
+// there were, the largest frame, and the flows they were part of. The
+// metrics count every drop.
+
+type DropLog struct {
+	sync.Mutex
+	what       string // e.g. "too big frames"
+	logger     Logger // of the latest drop, for the summary
+	windowEnd  time.Time
+	logged     int
+	suppressed int
+	maxLen     int
+	flows      map[string]bool
+	moreFlows  int // suppressed drops of flows beyond DropLogFlows
+}
+
+func NewDropLog(what string) *DropLog {
+	return &DropLog{what: what, flows: make(map[string]bool)}
+}
+
+// Log the drop of the frame with the message made of the arguments, or
+// count it towards the summary.
+func (dl *DropLog) Drop(logger Logger, frame []byte, args ...interface{}) {
+	dl.Lock()
+	defer dl.Unlock()
+	dl.logger = logger
+	now := time.Now()
+	if now.After(dl.windowEnd) {
+		dl.windowEnd = now.Add(DropLogInterval)
+		dl.logged = 0
+	}
+	if dl.logged < DropLogBurst {
+		dl.logged++
+		logger.Warn(args...)
+		return
+	}
+	if dl.suppressed == 0 {
+		time.AfterFunc(dl.windowEnd.Sub(now), dl.summarise)
+	}
+	dl.suppressed++
+	if len(frame) > dl.maxLen {
+		dl.maxLen = len(frame)
+	}
+	if flow := frameFlow(frame); dl.flows[flow] || len(dl.flows) < DropLogFlows {
+		dl.flows[flow] = true
+	} else {
+		dl.moreFlows++
+	}
+}
+
+func (dl *DropLog) summarise() {
+	dl.Lock()
+	defer dl.Unlock()
+	if dl.suppressed == 0 {
+		return
+	}
+	flows := make([]string, 0, len(dl.flows))
+	for flow := range dl.flows {
+		flows = append(flows, flow)
+	}
+	summary := fmt.Sprintf("flows %s", strings.Join(flows, ", "))
+	if dl.moreFlows > 0 {
+		summary += fmt.Sprintf(" and %d drops of other flows", dl.moreFlows)
+	}
+	dl.logger.Warn("Dropped", dl.suppressed, "more", dl.what, "in the last", DropLogInterval,
+		"without logging them; largest", dl.maxLen, "bytes;", summary)
+	dl.suppressed, dl.maxLen, dl.moreFlows = 0, 0, 0
+	dl.flows = make(map[string]bool)
+}
+
+// The flow the frame is part of, as its source and destination IP
+// addresses, or MAC addresses if it isn't IP.
+func frameFlow(frame []byte) string {
+	if len(frame) < EthernetOverhead {
+		return "runt"
+	}
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case 0x0800:
+		if len(frame) >= EthernetOverhead+20 {
+			return fmt.Sprint(net.IP(frame[26:30]), "->", net.IP(frame[30:34]))
+		}
+	case 0x86dd:
+		if len(frame) >= EthernetOverhead+40 {
+			return fmt.Sprint(net.IP(frame[22:38]), "->", net.IP(frame[38:54]))
+		}
+	}
+	return fmt.Sprint(net.HardwareAddr(frame[6:12]), "->", net.HardwareAddr(frame[0:6]))
+}
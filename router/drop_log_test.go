@@ -0,0 +1,42 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	wt "github.com/zettio/weave/testing"
+	"strings"
+	"testing"
+)
+
+func ipv4Frame(src, dst byte, size int) []byte {
+	frame := make([]byte, size)
+	frame[12], frame[13] = 0x08, 0x00
+	copy(frame[26:30], []byte{10, 0, 0, src})
+	copy(frame[30:34], []byte{10, 0, 0, dst})
+	return frame
+}
+
+func TestDropLog(t *testing.T) {
+	defer resetLogLevels()
+	var buf bytes.Buffer
+	logConfig.out = &buf
+	SetLogJSON(true)
+
+	dl := NewDropLog("too big frames")
+	for i := 0; i < DropLogBurst+3; i++ {
+		dl.Drop(logForwarder, ipv4Frame(1, byte(2+i%2), 1500+i), "Dropping too big frame")
+	}
+	dl.summarise()
+	// Nothing more to summarise
+	dl.summarise()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	wt.AssertEqualInt(t, len(lines), DropLogBurst+1, "log lines")
+	var summary map[string]string
+	wt.AssertNoErr(t, json.Unmarshal([]byte(lines[DropLogBurst]), &summary))
+	for _, part := range []string{"Dropped 3 more too big frames", "largest 1507 bytes", "10.0.0.1->10.0.0.2", "10.0.0.1->10.0.0.3"} {
+		if !strings.Contains(summary["msg"], part) {
+			wt.Fatalf(t, "Expected %q in the summary %q", part, summary["msg"])
+		}
+	}
+}
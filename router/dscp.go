@@ -0,0 +1,122 @@
+package router
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Marking of the UDP packets we send peers with a DSCP, so that the
+// underlay network can apply QoS to overlay traffic. The sockets we
+// send on are marked with the DSCP of the default traffic class;
+// packets carrying frames of a class marked differently get theirs
+// with a control message. Several frames travel in a packet, which is
+// marked for the most urgent of them.
+
+type DSCPMarking [NumTrafficClasses]int
+
+// Parse a DSCP for all classes, e.g. "46", or a comma-separated list
+// of DSCPs for particular ones, e.g. "interactive=46,bulk=8". Classes
+// not mentioned aren't marked, i.e. have DSCP 0.
+func ParseDSCPMarking(s string) (DSCPMarking, error) {
+	var marking DSCPMarking
+	if s == "" {
+		return marking, nil
+	}
+	parseDSCP := func(value string) (int, error) {
+		dscp, err := strconv.Atoi(value)
+		if err != nil || dscp < 0 || dscp > 63 {
+			return 0, fmt.Errorf("Invalid DSCP %q: must be 0 to 63", value)
+		}
+		return dscp, nil
+	}
+	if !strings.Contains(s, "=") {
+		dscp, err := parseDSCP(s)
+		for class := range marking {
+			marking[class] = dscp
+		}
+		return marking, err
+	}
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			return marking, fmt.Errorf("Invalid DSCP marking %q: expected <class>=<dscp>", item)
+		}
+		class := TrafficClass(-1)
+		for c, name := range trafficClassNames {
+			if name == parts[0] {
+				class = TrafficClass(c)
+			}
+		}
+		if class < 0 {
+			return marking, fmt.Errorf("Unknown traffic class %q: expected one of %s", parts[0], strings.Join(trafficClassNames, ", "))
+		}
+		dscp, err := parseDSCP(parts[1])
+		if err != nil {
+			return marking, err
+		}
+		marking[class] = dscp
+	}
+	return marking, nil
+}
+
+func (marking DSCPMarking) Empty() bool {
+	return marking == DSCPMarking{}
+}
+
+func (marking DSCPMarking) String() string {
+	items := make([]string, len(marking))
+	for class, dscp := range marking {
+		items[class] = fmt.Sprintf("%s=%d", TrafficClass(class), dscp)
+	}
+	return strings.Join(items, ",")
+}
+
+// The TOS to mark sockets with, i.e. the DSCP in the upper six bits
+func (marking DSCPMarking) socketTOS() int {
+	return marking[ClassDefault] << 2
+}
+
+// The TOS to mark a packet of the class with, or -1 to leave it as
+// the socket's.
+func (marking DSCPMarking) packetTOS(class TrafficClass) int {
+	if marking[class] == marking[ClassDefault] {
+		return -1
+	}
+	return marking[class] << 2
+}
+
+// Senders which can mark the packets they send with a TOS other than
+// their socket's
+type TOSMarker interface {
+	SetTOS(tos int)
+}
+
+// Mark the packets the sender sends from now on for the class, and,
+// with ecn, as ECN capable
+func (fwd *Forwarder) mark(sender interface{}, class TrafficClass, ecn bool) {
+	if marker, ok := sender.(TOSMarker); ok {
+		marker.SetTOS(fwd.packetTOS(class, ecn))
+	}
+}
+
+// Set the TOS of the packets sent on the socket. Dual-stack sockets
+// need both the IPv6 and the IPv4 option set.
+func setTOS(fd int, tos int) error {
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return err
+	}
+	if _, ok := sa.(*syscall.SockaddrInet6); !ok {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos); err != nil {
+		return err
+	}
+	// raw IPv6 sockets don't do IPv4 at all, and say so
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, tos); err != nil && err != syscall.ENOPROTOOPT {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseDSCPMarking(t *testing.T) {
+	marking, err := ParseDSCPMarking("46")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, marking.String(), "interactive=46,default=46,bulk=46", "marking")
+	wt.AssertEqualInt(t, marking.packetTOS(ClassBulk), -1, "TOS of bulk packets")
+
+	marking, err = ParseDSCPMarking("interactive=46, bulk=8")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, marking.String(), "interactive=46,default=0,bulk=8", "marking")
+	wt.AssertEqualInt(t, marking.socketTOS(), 0, "TOS of the socket")
+	wt.AssertEqualInt(t, marking.packetTOS(ClassInteractive), 46<<2, "TOS of interactive packets")
+	wt.AssertEqualInt(t, marking.packetTOS(ClassDefault), -1, "TOS of default packets")
+
+	marking, err = ParseDSCPMarking("")
+	wt.AssertNoErr(t, err)
+	if !marking.Empty() {
+		wt.Fatalf(t, "Expected no marking")
+	}
+	for _, invalid := range []string{"64", "-1", "ef", "video=34", "bulk"} {
+		if _, err := ParseDSCPMarking(invalid); err == nil {
+			wt.Fatalf(t, "Expected an error parsing %q", invalid)
+		}
+	}
+}
+
+// Packets marked in a batch arrive with their TOS, and the others
+// with the socket's
+func TestMMsgBatchTOS(t *testing.T) {
+	recvConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	wt.AssertNoErr(t, err)
+	defer recvConn.Close()
+	recvFile, err := recvConn.File()
+	wt.AssertNoErr(t, err)
+	defer recvFile.Close()
+	wt.AssertNoErr(t, syscall.SetsockoptInt(int(recvFile.Fd()), syscall.IPPROTO_IP, syscall.IP_RECVTOS, 1))
+	sendConn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	wt.AssertNoErr(t, err)
+	defer sendConn.Close()
+	wt.AssertNoErr(t, controlSocket(sendConn, func(fd int) error { return setTOS(fd, 8<<2) }))
+
+	batch, err := newSocketBatch(sendConn, 4)
+	wt.AssertNoErr(t, err)
+	dst := recvConn.LocalAddr().(*net.UDPAddr)
+	batch.Append([]byte("unmarked"), dst)
+	batch.SetTOS(46 << 2)
+	batch.Append([]byte("marked"), dst)
+	batch.Append([]byte("marked"), dst)
+	wt.AssertNoErr(t, batch.Send())
+
+	buf, oob := make([]byte, 100), make([]byte, 100)
+	recvConn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	for _, expected := range []int{8 << 2, 46 << 2, 46 << 2} {
+		_, oobn, _, _, err := recvConn.ReadMsgUDP(buf, oob)
+		wt.AssertNoErr(t, err)
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		wt.AssertNoErr(t, err)
+		if len(msgs) != 1 || msgs[0].Header.Type != syscall.IP_TOS || len(msgs[0].Data) < 1 {
+			wt.Fatalf(t, "Expected an IP_TOS control message, got %v", msgs)
+		}
+		wt.AssertEqualInt(t, int(msgs[0].Data[0]), expected, "TOS")
+	}
+}
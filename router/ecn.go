@@ -0,0 +1,182 @@
+package router
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Explicit congestion notification on the underlay. On connections
+// where both sides do ECN, the UDP packets we send are marked ECT(0),
+// so that routers short of buffer space can mark them congestion
+// experienced (CE) rather than drop them. The remote counts the marks
+// on the packets it receives and reports them to us, at most once per
+// ECNFeedbackDelay. On a report we slow the connection down to
+// ECNBackoff of the rate we were sending at, at most once per
+// ECNHoldoff, and then speed it up again in ECNRecoverySteps, one per
+// ECNRecoveryTick without further reports, until it is back to
+// its rate limit, or the rate it backed off from when it has none.
+// That way the overlay backs off before the underlay starts dropping.
+
+const (
+	ecnMask = 0x03
+	ecnECT0 = 0x02
+	ecnCE   = 0x03
+)
+
+type congestionControl struct {
+	sync.Mutex
+	bucket     *TokenBucket
+	ceiling    int64 // the connection's rate limit; 0 if none
+	target     int64 // the rate to recover to
+	backedOff  time.Time
+	recovering bool
+	backoffs   *uint64 // counted atomically in the connection's stats
+}
+
+func newCongestionControl(bucket *TokenBucket, ceiling int64, backoffs *uint64) *congestionControl {
+	return &congestionControl{bucket: bucket, ceiling: ceiling, target: ceiling, backoffs: backoffs}
+}
+
+// The remote reported congestion marks. Returns whether we slowed
+// down.
+func (cc *congestionControl) marked(now time.Time) bool {
+	cc.Lock()
+	defer cc.Unlock()
+	if now.Sub(cc.backedOff) < ECNHoldoff {
+		return false
+	}
+	current := cc.bucket.Rate()
+	if measured := cc.bucket.Measured(); current == 0 || measured > 0 && measured < current {
+		current = measured
+	}
+	if !cc.recovering && cc.ceiling == 0 {
+		cc.target = current
+	}
+	rate := int64(float64(current) * ECNBackoff)
+	if rate < ECNMinRate {
+		rate = ECNMinRate
+	}
+	cc.bucket.SetRate(rate)
+	cc.backedOff = now
+	atomic.AddUint64(cc.backoffs, 1)
+	if !cc.recovering {
+		cc.recovering = true
+		time.AfterFunc(ECNRecoveryTick, cc.recover)
+	}
+	return true
+}
+
+func (cc *congestionControl) recover() {
+	if cc.step(time.Now()) {
+		time.AfterFunc(ECNRecoveryTick, cc.recover)
+	}
+}
+
+// Speed up again, unless we slowed down since the last step. Returns
+// whether we have further to go.
+func (cc *congestionControl) step(now time.Time) bool {
+	cc.Lock()
+	defer cc.Unlock()
+	if now.Sub(cc.backedOff) < ECNRecoveryTick {
+		return true
+	}
+	increase := cc.target / ECNRecoverySteps
+	if increase < ECNMinRate {
+		increase = ECNMinRate
+	}
+	if rate := cc.bucket.Rate() + increase; rate < cc.target {
+		cc.bucket.SetRate(rate)
+		return true
+	}
+	cc.bucket.SetRate(cc.ceiling)
+	cc.recovering = false
+	return false
+}
+
+// The TOS of the packets sent on a connection: ECN capable where both
+// sides do ECN, with the DSCP of the class, or -1 to leave the socket's.
+func (fwd *Forwarder) packetTOS(class TrafficClass, ecn bool) int {
+	tos := fwd.conn.Router.DSCP.packetTOS(class)
+	if !ecn {
+		return tos
+	}
+	if tos < 0 {
+		tos = fwd.conn.Router.DSCP.socketTOS()
+	}
+	return tos | ecnECT0
+}
+
+// Ask for the TOS of the packets we receive on the socket. Dual-stack
+// sockets need both the IPv6 and the IPv4 option set.
+func setRecvTOS(fd int) error {
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return err
+	}
+	if _, ok := sa.(*syscall.SockaddrInet6); !ok {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_RECVTOS, 1)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_RECVTCLASS, 1); err != nil {
+		return err
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_RECVTOS, 1)
+}
+
+// Whether the control messages received with a packet say it was
+// marked congestion experienced.
+func congestionExperienced(oob []byte) bool {
+	for len(oob) >= syscall.CmsgLen(0) {
+		cmsg := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		cmsgLen := int(cmsg.Len)
+		if cmsgLen < syscall.CmsgLen(0) || cmsgLen > len(oob) {
+			return false
+		}
+		data := oob[syscall.CmsgLen(0):cmsgLen]
+		switch {
+		case cmsg.Level == syscall.IPPROTO_IP && cmsg.Type == syscall.IP_TOS && len(data) >= 1:
+			return data[0]&ecnMask == ecnCE
+		case cmsg.Level == syscall.IPPROTO_IPV6 && cmsg.Type == syscall.IPV6_TCLASS && len(data) >= 4:
+			return *(*int32)(unsafe.Pointer(&data[0]))&ecnMask == ecnCE
+		}
+		if space := syscall.CmsgSpace(cmsgLen - syscall.CmsgLen(0)); space < len(oob) {
+			oob = oob[space:]
+		} else {
+			return false
+		}
+	}
+	return false
+}
+
+// A packet from the remote arrived marked congestion experienced.
+// Reports to the remote are held back for a while, to gather the
+// marks on the packets that follow.
+func (conn *LocalConnection) congestionMarked() {
+	atomic.AddUint64(&conn.stats.CongestionMarks, 1)
+	if atomic.AddUint32(&conn.ecnUnreported, 1) == 1 {
+		time.AfterFunc(ECNFeedbackDelay, conn.reportCongestion)
+	}
+}
+
+func (conn *LocalConnection) reportCongestion() {
+	count := make([]byte, 4)
+	binary.BigEndian.PutUint32(count, atomic.SwapUint32(&conn.ecnUnreported, 0))
+	conn.SendProtocolMsg(ProtocolMsg{ProtocolCongestion, count})
+}
+
+// The remote reported congestion marks on the packets we sent it
+func (conn *LocalConnection) receivedCongestion(payload []byte) {
+	conn.RLock()
+	cc := conn.congestion
+	conn.RUnlock()
+	if cc == nil || len(payload) < 4 {
+		return
+	}
+	if cc.marked(time.Now()) {
+		conn.logger(logForwarder).Debug("Slowing down to", cc.bucket.Rate(), "bytes/s after",
+			binary.BigEndian.Uint32(payload), "congestion marks")
+	}
+}
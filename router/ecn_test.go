@@ -0,0 +1,83 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCongestionControl(t *testing.T) {
+	var backoffs uint64
+	bucket := NewTokenBucket(0)
+	cc := newCongestionControl(bucket, 0, &backoffs)
+	for i := 0; i < 1000; i++ {
+		if !bucket.Take(1000) {
+			wt.Fatalf(t, "Expected an unlimited bucket to allow everything")
+		}
+	}
+	bucket.measured = 10000000
+	now := time.Now()
+
+	if !cc.marked(now) {
+		wt.Fatalf(t, "Expected to slow down")
+	}
+	wt.AssertEqualInt(t, int(bucket.Rate()), 7000000, "rate after backing off")
+	// Reports soon after don't slow us down further
+	if cc.marked(now.Add(ECNHoldoff / 2)) {
+		wt.Fatalf(t, "Expected not to slow down again so soon")
+	}
+	cc.marked(now.Add(ECNHoldoff))
+	wt.AssertEqualInt(t, int(bucket.Rate()), 4900000, "rate after backing off again")
+	wt.AssertEqualuint64(t, backoffs, 2, "backoffs")
+
+	// Recover step by step to where we were, and then lift the limit
+	now = now.Add(ECNHoldoff)
+	for steps := 1; ; steps++ {
+		now = now.Add(ECNRecoveryTick)
+		if !cc.step(now) {
+			wt.AssertEqualInt(t, steps, 6, "steps to recover")
+			break
+		}
+	}
+	wt.AssertEqualInt(t, int(bucket.Rate()), 0, "rate after recovering")
+
+	// With a rate limit, we recover to that
+	bucket = NewTokenBucket(5000000)
+	cc = newCongestionControl(bucket, 5000000, &backoffs)
+	cc.marked(now)
+	wt.AssertEqualInt(t, int(bucket.Rate()), 3500000, "rate after backing off from the limit")
+	for cc.step(now.Add(ECNRecoveryTick)) {
+		now = now.Add(ECNRecoveryTick)
+	}
+	wt.AssertEqualInt(t, int(bucket.Rate()), 5000000, "rate after recovering")
+}
+
+func TestCongestionExperienced(t *testing.T) {
+	recvConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	wt.AssertNoErr(t, err)
+	defer recvConn.Close()
+	recvFile, err := recvConn.File()
+	wt.AssertNoErr(t, err)
+	defer recvFile.Close()
+	wt.AssertNoErr(t, setRecvTOS(int(recvFile.Fd())))
+	sendConn, err := net.DialUDP("udp", nil, recvConn.LocalAddr().(*net.UDPAddr))
+	wt.AssertNoErr(t, err)
+	defer sendConn.Close()
+	sendFile, err := sendConn.File()
+	wt.AssertNoErr(t, err)
+	defer sendFile.Close()
+
+	buf, oob := make([]byte, 100), make([]byte, 100)
+	recvConn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	for _, tos := range []int{ecnECT0, 46<<2 | ecnCE} {
+		wt.AssertNoErr(t, setTOS(int(sendFile.Fd()), tos))
+		_, err := sendConn.Write([]byte("packet"))
+		wt.AssertNoErr(t, err)
+		_, oobn, _, _, err := recvConn.ReadMsgUDP(buf, oob)
+		wt.AssertNoErr(t, err)
+		if congestionExperienced(oob[:oobn]) != (tos&ecnMask == ecnCE) {
+			wt.Fatalf(t, "Expected congestion experienced to be %v for TOS %d", tos&ecnMask == ecnCE, tos)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package router
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// Between unencrypted peers which both have it enabled, frames can
+// travel in a standard encapsulation, VXLAN (see vxlan.go) or Geneve
+// (see geneve.go), to the port for it on the remote rather than our
+// own, so that tools such as Wireshark can decode them as they are,
+// and other SDN systems can make sense of them. Each network has a VNI
+// of its own: the default network has the configured one, and a
+// tenant's is that plus its ID.
+//
+// The frames which can't go in the encapsulation, and the heartbeats
+// and probes we exchange with the remote, are still in our own format,
+// on our own port, and the control plane stays our gossip. All peers
+// need the same encapsulation, port and VNI, and have to reach each
+// other's port for it directly; connections falling back to TCP don't
+// use it.
+
+type Encapsulation int
+
+const (
+	EncapWeave Encapsulation = iota
+	EncapVXLAN
+	EncapGeneve
+)
+
+var encapsulationNames = map[Encapsulation]string{
+	EncapWeave:  "weave",
+	EncapVXLAN:  "vxlan",
+	EncapGeneve: "geneve"}
+
+func ParseEncapsulation(name string) (Encapsulation, error) {
+	for encap, encapName := range encapsulationNames {
+		if encapName == name {
+			return encap, nil
+		}
+	}
+	return EncapWeave, fmt.Errorf("Unknown encapsulation: %s", name)
+}
+
+func (encap Encapsulation) String() string {
+	return encapsulationNames[encap]
+}
+
+// The standard port of the encapsulation.
+func (encap Encapsulation) Port() int {
+	switch encap {
+	case EncapVXLAN:
+		return VXLANPort
+	case EncapGeneve:
+		return GenevePort
+	}
+	return Port
+}
+
+const MaxVNI = 1<<24 - 1
+
+func (router *Router) tenantVNI(tenant uint16) uint32 {
+	return router.VNI + uint32(tenant)
+}
+
+// The tenant a VNI belongs to, if any.
+func (router *Router) vniTenant(vni uint32) (uint16, bool) {
+	if vni < router.VNI || vni-router.VNI > 0xffff {
+		return 0, false
+	}
+	return uint16(vni - router.VNI), true
+}
+
+// Sends packets from our encapsulation port to the remote's.
+type EncapSender struct {
+	conn  *LocalConnection
+	addr  *net.UDPAddr
+	batch *MMsgBatch
+}
+
+func NewEncapSender(conn *LocalConnection) (*EncapSender, error) {
+	batch, err := newSocketBatch(conn.Router.EncapListener, conn.Router.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	return &EncapSender{
+		conn:  conn,
+		batch: batch}, nil
+}
+
+func (sender *EncapSender) Send(msg []byte) error {
+	remote := sender.conn.RemoteUDPAddr()
+	if remote == nil {
+		return nil
+	}
+	if sender.addr == nil || !sender.addr.IP.Equal(remote.IP) {
+		sender.addr = &net.UDPAddr{IP: remote.IP, Port: sender.conn.Router.EncapPort, Zone: remote.Zone}
+	}
+	return sendBatched(sender.batch, msg, sender.addr)
+}
+
+func (sender *EncapSender) SetTOS(tos int) {
+	sender.batch.SetTOS(tos)
+}
+
+func (sender *EncapSender) Flush() error {
+	return flushBatch(sender.batch)
+}
+
+// NB: this socket is shared by all connections
+func (sender *EncapSender) GrowSendBuffer(max int) (int, bool, error) {
+	return growSendBuffer(sender.conn.Router.EncapListener, max)
+}
+
+// The socket is shared, so there's nothing for us to close
+func (sender *EncapSender) Shutdown() error {
+	return nil
+}
+
+// Send a frame on its own, in the connection's encapsulation. Returns
+// false, having sent nothing, if the frame doesn't fit.
+func (fwd *Forwarder) sendEncapsulated(frame *ForwardedFrame) bool {
+	frameLen := len(frame.frame)
+	vni := fwd.conn.Router.tenantVNI(frame.tenant)
+	var headerLen int
+	switch fwd.conn.encap {
+	case EncapVXLAN:
+		headerLen = putVXLANHeader(fwd.encapBuf, vni)
+	case EncapGeneve:
+		var dstName []byte
+		if frame.dstPeer != fwd.conn.remote {
+			dstName = frame.dstPeer.NameByte
+		}
+		headerLen = putGeneveHeader(fwd.encapBuf, vni, frame.srcPeer.NameByte, dstName, frame.tenant)
+	}
+	if headerLen+frameLen > fwd.maxPayload {
+		return false
+	}
+	packet := fwd.encapBuf[:headerLen+frameLen]
+	copy(packet[headerLen:], frame.frame)
+	frame.buf.Release()
+	atomic.AddUint64(&fwd.conn.stats.FramesForwarded, 1)
+	atomic.AddUint64(&fwd.conn.stats.BytesForwarded, uint64(frameLen))
+	if fwd.rateLimiter != nil && !fwd.rateLimiter.Take(len(packet)) {
+		atomic.AddUint64(&fwd.conn.stats.RateLimitDrops, 1)
+		return true
+	}
+	fwd.pace()
+	atomic.AddUint64(&fwd.conn.stats.PacketsSent, 1)
+	atomic.AddUint64(&fwd.conn.stats.BytesSent, uint64(len(packet)))
+	atomic.AddUint64(&fwd.conn.stats.Overhead, uint64(headerLen))
+	if remote := fwd.conn.RemoteUDPAddr(); remote != nil && !fwd.taps.Empty() {
+		fwd.taps.Packet(fwd.conn, true, fwd.conn.Router.EncapPort,
+			&net.UDPAddr{IP: remote.IP, Port: fwd.conn.Router.EncapPort, Zone: remote.Zone}, packet)
+	}
+	// The remote doesn't look for congestion marks on VXLAN or Geneve
+	fwd.mark(fwd.encap, frame.class, false)
+	fwd.handleSendError(fwd.encap.Send(packet))
+	return true
+}
+
+func (router *Router) listenEncap(localPort int, po PacketSink) *net.UDPConn {
+	localAddr, err := net.ResolveUDPAddr("udp", router.listenAddr(localPort))
+	checkFatal(err)
+	conn, err := net.ListenUDP("udp", localAddr)
+	checkFatal(err)
+	tuning := router.CurrentTuning()
+	checkFatal(controlSocket(conn, func(fd int) error {
+		// As with our own port, we rely on the stack to fragment
+		if err := setPMTUDiscovery(fd, false); err != nil {
+			return err
+		}
+		if err := setTOS(fd, router.DSCP.socketTOS()); err != nil {
+			return err
+		}
+		return setSocketBuffers(fd, tuning.SndBuf, tuning.RcvBuf)
+	}))
+	go router.encapReader(conn, po)
+	return conn
+}
+
+func (router *Router) encapReader(conn *net.UDPConn, po PacketSink) {
+	defer conn.Close()
+	dec := NewEthernetDecoder()
+	handleUDPPacket := router.handleUDPPacketFunc(dec, po)
+	conns := make(map[string]*LocalConnection) // by the remote's IP
+	for {
+		fb := NewFrameBuffer()
+		err := router.readEncapPacket(conn, fb, dec, conns, handleUDPPacket)
+		fb.Release()
+		if err == io.EOF {
+			return
+		}
+	}
+}
+
+// Read an encapsulated packet into the buffer, and hand its frame to
+// the connection to the peer it came from, as if the peer had sent it
+// to us in our own format.
+func (router *Router) readEncapPacket(conn *net.UDPConn, fb *FrameBuffer, dec *EthernetDecoder, conns map[string]*LocalConnection, handleUDPPacket FrameConsumer) error {
+	buf := fb.Bytes()
+	n, sender, err := conn.ReadFromUDP(buf)
+	if err == io.EOF {
+		return err
+	} else if err != nil {
+		logForwarder.Warn("ignoring", router.Encap, "read error", err)
+		return nil
+	}
+	relayConn := router.encapConnection(sender.IP, conns)
+	if relayConn == nil {
+		return nil
+	}
+	router.Taps.Packet(relayConn, false, router.EncapPort, sender, buf[:n])
+	// Unless the packet says otherwise, it's from the remote, for us
+	srcName, dstName := relayConn.remote.NameByte, relayConn.local.NameByte
+	var (
+		vni       uint32
+		frame     []byte
+		ok        bool
+		tenant    uint16
+		hasTenant bool
+	)
+	switch router.Encap {
+	case EncapVXLAN:
+		vni, frame, ok = parseVXLANHeader(buf[:n])
+	case EncapGeneve:
+		var gf geneveFrame
+		gf, ok = parseGeneveHeader(buf[:n])
+		vni, frame, tenant, hasTenant = gf.vni, gf.frame, gf.tenant, gf.hasTenant
+		if gf.srcName != nil {
+			srcName = gf.srcName
+		}
+		if gf.dstName != nil {
+			dstName = gf.dstName
+		}
+	}
+	if !ok || len(frame) > 0xffff {
+		return nil
+	}
+	if !hasTenant {
+		if tenant, ok = router.vniTenant(vni); !ok {
+			return nil
+		}
+	}
+	dec.buf = fb
+	defer func() { dec.buf = nil }()
+	checkWarn(handleUDPPacket(relayConn, sender, srcName, dstName, tenant, 0, uint16(len(frame)), frame))
+	return nil
+}
+
+// The connection using our encapsulation to the peer at the IP, if
+// there is one. We remember the connections we found, as long as they
+// stay the current ones to their peers.
+func (router *Router) encapConnection(ip net.IP, conns map[string]*LocalConnection) *LocalConnection {
+	key := string(ip.To16())
+	if conn, found := conns[key]; found {
+		if current, found := router.Ourself.ConnectionTo(conn.remote.Name); found && current == Connection(conn) {
+			return conn
+		}
+		delete(conns, key)
+	}
+	var found *LocalConnection
+	router.Ourself.ForEachConnection(func(_ PeerName, conn Connection) {
+		localConn, ok := conn.(*LocalConnection)
+		if !ok || localConn.encap == EncapWeave || localConn.UsingTCPFallback() {
+			return
+		}
+		if remote := localConn.RemoteUDPAddr(); remote != nil && remote.IP.Equal(ip) {
+			found = localConn
+		}
+	})
+	if found != nil {
+		conns[key] = found
+	}
+	return found
+}
@@ -0,0 +1,110 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"testing"
+)
+
+func TestVXLANHeader(t *testing.T) {
+	packet := make([]byte, VXLANHeaderSize+1)
+	wt.AssertEqualInt(t, putVXLANHeader(packet, 0xabcdef), VXLANHeaderSize, "header length")
+	// As RFC 7348 has it: flags, 24 reserved bits, VNI, 8 reserved bits
+	wt.AssertEqualString(t, string(packet[:VXLANHeaderSize]), "\x08\x00\x00\x00\xab\xcd\xef\x00", "header")
+	vni, frame, ok := parseVXLANHeader(packet)
+	if !ok {
+		wt.Fatalf(t, "Expected a valid VNI")
+	}
+	wt.AssertEqualInt(t, int(vni), 0xabcdef, "VNI")
+	wt.AssertEqualInt(t, len(frame), 1, "frame length")
+
+	packet[0] = 0
+	if _, _, ok := parseVXLANHeader(packet); ok {
+		wt.Fatalf(t, "Expected no VNI without the flag")
+	}
+	if _, _, ok := parseVXLANHeader(packet[:4]); ok {
+		wt.Fatalf(t, "Expected no VNI in a short packet")
+	}
+}
+
+func TestGeneveHeader(t *testing.T) {
+	src, _ := PeerNameFromString("01:00:00:01:00:00")
+	dst, _ := PeerNameFromString("02:00:00:01:00:00")
+	srcName, dstName := src.Bin(), dst.Bin()
+	packet := make([]byte, GeneveMaxOverhead+3)
+
+	// Frames for the remote's own hosts leave out the destination
+	n := putGeneveHeader(packet, 0xabcdef, srcName, nil, 258)
+	wt.AssertEqualInt(t, n, GeneveHeaderSize+12+8, "header length")
+	// Version 0 and options length, flags, protocol, VNI, reserved
+	wt.AssertEqualString(t, string(packet[:GeneveHeaderSize]), "\x05\x00\x65\x58\xab\xcd\xef\x00", "header")
+	copy(packet[n:], "abc")
+	gf, ok := parseGeneveHeader(packet[:n+3])
+	if !ok {
+		wt.Fatalf(t, "Expected a valid packet")
+	}
+	wt.AssertEqualInt(t, int(gf.vni), 0xabcdef, "VNI")
+	wt.AssertEqualString(t, string(gf.srcName), string(srcName), "source peer")
+	if gf.dstName != nil {
+		wt.Fatalf(t, "Expected no destination peer")
+	}
+	if !gf.hasTenant || gf.tenant != 258 {
+		wt.Fatalf(t, "Expected tenant 258, got %d", gf.tenant)
+	}
+	wt.AssertEqualString(t, string(gf.frame), "abc", "frame")
+
+	// The destination is critical
+	n = putGeneveHeader(packet, 1, srcName, dstName, 0)
+	wt.AssertEqualInt(t, n, GeneveMaxOverhead, "header length")
+	wt.AssertEqualInt(t, int(packet[1]), geneveFlagCritical, "flags")
+	gf, ok = parseGeneveHeader(packet[:n])
+	if !ok {
+		wt.Fatalf(t, "Expected a valid packet")
+	}
+	wt.AssertEqualString(t, string(gf.dstName), string(dstName), "destination peer")
+	wt.AssertEqualInt(t, len(gf.frame), 0, "frame length")
+
+	// Unknown options are skipped, unless they're critical
+	packet[GeneveHeaderSize+2] = 9
+	if gf, ok = parseGeneveHeader(packet[:n]); !ok || gf.srcName != nil {
+		wt.Fatalf(t, "Expected unknown option to be skipped")
+	}
+	packet[GeneveHeaderSize+2] = 9 | geneveOptionCritical
+	if _, ok = parseGeneveHeader(packet[:n]); ok {
+		wt.Fatalf(t, "Expected unknown critical option to be refused")
+	}
+
+	// Packets from elsewhere may have no options at all
+	packet = []byte("\x00\x00\x65\x58\x00\x00\x07\x00abc")
+	if gf, ok = parseGeneveHeader(packet); !ok || gf.srcName != nil || gf.hasTenant || gf.vni != 7 {
+		wt.Fatalf(t, "Expected a packet without options")
+	}
+	for _, bad := range []string{
+		"\x00\x00\x08\x00\x00\x00\x07\x00", // not Ethernet
+		"\x40\x00\x65\x58\x00\x00\x07\x00", // version 1
+		"\x00\x80\x65\x58\x00\x00\x07\x00", // OAM
+		"\x01\x00\x65\x58\x00\x00\x07\x00", // truncated options
+		"\x00\x00\x65\x58",                 // truncated header
+	} {
+		if _, ok := parseGeneveHeader([]byte(bad)); ok {
+			wt.Fatalf(t, "Expected %q to be refused", bad)
+		}
+	}
+}
+
+func TestEncapTenants(t *testing.T) {
+	router := &Router{RouterConfig: RouterConfig{VNI: 100}}
+	wt.AssertEqualInt(t, int(router.tenantVNI(0)), 100, "default network VNI")
+	wt.AssertEqualInt(t, int(router.tenantVNI(7)), 107, "tenant VNI")
+	for vni, expected := range map[uint32]int{100: 0, 107: 7, 100 + 0xffff: 0xffff, 99: -1, 100 + 0x10000: -1} {
+		tenant, ok := router.vniTenant(vni)
+		if expected < 0 {
+			if ok {
+				wt.Fatalf(t, "Expected no tenant for VNI %d", vni)
+			}
+			continue
+		}
+		if !ok || int(tenant) != expected {
+			wt.Fatalf(t, "Expected tenant %d for VNI %d, got %d", expected, vni, tenant)
+		}
+	}
+}
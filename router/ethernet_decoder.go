@@ -4,20 +4,28 @@ import (
 	"bytes"
 	"code.google.com/p/gopacket"
 	"code.google.com/p/gopacket/layers"
-	"log"
+	"encoding/binary"
+	"fmt"
 	"net"
 )
 
 type EthernetDecoder struct {
 	eth     layers.Ethernet
 	ip      layers.IPv4
+	ip6     layers.IPv6
+	arp     layers.ARP
 	decoded []gopacket.LayerType
 	parser  *gopacket.DecodingLayerParser
+	buf     *FrameBuffer // the pooled buffer the frame is in, if any
+	tenant  uint16       // the virtual network the frame is on
+	hops    uint8        // the hop limit the frame arrived with; 0 for none, e.g. as we captured it
+	local   *localMacs   // created on first use
+	state   TrackedState // of the connection the frame arriving from a peer belongs to; see conntrack.go
 }
 
 func NewEthernetDecoder() *EthernetDecoder {
 	dec := &EthernetDecoder{}
-	dec.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &dec.eth, &dec.ip)
+	dec.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &dec.eth, &dec.ip, &dec.ip6, &dec.arp)
 	return dec
 }
 
@@ -25,14 +33,135 @@ func (dec *EthernetDecoder) DecodeLayers(data []byte) error {
 	return dec.parser.DecodeLayers(data, &dec.decoded)
 }
 
+// The pooled buffer the decoded frame is in, for queueing the frame
+// without copying it; nil if it isn't in one, or for no decoder.
+func (dec *EthernetDecoder) FrameBuffer() *FrameBuffer {
+	if dec == nil {
+		return nil
+	}
+	return dec.buf
+}
+
+// The virtual network the decoded frame is on; 0, the default, for
+// no decoder.
+func (dec *EthernetDecoder) Tenant() uint16 {
+	if dec == nil {
+		return 0
+	}
+	return dec.tenant
+}
+
+func (dec *EthernetDecoder) IsIPv4() bool {
+	return len(dec.decoded) >= 2 && dec.decoded[1] == layers.LayerTypeIPv4
+}
+
+func (dec *EthernetDecoder) IsIPv6() bool {
+	return len(dec.decoded) >= 2 && dec.decoded[1] == layers.LayerTypeIPv6
+}
+
+func (dec *EthernetDecoder) IsARP() bool {
+	return len(dec.decoded) >= 2 && dec.decoded[1] == layers.LayerTypeARP
+}
+
+// Whether the frame is an IPv4 packet with the DF flag set. IPv6
+// packets are never fragmented by routers, but the hosts on our
+// network expect to be on the same link, so we fragment such packets
+// ourselves if necessary, and only resort to ICMPv6 Packet Too Big
+// when we can't.
+func (dec *EthernetDecoder) DF() bool {
+	return dec.IsIPv4() && (dec.ip.Flags&layers.IPv4DontFragment != 0)
+}
+
+// A hash of the frame's flow, i.e. its MACs and, where present, its IP
+// addresses and TCP/UDP ports. IP fragments only get hashed on their
+// addresses, so that all fragments of a packet hash alike.
+func (dec *EthernetDecoder) FlowHash() uint32 {
+	h := fnvAdd(fnvOffset, dec.eth.SrcMAC)
+	h = fnvAdd(h, dec.eth.DstMAC)
+	var proto layers.IPProtocol
+	var payload []byte
+	switch {
+	case dec.IsIPv4():
+		h = fnvAdd(h, dec.ip.SrcIP)
+		h = fnvAdd(h, dec.ip.DstIP)
+		if dec.ip.Flags&layers.IPv4MoreFragments == 0 && dec.ip.FragOffset == 0 {
+			proto, payload = dec.ip.Protocol, dec.ip.Payload
+		}
+	case dec.IsIPv6():
+		h = fnvAdd(h, dec.ip6.SrcIP)
+		h = fnvAdd(h, dec.ip6.DstIP)
+		proto, payload = dec.ip6.NextHeader, dec.ip6.Payload
+	}
+	if (proto == layers.IPProtocolTCP || proto == layers.IPProtocolUDP) && len(payload) >= 4 {
+		h = fnvAdd(h, payload[:4]) // source and destination ports
+	}
+	return h
+}
+
+// The class a frame travels in, from the DSCP of IP packets: expedited
+// forwarding and the classes for voice, video and network control are
+// interactive, while the lower-effort ones are bulk. DNS is always
+// interactive, whatever its marking.
+func (dec *EthernetDecoder) TrafficClass() TrafficClass {
+	var dscp uint8
+	var proto layers.IPProtocol
+	var payload []byte
+	switch {
+	case dec.IsIPv4():
+		dscp = dec.ip.TOS >> 2
+		if dec.ip.Flags&layers.IPv4MoreFragments == 0 && dec.ip.FragOffset == 0 {
+			proto, payload = dec.ip.Protocol, dec.ip.Payload
+		}
+	case dec.IsIPv6():
+		dscp = dec.ip6.TrafficClass >> 2
+		proto, payload = dec.ip6.NextHeader, dec.ip6.Payload
+	default:
+		return ClassDefault
+	}
+	if (proto == layers.IPProtocolTCP || proto == layers.IPProtocolUDP) && len(payload) >= 4 &&
+		(binary.BigEndian.Uint16(payload[0:2]) == 53 || binary.BigEndian.Uint16(payload[2:4]) == 53) {
+		return ClassInteractive
+	}
+	switch dscp {
+	case 46, 40, 48, 56, 34, 36, 38: // EF, CS5-7, AF4x
+		return ClassInteractive
+	case 8, 10, 12, 14: // CS1, AF1x
+		return ClassBulk
+	}
+	return ClassDefault
+}
+
+// FNV-1a, without the allocation hash/fnv would incur
+const (
+	fnvOffset = 2166136261
+	fnvPrime  = 16777619
+)
+
+func fnvAdd(h uint32, data []byte) uint32 {
+	for _, b := range data {
+		h ^= uint32(b)
+		h *= fnvPrime
+	}
+	return h
+}
+
 func (dec *EthernetDecoder) CheckFrameTooBig(err error, sendFrame func([]byte) error) error {
 	if ftbe, ok := err.(FrameTooBigError); ok {
-		// we know: 1. ip is valid, 2. it was ip and DF was set
+		// we know: 1. ip is valid, 2. it was either IPv4 with DF
+		// set, or IPv6 we couldn't fragment
+		if dec.IsIPv6() {
+			icmpFrame, err := dec.formICMPv6PTBPacket(ftbe.EPMTU)
+			if err != nil {
+				return err
+			}
+			logPMTU.Info(fmt.Sprintf("Sending ICMPv6 Packet Too Big (%v -> %v): PMTU= %v", dec.ip6.DstIP, dec.ip6.SrcIP, ftbe.EPMTU))
+			return sendFrame(icmpFrame)
+		}
 		icmpFrame, err := dec.formICMPMTUPacket(ftbe.EPMTU)
 		if err != nil {
 			return err
 		}
-		log.Printf("Sending ICMP 3,4 (%v -> %v): PMTU= %v\n", dec.ip.DstIP, dec.ip.SrcIP, ftbe.EPMTU)
+		logPMTU.Info(fmt.Sprintf("Sending ICMP 3,4 (%v -> %v): PMTU= %v", dec.ip.DstIP, dec.ip.SrcIP, ftbe.EPMTU))
 		return sendFrame(icmpFrame)
 	} else {
 		return err
@@ -72,6 +201,46 @@ func (dec *EthernetDecoder) formICMPMTUPacket(mtu int) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// An ICMPv6 Packet Too Big message (RFC 4443, section 3.2) carries as
+// much of the offending packet as fits without the ICMPv6 packet
+// exceeding the minimum IPv6 MTU.
+const icmpv6MaxPayload = 1280 - 40 - 8
+
+func (dec *EthernetDecoder) formICMPv6PTBPacket(mtu int) ([]byte, error) {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true}
+	original := dec.eth.Payload
+	if len(original) > icmpv6MaxPayload {
+		original = original[:icmpv6MaxPayload]
+	}
+	mtuBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(mtuBytes, uint32(mtu))
+	payload := gopacket.Payload(Concat(mtuBytes, original))
+	ip := &layers.IPv6{
+		Version:      6,
+		TrafficClass: dec.ip6.TrafficClass,
+		NextHeader:   layers.IPProtocolICMPv6,
+		HopLimit:     64,
+		DstIP:        dec.ip6.SrcIP,
+		SrcIP:        dec.ip6.DstIP}
+	icmp := &layers.ICMPv6{TypeCode: 0x200}
+	icmp.SetNetworkLayerForChecksum(ip)
+	err := gopacket.SerializeLayers(buf, opts,
+		&layers.Ethernet{
+			SrcMAC:       dec.eth.DstMAC,
+			DstMAC:       dec.eth.SrcMAC,
+			EthernetType: dec.eth.EthernetType},
+		ip,
+		icmp,
+		&payload)
+	if err != nil {
+		return []byte{}, err
+	}
+	return buf.Bytes(), nil
+}
+
 var (
 	// see http://en.wikipedia.org/wiki/Multicast_address#Ethernet
 	stpMACPrefix = []byte{0x01, 0x80, 0xC2, 0x00, 0x00}
@@ -86,3 +255,127 @@ func (dec *EthernetDecoder) IsSpecial() bool {
 	return dec.eth.Length == 0 && dec.eth.EthernetType == layers.EthernetTypeLLC &&
 		bytes.Equal(zeroMAC, dec.eth.SrcMAC) && bytes.Equal(zeroMAC, dec.eth.DstMAC)
 }
+
+// Whether the frame is one of a throughput test; see throughput.go.
+func (dec *EthernetDecoder) IsThroughputTest() bool {
+	return dec.eth.EthernetType == throughputEtherType && len(dec.eth.Payload) >= throughputHeaderSize &&
+		bytes.Equal(zeroMAC, dec.eth.SrcMAC) && bytes.Equal(zeroMAC, dec.eth.DstMAC)
+}
+
+// Multicast groups whose frames we flood regardless of membership:
+// the link-local ones (224.0.0.x and ff02::x), which hosts don't
+// report, and IPv6 solicited-node ones, which neighbour discovery
+// can't do without.
+var (
+	ipv4MulticastMACPrefix = []byte{0x01, 0x00, 0x5E}
+	ipv6MulticastMACPrefix = []byte{0x33, 0x33}
+	ipv4LinkLocalGroups    = []byte{0x01, 0x00, 0x5E, 0x00, 0x00}
+	ipv6LinkLocalGroups    = []byte{0x33, 0x33, 0x00, 0x00, 0x00}
+	ipv6SolicitedNode      = []byte{0x33, 0x33, 0xFF}
+)
+
+// Whether frames for the group with the given MAC only go to peers
+// with receivers in it.
+func IsSnoopableGroup(mac net.HardwareAddr) bool {
+	switch {
+	case bytes.HasPrefix(mac, ipv4MulticastMACPrefix):
+		return !bytes.HasPrefix(mac, ipv4LinkLocalGroups)
+	case bytes.HasPrefix(mac, ipv6MulticastMACPrefix):
+		return !bytes.HasPrefix(mac, ipv6LinkLocalGroups) && !bytes.HasPrefix(mac, ipv6SolicitedNode)
+	}
+	return false
+}
+
+func (dec *EthernetDecoder) IsSnoopableMulticast() bool {
+	return IsSnoopableGroup(dec.eth.DstMAC)
+}
+
+const (
+	igmpV1Report    = 0x12
+	igmpV2Report    = 0x16
+	igmpV2Leave     = 0x17
+	igmpV3Report    = 0x22
+	mldV1Report     = 131
+	mldV1Done       = 132
+	mldV2Report     = 143
+	modeIsInclude   = 1
+	changeToInclude = 3
+	blockOldSources = 6
+)
+
+// Call fun for each multicast group the frame's sender joins or
+// leaves, if the frame is an IGMP or MLD report. Groups are given by
+// their MACs, since that's what we forward on.
+func (dec *EthernetDecoder) ForEachGroupChange(fun func(group net.HardwareAddr, join bool)) {
+	switch {
+	case dec.IsIPv4() && dec.ip.Protocol == layers.IPProtocolIGMP:
+		parseIGMP(dec.ip.Payload, fun)
+	case dec.IsIPv6():
+		// MLD messages come with a router alert option, in a header
+		// the decoder has already skipped.
+		next := dec.ip6.NextHeader
+		if dec.ip6.HopByHop != nil {
+			next = dec.ip6.HopByHop.NextHeader
+		}
+		if next == layers.IPProtocolICMPv6 {
+			parseMLD(dec.ip6.Payload, fun)
+		}
+	}
+}
+
+func parseIGMP(msg []byte, fun func(net.HardwareAddr, bool)) {
+	if len(msg) < 8 {
+		return
+	}
+	switch msg[0] {
+	case igmpV1Report, igmpV2Report:
+		fun(ipv4GroupMAC(msg[4:8]), true)
+	case igmpV2Leave:
+		fun(ipv4GroupMAC(msg[4:8]), false)
+	case igmpV3Report:
+		parseGroupRecords(msg[8:], int(binary.BigEndian.Uint16(msg[6:8])), net.IPv4len, ipv4GroupMAC, fun)
+	}
+}
+
+func parseMLD(msg []byte, fun func(net.HardwareAddr, bool)) {
+	switch {
+	case len(msg) >= 24 && msg[0] == mldV1Report:
+		fun(ipv6GroupMAC(msg[8:24]), true)
+	case len(msg) >= 24 && msg[0] == mldV1Done:
+		fun(ipv6GroupMAC(msg[8:24]), false)
+	case len(msg) >= 8 && msg[0] == mldV2Report:
+		parseGroupRecords(msg[8:], int(binary.BigEndian.Uint16(msg[6:8])), net.IPv6len, ipv6GroupMAC, fun)
+	}
+}
+
+// IGMPv3 and MLDv2 group records only differ in address length. A
+// host leaves a group by asking to receive from no sources, and is
+// otherwise interested in it, bar blocking some sources.
+func parseGroupRecords(records []byte, count, addrLen int, groupMAC func([]byte) net.HardwareAddr, fun func(net.HardwareAddr, bool)) {
+	for ; count > 0 && len(records) >= 4+addrLen; count-- {
+		recordType := records[0]
+		auxLen := int(records[1]) * 4
+		sources := int(binary.BigEndian.Uint16(records[2:4]))
+		group := groupMAC(records[4 : 4+addrLen])
+		switch {
+		case recordType == blockOldSources:
+		case (recordType == modeIsInclude || recordType == changeToInclude) && sources == 0:
+			fun(group, false)
+		default:
+			fun(group, true)
+		}
+		recordLen := 4 + addrLen + sources*addrLen + auxLen
+		if recordLen > len(records) {
+			return
+		}
+		records = records[recordLen:]
+	}
+}
+
+func ipv4GroupMAC(ip []byte) net.HardwareAddr {
+	return net.HardwareAddr{0x01, 0x00, 0x5E, ip[1] & 0x7F, ip[2], ip[3]}
+}
+
+func ipv6GroupMAC(ip []byte) net.HardwareAddr {
+	return net.HardwareAddr{0x33, 0x33, ip[12], ip[13], ip[14], ip[15]}
+}
@@ -0,0 +1,90 @@
+package router
+
+import (
+	"code.google.com/p/gopacket"
+	"code.google.com/p/gopacket/layers"
+	"encoding/binary"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+)
+
+func decodeTestFrame(t *testing.T, ip gopacket.SerializableLayer, ethType layers.EthernetType, payloadLen int) *EthernetDecoder {
+	srcMAC, _ := net.ParseMAC("00:11:22:33:44:55")
+	dstMAC, _ := net.ParseMAC("00:11:22:33:44:66")
+	buf := gopacket.NewSerializeBuffer()
+	payload := gopacket.Payload(make([]byte, payloadLen))
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: ethType}, ip, &payload)
+	wt.AssertNoErr(t, err)
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(buf.Bytes())
+	return dec
+}
+
+func checkFrameTooBig(t *testing.T, dec *EthernetDecoder) gopacket.Packet {
+	var icmpFrame []byte
+	err := dec.CheckFrameTooBig(FrameTooBigError{EPMTU: 1400}, func(frame []byte) error {
+		icmpFrame = frame
+		return nil
+	})
+	wt.AssertNoErr(t, err)
+	packet := gopacket.NewPacket(icmpFrame, layers.LayerTypeEthernet, gopacket.Default)
+	eth := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	wt.AssertEqualString(t, eth.DstMAC.String(), dec.eth.SrcMAC.String(), "ICMP destination MAC")
+	return packet
+}
+
+func TestICMPFragmentationNeeded(t *testing.T) {
+	dec := decodeTestFrame(t, &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Flags: layers.IPv4DontFragment,
+		Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(10, 0, 0, 2)},
+		layers.EthernetTypeIPv4, 2000)
+	if !dec.DF() {
+		wt.Fatalf(t, "Expected DF frame")
+	}
+	packet := checkFrameTooBig(t, dec)
+	icmp, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+	if !ok {
+		wt.Fatalf(t, "Expected an ICMP packet")
+	}
+	wt.AssertEqualInt(t, int(icmp.TypeCode), 0x304, "ICMP type/code")
+	wt.AssertEqualInt(t, int(icmp.Seq), 1400, "next-hop MTU")
+	ip := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	wt.AssertEqualString(t, ip.DstIP.String(), "10.0.0.1", "ICMP destination")
+}
+
+func TestICMPv6PacketTooBig(t *testing.T) {
+	dec := decodeTestFrame(t, &layers.IPv6{Version: 6, NextHeader: layers.IPProtocolUDP, HopLimit: 64,
+		SrcIP: net.ParseIP("fd00::1"), DstIP: net.ParseIP("fd00::2")},
+		layers.EthernetTypeIPv6, 2000)
+	packet := checkFrameTooBig(t, dec)
+	icmp, ok := packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+	if !ok {
+		wt.Fatalf(t, "Expected an ICMPv6 packet")
+	}
+	wt.AssertEqualInt(t, int(icmp.TypeCode), 0x200, "ICMPv6 type/code")
+	wt.AssertEqualInt(t, int(binary.BigEndian.Uint32(icmp.Payload)), 1400, "MTU")
+	ip := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	wt.AssertEqualString(t, ip.DstIP.String(), "fd00::1", "ICMPv6 destination")
+	if len(packet.Data()) > EthernetOverhead+1280 {
+		wt.Fatalf(t, "ICMPv6 packet exceeds minimum IPv6 MTU: %d bytes", len(packet.Data())-EthernetOverhead)
+	}
+}
+
+func TestFlowHash(t *testing.T) {
+	dec := decodeTestFrame(t, &layers.IPv4{Version: 4, IHL: 5, TTL: 64,
+		Protocol: layers.IPProtocolTCP, SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(10, 0, 0, 2)},
+		layers.EthernetTypeIPv4, 20)
+	ports := dec.ip.Payload[:4]
+	hash := dec.FlowHash()
+	wt.AssertEqualuint64(t, uint64(dec.FlowHash()), uint64(hash), "hash of same flow")
+	ports[1] = 80
+	if dec.FlowHash() == hash {
+		wt.Fatalf(t, "Expected different ports to give a different hash")
+	}
+	// fragments only hash on addresses
+	dec.ip.Flags |= layers.IPv4MoreFragments
+	hash = dec.FlowHash()
+	ports[1] = 81
+	wt.AssertEqualuint64(t, uint64(dec.FlowHash()), uint64(hash), "hash of fragment")
+}
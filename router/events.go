@@ -0,0 +1,133 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Topology events, for orchestration systems which want to react to
+// changes in the network without polling the status. They get
+// streamed to HTTP clients as server-sent events.
+//
+// Events are delivered to each subscriber through a buffered
+// channel. A subscriber which falls too far behind misses events
+// rather than holding up the router, and is told so.
+
+const (
+	EventPeerAdded             = "peer-added"
+	EventPeerRemoved           = "peer-removed"
+	EventConnectionEstablished = "connection-established"
+	EventConnectionFailed      = "connection-failed" // before completing the handshake
+	EventConnectionClosed      = "connection-closed"
+	EventConnectionState       = "connection-state" // moved to State; see connection_state.go
+	EventPMTUChanged           = "pmtu-changed"
+	EventMeshSplit             = "mesh-split"
+	EventMeshMerged            = "mesh-merged"
+	EventLoopDetected          = "loop-detected"
+	EventMissed                = "missed" // the subscriber fell behind and missed some events
+)
+
+type Event struct {
+	Time    time.Time
+	Type    string
+	Peer    string   `json:",omitempty"`
+	Address string   `json:",omitempty"`
+	PMTU    int      `json:",omitempty"`
+	State   string   `json:",omitempty"`
+	Peers   []string `json:",omitempty"`
+	Reason  string   `json:",omitempty"`
+}
+
+type Events struct {
+	sync.Mutex
+	subscribers map[chan Event]bool // -> whether it missed events
+}
+
+func NewEvents() *Events {
+	return &Events{subscribers: make(map[chan Event]bool)}
+}
+
+func (events *Events) Subscribe() <-chan Event {
+	ch := make(chan Event, EventBufferSize)
+	events.Lock()
+	defer events.Unlock()
+	events.subscribers[ch] = false
+	return ch
+}
+
+func (events *Events) Unsubscribe(ch <-chan Event) {
+	events.Lock()
+	defer events.Unlock()
+	for subscriber := range events.subscribers {
+		if subscriber == ch {
+			delete(events.subscribers, subscriber)
+		}
+	}
+}
+
+func (events *Events) Publish(event Event) {
+	event.Time = time.Now()
+	events.Lock()
+	defer events.Unlock()
+	for ch, missed := range events.subscribers {
+		if missed {
+			select {
+			case ch <- Event{Time: event.Time, Type: EventMissed}:
+				events.subscribers[ch] = false
+			default:
+				continue
+			}
+		}
+		select {
+		case ch <- event:
+		default:
+			events.subscribers[ch] = true
+		}
+	}
+}
+
+// Stream events to the client until it goes away.
+func (events *Events) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	ch := events.Subscribe()
+	defer events.Unsubscribe(ch)
+	flusher.Flush()
+	for {
+		select {
+		case event := <-ch:
+			data, err := json.Marshal(event)
+			if err != nil {
+				logRouter.Warn("Error encoding event:", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Connections in tests needn't have a router.
+func (conn *LocalConnection) publishEvent(eventType string, pmtu int, reason string) {
+	if conn.Router == nil {
+		return
+	}
+	conn.Router.Events.Publish(Event{
+		Type:    eventType,
+		Peer:    conn.remote.Name.String(),
+		Address: conn.remoteTCPAddr,
+		PMTU:    pmtu,
+		Reason:  reason})
+}
@@ -0,0 +1,55 @@
+package router
+
+import (
+	"bufio"
+	wt "github.com/zettio/weave/testing"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEventsSlowSubscriber(t *testing.T) {
+	events := NewEvents()
+	ch := events.Subscribe()
+	for i := 0; i < EventBufferSize+1; i++ {
+		events.Publish(Event{Type: EventPMTUChanged, PMTU: i})
+	}
+	for i := 0; i < EventBufferSize; i++ {
+		event := <-ch
+		wt.AssertEqualInt(t, event.PMTU, i, "PMTU")
+	}
+	// The subscriber hears that it missed something before the next event
+	events.Publish(Event{Type: EventPeerAdded})
+	wt.AssertEqualString(t, (<-ch).Type, EventMissed, "event type")
+	wt.AssertEqualString(t, (<-ch).Type, EventPeerAdded, "event type")
+
+	events.Unsubscribe(ch)
+	events.Publish(Event{Type: EventPeerRemoved})
+	select {
+	case event := <-ch:
+		wt.Fatalf(t, "Unexpected event after unsubscribing: %v", event)
+	default:
+	}
+}
+
+func TestEventsStream(t *testing.T) {
+	events := NewEvents()
+	server := httptest.NewServer(events)
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	wt.AssertNoErr(t, err)
+	defer resp.Body.Close()
+	wt.AssertEqualString(t, resp.Header.Get("Content-Type"), "text/event-stream", "content type")
+
+	events.Publish(Event{Type: EventConnectionEstablished, Peer: "00:00:00:00:00:01"})
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, line, "event: "+EventConnectionEstablished+"\n", "event line")
+	line, err = reader.ReadString('\n')
+	wt.AssertNoErr(t, err)
+	if !strings.HasPrefix(line, "data: {") || !strings.Contains(line, `"Peer":"00:00:00:00:00:01"`) {
+		wt.Fatalf(t, "Unexpected data line %q", line)
+	}
+}
@@ -0,0 +1,190 @@
+package router
+
+import (
+	"fmt"
+	weavenet "github.com/zettio/weave/net"
+	"net"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// The fast path offloads unicast traffic between unencrypted peers to
+// a kernel VXLAN device, so that it never has to pass through
+// userspace. The device has to be created beforehand, attached to the
+// same bridge as the interface we sniff on, in our network namespace,
+// and with learning disabled, e.g.
+//
+//   ip link add vethwe-vxlan type vxlan id 1 dstport 4789 nolearning
+//   ip link set vethwe-vxlan master weave up
+//
+// We only ever add forwarding entries for MACs we have seen at peers
+// we are directly connected to, and which support the fast path too.
+// The device drops everything else, in particular broadcasts, which
+// the bridge therefore only delivers to us and we forward as usual.
+
+type FastPath struct {
+	sync.Mutex
+	iface   *net.Interface
+	entries map[string]net.IP // MAC -> underlay IP of the peer
+	xdp     *XDPFilter        // sends frames for the MACs to the device ahead of the capture, if enabled
+}
+
+func NewFastPath(devName string) (*FastPath, error) {
+	iface, err := net.InterfaceByName(devName)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find fast path device %s: %v", devName, err)
+	}
+	return &FastPath{iface: iface, entries: make(map[string]net.IP)}, nil
+}
+
+func (fp *FastPath) DeviceName() string {
+	return fp.iface.Name
+}
+
+// Redirect frames for the MACs we have entries for to the device with
+// XDP, before the capture on the interface sees them; see xdp.go.
+func (fp *FastPath) EnableXDP(iface *net.Interface) error {
+	xdp, err := NewXDPFilter(iface)
+	if err != nil {
+		return err
+	}
+	fp.Lock()
+	defer fp.Unlock()
+	for macStr := range fp.entries {
+		mac, _ := net.ParseMAC(macStr)
+		if err := xdp.Add(mac, fp.iface); err != nil {
+			xdp.Close()
+			return err
+		}
+	}
+	fp.xdp = xdp
+	return nil
+}
+
+// Stop redirecting frames with XDP, if we were.
+func (fp *FastPath) DisableXDP() error {
+	fp.Lock()
+	defer fp.Unlock()
+	if fp.xdp == nil {
+		return nil
+	}
+	err := fp.xdp.Close()
+	fp.xdp = nil
+	return err
+}
+
+// Direct traffic for the MAC to the peer at the given IP.
+func (fp *FastPath) AddMAC(mac net.HardwareAddr, ip net.IP) error {
+	fp.Lock()
+	defer fp.Unlock()
+	if existing, found := fp.entries[mac.String()]; found && existing.Equal(ip) {
+		return nil
+	}
+	if err := fp.fdbRequest(syscall.RTM_NEWNEIGH, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, mac, ip); err != nil {
+		return err
+	}
+	fp.entries[mac.String()] = ip
+	if fp.xdp != nil {
+		return fp.xdp.Add(mac, fp.iface)
+	}
+	return nil
+}
+
+func (fp *FastPath) DeleteMAC(mac net.HardwareAddr) error {
+	fp.Lock()
+	defer fp.Unlock()
+	return fp.deleteMAC(mac.String())
+}
+
+// Remove all entries pointing at the peer with the given IP, making
+// the traffic go back to userspace. Called when our connection to the
+// peer goes away.
+func (fp *FastPath) DeletePeer(ip net.IP) error {
+	fp.Lock()
+	defer fp.Unlock()
+	var lastErr error
+	for mac, entryIP := range fp.entries {
+		if entryIP.Equal(ip) {
+			if err := fp.deleteMAC(mac); err != nil {
+				lastErr = err
+			}
+		}
+	}
+	return lastErr
+}
+
+func (fp *FastPath) deleteMAC(macStr string) error {
+	ip, found := fp.entries[macStr]
+	if !found {
+		return nil
+	}
+	delete(fp.entries, macStr)
+	mac, err := net.ParseMAC(macStr)
+	if err != nil {
+		return err
+	}
+	// Frames need to come back to us before the device drops them
+	if fp.xdp != nil {
+		if err := fp.xdp.Delete(mac); err != nil {
+			return err
+		}
+	}
+	return fp.fdbRequest(syscall.RTM_DELNEIGH, 0, mac, ip)
+}
+
+func (fp *FastPath) String() string {
+	fp.Lock()
+	defer fp.Unlock()
+	if fp.xdp != nil {
+		return fmt.Sprintf("%s (%d MACs, with XDP on %s)", fp.iface.Name, len(fp.entries), fp.xdp.iface.Name)
+	}
+	return fmt.Sprintf("%s (%d MACs)", fp.iface.Name, len(fp.entries))
+}
+
+// Where the fast path sends traffic for the remote's MACs: its address
+// on the WireGuard tunnel if we both have WireGuard, otherwise its
+// underlay IP if we don't use a password; nil if neither.
+func (conn *LocalConnection) fastPathDst() net.IP {
+	if conn.wireGuard {
+		return conn.Router.WireGuard.TunnelIP(conn.remote.Name)
+	}
+	return conn.fastPathIP
+}
+
+// Where the fast path sends traffic for MACs seen at the peer, in
+// frames which came over the connection: only if the peer sent them
+// to us directly, over UDP, and the connection can use the fast path.
+func (conn *LocalConnection) fastPathDstFor(srcPeer *Peer) net.IP {
+	if srcPeer != conn.Remote() || conn.UsingTCPFallback() {
+		return nil
+	}
+	return conn.fastPathDst()
+}
+
+// Netlink plumbing for forwarding database entries, i.e. the
+// equivalent of 'bridge fdb replace <mac> dev <dev> dst <ip>'. These
+// aren't defined in the syscall package.
+
+const (
+	ndaDst       = 1
+	ndaLLAddr    = 2
+	ntfSelf      = 0x02
+	nudNoARP     = 0x40
+	nudPermanent = 0x80
+	sizeofNdMsg  = 12
+)
+
+func (fp *FastPath) fdbRequest(msgType uint16, flags uint16, mac net.HardwareAddr, ip net.IP) error {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	body := make([]byte, sizeofNdMsg)
+	body[0] = syscall.AF_BRIDGE
+	*(*int32)(unsafe.Pointer(&body[4])) = int32(fp.iface.Index)
+	*(*uint16)(unsafe.Pointer(&body[8])) = nudPermanent | nudNoARP
+	body[10] = ntfSelf
+	body = append(body, weavenet.NetlinkAttr(ndaLLAddr, mac)...)
+	body = append(body, weavenet.NetlinkAttr(ndaDst, ip)...)
+	return weavenet.NetlinkRequest(msgType, flags, body)
+}
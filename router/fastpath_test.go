@@ -0,0 +1,54 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+)
+
+// A fast path which doesn't get as far as the kernel
+func testFastPath() *FastPath {
+	return &FastPath{iface: &net.Interface{Name: "vethwe-vxlan"}, entries: make(map[string]net.IP)}
+}
+
+func TestFastPathSelection(t *testing.T) {
+	loopback := net.IPv4(127, 0, 0, 1)
+	checkFastPath := func(fastPath1, fastPath2 bool, password string, wanted net.IP) (*LocalConnection, *LocalConnection) {
+		router1 := handshakeTestRouter("01:00:00:01:00:00", password)
+		router2 := handshakeTestRouter("02:00:00:01:00:00", password)
+		if fastPath1 {
+			router1.FastPath = testFastPath()
+		}
+		if fastPath2 {
+			router2.FastPath = testFastPath()
+		}
+		conn1, conn2, err1, err2 := handshakePair(t, router1, router2, nil)
+		wt.AssertNoErr(t, err1)
+		wt.AssertNoErr(t, err2)
+		for _, conn := range []*LocalConnection{conn1, conn2} {
+			if dst := conn.fastPathDst(); !dst.Equal(wanted) {
+				wt.Fatalf(t, "Expected fast path to %v (fast paths %v, %v; password %q); got %v", wanted, fastPath1, fastPath2, password, dst)
+			}
+		}
+		return conn1, conn2
+	}
+	checkFastPath(false, false, "", nil)
+	checkFastPath(true, false, "", nil)
+	checkFastPath(false, true, "", nil)
+	checkFastPath(true, true, "password", nil)
+	conn1, _ := checkFastPath(true, true, "", loopback)
+
+	// Only MACs the remote sent us frames from directly, over UDP, go
+	// the fast path
+	if dst := conn1.fastPathDstFor(conn1.Remote()); !dst.Equal(loopback) {
+		wt.Fatalf(t, "Expected MACs at the remote to go the fast path; got %v", dst)
+	}
+	name3, _ := PeerNameFromString("03:00:00:01:00:00")
+	if dst := conn1.fastPathDstFor(NewPeer(name3, 0, 0)); dst != nil {
+		wt.Fatalf(t, "Expected MACs at peers the remote relays for not to go the fast path; got %v", dst)
+	}
+	conn1.tcpFallback = true
+	if dst := conn1.fastPathDstFor(conn1.Remote()); dst != nil {
+		wt.Fatalf(t, "Expected no fast path while falling back to TCP; got %v", dst)
+	}
+}
@@ -0,0 +1,207 @@
+package router
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Accounting of traffic for capacity planning: how big the frames
+// going over each connection are, and, if asked for, which pairs of IP
+// addresses exchange the most traffic. We count frames by size on
+// every connection, which is only an atomic add. Flows cost a lookup
+// under a lock for every frame, so they are optional; we count them
+// for one FlowWindow at a time, reporting the current window and the
+// previous one, and lump together the traffic of flows beyond the
+// first MaxFlows of a window, so that a scan of many addresses can't
+// make the table grow without bounds.
+
+const FrameSizeBuckets = 8
+
+// The largest frame in each bucket but the last, which has the rest
+var FrameSizeBounds = [FrameSizeBuckets - 1]int{64, 128, 256, 512, 1024, 1500, 9000}
+
+func frameSizeBucket(size int) int {
+	for i, bound := range FrameSizeBounds {
+		if size <= bound {
+			return i
+		}
+	}
+	return FrameSizeBuckets - 1
+}
+
+func (conn *LocalConnection) countFrameSize(outbound bool, size int) {
+	if outbound {
+		atomic.AddUint64(&conn.stats.SentBySize[frameSizeBucket(size)], 1)
+	} else {
+		atomic.AddUint64(&conn.stats.ReceivedBySize[frameSizeBucket(size)], 1)
+	}
+}
+
+func loadFrameSizes(counts *[FrameSizeBuckets]uint64) [FrameSizeBuckets]uint64 {
+	var loaded [FrameSizeBuckets]uint64
+	for i := range counts {
+		loaded[i] = atomic.LoadUint64(&counts[i])
+	}
+	return loaded
+}
+
+type flowKey struct {
+	src, dst [net.IPv6len]byte
+}
+
+type FlowCounts struct {
+	Frames uint64
+	Bytes  uint64
+}
+
+func (counts *FlowCounts) add(other FlowCounts) {
+	counts.Frames += other.Frames
+	counts.Bytes += other.Bytes
+}
+
+type FlowStats struct {
+	sync.Mutex
+	windowStart       time.Time
+	current, previous map[flowKey]*FlowCounts
+	untracked         [2]FlowCounts // of the current and previous windows
+}
+
+type Talker struct {
+	Src string
+	Dst string
+	FlowCounts
+}
+
+type FlowReport struct {
+	Since      time.Time // when the counts start
+	TopTalkers []Talker
+	Untracked  FlowCounts // traffic of flows beyond the first MaxFlows of a window
+	FrameSizes []ConnectionFrameSizes
+}
+
+type ConnectionFrameSizes struct {
+	Peer     string
+	Sent     []FrameSizeCount
+	Received []FrameSizeCount
+}
+
+type FrameSizeCount struct {
+	UpTo   int // bytes; MaxUDPPacketSize for the last bucket
+	Frames uint64
+}
+
+func NewFlowStats() *FlowStats {
+	return &FlowStats{
+		windowStart: time.Now(),
+		current:     make(map[flowKey]*FlowCounts),
+		previous:    make(map[flowKey]*FlowCounts)}
+}
+
+// Count the frame towards its flow, if it is IP.
+func (flows *FlowStats) Frame(dec *EthernetDecoder, size int) {
+	var key flowKey
+	switch {
+	case dec.IsIPv4():
+		copy(key.src[:], dec.ip.SrcIP.To16())
+		copy(key.dst[:], dec.ip.DstIP.To16())
+	case dec.IsIPv6():
+		copy(key.src[:], dec.ip6.SrcIP)
+		copy(key.dst[:], dec.ip6.DstIP)
+	default:
+		return
+	}
+	now := time.Now()
+	flows.Lock()
+	defer flows.Unlock()
+	if now.Sub(flows.windowStart) >= FlowWindow {
+		flows.previous, flows.current = flows.current, make(map[flowKey]*FlowCounts)
+		flows.untracked[1], flows.untracked[0] = flows.untracked[0], FlowCounts{}
+		flows.windowStart = now
+	}
+	counts, found := flows.current[key]
+	if !found {
+		if len(flows.current) >= MaxFlows {
+			flows.untracked[0].add(FlowCounts{1, uint64(size)})
+			return
+		}
+		counts = &FlowCounts{}
+		flows.current[key] = counts
+	}
+	counts.Frames++
+	counts.Bytes += uint64(size)
+}
+
+// The flows with the most bytes, at most n of them, over the current
+// and previous windows.
+func (flows *FlowStats) TopTalkers(n int) ([]Talker, FlowCounts, time.Time) {
+	flows.Lock()
+	totals := make(map[flowKey]FlowCounts, len(flows.current)+len(flows.previous))
+	for _, window := range []map[flowKey]*FlowCounts{flows.current, flows.previous} {
+		for key, counts := range window {
+			total := totals[key]
+			total.add(*counts)
+			totals[key] = total
+		}
+	}
+	untracked := flows.untracked[0]
+	untracked.add(flows.untracked[1])
+	since := flows.windowStart.Add(-FlowWindow)
+	flows.Unlock()
+
+	talkers := make([]Talker, 0, len(totals))
+	for key, counts := range totals {
+		talkers = append(talkers, Talker{
+			Src:        net.IP(key.src[:]).String(),
+			Dst:        net.IP(key.dst[:]).String(),
+			FlowCounts: counts})
+	}
+	sort.Sort(talkersByBytes(talkers))
+	if len(talkers) > n {
+		talkers = talkers[:n]
+	}
+	return talkers, untracked, since
+}
+
+type talkersByBytes []Talker
+
+func (s talkersByBytes) Len() int      { return len(s) }
+func (s talkersByBytes) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s talkersByBytes) Less(i, j int) bool {
+	if s[i].Bytes != s[j].Bytes {
+		return s[i].Bytes > s[j].Bytes
+	}
+	return s[i].Src+s[i].Dst < s[j].Src+s[j].Dst
+}
+
+func frameSizeCounts(counts [FrameSizeBuckets]uint64) []FrameSizeCount {
+	sizes := make([]FrameSizeCount, FrameSizeBuckets)
+	for i := range sizes {
+		sizes[i] = FrameSizeCount{UpTo: MaxUDPPacketSize, Frames: counts[i]}
+		if i < len(FrameSizeBounds) {
+			sizes[i].UpTo = FrameSizeBounds[i]
+		}
+	}
+	return sizes
+}
+
+// The top n talkers, if we account flows, and the sizes of the frames
+// over each connection.
+func (router *Router) FlowReport(n int) FlowReport {
+	report := FlowReport{TopTalkers: []Talker{}, FrameSizes: []ConnectionFrameSizes{}}
+	if router.Flows != nil {
+		report.TopTalkers, report.Untracked, report.Since = router.Flows.TopTalkers(n)
+	}
+	router.Ourself.ForEachConnection(func(name PeerName, conn Connection) {
+		if localConn, ok := conn.(*LocalConnection); ok {
+			stats := localConn.ConnectionStats()
+			report.FrameSizes = append(report.FrameSizes, ConnectionFrameSizes{
+				Peer:     name.String(),
+				Sent:     frameSizeCounts(stats.SentBySize),
+				Received: frameSizeCounts(stats.ReceivedBySize)})
+		}
+	})
+	return report
+}
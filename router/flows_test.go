@@ -0,0 +1,55 @@
+package router
+
+import (
+	"code.google.com/p/gopacket/layers"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+)
+
+func TestFrameSizeBuckets(t *testing.T) {
+	wt.AssertEqualInt(t, frameSizeBucket(60), 0, "bucket of a small frame")
+	wt.AssertEqualInt(t, frameSizeBucket(64), 0, "bucket of a 64 byte frame")
+	wt.AssertEqualInt(t, frameSizeBucket(65), 1, "bucket of a 65 byte frame")
+	wt.AssertEqualInt(t, frameSizeBucket(1500), 5, "bucket of a full frame")
+	wt.AssertEqualInt(t, frameSizeBucket(9001), FrameSizeBuckets-1, "bucket of a jumbo frame")
+}
+
+func TestTopTalkers(t *testing.T) {
+	flows := NewFlowStats()
+	frame := func(src, dst string, size, n int) {
+		dec := NewEthernetDecoder()
+		dec.decoded = append(dec.decoded, layers.LayerTypeEthernet, layers.LayerTypeIPv4)
+		dec.ip.SrcIP, dec.ip.DstIP = net.ParseIP(src).To4(), net.ParseIP(dst).To4()
+		for i := 0; i < n; i++ {
+			flows.Frame(dec, size)
+		}
+	}
+	frame("10.0.0.1", "10.0.0.2", 1000, 3)
+	frame("10.0.0.2", "10.0.0.1", 100, 3)
+	frame("10.0.0.3", "10.0.0.1", 1500, 10)
+
+	talkers, untracked, _ := flows.TopTalkers(2)
+	wt.AssertEqualInt(t, len(talkers), 2, "top talkers")
+	wt.AssertEqualString(t, talkers[0].Src+" "+talkers[0].Dst, "10.0.0.3 10.0.0.1", "top talker")
+	wt.AssertEqualuint64(t, talkers[0].Bytes, 15000, "bytes of top talker")
+	wt.AssertEqualuint64(t, talkers[1].Frames, 3, "frames of second talker")
+	wt.AssertEqualuint64(t, untracked.Frames, 0, "untracked frames")
+
+	// Beyond MaxFlows, frames of new flows are lumped together
+	for i := len(flows.current); i < MaxFlows; i++ {
+		flows.current[flowKey{src: [16]byte{byte(i >> 8), byte(i)}}] = &FlowCounts{}
+	}
+	frame("10.0.0.4", "10.0.0.1", 500, 2)
+	frame("10.0.0.1", "10.0.0.2", 1000, 1)
+	talkers, untracked, _ = flows.TopTalkers(1)
+	wt.AssertEqualuint64(t, untracked.Bytes, 1000, "untracked bytes")
+	wt.AssertEqualuint64(t, talkers[0].Frames, 10, "frames of top talker")
+	wt.AssertEqualuint64(t, flows.current[flowKeyOf("10.0.0.1", "10.0.0.2")].Frames, 4, "frames of a known flow")
+}
+
+func flowKeyOf(src, dst string) (key flowKey) {
+	copy(key.src[:], net.ParseIP(src).To16())
+	copy(key.dst[:], net.ParseIP(dst).To16())
+	return key
+}
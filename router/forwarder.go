@@ -3,14 +3,50 @@ package router
 import (
 	"code.google.com/p/gopacket"
 	"code.google.com/p/gopacket/layers"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 type ForwardedFrame struct {
-	srcPeer *Peer
-	dstPeer *Peer
-	frame   []byte
+	srcPeer   *Peer
+	dstPeer   *Peer
+	frame     []byte
+	buf       *FrameBuffer // the pooled buffer the frame is in, if any
+	tenant    uint16       // the virtual network the frame is on; 0 for the default
+	hops      uint8        // how many more peers may relay it; see hop_limit.go
+	encap     bool         // whether the frame can go in the connection's encapsulation
+	class     TrafficClass // the queue it goes in, and how its packet is marked
+	heartbeat bool         // our heartbeat, which gets stamped on the way out
+}
+
+// What to do when a forwarder can't keep up
+type DropPolicy int
+
+const (
+	Block DropPolicy = iota
+	DropOldest
+	DropNewest
+)
+
+var dropPolicyNames = map[DropPolicy]string{
+	Block:      "block",
+	DropOldest: "drop-oldest",
+	DropNewest: "drop-newest"}
+
+func ParseDropPolicy(name string) (DropPolicy, error) {
+	for policy, policyName := range dropPolicyNames {
+		if policyName == name {
+			return policy, nil
+		}
+	}
+	return Block, fmt.Errorf("Unknown drop policy: %s", name)
+}
+
+func (policy DropPolicy) String() string {
+	return dropPolicyNames[policy]
 }
 
 type FrameTooBigError struct {
@@ -18,65 +54,212 @@ type FrameTooBigError struct {
 }
 
 func (conn *LocalConnection) ensureForwarders() error {
-	if conn.forwardChan != nil || conn.forwardChanDF != nil {
+	if conn.forwardChans != nil || conn.forwardChansDF != nil {
 		return nil
 	}
-	udpSender := NewSimpleUDPSender(conn)
-	udpSenderDF, err := NewRawUDPSender(conn) // only thing that can error, so do it early
-	if err != nil {
-		return err
+	workers := conn.forwarders
+	if workers < 1 {
+		workers = 1
+	}
+	// senders are the only things that can error, so do them early
+	var udpSenders, udpSendersDF, encapSenders []UDPSender
+	shutdownSenders := func() {
+		for _, sender := range append(append(udpSenders, udpSendersDF...), encapSenders...) {
+			sender.Shutdown()
+		}
+	}
+	for i := 0; i < workers; i++ {
+		if conn.sendingOverTCP {
+			udpSenders = append(udpSenders, NewTCPFallbackSender(conn))
+			udpSendersDF = append(udpSendersDF, NewTCPFallbackSender(conn))
+			continue
+		}
+		// One for each of the worker's forwarders
+		for j := 0; conn.encap != EncapWeave && j < 2; j++ {
+			encapSender, err := NewEncapSender(conn)
+			if err != nil {
+				shutdownSenders()
+				return err
+			}
+			encapSenders = append(encapSenders, encapSender)
+		}
+		udpSender, err := newPathUDPSender(conn, i)
+		if err != nil {
+			shutdownSenders()
+			return err
+		}
+		udpSenders = append(udpSenders, udpSender)
+		udpSenderDF, err := conn.newUDPSenderDF(i)
+		if err != nil {
+			shutdownSenders()
+			return err
+		}
+		udpSendersDF = append(udpSendersDF, udpSenderDF)
 	}
 
-	usingPassword := conn.SessionKey != nil
-	var encryptor, encryptorDF Encryptor
-	if usingPassword {
-		encryptor = NewNaClEncryptor(conn.local.NameByte, conn, false)
-		encryptorDF = NewNaClEncryptor(conn.local.NameByte, conn, true)
-	} else {
-		encryptor = NewNonEncryptor(conn.local.NameByte)
-		encryptorDF = NewNonEncryptor(conn.local.NameByte)
+	encrypted := conn.SessionKey != nil && !conn.plaintext
+	newEncryptor := func(df bool, stream int) Encryptor {
+		if encrypted {
+			return conn.EncryptionScheme.NewEncryptor(conn.packetPrefix(), conn, df, stream)
+		}
+		ne := NewNonEncryptor(conn.packetPrefix())
+		ne.tenants = conn.tenantTags
+		ne.hopLimits = conn.hopLimits
+		return ne
+	}
+
+	pinnedPMTU := conn.Router.PMTUOverrides.Lookup(conn.remote.Name, conn.underlayIP())
+	pmtu, cached := DefaultPMTU, false
+	if remoteUDPAddr := conn.RemoteUDPAddr(); remoteUDPAddr != nil && !conn.sendingOverTCP && pinnedPMTU == 0 {
+		if cachedPMTU, found := conn.Router.PMTUs.Lookup(remoteUDPAddr.IP); found {
+			pmtu, cached = cachedPMTU, true
+		}
+	}
+	var rateLimiter *TokenBucket
+	var congestion *congestionControl
+	limit := conn.Router.RateLimitFor(conn.remote.Name)
+	if limit > 0 || conn.ecn {
+		rateLimiter = NewTokenBucket(limit)
+	}
+	if conn.ecn {
+		congestion = newCongestionControl(rateLimiter, limit, &conn.stats.ECNBackoffs)
 	}
 
 	var (
-		forwardChan   = make(chan *ForwardedFrame, ChannelSize)
-		forwardChanDF = make(chan *ForwardedFrame, ChannelSize)
-		stopForward   = make(chan interface{}, 0)
-		stopForwardDF = make(chan interface{}, 0)
-		verifyPMTU    = make(chan int, ChannelSize)
+		forwarders     []*Forwarder
+		forwardChans   []forwardQueues
+		forwardChansDF []forwardQueues
+		stopForward    []chan<- interface{}
+		finished       []<-chan struct{}
+		rekeyChans     []chan<- *[32]byte
+		primaryDF      *Forwarder
+		queueSize      = conn.Router.CurrentTuning().QueueSize
+		verifyPMTU     = make(chan int, ChannelSize)
+		tooBig         = make(chan int, ChannelSize)
+		pinPMTU        = make(chan int, ChannelSize)
+		newSendersDF   []chan<- UDPSender
+		overTCP        chan struct{}
 	)
-	//NB: only forwarderDF can ever encounter EMSGSIZE errors, and
-	//thus perform PMTU verification
-	forwarder := NewForwarder(conn, forwardChan, stopForward, nil, encryptor, udpSender, DefaultPMTU)
-	forwarderDF := NewForwarder(conn, forwardChanDF, stopForwardDF, verifyPMTU, encryptorDF, udpSenderDF, DefaultPMTU)
+	if !conn.sendingOverTCP {
+		overTCP = make(chan struct{})
+	}
+	newForwarder := func(df bool, stream int, udpSender UDPSender, encapSender UDPSender) *Forwarder {
+		queues := newForwardQueues(queueSize)
+		stop := make(chan interface{}, 0)
+		rekey := make(chan *[32]byte, ChannelSize)
+		var fwd *Forwarder
+		if df {
+			forwardChansDF = append(forwardChansDF, queues)
+			fwd = NewForwarder(conn, queues, stop, nil, rekey, newEncryptor(df, stream), udpSender, pmtu)
+			if !conn.sendingOverTCP {
+				newSender := make(chan UDPSender, 1)
+				fwd.newSender = newSender
+				newSendersDF = append(newSendersDF, newSender)
+			}
+		} else {
+			forwardChans = append(forwardChans, queues)
+			fwd = NewForwarder(conn, queues, stop, nil, rekey, newEncryptor(df, stream), udpSender, DefaultPMTU)
+		}
+		fwd.rateLimiter = rateLimiter
+		fwd.overTCP = overTCP
+		if encapSender != nil {
+			fwd.encap = encapSender
+			fwd.encapBuf = make([]byte, MaxUDPPacketSize)
+		}
+		stopForward = append(stopForward, stop)
+		finished = append(finished, fwd.finished)
+		rekeyChans = append(rekeyChans, rekey)
+		forwarders = append(forwarders, fwd)
+		return fwd
+	}
+	encapSender := func(i int) UDPSender {
+		if i < len(encapSenders) {
+			return encapSenders[i]
+		}
+		return nil
+	}
+	for i := 0; i < workers; i++ {
+		newForwarder(false, i, udpSenders[i], encapSender(2*i))
+		forwarderDF := newForwarder(true, i, udpSendersDF[i], encapSender(2*i+1))
+		// NB: only DF forwarders can ever encounter EMSGSIZE errors,
+		// and thus need to know about the PMTU. The first of them
+		// performs PMTU verification on behalf of all of them.
+		if i == 0 {
+			primaryDF = forwarderDF
+			forwarderDF.verifyPMTU = verifyPMTU
+			forwarderDF.tooBig = tooBig
+			forwarderDF.pinPMTU = pinPMTU
+			if pinnedPMTU > 0 {
+				forwarderDF.pin(pinnedPMTU)
+			} else if cached {
+				conn.logger(logPMTU).Info("Using cached PMTU", pmtu)
+				// The path may have changed since, so we verify the
+				// cached PMTU before trusting it.
+				forwarderDF.resumeVerification()
+			}
+		} else {
+			forwarderDF.reportTooBig = tooBig
+		}
+	}
 
 	// Various fields in the conn struct are read by other processes,
 	// so we have to use locks.
 	conn.Lock()
-	conn.forwardChan = forwardChan
-	conn.forwardChanDF = forwardChanDF
+	conn.forwardChans = forwardChans
+	conn.forwardChansDF = forwardChansDF
 	conn.stopForward = stopForward
-	conn.stopForwardDF = stopForwardDF
+	conn.forwardersFinished = finished
 	conn.verifyPMTU = verifyPMTU
-	conn.effectivePMTU = forwarder.unverifiedPMTU
+	conn.pinPMTU = pinPMTU
+	conn.rekeyChans = rekeyChans
+	conn.effectivePMTU = primaryDF.unverifiedPMTU
+	conn.rateLimiter = rateLimiter
+	conn.congestion = congestion
 	conn.Unlock()
+	conn.newSendersDF = newSendersDF
+	conn.forwardOverTCP = overTCP
 
-	forwarder.Start()
-	forwarderDF.Start()
+	for _, fwd := range forwarders {
+		fwd.Start()
+	}
 
 	return nil
 }
 
 func (conn *LocalConnection) stopForwarders() {
 	conn.Lock()
-	conn.forwardChan = nil
-	conn.forwardChanDF = nil
+	conn.forwardChans = nil
+	conn.forwardChansDF = nil
 	conn.Unlock()
+	conn.newSendersDF = nil
+	conn.forwardOverTCP = nil
 	// Now signal the forwarder loops to exit. They will drain the
 	// forwarder chans in order to unblock any router processes
 	// blocked on sending.
-	if conn.stopForward != nil {
-		conn.stopForward <- nil
-		conn.stopForwardDF <- nil
+	for _, stop := range conn.stopForward {
+		stop <- nil
+	}
+	conn.stopForward = nil
+}
+
+// Stop the forwarders once they have sent the frames already queued
+// for them, or when the deadline passes, whichever is sooner.
+func (conn *LocalConnection) drainForwarders(deadline time.Time) {
+	conn.Lock()
+	conn.forwardChans = nil
+	conn.forwardChansDF = nil
+	conn.Unlock()
+	for _, stop := range conn.stopForward {
+		stop <- deadline
+	}
+	conn.stopForward = nil
+	timeout := time.After(deadline.Sub(time.Now()))
+	for _, finished := range conn.forwardersFinished {
+		select {
+		case <-finished:
+		case <-timeout:
+			return
+		}
 	}
 }
 
@@ -87,51 +270,130 @@ func (conn *LocalConnection) stopForwarders() {
 func (conn *LocalConnection) Forward(df bool, frame *ForwardedFrame, dec *EthernetDecoder) error {
 	conn.RLock()
 	var (
-		forwardChan   = conn.forwardChan
-		forwardChanDF = conn.forwardChanDF
-		effectivePMTU = conn.effectivePMTU
-		stackFrag     = conn.stackFrag
+		forwardChans   = conn.forwardChans
+		forwardChansDF = conn.forwardChansDF
+		effectivePMTU  = conn.effectivePMTU
+		stackFrag      = conn.stackFrag
 	)
 	conn.RUnlock()
 
-	if forwardChan == nil || forwardChanDF == nil {
-		conn.log("Cannot forward frame yet - awaiting contact")
+	// The forwarders only exist once the connection is established
+	if forwardChans == nil || forwardChansDF == nil {
+		state, _ := conn.State()
+		conn.logger(logForwarder).Debug("Not forwarding frame while connection is", state)
+		return nil
+	}
+	// Without tags, the remote would take the frame to be on the
+	// default network.
+	if frame.tenant != 0 && !conn.tenantTags {
+		atomic.AddUint64(&conn.stats.TenantDrops, 1)
 		return nil
 	}
-	// We could use non-blocking channel sends here, i.e. drop frames
-	// on the floor when the forwarder is busy. This would allow our
-	// caller - the capturing loop in the router - to read frames more
-	// quickly when under load, i.e. we'd drop fewer frames on the
-	// floor during capture. And we could maximise CPU utilisation
-	// since we aren't stalling a thread. However, a lot of work has
-	// already been done by the time we get here. Since any packet we
-	// drop will likely get re-transmitted we end up paying that cost
-	// multiple times. So it's better to drop things at the beginning
-	// of our pipeline.
+	if dec != nil {
+		conn.Router.Taps.Frame(conn, true, frame.srcPeer.Name, frame.frame, dec)
+		conn.countFrameSize(true, len(frame.frame))
+	}
+	// Callers may forward the same frame again, e.g. heartbeats, while
+	// forwarders still have it queued, so what we decide here goes
+	// in a copy.
+	queued := *frame
+	frame = &queued
+	// Frames we make up ourselves, such as heartbeats, aren't real
+	// Ethernet, so they stay in our own format. VXLAN has no room for
+	// the peers a frame is from and to, so only frames we send the
+	// remote for its own hosts can go as VXLAN; Geneve says who they
+	// are in its options.
+	frame.encap = dec != nil && (conn.encap == EncapGeneve ||
+		conn.encap == EncapVXLAN && frame.srcPeer == conn.local && frame.dstPeer == conn.remote)
+	// With several forwarders, all frames of a flow go to the same
+	// one, so they don't get reordered. Frames we make up ourselves,
+	// such as heartbeats, don't come with a decoder, and jump the
+	// queue.
+	worker, class := 0, ClassInteractive
+	if dec != nil {
+		class = dec.TrafficClass()
+		frame.class = class
+		if len(forwardChans) > 1 {
+			worker = int(dec.FlowHash() % uint32(len(forwardChans)))
+		}
+	}
+	forwardChan, forwardChanDF := forwardChans[worker][class], forwardChansDF[worker][class]
+	// What happens when the forwarder is busy is governed by the
+	// drop policy; see enqueue.
 	if df {
 		if !frameTooBig(frame, effectivePMTU) {
-			forwardChanDF <- frame
+			conn.enqueue(forwardChanDF, frame)
 			return nil
 		}
+		atomic.AddUint64(&conn.stats.PMTUDrops, 1)
 		return FrameTooBigError{EPMTU: effectivePMTU}
 	} else {
-		if stackFrag || dec == nil || len(dec.decoded) < 2 {
-			forwardChan <- frame
+		if stackFrag || dec == nil || !(dec.IsIPv4() || dec.IsIPv6()) {
+			conn.enqueue(forwardChan, frame)
 			return nil
 		}
 		// Don't have trustworthy stack, so we're going to have to
 		// send it DF in any case.
 		if !frameTooBig(frame, effectivePMTU) {
-			forwardChanDF <- frame
+			conn.enqueue(forwardChanDF, frame)
 			return nil
 		}
 		conn.Router.LogFrame("Fragmenting", frame.frame, &dec.eth)
+		atomic.AddUint64(&conn.stats.Fragmentations, 1)
 		// We can't trust the stack to fragment, we have IP, and we
 		// have a frame that's too big for the MTU, so we have to
 		// fragment it ourself.
-		return fragment(dec.eth, dec.ip, effectivePMTU, frame, func(segFrame *ForwardedFrame) {
-			forwardChanDF <- segFrame
-		})
+		forward := func(segFrame *ForwardedFrame) {
+			conn.enqueue(forwardChanDF, segFrame)
+		}
+		if dec.IsIPv6() {
+			err := fragmentIPv6(dec.eth, dec.ip6, effectivePMTU, frame, forward)
+			if _, ok := err.(FrameTooBigError); ok {
+				atomic.AddUint64(&conn.stats.PMTUDrops, 1)
+			}
+			return err
+		}
+		return fragment(dec.eth, dec.ip, effectivePMTU, frame, forward)
+	}
+}
+
+// Hand a frame to a forwarder, applying the connection's drop policy
+// when the forwarder's channel is full.
+//
+// Blocking is the default. A lot of work has already been done by the
+// time we get here, and since any frame we drop will likely get
+// re-transmitted we end up paying that cost multiple times. So it's
+// generally better to drop things at the beginning of our pipeline,
+// i.e. during capture. However, blocking stalls our caller - the
+// capturing loop or UDP listener in the router - and thus all other
+// connections too, so a single slow peer can hold up everything. The
+// dropping policies prevent that.
+func (conn *LocalConnection) enqueue(ch chan *ForwardedFrame, frame *ForwardedFrame) {
+	frame.buf.Retain()
+	switch conn.dropPolicy {
+	case DropNewest:
+		select {
+		case ch <- frame:
+		default:
+			atomic.AddUint64(&conn.stats.QueueDrops, 1)
+			frame.buf.Release()
+		}
+	case DropOldest:
+		for {
+			select {
+			case ch <- frame:
+				return
+			default:
+			}
+			select {
+			case dropped := <-ch:
+				atomic.AddUint64(&conn.stats.QueueDrops, 1)
+				dropped.buf.Release()
+			default:
+			}
+		}
+	default:
+		ch <- frame
 	}
 }
 
@@ -193,7 +455,85 @@ func fragment(eth layers.Ethernet, ip layers.IPv4, pmtu int, frame *ForwardedFra
 		}
 		// make copies of the frame we received
 		segFrame := *frame
-		segFrame.frame = buf.Bytes()
+		segFrame.frame, segFrame.buf = buf.Bytes(), nil
+		forward(&segFrame)
+	}
+	return nil
+}
+
+var ipv6FragmentId uint32
+
+// IPv6 fragmentation, as per RFC 2460, section 4.5. We only cope with
+// packets whose first extension header, if any, is a Fragment header,
+// i.e. we don't have to worry about the unfragmentable part of the
+// packet. For other packets we return a FrameTooBigError. Already
+// fragmented packets get fragmented further, keeping their
+// identification.
+func fragmentIPv6(eth layers.Ethernet, ip layers.IPv6, pmtu int, frame *ForwardedFrame, forward func(*ForwardedFrame)) error {
+	const (
+		headerSize     = 40
+		fragHeaderSize = 8
+	)
+	payload := ip.BaseLayer.Payload
+	if int(ip.Length) < len(payload) {
+		payload = payload[:ip.Length]
+	}
+	var (
+		nextHeader = ip.NextHeader
+		offsetBase = 0
+		moreFrags  = false
+		identifier uint32
+	)
+	switch nextHeader {
+	case layers.IPProtocolIPv6Fragment:
+		if len(payload) < fragHeaderSize {
+			return fmt.Errorf("IPv6 fragment header truncated")
+		}
+		nextHeader = layers.IPProtocol(payload[0])
+		offsetBase = int(binary.BigEndian.Uint16(payload[2:4]) &^ 7)
+		moreFrags = payload[3]&1 != 0
+		identifier = binary.BigEndian.Uint32(payload[4:8])
+		payload = payload[fragHeaderSize:]
+	case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing, layers.IPProtocolIPv6Destination:
+		// Leave it to the sender, via ICMPv6 Packet Too Big
+		return FrameTooBigError{EPMTU: pmtu}
+	default:
+		identifier = atomic.AddUint32(&ipv6FragmentId, 1)
+	}
+	maxSegmentSize := (pmtu - headerSize - fragHeaderSize) &^ 7
+	if maxSegmentSize <= 0 {
+		return fmt.Errorf("PMTU %d too small to fragment IPv6 packet", pmtu)
+	}
+	opts := gopacket.SerializeOptions{
+		FixLengths:       false,
+		ComputeChecksums: true}
+	ip.NextHeader = layers.IPProtocolIPv6Fragment
+	eth.Length = 0
+	fragHeader := make([]byte, fragHeaderSize)
+	fragHeader[0] = byte(nextHeader)
+	binary.BigEndian.PutUint32(fragHeader[4:], identifier)
+	for offset := 0; offset < len(payload); offset += maxSegmentSize {
+		segmentPayload := payload[offset:]
+		more := moreFrags
+		if len(segmentPayload) > maxSegmentSize {
+			segmentPayload = segmentPayload[:maxSegmentSize]
+			more = true
+		}
+		offsetFlags := uint16(offset + offsetBase)
+		if more {
+			offsetFlags |= 1
+		}
+		binary.BigEndian.PutUint16(fragHeader[2:4], offsetFlags)
+		ip.Length = uint16(fragHeaderSize + len(segmentPayload))
+		buf := gopacket.NewSerializeBuffer()
+		segPayload := gopacket.Payload(Concat(fragHeader, segmentPayload))
+		err := gopacket.SerializeLayers(buf, opts, &eth, &ip, &segPayload)
+		if err != nil {
+			return err
+		}
+		// make copies of the frame we received
+		segFrame := *frame
+		segFrame.frame, segFrame.buf = buf.Bytes(), nil
 		forward(&segFrame)
 	}
 	return nil
@@ -203,30 +543,66 @@ func fragment(eth layers.Ethernet, ip layers.IPv4, pmtu int, frame *ForwardedFra
 
 type Forwarder struct {
 	conn            *LocalConnection
-	ch              <-chan *ForwardedFrame
+	queues          forwardQueues
+	classCredits    [NumTrafficClasses]int // frames of each class left to take this turn
 	stop            <-chan interface{}
 	verifyPMTUTick  <-chan time.Time
+	probePMTUTick   <-chan time.Time
+	checkPMTUTick   <-chan time.Time
 	verifyPMTU      <-chan int
+	tooBig          <-chan int // PMTUs the other DF forwarders ran into
+	reportTooBig    chan<- int // where we report those, if we aren't the first DF forwarder
+	pinPMTU         <-chan int
+	newSender       <-chan UDPSender // replaces udpSender when the remote's underlay address changes
+	overTCP         <-chan struct{}  // closed when the connection falls back to TCP
+	sendingOverTCP  bool
+	rekey           <-chan *[32]byte
 	pmtuVerifyCount uint
 	enc             Encryptor
 	udpSender       UDPSender
+	encap           UDPSender // for frames which can go in the connection's encapsulation; nil if none can
+	encapBuf        []byte
 	maxPayload      int
+	udpOverhead     int
 	pmtuVerified    bool
+	checkingPMTU    bool // whether we are checking the verified PMTU still holds, rather than discovering it
+	pinnedPMTU      int  // overrides discovery when non-zero
 	highestGoodPMTU int
 	unverifiedPMTU  int
 	lowestBadPMTU   int
+	paceDelay       time.Duration
+	flushDelay      time.Duration // longest a frame may wait for others to go out with
+	finished        chan struct{} // closed when run exits
+	frames          int           // frames in the packet being assembled
+	frameBytes      int           // bytes of those frames
+	heartbeat       bool          // whether they include a heartbeat
+	class           TrafficClass  // the most urgent class of them
+	rateLimiter     *TokenBucket
+	padBuckets      []int // sizes to pad packets up to
+	compressing     bool
+	sealPool        *SealPool
+	sealing         sealQueue // packets handed to the pool, in order
+	taps            *FrameTaps
 }
 
-func NewForwarder(conn *LocalConnection, ch <-chan *ForwardedFrame, stop <-chan interface{}, verifyPMTU <-chan int, enc Encryptor, udpSender UDPSender, pmtu int) *Forwarder {
+func NewForwarder(conn *LocalConnection, queues forwardQueues, stop <-chan interface{}, verifyPMTU <-chan int, rekey <-chan *[32]byte, enc Encryptor, udpSender UDPSender, pmtu int) *Forwarder {
 	fwd := &Forwarder{
-		conn:       conn,
-		ch:         ch,
-		stop:       stop,
-		verifyPMTU: verifyPMTU,
-		enc:        enc,
-		udpSender:  udpSender}
+		conn:        conn,
+		queues:      queues,
+		stop:        stop,
+		verifyPMTU:  verifyPMTU,
+		rekey:       rekey,
+		enc:         enc,
+		udpSender:   udpSender,
+		udpOverhead: udpOverhead(conn),
+		padBuckets:  conn.Router.PaddingBuckets,
+		compressing: conn.compressing,
+		sealPool:    conn.Router.SealPool,
+		taps:        conn.Router.Taps,
+		flushDelay:  conn.Router.CurrentTuning().FlushDelay,
+		finished:    make(chan struct{})}
 	fwd.unverifiedPMTU = pmtu - fwd.effectiveOverhead()
-	fwd.maxPayload = pmtu - UDPOverhead
+	fwd.maxPayload = pmtu - fwd.udpOverhead
 	return fwd
 }
 
@@ -234,14 +610,33 @@ func (fwd *Forwarder) Start() {
 	go fwd.run()
 }
 
+// Make the forwarder verify its initial PMTU as soon as it starts,
+// searching downwards from there if verification fails. Must be
+// called before Start.
+func (fwd *Forwarder) resumeVerification() {
+	fwd.highestGoodPMTU = 8
+	fwd.lowestBadPMTU = fwd.unverifiedPMTU + 1
+	fwd.pmtuVerifyCount = PMTUVerifyAttempts
+}
+
 func (fwd *Forwarder) run() {
-	defer fwd.udpSender.Shutdown()
-	var flushed, ok bool
+	defer close(fwd.finished)
+	defer func() { fwd.udpSender.Shutdown() }() // which may have been replaced
+	defer func() {
+		if fwd.encap != nil {
+			fwd.encap.Shutdown()
+		}
+	}()
+	if fwd.pmtuVerifyCount > 0 {
+		fwd.verifyEffectivePMTU(fwd.unverifiedPMTU)
+	}
 	var frame *ForwardedFrame
 	for {
-		flushed = false
 		select {
-		case <-fwd.stop:
+		case stop := <-fwd.stop:
+			if deadline, ok := stop.(time.Time); ok {
+				fwd.sendQueued(deadline)
+			}
 			fwd.drain()
 			return
 		case <-fwd.verifyPMTUTick:
@@ -255,7 +650,15 @@ func (fwd *Forwarder) run() {
 			if fwd.pmtuVerifyCount > 0 {
 				fwd.pmtuVerifyCount--
 				fwd.attemptVerifyEffectivePMTU()
-			} else {
+			} else if fwd.checkingPMTU && !fwd.hearingFromRemote() {
+				// Nothing gets through, whatever its size, which is
+				// for heartbeats to deal with.
+				fwd.checkingPMTU = false
+				fwd.pmtuVerified = true
+				fwd.checkPMTUTick = time.After(PMTUCheckInterval)
+			} else if fwd.checkingPMTU {
+				fwd.blackholed()
+			} else if !fwd.checksumsNeeded() {
 				// we've exceeded the verification attempts of the
 				// unverifiedPMTU
 				fwd.lowestBadPMTU = fwd.unverifiedPMTU
@@ -270,39 +673,205 @@ func (fwd *Forwarder) run() {
 				fwd.verifyEffectivePMTU((fwd.highestGoodPMTU + fwd.lowestBadPMTU) / 2)
 			} else {
 				fwd.pmtuVerified = true
-				fwd.maxPayload = epmtu + fwd.effectiveOverhead() - UDPOverhead
+				fwd.checkPMTUTick = time.After(PMTUCheckInterval)
+				if fwd.checkingPMTU {
+					fwd.checkingPMTU = false
+					continue
+				}
+				fwd.maxPayload = epmtu + fwd.effectiveOverhead() - fwd.udpOverhead
 				fwd.conn.setEffectivePMTU(epmtu)
-				fwd.conn.log("Effective PMTU verified at", epmtu)
+				fwd.conn.logger(logPMTU).Info("Effective PMTU verified at", epmtu)
+				if !fwd.conn.UsingTCPFallback() {
+					fwd.conn.Router.PMTUs.Enter(fwd.conn.RemoteUDPAddr().IP, epmtu+fwd.effectiveOverhead())
+				}
+				if epmtu < fwd.probeCeiling() && fwd.probePMTUTick == nil {
+					fwd.probePMTUTick = time.After(PMTUProbeInterval)
+				}
+			}
+		case key := <-fwd.rekey:
+			// Nothing is buffered at this point, so all subsequent
+			// packets use the new key.
+			fwd.enc.Rekey(key)
+		case <-fwd.probePMTUTick:
+			// As with verifyPMTUTick, we only get here when the
+			// buffers are empty.
+			fwd.probePMTUTick = nil
+			if fwd.pmtuVerified && fwd.pinnedPMTU == 0 {
+				fwd.probeLargerPMTU()
+			}
+		case <-fwd.checkPMTUTick:
+			// Likewise.
+			fwd.checkPMTUTick = nil
+			fwd.checkPMTU()
+		case pmtu := <-fwd.tooBig:
+			fwd.handleSendError(MsgTooBigError{PMTU: pmtu})
+		case pmtu := <-fwd.pinPMTU:
+			fwd.pin(pmtu)
+		case <-fwd.overTCP:
+			// Likewise, so nothing is left in the old senders.
+			fwd.sendOverTCP()
+		case sender := <-fwd.newSender:
+			// Likewise, so nothing is left in the old sender.
+			if fwd.sendingOverTCP {
+				sender.Shutdown()
+				continue
+			}
+			fwd.udpSender.Shutdown()
+			fwd.udpSender = sender
+			// The path, and its PMTU, may have changed along with
+			// the address.
+			if fwd.verifyPMTU != nil && fwd.pmtuVerified && fwd.pinnedPMTU == 0 {
+				fwd.checkPMTUTick = nil
+				fwd.recheckPMTU()
+			}
+		case frame = <-fwd.queues[ClassInteractive]:
+			fwd.forwardFrames(frame)
+		case frame = <-fwd.queues[ClassDefault]:
+			fwd.forwardFrames(frame)
+		case frame = <-fwd.queues[ClassBulk]:
+			fwd.forwardFrames(frame)
+		}
+	}
+}
+
+// Send over the connection's TCP stream from now on. We keep our
+// encryptor, so the packets carry on from the nonces it had reached
+// rather than starting over under the same key. VXLAN and Geneve only
+// go over UDP, so we stop sending frames in them.
+func (fwd *Forwarder) sendOverTCP() {
+	fwd.overTCP = nil
+	fwd.sendingOverTCP = true
+	fwd.udpSender.Shutdown()
+	fwd.udpSender = NewTCPFallbackSender(fwd.conn)
+	if fwd.encap != nil {
+		fwd.encap.Shutdown()
+		fwd.encap = nil
+	}
+}
+
+// Send the frame, along with whatever else is queued by then, packing
+// as many frames into each packet as fit. At low rates the queues
+// drain straight away, and the frame goes on its own. At high rates
+// they may never drain, so we don't hold frames back for longer than
+// the flush delay waiting for others to fill their packet, or the
+// batch of packets it goes out in.
+func (fwd *Forwarder) forwardFrames(frame *ForwardedFrame) {
+	if fwd.reportTooBig != nil {
+		fwd.followPMTU()
+	}
+	if !fwd.appendFrame(frame) {
+		fwd.logDrop(frame)
+		return
+	}
+	deadline := time.Now().Add(fwd.flushDelay)
+	for {
+		frame, ok := fwd.nextFrame()
+		if !ok {
+			if !fwd.enc.IsEmpty() {
+				fwd.flush()
 			}
-		case frame = <-fwd.ch:
+			fwd.flushSender()
+			return
+		}
+		if !fwd.appendFrame(frame) {
+			fwd.flush()
 			if !fwd.appendFrame(frame) {
 				fwd.logDrop(frame)
-				continue
+				return
 			}
-			for !flushed {
-				select {
-				case frame, ok = <-fwd.ch:
-					if !ok {
-						return
-					}
-					if !fwd.appendFrame(frame) {
-						fwd.flush()
-						if !fwd.appendFrame(frame) {
-							fwd.logDrop(frame)
-							flushed = true
-						}
-					}
-				default:
-					fwd.flush()
-					flushed = true
-				}
+		}
+		if fwd.flushDelay > 0 && !time.Now().Before(deadline) {
+			if !fwd.enc.IsEmpty() {
+				fwd.flush()
 			}
+			fwd.flushSender()
+			atomic.AddUint64(&fwd.conn.stats.TimedFlushes, 1)
+			deadline = time.Now().Add(fwd.flushDelay)
 		}
 	}
 }
 
+// The largest effective PMTU worth trying, given the interface MTUs
+// at both ends; 0 if we don't know.
+func (fwd *Forwarder) maxEffectivePMTU() int {
+	if fwd.conn.maxPMTU == 0 {
+		return 0
+	}
+	return fwd.conn.maxPMTU - fwd.effectiveOverhead()
+}
+
+// The largest effective PMTU to probe for: the most the interfaces
+// allow, or, if we don't know that, the most UDP allows.
+func (fwd *Forwarder) probeCeiling() int {
+	if pmtu := fwd.maxEffectivePMTU(); pmtu > 0 {
+		return pmtu
+	}
+	return DefaultPMTU - fwd.effectiveOverhead()
+}
+
+// The path may allow larger packets than when we last verified the
+// PMTU, e.g. because it has changed, or because we had to fall back
+// to a lower PMTU at some point. We try the largest PMTU the
+// interfaces at both ends allow, searching downwards to our current
+// PMTU. We keep using the current PMTU in the meantime.
+func (fwd *Forwarder) probeLargerPMTU() {
+	fwd.conn.logger(logPMTU).Info("Probing for PMTU larger than", fwd.unverifiedPMTU)
+	fwd.pmtuVerified = false
+	fwd.highestGoodPMTU = fwd.unverifiedPMTU
+	fwd.lowestBadPMTU = fwd.probeCeiling() + 1
+	fwd.verifyEffectivePMTU(fwd.probeCeiling())
+}
+
+// The path may also stop carrying packets as large as it did, e.g.
+// because it now goes through a VPN, and if nothing tells us so with
+// an ICMP error, large frames vanish while small ones, such as
+// heartbeats, still get through. So every so often, if large frames
+// have gone over the connection, we check that the PMTU still holds.
+func (fwd *Forwarder) checkPMTU() {
+	if !fwd.pmtuVerified || fwd.pinnedPMTU != 0 {
+		return // whatever is going on resets the tick when done
+	}
+	if !atomic.CompareAndSwapInt32(&fwd.conn.largeFrames, 1, 0) {
+		fwd.checkPMTUTick = time.After(PMTUCheckInterval)
+		return
+	}
+	fwd.recheckPMTU()
+}
+
+// Verify the current PMTU again, falling back if it no longer gets
+// through; see blackholed.
+func (fwd *Forwarder) recheckPMTU() {
+	fwd.checkingPMTU = true
+	fwd.pmtuVerified = false
+	fwd.highestGoodPMTU = 8
+	fwd.lowestBadPMTU = fwd.unverifiedPMTU + 1
+	fwd.verifyEffectivePMTU(fwd.unverifiedPMTU)
+}
+
+// The verified PMTU no longer gets through, though the remote is
+// still there. We fall back to a size that gets through anywhere
+// while we discover the PMTU again from scratch.
+func (fwd *Forwarder) blackholed() {
+	fwd.conn.logger(logPMTU).Info("Frames of", fwd.unverifiedPMTU, "no longer get through; rediscovering PMTU")
+	atomic.AddUint64(&fwd.conn.stats.PMTUBlackholes, 1)
+	fwd.checkingPMTU = false
+	fwd.lowestBadPMTU = fwd.unverifiedPMTU
+	if safePMTU := MinPathMTU - fwd.effectiveOverhead(); safePMTU < fwd.unverifiedPMTU {
+		fwd.maxPayload = MinPathMTU - fwd.udpOverhead
+		fwd.conn.setEffectivePMTU(safePMTU)
+	}
+	fwd.verifyEffectivePMTU((fwd.highestGoodPMTU + fwd.lowestBadPMTU) / 2)
+}
+
+// Whether we have heard from the remote recently enough to take it
+// that it's still there.
+func (fwd *Forwarder) hearingFromRemote() bool {
+	since, ok := fwd.conn.SinceLastHeartbeat()
+	return ok && since < 2*fwd.conn.Router.CurrentTuning().SlowHeartbeat
+}
+
 func (fwd *Forwarder) effectiveOverhead() int {
-	return UDPOverhead + fwd.enc.PacketOverhead() + fwd.enc.FrameOverhead() + EthernetOverhead
+	return fwd.udpOverhead + fwd.enc.PacketOverhead() + fwd.enc.FrameOverhead() + EthernetOverhead
 }
 
 func (fwd *Forwarder) verifyEffectivePMTU(newUnverifiedPMTU int) {
@@ -318,6 +887,7 @@ func (fwd *Forwarder) attemptVerifyEffectivePMTU() {
 		frame:   make([]byte, fwd.unverifiedPMTU+EthernetOverhead)}
 	fwd.enc.AppendFrame(pmtuVerifyFrame)
 	fwd.flush()
+	fwd.flushSender()
 	if fwd.verifyPMTUTick == nil {
 		fwd.verifyPMTUTick = time.After(PMTUVerifyTimeout << (PMTUVerifyAttempts - fwd.pmtuVerifyCount))
 	}
@@ -325,48 +895,260 @@ func (fwd *Forwarder) attemptVerifyEffectivePMTU() {
 
 func (fwd *Forwarder) appendFrame(frame *ForwardedFrame) bool {
 	frameLen := len(frame.frame)
+	if frame.encap && fwd.encap != nil && fwd.sendEncapsulated(frame) {
+		return true
+	}
 	if fwd.enc.TotalLen()+fwd.enc.FrameOverhead()+frameLen > fwd.maxPayload {
 		return false
 	}
+	heartbeat := frame.heartbeat
+	if heartbeat {
+		frame = fwd.conn.stampHeartbeat(frame)
+	}
+	if frameLen+fwd.effectiveOverhead() > MinPathMTU && atomic.LoadInt32(&fwd.conn.largeFrames) == 0 {
+		atomic.StoreInt32(&fwd.conn.largeFrames, 1)
+	}
+	if fwd.frames == 0 || frame.class < fwd.class {
+		fwd.class = frame.class
+	}
 	fwd.enc.AppendFrame(frame)
+	// Once in the packet, the frame no longer needs its buffer
+	frame.buf.Release()
+	atomic.AddUint64(&fwd.conn.stats.FramesForwarded, 1)
+	atomic.AddUint64(&fwd.conn.stats.BytesForwarded, uint64(frameLen))
+	fwd.frames++
+	fwd.frameBytes += frameLen
+	fwd.heartbeat = fwd.heartbeat || heartbeat
 	return true
 }
 
 func (fwd *Forwarder) flush() {
-	err := fwd.udpSender.Send(fwd.enc.Bytes())
+	if fwd.frames > 0 {
+		// PMTU verification frames must go out at just their size
+		fwd.compress()
+		fwd.pad()
+	}
+	frames, frameBytes, heartbeat, class := fwd.frames, fwd.frameBytes, fwd.heartbeat, fwd.class
+	fwd.frames, fwd.frameBytes, fwd.heartbeat = 0, 0, false
+	// PMTU verification frames go like any other traffic
+	if frames == 0 {
+		class = ClassDefault
+	}
+	if deferred, ok := fwd.enc.(DeferredEncryptor); ok && fwd.sealPool != nil {
+		job := &sealJob{seal: deferred.DeferredBytes(), frames: frames, frameBytes: frameBytes, heartbeat: heartbeat, class: class}
+		fwd.sealPool.Seal(job)
+		fwd.sealing.push(job)
+		fwd.sendSealed(len(fwd.sealing) >= SealWindow)
+		return
+	}
+	fwd.send(fwd.enc.Bytes(), frames, frameBytes, heartbeat, class)
+}
+
+// Send the packets at the head of the sealing queue whose sealing has
+// finished, and, with wait, at least the first one.
+func (fwd *Forwarder) sendSealed(wait bool) {
+	for {
+		job, ok := fwd.sealing.pop(wait)
+		if !ok {
+			return
+		}
+		fwd.send(job.packet, job.frames, job.frameBytes, job.heartbeat, job.class)
+		wait = false
+	}
+}
+
+func (fwd *Forwarder) send(packet []byte, frames, frameBytes int, heartbeat bool, class TrafficClass) {
+	// Heartbeats are exempt from rate limiting, lest the connection
+	// appear dead when busy.
+	if fwd.rateLimiter != nil && !fwd.rateLimiter.Take(len(packet)) && !heartbeat {
+		atomic.AddUint64(&fwd.conn.stats.RateLimitDrops, uint64(frames))
+		return
+	}
+	fwd.pace()
+	atomic.AddUint64(&fwd.conn.stats.PacketsSent, 1)
+	atomic.AddUint64(&fwd.conn.stats.BytesSent, uint64(len(packet)))
+	atomic.AddUint64(&fwd.conn.stats.Overhead, uint64(len(packet)-frameBytes))
+	fwd.taps.Packet(fwd.conn, true, Port, fwd.conn.RemoteUDPAddr(), packet)
+	fwd.mark(fwd.udpSender, class, fwd.conn.ecn)
+	fwd.handleSendError(fwd.udpSender.Send(packet))
+}
+
+// Push out packets the UDP sender may be holding on to for batching.
+func (fwd *Forwarder) flushSender() {
+	for len(fwd.sealing) > 0 {
+		fwd.sendSealed(true)
+	}
+	fwd.handleSendError(fwd.udpSender.Flush())
+	if fwd.encap != nil {
+		fwd.handleSendError(fwd.encap.Flush())
+	}
+}
+
+// Fix the effective PMTU, without verifying it, or with 0, go back to
+// discovering it, starting from the top.
+func (fwd *Forwarder) pin(pmtu int) {
+	if pmtu == fwd.pinnedPMTU {
+		return
+	}
+	fwd.pinnedPMTU = pmtu
+	fwd.verifyPMTUTick, fwd.probePMTUTick, fwd.checkPMTUTick = nil, nil, nil
+	fwd.checkingPMTU = false
+	if pmtu == 0 {
+		fwd.conn.logger(logPMTU).Info("PMTU no longer pinned")
+		fwd.pmtuVerified = false
+		fwd.unverifiedPMTU = DefaultPMTU - fwd.effectiveOverhead()
+		fwd.resumeVerification()
+		fwd.verifyEffectivePMTU(fwd.unverifiedPMTU)
+		return
+	}
+	fwd.conn.logger(logPMTU).Info("PMTU pinned to", pmtu)
+	fwd.pmtuVerified = true
+	fwd.unverifiedPMTU = pmtu
+	fwd.maxPayload = pmtu + fwd.effectiveOverhead() - fwd.udpOverhead
+	fwd.conn.setEffectivePMTU(pmtu)
+}
+
+// DF forwarders other than the first leave PMTU discovery to it, and
+// just pick up the resulting effective PMTU.
+func (fwd *Forwarder) followPMTU() {
+	fwd.unverifiedPMTU = fwd.conn.EffectivePMTU()
+	fwd.maxPayload = fwd.unverifiedPMTU + fwd.effectiveOverhead() - fwd.udpOverhead
+}
+
+func (fwd *Forwarder) handleSendError(err error) {
 	if err != nil {
-		if mtbe, ok := err.(MsgTooBigError); ok {
+		if mtbe, ok := err.(MsgTooBigError); ok && fwd.reportTooBig != nil {
+			select {
+			case fwd.reportTooBig <- mtbe.PMTU:
+			default: // the first forwarder will find out for itself
+			}
+		} else if ok && fwd.pinnedPMTU > 0 {
+			fwd.conn.logger(logPMTU).Info("Sending failed with PMTU", mtbe.PMTU, "below the pinned PMTU")
+		} else if ok {
 			newUnverifiedPMTU := mtbe.PMTU - fwd.effectiveOverhead()
+			if max := fwd.maxEffectivePMTU(); max > 0 && newUnverifiedPMTU > max {
+				// No point trying anything larger than the
+				// remote's interface can receive.
+				newUnverifiedPMTU = max
+			}
 			if newUnverifiedPMTU >= fwd.unverifiedPMTU {
 				return
 			}
 			fwd.pmtuVerified = false
-			fwd.maxPayload = mtbe.PMTU - UDPOverhead
+			fwd.checkingPMTU = false
+			fwd.maxPayload = newUnverifiedPMTU + fwd.effectiveOverhead() - fwd.udpOverhead
 			fwd.highestGoodPMTU = 8
 			fwd.lowestBadPMTU = newUnverifiedPMTU + 1
 			fwd.conn.setEffectivePMTU(newUnverifiedPMTU)
 			fwd.verifyEffectivePMTU(newUnverifiedPMTU)
 		} else if PosixError(err) == syscall.ENOBUFS {
-			// TODO handle this better
+			fwd.backOff()
+		} else if _, raw := fwd.udpSender.(*RawUDPSender); raw && PosixError(err) == syscall.EADDRNOTAVAIL {
+			fwd.underlayAddrGone(err)
 		} else {
 			fwd.conn.Shutdown(err)
 		}
+	} else if fwd.paceDelay > 0 {
+		fwd.paceDelay /= 2
+		if fwd.paceDelay < MinPaceDelay {
+			fwd.paceDelay = 0
+		}
 	}
 }
 
-func (fwd *Forwarder) drain() {
-	// We want to drain before exiting otherwise we could get the
-	// packet sniffer or udp listener blocked on sending to a full
-	// chan
-	for {
-		select {
-		case <-fwd.ch:
-		default:
+// Our underlay address went away, e.g. with a DHCP renewal, so the
+// raw socket bound to it can't send any more. We send from the UDP
+// listener instead, until we know better. The control connection is
+// bound to the old address too, so is as good as dead.
+func (fwd *Forwarder) underlayAddrGone(err error) {
+	sender, senderErr := NewSimpleUDPSender(fwd.conn)
+	if senderErr != nil {
+		fwd.conn.Shutdown(err)
+		return
+	}
+	fwd.conn.logger(logForwarder).Info("Underlay address gone; sending DF packets from the UDP listener")
+	fwd.udpSender.Shutdown()
+	fwd.udpSender = sender
+	if fwd.conn.roaming {
+		fwd.conn.RLock()
+		tcpConn := fwd.conn.TCPConn
+		fwd.conn.RUnlock()
+		fwd.conn.controlLost(tcpConn, err)
+	}
+}
+
+// Sending failed with ENOBUFS, i.e. we are sending faster than the
+// kernel can get packets out of the door. The sender has kept hold of
+// the packets it couldn't send, so we back off, with exponentially
+// increasing delays, and retry them. The delay decays again on
+// successful sends, but until then we pause before every send.
+func (fwd *Forwarder) backOff() {
+	for attempt := 0; attempt < ENOBUFSRetries; attempt++ {
+		atomic.AddUint64(&fwd.conn.stats.ENOBUFS, 1)
+		if attempt == 0 {
+			fwd.growSendBuffer()
+		}
+		fwd.paceDelay *= 2
+		if fwd.paceDelay < MinPaceDelay {
+			fwd.paceDelay = MinPaceDelay
+		} else if fwd.paceDelay > MaxPaceDelay {
+			fwd.paceDelay = MaxPaceDelay
+		}
+		fwd.pace()
+		if err := fwd.udpSender.Flush(); err == nil {
 			return
+		} else if PosixError(err) != syscall.ENOBUFS {
+			fwd.handleSendError(err)
+			return
+		}
+	}
+	// Give up for now. The packets stay with the sender, and are
+	// retried with the next send.
+}
+
+func (fwd *Forwarder) pace() {
+	if fwd.paceDelay > 0 {
+		time.Sleep(fwd.paceDelay)
+		atomic.AddUint64(&fwd.conn.stats.PacingTime, uint64(fwd.paceDelay))
+	}
+}
+
+func (fwd *Forwarder) growSendBuffer() {
+	maxSndBuf := fwd.conn.Router.MaxSndBuf
+	if maxSndBuf <= 0 {
+		return
+	}
+	if size, grown, err := fwd.udpSender.GrowSendBuffer(maxSndBuf); err != nil {
+		fwd.conn.logger(logForwarder).Info("Unable to grow socket send buffer:", err)
+	} else if grown {
+		atomic.AddUint64(&fwd.conn.stats.SndBufGrowths, 1)
+		fwd.conn.logger(logForwarder).Info("Grew socket send buffer to", size, "bytes")
+	}
+}
+
+// Send the frames still queued for us, giving up at the deadline.
+func (fwd *Forwarder) sendQueued(deadline time.Time) {
+	for time.Now().Before(deadline) {
+		frame, ok := fwd.nextFrame()
+		if !ok {
+			if !fwd.enc.IsEmpty() {
+				fwd.flush()
+			}
+			fwd.flushSender()
+			return
+		}
+		if !fwd.appendFrame(frame) {
+			fwd.flush()
+			if !fwd.appendFrame(frame) {
+				fwd.logDrop(frame)
+			}
 		}
 	}
 }
 
 func (fwd *Forwarder) logDrop(frame *ForwardedFrame) {
-	fwd.conn.log("Dropping too big frame during forwarding: frame len:", len(frame.frame), "; effective PMTU:", fwd.maxPayload+UDPOverhead-fwd.effectiveOverhead())
+	atomic.AddUint64(&fwd.conn.stats.PMTUDrops, 1)
+	fwd.conn.tooBigDrops.Drop(fwd.conn.logger(logForwarder), frame.frame,
+		"Dropping too big frame during forwarding: frame len:", len(frame.frame), "; effective PMTU:", fwd.maxPayload+fwd.udpOverhead-fwd.effectiveOverhead())
+	frame.buf.Release()
 }
@@ -0,0 +1,291 @@
+package router
+
+import (
+	"bytes"
+	"code.google.com/p/gopacket"
+	"code.google.com/p/gopacket/layers"
+	"fmt"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func checkEnqueue(t *testing.T, policy DropPolicy, wantedFrames ...byte) {
+	conn := &LocalConnection{dropPolicy: policy, stats: &ConnectionStats{}}
+	ch := make(chan *ForwardedFrame, 2)
+	for i := byte(0); i < 4; i++ {
+		conn.enqueue(ch, &ForwardedFrame{frame: []byte{i}})
+	}
+	close(ch)
+	frames := []byte{}
+	for frame := range ch {
+		frames = append(frames, frame.frame[0])
+	}
+	wt.AssertEqualString(t, string(frames), string(wantedFrames), policy.String()+" frames")
+	wt.AssertEqualuint64(t, conn.ConnectionStats().QueueDrops, 2, policy.String()+" drops")
+}
+
+func TestEnqueueDropPolicies(t *testing.T) {
+	checkEnqueue(t, DropNewest, 0, 1)
+	checkEnqueue(t, DropOldest, 2, 3)
+	for name, _ := range map[string]bool{"block": true, "drop-oldest": true, "drop-newest": true} {
+		policy, err := ParseDropPolicy(name)
+		wt.AssertNoErr(t, err)
+		wt.AssertEqualString(t, policy.String(), name, "policy name")
+	}
+	if _, err := ParseDropPolicy("bogus"); err == nil {
+		wt.Fatalf(t, "Expected error parsing bogus policy")
+	}
+}
+
+func TestFragmentIPv6(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	data := make([]byte, 3000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	payload := gopacket.Payload(data)
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeIPv6},
+		&layers.IPv6{Version: 6, NextHeader: layers.IPProtocolUDP, HopLimit: 64,
+			SrcIP: net.ParseIP("fd00::1"), DstIP: net.ParseIP("fd00::2")},
+		&payload)
+	wt.AssertNoErr(t, err)
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(buf.Bytes())
+	if !dec.IsIPv6() || dec.DF() {
+		wt.Fatalf(t, "Expected to decode a non-DF IPv6 frame")
+	}
+
+	const pmtu = 1280
+	reassembled := []byte{}
+	frags := 0
+	err = fragmentIPv6(dec.eth, dec.ip6, pmtu, &ForwardedFrame{frame: buf.Bytes()}, func(frame *ForwardedFrame) {
+		if frameTooBig(frame, pmtu) {
+			wt.Fatalf(t, "Fragment of %d bytes exceeds PMTU", len(frame.frame))
+		}
+		packet := gopacket.NewPacket(frame.frame, layers.LayerTypeEthernet, gopacket.Default)
+		frag, ok := packet.Layer(layers.LayerTypeIPv6Fragment).(*layers.IPv6Fragment)
+		if !ok {
+			wt.Fatalf(t, "Missing fragment header")
+		}
+		wt.AssertEqualInt(t, int(frag.FragmentOffset)*8, len(reassembled), "fragment offset")
+		reassembled = append(reassembled, frag.Payload...)
+		frags++
+		wt.AssertEqualString(t, fmt.Sprint(frag.MoreFragments), fmt.Sprint(len(reassembled) < len(data)), "more fragments flag")
+	})
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, frags, 3, "fragments")
+	if !bytes.Equal(reassembled, data) {
+		wt.Fatalf(t, "Reassembled payload differs from original")
+	}
+}
+
+// Stopping with a deadline sends the frames already queued, as long
+// as the deadline permits
+func TestForwarderSendQueued(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	peer1, peer2 := NewPeer(name1, 0, 0), NewPeer(name2, 0, 0)
+	conn := &LocalConnection{RemoteConnection: RemoteConnection{local: peer1, remote: peer2}, stats: &ConnectionStats{}}
+	ch := make(chan *ForwardedFrame, 4)
+	sender := &mockUDPSender{}
+	fwd := &Forwarder{conn: conn, queues: forwardQueues{ClassDefault: ch}, enc: NewNonEncryptor(peer1.NameByte), udpSender: sender, maxPayload: 200}
+	enqueue := func() {
+		for i := byte(0); i < 4; i++ {
+			ch <- &ForwardedFrame{srcPeer: peer1, dstPeer: peer2, frame: make([]byte, 40)}
+		}
+	}
+
+	enqueue()
+	fwd.sendQueued(time.Now().Add(-time.Second))
+	wt.AssertEqualInt(t, len(sender.packets), 0, "packets sent after deadline")
+	fwd.drain()
+
+	enqueue()
+	fwd.sendQueued(time.Now().Add(time.Second))
+	wt.AssertEqualuint64(t, conn.ConnectionStats().FramesForwarded, 4, "frames forwarded")
+	wt.AssertEqualInt(t, len(sender.packets), 2, "packets sent")
+}
+
+// Frames keep coming, but those which have waited the flush delay go
+// without waiting for the packet to fill up
+func TestForwarderFlushDelay(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	peer1, peer2 := NewPeer(name1, 0, 0), NewPeer(name2, 0, 0)
+	conn := &LocalConnection{RemoteConnection: RemoteConnection{local: peer1, remote: peer2}, stats: &ConnectionStats{}}
+	ch := make(chan *ForwardedFrame, 4)
+	sender := &mockUDPSender{}
+	fwd := &Forwarder{conn: conn, queues: forwardQueues{ClassDefault: ch}, enc: NewNonEncryptor(peer1.NameByte), udpSender: sender, maxPayload: 200}
+	forward := func() {
+		for i := 0; i < 4; i++ {
+			ch <- &ForwardedFrame{srcPeer: peer1, dstPeer: peer2, frame: make([]byte, 20)}
+		}
+		fwd.forwardFrames(<-ch)
+	}
+
+	fwd.flushDelay = time.Second
+	forward()
+	wt.AssertEqualInt(t, len(sender.packets), 1, "packets sent within the flush delay")
+
+	sender.packets = nil
+	fwd.flushDelay = time.Nanosecond
+	forward()
+	wt.AssertEqualInt(t, len(sender.packets), 3, "packets sent after the flush delay")
+	wt.AssertEqualuint64(t, conn.ConnectionStats().TimedFlushes, 3, "timed flushes")
+}
+
+// Checking the PMTU only happens after large frames, and falls back
+// to a safe size when the PMTU turns out to be a blackhole
+func TestForwarderPMTUBlackhole(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	peer1, peer2 := NewPeer(name1, 0, 0), NewPeer(name2, 0, 0)
+	conn := &LocalConnection{RemoteConnection: RemoteConnection{local: peer1, remote: peer2}, stats: &ConnectionStats{},
+		Router: &Router{Events: NewEvents()}, effectivePMTU: 1400}
+	sender := &mockUDPSender{}
+	fwd := &Forwarder{conn: conn, enc: NewNonEncryptor(peer1.NameByte), udpSender: sender, udpOverhead: UDPOverhead}
+	fwd.unverifiedPMTU = 1400
+	fwd.maxPayload = 1400 + fwd.effectiveOverhead() - fwd.udpOverhead
+	fwd.pmtuVerified = true
+
+	fwd.checkPMTU()
+	if fwd.checkingPMTU || fwd.checkPMTUTick == nil {
+		wt.Fatalf(t, "Expected no check without large frames")
+	}
+	wt.AssertEqualInt(t, len(sender.packets), 0, "packets sent")
+
+	if !fwd.appendFrame(&ForwardedFrame{srcPeer: peer1, dstPeer: peer2, frame: make([]byte, 1000)}) {
+		wt.Fatalf(t, "Expected frame to fit")
+	}
+	fwd.flush()
+	fwd.checkPMTU()
+	if !fwd.checkingPMTU || fwd.pmtuVerified {
+		wt.Fatalf(t, "Expected a check after large frames")
+	}
+	wt.AssertEqualInt(t, len(sender.packets[1]), 1400+fwd.effectiveOverhead()-fwd.udpOverhead, "verification packet size")
+
+	fwd.blackholed()
+	wt.AssertEqualInt(t, conn.EffectivePMTU(), MinPathMTU-fwd.effectiveOverhead(), "effective PMTU")
+	wt.AssertEqualInt(t, fwd.unverifiedPMTU, (8+1400)/2, "PMTU being verified")
+	wt.AssertEqualuint64(t, conn.ConnectionStats().PMTUBlackholes, 1, "blackholes")
+}
+
+func decodedIPv4Frame(t *testing.T, df bool, payloadLen int) ([]byte, *EthernetDecoder) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP,
+		SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(10, 0, 0, 2)}
+	if df {
+		ip.Flags = layers.IPv4DontFragment
+	}
+	buf := gopacket.NewSerializeBuffer()
+	payload := gopacket.Payload(make([]byte, payloadLen))
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeIPv4}, ip, &payload)
+	wt.AssertNoErr(t, err)
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(buf.Bytes())
+	return buf.Bytes(), dec
+}
+
+// Frames over the PMTU get dropped when DF, and fragmented otherwise,
+// and the connection counts which
+func TestForwardStats(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	peer1, peer2 := NewPeer(name1, 0, 0), NewPeer(name2, 0, 0)
+	conn := &LocalConnection{RemoteConnection: RemoteConnection{local: peer1, remote: peer2},
+		Router: NewRouter(RouterConfig{LogFrame: func(string, []byte, *layers.Ethernet) {}}, name1),
+		stats:  &ConnectionStats{}, effectivePMTU: 576}
+	ch, chDF := newForwardQueues(8), newForwardQueues(8)
+	conn.forwardChans, conn.forwardChansDF = []forwardQueues{ch}, []forwardQueues{chDF}
+	queued := func(queues forwardQueues) (frames int) {
+		for _, q := range queues {
+			frames += len(q)
+		}
+		return
+	}
+	forward := func(df bool, payloadLen int) error {
+		frame, dec := decodedIPv4Frame(t, df, payloadLen)
+		return conn.Forward(dec.DF(), &ForwardedFrame{srcPeer: peer1, dstPeer: peer2, frame: frame}, dec)
+	}
+
+	wt.AssertNoErr(t, forward(true, 100))
+	wt.AssertEqualInt(t, queued(chDF), 1, "small DF frames queued")
+	if _, ok := forward(true, 1000).(FrameTooBigError); !ok {
+		wt.Fatalf(t, "Expected a big DF frame to be too big")
+	}
+	wt.AssertEqualuint64(t, conn.ConnectionStats().PMTUDrops, 1, "PMTU drops")
+	wt.AssertEqualInt(t, queued(chDF), 1, "frames queued after PMTU drop")
+
+	wt.AssertNoErr(t, forward(false, 1000))
+	stats := conn.ConnectionStats()
+	wt.AssertEqualuint64(t, stats.Fragmentations, 1, "fragmentations")
+	wt.AssertEqualuint64(t, stats.PMTUDrops, 1, "PMTU drops")
+	wt.AssertEqualInt(t, queued(chDF), 3, "frames queued after fragmenting")
+	wt.AssertEqualInt(t, queued(ch), 0, "frames queued to fragment by the stack")
+	if !strings.Contains(stats.String(), "PMTU drops 1, ENOBUFS 0, fragmentations 1") {
+		wt.Fatalf(t, "Unexpected stats: %s", stats)
+	}
+
+	// Forwarding counts the frames and their bytes
+	sender := &mockUDPSender{}
+	fwd := &Forwarder{conn: conn, queues: chDF, enc: NewNonEncryptor(peer1.NameByte), udpSender: sender, maxPayload: 1400}
+	lens := 0
+	for _, q := range chDF {
+		for i := len(q); i > 0; i-- {
+			frame := <-q
+			lens += len(frame.frame)
+			q <- frame
+		}
+	}
+	fwd.sendQueued(time.Now().Add(time.Second))
+	stats = conn.ConnectionStats()
+	wt.AssertEqualuint64(t, stats.FramesForwarded, 3, "frames forwarded")
+	wt.AssertEqualuint64(t, stats.BytesForwarded, uint64(lens), "bytes forwarded")
+}
+
+// Probing for a larger PMTU goes no further than the interfaces at
+// both ends allow
+func TestForwarderProbeLargerPMTU(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	peer1, peer2 := NewPeer(name1, 0, 0), NewPeer(name2, 0, 0)
+	conn := &LocalConnection{RemoteConnection: RemoteConnection{local: peer1, remote: peer2}, stats: &ConnectionStats{},
+		Router: &Router{Events: NewEvents()}, effectivePMTU: 1400, maxPMTU: 9000}
+	sender := &mockUDPSender{}
+	fwd := &Forwarder{conn: conn, enc: NewNonEncryptor(peer1.NameByte), udpSender: sender, udpOverhead: UDPOverhead}
+	fwd.unverifiedPMTU = 1400
+	fwd.maxPayload = 1400 + fwd.effectiveOverhead() - fwd.udpOverhead
+	fwd.pmtuVerified = true
+	ceiling := 9000 - fwd.effectiveOverhead()
+
+	fwd.probeLargerPMTU()
+	if fwd.pmtuVerified {
+		wt.Fatalf(t, "Expected the PMTU to be unverified while probing")
+	}
+	wt.AssertEqualInt(t, fwd.unverifiedPMTU, ceiling, "PMTU being verified")
+	wt.AssertEqualInt(t, fwd.highestGoodPMTU, 1400, "highest good PMTU")
+	wt.AssertEqualInt(t, fwd.lowestBadPMTU, ceiling+1, "lowest bad PMTU")
+	wt.AssertEqualInt(t, len(sender.packets[0]), 9000-fwd.udpOverhead, "probe packet size")
+	// We keep using the PMTU we have in the meantime
+	wt.AssertEqualInt(t, conn.EffectivePMTU(), 1400, "effective PMTU")
+
+	// ICMP can't take us beyond the interfaces' MTU...
+	fwd.handleSendError(MsgTooBigError{PMTU: 65535})
+	wt.AssertEqualInt(t, fwd.unverifiedPMTU, ceiling, "PMTU being verified after too big error above the MTU")
+	// ...but can take us below
+	fwd.handleSendError(MsgTooBigError{PMTU: 4000})
+	wt.AssertEqualInt(t, fwd.unverifiedPMTU, 4000-fwd.effectiveOverhead(), "PMTU being verified after too big error")
+	wt.AssertEqualInt(t, conn.EffectivePMTU(), 4000-fwd.effectiveOverhead(), "effective PMTU after too big error")
+
+	// Without the interfaces' MTUs, we go as far as UDP does
+	conn.maxPMTU = 0
+	fwd.pmtuVerified = true
+	fwd.probeLargerPMTU()
+	wt.AssertEqualInt(t, fwd.unverifiedPMTU, DefaultPMTU-fwd.effectiveOverhead(), "PMTU being verified without MTUs")
+}
@@ -0,0 +1,64 @@
+package router
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Frames we capture, and packets we receive, go into buffers from a
+// pool, rather than freshly allocated ones, and stay there until the
+// forwarders have copied them into the packets they assemble. That
+// saves an allocation and copy per frame, which makes a difference to
+// GC pressure at high packet rates.
+//
+// A frame may be queued for several forwarders at once, e.g. when
+// broadcasting, so buffers are reference counted: whoever fills one
+// holds the first reference, every queued ForwardedFrame holds
+// another, and the buffer goes back to the pool when the last one is
+// released. Frames not in a pooled buffer have a nil FrameBuffer, for
+// which Retain and Release do nothing.
+
+type FrameBuffer struct {
+	data []byte
+	refs int32
+}
+
+var frameBufferPool = sync.Pool{
+	New: func() interface{} {
+		return &FrameBuffer{data: make([]byte, MaxUDPPacketSize)}
+	}}
+
+// Get a buffer from the pool, holding a reference to it.
+func NewFrameBuffer() *FrameBuffer {
+	fb := frameBufferPool.Get().(*FrameBuffer)
+	fb.refs = 1
+	return fb
+}
+
+// The whole of the buffer, for filling
+func (fb *FrameBuffer) Bytes() []byte {
+	return fb.data
+}
+
+// Copy the data into the buffer, returning the copy.
+func (fb *FrameBuffer) Copy(data []byte) []byte {
+	return fb.data[:copy(fb.data, data)]
+}
+
+func (fb *FrameBuffer) Retain() {
+	if fb != nil {
+		atomic.AddInt32(&fb.refs, 1)
+	}
+}
+
+func (fb *FrameBuffer) Release() {
+	if fb == nil {
+		return
+	}
+	switch refs := atomic.AddInt32(&fb.refs, -1); {
+	case refs == 0:
+		frameBufferPool.Put(fb)
+	case refs < 0:
+		logForwarder.Error("Frame buffer released more often than retained")
+	}
+}
@@ -0,0 +1,29 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"testing"
+)
+
+func TestFrameBufferRefs(t *testing.T) {
+	fb := NewFrameBuffer()
+	frame := fb.Copy([]byte("frame"))
+	wt.AssertEqualString(t, string(frame), "frame", "copied frame")
+	wt.AssertEqualInt(t, len(fb.Bytes()), MaxUDPPacketSize, "buffer size")
+
+	// Frames queued for two connections, one of which drops it
+	conn := &LocalConnection{dropPolicy: DropNewest, stats: &ConnectionStats{}}
+	full := make(chan *ForwardedFrame)
+	ch := make(chan *ForwardedFrame, 1)
+	conn.enqueue(ch, &ForwardedFrame{frame: frame, buf: fb})
+	conn.enqueue(full, &ForwardedFrame{frame: frame, buf: fb})
+	wt.AssertEqualInt(t, int(fb.refs), 2, "references after queueing")
+
+	fb.Release()
+	(<-ch).buf.Release()
+	wt.AssertEqualInt(t, int(fb.refs), 0, "references after release")
+
+	// Frames not in a pooled buffer need no releasing
+	conn.enqueue(ch, &ForwardedFrame{frame: frame})
+	(<-ch).buf.Release()
+}
@@ -0,0 +1,97 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// Subnet routing. With -gateway, our host routes between the overlay
+// subnets and the host itself, and whatever networks it can reach: the
+// bridge gets an address in each subnet, which gives the host a route
+// to the subnet through the bridge, and the host forwards IP packets.
+// Hosts and clients elsewhere reach the subnets through the gateway's
+// host, given a route to them via it, e.g. advertised with BGP. The
+// weave script adds the iptables rules accepting the forwarded packets,
+// and masquerading those from outside the subnets as from the bridge,
+// so that containers anywhere send their replies back to the gateway.
+// As with the rest of the bridge's configuration, we put the addresses
+// back, and turn forwarding on again, should that drift.
+
+const ipForwardingPath = "/proc/sys/net/ipv4/ip_forward"
+
+// Parse gateway addresses of the form <address>/<prefix length>,...
+func ParseGatewayAddrs(spec string) ([]*net.IPNet, error) {
+	var addrs []*net.IPNet
+	for _, field := range strings.Split(spec, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		ip, subnet, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, err
+		}
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("gateway address %v is not IPv4", field)
+		}
+		if ip.Equal(subnet.IP) {
+			return nil, fmt.Errorf("gateway address %v is its subnet's network address", field)
+		}
+		for _, other := range addrs {
+			if other.Contains(ip) || subnet.Contains(other.IP) {
+				return nil, fmt.Errorf("gateway subnet %v overlaps %v", subnet, other)
+			}
+		}
+		addrs = append(addrs, &net.IPNet{IP: ip.To4(), Mask: subnet.Mask})
+	}
+	return addrs, nil
+}
+
+// Make the bridge the gateway to the subnets of the addresses, giving
+// it the addresses. Call before Start.
+func (bridge *Bridge) SetGateway(addrs []*net.IPNet) {
+	bridge.gateway = addrs
+}
+
+// The overlay subnets we are the gateway to
+func (bridge *Bridge) GatewaySubnets() []*net.IPNet {
+	if bridge == nil {
+		return nil
+	}
+	var subnets []*net.IPNet
+	for _, addr := range bridge.gateway {
+		subnets = append(subnets, &net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask})
+	}
+	return subnets
+}
+
+// Called in the host's network namespace, with the bridge locked
+func (bridge *Bridge) checkGateway() error {
+	if len(bridge.gateway) == 0 {
+		return nil
+	}
+	for _, addr := range bridge.gateway {
+		if err := addAddress(bridge.name, addr); err != nil {
+			return err
+		}
+	}
+	forwarding, err := ioutil.ReadFile(ipForwardingPath)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(bytes.TrimSpace(forwarding), []byte("1")) {
+		logRouter.Info("Turning on IP forwarding, to route to", bridge.GatewaySubnets())
+		return ioutil.WriteFile(ipForwardingPath, []byte("1\n"), 0644)
+	}
+	return nil
+}
+
+func gatewayString(addrs []*net.IPNet) string {
+	var strs []string
+	for _, addr := range addrs {
+		strs = append(strs, addr.String())
+	}
+	return strings.Join(strs, ", ")
+}
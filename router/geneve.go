@@ -0,0 +1,109 @@
+package router
+
+import (
+	"encoding/binary"
+)
+
+// Geneve (RFC 8926) headers carry options, in which we put the name of
+// the peer a frame comes from, its tenant and, when it's for a peer
+// other than the one we send it to, the name of that peer, so that
+// Geneve carries the frames we relay as well as our own. The options
+// are in a class from the range for experimental use. The destination
+// peer is critical, so that anyone not understanding it drops the
+// frame rather than taking it to be for their own hosts. Packets from
+// elsewhere without our options are taken to be from the peer which
+// sent them, for our hosts, and on the tenant of their VNI.
+
+const (
+	GenevePort           = 6081 // as assigned by IANA
+	GeneveHeaderSize     = 8
+	geneveFlagOAM        = 0x80
+	geneveFlagCritical   = 0x40   // there are critical options
+	geneveProtoEthernet  = 0x6558 // Transparent Ethernet Bridging
+	geneveOptionClass    = 0xfff0
+	geneveOptionCritical = 0x80 // in the option type
+	geneveOptSrcPeer     = 1
+	geneveOptDstPeer     = 2 | geneveOptionCritical
+	geneveOptTenant      = 3
+	// The most our options take up
+	GeneveMaxOverhead = GeneveHeaderSize + 2*(4+8) + 4 + 4
+)
+
+type geneveFrame struct {
+	vni       uint32
+	srcName   []byte // nil if the packet doesn't say
+	dstName   []byte // nil if the packet doesn't say
+	tenant    uint16
+	hasTenant bool
+	frame     []byte
+}
+
+// Write the header for a frame to buf, returning its length. dstName
+// is nil for frames for the peer we send them to.
+func putGeneveHeader(buf []byte, vni uint32, srcName, dstName []byte, tenant uint16) int {
+	opts := buf[GeneveHeaderSize:]
+	n := putGeneveOption(opts, geneveOptSrcPeer, srcName)
+	flags := byte(0)
+	if dstName != nil {
+		n += putGeneveOption(opts[n:], geneveOptDstPeer, dstName)
+		flags |= geneveFlagCritical
+	}
+	binary.BigEndian.PutUint16(opts[n:], geneveOptionClass)
+	opts[n+2], opts[n+3] = geneveOptTenant, 1
+	binary.BigEndian.PutUint16(opts[n+4:], tenant)
+	opts[n+6], opts[n+7] = 0, 0
+	n += 8
+	buf[0], buf[1] = byte(n/4), flags
+	binary.BigEndian.PutUint16(buf[2:4], geneveProtoEthernet)
+	binary.BigEndian.PutUint32(buf[4:8], vni<<8)
+	return GeneveHeaderSize + n
+}
+
+func putGeneveOption(buf []byte, optType byte, data []byte) int {
+	words := (len(data) + 3) / 4
+	binary.BigEndian.PutUint16(buf[0:2], geneveOptionClass)
+	buf[2], buf[3] = optType, byte(words)
+	padding := buf[4+copy(buf[4:], data) : 4+4*words]
+	for i := range padding {
+		padding[i] = 0
+	}
+	return 4 + 4*words
+}
+
+// Parse a Geneve packet carrying an Ethernet frame. Packets with
+// critical options we don't understand, and OAM packets, are no use
+// to us.
+func parseGeneveHeader(packet []byte) (gf geneveFrame, ok bool) {
+	if len(packet) < GeneveHeaderSize || packet[0]>>6 != 0 || packet[1]&geneveFlagOAM != 0 ||
+		binary.BigEndian.Uint16(packet[2:4]) != geneveProtoEthernet {
+		return gf, false
+	}
+	optsLen := int(packet[0]&0x3f) * 4
+	if len(packet) < GeneveHeaderSize+optsLen {
+		return gf, false
+	}
+	gf.vni = binary.BigEndian.Uint32(packet[4:8]) >> 8
+	for opts := packet[GeneveHeaderSize : GeneveHeaderSize+optsLen]; len(opts) > 0; {
+		if len(opts) < 4 {
+			return gf, false
+		}
+		class, optType, length := binary.BigEndian.Uint16(opts[0:2]), opts[2], int(opts[3]&0x1f)*4
+		if len(opts) < 4+length {
+			return gf, false
+		}
+		data := opts[4 : 4+length]
+		opts = opts[4+length:]
+		switch {
+		case class == geneveOptionClass && optType == geneveOptSrcPeer && length >= NameSize:
+			gf.srcName = data[:NameSize]
+		case class == geneveOptionClass && optType == geneveOptDstPeer && length >= NameSize:
+			gf.dstName = data[:NameSize]
+		case class == geneveOptionClass && optType == geneveOptTenant && length >= 2:
+			gf.tenant, gf.hasTenant = binary.BigEndian.Uint16(data), true
+		case optType&geneveOptionCritical != 0:
+			return gf, false
+		}
+	}
+	gf.frame = packet[GeneveHeaderSize+optsLen:]
+	return gf, true
+}
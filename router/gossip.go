@@ -4,7 +4,7 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
-	"log"
+	"sync/atomic"
 	"time"
 )
 
@@ -33,29 +33,47 @@ type GossipChannel struct {
 	name     string
 	hash     uint32
 	gossiper Gossiper
+	stats    *GossipStats
+}
+
+// Message counts of a gossip channel, updated atomically. Messages
+// sent to several connections count once per connection.
+type GossipStats struct {
+	Sent     uint64
+	Received uint64
 }
 
 func (router *Router) NewGossip(channelName string, g Gossiper) Gossip {
 	channelHash := hash(channelName)
-	channel := &GossipChannel{router.Ourself, channelName, channelHash, g}
+	channel := &GossipChannel{ourself: router.Ourself, name: channelName, hash: channelHash, gossiper: g, stats: &GossipStats{}}
 	router.GossipChannels[channelHash] = channel
 	return channel
 }
 
 func (router *Router) SendAllGossip() {
 	for _, channel := range router.GossipChannels {
+		if Gossip(channel) == router.TopologyGossip {
+			router.sendTopologyGossip(channel)
+			continue
+		}
 		channel.SendGossipMsg(channel.gossiper.Gossip())
 	}
 }
 
 func (router *Router) SendAllGossipDown(conn Connection) {
 	for _, channel := range router.GossipChannels {
-		protocolMsg := channel.gossipMsg(channel.gossiper.Gossip())
-		conn.(ProtocolSender).SendProtocolMsg(protocolMsg)
+		buf := channel.gossiper.Gossip()
+		if local, ok := conn.(*LocalConnection); ok && local.gossipDeltas != nil && Gossip(channel) == router.TopologyGossip {
+			buf = local.gossipDeltas.all(router.Peers)
+		}
+		conn.(ProtocolSender).SendProtocolMsg(channel.gossipMsg(buf))
 	}
 }
 
 func (router *Router) handleGossip(payload []byte, onok func(*GossipChannel, PeerName, []byte, *gob.Decoder) error) error {
+	if len(payload) > router.Limits.gossipSize() {
+		return TopologyLimitError{fmt.Sprintf("gossip message of %d bytes", len(payload))}
+	}
 	decoder := gob.NewDecoder(bytes.NewReader(payload))
 	var channelHash uint32
 	if err := decoder.Decode(&channelHash); err != nil {
@@ -65,6 +83,7 @@ func (router *Router) handleGossip(payload []byte, onok func(*GossipChannel, Pee
 	if !found {
 		return fmt.Errorf("[gossip] received unknown channel with hash %v", channelHash)
 	}
+	atomic.AddUint64(&channel.stats.Received, 1)
 	var srcName PeerName
 	if err := decoder.Decode(&srcName); err != nil {
 		return err
@@ -119,6 +138,7 @@ func (c *GossipChannel) SendGossipMsg(buf []byte) {
 	protocolMsg := c.gossipMsg(buf)
 	c.ourself.ForEachConnection(func(_ PeerName, conn Connection) {
 		conn.(ProtocolSender).SendProtocolMsg(protocolMsg)
+		atomic.AddUint64(&c.stats.Sent, 1)
 	})
 }
 
@@ -141,6 +161,7 @@ func (c *GossipChannel) relayGossipUnicast(dstPeerName PeerName, msg []byte) err
 		c.log("unable to find connection to relay peer", relayPeerName)
 	} else {
 		conn.(ProtocolSender).SendProtocolMsg(ProtocolMsg{ProtocolGossipUnicast, msg})
+		atomic.AddUint64(&c.stats.Sent, 1)
 	}
 	return nil
 }
@@ -152,11 +173,18 @@ func (c *GossipChannel) relayGossipBroadcast(srcName PeerName, msg []byte) error
 		protocolMsg := ProtocolMsg{ProtocolGossipBroadcast, msg}
 		for _, conn := range c.ourself.NextBroadcastHops(srcPeer) {
 			conn.SendProtocolMsg(protocolMsg)
+			atomic.AddUint64(&c.stats.Sent, 1)
 		}
 	}
 	return nil
 }
 
+func (c *GossipChannel) Stats() GossipStats {
+	return GossipStats{
+		Sent:     atomic.LoadUint64(&c.stats.Sent),
+		Received: atomic.LoadUint64(&c.stats.Received)}
+}
+
 func (c *GossipChannel) log(args ...interface{}) {
-	log.Println(append(append([]interface{}{}, "[gossip "+c.name+"]:"), args...)...)
+	logGossip.With("channel", c.name).Warn(args...)
 }
@@ -0,0 +1,59 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/bkaradzic/go-lz4"
+	"sync/atomic"
+)
+
+// Gossip messages can go compressed with LZ4, where both peers
+// understand that. Those of GossipCompressMin bytes or more go as a
+// ProtocolCompressed message instead, carrying the tag of the original
+// message and its LZ4 block, unless that doesn't make them any
+// smaller. Topology gossip in particular is repetitive, with the same
+// peer names and addresses appearing in the connections of many
+// peers, and compresses well.
+
+func isGossip(tag ProtocolTag) bool {
+	return tag == ProtocolGossip || tag == ProtocolGossipUnicast || tag == ProtocolGossipBroadcast
+}
+
+func (conn *LocalConnection) compressGossip(m ProtocolMsg) ProtocolMsg {
+	if !conn.gossipCompression || !isGossip(m.tag) || len(m.msg) < GossipCompressMin {
+		return m
+	}
+	atomic.AddUint64(&conn.stats.GossipIn, uint64(len(m.msg)))
+	compressed, err := compressProtocolMsg(m)
+	if err != nil || len(compressed.msg) >= len(m.msg) {
+		atomic.AddUint64(&conn.stats.GossipOut, uint64(len(m.msg)))
+		return m
+	}
+	atomic.AddUint64(&conn.stats.GossipOut, uint64(len(compressed.msg)))
+	return compressed
+}
+
+func compressProtocolMsg(m ProtocolMsg) (ProtocolMsg, error) {
+	compressed, err := lz4.Encode(nil, m.msg)
+	if err != nil {
+		return m, err
+	}
+	return ProtocolMsg{ProtocolCompressed, Concat([]byte{byte(m.tag)}, compressed)}, nil
+}
+
+// The original gossip message of a ProtocolCompressed one
+func decompressGossip(payload []byte, maxSize int) (ProtocolTag, []byte, error) {
+	// LZ4 blocks start with their decompressed length
+	if len(payload) < 5 || binary.LittleEndian.Uint32(payload[1:5]) > uint32(maxSize) {
+		return 0, nil, fmt.Errorf("bad compressed gossip length")
+	}
+	tag := ProtocolTag(payload[0])
+	if !isGossip(tag) {
+		return 0, nil, fmt.Errorf("unexpected compressed message with tag %d", tag)
+	}
+	msg, err := lz4.Decode(nil, payload[1:])
+	if err != nil {
+		return 0, nil, fmt.Errorf("gossip decompression failed; %v", err)
+	}
+	return tag, msg, nil
+}
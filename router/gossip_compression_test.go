@@ -0,0 +1,44 @@
+package router
+
+import (
+	"bytes"
+	wt "github.com/zettio/weave/testing"
+	"testing"
+)
+
+func TestGossipCompression(t *testing.T) {
+	conn := &LocalConnection{stats: &ConnectionStats{}, gossipCompression: true}
+	gossip := ProtocolMsg{ProtocolGossipBroadcast, bytes.Repeat([]byte("weave"), 1000)}
+	compressed := conn.compressGossip(gossip)
+	if compressed.tag != ProtocolCompressed || len(compressed.msg) >= len(gossip.msg) {
+		wt.Fatalf(t, "Expected gossip to get compressed; got tag %d, %d bytes", compressed.tag, len(compressed.msg))
+	}
+	tag, msg, err := decompressGossip(compressed.msg, MaxGossipSize)
+	wt.AssertNoErr(t, err)
+	if tag != gossip.tag || !bytes.Equal(msg, gossip.msg) {
+		wt.Fatalf(t, "Decompressed gossip differs from the original")
+	}
+	stats := conn.ConnectionStats()
+	wt.AssertEqualInt(t, int(stats.GossipIn), len(gossip.msg), "bytes in")
+	wt.AssertEqualInt(t, int(stats.GossipOut), len(compressed.msg), "bytes out")
+
+	// Small, incompressible and non-gossip messages go as they are
+	for _, m := range []ProtocolMsg{
+		{ProtocolGossip, []byte("weave")},
+		{ProtocolGossip, randBytes(2 * GossipCompressMin)},
+		{ProtocolNATCandidates, bytes.Repeat([]byte("weave"), 1000)}} {
+		if sent := conn.compressGossip(m); sent.tag != m.tag || !bytes.Equal(sent.msg, m.msg) {
+			wt.Fatalf(t, "Expected message with tag %d to go uncompressed", m.tag)
+		}
+	}
+
+	// Only gossip may come compressed
+	notGossip, err := compressProtocolMsg(ProtocolMsg{ProtocolGoingAway, bytes.Repeat([]byte("weave"), 1000)})
+	wt.AssertNoErr(t, err)
+	if _, _, err := decompressGossip(notGossip.msg, MaxGossipSize); err == nil {
+		wt.Fatalf(t, "Expected compressed non-gossip message to be rejected")
+	}
+	if _, _, err := decompressGossip([]byte{byte(ProtocolGossip), 0xff, 0xff, 0xff, 0xff}, MaxGossipSize); err == nil {
+		wt.Fatalf(t, "Expected excessive decompressed length to be rejected")
+	}
+}
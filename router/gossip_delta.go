@@ -0,0 +1,95 @@
+package router
+
+import (
+	"sync/atomic"
+)
+
+// Topology gossip in deltas. The periodic topology gossip used to tell
+// every connected peer the whole topology, every GossipInterval, which
+// in large meshes makes for a lot of control-plane traffic carrying
+// little news. Where both peers understand deltas, each connection
+// instead keeps a version vector of what it last told the remote: the
+// UID and version of every peer. Periodic gossip then only carries the
+// peers whose UID or version changed since, or nothing at all when
+// none did. Every GossipFullEvery rounds, and whenever a connection
+// gets added, the whole topology goes out as before, in case the
+// remote dropped a delta, e.g. one mentioning a peer which it had
+// since forgotten.
+
+type peerVersion struct {
+	uid     uint64
+	version uint64
+}
+
+// Only touched from the LocalPeer's actor, which sends the periodic
+// gossip and the gossip to new connections.
+type gossipDeltas struct {
+	sent   map[PeerName]peerVersion
+	rounds int
+}
+
+func newGossipDeltas() *gossipDeltas {
+	return &gossipDeltas{sent: make(map[PeerName]peerVersion)}
+}
+
+// The topology gossip to send in the next periodic round, or nil when
+// there is nothing new to tell.
+func (deltas *gossipDeltas) next(peers *Peers) []byte {
+	deltas.rounds++
+	if deltas.rounds%GossipFullEvery == 0 {
+		return deltas.all(peers)
+	}
+	return peers.encodeChanged(deltas.sent)
+}
+
+// All of the topology, remembering we told it
+func (deltas *gossipDeltas) all(peers *Peers) []byte {
+	deltas.sent = make(map[PeerName]peerVersion)
+	return peers.encodeChanged(deltas.sent)
+}
+
+// Encode the peers of which we know another UID or version than the
+// known ones, and update the latter to what we encoded. Peers which
+// have gone get forgotten.
+func (peers *Peers) encodeChanged(known map[PeerName]peerVersion) []byte {
+	peers.RLock()
+	defer peers.RUnlock()
+	changed := make(map[PeerName]*Peer)
+	for name, peer := range peers.table {
+		current := peerVersion{peer.UID, peer.Version()}
+		if known[name] != current {
+			changed[name] = peer
+			known[name] = current
+		}
+	}
+	for name := range known {
+		if _, found := peers.table[name]; !found {
+			delete(known, name)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	return encodePeersMap(changed)
+}
+
+// The periodic topology gossip: deltas to the connections which
+// understand them, and everything to the others.
+func (router *Router) sendTopologyGossip(channel *GossipChannel) {
+	var all []byte
+	router.Ourself.ForEachConnection(func(_ PeerName, conn Connection) {
+		var buf []byte
+		if local, ok := conn.(*LocalConnection); ok && local.gossipDeltas != nil {
+			if buf = local.gossipDeltas.next(router.Peers); buf == nil {
+				return
+			}
+		} else {
+			if all == nil {
+				all = router.Peers.EncodeAllPeers()
+			}
+			buf = all
+		}
+		conn.(ProtocolSender).SendProtocolMsg(channel.gossipMsg(buf))
+		atomic.AddUint64(&channel.stats.Sent, 1)
+	})
+}
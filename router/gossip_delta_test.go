@@ -0,0 +1,64 @@
+package router
+
+import (
+	"bytes"
+	"encoding/gob"
+	wt "github.com/zettio/weave/testing"
+	"io"
+	"testing"
+)
+
+func decodedPeerNames(t *testing.T, buf []byte) map[PeerName]bool {
+	names := make(map[PeerName]bool)
+	dec := gob.NewDecoder(bytes.NewReader(buf))
+	for {
+		nameByte, _, _, _, _, err := decodePeerNoConns(dec)
+		if err == io.EOF {
+			return names
+		}
+		wt.AssertNoErr(t, err)
+		names[PeerNameFromBin(nameByte)] = true
+	}
+}
+
+func TestGossipDeltas(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	name3, _ := PeerNameFromString("03:00:00:01:00:00")
+	ourself, peers := newNode(name1)
+	peer2, _ := newNode(name2)
+	peer3, _ := newNode(name3)
+	peers.AddTestConnection(peer2)
+
+	deltas := newGossipDeltas()
+	wt.AssertEqualInt(t, len(decodedPeerNames(t, deltas.next(peers))), 2, "peers in first round")
+	if buf := deltas.next(peers); buf != nil {
+		wt.Fatalf(t, "Expected no gossip without changes; got %v", decodedPeerNames(t, buf))
+	}
+
+	// A new connection changes us, and adds the new peer
+	peers.AddTestConnection(peer3)
+	changed := decodedPeerNames(t, deltas.next(peers))
+	if len(changed) != 2 || !changed[ourself.Name] || !changed[name3] {
+		wt.Fatalf(t, "Expected delta with us and the new peer; got %v", changed)
+	}
+
+	// Every GossipFullEvery rounds, everything goes out again
+	for deltas.rounds%GossipFullEvery != GossipFullEvery-1 {
+		if buf := deltas.next(peers); buf != nil {
+			wt.Fatalf(t, "Expected no gossip without changes in round %d", deltas.rounds)
+		}
+	}
+	wt.AssertEqualInt(t, len(decodedPeerNames(t, deltas.next(peers))), 3, "peers in full round")
+
+	// Peers which have gone get forgotten
+	peers.DeleteTestConnection(peer3)
+	peers.GarbageCollect()
+	changed = decodedPeerNames(t, deltas.next(peers))
+	if len(changed) != 1 || !changed[ourself.Name] {
+		wt.Fatalf(t, "Expected delta with just us; got %v", changed)
+	}
+	if _, found := deltas.sent[name3]; found {
+		wt.Fatalf(t, "Expected removed peer to be forgotten")
+	}
+}
@@ -0,0 +1,192 @@
+package router
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Much of what we gossip is a table with an entry for each peer, which
+// only that peer changes: the multicast groups of its local hosts, the
+// quality of its links, etc. Whenever we change our entry it gets a
+// new version and goes to everyone, and we take on the entries of
+// others which are more recent than those we have. Nobody else knows
+// better than we do what our own entry is.
+//
+// Every peer gossips an entry, even an empty one, so that an entry
+// from before a restart doesn't linger. Entries go when their peer
+// leaves the topology.
+//
+// Users embed a GossipTable, which does their gossiping and guards
+// their state with its lock, and tell it how to encode their entries.
+type GossipTable struct {
+	sync.RWMutex
+	ourName  PeerName
+	what     string // what the table is of, for errors
+	codec    GossipTableCodec
+	gossip   Gossip
+	onChange func()
+	versions map[PeerName]uint64
+	entries  map[PeerName]interface{} // includes ourself
+}
+
+// How the entries of a gossip table go over the wire. Gossip carries
+// the versions of the entries, followed by the value EncodeEntries
+// gives for them.
+type GossipTableCodec interface {
+	EncodeEntries(entries map[PeerName]interface{}) interface{}
+	DecodeEntries(decoder *gob.Decoder) (map[PeerName]interface{}, error)
+}
+
+func NewGossipTable(ourName PeerName, what string, codec GossipTableCodec, ours interface{}) *GossipTable {
+	return &GossipTable{
+		ourName:  ourName,
+		what:     what,
+		codec:    codec,
+		onChange: func() {},
+		versions: map[PeerName]uint64{ourName: uint64(time.Now().UnixNano())},
+		entries:  map[PeerName]interface{}{ourName: ours}}
+}
+
+// The version to follow the one given. Versions need to keep going up
+// across restarts.
+func NextGossipVersion(version uint64) uint64 {
+	version++
+	if now := uint64(time.Now().UnixNano()); now > version {
+		version = now
+	}
+	return version
+}
+
+func (table *GossipTable) SetGossip(gossip Gossip) {
+	table.Lock()
+	defer table.Unlock()
+	table.gossip = gossip
+}
+
+// Have the table call onChange, without its lock, whenever it takes
+// on entries or we change ours.
+func (table *GossipTable) SetOnChange(onChange func()) {
+	table.Lock()
+	defer table.Unlock()
+	table.onChange = onChange
+}
+
+// The entry of the peer. Callers hold the table's lock, as for Ours
+// and ForEach.
+func (table *GossipTable) Entry(name PeerName) (interface{}, bool) {
+	entry, found := table.entries[name]
+	return entry, found
+}
+
+func (table *GossipTable) Ours() interface{} {
+	return table.entries[table.ourName]
+}
+
+func (table *GossipTable) ForEach(f func(PeerName, interface{})) {
+	for name, entry := range table.entries {
+		f(name, entry)
+	}
+}
+
+// Apply a change to our entry, with the table locked, and if there is
+// one, tell everyone. Ours is the only entry which changes in place;
+// those of other peers only get replaced.
+func (table *GossipTable) Update(change func(ours interface{}) bool) {
+	table.Lock()
+	if !change(table.entries[table.ourName]) {
+		table.Unlock()
+		return
+	}
+	version := NextGossipVersion(table.versions[table.ourName])
+	table.versions[table.ourName] = version
+	update := table.encode(map[PeerName]uint64{table.ourName: version}, table.entries)
+	gossip, onChange := table.gossip, table.onChange
+	table.Unlock()
+	onChange()
+	if gossip != nil {
+		checkWarn(gossip.GossipBroadcast(update))
+	}
+}
+
+func (table *GossipTable) DeletePeer(name PeerName) {
+	table.Lock()
+	defer table.Unlock()
+	if name != table.ourName {
+		delete(table.versions, name)
+		delete(table.entries, name)
+	}
+}
+
+func (table *GossipTable) OnGossipUnicast(sender PeerName, msg []byte) error {
+	return fmt.Errorf("unexpected %s gossip unicast from %s", table.what, sender)
+}
+
+func (table *GossipTable) OnGossipBroadcast(msg []byte) error {
+	_, _, err := table.merge(msg)
+	return err
+}
+
+func (table *GossipTable) Gossip() []byte {
+	table.RLock()
+	defer table.RUnlock()
+	return table.encode(table.versions, table.entries)
+}
+
+func (table *GossipTable) OnGossip(buf []byte) ([]byte, error) {
+	versions, entries, err := table.merge(buf)
+	if err != nil || len(versions) == 0 {
+		return nil, err
+	}
+	return table.encode(versions, entries), nil
+}
+
+// Take on entries more recent than those we have, returning them.
+func (table *GossipTable) merge(buf []byte) (map[PeerName]uint64, map[PeerName]interface{}, error) {
+	decoder := gob.NewDecoder(bytes.NewReader(buf))
+	var versions map[PeerName]uint64
+	if err := decoder.Decode(&versions); err != nil {
+		return nil, nil, err
+	}
+	entries, err := table.codec.DecodeEntries(decoder)
+	if err != nil {
+		return nil, nil, err
+	}
+	table.Lock()
+	newVersions := make(map[PeerName]uint64)
+	for name, version := range versions {
+		entry, found := entries[name]
+		if existing, known := table.versions[name]; !found || name == table.ourName || (known && existing >= version) {
+			continue
+		}
+		table.versions[name] = version
+		table.entries[name] = entry
+		newVersions[name] = version
+	}
+	onChange := table.onChange
+	table.Unlock()
+	if len(newVersions) > 0 {
+		onChange()
+	}
+	return newVersions, entries, nil
+}
+
+// Encode the versions given, and the entries they are of.
+func (table *GossipTable) encode(versions map[PeerName]uint64, entries map[PeerName]interface{}) []byte {
+	selected := make(map[PeerName]interface{}, len(versions))
+	for name := range versions {
+		selected[name] = entries[name]
+	}
+	buf := new(bytes.Buffer)
+	encoder := gob.NewEncoder(buf)
+	if err := encoder.Encode(versions); err != nil {
+		log.Fatal(err)
+	}
+	if err := encoder.Encode(table.codec.EncodeEntries(selected)); err != nil {
+		log.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,92 @@
+package router
+
+import (
+	"encoding/gob"
+	wt "github.com/zettio/weave/testing"
+	"testing"
+)
+
+// Entries which are just strings
+type stringEntries struct{}
+
+func (stringEntries) EncodeEntries(entries map[PeerName]interface{}) interface{} {
+	update := make(map[PeerName]string, len(entries))
+	for name, entry := range entries {
+		update[name] = *entry.(*string)
+	}
+	return update
+}
+
+func (stringEntries) DecodeEntries(decoder *gob.Decoder) (map[PeerName]interface{}, error) {
+	var update map[PeerName]string
+	if err := decoder.Decode(&update); err != nil {
+		return nil, err
+	}
+	entries := make(map[PeerName]interface{}, len(update))
+	for name, received := range update {
+		entry := received
+		entries[name] = &entry
+	}
+	return entries, nil
+}
+
+func newStringTable(name PeerName, value string) *GossipTable {
+	return NewGossipTable(name, "test", stringEntries{}, &value)
+}
+
+func setString(table *GossipTable, value string) {
+	table.Update(func(ours interface{}) bool {
+		*ours.(*string) = value
+		return true
+	})
+}
+
+func stringEntry(table *GossipTable, name PeerName) string {
+	table.RLock()
+	defer table.RUnlock()
+	if entry, found := table.Entry(name); found {
+		return *entry.(*string)
+	}
+	return ""
+}
+
+func TestGossipTable(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	table1 := newStringTable(name1, "one")
+	table2 := newStringTable(name2, "two")
+	changes := 0
+	table2.SetOnChange(func() { changes++ })
+
+	update, err := table2.OnGossip(table1.Gossip())
+	wt.AssertNoErr(t, err)
+	if update == nil || stringEntry(table2, name1) != "one" {
+		wt.Fatalf(t, "Expected to take on the entry of peer 1")
+	}
+	wt.AssertEqualInt(t, changes, 1, "changes")
+	// Nothing new the second time round
+	update, err = table2.OnGossip(table1.Gossip())
+	wt.AssertNoErr(t, err)
+	if update != nil {
+		wt.Fatalf(t, "Expected no update from the same gossip")
+	}
+
+	// Entries from before a restart are older
+	stale := table1.Gossip()
+	table1 = newStringTable(name1, "restarted")
+	setString(table1, "again")
+	wt.AssertNoErr(t, table2.OnGossipBroadcast(table1.Gossip()))
+	wt.AssertNoErr(t, table2.OnGossipBroadcast(stale))
+	wt.AssertEqualString(t, stringEntry(table2, name1), "again", "entry of peer 1")
+
+	// Nobody else tells us what our own entry is
+	_, err = table1.OnGossip(table2.Gossip())
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, stringEntry(table1, name1), "again", "our entry")
+	wt.AssertEqualString(t, stringEntry(table1, name2), "two", "entry of peer 2")
+
+	table2.DeletePeer(name1)
+	table2.DeletePeer(name2)
+	wt.AssertEqualString(t, stringEntry(table2, name1), "", "entry of deleted peer")
+	wt.AssertEqualString(t, stringEntry(table2, name2), "two", "our entry")
+}
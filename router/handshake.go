@@ -1,10 +1,16 @@
 package router
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/gob"
 	"encoding/hex"
 	"fmt"
+	"net"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 type FieldValidator struct {
@@ -44,6 +50,23 @@ func (fv FieldValidator) Err() error {
 	return fv.err
 }
 
+func decodePublicKey(fv FieldValidator, fieldName string) (*[32]byte, error) {
+	str, err := fv.Value(fieldName)
+	if err != nil {
+		return nil, err
+	}
+	slice, err := hex.DecodeString(str)
+	if err != nil {
+		return nil, err
+	}
+	if len(slice) != 32 {
+		return nil, fmt.Errorf("Field %s has wrong length; expected 32 bytes, received %d", fieldName, len(slice))
+	}
+	key := [32]byte{}
+	copy(key[:], slice)
+	return &key, nil
+}
+
 func (conn *LocalConnection) handshake(enc *gob.Encoder, dec *gob.Decoder, acceptNewPeer bool) error {
 	// We do not need to worry about locking in here as at this point
 	// the connection is not reachable by any go-routine other than
@@ -53,25 +76,51 @@ func (conn *LocalConnection) handshake(enc *gob.Encoder, dec *gob.Decoder, accep
 	conn.extendReadDeadline()
 
 	localConnID := randUint64()
-	versionStr := fmt.Sprint(ProtocolVersion)
 	handshakeSend := map[string]string{
 		"Protocol":        Protocol,
-		"ProtocolVersion": versionStr,
+		"ProtocolVersion": fmt.Sprint(ProtocolVersion),
 		"PeerNameFlavour": PeerNameFlavour,
 		"Name":            conn.local.Name.String(),
 		"UID":             fmt.Sprint(conn.local.UID),
 		"ConnID":          fmt.Sprint(localConnID)}
 	handshakeRecv := map[string]string{}
 
+	localMTU := InterfaceMTU(conn.TCPConn.LocalAddr().(*net.TCPAddr).IP)
+	if localMTU > 0 {
+		handshakeSend["InterfaceMTU"] = fmt.Sprint(localMTU)
+	}
+
+	// We always exchange public keys. With a password, the
+	// resulting session key encrypts both the data and control
+	// channels, and authenticates the peers. Without one, peers which
+	// support it still encrypt the control channel, but nothing
+	// authenticates the keys, so anyone in the way can stand in for
+	// either end: that only keeps the topology etc. from passive
+	// observers, as we tell users on startup.
 	usingPassword := conn.Router.UsingPassword()
-	var public, private *[32]byte
-	var err error
+	localCaps := conn.Router.capabilities()
+	public, private, err := GenerateKeyPair()
+	if err != nil {
+		return err
+	}
 	if usingPassword {
-		public, private, err = GenerateKeyPair()
-		if err != nil {
-			return err
-		}
 		handshakeSend["PublicKey"] = hex.EncodeToString(public[:])
+		handshakeSend["EncryptionSchemes"] = strings.Join(conn.Router.encryptionSchemeNames(), ",")
+		if conn.resumes != nil {
+			handshakeSend["ResumeConnUID"] = fmt.Sprint(conn.resumes.uid)
+			handshakeSend["ResumeProof"] = resumeProof(conn.resumes.SessionKey, fmt.Sprint(localConnID), handshakeSend["PublicKey"])
+		}
+	} else {
+		handshakeSend["ControlPublicKey"] = hex.EncodeToString(public[:])
+	}
+	if addrs := conn.Router.underlayAddrs(); len(addrs) > 0 {
+		handshakeSend["UnderlayAddrs"] = string(encodeCandidates(addrs))
+	}
+	sendCapabilities(handshakeSend, localCaps)
+	// The fast path carries frames unencrypted, so is only on offer
+	// when we aren't using a password.
+	if conn.Router.FastPath != nil && !usingPassword {
+		handshakeSend["FastPath"] = "vxlan"
 	}
 	enc.Encode(handshakeSend)
 
@@ -81,7 +130,6 @@ func (conn *LocalConnection) handshake(enc *gob.Encoder, dec *gob.Decoder, accep
 	}
 	fv := NewFieldValidator(handshakeRecv)
 	fv.CheckEqual("Protocol", Protocol)
-	fv.CheckEqual("ProtocolVersion", versionStr)
 	fv.CheckEqual("PeerNameFlavour", PeerNameFlavour)
 	nameStr, _ := fv.Value("Name")
 	uidStr, _ := fv.Value("UID")
@@ -89,17 +137,39 @@ func (conn *LocalConnection) handshake(enc *gob.Encoder, dec *gob.Decoder, accep
 	if err := fv.Err(); err != nil {
 		return err
 	}
+	version, remoteCaps, err := receiveCapabilities(handshakeRecv)
+	if err != nil {
+		return err
+	}
+	conn.version = version
+	conn.capabilities = localCaps & remoteCaps
 
 	name, err := PeerNameFromString(nameStr)
 	if err != nil {
 		return err
 	}
+	if conn.peerCert != nil {
+		if certName, err := PeerNameFromUserInput(conn.peerCert.Subject.CommonName); err != nil || certName != name {
+			return fmt.Errorf("Certificate of remote is for %q, not %s", conn.peerCert.Subject.CommonName, name)
+		}
+	}
+	if !conn.Router.PeerACL.Allow(conn.underlayIP(), name) {
+		return fmt.Errorf("Peer rules deny %s at %s", name, conn.underlayIP())
+	}
 	if !acceptNewPeer {
 		if _, found := conn.Router.Peers.Fetch(name); !found {
 			return fmt.Errorf("Found unknown remote name: %s at %s", name, conn.remoteTCPAddr)
 		}
 	}
-	if existingConn, found := conn.local.ConnectionTo(name); found && existingConn.Established() {
+	if _, found := handshakeRecv["ResumeConnUID"]; found {
+		if conn.resumes, err = conn.resumedConnection(name, handshakeRecv); err != nil {
+			return err
+		}
+	} else if conn.resumes != nil {
+		if name != conn.resumes.remote.Name {
+			return fmt.Errorf("Expected %s to resume connection, found %s", conn.resumes.remote.Name, name)
+		}
+	} else if existingConn, found := conn.local.ConnectionTo(name); found && existingConn.Established() {
 		return fmt.Errorf("Already have connection to %s at %s", name, existingConn.RemoteTCPAddr())
 	}
 	uid, err := strconv.ParseUint(uidStr, 10, 64)
@@ -111,29 +181,135 @@ func (conn *LocalConnection) handshake(enc *gob.Encoder, dec *gob.Decoder, accep
 		return err
 	}
 	conn.uid = localConnID ^ remoteConnID
+	conn.canFallBack = conn.capabilities.Has(CapTCPFallback)
+	conn.canPunch = conn.capabilities.Has(CapNATTraversal)
+	conn.measuringQuality = conn.capabilities.Has(CapLinkQuality)
+	conn.tenantTags = conn.capabilities.Has(CapTenants)
+	conn.wireGuard = conn.capabilities.Has(CapWireGuard)
+	conn.throughputTests = conn.capabilities.Has(CapThroughputTests)
+	conn.connUIDs = conn.capabilities.Has(CapConnUIDs)
+	conn.ecn = conn.capabilities.Has(CapECN)
+	conn.standbyPaths = conn.capabilities.Has(CapStandby)
+	conn.multiPath = conn.capabilities.Has(CapMultiPath)
+	conn.keepalives = conn.capabilities.Has(CapKeepalives)
+	conn.gossipCompression = conn.capabilities.Has(CapGossipCompression)
+	conn.hopLimits = conn.capabilities.Has(CapHopLimits)
+	if conn.capabilities.Has(CapGossipDeltas) {
+		conn.gossipDeltas = newGossipDeltas()
+	}
+	switch {
+	case usingPassword:
+	case conn.capabilities.Has(CapVXLAN):
+		conn.encap = EncapVXLAN
+	case conn.capabilities.Has(CapGeneve):
+		conn.encap = EncapGeneve
+	}
 
+	// Older peers don't tell us their MTU, in which case we don't
+	// know how far we can go.
+	if remoteMTUStr, found := handshakeRecv["InterfaceMTU"]; found && localMTU > 0 {
+		remoteMTU, err := strconv.Atoi(remoteMTUStr)
+		if err != nil {
+			return err
+		}
+		conn.maxPMTU = localMTU
+		if remoteMTU < localMTU {
+			conn.maxPMTU = remoteMTU
+		}
+	}
+
+	// Older peers don't tell us their other addresses, in which case
+	// we stick with the one we found them at.
+	if err := conn.receiveUnderlayAddrs(handshakeRecv); err != nil {
+		return err
+	}
+
+	var controlKey *[32]byte
 	if usingPassword {
-		remotePublicStr, rpErr := fv.Value("PublicKey")
-		if rpErr != nil {
-			return rpErr
+		remotePublic, err := decodePublicKey(fv, "PublicKey")
+		if err != nil {
+			return err
+		}
+		remoteSchemes := []string{DefaultEncryptionScheme}
+		if remoteSchemesStr, found := handshakeRecv["EncryptionSchemes"]; found {
+			remoteSchemes = strings.Split(remoteSchemesStr, ",")
+		}
+		// The peer with the lower name gets its preferred scheme
+		var scheme *EncryptionScheme
+		if conn.local.Name < name {
+			scheme, err = ChooseEncryptionScheme(conn.Router.encryptionSchemeNames(), remoteSchemes)
+		} else {
+			scheme, err = ChooseEncryptionScheme(remoteSchemes, conn.Router.encryptionSchemeNames())
 		}
-		remotePublicSlice, rpErr := hex.DecodeString(remotePublicStr)
-		if rpErr != nil {
-			return rpErr
+		if err != nil {
+			return err
 		}
-		remotePublic := [32]byte{}
-		for idx, elem := range remotePublicSlice {
-			remotePublic[idx] = elem
+		conn.EncryptionScheme = scheme
+		conn.roaming = conn.capabilities.Has(CapRoaming) && scheme.Detachable && !conn.sendingOverTCP
+		conn.canRotatePassword = conn.capabilities.Has(CapPasswordRotation)
+		conn.padded = conn.capabilities.Has(CapPadding)
+		conn.compressed = conn.capabilities.Has(CapCompression)
+		conn.compressing = conn.compressed && conn.Router.shouldCompress(tcpRTT(conn.TCPConn))
+		if conn.password, err = conn.choosePassword(enc, dec, handshakeRecv, remotePublic, private, name); err != nil {
+			return err
+		}
+		conn.SessionKey = FormSessionKey(remotePublic, private, &conn.password)
+		if err := conn.checkHandshakeMAC(enc, dec, conn.SessionKey, handshakeSend, handshakeRecv, name); err != nil {
+			return err
+		}
+		if conn.capabilities.Has(CapJoinTokens) {
+			if conn.joinTokenID, err = conn.exchangeJoinTokens(enc, dec, name); err != nil {
+				return err
+			}
+		} else if conn.Router.JoinAuth != nil {
+			return fmt.Errorf("Remote presented no join token")
+		}
+		conn.Router.KeyLog.Log(conn, conn.SessionKey)
+		controlKey = conn.SessionKey
+		conn.canRekey = conn.capabilities.Has(CapRekey)
+		if conn.capabilities.Has(CapPlaintext) {
+			if conn.plaintext, err = conn.agreePlaintext(enc, dec, name); err != nil {
+				return err
+			}
+		}
+		if conn.plaintext {
+			// Only the control channel is left to encrypt
+			conn.roaming, conn.padded, conn.compressed, conn.compressing, conn.canRekey = false, false, false, false, false
+		} else if !scheme.Streams || !conn.capabilities.Has(CapEncryptionStreams) {
+			// Several forwarders of each kind need several encryption
+			// streams, which older peers can't decrypt.
+			conn.forwarders = 1
 		}
-		conn.SessionKey = FormSessionKey(&remotePublic, private, conn.Router.Password)
-		conn.tcpSender = NewEncryptedTCPSender(enc, conn)
-		conn.Decryptor = NewNaClDecryptor(conn)
 	} else {
 		if _, found := handshakeRecv["PublicKey"]; found {
 			return fmt.Errorf("Remote network is encrypted. Password required.")
 		}
-		conn.tcpSender = NewSimpleTCPSender(enc)
+		if _, found := handshakeRecv["ControlPublicKey"]; found {
+			remotePublic, err := decodePublicKey(fv, "ControlPublicKey")
+			if err != nil {
+				return err
+			}
+			controlKey = FormSessionKey(remotePublic, private, &[]byte{})
+			if err := conn.checkHandshakeMAC(enc, dec, controlKey, handshakeSend, handshakeRecv, name); err != nil {
+				return err
+			}
+		}
 		conn.Decryptor = NewNonDecryptor(conn)
+		if conn.Router.FastPath != nil && handshakeRecv["FastPath"] == "vxlan" {
+			conn.fastPathIP = conn.TCPConn.RemoteAddr().(*net.TCPAddr).IP
+		}
+	}
+
+	if controlKey == nil {
+		conn.tcpSender = NewSimpleTCPSender(enc)
+		conn.tcpReceiver = NewSimpleTCPReceiver()
+	} else if conn.capabilities.Has(CapDirectionalControlKeys) {
+		conn.tcpSender = NewEncryptedTCPSender(enc, FormDirectionalKey(controlKey, conn.local.NameByte))
+		conn.tcpReceiver = NewEncryptedTCPReceiver(FormDirectionalKey(controlKey, name.Bin()))
+	} else {
+		// older peers use the same key in both directions
+		conn.tcpSender = NewEncryptedTCPSender(enc, controlKey)
+		conn.tcpReceiver = NewEncryptedTCPReceiver(controlKey)
 	}
 
 	toPeer := NewPeer(name, uid, 0)
@@ -146,6 +322,62 @@ func (conn *LocalConnection) handshake(enc *gob.Encoder, dec *gob.Decoder, accep
 		return fmt.Errorf("Cannot connect to ourself")
 	default:
 		conn.remote = toPeer
+		if conn.plaintext {
+			conn.Decryptor = NewNonDecryptor(conn)
+		} else if usingPassword {
+			// The decryptor needs to know the remote peer
+			conn.Decryptor = conn.EncryptionScheme.NewDecryptor(conn)
+		}
 		return nil
 	}
 }
+
+// Once we have a key, make sure the remote received just the fields we
+// sent, and sent just those we received, capabilities and all, so that
+// someone in the way can't e.g. strip capabilities to downgrade the
+// connection. Each end sends a MAC of both, and checks the other's.
+// Older peers don't, so stripping this capability along with others
+// still goes unnoticed; that needs the password too, though, to get
+// anywhere.
+func (conn *LocalConnection) checkHandshakeMAC(enc *gob.Encoder, dec *gob.Decoder, key *[32]byte, handshakeSend, handshakeRecv map[string]string, remoteName PeerName) error {
+	if !conn.capabilities.Has(CapHandshakeMAC) {
+		return nil
+	}
+	if err := enc.Encode(map[string]string{"HandshakeMAC": handshakeMAC(key, conn.local.NameByte, handshakeSend, handshakeRecv)}); err != nil {
+		return err
+	}
+	macRecv := map[string]string{}
+	if err := dec.Decode(&macRecv); err != nil {
+		return err
+	}
+	expected := handshakeMAC(key, remoteName.Bin(), handshakeRecv, handshakeSend)
+	if !hmac.Equal([]byte(macRecv["HandshakeMAC"]), []byte(expected)) {
+		return fmt.Errorf("Handshake fields were tampered with on the way")
+	}
+	return nil
+}
+
+// A MAC of the fields one end sent, then those it received, in order
+// of name, each length-prefixed.
+func handshakeMAC(key *[32]byte, senderName []byte, sent, received map[string]string) string {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write(Concat([]byte("weave handshake "), senderName))
+	var length [binary.MaxVarintLen64]byte
+	write := func(str string) {
+		mac.Write(length[:binary.PutUvarint(length[:], uint64(len(str)))])
+		mac.Write([]byte(str))
+	}
+	for _, fields := range []map[string]string{sent, received} {
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		write(fmt.Sprint(len(names)))
+		for _, name := range names {
+			write(name)
+			write(fields[name])
+		}
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
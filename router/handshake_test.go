@@ -0,0 +1,199 @@
+package router
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"strings"
+	"testing"
+)
+
+func handshakeTestRouter(nameStr string, password string) *Router {
+	name, _ := PeerNameFromString(nameStr)
+	config := RouterConfig{}
+	if password != "" {
+		config.Password = []byte(password)
+	}
+	return NewRouter(config, name)
+}
+
+// Run the handshake between two routers over loopback TCP, the first
+// dialing, through a proxy which lets tamper change the first message
+// each sends. Ends hang up on failing, as they would.
+func handshakePair(t *testing.T, router1, router2 *Router, tamper func(fromDialer bool, fields map[string]string)) (*LocalConnection, *LocalConnection, error, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	wt.AssertNoErr(t, err)
+	defer listener.Close()
+	dial := func() (net.Conn, net.Conn) {
+		dialed, err := net.Dial("tcp", listener.Addr().String())
+		wt.AssertNoErr(t, err)
+		accepted, err := listener.Accept()
+		wt.AssertNoErr(t, err)
+		return dialed, accepted
+	}
+	tcpConn1, proxy1 := dial()
+	proxy2, tcpConn2 := dial()
+	for _, tcpConn := range []net.Conn{tcpConn1, proxy1, proxy2, tcpConn2} {
+		defer tcpConn.Close()
+	}
+	// Handshake messages are all maps of fields
+	relay := func(from, to net.Conn, fromDialer bool) {
+		defer to.Close()
+		dec, enc := gob.NewDecoder(from), gob.NewEncoder(to)
+		for first := true; ; first = false {
+			fields := map[string]string{}
+			if dec.Decode(&fields) != nil {
+				return
+			}
+			if first && tamper != nil {
+				tamper(fromDialer, fields)
+			}
+			if enc.Encode(fields) != nil {
+				return
+			}
+		}
+	}
+	go relay(proxy1, proxy2, true)
+	go relay(proxy2, proxy1, false)
+
+	newConn := func(router *Router, tcpConn net.Conn, outbound bool) *LocalConnection {
+		conn := NewLocalConnection(NewRemoteConnection(router.Ourself.Peer, nil, tcpConn.RemoteAddr().String(), false),
+			tcpConn, nil, router)
+		conn.outbound = outbound
+		return conn
+	}
+	conn1, conn2 := newConn(router1, tcpConn1, true), newConn(router2, tcpConn2, false)
+	var err2 error
+	done := make(chan struct{})
+	go func() {
+		if err2 = conn2.handshake(gob.NewEncoder(tcpConn2), gob.NewDecoder(tcpConn2), true); err2 != nil {
+			tcpConn2.Close()
+		}
+		close(done)
+	}()
+	err1 := conn1.handshake(gob.NewEncoder(tcpConn1), gob.NewDecoder(tcpConn1), true)
+	if err1 != nil {
+		tcpConn1.Close()
+	}
+	<-done
+	return conn1, conn2, err1, err2
+}
+
+func TestHandshakeMAC(t *testing.T) {
+	for _, password := range []string{"", "password"} {
+		router1 := handshakeTestRouter("01:00:00:01:00:00", password)
+		router2 := handshakeTestRouter("02:00:00:01:00:00", password)
+		conn1, conn2, err1, err2 := handshakePair(t, router1, router2, nil)
+		wt.AssertNoErr(t, err1)
+		wt.AssertNoErr(t, err2)
+		for _, conn := range []*LocalConnection{conn1, conn2} {
+			if !conn.capabilities.Has(CapHandshakeMAC | CapDirectionalControlKeys) {
+				wt.Fatalf(t, "Expected a MACed handshake with directional control keys; got %s", conn.capabilities)
+			}
+		}
+
+		// Someone in the way strips a capability, to downgrade the
+		// connection to the same control key both ways
+		router1 = handshakeTestRouter("01:00:00:01:00:00", password)
+		router2 = handshakeTestRouter("02:00:00:01:00:00", password)
+		_, _, err1, err2 = handshakePair(t, router1, router2, func(fromDialer bool, fields map[string]string) {
+			if fromDialer {
+				fields["Capabilities"] = fmt.Sprint(uint64(router1.capabilities() &^ CapDirectionalControlKeys))
+				delete(fields, "ControlKeys")
+			}
+		})
+		if err2 == nil || !strings.Contains(err2.Error(), "tampered") {
+			wt.Fatalf(t, "Expected the remote to notice the handshake was tampered with; got %v", err2)
+		}
+		if err1 == nil {
+			wt.Fatalf(t, "Expected a tampered handshake to fail")
+		}
+	}
+}
+
+// Send a message over the control channel of one end of a connection,
+// and receive it at the other.
+func sendControlMsg(t *testing.T, sender *LocalConnection, receiver TCPReceiver, msg []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	tcpSender, ok := sender.tcpSender.(*EncryptedTCPSender)
+	if !ok {
+		wt.Fatalf(t, "Expected an encrypted control channel; got %T", sender.tcpSender)
+	}
+	tcpSender.outerEncoder = gob.NewEncoder(&buf)
+	wt.AssertNoErr(t, tcpSender.Send(msg))
+	var sent []byte
+	wt.AssertNoErr(t, gob.NewDecoder(&buf).Decode(&sent))
+	return receiver.Decode(sent)
+}
+
+func TestControlKeys(t *testing.T) {
+	for _, password := range []string{"", "password"} {
+		router1 := handshakeTestRouter("01:00:00:01:00:00", password)
+		router2 := handshakeTestRouter("02:00:00:01:00:00", password)
+		conn1, conn2, err1, err2 := handshakePair(t, router1, router2, nil)
+		wt.AssertNoErr(t, err1)
+		wt.AssertNoErr(t, err2)
+
+		for _, ends := range [][2]*LocalConnection{{conn1, conn2}, {conn2, conn1}} {
+			msg := []byte("from " + ends[0].local.Name.String())
+			received, err := sendControlMsg(t, ends[0], ends[1].tcpReceiver, msg)
+			wt.AssertNoErr(t, err)
+			wt.AssertEqualString(t, string(received), string(msg), "control message")
+		}
+		// Each direction has its own key, so messages can't be
+		// reflected back at their sender
+		if _, err := sendControlMsg(t, conn1, conn1.tcpReceiver, []byte("reflected")); err == nil {
+			wt.Fatalf(t, "Expected a reflected control message not to decrypt")
+		}
+	}
+
+	// Older peers use the same key both ways, and don't MAC the
+	// handshake
+	router1 := handshakeTestRouter("01:00:00:01:00:00", "")
+	router2 := handshakeTestRouter("02:00:00:01:00:00", "")
+	conn1, conn2, err1, err2 := handshakePair(t, router1, router2, func(_ bool, fields map[string]string) {
+		fields["Capabilities"] = fmt.Sprint(uint64(router1.capabilities() &^ (CapDirectionalControlKeys | CapHandshakeMAC)))
+		delete(fields, "ControlKeys")
+	})
+	wt.AssertNoErr(t, err1)
+	wt.AssertNoErr(t, err2)
+	received, err := sendControlMsg(t, conn1, conn2.tcpReceiver, []byte("legacy"))
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, string(received), "legacy", "control message")
+	if *conn1.tcpSender.(*EncryptedTCPSender).key != *conn1.tcpReceiver.(*EncryptedTCPReceiver).key {
+		wt.Fatalf(t, "Expected the same key both ways with an older peer")
+	}
+}
+
+func TestHandshakeInterfaceMTU(t *testing.T) {
+	loMTU := InterfaceMTU(net.IPv4(127, 0, 0, 1))
+	if loMTU == 0 {
+		t.Skip("No MTU for the loopback interface")
+	}
+	router1 := handshakeTestRouter("01:00:00:01:00:00", "")
+	router2 := handshakeTestRouter("02:00:00:01:00:00", "")
+	conn1, conn2, err1, err2 := handshakePair(t, router1, router2, nil)
+	wt.AssertNoErr(t, err1)
+	wt.AssertNoErr(t, err2)
+	wt.AssertEqualInt(t, conn1.maxPMTU, loMTU, "dialer's max PMTU")
+	wt.AssertEqualInt(t, conn2.maxPMTU, loMTU, "listener's max PMTU")
+
+	// The lower of the two MTUs goes, on both sides; older peers
+	// don't MAC the handshake, or say what their MTU is
+	router1 = handshakeTestRouter("01:00:00:01:00:00", "")
+	router2 = handshakeTestRouter("02:00:00:01:00:00", "")
+	conn1, conn2, err1, err2 = handshakePair(t, router1, router2, func(fromDialer bool, fields map[string]string) {
+		fields["Capabilities"] = fmt.Sprint(uint64(router1.capabilities() &^ CapHandshakeMAC))
+		if fromDialer {
+			fields["InterfaceMTU"] = "1280"
+		} else {
+			delete(fields, "InterfaceMTU")
+		}
+	})
+	wt.AssertNoErr(t, err1)
+	wt.AssertNoErr(t, err2)
+	wt.AssertEqualInt(t, conn1.maxPMTU, 0, "max PMTU with a peer that didn't say")
+	wt.AssertEqualInt(t, conn2.maxPMTU, 1280, "max PMTU with a peer of lower MTU")
+}
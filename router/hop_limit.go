@@ -0,0 +1,32 @@
+package router
+
+import (
+	"sync/atomic"
+)
+
+// Hop limits. Where both peers understand them, the header of every
+// frame they exchange carries a hop limit, much like the TTL of IP
+// packets. The source of a frame sets it to FrameHopLimit, and every
+// peer relaying the frame on sends it on with one less, or drops it,
+// counting it in HopLimitDrops, when the limit is down to one. So
+// frames caught in a routing loop, while peers disagree about the
+// topology, as they converge on a change, don't circle forever.
+// Frames from peers which don't set the limit start afresh at ours.
+
+// The hop limit to send the frame on with
+func (dec *EthernetDecoder) HopLimit() uint8 {
+	if dec == nil || dec.hops == 0 {
+		return FrameHopLimit
+	}
+	return dec.hops - 1
+}
+
+// Whether we may relay a frame which arrived over the connection with
+// the hop limit, counting it as dropped if not
+func (conn *LocalConnection) withinHopLimit(hops uint8) bool {
+	if hops == 1 {
+		atomic.AddUint64(&conn.stats.HopLimitDrops, 1)
+		return false
+	}
+	return true
+}
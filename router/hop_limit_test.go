@@ -0,0 +1,45 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+)
+
+func TestHopLimits(t *testing.T) {
+	conn1, conn2 := newTestGCMConnPair()
+	conn1.stats, conn2.stats = &ConnectionStats{}, &ConnectionStats{}
+	conn1.hopLimits, conn2.hopLimits = true, true
+	conn1.tenantTags, conn2.tenantTags = true, true
+	enc := newPlaintextEncryptor(conn1)
+	frame := &ForwardedFrame{srcPeer: conn1.local, dstPeer: conn1.remote, frame: []byte("hello world"), tenant: 258, hops: 7}
+	enc.AppendFrame(frame)
+	packet := enc.Bytes()
+	wt.AssertEqualInt(t, len(packet), enc.FrameOverhead()+len(frame.frame), "packet length")
+	dec := NewEthernetDecoder()
+	received := 0
+	err := NewNonDecryptor(conn2).IterateFrames(func(_ *LocalConnection, _ *net.UDPAddr, _, _ []byte, tenant uint16, hops uint8, _ uint16, payload []byte) error {
+		wt.AssertEqualInt(t, int(tenant), 258, "tenant")
+		wt.AssertEqualInt(t, int(hops), 7, "hop limit")
+		wt.AssertEqualString(t, string(payload), string(frame.frame), "frame")
+		dec.hops = hops
+		received++
+		return nil
+	}, &UDPPacket{Packet: packet})
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, received, 1, "frames received")
+
+	// Relayed frames go on with one less, and our own with the full limit
+	wt.AssertEqualInt(t, int(dec.HopLimit()), 6, "hop limit relayed")
+	wt.AssertEqualInt(t, int(NewEthernetDecoder().HopLimit()), FrameHopLimit, "hop limit of captured frames")
+	var noDec *EthernetDecoder
+	wt.AssertEqualInt(t, int(noDec.HopLimit()), FrameHopLimit, "hop limit without decoder")
+
+	if !conn2.withinHopLimit(2) || !conn2.withinHopLimit(0) {
+		wt.Fatalf(t, "Expected frames within their hop limit, or without one, to be relayed")
+	}
+	if conn2.withinHopLimit(1) {
+		wt.Fatalf(t, "Expected frame at its hop limit to be dropped")
+	}
+	wt.AssertEqualInt(t, int(conn2.ConnectionStats().HopLimitDrops), 1, "hop limit drops")
+}
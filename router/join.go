@@ -0,0 +1,424 @@
+package router
+
+import (
+	"bytes"
+	"code.google.com/p/go.crypto/nacl/secretbox"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Join tokens, so that the password alone doesn't let a peer into the
+// network. Peers launched with a join key sign tokens with it, and
+// hand them out, e.g. through `weave token`, to peers which should
+// join. Tokens carry the public half of the join key, so peers which
+// joined with one can check the tokens of others too.
+//
+// Each token is bound to a key pair of its own, the holder key, whose
+// private half goes out with the token but never over the network. In
+// the handshake, each peer presents a token, along with a signature
+// with its holder key over the session key, and encrypted with the
+// session key, so that neither observers nor the peers it was
+// presented to can replay it on another connection. Peers with the
+// join key sign themselves a short-lived token for each connection;
+// the others present the one they joined with. The peer which dialed
+// presents its token first, and the other only presents its own once
+// that checks out.
+//
+// Tokens can be revoked, by their ID, on any peer with the key. Peers
+// gossip the revocations, signed with the key, and shut down the
+// connections of peers which presented a revoked token.
+
+const (
+	joinTokenVersion = 2
+	joinTokenSize    = 1 + 2*ed25519.PublicKeySize + 8 + 8 + ed25519.SignatureSize
+	joinTokenIDSize  = 8
+)
+
+type JoinToken struct {
+	Issuer    ed25519.PublicKey
+	Holder    ed25519.PublicKey
+	ID        string    // hex
+	Expiry    time.Time // zero for none
+	Signature []byte
+	holderKey ed25519.PrivateKey // nil but for the peer holding the token
+}
+
+type JoinAuth struct {
+	sync.RWMutex
+	private  ed25519.PrivateKey // nil when we joined with a token, and can't issue them
+	public   ed25519.PublicKey
+	token    *JoinToken        // the one we joined with, if we did
+	revoked  map[string][]byte // token IDs, with the signatures revoking them
+	onRevoke func(id string)
+	gossip   Gossip
+}
+
+// What we gossip about revoked tokens
+type JoinRevocation struct {
+	ID        string
+	Signature []byte
+}
+
+// Peers with the same join key can issue tokens for each other.
+func NewJoinAuthWithKey(key []byte) (*JoinAuth, error) {
+	if len(key) == 0 {
+		return nil, fmt.Errorf("join key must not be empty")
+	}
+	seed := sha256.Sum256(Concat([]byte("weave join key"), key))
+	private := ed25519.NewKeyFromSeed(seed[:])
+	return &JoinAuth{private: private, public: private.Public().(ed25519.PublicKey), revoked: make(map[string][]byte)}, nil
+}
+
+func NewJoinAuthWithToken(tokenStr string) (*JoinAuth, error) {
+	token, err := ParseJoinToken(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+	if token.holderKey == nil {
+		return nil, fmt.Errorf("join token %s comes without its holder key", token.ID)
+	}
+	auth := &JoinAuth{public: token.Issuer, token: token, revoked: make(map[string][]byte)}
+	if err := auth.Check(token); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+func (auth *JoinAuth) CanIssue() bool {
+	return auth.private != nil
+}
+
+// Issue a token which admits a peer for the given time, or forever if
+// zero.
+func (auth *JoinAuth) Issue(ttl time.Duration) (*JoinToken, error) {
+	if auth.private == nil {
+		return nil, fmt.Errorf("cannot issue join tokens without the join key")
+	}
+	id := make([]byte, joinTokenIDSize)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	holder, holderKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	token := &JoinToken{Issuer: auth.public, Holder: holder, ID: hex.EncodeToString(id), holderKey: holderKey}
+	if ttl > 0 {
+		token.Expiry = time.Now().Add(ttl).Truncate(time.Second)
+	}
+	token.Signature = ed25519.Sign(auth.private, token.signed())
+	return token, nil
+}
+
+// The token we present in the handshake.
+func (auth *JoinAuth) handshakeToken() (*JoinToken, error) {
+	if auth.private == nil {
+		return auth.token, nil
+	}
+	return auth.Issue(HandshakeTokenTTL)
+}
+
+// Whether a token admits its peer.
+func (auth *JoinAuth) Check(token *JoinToken) error {
+	if !bytes.Equal(token.Issuer, auth.public) {
+		return fmt.Errorf("join token %s was issued for another network", token.ID)
+	}
+	if !ed25519.Verify(auth.public, token.signed(), token.Signature) {
+		return fmt.Errorf("join token %s has an invalid signature", token.ID)
+	}
+	if !token.Expiry.IsZero() && time.Now().After(token.Expiry) {
+		return fmt.Errorf("join token %s expired at %v", token.ID, token.Expiry)
+	}
+	auth.RLock()
+	defer auth.RUnlock()
+	if _, found := auth.revoked[token.ID]; found {
+		return fmt.Errorf("join token %s has been revoked", token.ID)
+	}
+	return nil
+}
+
+// Revoke a token, and tell everyone.
+func (auth *JoinAuth) Revoke(id string) error {
+	if auth.private == nil {
+		return fmt.Errorf("cannot revoke join tokens without the join key")
+	}
+	if raw, err := hex.DecodeString(id); err != nil || len(raw) != joinTokenIDSize {
+		return fmt.Errorf("invalid join token ID %q", id)
+	}
+	revocation := JoinRevocation{ID: id, Signature: ed25519.Sign(auth.private, revocationSigned(id))}
+	if !auth.add([]JoinRevocation{revocation}) {
+		return nil
+	}
+	if auth.gossip != nil {
+		checkWarn(auth.gossip.GossipBroadcast(encodeRevocations([]JoinRevocation{revocation})))
+	}
+	return nil
+}
+
+func (auth *JoinAuth) Revoked() []string {
+	auth.RLock()
+	defer auth.RUnlock()
+	ids := make([]string, 0, len(auth.revoked))
+	for id := range auth.revoked {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Take on the revocations we didn't know of, returning whether there
+// were any.
+func (auth *JoinAuth) add(revocations []JoinRevocation) bool {
+	var added []string
+	auth.Lock()
+	for _, revocation := range revocations {
+		if _, found := auth.revoked[revocation.ID]; !found {
+			auth.revoked[revocation.ID] = revocation.Signature
+			added = append(added, revocation.ID)
+		}
+	}
+	onRevoke := auth.onRevoke
+	auth.Unlock()
+	for _, id := range added {
+		logCrypto.Info("Join token", id, "revoked")
+		if auth.token != nil && auth.token.ID == id {
+			logCrypto.Warn("The join token we joined with has been revoked")
+		}
+		if onRevoke != nil {
+			onRevoke(id)
+		}
+	}
+	return len(added) > 0
+}
+
+func (auth *JoinAuth) String() string {
+	var buf bytes.Buffer
+	if auth.CanIssue() {
+		buf.WriteString("Issuing join tokens\n")
+	} else {
+		buf.WriteString(fmt.Sprintf("Joined with token %s\n", auth.token.ID))
+	}
+	buf.WriteString(fmt.Sprintf("Revoked tokens: %s\n", strings.Join(auth.Revoked(), " ")))
+	return buf.String()
+}
+
+func (auth *JoinAuth) OnGossipUnicast(sender PeerName, msg []byte) error {
+	return fmt.Errorf("unexpected join token gossip unicast from %s", sender)
+}
+
+func (auth *JoinAuth) OnGossipBroadcast(msg []byte) error {
+	_, err := auth.merge(msg)
+	return err
+}
+
+func (auth *JoinAuth) Gossip() []byte {
+	auth.RLock()
+	defer auth.RUnlock()
+	revocations := make([]JoinRevocation, 0, len(auth.revoked))
+	for id, signature := range auth.revoked {
+		revocations = append(revocations, JoinRevocation{id, signature})
+	}
+	return encodeRevocations(revocations)
+}
+
+func (auth *JoinAuth) OnGossip(buf []byte) ([]byte, error) {
+	if changed, err := auth.merge(buf); err != nil || !changed {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (auth *JoinAuth) merge(buf []byte) (bool, error) {
+	var revocations []JoinRevocation
+	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&revocations); err != nil {
+		return false, err
+	}
+	for _, revocation := range revocations {
+		if !ed25519.Verify(auth.public, revocationSigned(revocation.ID), revocation.Signature) {
+			return false, fmt.Errorf("revocation of join token %s has an invalid signature", revocation.ID)
+		}
+	}
+	return auth.add(revocations), nil
+}
+
+func encodeRevocations(revocations []JoinRevocation) []byte {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(revocations); err != nil {
+		log.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func revocationSigned(id string) []byte {
+	return []byte("weave join token revocation " + id)
+}
+
+func (token *JoinToken) encode() []byte {
+	buf := make([]byte, 0, joinTokenSize)
+	buf = append(buf, joinTokenVersion)
+	buf = append(buf, token.Issuer...)
+	buf = append(buf, token.Holder...)
+	id, _ := hex.DecodeString(token.ID)
+	buf = append(buf, id...)
+	var expiry [8]byte
+	if !token.Expiry.IsZero() {
+		binary.BigEndian.PutUint64(expiry[:], uint64(token.Expiry.Unix()))
+	}
+	buf = append(buf, expiry[:]...)
+	return append(buf, token.Signature...)
+}
+
+// What the signature covers
+func (token *JoinToken) signed() []byte {
+	buf := token.encode()
+	return Concat([]byte("weave join token"), buf[:joinTokenSize-ed25519.SignatureSize])
+}
+
+// The token as we hand it out, along with the seed of its holder key
+// where we have it.
+func (token *JoinToken) String() string {
+	buf := token.encode()
+	if token.holderKey != nil {
+		buf = append(buf, token.holderKey.Seed()...)
+	}
+	return base64.URLEncoding.EncodeToString(buf)
+}
+
+func ParseJoinToken(str string) (*JoinToken, error) {
+	buf, err := base64.URLEncoding.DecodeString(strings.TrimSpace(str))
+	if err != nil || len(buf) < joinTokenSize {
+		return nil, fmt.Errorf("invalid join token")
+	}
+	token, err := decodeJoinToken(buf[:joinTokenSize])
+	if err != nil {
+		return nil, err
+	}
+	switch seed := buf[joinTokenSize:]; len(seed) {
+	case 0:
+	case ed25519.SeedSize:
+		token.holderKey = ed25519.NewKeyFromSeed(seed)
+		if !bytes.Equal(token.holderKey.Public().(ed25519.PublicKey), token.Holder) {
+			return nil, fmt.Errorf("join token %s comes with the wrong holder key", token.ID)
+		}
+	default:
+		return nil, fmt.Errorf("invalid join token")
+	}
+	return token, nil
+}
+
+func decodeJoinToken(buf []byte) (*JoinToken, error) {
+	if len(buf) != joinTokenSize || buf[0] != joinTokenVersion {
+		return nil, fmt.Errorf("invalid join token")
+	}
+	buf = buf[1:]
+	token := &JoinToken{Issuer: ed25519.PublicKey(buf[:ed25519.PublicKeySize])}
+	buf = buf[ed25519.PublicKeySize:]
+	token.Holder = ed25519.PublicKey(buf[:ed25519.PublicKeySize])
+	buf = buf[ed25519.PublicKeySize:]
+	token.ID = hex.EncodeToString(buf[:joinTokenIDSize])
+	buf = buf[joinTokenIDSize:]
+	if expiry := binary.BigEndian.Uint64(buf[:8]); expiry != 0 {
+		token.Expiry = time.Unix(int64(expiry), 0)
+	}
+	token.Signature = buf[8:]
+	return token, nil
+}
+
+// Each direction of a connection has its own key for the token, so
+// that a peer can't reflect ours back at us.
+func joinTokenKey(sessionKey *[32]byte, senderName []byte) *[32]byte {
+	key := sha256.Sum256(Concat([]byte("weave join token"), sessionKey[:], senderName))
+	return &key
+}
+
+// What a peer signs with its holder key to show it holds the token it
+// presents on a connection.
+func joinTokenProof(sessionKey *[32]byte, senderName []byte) []byte {
+	proof := sha256.Sum256(Concat([]byte("weave join token proof"), sessionKey[:], senderName))
+	return proof[:]
+}
+
+// In the handshake, present our token to the remote peer, and check
+// the one it presents, returning its ID. The peer which dialed goes
+// first, so we never present ours to a peer without a good one.
+func (conn *LocalConnection) exchangeJoinTokens(enc *gob.Encoder, dec *gob.Decoder, remoteName PeerName) (string, error) {
+	auth := conn.Router.JoinAuth
+	token, err := auth.handshakeToken()
+	if err != nil {
+		return "", err
+	}
+	present := func() error {
+		return enc.Encode(map[string]string{"JoinToken": hex.EncodeToString(conn.sealJoinToken(token))})
+	}
+	if conn.outbound {
+		if err := present(); err != nil {
+			return "", err
+		}
+	}
+	tokenRecv := map[string]string{}
+	if err := dec.Decode(&tokenRecv); err != nil {
+		return "", err
+	}
+	sealed, err := hex.DecodeString(tokenRecv["JoinToken"])
+	if err != nil {
+		return "", err
+	}
+	remoteToken, err := conn.openJoinToken(sealed, remoteName)
+	if err != nil {
+		return "", err
+	}
+	if err := auth.Check(remoteToken); err != nil {
+		return remoteToken.ID, err
+	}
+	if !conn.outbound {
+		if err := present(); err != nil {
+			return "", err
+		}
+	}
+	return remoteToken.ID, nil
+}
+
+// Our token, with the proof that we hold it, sealed for the remote
+func (conn *LocalConnection) sealJoinToken(token *JoinToken) []byte {
+	signature := ed25519.Sign(token.holderKey, joinTokenProof(conn.SessionKey, conn.local.NameByte))
+	// Each key only ever seals one message, so a fixed nonce is fine
+	var nonce [24]byte
+	return secretbox.Seal(nil, Concat(token.encode(), signature), &nonce, joinTokenKey(conn.SessionKey, conn.local.NameByte))
+}
+
+// The token the remote presented, provided it proved it holds it.
+func (conn *LocalConnection) openJoinToken(sealed []byte, remoteName PeerName) (*JoinToken, error) {
+	var nonce [24]byte
+	opened, ok := secretbox.Open(nil, sealed, &nonce, joinTokenKey(conn.SessionKey, remoteName.Bin()))
+	if !ok || len(opened) != joinTokenSize+ed25519.SignatureSize {
+		return nil, fmt.Errorf("Unable to decrypt join token from remote")
+	}
+	token, err := decodeJoinToken(opened[:joinTokenSize])
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(token.Holder, joinTokenProof(conn.SessionKey, remoteName.Bin()), opened[joinTokenSize:]) {
+		return nil, fmt.Errorf("Remote presented join token %s without proof that it holds it", token.ID)
+	}
+	return token, nil
+}
+
+// Shut down the connections of peers which presented the token.
+func (router *Router) joinTokenRevoked(id string) {
+	router.Ourself.ForEachConnection(func(_ PeerName, conn Connection) {
+		if localConn, ok := conn.(*LocalConnection); ok && localConn.joinTokenID == id {
+			localConn.Shutdown(fmt.Errorf("join token %s revoked", id))
+		}
+	})
+}
@@ -0,0 +1,200 @@
+package router
+
+import (
+	"code.google.com/p/go.crypto/nacl/secretbox"
+	"crypto/ed25519"
+	"encoding/gob"
+	wt "github.com/zettio/weave/testing"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestJoinTokens(t *testing.T) {
+	issuer, err := NewJoinAuthWithKey([]byte("key"))
+	wt.AssertNoErr(t, err)
+	token, err := issuer.Issue(time.Hour)
+	wt.AssertNoErr(t, err)
+	parsed, err := ParseJoinToken(token.String())
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, parsed.String(), token.String(), "token")
+	wt.AssertEqualString(t, parsed.ID, token.ID, "token ID")
+
+	// Peers which joined with a token check the tokens of others
+	joined, err := NewJoinAuthWithToken(token.String())
+	wt.AssertNoErr(t, err)
+	if joined.CanIssue() {
+		wt.Fatalf(t, "Expected a peer which joined with a token not to issue them")
+	}
+	forever, err := issuer.Issue(0)
+	wt.AssertNoErr(t, err)
+	wt.AssertNoErr(t, joined.Check(forever))
+	handshakeToken, err := joined.handshakeToken()
+	wt.AssertNoErr(t, err)
+	wt.AssertNoErr(t, issuer.Check(handshakeToken))
+
+	other, _ := NewJoinAuthWithKey([]byte("other key"))
+	if err := other.Check(token); err == nil {
+		wt.Fatalf(t, "Expected a token for another network not to check out")
+	}
+	token.Expiry = token.Expiry.Add(time.Hour)
+	if err := issuer.Check(token); err == nil {
+		wt.Fatalf(t, "Expected a tampered token not to check out")
+	}
+	expired, _ := issuer.Issue(time.Nanosecond)
+	expired.Expiry = time.Now().Add(-time.Second)
+	expired.Signature = ed25519.Sign(issuer.private, expired.signed())
+	if err := issuer.Check(expired); err == nil {
+		wt.Fatalf(t, "Expected an expired token not to check out")
+	}
+	if _, err := ParseJoinToken("not a token"); err == nil {
+		wt.Fatalf(t, "Expected an error parsing an invalid token")
+	}
+	// What peers see of a token in the handshake is no good for joining
+	seen, err := decodeJoinToken(forever.encode())
+	wt.AssertNoErr(t, err)
+	wt.AssertNoErr(t, issuer.Check(seen))
+	if _, err := NewJoinAuthWithToken(seen.String()); err == nil {
+		wt.Fatalf(t, "Expected a token without its holder key not to be accepted for joining")
+	}
+}
+
+func joinTestConn(name PeerName, auth *JoinAuth, sessionKey *[32]byte, outbound bool) *LocalConnection {
+	conn := &LocalConnection{Router: &Router{RouterConfig: RouterConfig{JoinAuth: auth}}, SessionKey: sessionKey}
+	conn.local = NewPeer(name, 0, 0)
+	conn.outbound = outbound
+	return conn
+}
+
+// Run exchangeJoinTokens on both ends of a TCP connection, the first
+// having dialed. The second hangs up on failing, as the handshake
+// would.
+func exchangeJoinTokensPair(t *testing.T, conn1, conn2 *LocalConnection) (string, string, error, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	wt.AssertNoErr(t, err)
+	defer listener.Close()
+	tcpConn1, err := net.Dial("tcp", listener.Addr().String())
+	wt.AssertNoErr(t, err)
+	defer tcpConn1.Close()
+	tcpConn2, err := listener.Accept()
+	wt.AssertNoErr(t, err)
+	var id2 string
+	var err2 error
+	done := make(chan struct{})
+	go func() {
+		id2, err2 = conn2.exchangeJoinTokens(gob.NewEncoder(tcpConn2), gob.NewDecoder(tcpConn2), conn1.local.Name)
+		tcpConn2.Close()
+		close(done)
+	}()
+	id1, err1 := conn1.exchangeJoinTokens(gob.NewEncoder(tcpConn1), gob.NewDecoder(tcpConn1), conn2.local.Name)
+	<-done
+	return id1, id2, err1, err2
+}
+
+func TestJoinTokenExchange(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	issuer, _ := NewJoinAuthWithKey([]byte("key"))
+	token, _ := issuer.Issue(0)
+	joined, _ := NewJoinAuthWithToken(token.String())
+	sessionKey := &[32]byte{7}
+
+	id1, id2, err1, err2 := exchangeJoinTokensPair(t, joinTestConn(name1, joined, sessionKey, true),
+		joinTestConn(name2, issuer, sessionKey, false))
+	wt.AssertNoErr(t, err1)
+	wt.AssertNoErr(t, err2)
+	wt.AssertEqualString(t, id2, token.ID, "token presented by peer which dialed")
+	if id1 == "" || id1 == token.ID {
+		wt.Fatalf(t, "Expected a token of its own from the peer with the key; got %q", id1)
+	}
+
+	// Peers with a bad token don't get to see ours
+	other, _ := NewJoinAuthWithKey([]byte("other key"))
+	_, _, err1, err2 = exchangeJoinTokensPair(t, joinTestConn(name1, other, sessionKey, true),
+		joinTestConn(name2, issuer, sessionKey, false))
+	if err2 == nil {
+		wt.Fatalf(t, "Expected a token for another network to be rejected")
+	}
+	if err1 != io.EOF {
+		wt.Fatalf(t, "Expected no token back for a bad one; got %v", err1)
+	}
+}
+
+func TestJoinTokenReplay(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	name3, _ := PeerNameFromString("03:00:00:01:00:00")
+	issuer, _ := NewJoinAuthWithKey([]byte("key"))
+	token, _ := issuer.Issue(0)
+	joined, _ := NewJoinAuthWithToken(token.String())
+
+	// Peer 1 presents its token to peer 2...
+	sessionKey := &[32]byte{7}
+	sealed := joinTestConn(name1, joined, sessionKey, true).sealJoinToken(token)
+	opened, err := joinTestConn(name2, issuer, sessionKey, false).openJoinToken(sealed, name1)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, opened.ID, token.ID, "token ID")
+
+	// ...which can open it, but not pass it off as its own, or as peer
+	// 1's, on a connection to peer 3
+	var nonce [24]byte
+	presented, ok := secretbox.Open(nil, sealed, &nonce, joinTokenKey(sessionKey, name1.Bin()))
+	if !ok {
+		wt.Fatalf(t, "Unable to open the token peer 1 presented")
+	}
+	otherKey := &[32]byte{8}
+	conn3 := joinTestConn(name3, issuer, otherKey, false)
+	for _, name := range []PeerName{name1, name2} {
+		replayed := secretbox.Seal(nil, presented, &nonce, joinTokenKey(otherKey, name.Bin()))
+		if _, err := conn3.openJoinToken(replayed, name); err == nil {
+			wt.Fatalf(t, "Expected a token replayed by %s to be rejected", name)
+		}
+	}
+	// Nor on another connection between the same peers
+	replayed := secretbox.Seal(nil, presented, &nonce, joinTokenKey(otherKey, name1.Bin()))
+	if _, err := joinTestConn(name2, issuer, otherKey, false).openJoinToken(replayed, name1); err == nil {
+		wt.Fatalf(t, "Expected a token replayed on another connection to be rejected")
+	}
+}
+
+func TestJoinTokenRevocation(t *testing.T) {
+	issuer, _ := NewJoinAuthWithKey([]byte("key"))
+	token, _ := issuer.Issue(0)
+	joined, _ := NewJoinAuthWithToken(token.String())
+	var revoked []string
+	joined.onRevoke = func(id string) { revoked = append(revoked, id) }
+
+	if err := joined.Revoke(token.ID); err == nil {
+		wt.Fatalf(t, "Expected a peer without the key not to revoke tokens")
+	}
+	wt.AssertNoErr(t, issuer.Revoke(token.ID))
+	if err := issuer.Check(token); err == nil {
+		wt.Fatalf(t, "Expected a revoked token not to check out")
+	}
+
+	// Revocations spread through gossip, once
+	update, err := joined.OnGossip(issuer.Gossip())
+	wt.AssertNoErr(t, err)
+	if update == nil {
+		wt.Fatalf(t, "Expected gossip of a new revocation to be passed on")
+	}
+	update, err = joined.OnGossip(issuer.Gossip())
+	wt.AssertNoErr(t, err)
+	if update != nil {
+		wt.Fatalf(t, "Expected gossip of a known revocation not to be passed on")
+	}
+	wt.AssertEqualInt(t, len(revoked), 1, "revocations")
+	wt.AssertEqualString(t, revoked[0], token.ID, "revoked token")
+	if err := joined.Check(token); err == nil {
+		wt.Fatalf(t, "Expected a revoked token not to check out")
+	}
+
+	// Only those signed with the key count
+	other, _ := NewJoinAuthWithKey([]byte("other key"))
+	otherToken, _ := other.Issue(0)
+	wt.AssertNoErr(t, other.Revoke(otherToken.ID))
+	if _, err := joined.OnGossip(other.Gossip()); err == nil {
+		wt.Fatalf(t, "Expected an error merging revocations signed with another key")
+	}
+}
@@ -0,0 +1,50 @@
+package router
+
+import (
+	"time"
+)
+
+// NAT keepalives. NATs forget the mappings of UDP flows which have
+// gone idle for a while, commonly 30s, and as little as 20s in some,
+// whereupon packets from the remote stop getting through, silently,
+// while ours still do. Heartbeats keep mappings alive as a rule, but
+// their interval is tuned for noticing failures rather than NATs, may
+// well be longer than the NATs' timeouts, and they go through the
+// forwarders, where they can be held up behind frames, or leave from
+// raw sockets. So every established connection also sends the remote
+// a STUN binding indication, which RFC 5389 provides for keepalives,
+// straight from the UDP listener, every NATKeepalive, or the interval
+// configured for the remote peer, whether or not frames flow. The
+// remote drops it unanswered; its own keepalives keep the mappings in
+// its direction alive. Older peers would take indications for frames,
+// so they only go to peers which know better.
+
+// The interval of keepalives to the named peer; 0 for none.
+func (router *Router) KeepaliveFor(name PeerName) time.Duration {
+	if interval, found := router.PeerKeepalives[name]; found {
+		return interval
+	}
+	return router.CurrentTuning().NATKeepalive
+}
+
+// Called on becoming established, and on retuning
+func (conn *LocalConnection) startKeepalives() {
+	stopTicker(conn.keepalive)
+	conn.keepalive = nil
+	if !conn.keepalives || !conn.established {
+		return
+	}
+	if interval := conn.Router.KeepaliveFor(conn.remote.Name); interval > 0 {
+		conn.keepalive = time.NewTicker(interval)
+	}
+}
+
+func (conn *LocalConnection) sendKeepalive() {
+	if conn.sendingOverTCP || conn.remoteUDPAddr == nil {
+		return
+	}
+	var txID stunTxID
+	copy(txID[:], randBytes(len(txID)))
+	// Should this fail, so do heartbeats, which tell
+	conn.Router.UDPListener.WriteToUDP(formSTUN(stunIndication, txID, nil), conn.remoteUDPAddr)
+}
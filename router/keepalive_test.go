@@ -0,0 +1,47 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKeepaliveIntervals(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	router := NewRouter(RouterConfig{
+		Tuning:         Tuning{NATKeepalive: 20 * time.Second},
+		PeerKeepalives: map[PeerName]time.Duration{name2: 0}}, name1)
+	wt.AssertEqualInt(t, int(router.KeepaliveFor(name1)), int(20*time.Second), "keepalive interval")
+	wt.AssertEqualInt(t, int(router.KeepaliveFor(name2)), 0, "overridden keepalive interval")
+
+	conn := &LocalConnection{Router: router}
+	conn.remote = NewPeer(name1, 0, 0)
+	conn.startKeepalives()
+	if conn.keepalive != nil {
+		wt.Fatalf(t, "Expected no keepalives to a peer which doesn't understand them")
+	}
+	conn.keepalives = true
+	conn.established = true
+	conn.startKeepalives()
+	if conn.keepalive == nil {
+		wt.Fatalf(t, "Expected keepalives")
+	}
+	conn.remote = NewPeer(name2, 0, 0)
+	conn.startKeepalives()
+	if conn.keepalive != nil {
+		wt.Fatalf(t, "Expected keepalives to stop for a peer with them disabled")
+	}
+}
+
+func TestKeepaliveDropped(t *testing.T) {
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	router := NewRouter(RouterConfig{}, name)
+	var txID stunTxID
+	copy(txID[:], randBytes(len(txID)))
+	sender := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: Port}
+	if !router.NAT.HandlePacket(formSTUN(stunIndication, txID, nil), sender) {
+		wt.Fatalf(t, "Expected a keepalive not to be taken for a frame")
+	}
+}
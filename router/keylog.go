@@ -0,0 +1,48 @@
+package router
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// A key log has the session keys of encrypted connections written to
+// it as they come into use, in the spirit of the SSLKEYLOGFILE of TLS
+// libraries, so that captures of the traffic between peers can be
+// decrypted after the fact, e.g. by a Wireshark dissector. Anyone who
+// can read it can read that traffic, so it's only for debugging in
+// test environments. Each line is
+//
+//   WEAVE_SESSION_KEY <connection uid> <local peer> <remote peer> <scheme> <key>
+//
+// with the uid and key in hex. The key is the one from the handshake
+// or a rekey, from which the connection's encryption scheme derives
+// what it encrypts frames with, and the control channel is encrypted
+// with SHA-256 of it followed by the binary name of the sending peer.
+
+type KeyLog struct {
+	sync.Mutex
+	file *os.File
+}
+
+func NewKeyLog(path string) (*KeyLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyLog{file: file}, nil
+}
+
+// Log the key coming into use on the connection; a no-op without a
+// key log.
+func (kl *KeyLog) Log(conn *LocalConnection, key *[32]byte) {
+	if kl == nil {
+		return
+	}
+	kl.Lock()
+	defer kl.Unlock()
+	_, err := fmt.Fprintf(kl.file, "WEAVE_SESSION_KEY %016x %s %s %s %s\n",
+		conn.uid, conn.local.Name, conn.remote.Name, conn.EncryptionScheme.Name, hex.EncodeToString(key[:]))
+	checkWarn(err)
+}
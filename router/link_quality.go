@@ -0,0 +1,263 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Where both peers can, they measure the quality of the link between
+// them with their heartbeats. Every heartbeat carries a sequence
+// number, from which the receiver works out how many heartbeats got
+// lost, and the time it was sent, which the receiver echoes in its
+// next heartbeat, along with how long it held on to it, from which
+// the original sender works out the round trip time. Neither needs
+// the peers' clocks to agree.
+//
+// Each peer tells all the others, by gossip, the round trip times and
+// loss it measured on its connections, so that LinkQualityRouting
+// can prefer routes with lower latency and loss.
+
+const (
+	heartbeatUIDSize     = 8
+	heartbeatQualitySize = heartbeatUIDSize + 4 + 8 + 8 + 8 // uid, sequence number, sent at, echoed sent at, echo delay
+	maxLossGap           = 64                               // beyond which a gap in sequence numbers counts as total loss
+)
+
+type LinkMetrics struct {
+	RTT  time.Duration // smoothed round trip time; 0 if unknown
+	Loss float64       // smoothed proportion of heartbeats from the remote which got lost
+}
+
+func (metrics LinkMetrics) String() string {
+	return fmt.Sprintf("RTT %v, loss %.1f%%", metrics.RTT, metrics.Loss*100)
+}
+
+type linkQuality struct {
+	sync.Mutex
+	sentSeq      uint32
+	receivedSeq  uint32    // highest sequence number received
+	received     bool      // whether we have received any
+	echoSentAt   int64     // when the remote sent its latest heartbeat, by its clock
+	echoReceived time.Time // when we received that
+	LinkMetrics
+}
+
+// Fill in the measurements of a heartbeat we're about to send.
+func (lq *linkQuality) stamp(payload []byte, now time.Time) {
+	lq.Lock()
+	defer lq.Unlock()
+	lq.sentSeq++
+	binary.BigEndian.PutUint32(payload[8:12], lq.sentSeq)
+	binary.BigEndian.PutUint64(payload[12:20], uint64(now.UnixNano()))
+	binary.BigEndian.PutUint64(payload[20:28], uint64(lq.echoSentAt))
+	var delay time.Duration
+	if lq.echoSentAt != 0 {
+		delay = now.Sub(lq.echoReceived)
+	}
+	binary.BigEndian.PutUint64(payload[28:36], uint64(delay))
+}
+
+func (lq *linkQuality) receive(payload []byte, now time.Time) {
+	seq := binary.BigEndian.Uint32(payload[8:12])
+	sentAt := int64(binary.BigEndian.Uint64(payload[12:20]))
+	echoSentAt := int64(binary.BigEndian.Uint64(payload[20:28]))
+	delay := time.Duration(binary.BigEndian.Uint64(payload[28:36]))
+	lq.Lock()
+	defer lq.Unlock()
+	if lq.received && seq <= lq.receivedSeq {
+		return // duplicated or reordered
+	}
+	if lq.received {
+		gap := seq - lq.receivedSeq
+		if gap > maxLossGap {
+			gap = maxLossGap
+		}
+		for ; gap > 1; gap-- {
+			lq.Loss += (1 - lq.Loss) / LinkLossWeight
+		}
+		lq.Loss -= lq.Loss / LinkLossWeight
+	}
+	lq.received, lq.receivedSeq = true, seq
+	lq.echoSentAt, lq.echoReceived = sentAt, now
+	if echoSentAt == 0 {
+		return
+	}
+	sample := now.Sub(time.Unix(0, echoSentAt)) - delay
+	switch {
+	case sample < 0:
+		// the remote is telling us nonsense
+	case lq.RTT == 0:
+		lq.RTT = sample
+	default:
+		lq.RTT += (sample - lq.RTT) / LinkRTTWeight
+	}
+}
+
+func (lq *linkQuality) metrics() LinkMetrics {
+	lq.Lock()
+	defer lq.Unlock()
+	return lq.LinkMetrics
+}
+
+func (conn *LocalConnection) LinkMetrics() LinkMetrics {
+	return conn.quality.metrics()
+}
+
+// The heartbeat frame for the forwarder to send; with link quality
+// measurements, a fresh copy with them filled in.
+func (conn *LocalConnection) stampHeartbeat(frame *ForwardedFrame) *ForwardedFrame {
+	if !conn.measuringQuality {
+		return frame
+	}
+	stamped := *frame
+	stamped.frame = make([]byte, len(frame.frame))
+	copy(stamped.frame, frame.frame)
+	conn.quality.stamp(stamped.frame[EthernetOverhead:], time.Now())
+	return &stamped
+}
+
+// Called by the router's UDP listener process
+func (conn *LocalConnection) ReceivedQualityHeartbeat(payload []byte) {
+	if conn.measuringQuality && binary.BigEndian.Uint64(payload[:8]) == conn.uid {
+		conn.quality.receive(payload, time.Now())
+	}
+}
+
+// What each peer has told us about the quality of its links, for
+// route selection, in a gossip table; see gossip_table.go.
+type LinkQualities struct {
+	*GossipTable
+}
+
+type peerLinks struct {
+	links map[PeerName]LinkMetrics
+}
+
+// What we gossip about each peer
+type PeerLinks struct {
+	Links map[PeerName]LinkMetrics
+}
+
+func NewLinkQualities(ourName PeerName) *LinkQualities {
+	lq := &LinkQualities{}
+	lq.GossipTable = NewGossipTable(ourName, "link quality", lq, &peerLinks{links: make(map[PeerName]LinkMetrics)})
+	return lq
+}
+
+// What the peer measured on its link to the remote, if anything.
+func (lq *LinkQualities) Metrics(name, remoteName PeerName) (LinkMetrics, bool) {
+	lq.RLock()
+	defer lq.RUnlock()
+	entry, found := lq.Entry(name)
+	if !found {
+		return LinkMetrics{}, false
+	}
+	metrics, found := entry.(*peerLinks).links[remoteName]
+	return metrics, found
+}
+
+// The cost of sending over the link between the two peers: the round
+// trip time, plus a little for the hop itself, scaled up by how many
+// attempts it takes to get through in both directions.
+func (lq *LinkQualities) Cost(name1, name2 PeerName) float64 {
+	var rtt time.Duration
+	delivery := 1.0
+	for _, names := range [][2]PeerName{{name1, name2}, {name2, name1}} {
+		if metrics, found := lq.Metrics(names[0], names[1]); found {
+			if metrics.RTT > rtt {
+				rtt = metrics.RTT
+			}
+			delivery *= 1 - metrics.Loss
+		}
+	}
+	if rtt == 0 {
+		rtt = UnknownLinkRTT
+	}
+	if delivery < MinLinkDelivery {
+		delivery = MinLinkDelivery
+	}
+	return float64(LinkHopCost+rtt) / delivery
+}
+
+// Take on our latest measurements and, if they changed, tell everyone.
+func (lq *LinkQualities) Update(links map[PeerName]LinkMetrics) {
+	lq.GossipTable.Update(func(entry interface{}) bool {
+		ours := entry.(*peerLinks)
+		if linksEqual(ours.links, links) {
+			return false
+		}
+		ours.links = links
+		return true
+	})
+}
+
+func linksEqual(links1, links2 map[PeerName]LinkMetrics) bool {
+	if len(links1) != len(links2) {
+		return false
+	}
+	for name, metrics := range links1 {
+		if other, found := links2[name]; !found || other != metrics {
+			return false
+		}
+	}
+	return true
+}
+
+func (lq *LinkQualities) EncodeEntries(entries map[PeerName]interface{}) interface{} {
+	update := make(map[PeerName]PeerLinks, len(entries))
+	for name, entry := range entries {
+		update[name] = PeerLinks{Links: entry.(*peerLinks).links}
+	}
+	return update
+}
+
+func (lq *LinkQualities) DecodeEntries(decoder *gob.Decoder) (map[PeerName]interface{}, error) {
+	var update map[PeerName]PeerLinks
+	if err := decoder.Decode(&update); err != nil {
+		return nil, err
+	}
+	entries := make(map[PeerName]interface{}, len(update))
+	for name, received := range update {
+		entry := &peerLinks{links: received.Links}
+		if entry.links == nil {
+			entry.links = make(map[PeerName]LinkMetrics)
+		}
+		entries[name] = entry
+	}
+	return entries, nil
+}
+
+func (lq *LinkQualities) String() string {
+	var lines []string
+	lq.RLock()
+	defer lq.RUnlock()
+	lq.ForEach(func(name PeerName, entry interface{}) {
+		for remoteName, metrics := range entry.(*peerLinks).links {
+			lines = append(lines, fmt.Sprintln(name, "->", remoteName, metrics))
+		}
+	})
+	sort.Strings(lines)
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line)
+	}
+	return buf.String()
+}
+
+// Now and then, tell everyone what we measured on our connections.
+func (router *Router) gossipLinkQuality() {
+	for range time.Tick(LinkQualityPeriod) {
+		links := make(map[PeerName]LinkMetrics)
+		router.Ourself.ForEachConnection(func(name PeerName, conn Connection) {
+			if localConn, ok := conn.(*LocalConnection); ok && localConn.measuringQuality && localConn.Established() {
+				links[name] = localConn.LinkMetrics()
+			}
+		})
+		router.LinkQuality.Update(links)
+	}
+}
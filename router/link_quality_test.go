@@ -0,0 +1,81 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"testing"
+	"time"
+)
+
+func TestLinkQualityMeasurement(t *testing.T) {
+	var lq1, lq2 linkQuality
+	payload := make([]byte, heartbeatQualitySize)
+	start := time.Now()
+
+	lq1.stamp(payload, start)
+	lq2.receive(payload, start.Add(10*time.Millisecond))
+	lq2.stamp(payload, start.Add(30*time.Millisecond))
+	lq1.receive(payload, start.Add(40*time.Millisecond))
+	wt.AssertEqualInt(t, int(lq1.metrics().RTT/time.Millisecond), 20, "RTT in ms")
+	if lq2.metrics().RTT != 0 {
+		wt.Fatalf(t, "Expected no RTT without an echo; got %v", lq2.metrics().RTT)
+	}
+
+	// Lose two heartbeats
+	for i := 0; i < 3; i++ {
+		lq1.stamp(payload, start)
+	}
+	lq2.receive(payload, start)
+	loss := lq2.metrics().Loss
+	if loss <= 0 || loss >= 2.0/LinkLossWeight {
+		wt.Fatalf(t, "Expected some loss after losing two heartbeats; got %v", loss)
+	}
+	// Duplicates don't count
+	lq2.receive(payload, start)
+	if lq2.metrics().Loss != loss {
+		wt.Fatalf(t, "Expected duplicate heartbeat to leave loss alone")
+	}
+}
+
+func TestLinkQualityRouting(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	name3, _ := PeerNameFromString("03:00:00:01:00:00")
+	peer1, peers := newNode(name1)
+	peer2 := peers.FetchWithDefault(NewPeer(name2, 0, 0))
+	peer3 := peers.FetchWithDefault(NewPeer(name3, 0, 0))
+	connect := func(from *Peer, tos ...*Peer) {
+		conns := make(map[PeerName]Connection)
+		for _, to := range tos {
+			conns[to.Name] = NewRemoteConnection(from, to, "", true)
+		}
+		from.SetVersionAndConnections(1, conns)
+	}
+	connect(peer1, peer2, peer3)
+	connect(peer2, peer1, peer3)
+	connect(peer3, peer1, peer2)
+
+	qualities := NewLinkQualities(name1)
+	qualities.Update(map[PeerName]LinkMetrics{name2: {RTT: 5 * time.Millisecond}, name3: {RTT: 100 * time.Millisecond}})
+	qualities2 := NewLinkQualities(name2)
+	qualities2.Update(map[PeerName]LinkMetrics{name3: {RTT: 5 * time.Millisecond}})
+	_, err := qualities.OnGossip(qualities2.Gossip())
+	wt.AssertNoErr(t, err)
+
+	unicast := HopCountRouting{}.Unicast(peer1, peers)
+	if unicast[name3] != name3 {
+		wt.Fatalf(t, "Expected fewest hops to go directly to peer 3; got %s", unicast[name3])
+	}
+	unicast = NewLinkQualityRouting(qualities).Unicast(peer1, peers)
+	if unicast[name2] != name2 || unicast[name3] != name2 {
+		wt.Fatalf(t, "Expected lowest latency to go via peer 2; got %v", unicast)
+	}
+
+	// Heavy loss on the detour makes the direct route preferable
+	qualities2.Update(map[PeerName]LinkMetrics{name3: {RTT: 5 * time.Millisecond, Loss: 0.99}})
+	_, err = qualities.OnGossip(qualities2.Gossip())
+	wt.AssertNoErr(t, err)
+	unicast = NewLinkQualityRouting(qualities).Unicast(peer1, peers)
+	if unicast[name3] != name3 {
+		wt.Fatalf(t, "Expected lossy detour to be avoided; got %v", unicast)
+	}
+}
@@ -0,0 +1,54 @@
+package router
+
+import (
+	"net"
+)
+
+// Frames between two MACs on our bridge, e.g. between containers on
+// this host, the bridge delivers itself, so we never hand them to the
+// forwarders, which would encrypt them and send them round in UDP for
+// nothing. The capture sees a great many of them, so rather than look
+// both MACs up in the MAC cache, under its lock, for each, decoders
+// remember which MACs they found to be local, for as long as the MAC
+// cache stays in the same generation, i.e. no MAC moves, appears or
+// goes. Only local MACs get remembered; frames for any others are on
+// their way to the forwarders, next to which a lookup costs little.
+
+type localMacs struct {
+	generations map[uint64]uint64 // MAC and network -> MAC cache generation it was local in
+}
+
+func newLocalMacs() *localMacs {
+	return &localMacs{generations: make(map[uint64]uint64)}
+}
+
+func (local *localMacs) isLocal(macs *MacCache, tenant uint16, mac net.HardwareAddr, ourself *Peer) bool {
+	if mac[0]&1 != 0 {
+		// broadcast or multicast
+		return false
+	}
+	key := uint64(tenant)<<48 | macint(mac)
+	generation := macs.Generation()
+	if cached, found := local.generations[key]; found && cached == generation {
+		return true
+	}
+	if peer, found := macs.Lookup(mac); !found || peer != ourself {
+		delete(local.generations, key)
+		return false
+	}
+	if len(local.generations) >= LocalMacsSize {
+		local.generations = make(map[uint64]uint64)
+	}
+	local.generations[key] = generation
+	return true
+}
+
+// Whether both MACs of the decoded frame are at our peer, according
+// to the MAC cache of the frame's network.
+func (dec *EthernetDecoder) IsLocal(macs *MacCache, ourself *Peer) bool {
+	if dec.local == nil {
+		dec.local = newLocalMacs()
+	}
+	return dec.local.isLocal(macs, dec.tenant, dec.eth.DstMAC, ourself) &&
+		dec.local.isLocal(macs, dec.tenant, dec.eth.SrcMAC, ourself)
+}
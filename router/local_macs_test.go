@@ -0,0 +1,48 @@
+package router
+
+import (
+	"code.google.com/p/gopacket/layers"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLocalMacs(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	peer1, peers := newNode(name1)
+	peer2 := peers.FetchWithDefault(NewPeer(name2, 0, 0))
+	macs := NewMacCache(time.Minute, func(net.HardwareAddr, *Peer) {}, peers.Fetch)
+	dec := decodeTestFrame(t, &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP,
+		SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(10, 0, 0, 2)}, layers.EthernetTypeIPv4, 10)
+
+	macs.Enter(dec.eth.SrcMAC, peer1)
+	if dec.IsLocal(macs, peer1) {
+		wt.Fatalf(t, "Expected frame to a MAC we haven't learnt not to be local")
+	}
+	macs.Enter(dec.eth.DstMAC, peer1)
+	for i := 0; i < 2; i++ {
+		if !dec.IsLocal(macs, peer1) {
+			wt.Fatalf(t, "Expected frame between local MACs to be local")
+		}
+	}
+	wt.AssertEqualInt(t, len(dec.local.generations), 2, "local MACs remembered")
+
+	// The destination moved to another peer
+	macs.Enter(dec.eth.DstMAC, peer2)
+	if dec.IsLocal(macs, peer1) {
+		wt.Fatalf(t, "Expected frame to a MAC at another peer not to be local")
+	}
+	macs.Pin(dec.eth.DstMAC, name1)
+	if !dec.IsLocal(macs, peer1) {
+		wt.Fatalf(t, "Expected frame to a MAC pinned to us to be local")
+	}
+
+	// Local on one network says nothing about another
+	dec.tenant = 1
+	other := NewMacCache(time.Minute, func(net.HardwareAddr, *Peer) {}, peers.Fetch)
+	if dec.IsLocal(other, peer1) {
+		wt.Fatalf(t, "Expected MACs unknown on the frame's network not to be local")
+	}
+}
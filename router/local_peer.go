@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strings"
 	"time"
 )
 
@@ -37,40 +38,65 @@ func (peer *LocalPeer) Broadcast(df bool, frame []byte, dec *EthernetDecoder) er
 }
 
 func (peer *LocalPeer) Relay(srcPeer, dstPeer *Peer, df bool, frame []byte, dec *EthernetDecoder) error {
-	relayPeerName, found := peer.Router.Routes.Unicast(dstPeer.Name)
+	conn, found := peer.Router.Routes.Relay(dstPeer.Name)
 	if !found {
 		// Not necessarily an error as there could be a race with the
-		// dst disappearing whilst the frame is in flight
-		log.Println("Received packet for unknown destination:", dstPeer.Name)
-		return nil
-	}
-	conn, found := peer.ConnectionTo(relayPeerName)
-	if !found {
-		// Again, could just be a race, not necessarily an error
-		log.Println("Unable to find connection to relay peer", relayPeerName)
+		// dst, or the connection to the relay peer, disappearing
+		// whilst the frame is in flight
+		if relayPeerName, found := peer.Router.Routes.Unicast(dstPeer.Name); found {
+			logForwarder.Info("Unable to find connection to relay peer", relayPeerName)
+		} else {
+			logForwarder.Info("Received packet for unknown destination:", dstPeer.Name)
+		}
 		return nil
 	}
-	return conn.(*LocalConnection).Forward(df, &ForwardedFrame{
+	return conn.Forward(df, &ForwardedFrame{
 		srcPeer: srcPeer,
 		dstPeer: dstPeer,
-		frame:   frame},
+		frame:   frame,
+		buf:     dec.FrameBuffer(),
+		tenant:  dec.Tenant(),
+		hops:    dec.HopLimit()},
 		dec)
 }
 
+// A frame that is too big for some of the connections still goes out
+// on the others. We report the smallest effective PMTU, so that the
+// sender can pick a size that works everywhere.
 func (peer *LocalPeer) RelayBroadcast(srcPeer *Peer, df bool, frame []byte, dec *EthernetDecoder) error {
+	var tooBig *FrameTooBigError
 	for _, conn := range peer.NextBroadcastHops(srcPeer) {
-		err := conn.Forward(df, &ForwardedFrame{
+		var err error
+		tooBig, err = lowestTooBig(tooBig, conn.Forward(df, &ForwardedFrame{
 			srcPeer: srcPeer,
 			dstPeer: conn.Remote(),
-			frame:   frame},
-			dec)
+			frame:   frame,
+			buf:     dec.FrameBuffer(),
+			tenant:  dec.Tenant(),
+			hops:    dec.HopLimit()},
+			dec))
 		if err != nil {
 			return err
 		}
 	}
+	if tooBig != nil {
+		return *tooBig
+	}
 	return nil
 }
 
+// Fold the error from forwarding a copy of a frame into the lowest
+// FrameTooBigError so far, passing on any other error.
+func lowestTooBig(tooBig *FrameTooBigError, err error) (*FrameTooBigError, error) {
+	if ftbe, ok := err.(FrameTooBigError); ok {
+		if tooBig == nil || ftbe.EPMTU < tooBig.EPMTU {
+			return &ftbe, nil
+		}
+		return tooBig, nil
+	}
+	return tooBig, err
+}
+
 func (peer *LocalPeer) NextBroadcastHops(srcPeer *Peer) []*LocalConnection {
 	nextHops := peer.Router.Routes.Broadcast(srcPeer.Name)
 	if len(nextHops) == 0 {
@@ -95,21 +121,30 @@ func (peer *LocalPeer) CreateConnection(peerAddr string, acceptNewPeer bool) err
 	}
 	// We're dialing the remote so that means connections will come from random ports
 	addrStr := NormalisePeerAddr(peerAddr)
-	tcpAddr, tcpErr := net.ResolveTCPAddr("tcp4", addrStr)
-	udpAddr, udpErr := net.ResolveUDPAddr("udp4", addrStr)
-	if tcpErr != nil || udpErr != nil {
-		// they really should have the same value, but just in case...
-		if tcpErr == nil {
-			return udpErr
+	if isWebSocketAddr(addrStr) {
+		wsConn, err := DialWebSocket(strings.TrimPrefix(addrStr, WebSocketScheme))
+		if err != nil {
+			return err
 		}
-		return tcpErr
+		connRemote := NewRemoteConnection(peer.Peer, nil, WebSocketScheme+wsConn.RemoteAddr().String(), false)
+		connLocal := NewLocalConnection(connRemote, wsConn, nil, peer.Router)
+		connLocal.outbound = true
+		connLocal.target = addrStr
+		connLocal.Start(acceptNewPeer)
+		return nil
 	}
-	tcpConn, err := net.DialTCP("tcp4", nil, tcpAddr)
+	tcpConn, err := dialPeer(addrStr, peer.Router.localTCPAddr())
 	if err != nil {
 		return err
 	}
-	connRemote := NewRemoteConnection(peer.Peer, nil, tcpConn.RemoteAddr().String(), false)
+	// UDP goes to the same address and port as the TCP connection
+	// that won
+	tcpAddr := tcpConn.RemoteAddr().(*net.TCPAddr)
+	udpAddr := &net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port}
+	connRemote := NewRemoteConnection(peer.Peer, nil, tcpAddr.String(), false)
 	connLocal := NewLocalConnection(connRemote, tcpConn, udpAddr, peer.Router)
+	connLocal.outbound = true
+	connLocal.target = addrStr
 	connLocal.Start(acceptNewPeer)
 	return nil
 }
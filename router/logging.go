@@ -0,0 +1,203 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logging by subsystem, at levels, so that noisy subsystems, e.g. the
+// forwarder dropping frames, can be quietened at runtime without
+// losing the warnings and errors of the others. Each subsystem has a
+// Logger, which adds fields such as the peer a message is about. We
+// write messages either as text, through the standard logger, with
+// the fields at the end as name=value, or as JSON objects, one per
+// line, for log collectors to make sense of.
+
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func ParseLogLevel(str string) (LogLevel, error) {
+	for level, name := range logLevelNames {
+		if name == str {
+			return LogLevel(level), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q; expected one of %s", str, strings.Join(logLevelNames, ", "))
+}
+
+func (level LogLevel) String() string {
+	return logLevelNames[level]
+}
+
+type Logger struct {
+	subsystem string
+	fields    []interface{} // name/value pairs
+}
+
+var logConfig = struct {
+	sync.RWMutex
+	subsystems   map[string]bool
+	levels       map[string]LogLevel // overriding defaultLevel
+	defaultLevel LogLevel
+	json         bool
+	out          io.Writer // for JSON; text goes through the standard logger
+}{
+	subsystems:   make(map[string]bool),
+	levels:       make(map[string]LogLevel),
+	defaultLevel: LogInfo,
+	out:          os.Stderr}
+
+var (
+	logRouter     = NewLogger("router")
+	logConnection = NewLogger("connection")
+	logForwarder  = NewLogger("forwarder")
+	logCrypto     = NewLogger("crypto")
+	logGossip     = NewLogger("gossip")
+	logPMTU       = NewLogger("pmtu")
+	logNAT        = NewLogger("nat")
+)
+
+func NewLogger(subsystem string) Logger {
+	logConfig.Lock()
+	defer logConfig.Unlock()
+	logConfig.subsystems[subsystem] = true
+	return Logger{subsystem: subsystem}
+}
+
+// A logger which adds the fields, given as name/value pairs, to every
+// message.
+func (lg Logger) With(fields ...interface{}) Logger {
+	return Logger{subsystem: lg.subsystem, fields: append(append([]interface{}{}, lg.fields...), fields...)}
+}
+
+func (lg Logger) Enabled(level LogLevel) bool {
+	logConfig.RLock()
+	defer logConfig.RUnlock()
+	minLevel, found := logConfig.levels[lg.subsystem]
+	if !found {
+		minLevel = logConfig.defaultLevel
+	}
+	return level >= minLevel
+}
+
+// Messages are made of the arguments as with log.Println
+func (lg Logger) Debug(args ...interface{}) { lg.output(LogDebug, args) }
+func (lg Logger) Info(args ...interface{})  { lg.output(LogInfo, args) }
+func (lg Logger) Warn(args ...interface{})  { lg.output(LogWarn, args) }
+func (lg Logger) Error(args ...interface{}) { lg.output(LogError, args) }
+
+func (lg Logger) output(level LogLevel, args []interface{}) {
+	if !lg.Enabled(level) {
+		return
+	}
+	msg := strings.TrimSuffix(fmt.Sprintln(args...), "\n")
+	logConfig.RLock()
+	useJSON, out := logConfig.json, logConfig.out
+	logConfig.RUnlock()
+	if !useJSON {
+		text := fmt.Sprintf("%s [%s] %s", strings.ToUpper(level.String()), lg.subsystem, msg)
+		for i := 0; i+1 < len(lg.fields); i += 2 {
+			text += fmt.Sprintf(" %v=%v", lg.fields[i], lg.fields[i+1])
+		}
+		log.Output(3, text)
+		return
+	}
+	entry := map[string]interface{}{
+		"time":      time.Now().Format(time.RFC3339Nano),
+		"level":     level.String(),
+		"subsystem": lg.subsystem,
+		"msg":       msg}
+	for i := 0; i+1 < len(lg.fields); i += 2 {
+		entry[fmt.Sprint(lg.fields[i])] = fmt.Sprint(lg.fields[i+1])
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Println("Unable to log as JSON:", err)
+		return
+	}
+	logConfig.Lock()
+	defer logConfig.Unlock()
+	out.Write(append(line, '\n'))
+}
+
+// Write log messages as JSON, rather than text.
+func SetLogJSON(useJSON bool) {
+	logConfig.Lock()
+	defer logConfig.Unlock()
+	logConfig.json = useJSON
+}
+
+// Set the level of a subsystem, or with "", the default for those
+// without a level of their own.
+func SetLogLevel(subsystem string, level LogLevel) error {
+	logConfig.Lock()
+	defer logConfig.Unlock()
+	if subsystem == "" {
+		logConfig.defaultLevel = level
+		return nil
+	}
+	if !logConfig.subsystems[subsystem] {
+		return fmt.Errorf("unknown log subsystem %q", subsystem)
+	}
+	logConfig.levels[subsystem] = level
+	return nil
+}
+
+// Set levels from a comma-separated list of [<subsystem>=]<level>,
+// where a level on its own sets the default.
+func SetLogLevels(spec string) error {
+	for _, field := range strings.Split(spec, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		subsystem, levelStr := "", field
+		if parts := strings.SplitN(field, "=", 2); len(parts) == 2 {
+			subsystem, levelStr = parts[0], parts[1]
+		}
+		level, err := ParseLogLevel(levelStr)
+		if err != nil {
+			return err
+		}
+		if err := SetLogLevel(subsystem, level); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The level of each subsystem, default first.
+func LogLevels() string {
+	logConfig.RLock()
+	defer logConfig.RUnlock()
+	subsystems := make([]string, 0, len(logConfig.subsystems))
+	for subsystem := range logConfig.subsystems {
+		subsystems = append(subsystems, subsystem)
+	}
+	sort.Strings(subsystems)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "default=%s\n", logConfig.defaultLevel)
+	for _, subsystem := range subsystems {
+		level, found := logConfig.levels[subsystem]
+		if !found {
+			level = logConfig.defaultLevel
+		}
+		fmt.Fprintf(&buf, "%s=%s\n", subsystem, level)
+	}
+	return buf.String()
+}
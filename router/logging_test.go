@@ -0,0 +1,65 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	wt "github.com/zettio/weave/testing"
+	"os"
+	"testing"
+)
+
+func resetLogLevels() {
+	logConfig.Lock()
+	defer logConfig.Unlock()
+	logConfig.levels = make(map[string]LogLevel)
+	logConfig.defaultLevel = LogInfo
+	logConfig.json = false
+	logConfig.out = os.Stderr
+}
+
+func TestLogLevels(t *testing.T) {
+	defer resetLogLevels()
+	for _, name := range []string{"debug", "info", "warn", "error"} {
+		level, err := ParseLogLevel(name)
+		wt.AssertNoErr(t, err)
+		wt.AssertEqualString(t, level.String(), name, "level")
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		wt.Fatalf(t, "Expected an error parsing an unknown level")
+	}
+
+	wt.AssertNoErr(t, SetLogLevels("warn, forwarder=error,pmtu=debug"))
+	if logRouter.Enabled(LogInfo) || !logRouter.Enabled(LogWarn) {
+		wt.Fatalf(t, "Expected the default level to apply to subsystems without one")
+	}
+	if logForwarder.Enabled(LogWarn) || !logPMTU.Enabled(LogDebug) {
+		wt.Fatalf(t, "Expected subsystems to have levels of their own")
+	}
+	if err := SetLogLevels("nonsense=info"); err == nil {
+		wt.Fatalf(t, "Expected an error setting the level of an unknown subsystem")
+	}
+	if err := SetLogLevels("crypto=loud"); err == nil {
+		wt.Fatalf(t, "Expected an error setting an unknown level")
+	}
+}
+
+func TestLogJSON(t *testing.T) {
+	defer resetLogLevels()
+	var buf bytes.Buffer
+	logConfig.out = &buf
+	SetLogJSON(true)
+	wt.AssertNoErr(t, SetLogLevels("gossip=warn"))
+
+	logGossip.Info("not this")
+	logGossip.With("channel", "topology", "peers", 3).Warn("unable to relay", "broadcast")
+	var entry map[string]string
+	wt.AssertNoErr(t, json.Unmarshal(buf.Bytes(), &entry))
+	for field, value := range map[string]string{
+		"level":     "warn",
+		"subsystem": "gossip",
+		"msg":       "unable to relay broadcast",
+		"channel":   "topology",
+		"peers":     "3"} {
+		wt.AssertEqualString(t, entry[field], value, field)
+	}
+}
@@ -0,0 +1,141 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Bridging loops. Should the interface we capture on get connected to
+// a network which leads back to it, e.g. with a physical NIC bridged
+// to the weave bridge as well as to the network the host is on, the
+// frames we inject come back to us, from hosts which seem to have
+// moved here from other peers. handleCapturedPacket already refuses to
+// forward captured frames from the MACs of hosts at other peers, which
+// stops the worst of that, but also hides the loop.
+//
+// So we remember a signature of every frame we inject, a hash of its
+// length and first LoopSignatureSize bytes, for LoopMemory, and count
+// the frames we capture from hosts at other peers which carry one.
+// Once LoopThreshold of them arrive within LoopWindow, we raise an
+// alert, with a warning in the log and a loop-detected event, and,
+// with LoopDisable, stop forwarding anything we capture for
+// LoopHoldoff, after which we try again. Those hosts may well have
+// moved here, after all.
+
+type LoopAction int
+
+const (
+	LoopIgnore  LoopAction = iota
+	LoopAlert              // warn, and publish an event
+	LoopDisable            // likewise, and stop forwarding captured frames for a while
+)
+
+var loopActionNames = map[LoopAction]string{
+	LoopIgnore:  "off",
+	LoopAlert:   "alert",
+	LoopDisable: "disable"}
+
+func ParseLoopAction(name string) (LoopAction, error) {
+	for action, actionName := range loopActionNames {
+		if actionName == name {
+			return action, nil
+		}
+	}
+	return LoopIgnore, fmt.Errorf("Unknown loop detection action: %s", name)
+}
+
+func (action LoopAction) String() string {
+	return loopActionNames[action]
+}
+
+type LoopDetector struct {
+	sync.Mutex
+	action    LoopAction
+	iface     string
+	events    *Events
+	injected  *DedupCache
+	looped    int       // frames we injected and captured again since windowed
+	windowed  time.Time // when the current LoopWindow started
+	detected  int       // loops detected
+	suspended time.Time // until when not to forward captured frames
+	now       func() time.Time
+}
+
+func NewLoopDetector(action LoopAction, iface string, events *Events) *LoopDetector {
+	return &LoopDetector{
+		action:   action,
+		iface:    iface,
+		events:   events,
+		injected: NewDedupCache(LoopMemory),
+		now:      time.Now}
+}
+
+func loopSignature(frame []byte) uint64 {
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(frame)))
+	if len(frame) > LoopSignatureSize {
+		frame = frame[:LoopSignatureSize]
+	}
+	return fnv64Add(fnv64Add(fnv64Offset, length), frame)
+}
+
+// We are injecting the frame into the interface
+func (loops *LoopDetector) Injected(frame []byte) {
+	if loops.action != LoopIgnore {
+		loops.injected.check(loopSignature(frame), true)
+	}
+}
+
+// We captured the frame from a host which is at another peer. Returns
+// whether it's one we injected.
+func (loops *LoopDetector) Captured(frame []byte) bool {
+	if loops.action == LoopIgnore || !loops.injected.check(loopSignature(frame), false) {
+		return false
+	}
+	loops.Lock()
+	now := loops.now()
+	if now.Sub(loops.windowed) > LoopWindow {
+		loops.looped, loops.windowed = 0, now
+	}
+	loops.looped++
+	detected := loops.looped == LoopThreshold
+	if detected {
+		loops.detected++
+		if loops.action == LoopDisable {
+			loops.suspended = now.Add(LoopHoldoff)
+		}
+	}
+	loops.Unlock()
+	if detected {
+		reason := fmt.Sprintf("%d frames injected into %s captured again within %v", LoopThreshold, loops.iface, LoopWindow)
+		if loops.action == LoopDisable {
+			logRouter.Warn("Bridging loop detected:", reason, "- not forwarding captured frames for", LoopHoldoff)
+		} else {
+			logRouter.Warn("Bridging loop detected:", reason)
+		}
+		loops.events.Publish(Event{Type: EventLoopDetected, Reason: reason})
+	}
+	return true
+}
+
+// Whether to refrain from forwarding the frames we capture
+func (loops *LoopDetector) Suspended() bool {
+	if loops.action != LoopDisable {
+		return false
+	}
+	loops.Lock()
+	defer loops.Unlock()
+	return loops.now().Before(loops.suspended)
+}
+
+func (loops *LoopDetector) String() string {
+	loops.Lock()
+	defer loops.Unlock()
+	status := fmt.Sprintf("%s, %d detected", loops.action, loops.detected)
+	if now := loops.now(); now.Before(loops.suspended) {
+		status += fmt.Sprintf(", not forwarding captured frames for another %v", loops.suspended.Sub(now))
+	}
+	return status + "\n"
+}
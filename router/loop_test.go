@@ -0,0 +1,63 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"testing"
+	"time"
+)
+
+func TestLoopDetection(t *testing.T) {
+	events := NewEvents()
+	sub := events.Subscribe()
+	loops := NewLoopDetector(LoopDisable, "weave", events)
+	now := time.Now()
+	loops.now = func() time.Time { return now }
+
+	injected := []byte("frame we injected")
+	if loops.Captured(injected) {
+		wt.Fatalf(t, "Expected frame we never injected not to count as looped")
+	}
+	loops.Injected(injected)
+	for i := 1; i < LoopThreshold; i++ {
+		if !loops.Captured(injected) {
+			wt.Fatalf(t, "Expected frame we injected to count as looped")
+		}
+	}
+	if loops.Suspended() {
+		wt.Fatalf(t, "Expected forwarding to carry on below the threshold")
+	}
+	loops.Captured(injected)
+	if !loops.Suspended() {
+		wt.Fatalf(t, "Expected forwarding to be suspended on detecting a loop")
+	}
+	select {
+	case event := <-sub:
+		wt.AssertEqualString(t, event.Type, EventLoopDetected, "event type")
+	default:
+		wt.Fatalf(t, "Expected loop-detected event")
+	}
+	now = now.Add(LoopHoldoff + time.Second)
+	if loops.Suspended() {
+		wt.Fatalf(t, "Expected forwarding to resume after the holdoff")
+	}
+
+	// Only alerting, forwarding carries on
+	alerting := NewLoopDetector(LoopAlert, "weave", events)
+	alerting.Injected(injected)
+	for i := 0; i < LoopThreshold; i++ {
+		alerting.Captured(injected)
+	}
+	if alerting.Suspended() {
+		wt.Fatalf(t, "Expected alerting not to suspend forwarding")
+	}
+	wt.AssertEqualInt(t, alerting.detected, 1, "loops detected")
+
+	for _, name := range []string{"off", "alert", "disable"} {
+		action, err := ParseLoopAction(name)
+		wt.AssertNoErr(t, err)
+		wt.AssertEqualString(t, action.String(), name, "loop action")
+	}
+	if _, err := ParseLoopAction("bogus"); err == nil {
+		wt.Fatalf(t, "Expected unknown loop action to be rejected")
+	}
+}
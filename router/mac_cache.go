@@ -4,10 +4,20 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Besides the MACs we learn from the frames we see, which expire when
+// we stop seeing them, MACs can be pinned to peers, so that frames for
+// well-known addresses, such as those of gateways and VIPs, go
+// straight to the right peer rather than being flooded until we learn
+// where they are. Pins are by peer name, and only take effect once we
+// know of the peer. Learning never overrides them, and they never
+// expire.
+
 type MacCacheEntry struct {
 	lastSeen time.Time
 	peer     *Peer
@@ -16,16 +26,29 @@ type MacCacheEntry struct {
 type MacCache struct {
 	sync.RWMutex
 	table       map[uint64]*MacCacheEntry
+	pins        map[uint64]PeerName
 	maxAge      time.Duration
 	expiryTimer *time.Timer
 	onExpiry    func(net.HardwareAddr, *Peer)
+	lookupPeer  func(PeerName) (*Peer, bool)
+	generation  uint64 // bumped atomically whenever a MAC moves, appears or goes; see local_macs.go
+}
+
+// What we export about each entry
+type MacEntry struct {
+	MAC      string
+	Peer     string
+	LastSeen time.Time // zero for pinned entries
+	Pinned   bool
 }
 
-func NewMacCache(maxAge time.Duration, onExpiry func(net.HardwareAddr, *Peer)) *MacCache {
+func NewMacCache(maxAge time.Duration, onExpiry func(net.HardwareAddr, *Peer), lookupPeer func(PeerName) (*Peer, bool)) *MacCache {
 	return &MacCache{
-		table:    make(map[uint64]*MacCacheEntry),
-		maxAge:   maxAge,
-		onExpiry: onExpiry}
+		table:      make(map[uint64]*MacCacheEntry),
+		pins:       make(map[uint64]PeerName),
+		maxAge:     maxAge,
+		onExpiry:   onExpiry,
+		lookupPeer: lookupPeer}
 }
 
 func (cache *MacCache) Start() {
@@ -37,7 +60,7 @@ func (cache *MacCache) Enter(mac net.HardwareAddr, peer *Peer) bool {
 	now := time.Now()
 	cache.RLock()
 	entry, found := cache.table[key]
-	if found && entry.peer == peer && now.Before(entry.lastSeen.Add(cache.maxAge/10)) {
+	if _, pinned := cache.pins[key]; pinned || (found && entry.peer == peer && now.Before(entry.lastSeen.Add(cache.maxAge/10))) {
 		cache.RUnlock()
 		return false
 	} else {
@@ -45,14 +68,19 @@ func (cache *MacCache) Enter(mac net.HardwareAddr, peer *Peer) bool {
 	}
 	cache.Lock()
 	defer cache.Unlock()
+	if _, pinned := cache.pins[key]; pinned {
+		return false
+	}
 	entry, found = cache.table[key]
 	if !found {
 		cache.table[key] = &MacCacheEntry{lastSeen: now, peer: peer}
+		cache.changed()
 		return true
 	}
 	if entry.peer != peer {
 		entry.lastSeen = now
 		entry.peer = peer
+		cache.changed()
 		return true
 	}
 	if now.After(entry.lastSeen.Add(cache.maxAge / 10)) {
@@ -64,14 +92,74 @@ func (cache *MacCache) Enter(mac net.HardwareAddr, peer *Peer) bool {
 func (cache *MacCache) Lookup(mac net.HardwareAddr) (*Peer, bool) {
 	key := macint(mac)
 	cache.RLock()
-	defer cache.RUnlock()
+	name, pinned := cache.pins[key]
 	entry, found := cache.table[key]
+	cache.RUnlock()
+	if pinned {
+		if peer, known := cache.lookupPeer(name); known {
+			return peer, true
+		}
+	}
 	if !found {
 		return nil, false
 	}
 	return entry.peer, true
 }
 
+func (cache *MacCache) Pin(mac net.HardwareAddr, name PeerName) {
+	key := macint(mac)
+	cache.Lock()
+	defer cache.Unlock()
+	cache.pins[key] = name
+	delete(cache.table, key)
+	cache.changed()
+}
+
+func (cache *MacCache) Unpin(mac net.HardwareAddr) {
+	cache.Lock()
+	defer cache.Unlock()
+	delete(cache.pins, macint(mac))
+	cache.changed()
+}
+
+func (cache *MacCache) Entries() []MacEntry {
+	cache.RLock()
+	defer cache.RUnlock()
+	entries := make([]MacEntry, 0, len(cache.pins)+len(cache.table))
+	for key, name := range cache.pins {
+		entries = append(entries, MacEntry{MAC: intmac(key).String(), Peer: name.String(), Pinned: true})
+	}
+	for key, entry := range cache.table {
+		entries = append(entries, MacEntry{MAC: intmac(key).String(), Peer: entry.peer.Name.String(), LastSeen: entry.lastSeen})
+	}
+	sort.Sort(macEntriesByMAC(entries))
+	return entries
+}
+
+type macEntriesByMAC []MacEntry
+
+func (entries macEntriesByMAC) Len() int           { return len(entries) }
+func (entries macEntriesByMAC) Swap(i, j int)      { entries[i], entries[j] = entries[j], entries[i] }
+func (entries macEntriesByMAC) Less(i, j int) bool { return entries[i].MAC < entries[j].MAC }
+
+// The MACs learnt at, or pinned to, the peer
+func (cache *MacCache) PeerMacs(peer *Peer) []net.HardwareAddr {
+	cache.RLock()
+	defer cache.RUnlock()
+	var macs []net.HardwareAddr
+	for key, name := range cache.pins {
+		if name == peer.Name {
+			macs = append(macs, intmac(key))
+		}
+	}
+	for key, entry := range cache.table {
+		if entry.peer == peer {
+			macs = append(macs, intmac(key))
+		}
+	}
+	return macs
+}
+
 func (cache *MacCache) Delete(peer *Peer) bool {
 	found := false
 	cache.Lock()
@@ -82,6 +170,9 @@ func (cache *MacCache) Delete(peer *Peer) bool {
 			found = true
 		}
 	}
+	if found {
+		cache.changed()
+	}
 	return found
 }
 
@@ -89,12 +180,26 @@ func (cache *MacCache) String() string {
 	var buf bytes.Buffer
 	cache.RLock()
 	defer cache.RUnlock()
+	for key, name := range cache.pins {
+		buf.WriteString(fmt.Sprintf("%v -> %s (pinned)\n", intmac(key), name))
+	}
 	for key, entry := range cache.table {
 		buf.WriteString(fmt.Sprintf("%v -> %s (%v)\n", intmac(key), entry.peer.Name, entry.lastSeen))
 	}
 	return buf.String()
 }
 
+// Called with the cache locked
+func (cache *MacCache) changed() {
+	atomic.AddUint64(&cache.generation, 1)
+}
+
+// Which generation the cache is in; any change to where MACs are
+// makes a new one, while merely seeing them again doesn't.
+func (cache *MacCache) Generation() uint64 {
+	return atomic.LoadUint64(&cache.generation)
+}
+
 func (cache *MacCache) setExpiryTimer() {
 	cache.expiryTimer = time.AfterFunc(cache.maxAge/10, func() { cache.expire() })
 }
@@ -106,8 +211,37 @@ func (cache *MacCache) expire() {
 	for key, entry := range cache.table {
 		if now.After(entry.lastSeen.Add(cache.maxAge)) {
 			delete(cache.table, key)
+			cache.changed()
 			cache.onExpiry(intmac(key), entry.peer)
 		}
 	}
 	cache.setExpiryTimer()
 }
+
+// Pin the MAC to the peer, or with an empty peer, unpin it. Seeding
+// instead enters the MAC as if we had learnt it, which requires that
+// we know of the peer already.
+func (router *Router) SetMac(macStr, peerStr string, seed bool) error {
+	mac, err := net.ParseMAC(macStr)
+	if err != nil {
+		return err
+	}
+	if peerStr == "" {
+		router.Macs.Unpin(mac)
+		return nil
+	}
+	name, err := PeerNameFromUserInput(peerStr)
+	if err != nil {
+		return err
+	}
+	if !seed {
+		router.Macs.Pin(mac, name)
+		return nil
+	}
+	peer, found := router.Peers.Fetch(name)
+	if !found {
+		return fmt.Errorf("unknown peer %s", name)
+	}
+	router.Macs.Enter(mac, peer)
+	return nil
+}
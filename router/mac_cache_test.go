@@ -0,0 +1,44 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMacCachePinning(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	name3, _ := PeerNameFromString("03:00:00:01:00:00")
+	peer1, peers := newNode(name1)
+	peer2 := peers.FetchWithDefault(NewPeer(name2, 0, 0))
+	cache := NewMacCache(time.Minute, func(net.HardwareAddr, *Peer) {}, peers.Fetch)
+	mac, _ := net.ParseMAC("00:00:00:00:00:0a")
+
+	cache.Enter(mac, peer1)
+	cache.Pin(mac, name2)
+	if peer, found := cache.Lookup(mac); !found || peer != peer2 {
+		wt.Fatalf(t, "Expected pinned MAC at %s; got %v", name2, peer)
+	}
+	if cache.Enter(mac, peer1) {
+		wt.Fatalf(t, "Expected learning not to override pin")
+	}
+	entries := cache.Entries()
+	wt.AssertEqualInt(t, len(entries), 1, "number of entries")
+	if entries[0] != (MacEntry{MAC: mac.String(), Peer: name2.String(), Pinned: true}) {
+		wt.Fatalf(t, "Unexpected entry %v", entries[0])
+	}
+
+	// Pins to peers we don't know of yet have no effect
+	cache.Pin(mac, name3)
+	if _, found := cache.Lookup(mac); found {
+		wt.Fatalf(t, "Expected no entry for MAC pinned to unknown peer")
+	}
+
+	cache.Unpin(mac)
+	cache.Enter(mac, peer1)
+	if peer, found := cache.Lookup(mac); !found || peer != peer1 {
+		wt.Fatalf(t, "Expected MAC to be learnt after unpinning; got %v", peer)
+	}
+}
@@ -0,0 +1,203 @@
+package router
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Router internals in the Prometheus text exposition format, so the
+// overlay can be monitored with standard tooling. We write the format
+// ourselves rather than pull in the client library; it's simple
+// enough.
+
+type metricsWriter struct {
+	*bufio.Writer
+}
+
+func (mw metricsWriter) metric(name, metricType, help string) {
+	fmt.Fprintf(mw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// Labels are given as name/value pairs
+func (mw metricsWriter) sample(name string, value interface{}, labels ...string) {
+	mw.WriteString(name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1])))
+		}
+		mw.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	fmt.Fprintln(mw, "", value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type connectionMetrics struct {
+	peer          string
+	stats         ConnectionStats
+	queueLen      int
+	queueLenDF    int
+	effectivePMTU int
+	rateLimit     int64
+	tcpFallback   bool
+	link          LinkMetrics
+}
+
+func (router *Router) WriteMetrics(w io.Writer) error {
+	conns := []connectionMetrics{}
+	router.Ourself.ForEachConnection(func(name PeerName, conn Connection) {
+		if localConn, ok := conn.(*LocalConnection); ok {
+			conns = append(conns, localConn.metrics())
+		}
+	})
+	mw := metricsWriter{bufio.NewWriter(w)}
+
+	perConn := func(name, metricType, help string, value func(*connectionMetrics) interface{}) {
+		mw.metric(name, metricType, help)
+		for i := range conns {
+			mw.sample(name, value(&conns[i]), "peer", conns[i].peer)
+		}
+	}
+	perConn("weave_forwarder_queue_length", "gauge", "Frames queued for the non-DF forwarders.",
+		func(c *connectionMetrics) interface{} { return c.queueLen })
+	perConn("weave_forwarder_df_queue_length", "gauge", "Frames queued for the DF forwarders.",
+		func(c *connectionMetrics) interface{} { return c.queueLenDF })
+	mw.metric("weave_forwarder_queue_capacity", "gauge", "Capacity of the queue of each forwarder.")
+	mw.sample("weave_forwarder_queue_capacity", router.CurrentTuning().QueueSize)
+	perConn("weave_connection_pmtu", "gauge", "Effective PMTU of the connection, i.e. the largest frame it carries without fragmentation.",
+		func(c *connectionMetrics) interface{} { return c.effectivePMTU })
+	perConn("weave_connection_rtt_seconds", "gauge", "Smoothed round trip time of the connection, as measured by heartbeats; 0 if unknown.",
+		func(c *connectionMetrics) interface{} { return c.link.RTT.Seconds() })
+	perConn("weave_connection_heartbeat_loss_ratio", "gauge", "Smoothed proportion of heartbeats from the remote peer which got lost.",
+		func(c *connectionMetrics) interface{} { return c.link.Loss })
+	perConn("weave_connection_frames_forwarded_total", "counter", "Frames forwarded over the connection.",
+		func(c *connectionMetrics) interface{} { return c.stats.FramesForwarded })
+	perConn("weave_connection_bytes_forwarded_total", "counter", "Bytes of frames forwarded over the connection.",
+		func(c *connectionMetrics) interface{} { return c.stats.BytesForwarded })
+	perConn("weave_connection_packets_sent_total", "counter", "UDP packets sent over the connection.",
+		func(c *connectionMetrics) interface{} { return c.stats.PacketsSent })
+	perConn("weave_connection_bytes_sent_total", "counter", "Bytes of UDP payload sent over the connection.",
+		func(c *connectionMetrics) interface{} { return c.stats.BytesSent })
+	perConn("weave_connection_overhead_bytes_total", "counter", "Bytes sent over the connection not carrying frames, i.e. encapsulation, encryption and PMTU probes.",
+		func(c *connectionMetrics) interface{} { return c.stats.Overhead })
+	perConn("weave_connection_compression_in_bytes_total", "counter", "Bytes of frames we tried to compress.",
+		func(c *connectionMetrics) interface{} { return c.stats.CompressionIn })
+	perConn("weave_connection_compression_out_bytes_total", "counter", "Bytes of those frames after compression.",
+		func(c *connectionMetrics) interface{} { return c.stats.CompressionOut })
+	perConn("weave_connection_gossip_in_bytes_total", "counter", "Bytes of gossip messages we tried to compress.",
+		func(c *connectionMetrics) interface{} { return c.stats.GossipIn })
+	perConn("weave_connection_gossip_out_bytes_total", "counter", "Bytes of those gossip messages after compression.",
+		func(c *connectionMetrics) interface{} { return c.stats.GossipOut })
+	perConn("weave_connection_hop_limit_drops_total", "counter", "Frames received over the connection which were dropped rather than relayed, having reached their hop limit.",
+		func(c *connectionMetrics) interface{} { return c.stats.HopLimitDrops })
+	perConn("weave_connection_fragmentations_total", "counter", "Frames we fragmented before forwarding.",
+		func(c *connectionMetrics) interface{} { return c.stats.Fragmentations })
+	perConn("weave_connection_enobufs_total", "counter", "UDP sends which failed with ENOBUFS.",
+		func(c *connectionMetrics) interface{} { return c.stats.ENOBUFS })
+	perConn("weave_connection_pacing_seconds_total", "counter", "Time spent backing off after ENOBUFS.",
+		func(c *connectionMetrics) interface{} { return time.Duration(c.stats.PacingTime).Seconds() })
+	perConn("weave_connection_sndbuf_growths_total", "counter", "Times a UDP socket's send buffer was enlarged.",
+		func(c *connectionMetrics) interface{} { return c.stats.SndBufGrowths })
+	perConn("weave_connection_rekeys_total", "counter", "Session key rotations.",
+		func(c *connectionMetrics) interface{} { return c.stats.Rekeys })
+	perConn("weave_connection_ecn_marks_total", "counter", "Packets received over the connection marked congestion experienced.",
+		func(c *connectionMetrics) interface{} { return c.stats.CongestionMarks })
+	perConn("weave_connection_ecn_backoffs_total", "counter", "Times the connection slowed down for congestion marks the remote reported.",
+		func(c *connectionMetrics) interface{} { return c.stats.ECNBackoffs })
+	perConn("weave_connection_timed_flushes_total", "counter", "Times frames waiting to fill a packet were sent because they had waited the flush delay.",
+		func(c *connectionMetrics) interface{} { return c.stats.TimedFlushes })
+	perConn("weave_connection_pmtu_blackholes_total", "counter", "Times frames as large as the verified PMTU stopped getting through.",
+		func(c *connectionMetrics) interface{} { return c.stats.PMTUBlackholes })
+	perConn("weave_connection_failovers_total", "counter", "Times the connection switched to another of the remote's addresses for want of heartbeats.",
+		func(c *connectionMetrics) interface{} { return c.stats.Failovers })
+
+	mw.metric("weave_connection_drops_total", "counter", "Frames dropped, by reason.")
+	for _, c := range conns {
+		mw.sample("weave_connection_drops_total", c.stats.PMTUDrops, "peer", c.peer, "reason", "pmtu")
+		mw.sample("weave_connection_drops_total", c.stats.QueueDrops, "peer", c.peer, "reason", "queue")
+		mw.sample("weave_connection_drops_total", c.stats.RateLimitDrops, "peer", c.peer, "reason", "ratelimit")
+		mw.sample("weave_connection_drops_total", c.stats.DuplicateDrops, "peer", c.peer, "reason", "duplicate")
+		mw.sample("weave_connection_drops_total", c.stats.TenantDrops, "peer", c.peer, "reason", "tenant")
+	}
+	mw.metric("weave_connection_frames_by_size_total", "counter", "Frames sent and received over the connection, by the largest size of their bucket.")
+	for _, c := range conns {
+		for direction, counts := range map[string][FrameSizeBuckets]uint64{"sent": c.stats.SentBySize, "received": c.stats.ReceivedBySize} {
+			for _, size := range frameSizeCounts(counts) {
+				mw.sample("weave_connection_frames_by_size_total", size.Frames, "peer", c.peer, "direction", direction, "size", fmt.Sprint(size.UpTo))
+			}
+		}
+	}
+	mw.metric("weave_connection_rate_limit_bytes", "gauge", "Rate limit of the connection in bytes per second.")
+	for _, c := range conns {
+		if c.rateLimit > 0 {
+			mw.sample("weave_connection_rate_limit_bytes", c.rateLimit, "peer", c.peer)
+		}
+	}
+
+	mw.metric("weave_connection_tcp_fallback", "gauge", "Whether the connection carries frames over TCP, because UDP doesn't get through.")
+	for _, c := range conns {
+		fallback := 0
+		if c.tcpFallback {
+			fallback = 1
+		}
+		mw.sample("weave_connection_tcp_fallback", fallback, "peer", c.peer)
+	}
+
+	mw.metric("weave_connections", "gauge", "Connections with peers, by state.")
+	counts := router.ConnStates.Counts()
+	for state, name := range connectionStateNames {
+		mw.sample("weave_connections", counts[ConnectionState(state)], "state", name)
+	}
+
+	reachable, split := router.Partitions.Counts()
+	mw.metric("weave_mesh_reachable_peers", "gauge", "Peers we can reach, including ourself.")
+	mw.sample("weave_mesh_reachable_peers", reachable)
+	mw.metric("weave_mesh_split_peers", "gauge", "Peers which have been unreachable for long enough to count as split from us.")
+	mw.sample("weave_mesh_split_peers", split)
+	status := router.Partitions.Status()
+	mw.metric("weave_mesh_splits_total", "counter", "Times peers stayed unreachable for long enough to count as split from us.")
+	mw.sample("weave_mesh_splits_total", status.Splits)
+	mw.metric("weave_mesh_merges_total", "counter", "Times peers we had split from became reachable again.")
+	mw.sample("weave_mesh_merges_total", status.Merges)
+
+	mw.metric("weave_local_frames_total", "counter", "Captured frames not forwarded since both their MACs are local, so the bridge delivered them.")
+	mw.sample("weave_local_frames_total", router.LocalFrames())
+
+	mw.metric("weave_peer_connections_rejected_total", "counter", "Connections with peers which the peer rules denied.")
+	mw.sample("weave_peer_connections_rejected_total", router.PeerACL.Rejected())
+
+	mw.metric("weave_gossip_messages_sent_total", "counter", "Gossip messages sent, counting each connection separately.")
+	for _, channel := range router.GossipChannels {
+		mw.sample("weave_gossip_messages_sent_total", channel.Stats().Sent, "channel", channel.name)
+	}
+	mw.metric("weave_gossip_messages_received_total", "counter", "Gossip messages received.")
+	for _, channel := range router.GossipChannels {
+		mw.sample("weave_gossip_messages_received_total", channel.Stats().Received, "channel", channel.name)
+	}
+	return mw.Flush()
+}
+
+func (conn *LocalConnection) metrics() connectionMetrics {
+	conn.RLock()
+	defer conn.RUnlock()
+	metrics := connectionMetrics{
+		peer:          conn.remote.Name.String(),
+		stats:         conn.ConnectionStats(),
+		effectivePMTU: conn.effectivePMTU,
+		tcpFallback:   conn.tcpFallback,
+		link:          conn.LinkMetrics()}
+	for _, queues := range conn.forwardChans {
+		metrics.queueLen += queues.len()
+	}
+	for _, queues := range conn.forwardChansDF {
+		metrics.queueLenDF += queues.len()
+	}
+	if conn.rateLimiter != nil {
+		metrics.rateLimit = conn.rateLimiter.Rate()
+	}
+	return metrics
+}
@@ -0,0 +1,32 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	wt "github.com/zettio/weave/testing"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	router := NewRouter(RouterConfig{}, name)
+	router.TopologyGossip.(*GossipChannel).stats.Received = 3
+
+	var buf bytes.Buffer
+	wt.AssertNoErr(t, router.WriteMetrics(&buf))
+	for _, line := range []string{
+		"# TYPE weave_gossip_messages_received_total counter",
+		`weave_gossip_messages_received_total{channel="topology"} 3`,
+		"weave_forwarder_queue_capacity 16"} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			wt.Fatalf(t, "Expected metrics to contain %q, got:\n%s", line, buf.String())
+		}
+	}
+
+	var labelled bytes.Buffer
+	mw := metricsWriter{bufio.NewWriter(&labelled)}
+	mw.sample("m", 1, "a", `x"y\z`, "b", "w")
+	mw.Flush()
+	wt.AssertEqualString(t, labelled.String(), `m{a="x\"y\\z",b="w"} 1`+"\n", "labelled sample")
+}
@@ -0,0 +1,348 @@
+package router
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// Matches struct mmsghdr from <sys/socket.h>. Go pads the struct to
+// the alignment of Msghdr, which is what the C ABI does too.
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// An MMsgBatch collects UDP packets and sends them with a single
+// sendmmsg(2) syscall, rather than one syscall per packet. This makes
+// a big difference to CPU consumption at high packet rates.
+//
+// Packets are copied into the batch, so callers are free to reuse
+// their buffers as soon as Append returns. Not thread-safe; each
+// batch is owned by a single forwarder.
+//
+// A batch of size one simply sends packets one at a time, but still
+// gives us the retry semantics of Send.
+//
+// On kernels supporting UDP GSO (4.18+), runs of packets for the same
+// destination which are all the same size, except possibly a shorter
+// last one, are coalesced into a single message, with a UDP_SEGMENT
+// control message telling the kernel to split it up again as late as
+// possible. That saves most of the per-packet cost of traversing the
+// network stack. GSO is only available on UDP sockets.
+//
+// Packets may be marked with a TOS other than the socket's, with an
+// IP_TOS or IPV6_TCLASS control message; see SetTOS.
+//
+// The batch goes through the socket's RawConn rather than its File, so
+// the socket stays non-blocking and no fd gets duplicated; sends which
+// find the socket buffer full wait for it to drain.
+type MMsgBatch struct {
+	conn     syscall.RawConn
+	ipv6     bool // whether the socket is AF_INET6, and thus needs IPv6 addresses
+	bufs     [][]byte
+	lens     []int
+	dsts     []*net.UDPAddr
+	addrs    []syscall.RawSockaddrInet6 // big enough for IPv4 addresses too
+	iovecs   []syscall.Iovec
+	hdrs     []mmsghdr
+	oobs     [][]byte // UDP_SEGMENT and TOS control messages
+	toss     []int    // TOS of each packet; -1 for the socket's
+	tos      int      // TOS of packets appended from now on
+	msgs     []int    // index of the first packet of each message, then count
+	count    int
+	fallback bool // kernel lacks sendmmsg; send one packet at a time
+	gso      bool // kernel supports UDP_SEGMENT on this socket
+}
+
+// From <linux/udp.h> and <linux/socket.h>; not defined in the syscall package
+const (
+	solUDP         = 17  // SOL_UDP
+	udpSegment     = 103 // UDP_SEGMENT
+	gsoMaxSegments = 64  // UDP_MAX_SEGMENTS
+	gsoMaxBytes    = 65507
+)
+
+func NewMMsgBatch(conn syscall.RawConn, size int) *MMsgBatch {
+	batch := &MMsgBatch{
+		conn:   conn,
+		bufs:   make([][]byte, size),
+		lens:   make([]int, size),
+		dsts:   make([]*net.UDPAddr, size),
+		addrs:  make([]syscall.RawSockaddrInet6, size),
+		iovecs: make([]syscall.Iovec, size),
+		hdrs:   make([]mmsghdr, size),
+		oobs:   make([][]byte, size),
+		toss:   make([]int, size),
+		tos:    -1,
+		msgs:   make([]int, size+1)}
+	for i := range batch.bufs {
+		batch.bufs[i] = make([]byte, MaxUDPPacketSize)
+		batch.oobs[i] = make([]byte, syscall.CmsgSpace(2)+syscall.CmsgSpace(4))
+	}
+	conn.Control(func(fd uintptr) {
+		if sa, err := syscall.Getsockname(int(fd)); err == nil {
+			_, batch.ipv6 = sa.(*syscall.SockaddrInet6)
+		}
+		// Only kernels which support UDP_SEGMENT let us query it
+		_, err := syscall.GetsockoptInt(int(fd), solUDP, udpSegment)
+		batch.gso = size > 1 && err == nil
+	})
+	return batch
+}
+
+func (batch *MMsgBatch) IsEmpty() bool {
+	return batch.count == 0
+}
+
+func (batch *MMsgBatch) IsFull() bool {
+	return batch.count == len(batch.bufs)
+}
+
+// Append a packet to the batch. When addr is nil the packet is sent
+// to the address the socket is connected to.
+func (batch *MMsgBatch) Append(msg []byte, addr *net.UDPAddr) {
+	i := batch.count
+	batch.lens[i] = copy(batch.bufs[i], msg)
+	batch.dsts[i] = addr
+	batch.toss[i] = batch.tos
+	batch.count++
+}
+
+// Mark the packets appended from now on with the TOS, i.e. the DSCP
+// and ECN bits, or with -1, with the socket's.
+func (batch *MMsgBatch) SetTOS(tos int) {
+	batch.tos = tos
+}
+
+// Send all packets in the batch. If sending any of the packets fails,
+// the error is returned. When that error indicates the kernel is
+// temporarily short of buffer space (ENOBUFS or EAGAIN), the unsent
+// packets remain in the batch, so a subsequent Send can retry them.
+// Otherwise they are discarded.
+func (batch *MMsgBatch) Send() error {
+	sent := 0
+	coalesce := batch.gso
+	for sent < batch.count {
+		var err error
+		if batch.fallback {
+			if err = batch.sendOne(sent); err == nil {
+				sent++
+				continue
+			}
+		} else {
+			numMsgs := batch.prepare(sent, coalesce)
+			var n uintptr
+			var errno syscall.Errno
+			if err = batch.conn.Write(func(fd uintptr) bool {
+				n, _, errno = syscall.Syscall6(sysSendMMsg, fd,
+					uintptr(unsafe.Pointer(&batch.hdrs[0])), uintptr(numMsgs), 0, 0, 0)
+				// Returning false waits for the socket to be writable
+				return errno != syscall.EAGAIN
+			}); err != nil {
+				batch.count = 0
+				return err
+			}
+			switch {
+			case errno == 0:
+				sent = batch.msgs[n]
+				continue
+			case errno == syscall.ENOSYS:
+				batch.fallback = true
+				continue
+			case errno == syscall.EINTR:
+				continue
+			case batch.msgs[1]-batch.msgs[0] > 1 && (errno == syscall.EIO || errno == syscall.EINVAL):
+				// The kernel couldn't segment the message. EIO
+				// means the device can't do the checksums GSO
+				// needs, so don't try again. EINVAL means the
+				// segments are larger than the device MTU, which
+				// plain sends deal with by fragmenting.
+				if errno == syscall.EIO {
+					logForwarder.Warn("UDP GSO not supported by device; disabling")
+					batch.gso = false
+				}
+				coalesce = false
+				continue
+			}
+			err = &net.OpError{Op: "sendmmsg", Net: "udp", Err: errno}
+		}
+		if errno := PosixError(err); errno == syscall.ENOBUFS || errno == syscall.EAGAIN {
+			batch.retain(sent)
+		} else {
+			batch.count = 0
+		}
+		return err
+	}
+	batch.count = 0
+	return nil
+}
+
+// Fill in the message headers for the packets from index start
+// onwards, coalescing them if requested. Returns the number of
+// messages.
+func (batch *MMsgBatch) prepare(start int, coalesce bool) int {
+	numMsgs := 0
+	for i := start; i < batch.count; numMsgs++ {
+		batch.msgs[numMsgs] = i
+		segSize, total := batch.lens[i], batch.lens[i]
+		j := i + 1
+		for coalesce && j < batch.count && j-i < gsoMaxSegments &&
+			batch.lens[j-1] == segSize && batch.lens[j] <= segSize &&
+			total+batch.lens[j] <= gsoMaxBytes && sameUDPAddr(batch.dsts[i], batch.dsts[j]) &&
+			batch.toss[j] == batch.toss[i] {
+			total += batch.lens[j]
+			j++
+		}
+		batch.setHdr(numMsgs, i, j)
+		i = j
+	}
+	batch.msgs[numMsgs] = batch.count
+	return numMsgs
+}
+
+// Set up the k'th message header to send packets first up to (but
+// excluding) end, as UDP GSO segments if there are several.
+func (batch *MMsgBatch) setHdr(k, first, end int) {
+	hdr := &batch.hdrs[k].hdr
+	*hdr = syscall.Msghdr{}
+	if addr := batch.dsts[first]; addr != nil {
+		hdr.Name, hdr.Namelen = batch.rawSockaddr(k, addr)
+	}
+	for i := first; i < end; i++ {
+		iov := &batch.iovecs[i]
+		iov.Base = &batch.bufs[i][0]
+		iov.SetLen(batch.lens[i])
+	}
+	hdr.Iov = &batch.iovecs[first]
+	setIovlen(hdr, end-first)
+	oob, oobLen := batch.oobs[k], 0
+	if end-first > 1 {
+		cmsg := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		cmsg.Level = solUDP
+		cmsg.Type = udpSegment
+		cmsg.SetLen(syscall.CmsgLen(2))
+		*(*uint16)(unsafe.Pointer(&oob[syscall.CmsgLen(0)])) = uint16(batch.lens[first])
+		oobLen = syscall.CmsgSpace(2)
+	}
+	oobLen += batch.putTOS(oob[oobLen:], first)
+	if oobLen > 0 {
+		hdr.Control = &oob[0]
+		hdr.SetControllen(oobLen)
+	}
+}
+
+// Put a control message marking the i'th packet with its TOS, if it
+// has one, returning the space that took. Which option that is
+// depends on where the packet goes rather than on the socket, since
+// dual-stack sockets send IPv4 too.
+func (batch *MMsgBatch) putTOS(oob []byte, i int) int {
+	tos := batch.toss[i]
+	if tos < 0 {
+		return 0
+	}
+	cmsg := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	cmsg.Level, cmsg.Type = syscall.IPPROTO_IP, syscall.IP_TOS
+	if addr := batch.dsts[i]; addr == nil && batch.ipv6 || addr != nil && addr.IP.To4() == nil {
+		cmsg.Level, cmsg.Type = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+	}
+	cmsg.SetLen(syscall.CmsgLen(4))
+	*(*int32)(unsafe.Pointer(&oob[syscall.CmsgLen(0)])) = int32(tos)
+	return syscall.CmsgSpace(4)
+}
+
+func sameUDPAddr(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a == b || (a.Port == b.Port && a.Zone == b.Zone && a.IP.Equal(b.IP))
+}
+
+// Move the packets from index start onwards to the front of the batch
+func (batch *MMsgBatch) retain(start int) {
+	for i := start; i < batch.count; i++ {
+		j := i - start
+		batch.bufs[i], batch.bufs[j] = batch.bufs[j], batch.bufs[i]
+		batch.lens[j] = batch.lens[i]
+		batch.dsts[j] = batch.dsts[i]
+		batch.toss[j] = batch.toss[i]
+	}
+	batch.count -= start
+}
+
+func (batch *MMsgBatch) sendOne(i int) error {
+	var err error
+	msg := batch.bufs[i][:batch.lens[i]]
+	var oob []byte
+	if batch.toss[i] >= 0 {
+		oob = batch.oobs[i][:batch.putTOS(batch.oobs[i], i)]
+	}
+	var sa syscall.Sockaddr
+	if addr := batch.dsts[i]; addr != nil {
+		sa = batch.sockaddr(addr)
+	}
+	if werr := batch.conn.Write(func(fd uintptr) bool {
+		switch {
+		case oob != nil:
+			err = syscall.Sendmsg(int(fd), msg, oob, sa, 0)
+		case sa == nil:
+			_, err = syscall.Write(int(fd), msg)
+		default:
+			err = syscall.Sendto(int(fd), msg, 0, sa)
+		}
+		return err != syscall.EAGAIN
+	}); werr != nil {
+		return werr
+	}
+	if err != nil {
+		return &net.OpError{Op: "write", Net: "udp", Err: err}
+	}
+	return nil
+}
+
+// Fill in the raw socket address for the i'th packet of the batch.
+// IPv4 addresses are sent as IPv4-mapped IPv6 addresses on AF_INET6
+// sockets.
+func (batch *MMsgBatch) rawSockaddr(i int, addr *net.UDPAddr) (*byte, uint32) {
+	sa := &batch.addrs[i]
+	if !batch.ipv6 {
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		sa4.Family = syscall.AF_INET
+		putPort(&sa4.Port, addr.Port)
+		copy(sa4.Addr[:], addr.IP.To4())
+		return (*byte)(unsafe.Pointer(sa4)), syscall.SizeofSockaddrInet4
+	}
+	*sa = syscall.RawSockaddrInet6{Family: syscall.AF_INET6}
+	putPort(&sa.Port, addr.Port)
+	copy(sa.Addr[:], addr.IP.To16())
+	sa.Scope_id = zoneIndex(addr.Zone)
+	return (*byte)(unsafe.Pointer(sa)), syscall.SizeofSockaddrInet6
+}
+
+func (batch *MMsgBatch) sockaddr(addr *net.UDPAddr) syscall.Sockaddr {
+	if !batch.ipv6 {
+		sa := &syscall.SockaddrInet4{Port: addr.Port}
+		copy(sa.Addr[:], addr.IP.To4())
+		return sa
+	}
+	sa := &syscall.SockaddrInet6{Port: addr.Port, ZoneId: zoneIndex(addr.Zone)}
+	copy(sa.Addr[:], addr.IP.To16())
+	return sa
+}
+
+// Ports in raw socket addresses are in network byte order
+func putPort(field *uint16, port int) {
+	bytes := (*[2]byte)(unsafe.Pointer(field))
+	bytes[0] = byte(port >> 8)
+	bytes[1] = byte(port)
+}
+
+func zoneIndex(zone string) uint32 {
+	if zone == "" {
+		return 0
+	}
+	if iface, err := net.InterfaceByName(zone); err == nil {
+		return uint32(iface.Index)
+	}
+	return 0
+}
@@ -0,0 +1,13 @@
+package router
+
+import "syscall"
+
+// syscall doesn't define SYS_SENDMMSG or SYS_RECVMMSG for all platforms
+const (
+	sysSendMMsg = 307
+	sysRecvMMsg = 299
+)
+
+func setIovlen(hdr *syscall.Msghdr, n int) {
+	hdr.Iovlen = uint64(n)
+}
@@ -0,0 +1,170 @@
+package router
+
+import (
+	"io"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// An MMsgReader receives UDP packets with a single recvmmsg(2)
+// syscall, as many as are waiting, up to its size, rather than one
+// syscall per packet; the receiving counterpart of MMsgBatch.
+//
+// Packets are received into FrameBuffers from the pool, which the
+// reader hands over to the caller with Packet, taking fresh ones for
+// the next Read. Not thread-safe; each reader is owned by a single
+// goroutine.
+//
+// A reader of size one simply receives packets one at a time.
+type MMsgReader struct {
+	conn     syscall.RawConn
+	fbs      []*FrameBuffer
+	addrs    []syscall.RawSockaddrInet6 // big enough for IPv4 addresses too
+	iovecs   []syscall.Iovec
+	hdrs     []mmsghdr
+	oobs     [][]byte // control messages, e.g. with the TOS
+	fallback bool     // kernel lacks recvmmsg; receive one packet at a time
+}
+
+// A UDP packet as received, in the buffer it was received into
+type ReceivedPacket struct {
+	fb        *FrameBuffer
+	n         int
+	sender    *net.UDPAddr
+	congested bool // marked congestion experienced, going by its TOS
+}
+
+func (packet *ReceivedPacket) Bytes() []byte {
+	return packet.fb.Bytes()[:packet.n]
+}
+
+// A reader for the socket, receiving control messages of up to
+// oobSize bytes with each packet, i.e. the TOS when that's been
+// asked for with setRecvTOS.
+func NewMMsgReader(conn *net.UDPConn, size int, oobSize int) (*MMsgReader, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	if size < 1 {
+		size = 1
+	}
+	reader := &MMsgReader{
+		conn:     rawConn,
+		fbs:      make([]*FrameBuffer, size),
+		addrs:    make([]syscall.RawSockaddrInet6, size),
+		iovecs:   make([]syscall.Iovec, size),
+		hdrs:     make([]mmsghdr, size),
+		oobs:     make([][]byte, size),
+		fallback: size == 1}
+	for i := range reader.oobs {
+		reader.oobs[i] = make([]byte, oobSize)
+	}
+	return reader, nil
+}
+
+// Wait for packets, and receive as many as are waiting, up to the
+// reader's size, returning how many. Returns io.EOF once the socket
+// is closed.
+func (reader *MMsgReader) Read() (int, error) {
+	for i := range reader.hdrs {
+		reader.setHdr(i)
+	}
+	var n uintptr
+	var errno syscall.Errno
+	for {
+		err := reader.conn.Read(func(fd uintptr) bool {
+			if reader.fallback {
+				n, _, errno = syscall.Syscall(syscall.SYS_RECVMSG, fd,
+					uintptr(unsafe.Pointer(&reader.hdrs[0].hdr)), syscall.MSG_DONTWAIT)
+				reader.hdrs[0].len = uint32(n)
+				n = 1
+			} else {
+				n, _, errno = syscall.Syscall6(sysRecvMMsg, fd,
+					uintptr(unsafe.Pointer(&reader.hdrs[0])), uintptr(len(reader.hdrs)), syscall.MSG_DONTWAIT, 0, 0)
+			}
+			// Returning false waits for the socket to be readable
+			return errno != syscall.EAGAIN
+		})
+		switch {
+		case err != nil:
+			return 0, io.EOF
+		case errno == syscall.ENOSYS && !reader.fallback:
+			reader.fallback = true
+			continue
+		case errno == syscall.EINTR:
+			continue
+		case errno != 0:
+			return 0, &net.OpError{Op: "recvmmsg", Net: "udp", Err: errno}
+		}
+		return int(n), nil
+	}
+}
+
+// Set up the i'th message header to receive a packet into the i'th
+// buffer, taking a fresh one if the last was handed over.
+func (reader *MMsgReader) setHdr(i int) {
+	if reader.fbs[i] == nil {
+		reader.fbs[i] = NewFrameBuffer()
+	}
+	buf := reader.fbs[i].Bytes()
+	iov := &reader.iovecs[i]
+	iov.Base = &buf[0]
+	iov.SetLen(len(buf))
+	hdr := &reader.hdrs[i].hdr
+	*hdr = syscall.Msghdr{}
+	hdr.Name = (*byte)(unsafe.Pointer(&reader.addrs[i]))
+	hdr.Namelen = syscall.SizeofSockaddrInet6
+	hdr.Iov = iov
+	setIovlen(hdr, 1)
+	if oob := reader.oobs[i]; len(oob) > 0 {
+		hdr.Control = &oob[0]
+		hdr.SetControllen(len(oob))
+	}
+}
+
+// Hand over the i'th packet of the last Read, along with its buffer,
+// which the caller must Release.
+func (reader *MMsgReader) Packet(i int) *ReceivedPacket {
+	hdr := &reader.hdrs[i]
+	packet := &ReceivedPacket{
+		fb:        reader.fbs[i],
+		n:         int(hdr.len),
+		sender:    reader.sender(i),
+		congested: congestionExperienced(reader.oobs[i][:int(hdr.hdr.Controllen)])}
+	reader.fbs[i] = nil
+	return packet
+}
+
+// The address the i'th packet came from. IPv4 senders on AF_INET6
+// sockets appear as IPv4-mapped IPv6 addresses, as with ReadFromUDP.
+func (reader *MMsgReader) sender(i int) *net.UDPAddr {
+	sa := &reader.addrs[i]
+	switch sa.Family {
+	case syscall.AF_INET:
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		return &net.UDPAddr{IP: net.IPv4(sa4.Addr[0], sa4.Addr[1], sa4.Addr[2], sa4.Addr[3]), Port: getPort(sa4.Port)}
+	case syscall.AF_INET6:
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[:])
+		return &net.UDPAddr{IP: ip, Port: getPort(sa.Port), Zone: zoneName(sa.Scope_id)}
+	}
+	return nil
+}
+
+// Ports in raw socket addresses are in network byte order
+func getPort(field uint16) int {
+	bytes := (*[2]byte)(unsafe.Pointer(&field))
+	return int(bytes[0])<<8 | int(bytes[1])
+}
+
+func zoneName(index uint32) string {
+	if index == 0 {
+		return ""
+	}
+	if iface, err := net.InterfaceByIndex(int(index)); err == nil {
+		return iface.Name
+	}
+	return ""
+}
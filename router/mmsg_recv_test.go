@@ -0,0 +1,74 @@
+package router
+
+import (
+	"fmt"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+)
+
+func TestMMsgReader(t *testing.T) {
+	testMMsgReader(t, "udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, 8)
+}
+
+// Receiving one packet at a time
+func TestMMsgReaderSingle(t *testing.T) {
+	testMMsgReader(t, "udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, 1)
+}
+
+// IPv4 senders on a dual-stack socket
+func TestMMsgReaderDualStack(t *testing.T) {
+	testMMsgReader(t, "udp", &net.UDPAddr{}, 8)
+}
+
+func testMMsgReader(t *testing.T, network string, recvAddr *net.UDPAddr, size int) {
+	recvConn, err := net.ListenUDP(network, recvAddr)
+	wt.AssertNoErr(t, err)
+	defer recvConn.Close()
+	sendConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	wt.AssertNoErr(t, err)
+	defer sendConn.Close()
+
+	const numPackets = 5
+	dst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: recvConn.LocalAddr().(*net.UDPAddr).Port}
+	for i := 0; i < numPackets; i++ {
+		_, err := sendConn.WriteToUDP([]byte(fmt.Sprint("packet ", i)), dst)
+		wt.AssertNoErr(t, err)
+	}
+
+	reader, err := NewMMsgReader(recvConn, size, 0)
+	wt.AssertNoErr(t, err)
+	received := 0
+	for received < numPackets {
+		n, err := reader.Read()
+		wt.AssertNoErr(t, err)
+		if n < 1 || n > size {
+			wt.Fatalf(t, "Read %d packets with a reader of size %d", n, size)
+		}
+		for i := 0; i < n; i++ {
+			packet := reader.Packet(i)
+			wt.AssertEqualString(t, string(packet.Bytes()), fmt.Sprint("packet ", received), "packet")
+			wt.AssertEqualString(t, packet.sender.String(), sendConn.LocalAddr().String(), "sender")
+			packet.fb.Release()
+			received++
+		}
+	}
+
+	recvConn.Close()
+	if _, err := reader.Read(); err == nil {
+		wt.Fatalf(t, "Expected error reading from closed socket")
+	}
+}
+
+func TestRecvShard(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	packet1 := Concat(name1.Bin(), []byte("one packet"))
+	packet2 := Concat(name1.Bin(), []byte("another"))
+	wt.AssertEqualInt(t, recvShard(packet1, 4), recvShard(packet2, 4), "shard of packets from the same peer")
+	shard := recvShard(Concat(name2.Bin(), []byte("x")), 4)
+	if shard < 0 || shard >= 4 {
+		wt.Fatalf(t, "Shard %d out of range", shard)
+	}
+	wt.AssertEqualInt(t, recvShard([]byte("x"), 4), 0, "shard of a short packet")
+}
@@ -0,0 +1,113 @@
+package router
+
+import (
+	"fmt"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMMsgBatch(t *testing.T) {
+	testMMsgBatch(t, "udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+}
+
+// IPv4 destinations on a dual-stack socket
+func TestMMsgBatchDualStack(t *testing.T) {
+	testMMsgBatch(t, "udp", &net.UDPAddr{})
+}
+
+func testMMsgBatch(t *testing.T, network string, sendAddr *net.UDPAddr) {
+	recvConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	wt.AssertNoErr(t, err)
+	defer recvConn.Close()
+	sendConn, err := net.ListenUDP(network, sendAddr)
+	wt.AssertNoErr(t, err)
+	defer sendConn.Close()
+
+	const numPackets = 5
+	batch, err := newSocketBatch(sendConn, numPackets)
+	wt.AssertNoErr(t, err)
+	dst := recvConn.LocalAddr().(*net.UDPAddr)
+	for i := 0; i < numPackets; i++ {
+		if batch.IsFull() {
+			wt.Fatalf(t, "Batch full after %d packets", i)
+		}
+		batch.Append([]byte(fmt.Sprint("packet ", i)), dst)
+	}
+	if !batch.IsFull() {
+		wt.Fatalf(t, "Expected batch to be full")
+	}
+	wt.AssertNoErr(t, batch.Send())
+	if !batch.IsEmpty() {
+		wt.Fatalf(t, "Expected batch to be empty after sending")
+	}
+
+	buf := make([]byte, 100)
+	recvConn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	for i := 0; i < numPackets; i++ {
+		n, _, err := recvConn.ReadFromUDP(buf)
+		wt.AssertNoErr(t, err)
+		wt.AssertEqualString(t, string(buf[:n]), fmt.Sprint("packet ", i), "packet")
+	}
+}
+
+// After a partial send, the unsent packets must be sent intact
+func TestMMsgBatchRetain(t *testing.T) {
+	recvConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	wt.AssertNoErr(t, err)
+	defer recvConn.Close()
+	sendConn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	wt.AssertNoErr(t, err)
+	defer sendConn.Close()
+
+	batch, err := newSocketBatch(sendConn, 4)
+	wt.AssertNoErr(t, err)
+	dst := recvConn.LocalAddr().(*net.UDPAddr)
+	for i := 0; i < 3; i++ {
+		batch.Append([]byte(fmt.Sprint("packet ", i)), dst)
+	}
+	batch.retain(1)
+	wt.AssertEqualInt(t, batch.count, 2, "retained packets")
+	batch.Append([]byte("packet 3"), dst)
+	wt.AssertNoErr(t, batch.Send())
+
+	buf := make([]byte, 100)
+	recvConn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	for i := 1; i < 4; i++ {
+		n, _, err := recvConn.ReadFromUDP(buf)
+		wt.AssertNoErr(t, err)
+		wt.AssertEqualString(t, string(buf[:n]), fmt.Sprint("packet ", i), "packet")
+	}
+}
+
+// Runs of equal-sized packets get coalesced when the kernel supports
+// UDP GSO; either way they must arrive as separate datagrams.
+func TestMMsgBatchGSO(t *testing.T) {
+	recvConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	wt.AssertNoErr(t, err)
+	defer recvConn.Close()
+	sendConn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	wt.AssertNoErr(t, err)
+	defer sendConn.Close()
+
+	batch, err := newSocketBatch(sendConn, 8)
+	wt.AssertNoErr(t, err)
+	dst := recvConn.LocalAddr().(*net.UDPAddr)
+	packets := []string{"packet 0", "packet 1", "packet 2", "short", "packet 4", "longer packet 5"}
+	for _, packet := range packets {
+		batch.Append([]byte(packet), dst)
+	}
+	if batch.gso {
+		wt.AssertEqualInt(t, batch.prepare(0, true), 3, "coalesced messages")
+	}
+	wt.AssertNoErr(t, batch.Send())
+
+	buf := make([]byte, 100)
+	recvConn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	for _, packet := range packets {
+		n, _, err := recvConn.ReadFromUDP(buf)
+		wt.AssertNoErr(t, err)
+		wt.AssertEqualString(t, string(buf[:n]), packet, "packet")
+	}
+}
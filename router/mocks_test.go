@@ -111,3 +111,25 @@ func checkTopologyPeers(t *testing.T, checkConns bool, peers []*Peer, wantedPeer
 		wt.Fatalf(t, "Expected peers not found: %v", check)
 	}
 }
+
+// A UDPSender which just records what it is asked to send
+type mockUDPSender struct {
+	packets [][]byte
+}
+
+func (sender *mockUDPSender) Send(msg []byte) error {
+	sender.packets = append(sender.packets, append([]byte{}, msg...))
+	return nil
+}
+
+func (sender *mockUDPSender) Flush() error {
+	return nil
+}
+
+func (sender *mockUDPSender) GrowSendBuffer(max int) (int, bool, error) {
+	return 0, false, nil
+}
+
+func (sender *mockUDPSender) Shutdown() error {
+	return nil
+}
@@ -0,0 +1,117 @@
+package router
+
+import (
+	"code.google.com/p/gopacket/layers"
+	"encoding/binary"
+)
+
+// TCP MSS clamping. Hosts on our network take it that they can send
+// TCP segments as large as the MTU of their interfaces allows, and
+// rely on ICMP to learn of the lower effective PMTU of the overlay,
+// which firewalls on the way, or on the hosts themselves, often drop.
+// With ClampMSS we lower the MSS option of TCP SYN and SYN-ACK
+// segments to what fits the effective PMTU of the connection they go
+// over, so that the hosts never send segments too large in the first
+// place. We clamp both the frames we capture, before forwarding them,
+// and the frames we receive, before injecting them, so that hosts
+// behind peers which don't clamp are covered as well.
+
+const (
+	ipv4HeaderLen   = 20
+	ipv6HeaderLen   = 40
+	tcpHeaderLen    = 20
+	tcpFlagSYN      = 0x02
+	tcpOptionEnd    = 0
+	tcpOptionNOP    = 1
+	tcpOptionMSS    = 2
+	tcpOptionMSSLen = 4
+)
+
+// Lower the MSS option of the frame, should it be a TCP SYN, to fit
+// IP packets of the PMTU, returning whether we did. The frame changes
+// in place.
+func (dec *EthernetDecoder) ClampMSS(pmtu int) bool {
+	switch {
+	case dec.IsIPv4():
+		if dec.ip.Protocol != layers.IPProtocolTCP || dec.ip.Flags&layers.IPv4MoreFragments != 0 || dec.ip.FragOffset != 0 {
+			return false
+		}
+		return clampMSS(dec.ip.Payload, pmtu-ipv4HeaderLen-tcpHeaderLen)
+	case dec.IsIPv6():
+		if dec.ip6.NextHeader != layers.IPProtocolTCP {
+			return false
+		}
+		return clampMSS(dec.ip6.Payload, pmtu-ipv6HeaderLen-tcpHeaderLen)
+	}
+	return false
+}
+
+func clampMSS(tcp []byte, mss int) bool {
+	if mss <= 0 || len(tcp) < tcpHeaderLen || tcp[13]&tcpFlagSYN == 0 {
+		return false
+	}
+	optionsEnd := int(tcp[12]>>4) * 4
+	if optionsEnd > len(tcp) {
+		return false
+	}
+	for i := tcpHeaderLen; i < optionsEnd; {
+		switch tcp[i] {
+		case tcpOptionEnd:
+			return false
+		case tcpOptionNOP:
+			i++
+			continue
+		}
+		if i+1 >= optionsEnd || tcp[i+1] < 2 {
+			return false // malformed
+		}
+		if tcp[i] == tcpOptionMSS && tcp[i+1] == tcpOptionMSSLen && i+tcpOptionMSSLen <= optionsEnd {
+			old := binary.BigEndian.Uint16(tcp[i+2:])
+			if int(old) <= mss {
+				return false
+			}
+			binary.BigEndian.PutUint16(tcp[i+2:], uint16(mss))
+			updateChecksum(tcp[16:18], old, uint16(mss), i%2 == 1)
+			return true
+		}
+		i += int(tcp[i+1])
+	}
+	return false
+}
+
+// Update the internet checksum for a 16-bit word of the data it
+// covers changing from old to new, incrementally as in RFC 1624, so we
+// needn't go over the whole segment again. A word at an odd offset
+// straddles two of the words summed, which amounts to its bytes being
+// swapped.
+func updateChecksum(checksum []byte, old, new uint16, odd bool) {
+	if odd {
+		old, new = old>>8|old<<8, new>>8|new<<8
+	}
+	sum := uint32(^binary.BigEndian.Uint16(checksum)) + uint32(^old) + uint32(new)
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	binary.BigEndian.PutUint16(checksum, ^uint16(sum))
+}
+
+// The effective PMTU of the connection frames for the peer go over,
+// or, for none, the lowest of our established connections, which
+// broadcasts go over; 0 if there is no such connection.
+func (router *Router) effectivePMTU(dstPeer *Peer) int {
+	if dstPeer != nil {
+		if conn, found := router.Routes.Relay(dstPeer.Name); found {
+			return conn.EffectivePMTU()
+		}
+		return 0
+	}
+	mtu := 0
+	router.Ourself.ForEachConnection(func(_ PeerName, conn Connection) {
+		if localConn, ok := conn.(*LocalConnection); ok && localConn.Established() {
+			if pmtu := localConn.EffectivePMTU(); pmtu > 0 && (mtu == 0 || pmtu < mtu) {
+				mtu = pmtu
+			}
+		}
+	})
+	return mtu
+}
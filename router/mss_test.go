@@ -0,0 +1,86 @@
+package router
+
+import (
+	"code.google.com/p/gopacket/layers"
+	"encoding/binary"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+)
+
+// A TCP segment with the flags and options, checksummed as from the
+// addresses
+func mssTestFrame(t *testing.T, flags byte, options []byte) *EthernetDecoder {
+	src, dst := net.ParseIP("10.0.0.1").To4(), net.ParseIP("10.0.0.2").To4()
+	dec := decodeTestFrame(t, &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP,
+		SrcIP: src, DstIP: dst}, layers.EthernetTypeIPv4, tcpHeaderLen+len(options))
+	tcp := dec.ip.Payload
+	binary.BigEndian.PutUint16(tcp[0:], 40000)
+	binary.BigEndian.PutUint16(tcp[2:], 80)
+	tcp[12] = byte((tcpHeaderLen + len(options)) / 4 << 4)
+	tcp[13] = flags
+	copy(tcp[tcpHeaderLen:], options)
+	binary.BigEndian.PutUint16(tcp[16:], ^tcpChecksumSum(src, dst, tcp))
+	return dec
+}
+
+// The one's complement sum of the segment and its pseudo header, which
+// is 0xffff for a correct checksum.
+func tcpChecksumSum(src, dst net.IP, tcp []byte) uint16 {
+	pseudo := append(append(append([]byte{}, src...), dst...), 0, byte(layers.IPProtocolTCP), byte(len(tcp)>>8), byte(len(tcp)))
+	var sum uint32
+	for _, data := range [][]byte{pseudo, tcp} {
+		for i := 0; i < len(data); i += 2 {
+			word := uint32(data[i]) << 8
+			if i+1 < len(data) {
+				word |= uint32(data[i+1])
+			}
+			sum += word
+		}
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return uint16(sum)
+}
+
+func checkMSS(t *testing.T, dec *EthernetDecoder, offset int, wanted uint16) {
+	tcp := dec.ip.Payload
+	wt.AssertEqualInt(t, int(binary.BigEndian.Uint16(tcp[offset:])), int(wanted), "MSS")
+	wt.AssertEqualInt(t, int(tcpChecksumSum(dec.ip.SrcIP, dec.ip.DstIP, tcp)), 0xffff, "checksum")
+}
+
+func TestClampMSS(t *testing.T) {
+	// MSS at an even offset
+	dec := mssTestFrame(t, tcpFlagSYN, []byte{tcpOptionMSS, 4, 0x05, 0xb4})
+	if !dec.ClampMSS(1400) {
+		wt.Fatalf(t, "expected the MSS to be clamped")
+	}
+	checkMSS(t, dec, 22, 1360)
+
+	// At an odd offset, before another option, in a SYN-ACK
+	dec = mssTestFrame(t, tcpFlagSYN|0x10, []byte{tcpOptionNOP, tcpOptionMSS, 4, 0xff, 0xd7, 3, 3, 7})
+	if !dec.ClampMSS(1410) {
+		wt.Fatalf(t, "expected the MSS to be clamped")
+	}
+	checkMSS(t, dec, 23, 1370)
+
+	// Already small enough
+	dec = mssTestFrame(t, tcpFlagSYN, []byte{tcpOptionMSS, 4, 0x02, 0x18})
+	if dec.ClampMSS(1400) {
+		wt.Fatalf(t, "expected a small MSS to be left alone")
+	}
+	checkMSS(t, dec, 22, 536)
+
+	// Not a SYN
+	dec = mssTestFrame(t, 0x10, []byte{tcpOptionMSS, 4, 0x05, 0xb4})
+	if dec.ClampMSS(1400) {
+		wt.Fatalf(t, "expected a segment other than a SYN to be left alone")
+	}
+
+	// Malformed options
+	dec = mssTestFrame(t, tcpFlagSYN, []byte{3, 0, tcpOptionMSS, 4})
+	if dec.ClampMSS(1400) {
+		wt.Fatalf(t, "expected malformed options to be left alone")
+	}
+}
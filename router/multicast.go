@@ -0,0 +1,230 @@
+package router
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// Multicast frames for groups we snoop IGMP/MLD reports for only go
+// to the peers with receivers in the group, rather than being flooded
+// along the broadcast topology. Each peer tells all the others which
+// groups its local hosts have joined, by gossip.
+//
+// The sender forwards a copy of the frame to each interested peer
+// directly, so receivers mustn't relay frames from a snooping peer
+// any further. Peers which don't snoop don't tell us what they want,
+// so they get everything.
+//
+// The groups go in a gossip table; see gossip_table.go. Peers which
+// don't snoop still gossip an entry, so that one from before a restart
+// with snooping turned off doesn't linger.
+//
+// Hosts only report membership when they join, or when asked by a
+// querier, which there may not be. So rather than expiring
+// memberships, we keep them until the host leaves the group, or its
+// MAC expires.
+
+type MulticastGroups struct {
+	*GossipTable
+	ourName PeerName
+	local   map[string]map[string]bool // group MAC -> MACs of local hosts in it
+}
+
+type peerGroups struct {
+	snooping bool
+	groups   map[string]bool
+}
+
+// What we gossip about each peer
+type PeerGroups struct {
+	Snooping bool
+	Groups   []string
+}
+
+func NewMulticastGroups(ourName PeerName, snooping bool) *MulticastGroups {
+	mg := &MulticastGroups{
+		ourName: ourName,
+		local:   make(map[string]map[string]bool)}
+	mg.GossipTable = NewGossipTable(ourName, "multicast", mg, &peerGroups{snooping: snooping, groups: make(map[string]bool)})
+	return mg
+}
+
+func (mg *MulticastGroups) Snooping() bool {
+	return mg.SnoopingPeer(mg.ourName)
+}
+
+// Whether frames from the peer for snoopable groups go directly to
+// the peers wanting them.
+func (mg *MulticastGroups) SnoopingPeer(name PeerName) bool {
+	mg.RLock()
+	defer mg.RUnlock()
+	entry, found := mg.Entry(name)
+	return found && entry.(*peerGroups).snooping
+}
+
+// Whether the peer has receivers in the group, or might have.
+func (mg *MulticastGroups) Wants(name PeerName, group net.HardwareAddr) bool {
+	mg.RLock()
+	defer mg.RUnlock()
+	entry, found := mg.Entry(name)
+	if !found {
+		return true
+	}
+	groups := entry.(*peerGroups)
+	return !groups.snooping || groups.groups[string(group)]
+}
+
+func (mg *MulticastGroups) Join(group, host net.HardwareAddr) {
+	mg.update(func() bool {
+		hosts, found := mg.local[string(group)]
+		if !found {
+			hosts = make(map[string]bool)
+			mg.local[string(group)] = hosts
+		}
+		if hosts[string(host)] {
+			return false
+		}
+		hosts[string(host)] = true
+		return !found
+	})
+}
+
+func (mg *MulticastGroups) Leave(group, host net.HardwareAddr) {
+	mg.update(func() bool {
+		return mg.removeHost(string(group), string(host))
+	})
+}
+
+// Remove the host from all groups; for when its MAC expires.
+func (mg *MulticastGroups) ForgetHost(host net.HardwareAddr) {
+	mg.update(func() bool {
+		changed := false
+		for group := range mg.local {
+			changed = mg.removeHost(group, string(host)) || changed
+		}
+		return changed
+	})
+}
+
+func (mg *MulticastGroups) removeHost(group, host string) bool {
+	hosts, found := mg.local[group]
+	if !found || !hosts[host] {
+		return false
+	}
+	delete(hosts, host)
+	if len(hosts) > 0 {
+		return false
+	}
+	delete(mg.local, group)
+	return true
+}
+
+// Apply a change to our local memberships and, if it changes the
+// groups we want, tell everyone.
+func (mg *MulticastGroups) update(change func() bool) {
+	mg.Update(func(entry interface{}) bool {
+		ours := entry.(*peerGroups)
+		if !ours.snooping || !change() {
+			return false
+		}
+		ours.groups = make(map[string]bool)
+		for group := range mg.local {
+			ours.groups[group] = true
+		}
+		return true
+	})
+}
+
+func (mg *MulticastGroups) EncodeEntries(entries map[PeerName]interface{}) interface{} {
+	update := make(map[PeerName]PeerGroups, len(entries))
+	for name, entry := range entries {
+		entry := entry.(*peerGroups)
+		groups := make([]string, 0, len(entry.groups))
+		for group := range entry.groups {
+			groups = append(groups, group)
+		}
+		update[name] = PeerGroups{Snooping: entry.snooping, Groups: groups}
+	}
+	return update
+}
+
+func (mg *MulticastGroups) DecodeEntries(decoder *gob.Decoder) (map[PeerName]interface{}, error) {
+	var update map[PeerName]PeerGroups
+	if err := decoder.Decode(&update); err != nil {
+		return nil, err
+	}
+	entries := make(map[PeerName]interface{}, len(update))
+	for name, received := range update {
+		entry := &peerGroups{snooping: received.Snooping, groups: make(map[string]bool)}
+		for _, group := range received.Groups {
+			entry.groups[group] = true
+		}
+		entries[name] = entry
+	}
+	return entries, nil
+}
+
+func (mg *MulticastGroups) String() string {
+	var buf bytes.Buffer
+	mg.RLock()
+	defer mg.RUnlock()
+	mg.ForEach(func(name PeerName, value interface{}) {
+		entry := value.(*peerGroups)
+		if !entry.snooping {
+			buf.WriteString(fmt.Sprintln(name, "not snooping"))
+			return
+		}
+		groups := make([]string, 0, len(entry.groups))
+		for group := range entry.groups {
+			groups = append(groups, net.HardwareAddr(group).String())
+		}
+		sort.Strings(groups)
+		buf.WriteString(fmt.Sprintln(name, "->", groups))
+	})
+	return buf.String()
+}
+
+// Send a copy of the frame to each peer which wants frames for its
+// group; see RelayBroadcast regarding frames too big for some.
+func (peer *LocalPeer) Multicast(df bool, frame []byte, dec *EthernetDecoder) error {
+	group := dec.eth.DstMAC
+	var dstPeers []*Peer
+	peer.Router.Peers.ForEach(func(name PeerName, dstPeer *Peer) {
+		if dstPeer == peer.Peer || !peer.Router.Multicast.Wants(name, group) {
+			return
+		}
+		if _, found := peer.Router.Routes.Unicast(name); found {
+			dstPeers = append(dstPeers, dstPeer)
+		}
+	})
+	var tooBig *FrameTooBigError
+	for _, dstPeer := range dstPeers {
+		var err error
+		tooBig, err = lowestTooBig(tooBig, peer.Forward(dstPeer, df, frame, dec))
+		if err != nil {
+			return err
+		}
+	}
+	if tooBig != nil {
+		return *tooBig
+	}
+	return nil
+}
+
+// Track the group memberships of local hosts from their reports.
+func (router *Router) snoopGroupChanges(dec *EthernetDecoder) {
+	host := dec.eth.SrcMAC
+	dec.ForEachGroupChange(func(group net.HardwareAddr, join bool) {
+		if !IsSnoopableGroup(group) {
+			return
+		}
+		if join {
+			router.Multicast.Join(group, host)
+		} else {
+			router.Multicast.Leave(group, host)
+		}
+	})
+}
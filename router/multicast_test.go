@@ -0,0 +1,130 @@
+package router
+
+import (
+	"code.google.com/p/gopacket/layers"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+)
+
+type groupChange struct {
+	group string
+	join  bool
+}
+
+func groupChanges(dec *EthernetDecoder) []groupChange {
+	var changes []groupChange
+	dec.ForEachGroupChange(func(group net.HardwareAddr, join bool) {
+		changes = append(changes, groupChange{group.String(), join})
+	})
+	return changes
+}
+
+func checkGroupChanges(t *testing.T, dec *EthernetDecoder, expected ...groupChange) {
+	changes := groupChanges(dec)
+	wt.AssertEqualInt(t, len(changes), len(expected), "number of group changes")
+	for i, change := range changes {
+		if change != expected[i] {
+			wt.Fatalf(t, "Expected group change %v; got %v", expected[i], change)
+		}
+	}
+}
+
+func decodeIGMP(t *testing.T, msg []byte) *EthernetDecoder {
+	dec := decodeTestFrame(t, &layers.IPv4{Version: 4, IHL: 5, TTL: 1, Protocol: layers.IPProtocolIGMP,
+		SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(224, 0, 0, 22)}, layers.EthernetTypeIPv4, 0)
+	dec.ip.Payload = msg
+	return dec
+}
+
+func TestIGMPSnooping(t *testing.T) {
+	checkGroupChanges(t, decodeIGMP(t, []byte{igmpV2Report, 0, 0, 0, 239, 129, 2, 3}),
+		groupChange{"01:00:5e:01:02:03", true})
+	checkGroupChanges(t, decodeIGMP(t, []byte{igmpV2Leave, 0, 0, 0, 239, 1, 2, 3}),
+		groupChange{"01:00:5e:01:02:03", false})
+	checkGroupChanges(t, decodeIGMP(t, []byte{igmpV3Report, 0, 0, 0, 0, 0, 0, 3,
+		changeToInclude, 0, 0, 0, 239, 1, 2, 3, // leave
+		modeIsInclude, 1, 0, 1, 239, 1, 2, 4, 10, 0, 0, 9, 0, 0, 0, 0, // join some sources, with aux data
+		blockOldSources, 0, 0, 1, 239, 1, 2, 5, 10, 0, 0, 9}),
+		groupChange{"01:00:5e:01:02:03", false},
+		groupChange{"01:00:5e:01:02:04", true})
+	// Truncated records
+	checkGroupChanges(t, decodeIGMP(t, []byte{igmpV3Report, 0, 0, 0, 0, 0, 0, 2, 2, 0, 0, 0, 239}))
+
+	// An MLDv2 report, after a hop-by-hop header with a router alert
+	mld := append([]byte{byte(layers.IPProtocolICMPv6), 0, 5, 2, 0, 0, 1, 0,
+		mldV2Report, 0, 0, 0, 0, 0, 0, 1, 4, 0, 0, 0}, net.ParseIP("ff0e::1:2:3")...)
+	frame := []byte{0x33, 0x33, 0, 0, 0, 0x16, 0, 0x11, 0x22, 0x33, 0x44, 0x55, 0x86, 0xdd,
+		0x60, 0, 0, 0, 0, byte(len(mld)), byte(layers.IPProtocolIPv6HopByHop), 1}
+	frame = append(frame, net.ParseIP("fe80::1")...)
+	frame = append(frame, net.ParseIP("ff02::16")...)
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(append(frame, mld...))
+	checkGroupChanges(t, dec, groupChange{"33:33:00:02:00:03", true})
+}
+
+func TestSnoopableGroups(t *testing.T) {
+	for mac, expected := range map[string]bool{
+		"01:00:5e:01:02:03": true,
+		"01:00:5e:00:00:fb": false, // 224.0.0.251, mDNS
+		"33:33:00:02:00:03": true,
+		"33:33:00:00:00:01": false, // ff02::1, all nodes
+		"33:33:ff:00:00:01": false, // solicited node
+		"ff:ff:ff:ff:ff:ff": false} {
+		hwAddr, _ := net.ParseMAC(mac)
+		if IsSnoopableGroup(hwAddr) != expected {
+			wt.Fatalf(t, "Expected %s to be snoopable: %v", mac, expected)
+		}
+	}
+}
+
+func TestMulticastGroupsGossip(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	name3, _ := PeerNameFromString("03:00:00:01:00:00")
+	group, _ := net.ParseMAC("01:00:5e:01:02:03")
+	host1, _ := net.ParseMAC("00:00:00:00:00:01")
+	host2, _ := net.ParseMAC("00:00:00:00:00:02")
+	mg1 := NewMulticastGroups(name1, true)
+	mg2 := NewMulticastGroups(name2, true)
+	mg3 := NewMulticastGroups(name3, false)
+
+	update, err := mg2.OnGossip(mg1.Gossip())
+	wt.AssertNoErr(t, err)
+	if update == nil {
+		wt.Fatalf(t, "Expected new entry to be passed on")
+	}
+	update, err = mg2.OnGossip(mg1.Gossip())
+	wt.AssertNoErr(t, err)
+	if update != nil {
+		wt.Fatalf(t, "Expected nothing new")
+	}
+	_, err = mg2.OnGossip(mg3.Gossip())
+	wt.AssertNoErr(t, err)
+	if !mg2.SnoopingPeer(name1) || mg2.SnoopingPeer(name3) {
+		wt.Fatalf(t, "Expected only peer 1 to be snooping")
+	}
+	if mg2.Wants(name1, group) || !mg2.Wants(name3, group) {
+		wt.Fatalf(t, "Expected only peer 3 to want group")
+	}
+
+	mg1.Join(group, host1)
+	mg1.Join(group, host2)
+	mg1.Leave(group, host1)
+	_, err = mg2.OnGossip(mg1.Gossip())
+	wt.AssertNoErr(t, err)
+	if !mg2.Wants(name1, group) {
+		wt.Fatalf(t, "Expected peer 1 to want group after join")
+	}
+	mg1.ForgetHost(host2)
+	wt.AssertNoErr(t, mg2.OnGossipBroadcast(mg1.Gossip()))
+	if mg2.Wants(name1, group) {
+		wt.Fatalf(t, "Expected peer 1 not to want group after last host left")
+	}
+
+	// Peers with snooping off never announce groups
+	mg3.Join(group, host1)
+	if !mg3.Wants(name3, group) || mg3.Snooping() {
+		wt.Fatalf(t, "Expected peer 3 not to be snooping")
+	}
+}
@@ -0,0 +1,126 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Multi-homing. Hosts may be reachable at several addresses, e.g. over
+// several NICs or uplinks, and peers tell each other all of theirs in
+// the handshake. When an established connection goes without
+// heartbeats from the remote for FailoverHeartbeats slow heartbeat
+// intervals, we send to the next of the remote's addresses instead,
+// and so on, in turn, while the silence lasts. The connection itself,
+// and with it the MACs, routes and session keys, stays as it is. As
+// ever, heartbeats from the remote, whichever address they come from,
+// tell us where it can be reached; see handleReceivedHeartbeat.
+
+// The addresses of our interfaces peers may reach us at: all but
+// loopback and the one we capture on, or only the one we bind to.
+func (router *Router) underlayIPs() []net.IP {
+	var ips []net.IP
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ips
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 ||
+			(router.Iface != nil && iface.Name == router.Iface.Name) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || (ipNet.IP.To4() == nil && !ipNet.IP.IsGlobalUnicast()) ||
+				(router.BindAddr != nil && !ipNet.IP.Equal(router.BindAddr)) {
+				continue
+			}
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
+
+// What we tell peers in the handshake
+func (router *Router) underlayAddrs() []string {
+	var addrs []string
+	for _, ip := range router.underlayIPs() {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), fmt.Sprint(Port)))
+	}
+	return addrs
+}
+
+// The addresses the remote told us in the handshake which we can
+// send to: bound to an address, only those of its family.
+func (conn *LocalConnection) receiveUnderlayAddrs(handshakeRecv map[string]string) error {
+	addrs, err := decodeCandidates([]byte(handshakeRecv["UnderlayAddrs"]))
+	if err != nil {
+		return err
+	}
+	bindAddr := conn.Router.BindAddr
+	for _, addr := range addrs {
+		if bindAddr == nil || (addr.IP.To4() == nil) == (bindAddr.To4() == nil) {
+			conn.remoteAddrs = append(conn.remoteAddrs, addr)
+		}
+	}
+	return nil
+}
+
+// The remote's address to try after the current one
+func nextRemoteAddr(addrs []*net.UDPAddr, current *net.UDPAddr) *net.UDPAddr {
+	start := 0
+	for i, addr := range addrs {
+		if current != nil && addr.String() == current.String() {
+			start = i + 1
+			break
+		}
+	}
+	for i := range addrs {
+		if addr := addrs[(start+i)%len(addrs)]; current == nil || addr.String() != current.String() {
+			return addr
+		}
+	}
+	return nil
+}
+
+// Called on each heartbeat tick of an established connection, with how
+// long the remote has been silent for. Fails over to the remote's next
+// address once the silence exceeds FailoverHeartbeats, and again after
+// each further such silence.
+func (conn *LocalConnection) checkFailover(silence time.Duration, slowHeartbeat time.Duration) {
+	if conn.sendingOverTCP || conn.encap != EncapWeave || len(conn.remoteAddrs) == 0 {
+		return
+	}
+	wait := silence
+	if since := time.Since(conn.failedOverAt); since < wait {
+		wait = since
+	}
+	if wait <= FailoverHeartbeats*slowHeartbeat {
+		return
+	}
+	oldRemoteUDPAddr := conn.remoteUDPAddr
+	remoteUDPAddr := nextRemoteAddr(conn.remoteAddrs, oldRemoteUDPAddr)
+	if remoteUDPAddr == nil {
+		return
+	}
+	conn.logger(logConnection).Info("No heartbeat from", oldRemoteUDPAddr, "for", silence, "- failing over to", remoteUDPAddr)
+	conn.failedOverAt = time.Now()
+	conn.failOver(remoteUDPAddr)
+}
+
+// Send to the remote at another of its addresses
+func (conn *LocalConnection) failOver(remoteUDPAddr *net.UDPAddr) {
+	conn.Lock()
+	conn.remoteUDPAddr = remoteUDPAddr
+	conn.Unlock()
+	atomic.AddUint64(&conn.stats.Failovers, 1)
+	// The DF senders may be tied to the old address; the others look
+	// it up with every packet.
+	conn.retargetDF()
+	conn.Forward(true, conn.heartbeatFrame, nil)
+}
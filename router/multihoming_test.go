@@ -0,0 +1,72 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNextRemoteAddr(t *testing.T) {
+	addrs, err := decodeCandidates([]byte("10.0.0.1:6783,10.0.1.1:6783,[2001:db8::1]:6783"))
+	wt.AssertNoErr(t, err)
+	next := func(current string) string {
+		var currentAddr *net.UDPAddr
+		if current != "" {
+			currentAddr, _ = net.ResolveUDPAddr("udp", current)
+		}
+		if addr := nextRemoteAddr(addrs, currentAddr); addr != nil {
+			return addr.String()
+		}
+		return ""
+	}
+	wt.AssertEqualString(t, next("10.0.0.1:6783"), "10.0.1.1:6783", "next address")
+	wt.AssertEqualString(t, next("[2001:db8::1]:6783"), "10.0.0.1:6783", "next address")
+	// where we found the remote at an address it didn't tell us, e.g.
+	// behind NAT, we start at the beginning
+	wt.AssertEqualString(t, next("192.0.2.1:6783"), "10.0.0.1:6783", "next address")
+	wt.AssertEqualString(t, next(""), "10.0.0.1:6783", "next address")
+
+	addrs = addrs[:1]
+	wt.AssertEqualString(t, next("10.0.0.1:6783"), "", "next address with the only one in use")
+}
+
+func TestReceiveUnderlayAddrs(t *testing.T) {
+	conn := &LocalConnection{Router: &Router{}}
+	wt.AssertNoErr(t, conn.receiveUnderlayAddrs(map[string]string{}))
+	wt.AssertEqualInt(t, len(conn.remoteAddrs), 0, "addresses from older peers")
+
+	fields := map[string]string{"UnderlayAddrs": "10.0.0.1:6783,[2001:db8::1]:6783"}
+	wt.AssertNoErr(t, conn.receiveUnderlayAddrs(fields))
+	wt.AssertEqualInt(t, len(conn.remoteAddrs), 2, "addresses")
+
+	// bound to an address, we can only send to those of its family
+	conn = &LocalConnection{Router: &Router{RouterConfig: RouterConfig{BindAddr: net.ParseIP("10.0.0.2")}}}
+	wt.AssertNoErr(t, conn.receiveUnderlayAddrs(fields))
+	wt.AssertEqualInt(t, len(conn.remoteAddrs), 1, "addresses when bound")
+	wt.AssertEqualString(t, conn.remoteAddrs[0].String(), "10.0.0.1:6783", "address when bound")
+
+	if err := conn.receiveUnderlayAddrs(map[string]string{"UnderlayAddrs": "nonsense"}); err == nil {
+		wt.Fatalf(t, "Expected error for malformed address")
+	}
+}
+
+func TestCheckFailover(t *testing.T) {
+	conn, _ := newTestGCMConnPair()
+	conn.stats = &ConnectionStats{}
+	conn.remoteAddrs, _ = decodeCandidates([]byte("10.0.0.1:6783,10.0.1.1:6783"))
+	conn.remoteUDPAddr = conn.remoteAddrs[0]
+	slow := time.Second
+
+	conn.checkFailover(FailoverHeartbeats*slow, slow)
+	wt.AssertEqualString(t, conn.remoteUDPAddr.String(), "10.0.0.1:6783", "address before the silence is long enough")
+	conn.checkFailover(FailoverHeartbeats*slow+1, slow)
+	wt.AssertEqualString(t, conn.remoteUDPAddr.String(), "10.0.1.1:6783", "address after failing over")
+	// the next address gets as long before we move on again
+	conn.checkFailover(2*FailoverHeartbeats*slow, slow)
+	wt.AssertEqualString(t, conn.remoteUDPAddr.String(), "10.0.1.1:6783", "address straight after failing over")
+	conn.failedOverAt = conn.failedOverAt.Add(-FailoverHeartbeats*slow - 1)
+	conn.checkFailover(2*FailoverHeartbeats*slow, slow)
+	wt.AssertEqualString(t, conn.remoteUDPAddr.String(), "10.0.0.1:6783", "address after failing over again")
+	wt.AssertEqualuint64(t, conn.stats.Failovers, 2, "failovers")
+}
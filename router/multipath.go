@@ -0,0 +1,88 @@
+package router
+
+import (
+	"net"
+	"time"
+)
+
+// Multi-path. Where both peers run with -multipath, a connection
+// spreads its flows over all the paths to the remote's addresses (see
+// multihoming.go) which answer probes (see standby.go), so as to make
+// use of the bandwidth of all of them. Frames of a flow all go to the
+// same forwarder worker (see Forward), and each worker sends down one
+// path, the worker's number modulo the number of paths answering, in
+// the order the remote told us its addresses. So a flow only changes
+// path when a path stops or starts answering, and the frames of a
+// flow don't get reordered by taking different paths. It takes
+// several forwarder workers to spread flows at all.
+//
+// Packets from the remote arriving from any of its addresses don't
+// mean it moved there.
+
+// The address the worker sends to
+func (conn *LocalConnection) pathFor(worker int) *net.UDPAddr {
+	conn.RLock()
+	defer conn.RUnlock()
+	if len(conn.paths) > 0 {
+		return conn.paths[worker%len(conn.paths)]
+	}
+	return conn.remoteUDPAddr
+}
+
+// A sender from the UDP listener for the forwarder worker
+func newPathUDPSender(conn *LocalConnection, worker int) (UDPSender, error) {
+	sender, err := NewSimpleUDPSender(conn)
+	if err != nil {
+		return nil, err
+	}
+	sender.worker = worker
+	return sender, nil
+}
+
+// Whether the remote sent a packet from one of its paths, rather than
+// from wherever it moved to.
+func (conn *LocalConnection) knownPath(addr *net.UDPAddr) bool {
+	if !conn.multiPath {
+		return false
+	}
+	for _, remoteAddr := range conn.remoteAddrs {
+		if remoteAddr.Port == addr.Port && remoteAddr.IP.Equal(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Called on every StandbyProbe: spread flows over the paths which
+// answered lately.
+func (conn *LocalConnection) updatePaths(now time.Time) {
+	var paths []*net.UDPAddr
+	for _, addr := range conn.remoteAddrs {
+		if last, found := conn.standby.answered[addr.String()]; found && now.Sub(last) <= StandbyTimeout {
+			paths = append(paths, addr)
+		}
+	}
+	if samePaths(paths, conn.paths) {
+		return
+	}
+	conn.logger(logConnection).Info("Spreading flows over", len(paths), "paths:", paths)
+	conn.setPaths(paths)
+}
+
+func (conn *LocalConnection) setPaths(paths []*net.UDPAddr) {
+	conn.Lock()
+	conn.paths = paths
+	conn.Unlock()
+}
+
+func samePaths(paths1, paths2 []*net.UDPAddr) bool {
+	if len(paths1) != len(paths2) {
+		return false
+	}
+	for i := range paths1 {
+		if paths1[i].String() != paths2[i].String() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,48 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMultiPath(t *testing.T) {
+	conn, _ := newTestGCMConnPair()
+	conn.multiPath = true
+	conn.remoteAddrs, _ = decodeCandidates([]byte("10.0.0.1:6783,10.0.1.1:6783,10.0.2.1:6783"))
+	conn.remoteUDPAddr = conn.remoteAddrs[0]
+	now := time.Now()
+	conn.standby = newStandbyPaths(now)
+	pathsFor := func() string {
+		s := ""
+		for worker := 0; worker < 4; worker++ {
+			s += conn.pathFor(worker).String() + " "
+		}
+		return s
+	}
+
+	// Until paths answer, all goes to the remote's UDP address
+	conn.updatePaths(now)
+	wt.AssertEqualString(t, pathsFor(), "10.0.0.1:6783 10.0.0.1:6783 10.0.0.1:6783 10.0.0.1:6783 ", "paths")
+
+	for _, addr := range conn.remoteAddrs {
+		conn.standby.answered[addr.String()] = now
+	}
+	conn.updatePaths(now)
+	wt.AssertEqualString(t, pathsFor(), "10.0.0.1:6783 10.0.1.1:6783 10.0.2.1:6783 10.0.0.1:6783 ", "paths")
+
+	// A path stops answering
+	now = now.Add(StandbyTimeout)
+	conn.standby.answered["10.0.0.1:6783"], conn.standby.answered["10.0.2.1:6783"] = now, now
+	conn.updatePaths(now.Add(StandbyProbe))
+	wt.AssertEqualString(t, pathsFor(), "10.0.0.1:6783 10.0.2.1:6783 10.0.0.1:6783 10.0.2.1:6783 ", "paths")
+
+	// Packets from the remote's other addresses don't mean it moved
+	if !conn.knownPath(conn.remoteAddrs[2]) {
+		wt.Fatalf(t, "Expected packets from the remote's address to come down a known path")
+	}
+	if conn.knownPath(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: Port}) {
+		wt.Fatalf(t, "Unexpected known path to an address the remote didn't tell us")
+	}
+}
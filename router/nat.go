@@ -0,0 +1,366 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Peers behind NAT can't receive UDP from peers they haven't sent to.
+// So, when a connection comes up, both ends tell each other over TCP
+// which addresses they might be reachable at for UDP: those of their
+// interfaces, and their reflexive addresses, i.e. those their NATs
+// map them to, as learnt from STUN servers and from other peers. Then
+// both ends send STUN binding requests to all of the other's
+// candidates at once, which opens paths through their NATs. The first
+// address we hear a request or response from becomes the remote's UDP
+// address, whereupon heartbeats establish the connection as usual.
+//
+// We speak just enough STUN (RFC 5389) for binding requests and
+// responses, which also serves to learn our reflexive addresses from
+// the responses to our requests.
+
+const (
+	stunBindingRequest   = 0x0001
+	stunIndication       = 0x0011
+	stunBindingResponse  = 0x0101
+	stunMagicCookie      = 0x2112A442
+	stunHeaderSize       = 20
+	stunMappedAddress    = 0x0001
+	stunXORMappedAddress = 0x0020
+	stunIPv4             = 0x01
+	stunIPv6             = 0x02
+)
+
+type stunTxID [12]byte
+
+type stunMessage struct {
+	msgType uint16
+	txID    stunTxID
+	mapped  *net.UDPAddr // nil if absent
+}
+
+// Parse a STUN message, returning false if the packet isn't one.
+func parseSTUN(packet []byte) (*stunMessage, bool) {
+	if len(packet) < stunHeaderSize || packet[0]&0xC0 != 0 ||
+		binary.BigEndian.Uint32(packet[4:8]) != stunMagicCookie ||
+		int(binary.BigEndian.Uint16(packet[2:4]))+stunHeaderSize != len(packet) {
+		return nil, false
+	}
+	msg := &stunMessage{msgType: binary.BigEndian.Uint16(packet[0:2])}
+	copy(msg.txID[:], packet[8:stunHeaderSize])
+	attrs := packet[stunHeaderSize:]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if 4+attrLen > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+attrLen]
+		switch attrType {
+		case stunXORMappedAddress:
+			msg.mapped = decodeSTUNAddr(value, msg.xorMask())
+		case stunMappedAddress:
+			if msg.mapped == nil {
+				msg.mapped = decodeSTUNAddr(value, make([]byte, 2+net.IPv6len))
+			}
+		}
+		// attributes are padded to a multiple of four bytes
+		if attrLen = (attrLen + 3) &^ 3; 4+attrLen > len(attrs) {
+			break
+		}
+		attrs = attrs[4+attrLen:]
+	}
+	return msg, true
+}
+
+// Form a STUN message, with an XOR-MAPPED-ADDRESS attribute if mapped
+// isn't nil.
+func formSTUN(msgType uint16, txID stunTxID, mapped *net.UDPAddr) []byte {
+	var attrs []byte
+	if mapped != nil {
+		attrs = encodeSTUNAddr(mapped, (&stunMessage{txID: txID}).xorMask())
+	}
+	packet := make([]byte, stunHeaderSize, stunHeaderSize+len(attrs))
+	binary.BigEndian.PutUint16(packet[0:2], msgType)
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(attrs)))
+	binary.BigEndian.PutUint32(packet[4:8], stunMagicCookie)
+	copy(packet[8:], txID[:])
+	return append(packet, attrs...)
+}
+
+// The port and address in XOR-MAPPED-ADDRESS are XORed with the magic
+// cookie followed by the transaction ID.
+func (msg *stunMessage) xorMask() []byte {
+	mask := make([]byte, 4, 4+len(msg.txID))
+	binary.BigEndian.PutUint32(mask, stunMagicCookie)
+	return append(mask, msg.txID[:]...)
+}
+
+func decodeSTUNAddr(value, mask []byte) *net.UDPAddr {
+	if len(value) < 4 {
+		return nil
+	}
+	ipLen := net.IPv4len
+	switch value[1] {
+	case stunIPv4:
+	case stunIPv6:
+		ipLen = net.IPv6len
+	default:
+		return nil
+	}
+	if len(value) < 4+ipLen {
+		return nil
+	}
+	port := binary.BigEndian.Uint16(value[2:4]) ^ binary.BigEndian.Uint16(mask[0:2])
+	ip := make(net.IP, ipLen)
+	for i := range ip {
+		ip[i] = value[4+i] ^ mask[i]
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
+
+func encodeSTUNAddr(addr *net.UDPAddr, mask []byte) []byte {
+	family, ip := byte(stunIPv4), addr.IP.To4()
+	if ip == nil {
+		family, ip = stunIPv6, addr.IP.To16()
+	}
+	attr := make([]byte, 8+len(ip))
+	binary.BigEndian.PutUint16(attr[0:2], stunXORMappedAddress)
+	binary.BigEndian.PutUint16(attr[2:4], uint16(4+len(ip)))
+	attr[5] = family
+	binary.BigEndian.PutUint16(attr[6:8], uint16(addr.Port)^binary.BigEndian.Uint16(mask[0:2]))
+	for i := range ip {
+		attr[8+i] = ip[i] ^ mask[i]
+	}
+	return attr
+}
+
+type NATTraversal struct {
+	sync.Mutex
+	router    *Router
+	reflexive map[string]time.Time // our reflexive addresses, with when we last heard of them
+	queries   map[stunTxID]string  // outstanding requests to STUN servers
+}
+
+func NewNATTraversal(router *Router) *NATTraversal {
+	return &NATTraversal{
+		router:    router,
+		reflexive: make(map[string]time.Time),
+		queries:   make(map[stunTxID]string)}
+}
+
+// Ask the configured STUN servers for our reflexive address, now and
+// then, since NAT mappings change.
+func (nat *NATTraversal) Start() {
+	if len(nat.router.STUNServers) == 0 {
+		return
+	}
+	go func() {
+		nat.querySTUNServers()
+		for range time.Tick(STUNInterval) {
+			nat.querySTUNServers()
+		}
+	}()
+}
+
+func (nat *NATTraversal) querySTUNServers() {
+	// Forget about requests which never got a response
+	nat.Lock()
+	nat.queries = make(map[stunTxID]string)
+	nat.Unlock()
+	for _, server := range nat.router.STUNServers {
+		addr, err := net.ResolveUDPAddr("udp4", server)
+		if err != nil {
+			logNAT.Warn("Unable to resolve STUN server:", err)
+			continue
+		}
+		var txID stunTxID
+		copy(txID[:], randBytes(len(txID)))
+		nat.Lock()
+		nat.queries[txID] = server
+		nat.Unlock()
+		if _, err := nat.router.UDPListener.WriteToUDP(formSTUN(stunBindingRequest, txID, nil), addr); err != nil {
+			logNAT.Warn("Unable to query STUN server", server, "-", err)
+		}
+	}
+}
+
+// Handle the packet if it's a STUN message, returning whether it was.
+func (nat *NATTraversal) HandlePacket(packet []byte, sender *net.UDPAddr) bool {
+	msg, ok := parseSTUN(packet)
+	if !ok {
+		return false
+	}
+	conn := nat.router.punchingConnection(msg.txID)
+	switch {
+	case msg.msgType == stunBindingRequest && conn != nil:
+		_, err := nat.router.UDPListener.WriteToUDP(formSTUN(stunBindingResponse, msg.txID, sender), sender)
+		checkWarn(err)
+		conn.PunchedThrough(sender)
+	case msg.msgType == stunBindingResponse && conn != nil:
+		nat.addReflexive(msg.mapped)
+		conn.ProbeAnswered(sender)
+	case msg.msgType == stunIndication:
+		// A keepalive; see keepalive.go
+	case msg.msgType == stunBindingResponse:
+		nat.Lock()
+		_, found := nat.queries[msg.txID]
+		delete(nat.queries, msg.txID)
+		nat.Unlock()
+		if found {
+			nat.addReflexive(msg.mapped)
+		}
+	default:
+		// A request for a connection we no longer have, which we
+		// drop, or something else which merely looks like STUN, and
+		// may well be a frame.
+		return msg.msgType == stunBindingRequest || msg.msgType == stunBindingResponse
+	}
+	return true
+}
+
+func (nat *NATTraversal) addReflexive(addr *net.UDPAddr) {
+	if addr == nil {
+		return
+	}
+	nat.Lock()
+	defer nat.Unlock()
+	if _, found := nat.reflexive[addr.String()]; !found {
+		logNAT.Info("Discovered our reflexive address", addr)
+	}
+	nat.reflexive[addr.String()] = time.Now()
+}
+
+// The addresses we may be reachable at for UDP: those of our
+// interfaces, bar loopback and the one we capture on, or only the one
+// we bind to, and our recent reflexive addresses.
+func (nat *NATTraversal) Candidates() []string {
+	var candidates []string
+	for _, ip := range nat.router.underlayIPs() {
+		if ip.To4() != nil {
+			candidates = append(candidates, fmt.Sprintf("%s:%d", ip, Port))
+		}
+	}
+	nat.Lock()
+	defer nat.Unlock()
+	for addr, seen := range nat.reflexive {
+		if time.Since(seen) > 2*STUNInterval {
+			delete(nat.reflexive, addr)
+		} else {
+			candidates = append(candidates, addr)
+		}
+	}
+	sort.Strings(candidates)
+	return candidates
+}
+
+func (nat *NATTraversal) String() string {
+	return fmt.Sprintln(nat.Candidates())
+}
+
+func encodeCandidates(candidates []string) []byte {
+	return []byte(strings.Join(candidates, ","))
+}
+
+func decodeCandidates(payload []byte) ([]*net.UDPAddr, error) {
+	var addrs []*net.UDPAddr
+	if len(payload) == 0 {
+		return addrs, nil
+	}
+	for _, candidate := range strings.Split(string(payload), ",") {
+		addr, err := net.ResolveUDPAddr("udp", candidate)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// The connection whose hole punching, or probing of paths, the
+// transaction belongs to, if any; see punchTxID.
+func (router *Router) punchingConnection(txID stunTxID) *LocalConnection {
+	uid := binary.BigEndian.Uint64(txID[:8])
+	var found *LocalConnection
+	router.Ourself.ForEachConnection(func(_ PeerName, conn Connection) {
+		if localConn, ok := conn.(*LocalConnection); ok && (localConn.canPunch || localConn.standbyPaths || localConn.multiPath) && localConn.uid == uid {
+			found = localConn
+		}
+	})
+	return found
+}
+
+// Both ends know the connection's uid, so it identifies our requests
+// to each other.
+func (conn *LocalConnection) punchTxID() stunTxID {
+	var txID stunTxID
+	binary.BigEndian.PutUint64(txID[:8], conn.uid)
+	copy(txID[8:], randBytes(len(txID)-8))
+	return txID
+}
+
+// Async
+func (conn *LocalConnection) PunchedThrough(remoteUDPAddr *net.UDPAddr) {
+	conn.sendQuery(CPunchedThrough, remoteUDPAddr)
+}
+
+func (conn *LocalConnection) sendCandidates() error {
+	return conn.handleSendProtocolMsg(ProtocolMsg{ProtocolNATCandidates, encodeCandidates(conn.Router.NAT.Candidates())})
+}
+
+func (conn *LocalConnection) handleStartPunching(candidates []*net.UDPAddr) {
+	if conn.established || conn.sendingOverTCP || len(candidates) == 0 {
+		return
+	}
+	conn.punchCandidates = candidates
+	conn.punchDeadline = time.Now().Add(PunchTimeout)
+	stopTicker(conn.punch)
+	conn.punch = time.NewTicker(PunchInterval)
+	conn.sendPunches()
+}
+
+func (conn *LocalConnection) sendPunches() {
+	if conn.established || conn.sendingOverTCP || time.Now().After(conn.punchDeadline) {
+		stopTicker(conn.punch)
+		conn.punch = nil
+		return
+	}
+	for _, candidate := range conn.punchCandidates {
+		// Candidates we can't send to are simply no good
+		conn.Router.UDPListener.WriteToUDP(formSTUN(stunBindingRequest, conn.punchTxID(), nil), candidate)
+	}
+}
+
+func (conn *LocalConnection) handlePunchedThrough(remoteUDPAddr *net.UDPAddr) error {
+	oldRemoteUDPAddr := conn.remoteUDPAddr
+	if conn.established || conn.sendingOverTCP ||
+		(oldRemoteUDPAddr != nil && oldRemoteUDPAddr.String() == remoteUDPAddr.String()) {
+		return nil
+	}
+	conn.logger(logNAT).Info("punched through to", remoteUDPAddr)
+	conn.Lock()
+	conn.remoteUDPAddr = remoteUDPAddr
+	conn.Unlock()
+	// The DF senders are tied to the old address, while the others go
+	// wherever the remote is. We keep the forwarders, and with them
+	// their encryptors' state, and start heartbeating afresh to the
+	// new address.
+	conn.retargetDF()
+	stopTicker(conn.heartbeat)
+	return conn.sendFastHeartbeats()
+}
+
+// Sending with DF takes a raw socket to the underlay IP of the remote.
+// Where we punched through to it at some other IP, or spread flows
+// over several, we do without.
+func (conn *LocalConnection) newUDPSenderDF(worker int) (UDPSender, error) {
+	if remoteUDPAddr := conn.RemoteUDPAddr(); conn.multiPath || remoteUDPAddr != nil && !remoteUDPAddr.IP.Equal(conn.underlayIP()) {
+		return newPathUDPSender(conn, worker)
+	}
+	return NewRawUDPSender(conn)
+}
@@ -0,0 +1,98 @@
+package router
+
+import (
+	"bytes"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+)
+
+func TestSTUNMessages(t *testing.T) {
+	var txID stunTxID
+	copy(txID[:], randBytes(len(txID)))
+	for _, addr := range []*net.UDPAddr{
+		{IP: net.ParseIP("203.0.113.7").To4(), Port: 40000},
+		{IP: net.ParseIP("2001:db8::7"), Port: 6783}} {
+		msg, ok := parseSTUN(formSTUN(stunBindingResponse, txID, addr))
+		if !ok {
+			wt.Fatalf(t, "Expected STUN message to parse")
+		}
+		if msg.msgType != stunBindingResponse || msg.txID != txID {
+			wt.Fatalf(t, "Wrong type or transaction: %v", msg)
+		}
+		if msg.mapped == nil || msg.mapped.String() != addr.String() {
+			wt.Fatalf(t, "Expected mapped address %s; got %v", addr, msg.mapped)
+		}
+	}
+	msg, ok := parseSTUN(formSTUN(stunBindingRequest, txID, nil))
+	if !ok || msg.msgType != stunBindingRequest || msg.mapped != nil {
+		wt.Fatalf(t, "Expected binding request without address; got %v", msg)
+	}
+	if _, ok := parseSTUN(make([]byte, 60)); ok {
+		wt.Fatalf(t, "Expected packet without magic cookie not to parse")
+	}
+}
+
+func TestSTUNServerResponse(t *testing.T) {
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	router := NewRouter(RouterConfig{}, name)
+	server := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 3478}
+	reflexive := &net.UDPAddr{IP: net.ParseIP("203.0.113.7").To4(), Port: 40000}
+	var txID stunTxID
+	copy(txID[:], randBytes(len(txID)))
+
+	// Responses to requests we didn't make are ignored
+	if !router.NAT.HandlePacket(formSTUN(stunBindingResponse, txID, reflexive), server) {
+		wt.Fatalf(t, "Expected STUN response to be handled")
+	}
+	wt.AssertEqualInt(t, len(router.NAT.reflexive), 0, "reflexive addresses")
+
+	router.NAT.queries[txID] = server.String()
+	router.NAT.HandlePacket(formSTUN(stunBindingResponse, txID, reflexive), server)
+	found := false
+	for _, candidate := range router.NAT.Candidates() {
+		found = found || candidate == reflexive.String()
+	}
+	if !found {
+		wt.Fatalf(t, "Expected reflexive address %s among candidates", reflexive)
+	}
+	candidates, err := decodeCandidates(encodeCandidates(router.NAT.Candidates()))
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(candidates), len(router.NAT.Candidates()), "decoded candidates")
+}
+
+// Punching through to the remote at another address retargets the
+// forwarders we have, so packets carry on from the nonces they reached.
+func TestPunchedThroughKeepsForwarders(t *testing.T) {
+	conn1, conn2, _, closeConn := newTestForwardingConn(t)
+	defer closeConn()
+	var remotes [2]*net.UDPConn
+	for i := range remotes {
+		remote, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		wt.AssertNoErr(t, err)
+		defer remote.Close()
+		remotes[i] = remote
+	}
+	conn1.remoteUDPAddr = remotes[0].LocalAddr().(*net.UDPAddr)
+	conn1.heartbeatFrame = &ForwardedFrame{srcPeer: conn1.local, dstPeer: conn1.remote, frame: make([]byte, EthernetOverhead), heartbeat: true}
+	dec := NewGCMDecryptor(conn2)
+
+	wt.AssertNoErr(t, conn1.sendFastHeartbeats())
+	defer conn1.stopForwarders()
+	before := receiveUDPPacket(t, remotes[0])
+	_, err := dec.decrypt(before)
+	wt.AssertNoErr(t, err)
+
+	forwardChans := conn1.forwardChansDF
+	wt.AssertNoErr(t, conn1.handlePunchedThrough(remotes[1].LocalAddr().(*net.UDPAddr)))
+	defer stopTicker(conn1.heartbeat)
+	if &conn1.forwardChansDF[0] != &forwardChans[0] {
+		wt.Fatalf(t, "Expected to keep the forwarders")
+	}
+	after := receiveUDPPacket(t, remotes[1])
+	if bytes.Equal(after[:gcmHeaderSize], before[:gcmHeaderSize]) {
+		wt.Fatalf(t, "Header repeated after punching through")
+	}
+	_, err = dec.decrypt(after)
+	wt.AssertNoErr(t, err)
+}
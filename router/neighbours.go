@@ -0,0 +1,319 @@
+package router
+
+import (
+	"bytes"
+	"code.google.com/p/gopacket"
+	"code.google.com/p/gopacket/layers"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// With ARP proxying, we answer ARP requests and IPv6 neighbour
+// solicitations from local hosts ourselves, when we know the MAC for
+// the address asked about, rather than flooding them to every peer.
+// Each peer learns the addresses of its local hosts from the ARP and
+// neighbour discovery messages they send, and tells all the others
+// by gossip, in a gossip table; see gossip_table.go.
+//
+// Requests for addresses of local hosts don't need answering, since
+// those hosts answer themselves, and don't need to go anywhere else
+// either. Requests we can't answer, and probes from hosts checking
+// nobody else has their address yet, get flooded as usual.
+//
+// Bindings of local hosts go when their MACs expire.
+
+type Neighbours struct {
+	*GossipTable
+	ourName PeerName
+}
+
+type peerNeighbours struct {
+	hosts map[string]string // IP, in its 16-byte form -> MAC
+}
+
+// What we gossip about each peer
+type PeerNeighbours struct {
+	Hosts map[string]string
+}
+
+func NewNeighbours(ourName PeerName) *Neighbours {
+	ns := &Neighbours{ourName: ourName}
+	ns.GossipTable = NewGossipTable(ourName, "neighbours", ns, &peerNeighbours{hosts: make(map[string]string)})
+	return ns
+}
+
+// The MAC of the host with the address, and the peer it's at. When
+// more than one peer claims the address, e.g. while a host moves
+// between them, we only trust a claim by ourself.
+func (ns *Neighbours) Lookup(ip net.IP) (net.HardwareAddr, PeerName, bool) {
+	key := string(ip.To16())
+	ns.RLock()
+	defer ns.RUnlock()
+	if mac, found := ns.Ours().(*peerNeighbours).hosts[key]; found {
+		return net.HardwareAddr(mac), ns.ourName, true
+	}
+	var (
+		mac       string
+		owner     PeerName
+		found     bool
+		ambiguous bool
+	)
+	ns.ForEach(func(name PeerName, entry interface{}) {
+		if entryMac, ok := entry.(*peerNeighbours).hosts[key]; ok {
+			ambiguous = found
+			mac, owner, found = entryMac, name, true
+		}
+	})
+	if ambiguous {
+		return nil, UnknownPeerName, false
+	}
+	return net.HardwareAddr(mac), owner, found
+}
+
+// Record that a local host has the address.
+func (ns *Neighbours) Learn(ip net.IP, host net.HardwareAddr) {
+	key := string(ip.To16())
+	ns.update(func(hosts map[string]string) bool {
+		if hosts[key] == string(host) {
+			return false
+		}
+		hosts[key] = string(host)
+		return true
+	})
+}
+
+// Forget all addresses of the host; for when its MAC expires.
+func (ns *Neighbours) ForgetHost(host net.HardwareAddr) {
+	ns.update(func(hosts map[string]string) bool {
+		changed := false
+		for ip, mac := range hosts {
+			if mac == string(host) {
+				delete(hosts, ip)
+				changed = true
+			}
+		}
+		return changed
+	})
+}
+
+// Apply a change to the bindings of our local hosts and, if there is
+// one, tell everyone.
+func (ns *Neighbours) update(change func(map[string]string) bool) {
+	ns.Update(func(ours interface{}) bool {
+		return change(ours.(*peerNeighbours).hosts)
+	})
+}
+
+func (ns *Neighbours) EncodeEntries(entries map[PeerName]interface{}) interface{} {
+	update := make(map[PeerName]PeerNeighbours, len(entries))
+	for name, entry := range entries {
+		peerHosts := entry.(*peerNeighbours).hosts
+		hosts := make(map[string]string, len(peerHosts))
+		for ip, mac := range peerHosts {
+			hosts[ip] = mac
+		}
+		update[name] = PeerNeighbours{Hosts: hosts}
+	}
+	return update
+}
+
+func (ns *Neighbours) DecodeEntries(decoder *gob.Decoder) (map[PeerName]interface{}, error) {
+	var update map[PeerName]PeerNeighbours
+	if err := decoder.Decode(&update); err != nil {
+		return nil, err
+	}
+	entries := make(map[PeerName]interface{}, len(update))
+	for name, received := range update {
+		entry := &peerNeighbours{hosts: received.Hosts}
+		if entry.hosts == nil {
+			entry.hosts = make(map[string]string)
+		}
+		entries[name] = entry
+	}
+	return entries, nil
+}
+
+func (ns *Neighbours) String() string {
+	var buf bytes.Buffer
+	ns.RLock()
+	defer ns.RUnlock()
+	ns.ForEach(func(name PeerName, entry interface{}) {
+		peerHosts := entry.(*peerNeighbours).hosts
+		if len(peerHosts) == 0 {
+			return
+		}
+		hosts := make([]string, 0, len(peerHosts))
+		for ip, mac := range peerHosts {
+			hosts = append(hosts, fmt.Sprint(net.IP(ip), "=", net.HardwareAddr(mac)))
+		}
+		sort.Strings(hosts)
+		buf.WriteString(fmt.Sprintln(name, "->", hosts))
+	})
+	return buf.String()
+}
+
+const (
+	arpRequest                = 1
+	arpReply                  = 2
+	ndpNeighborSolicitation   = 135
+	ndpNeighborAdvertisement  = 136
+	ndpTargetLinkLayerAddress = 2
+	ndpSolicitedOverride      = 0x60 // flags in a neighbour advertisement
+)
+
+// A request for the MAC of an address, or an announcement of one, from
+// an ARP or neighbour discovery message.
+type neighbourMessage struct {
+	request  bool
+	senderIP net.IP // nil when the sender has no address yet
+	targetIP net.IP
+}
+
+// Parse the frame as an ARP request or reply for IPv4 over ethernet,
+// or a neighbour solicitation or advertisement.
+func (dec *EthernetDecoder) NeighbourMessage() (*neighbourMessage, bool) {
+	switch {
+	case dec.IsARP():
+		arp := &dec.arp
+		if arp.AddrType != layers.LinkTypeEthernet || arp.Protocol != layers.EthernetTypeIPv4 ||
+			len(arp.SourceProtAddress) != net.IPv4len || len(arp.DstProtAddress) != net.IPv4len ||
+			(arp.Operation != arpRequest && arp.Operation != arpReply) {
+			return nil, false
+		}
+		msg := &neighbourMessage{request: arp.Operation == arpRequest, targetIP: net.IP(arp.DstProtAddress)}
+		if senderIP := net.IP(arp.SourceProtAddress); !senderIP.IsUnspecified() {
+			msg.senderIP = senderIP
+		}
+		return msg, true
+	case dec.IsIPv6() && dec.ip6.NextHeader == layers.IPProtocolICMPv6:
+		// Hosts only accept neighbour discovery messages which
+		// haven't crossed a router
+		payload := dec.ip6.Payload
+		if dec.ip6.HopLimit != 255 || len(payload) < 24 ||
+			(payload[0] != ndpNeighborSolicitation && payload[0] != ndpNeighborAdvertisement) {
+			return nil, false
+		}
+		msg := &neighbourMessage{request: payload[0] == ndpNeighborSolicitation, targetIP: net.IP(payload[8:24])}
+		if !dec.ip6.SrcIP.IsUnspecified() {
+			msg.senderIP = dec.ip6.SrcIP
+		}
+		return msg, true
+	}
+	return nil, false
+}
+
+// Learn the addresses of local hosts from their ARP and neighbour
+// discovery messages, and answer their requests for the MACs of
+// others where we can. Returns whether the frame needs to go no
+// further.
+func (router *Router) proxyNeighbours(dec *EthernetDecoder, injectFrame func([]byte) error) bool {
+	msg, ok := dec.NeighbourMessage()
+	if !ok {
+		return false
+	}
+	host := dec.eth.SrcMAC
+	if msg.senderIP != nil {
+		router.Neighbours.Learn(msg.senderIP, host)
+	}
+	if !msg.request {
+		// Advertisements are for the sender's own addresses
+		if !dec.IsARP() {
+			router.Neighbours.Learn(msg.targetIP, host)
+		}
+		return false
+	}
+	if msg.senderIP == nil || msg.targetIP.Equal(msg.senderIP) {
+		return false
+	}
+	mac, owner, found := router.Neighbours.Lookup(msg.targetIP)
+	if !found {
+		return false
+	}
+	if owner == router.Ourself.Name {
+		return true
+	}
+	peer, found := router.Peers.Fetch(owner)
+	if !found {
+		return false
+	}
+	if _, found := router.Routes.Unicast(owner); !found {
+		return false
+	}
+	// The answer comes from the target's MAC, so when we capture it
+	// we must know not to treat that MAC as local.
+	router.Tenants.Macs(dec.Tenant()).Enter(mac, peer)
+	var reply []byte
+	var err error
+	if dec.IsARP() {
+		reply, err = dec.formARPReply(mac)
+	} else {
+		reply, err = dec.formNeighborAdvertisement(mac, msg.targetIP)
+	}
+	if err == nil {
+		err = injectFrame(reply)
+	}
+	if err != nil {
+		logRouter.Warn("Unable to answer neighbour request from", host, "for", msg.targetIP, ":", err)
+		return false
+	}
+	router.LogFrame("Answered neighbour request", reply, nil)
+	return true
+}
+
+func (dec *EthernetDecoder) formARPReply(mac net.HardwareAddr) ([]byte, error) {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true}
+	err := gopacket.SerializeLayers(buf, opts,
+		&layers.Ethernet{
+			SrcMAC:       mac,
+			DstMAC:       dec.eth.SrcMAC,
+			EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			Operation:         arpReply,
+			SourceHwAddress:   mac,
+			SourceProtAddress: dec.arp.DstProtAddress,
+			DstHwAddress:      dec.arp.SourceHwAddress,
+			DstProtAddress:    dec.arp.SourceProtAddress})
+	if err != nil {
+		return []byte{}, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (dec *EthernetDecoder) formNeighborAdvertisement(mac net.HardwareAddr, target net.IP) ([]byte, error) {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true}
+	body := make([]byte, 4, 4+net.IPv6len+8)
+	binary.BigEndian.PutUint32(body, ndpSolicitedOverride<<24)
+	body = append(body, target.To16()...)
+	body = append(body, ndpTargetLinkLayerAddress, 1)
+	body = append(body, mac...)
+	payload := gopacket.Payload(body)
+	ip := &layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolICMPv6,
+		HopLimit:   255,
+		SrcIP:      target,
+		DstIP:      dec.ip6.SrcIP}
+	icmp := &layers.ICMPv6{TypeCode: ndpNeighborAdvertisement << 8}
+	icmp.SetNetworkLayerForChecksum(ip)
+	err := gopacket.SerializeLayers(buf, opts,
+		&layers.Ethernet{
+			SrcMAC:       mac,
+			DstMAC:       dec.eth.SrcMAC,
+			EthernetType: layers.EthernetTypeIPv6},
+		ip,
+		icmp,
+		&payload)
+	if err != nil {
+		return []byte{}, err
+	}
+	return buf.Bytes(), nil
+}
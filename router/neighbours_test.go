@@ -0,0 +1,111 @@
+package router
+
+import (
+	"code.google.com/p/gopacket"
+	"code.google.com/p/gopacket/layers"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+)
+
+func TestNeighboursGossip(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	name3, _ := PeerNameFromString("03:00:00:01:00:00")
+	ip := net.ParseIP("10.0.0.1")
+	host1, _ := net.ParseMAC("00:00:00:00:00:01")
+	host2, _ := net.ParseMAC("00:00:00:00:00:02")
+	ns1 := NewNeighbours(name1)
+	ns2 := NewNeighbours(name2)
+	ns3 := NewNeighbours(name3)
+
+	ns1.Learn(ip, host1)
+	update, err := ns2.OnGossip(ns1.Gossip())
+	wt.AssertNoErr(t, err)
+	if update == nil {
+		wt.Fatalf(t, "Expected new entry to be passed on")
+	}
+	update, err = ns2.OnGossip(ns1.Gossip())
+	wt.AssertNoErr(t, err)
+	if update != nil {
+		wt.Fatalf(t, "Expected nothing new")
+	}
+	mac, owner, found := ns2.Lookup(net.IPv4(10, 0, 0, 1).To4())
+	if !found || owner != name1 {
+		wt.Fatalf(t, "Expected address to be at peer 1")
+	}
+	wt.AssertEqualString(t, mac.String(), host1.String(), "MAC")
+
+	// A claim by another peer makes the address ambiguous, unless
+	// it's ours
+	ns3.Learn(ip, host2)
+	wt.AssertNoErr(t, ns2.OnGossipBroadcast(ns3.Gossip()))
+	if _, _, found := ns2.Lookup(ip); found {
+		wt.Fatalf(t, "Expected address claimed by two peers to be unknown")
+	}
+	wt.AssertNoErr(t, ns3.OnGossipBroadcast(ns1.Gossip()))
+	if _, owner, _ := ns3.Lookup(ip); owner != name3 {
+		wt.Fatalf(t, "Expected our own claim to win")
+	}
+
+	ns1.ForgetHost(host1)
+	wt.AssertNoErr(t, ns2.OnGossipBroadcast(ns1.Gossip()))
+	if _, owner, found := ns2.Lookup(ip); !found || owner != name3 {
+		wt.Fatalf(t, "Expected address to be at peer 3 after host left peer 1")
+	}
+}
+
+func TestARPReply(t *testing.T) {
+	dec := decodeTestFrame(t, &layers.ARP{AddrType: layers.LinkTypeEthernet, Protocol: layers.EthernetTypeIPv4,
+		Operation: arpRequest, SourceHwAddress: []byte{0, 0x11, 0x22, 0x33, 0x44, 0x55}, SourceProtAddress: []byte{10, 0, 0, 1},
+		DstHwAddress: make([]byte, 6), DstProtAddress: []byte{10, 0, 0, 2}}, layers.EthernetTypeARP, 0)
+	msg, ok := dec.NeighbourMessage()
+	if !ok || !msg.request {
+		wt.Fatalf(t, "Expected an ARP request")
+	}
+	wt.AssertEqualString(t, msg.senderIP.String(), "10.0.0.1", "sender address")
+	wt.AssertEqualString(t, msg.targetIP.String(), "10.0.0.2", "target address")
+
+	mac, _ := net.ParseMAC("00:00:00:00:00:02")
+	frame, err := dec.formARPReply(mac)
+	wt.AssertNoErr(t, err)
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	eth := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	wt.AssertEqualString(t, eth.DstMAC.String(), "00:11:22:33:44:55", "reply destination MAC")
+	arp, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if !ok {
+		wt.Fatalf(t, "Expected an ARP packet")
+	}
+	wt.AssertEqualInt(t, int(arp.Operation), arpReply, "ARP operation")
+	wt.AssertEqualString(t, net.HardwareAddr(arp.SourceHwAddress).String(), mac.String(), "answered MAC")
+	wt.AssertEqualString(t, net.IP(arp.SourceProtAddress).String(), "10.0.0.2", "answered address")
+	wt.AssertEqualString(t, net.IP(arp.DstProtAddress).String(), "10.0.0.1", "requester address")
+}
+
+func TestNeighborAdvertisement(t *testing.T) {
+	target := net.ParseIP("fd00::2")
+	dec := decodeTestFrame(t, &layers.IPv6{Version: 6, NextHeader: layers.IPProtocolICMPv6, HopLimit: 255,
+		SrcIP: net.ParseIP("fd00::1"), DstIP: net.ParseIP("ff02::1:ff00:2")}, layers.EthernetTypeIPv6, 24)
+	copy(dec.ip6.Payload, append([]byte{ndpNeighborSolicitation, 0, 0, 0, 0, 0, 0, 0}, target...))
+	msg, ok := dec.NeighbourMessage()
+	if !ok || !msg.request {
+		wt.Fatalf(t, "Expected a neighbour solicitation")
+	}
+	wt.AssertEqualString(t, msg.targetIP.String(), "fd00::2", "target address")
+
+	mac, _ := net.ParseMAC("00:00:00:00:00:02")
+	frame, err := dec.formNeighborAdvertisement(mac, msg.targetIP)
+	wt.AssertNoErr(t, err)
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	ip := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	wt.AssertEqualString(t, ip.SrcIP.String(), "fd00::2", "advertisement source")
+	wt.AssertEqualString(t, ip.DstIP.String(), "fd00::1", "advertisement destination")
+	icmp, ok := packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+	if !ok {
+		wt.Fatalf(t, "Expected an ICMPv6 packet")
+	}
+	wt.AssertEqualInt(t, int(icmp.TypeCode), ndpNeighborAdvertisement<<8, "ICMPv6 type/code")
+	body := icmp.Payload
+	wt.AssertEqualString(t, net.IP(body[4:20]).String(), "fd00::2", "advertised address")
+	wt.AssertEqualString(t, net.HardwareAddr(body[22:28]).String(), mac.String(), "advertised MAC")
+}
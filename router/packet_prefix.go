@@ -0,0 +1,43 @@
+package router
+
+import (
+	"encoding/binary"
+)
+
+// Packets between peers start with the name of the peer which sent
+// them, from which the UDP listener works out which connection they
+// belong to, wherever they came from. Between peers which both
+// support it, the name is followed by the UID of the connection, so
+// that packets of an earlier connection between the same peers, e.g.
+// from before one of them restarted, don't get taken for packets of
+// the current one. The source address of packets then doesn't matter
+// at all: when a packet of the connection decrypts fine but comes
+// from somewhere else than we thought the remote was, e.g. because a
+// NAT picked another port, that is where the remote is now, and we
+// send there from then on, without waiting for its next heartbeat.
+
+const ConnUIDSize = 8
+
+// What packets we send over the connection start with.
+func (conn *LocalConnection) packetPrefix() []byte {
+	if !conn.connUIDs {
+		return conn.local.NameByte
+	}
+	prefix := make([]byte, NameSize+ConnUIDSize)
+	copy(prefix, conn.local.NameByte)
+	binary.BigEndian.PutUint64(prefix[NameSize:], conn.uid)
+	return prefix
+}
+
+// Strip the connection UID off a packet received for the connection,
+// after the sender's name, returning false if the packet belongs to
+// another connection.
+func (conn *LocalConnection) stripConnUID(packet []byte) ([]byte, bool) {
+	if !conn.connUIDs {
+		return packet, true
+	}
+	if len(packet) < ConnUIDSize || binary.BigEndian.Uint64(packet) != conn.uid {
+		return nil, false
+	}
+	return packet[ConnUIDSize:], true
+}
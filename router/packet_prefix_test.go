@@ -0,0 +1,37 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+)
+
+func TestConnUIDs(t *testing.T) {
+	conn1, conn2 := newTestGCMConnPair()
+	conn1.connUIDs, conn2.connUIDs = true, true
+	conn1.uid, conn2.uid = 12345, 12345
+	enc := NewGCMEncryptor(conn1.packetPrefix(), conn1, false, 0)
+	frame := &ForwardedFrame{srcPeer: conn1.local, dstPeer: conn1.remote, frame: []byte("hello world")}
+	enc.AppendFrame(frame)
+	packet := enc.Bytes()
+	wt.AssertEqualString(t, string(packet[:NameSize]), string(conn1.local.NameByte), "sender name")
+
+	received := 0
+	rest, ok := conn2.stripConnUID(packet[NameSize:])
+	if !ok {
+		wt.Fatalf(t, "Expected packet to belong to the connection")
+	}
+	err := NewGCMDecryptor(conn2).IterateFrames(func(_ *LocalConnection, _ *net.UDPAddr, _, _ []byte, _ uint16, _ uint8, _ uint16, payload []byte) error {
+		wt.AssertEqualString(t, string(payload), string(frame.frame), "frame")
+		received++
+		return nil
+	}, &UDPPacket{Packet: rest})
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, received, 1, "frames received")
+
+	// Packets of a previous connection between the peers
+	conn2.uid = 54321
+	if _, ok := conn2.stripConnUID(packet[NameSize:]); ok {
+		wt.Fatalf(t, "Expected packet of another connection to be refused")
+	}
+}
@@ -0,0 +1,82 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Encrypted packets can be padded up to one of a set of sizes, so
+// that observers of the underlay learn less about the traffic from
+// the packet lengths.
+//
+// Where both peers support padding, the plaintext of every encrypted
+// packet in either direction ends with the length of the padding
+// before it, which may be zero. Each peer pads to the sizes it has
+// been configured with, if any; the receiver just strips the padding
+// off, whatever its length. Packets are never padded beyond what the
+// PMTU allows, and packets larger than the largest size stay as they
+// are.
+
+func newPlaintextEncryptor(conn *LocalConnection) *NonEncryptor {
+	prefix := []byte{}
+	if conn.compressed {
+		prefix = []byte{uncompressedFlag}
+	}
+	ne := NewNonEncryptor(prefix)
+	ne.padded = conn.padded
+	ne.compressed = conn.compressed
+	ne.tenants = conn.tenantTags
+	ne.hopLimits = conn.hopLimits
+	return ne
+}
+
+// Add that many bytes of padding to the packet being assembled.
+func (ne *NonEncryptor) Pad(n int) {
+	if !ne.padded || n <= 0 {
+		return
+	}
+	padding := ne.bufTail[:n]
+	for i := range padding {
+		padding[i] = 0
+	}
+	ne.bufTail = ne.bufTail[n:]
+	ne.buffered += n
+	ne.padding += n
+}
+
+func (conn *LocalConnection) stripPadding(plaintext []byte) ([]byte, error) {
+	if !conn.padded {
+		return plaintext, nil
+	}
+	if len(plaintext) < 2 {
+		return nil, PacketDecodingError{Desc: "too short for padding length"}
+	}
+	end := len(plaintext) - 2
+	padding := int(binary.BigEndian.Uint16(plaintext[end:]))
+	if padding > end {
+		return nil, PacketDecodingError{Desc: fmt.Sprintf("padding of %d octets exceeds packet", padding)}
+	}
+	return plaintext[:end-padding], nil
+}
+
+// The size to pad a packet of the given size up to: the smallest
+// bucket it fits in, but no more than max.
+func paddedLen(packetLen, max int, buckets []int) int {
+	for _, bucket := range buckets {
+		if bucket < packetLen {
+			continue
+		}
+		if bucket > max {
+			bucket = max
+		}
+		return bucket
+	}
+	return packetLen
+}
+
+func (fwd *Forwarder) pad() {
+	if len(fwd.padBuckets) > 0 {
+		packetLen := fwd.enc.TotalLen()
+		fwd.enc.Pad(paddedLen(packetLen, fwd.maxPayload, fwd.padBuckets) - packetLen)
+	}
+}
@@ -0,0 +1,43 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+)
+
+func TestPaddedLen(t *testing.T) {
+	buckets := []int{256, 512, 1024}
+	wt.AssertEqualInt(t, paddedLen(100, 1400, buckets), 256, "padded length")
+	wt.AssertEqualInt(t, paddedLen(256, 1400, buckets), 256, "padded length of exact fit")
+	wt.AssertEqualInt(t, paddedLen(600, 800, buckets), 800, "padded length capped by max")
+	wt.AssertEqualInt(t, paddedLen(1200, 1400, buckets), 1200, "padded length beyond largest bucket")
+}
+
+func TestPaddingRoundTrip(t *testing.T) {
+	conn1, conn2 := newTestGCMConnPair()
+	conn1.padded, conn2.padded = true, true
+	enc := NewGCMEncryptor(conn1.local.NameByte, conn1, false, 0)
+	dec := NewGCMDecryptor(conn2)
+	frame := &ForwardedFrame{srcPeer: conn1.local, dstPeer: conn1.remote, frame: []byte("hello world")}
+	for _, padding := range []int{0, 1, 300} {
+		enc.AppendFrame(frame)
+		enc.Pad(padding)
+		expectedLen := enc.PacketOverhead() + enc.FrameOverhead() + len(frame.frame) + padding
+		wt.AssertEqualInt(t, enc.TotalLen(), expectedLen, "encryptor length")
+		packet := enc.Bytes()
+		wt.AssertEqualInt(t, len(packet), expectedLen, "packet length")
+		received := 0
+		err := dec.IterateFrames(func(_ *LocalConnection, _ *net.UDPAddr, _, _ []byte, _ uint16, _ uint8, _ uint16, payload []byte) error {
+			wt.AssertEqualString(t, string(payload), string(frame.frame), "frame")
+			received++
+			return nil
+		}, &UDPPacket{Packet: Concat(packet[NameSize:])})
+		wt.AssertNoErr(t, err)
+		wt.AssertEqualInt(t, received, 1, "frames received")
+	}
+
+	if _, err := conn2.stripPadding([]byte{0, 0, 0, 5}); err == nil {
+		wt.Fatalf(t, "Expected error for padding exceeding packet")
+	}
+}
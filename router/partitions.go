@@ -0,0 +1,190 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Detection of the mesh splitting into partitions, and of partitions
+// merging again. Peers drop out of the topology as soon as we can't
+// reach them, which is also what a peer briefly disconnected, or slow
+// gossip, looks like. So we remember the peers we could no longer
+// reach, and only take the mesh to have split once one has stayed
+// unreachable for PartitionTimeout; when any of those becomes
+// reachable again, the partitions have merged. A peer stopped for good
+// looks the same as one cut off from us, so we forget unreachable
+// peers after PartitionMaxAge, or when asked to forget them.
+
+type Partitions struct {
+	sync.Mutex
+	unreachable map[PeerName]*unreachablePeer
+	reachable   []PeerName // our side, including ourself, as of the last check
+	splits      uint64
+	merges      uint64
+}
+
+type unreachablePeer struct {
+	since time.Time
+	split bool // whether it has been unreachable for PartitionTimeout
+}
+
+type PartitionStatus struct {
+	Reachable   []string // the peers on our side, including ourself
+	Unreachable []UnreachablePeerStatus
+	Splits      uint64 // times peers stayed unreachable long enough to count as a split
+	Merges      uint64 // times peers we had split from became reachable again
+}
+
+type UnreachablePeerStatus struct {
+	Name  string
+	Since time.Time
+	Split bool // false while it may only be slow to reconnect
+}
+
+func NewPartitions() *Partitions {
+	return &Partitions{unreachable: make(map[PeerName]*unreachablePeer)}
+}
+
+// Called when a peer goes from the topology, having become
+// unreachable.
+func (partitions *Partitions) Lost(name PeerName, now time.Time) {
+	partitions.Lock()
+	defer partitions.Unlock()
+	if _, found := partitions.unreachable[name]; !found {
+		partitions.unreachable[name] = &unreachablePeer{since: now}
+	}
+}
+
+func (partitions *Partitions) Forget(name PeerName) {
+	partitions.Lock()
+	defer partitions.Unlock()
+	delete(partitions.unreachable, name)
+}
+
+// Take note of which of the peers in the topology we can reach,
+// returning the peers which have now been unreachable for long enough
+// to count as a split, and those we had split from which are reachable
+// again.
+func (partitions *Partitions) update(now time.Time, known map[PeerName]bool) (split, merged []PeerName) {
+	partitions.Lock()
+	defer partitions.Unlock()
+	partitions.reachable = partitions.reachable[:0]
+	for name, reachable := range known {
+		peer, found := partitions.unreachable[name]
+		switch {
+		case reachable:
+			partitions.reachable = append(partitions.reachable, name)
+			if found {
+				if peer.split {
+					merged = append(merged, name)
+				}
+				delete(partitions.unreachable, name)
+			}
+		case !found:
+			partitions.unreachable[name] = &unreachablePeer{since: now}
+		}
+	}
+	for name, peer := range partitions.unreachable {
+		switch age := now.Sub(peer.since); {
+		case age >= PartitionMaxAge:
+			delete(partitions.unreachable, name)
+		case age >= PartitionTimeout && !peer.split:
+			peer.split = true
+			split = append(split, name)
+		}
+	}
+	if len(split) > 0 {
+		partitions.splits++
+	}
+	if len(merged) > 0 {
+		partitions.merges++
+	}
+	return split, merged
+}
+
+func (partitions *Partitions) Status() PartitionStatus {
+	partitions.Lock()
+	defer partitions.Unlock()
+	status := PartitionStatus{
+		Reachable:   peerNameStrings(partitions.reachable),
+		Unreachable: []UnreachablePeerStatus{},
+		Splits:      partitions.splits,
+		Merges:      partitions.merges}
+	for name, peer := range partitions.unreachable {
+		status.Unreachable = append(status.Unreachable, UnreachablePeerStatus{Name: name.String(), Since: peer.since, Split: peer.split})
+	}
+	sort.Sort(unreachableByName(status.Unreachable))
+	return status
+}
+
+// How many peers there are on our side and beyond a split
+func (partitions *Partitions) Counts() (reachable, split int) {
+	partitions.Lock()
+	defer partitions.Unlock()
+	for _, peer := range partitions.unreachable {
+		if peer.split {
+			split++
+		}
+	}
+	return len(partitions.reachable), split
+}
+
+func (partitions *Partitions) Empty() bool {
+	partitions.Lock()
+	defer partitions.Unlock()
+	return len(partitions.unreachable) == 0
+}
+
+func (partitions *Partitions) String() string {
+	status := partitions.Status()
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("%d peers reachable; split %d times, merged %d times\n", len(status.Reachable), status.Splits, status.Merges))
+	for _, peer := range status.Unreachable {
+		what := "unreachable"
+		if peer.Split {
+			what = "split from us"
+		}
+		buf.WriteString(fmt.Sprintf("%s %s for %v\n", peer.Name, what, time.Now().Sub(peer.Since)))
+	}
+	return buf.String()
+}
+
+type unreachableByName []UnreachablePeerStatus
+
+func (s unreachableByName) Len() int           { return len(s) }
+func (s unreachableByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s unreachableByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+func peerNameStrings(names []PeerName) []string {
+	strs := make([]string, len(names))
+	for i, name := range names {
+		strs[i] = name.String()
+	}
+	sort.Strings(strs)
+	return strs
+}
+
+func (router *Router) watchPartitions() {
+	for now := range time.Tick(PartitionCheck) {
+		known := make(map[PeerName]bool)
+		router.Peers.ForEach(func(name PeerName, _ *Peer) {
+			if name == router.Ourself.Name {
+				known[name] = true
+			} else {
+				_, known[name] = router.Routes.Unicast(name)
+			}
+		})
+		split, merged := router.Partitions.update(now, known)
+		if len(split) > 0 {
+			logRouter.Warn("Mesh split: unreachable for", PartitionTimeout, "-", peerNameStrings(split))
+			router.Events.Publish(Event{Type: EventMeshSplit, Peers: peerNameStrings(split)})
+		}
+		if len(merged) > 0 {
+			logRouter.Info("Mesh merged: reachable again -", peerNameStrings(merged))
+			router.Events.Publish(Event{Type: EventMeshMerged, Peers: peerNameStrings(merged)})
+		}
+	}
+}
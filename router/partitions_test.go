@@ -0,0 +1,53 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"testing"
+	"time"
+)
+
+func TestPartitions(t *testing.T) {
+	partitions := NewPartitions()
+	ourself, peer1, peer2 := PeerName(1), PeerName(2), PeerName(3)
+	now := time.Now()
+
+	split, merged := partitions.update(now, map[PeerName]bool{ourself: true, peer1: true, peer2: false})
+	wt.AssertEqualInt(t, len(split)+len(merged), 0, "splits and merges")
+	// peer1 goes from the topology
+	partitions.Lost(peer1, now.Add(time.Second))
+
+	// Briefly unreachable is no split
+	split, _ = partitions.update(now.Add(PartitionTimeout/2), map[PeerName]bool{ourself: true, peer2: false})
+	wt.AssertEqualInt(t, len(split), 0, "peers split")
+	split, _ = partitions.update(now.Add(PartitionTimeout), map[PeerName]bool{ourself: true, peer2: false})
+	if len(split) != 1 || split[0] != peer2 {
+		wt.Fatalf(t, "Expected a split from peer2, got %v", split)
+	}
+	split, _ = partitions.update(now.Add(PartitionTimeout+time.Second), map[PeerName]bool{ourself: true})
+	if len(split) != 1 || split[0] != peer1 {
+		wt.Fatalf(t, "Expected a split from peer1, got %v", split)
+	}
+	reachable, splitPeers := partitions.Counts()
+	wt.AssertEqualInt(t, reachable, 1, "reachable peers")
+	wt.AssertEqualInt(t, splitPeers, 2, "split peers")
+
+	_, merged = partitions.update(now.Add(2*PartitionTimeout), map[PeerName]bool{ourself: true, peer1: true})
+	if len(merged) != 1 || merged[0] != peer1 {
+		wt.Fatalf(t, "Expected a merge with peer1, got %v", merged)
+	}
+	partitions.Forget(peer2)
+	if !partitions.Empty() {
+		wt.Fatalf(t, "Expected no unreachable peers left")
+	}
+	status := partitions.Status()
+	wt.AssertEqualuint64(t, status.Splits, 2, "splits")
+	wt.AssertEqualuint64(t, status.Merges, 1, "merges")
+	wt.AssertEqualInt(t, len(status.Reachable), 2, "reachable peers")
+
+	// Unreachable peers are forgotten in the end
+	partitions.Lost(peer2, now)
+	partitions.update(now.Add(PartitionMaxAge), map[PeerName]bool{ourself: true})
+	if !partitions.Empty() {
+		wt.Fatalf(t, "Expected long unreachable peers to be forgotten")
+	}
+}
@@ -0,0 +1,186 @@
+package router
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Rotating the password without restarting.
+//
+// A new password gets installed on each router in turn, with a grace
+// period during which the router also still accepts the old one. In
+// the handshake, peers which support this exchange proofs of the
+// passwords they hold, and pick the newest one they share. Proofs are
+// hashes over the password and a key only the two peers know, so
+// they give nothing away to an observer.
+//
+// Installing a password also tells every connected peer, again with
+// a proof. A peer which finds it already has the new password, while
+// the connection still uses an old one, re-handshakes the connection,
+// so that it picks the new password. Connections get re-handshaken
+// one at a time, to avoid disrupting the network. Once the grace
+// period is up, connections still using the old password are shut
+// down.
+
+type Passwords struct {
+	current    []byte
+	previous   []byte // accepted until the grace period is up; nil when there is none
+	graceTimer *time.Timer
+}
+
+// The passwords we accept, newest first.
+func (router *Router) Passwords() [][]byte {
+	router.passwordLock.RLock()
+	defer router.passwordLock.RUnlock()
+	passwords := [][]byte{router.passwords.current}
+	if router.passwords.previous != nil {
+		passwords = append(passwords, router.passwords.previous)
+	}
+	return passwords
+}
+
+func (router *Router) UsingPassword() bool {
+	router.passwordLock.RLock()
+	defer router.passwordLock.RUnlock()
+	return len(router.passwords.current) > 0
+}
+
+// Install a new password, accepting the current one as well until the
+// grace period is up. Without a password to begin with, connections
+// aren't encrypted, which we can't change on the fly.
+func (router *Router) SetPassword(password []byte, grace time.Duration) error {
+	if len(password) == 0 {
+		return fmt.Errorf("password must not be empty")
+	}
+	router.passwordLock.Lock()
+	passwords := &router.passwords
+	if len(passwords.current) == 0 {
+		router.passwordLock.Unlock()
+		return fmt.Errorf("cannot set password when running without one")
+	}
+	if bytes.Equal(password, passwords.current) {
+		router.passwordLock.Unlock()
+		return nil
+	}
+	if passwords.graceTimer != nil {
+		passwords.graceTimer.Stop()
+	}
+	passwords.previous, passwords.current = passwords.current, password
+	passwords.graceTimer = time.AfterFunc(grace, router.endPasswordGrace)
+	router.passwordLock.Unlock()
+
+	logCrypto.Info("Installed new password, accepting the old one for", grace)
+	router.Ourself.ForEachConnection(func(_ PeerName, conn Connection) {
+		if localConn, ok := conn.(*LocalConnection); ok {
+			localConn.PasswordChanged()
+		}
+	})
+	return nil
+}
+
+func (router *Router) endPasswordGrace() {
+	router.passwordLock.Lock()
+	previous := router.passwords.previous
+	router.passwords.previous, router.passwords.graceTimer = nil, nil
+	router.passwordLock.Unlock()
+	if previous == nil {
+		return
+	}
+	logCrypto.Info("Old password no longer accepted")
+	router.Ourself.ForEachConnection(func(_ PeerName, conn Connection) {
+		if localConn, ok := conn.(*LocalConnection); ok && bytes.Equal(localConn.password, previous) {
+			localConn.Shutdown(fmt.Errorf("connection uses the old password"))
+		}
+	})
+}
+
+// Re-handshake the connections queued up, one at a time, leaving the
+// connection maker time to reconnect in between.
+func (router *Router) rehandshakeLoop() {
+	for conn := range router.rehandshakes {
+		conn.logger(logCrypto).Info("re-handshaking to take on the new password")
+		conn.Shutdown(fmt.Errorf("re-handshaking for the new password"))
+		time.Sleep(RehandshakeDelay)
+	}
+}
+
+// Proofs the peers exchange, to find out which passwords they share.
+func passwordProof(key *[32]byte, password []byte) string {
+	proof := sha256.Sum256(Concat([]byte("weave password proof"), key[:], password))
+	return hex.EncodeToString(proof[:])
+}
+
+// In the handshake, agree with the remote peer on the newest password
+// we share. The peer with the lower name gets its preference, should
+// we disagree on which is newest. Older peers only know the one
+// password.
+func (conn *LocalConnection) choosePassword(enc *gob.Encoder, dec *gob.Decoder, handshakeRecv map[string]string, remotePublic, private *[32]byte, remoteName PeerName) ([]byte, error) {
+	passwords := conn.Router.Passwords()
+	if handshakeRecv["PasswordRotation"] != fmt.Sprint(true) {
+		return passwords[0], nil
+	}
+	key := FormSessionKey(remotePublic, private, &[]byte{})
+	proofs := make([]string, len(passwords))
+	for i, password := range passwords {
+		proofs[i] = passwordProof(key, password)
+	}
+	if err := enc.Encode(map[string]string{"PasswordProofs": strings.Join(proofs, ",")}); err != nil {
+		return nil, err
+	}
+	proofsRecv := map[string]string{}
+	if err := dec.Decode(&proofsRecv); err != nil {
+		return nil, err
+	}
+	remoteProofs := strings.Split(proofsRecv["PasswordProofs"], ",")
+	if conn.local.Name < remoteName {
+		for i, proof := range proofs {
+			for _, remoteProof := range remoteProofs {
+				if proof == remoteProof {
+					return passwords[i], nil
+				}
+			}
+		}
+	} else {
+		for _, remoteProof := range remoteProofs {
+			for i, proof := range proofs {
+				if proof == remoteProof {
+					return passwords[i], nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("No password in common with remote")
+}
+
+// Async. Tell the remote peer about our new password.
+func (conn *LocalConnection) PasswordChanged() {
+	conn.sendQuery(CPasswordChanged, nil)
+}
+
+func (conn *LocalConnection) handlePasswordChanged() error {
+	if !conn.canRotatePassword {
+		return nil
+	}
+	proof := passwordProof(conn.SessionKey, conn.Router.Passwords()[0])
+	return conn.handleSendProtocolMsg(ProtocolMsg{ProtocolPasswordChanged, []byte(proof)})
+}
+
+// The remote peer has installed a new password. If it is the one we
+// use for new connections, and this connection uses another, it needs
+// re-handshaking.
+func (conn *LocalConnection) receivedPasswordChanged(payload []byte) {
+	current := conn.Router.Passwords()[0]
+	if bytes.Equal(conn.password, current) || passwordProof(conn.SessionKey, current) != string(payload) {
+		return
+	}
+	select {
+	case conn.Router.rehandshakes <- conn:
+	default:
+		conn.logger(logCrypto).Warn("too many connections awaiting re-handshake; not re-handshaking")
+	}
+}
@@ -0,0 +1,90 @@
+package router
+
+import (
+	"encoding/gob"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+	"time"
+)
+
+func passwordTestConn(t *testing.T, nameStr string, passwords ...string) *LocalConnection {
+	name, _ := PeerNameFromString(nameStr)
+	router := NewRouter(RouterConfig{Password: []byte(passwords[0])}, name)
+	for _, password := range passwords[1:] {
+		wt.AssertNoErr(t, router.SetPassword([]byte(password), time.Hour))
+	}
+	conn := &LocalConnection{Router: router}
+	conn.local = router.Ourself.Peer
+	return conn
+}
+
+// Run choosePassword on both ends of a TCP connection
+func choosePasswords(t *testing.T, conn1, conn2 *LocalConnection, rotation bool) (string, string, error, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	wt.AssertNoErr(t, err)
+	defer listener.Close()
+	tcpConn1, err := net.Dial("tcp", listener.Addr().String())
+	wt.AssertNoErr(t, err)
+	defer tcpConn1.Close()
+	tcpConn2, err := listener.Accept()
+	wt.AssertNoErr(t, err)
+	defer tcpConn2.Close()
+
+	public1, private1, _ := GenerateKeyPair()
+	public2, private2, _ := GenerateKeyPair()
+	recv := map[string]string{"PasswordRotation": "false"}
+	if rotation {
+		recv["PasswordRotation"] = "true"
+	}
+	type result struct {
+		password []byte
+		err      error
+	}
+	results := make(chan result)
+	go func() {
+		password, err := conn2.choosePassword(gob.NewEncoder(tcpConn2), gob.NewDecoder(tcpConn2), recv, public1, private2, conn1.local.Name)
+		results <- result{password, err}
+	}()
+	password1, err1 := conn1.choosePassword(gob.NewEncoder(tcpConn1), gob.NewDecoder(tcpConn1), recv, public2, private1, conn2.local.Name)
+	r := <-results
+	return string(password1), string(r.password), err1, r.err
+}
+
+func TestChoosePassword(t *testing.T) {
+	check := func(conn1, conn2 *LocalConnection, expected string) {
+		password1, password2, err1, err2 := choosePasswords(t, conn1, conn2, true)
+		wt.AssertNoErr(t, err1)
+		wt.AssertNoErr(t, err2)
+		wt.AssertEqualString(t, password1, expected, "password chosen")
+		wt.AssertEqualString(t, password2, expected, "password chosen by remote")
+	}
+	check(passwordTestConn(t, "01:00:00:01:00:00", "old", "new"), passwordTestConn(t, "02:00:00:01:00:00", "old"), "old")
+	check(passwordTestConn(t, "01:00:00:01:00:00", "old", "new"), passwordTestConn(t, "02:00:00:01:00:00", "new"), "new")
+	check(passwordTestConn(t, "01:00:00:01:00:00", "old", "new"), passwordTestConn(t, "02:00:00:01:00:00", "old", "new"), "new")
+	// Disagreeing on which is newest, the lower name wins
+	check(passwordTestConn(t, "01:00:00:01:00:00", "old", "new"), passwordTestConn(t, "02:00:00:01:00:00", "new", "old"), "new")
+
+	_, _, err1, err2 := choosePasswords(t, passwordTestConn(t, "01:00:00:01:00:00", "one"), passwordTestConn(t, "02:00:00:01:00:00", "other"), true)
+	if err1 == nil || err2 == nil {
+		wt.Fatalf(t, "Expected no password in common")
+	}
+
+	// Without rotation, there's only the current password
+	password1, _, err1, _ := choosePasswords(t, passwordTestConn(t, "01:00:00:01:00:00", "old", "new"), passwordTestConn(t, "02:00:00:01:00:00", "new"), false)
+	wt.AssertNoErr(t, err1)
+	wt.AssertEqualString(t, password1, "new", "password chosen without rotation")
+}
+
+func TestSetPassword(t *testing.T) {
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	if err := NewRouter(RouterConfig{}, name).SetPassword([]byte("new"), time.Hour); err == nil {
+		wt.Fatalf(t, "Expected error setting password when running without one")
+	}
+	router := NewRouter(RouterConfig{Password: []byte("old")}, name)
+	wt.AssertNoErr(t, router.SetPassword([]byte("new"), 10*time.Millisecond))
+	wt.AssertEqualInt(t, len(router.Passwords()), 2, "passwords during grace period")
+	wt.AssertEqualString(t, string(router.Passwords()[0]), "new", "current password")
+	time.Sleep(50 * time.Millisecond)
+	wt.AssertEqualInt(t, len(router.Passwords()), 1, "passwords after grace period")
+}
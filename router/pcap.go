@@ -69,6 +69,10 @@ func (pi *PcapIO) ReadPacket() (data []byte, err error) {
 	return
 }
 
+func (pi *PcapIO) SetCaptureFilter(filter *CaptureFilter) error {
+	return pi.handle.SetBPFFilter(filter.Expression())
+}
+
 func (po *PcapIO) WritePacket(data []byte) error {
 	return po.handle.WritePacketData(data)
 }
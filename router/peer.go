@@ -14,6 +14,7 @@ type Peer struct {
 	version       uint64
 	localRefCount uint64
 	connections   map[PeerName]Connection
+	relays        []PeerName // peers it only connects to, and has everyone else relay through
 }
 
 func NewPeer(name PeerName, uid uint64, version uint64) *Peer {
@@ -40,6 +41,19 @@ func (peer *Peer) Version() uint64 {
 	return peer.version
 }
 
+// The peers this peer has designated as relays; see relay.go
+func (peer *Peer) Relays() []PeerName {
+	peer.RLock()
+	defer peer.RUnlock()
+	return peer.relays
+}
+
+func (peer *Peer) SetRelays(relays []PeerName) {
+	peer.Lock()
+	defer peer.Unlock()
+	peer.relays = relays
+}
+
 func (peer *Peer) IncrementLocalRefCount() {
 	peer.Lock()
 	defer peer.Unlock()
@@ -0,0 +1,209 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Rules restricting which peers may connect to us, and we to them, by
+// their underlay address and their name. The first rule matching a
+// peer decides, and peers no rule matches are allowed, so a final
+// plain "deny" denies everyone not allowed. We check the address of
+// peers connecting to us as soon as we accept their connection, as far
+// as the rules can tell without the peer's name, and check everything
+// again in the handshake, once we know it. Changing the rules shuts
+// down the connections they no longer allow.
+
+type PeerACLRule struct {
+	hits  uint64 // peers matched, updated atomically; first, for alignment
+	Allow bool
+	Addr  *net.IPNet // nil for any
+	Peer  *PeerName  // nil for any
+}
+
+type PeerACL struct {
+	rejected uint64 // updated atomically; first, for alignment
+	sync.RWMutex
+	rules []*PeerACLRule
+}
+
+// Parse a rule of the form
+//
+//	allow|deny [addr=<cidr or address>] [peer=<name>]
+func ParsePeerACLRule(text string) (*PeerACLRule, error) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty peer rule")
+	}
+	rule := &PeerACLRule{}
+	switch fields[0] {
+	case "allow":
+		rule.Allow = true
+	case "deny":
+	default:
+		return nil, fmt.Errorf("peer rule %q doesn't start with allow or deny", text)
+	}
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid condition %q in peer rule %q", field, text)
+		}
+		var err error
+		switch kv[0] {
+		case "addr":
+			if ip := net.ParseIP(kv[1]); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 8*net.IPv4len
+				}
+				rule.Addr = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+			} else {
+				_, rule.Addr, err = net.ParseCIDR(kv[1])
+			}
+		case "peer":
+			var name PeerName
+			if name, err = PeerNameFromUserInput(kv[1]); err == nil {
+				rule.Peer = &name
+			}
+		default:
+			err = fmt.Errorf("unknown condition")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid condition %q in peer rule %q: %v", field, text, err)
+		}
+	}
+	return rule, nil
+}
+
+// Parse rules, one per line, skipping blank lines and comments
+// starting with #.
+func ParsePeerACLRules(text string) ([]*PeerACLRule, error) {
+	var rules []*PeerACLRule
+	for _, line := range strings.Split(text, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		rule, err := ParsePeerACLRule(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (rule *PeerACLRule) String() string {
+	fields := []string{"deny"}
+	if rule.Allow {
+		fields[0] = "allow"
+	}
+	if rule.Addr != nil {
+		fields = append(fields, fmt.Sprint("addr=", rule.Addr))
+	}
+	if rule.Peer != nil {
+		fields = append(fields, fmt.Sprint("peer=", *rule.Peer))
+	}
+	return strings.Join(fields, " ")
+}
+
+func NewPeerACL() *PeerACL {
+	return &PeerACL{}
+}
+
+func (acl *PeerACL) Empty() bool {
+	acl.RLock()
+	defer acl.RUnlock()
+	return len(acl.rules) == 0
+}
+
+func (acl *PeerACL) SetRules(rules []*PeerACLRule) {
+	acl.Lock()
+	defer acl.Unlock()
+	acl.rules = rules
+}
+
+func (acl *PeerACL) Rules() []*PeerACLRule {
+	acl.RLock()
+	defer acl.RUnlock()
+	return acl.rules
+}
+
+// The first rule matching a peer at the address, with the name if we
+// know it. Without the name, we can't get past rules with one, so
+// return nil as if no rule matched.
+func (acl *PeerACL) match(ip net.IP, name *PeerName) *PeerACLRule {
+	acl.RLock()
+	defer acl.RUnlock()
+	for _, rule := range acl.rules {
+		if rule.Addr != nil && !rule.Addr.Contains(ip) {
+			continue
+		}
+		if rule.Peer != nil && name == nil {
+			return nil
+		}
+		if rule.Peer != nil && *rule.Peer != *name {
+			continue
+		}
+		return rule
+	}
+	return nil
+}
+
+// Whether to let a peer at the address connect to us, as far as we can
+// tell before the handshake. We only count the peers we reject here,
+// since we check the others again in the handshake.
+func (acl *PeerACL) AllowAddr(ip net.IP) bool {
+	rule := acl.match(ip, nil)
+	if rule == nil || rule.Allow {
+		return true
+	}
+	atomic.AddUint64(&rule.hits, 1)
+	atomic.AddUint64(&acl.rejected, 1)
+	return false
+}
+
+// Whether to connect with the peer at the address.
+func (acl *PeerACL) Allow(ip net.IP, name PeerName) bool {
+	rule := acl.match(ip, &name)
+	if rule == nil {
+		return true
+	}
+	atomic.AddUint64(&rule.hits, 1)
+	if !rule.Allow {
+		atomic.AddUint64(&acl.rejected, 1)
+	}
+	return rule.Allow
+}
+
+func (acl *PeerACL) Rejected() uint64 {
+	return atomic.LoadUint64(&acl.rejected)
+}
+
+func (acl *PeerACL) String() string {
+	var buf bytes.Buffer
+	for _, rule := range acl.Rules() {
+		buf.WriteString(fmt.Sprintf("%s (%d peers)\n", rule, atomic.LoadUint64(&rule.hits)))
+	}
+	buf.WriteString(fmt.Sprintf("Rejected %d peers\n", acl.Rejected()))
+	return buf.String()
+}
+
+// Replace the peer rules, and shut down the connections they no longer
+// allow.
+func (router *Router) SetPeerACLRules(rules []*PeerACLRule) {
+	router.PeerACL.SetRules(rules)
+	router.Ourself.ForEachConnection(func(_ PeerName, conn Connection) {
+		localConn, ok := conn.(*LocalConnection)
+		if ok && !router.PeerACL.Allow(localConn.underlayIP(), localConn.remote.Name) {
+			localConn.logger(logConnection).Info("Peer rules no longer allow the peer at", localConn.underlayIP())
+			localConn.Shutdown(fmt.Errorf("denied by peer rules"))
+		}
+	})
+}
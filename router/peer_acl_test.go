@@ -0,0 +1,65 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+)
+
+func TestPeerACLRuleParsing(t *testing.T) {
+	for _, text := range []string{
+		"deny",
+		"allow addr=10.0.0.0/8",
+		"deny addr=10.1.2.3/32 peer=01:00:00:01:00:00",
+		"allow addr=fd00::/8",
+	} {
+		rule, err := ParsePeerACLRule(text)
+		wt.AssertNoErr(t, err)
+		wt.AssertEqualString(t, rule.String(), text, "rule")
+	}
+	rule, err := ParsePeerACLRule("allow addr=10.1.2.3")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, rule.String(), "allow addr=10.1.2.3/32", "rule")
+	for _, text := range []string{
+		"",
+		"permit",
+		"allow addr=10.0.0.0/33",
+		"deny peer=nonsense",
+		"deny port=22",
+	} {
+		if _, err := ParsePeerACLRule(text); err == nil {
+			wt.Fatalf(t, "Expected an error parsing %q", text)
+		}
+	}
+}
+
+func TestPeerACL(t *testing.T) {
+	acl := NewPeerACL()
+	peer1, _ := PeerNameFromString("01:00:00:01:00:00")
+	peer2, _ := PeerNameFromString("02:00:00:01:00:00")
+	inside, outside := net.ParseIP("10.0.0.1"), net.ParseIP("192.168.0.1")
+	if !acl.AllowAddr(outside) || !acl.Allow(outside, peer1) {
+		wt.Fatalf(t, "Expected peers to be allowed without rules")
+	}
+
+	rules, err := ParsePeerACLRules("deny peer=02:00:00:01:00:00 # bad peer\n\nallow addr=10.0.0.0/8\ndeny\n")
+	wt.AssertNoErr(t, err)
+	acl.SetRules(rules)
+	// Before the handshake, a rule with a name stops us deciding
+	if !acl.AllowAddr(outside) {
+		wt.Fatalf(t, "Expected a peer to be allowed before we know its name")
+	}
+	if !acl.Allow(inside, peer1) {
+		wt.Fatalf(t, "Expected an allowed peer to be allowed")
+	}
+	if acl.Allow(inside, peer2) || acl.Allow(outside, peer1) {
+		wt.Fatalf(t, "Expected denied peers to be denied")
+	}
+
+	acl.SetRules(rules[1:])
+	if acl.AllowAddr(outside) {
+		wt.Fatalf(t, "Expected a peer at a denied address to be denied before the handshake")
+	}
+	wt.AssertEqualuint64(t, acl.Rejected(), 3, "rejections")
+	wt.AssertEqualuint64(t, rules[2].hits, 2, "hits")
+}
@@ -0,0 +1,168 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The peers we know of, and the addresses we and others connect to
+// them on, kept in a file across restarts, so that a restarted router
+// reconnects to the mesh it was part of rather than only to the peers
+// given on the command line. We save the peers every PeerStoreInterval
+// when they have changed, and when stopping, writing a new file and
+// renaming it over the old one, so that a crash leaves either.
+
+type PeerStore struct {
+	sync.Mutex
+	path  string
+	saved []byte // what we last wrote, so we only write changes
+}
+
+type storedPeer struct {
+	Name      string
+	Addresses []string
+}
+
+type peerStoreState struct {
+	Peers []storedPeer
+}
+
+func NewPeerStore(path string) *PeerStore {
+	return &PeerStore{path: path}
+}
+
+// The addresses of the peers we knew, if any.
+func (store *PeerStore) Load() ([]string, error) {
+	data, err := ioutil.ReadFile(store.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var state peerStoreState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("Unable to parse peers in %s: %v", store.path, err)
+	}
+	store.Lock()
+	store.saved = data
+	store.Unlock()
+	var addresses []string
+	for _, peer := range state.Peers {
+		addresses = append(addresses, peer.Addresses...)
+	}
+	return addresses, nil
+}
+
+func (store *PeerStore) save(state peerStoreState) error {
+	store.Lock()
+	defer store.Unlock()
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil || string(data) == string(store.saved) {
+		return err
+	}
+	tmpPath := store.path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, store.path)
+	}
+	if err != nil {
+		return err
+	}
+	// Make the rename itself durable
+	if dir, err := os.Open(filepath.Dir(store.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	store.saved = data
+	return nil
+}
+
+// The peers other than ourself, with the addresses connections to
+// them go to, and those addresses with the standard port, since those
+// of connections the peers made are of ephemeral ports.
+func (router *Router) knownPeers() peerStoreState {
+	addresses := make(map[PeerName]map[string]bool)
+	add := func(name PeerName, address string) {
+		if name == router.Ourself.Name || address == "" {
+			return
+		}
+		if addresses[name] == nil {
+			addresses[name] = make(map[string]bool)
+		}
+		addresses[name][address] = true
+	}
+	router.Peers.ForEach(func(_ PeerName, peer *Peer) {
+		peer.ForEachConnection(func(remote PeerName, conn Connection) {
+			add(remote, conn.RemoteTCPAddr())
+			if host, _, err := net.SplitHostPort(conn.RemoteTCPAddr()); err == nil {
+				add(remote, NormalisePeerAddr(host))
+			}
+			// which may be a hostname rather than the address it
+			// resolved to
+			if localConn, ok := conn.(*LocalConnection); ok {
+				add(remote, localConn.targetAddr())
+			}
+		})
+	})
+	var state peerStoreState
+	for name, set := range addresses {
+		peer := storedPeer{Name: name.String()}
+		for address := range set {
+			peer.Addresses = append(peer.Addresses, address)
+		}
+		sort.Strings(peer.Addresses)
+		state.Peers = append(state.Peers, peer)
+	}
+	sort.Sort(storedPeersByName(state.Peers))
+	return state
+}
+
+type storedPeersByName []storedPeer
+
+func (peers storedPeersByName) Len() int           { return len(peers) }
+func (peers storedPeersByName) Swap(i, j int)      { peers[i], peers[j] = peers[j], peers[i] }
+func (peers storedPeersByName) Less(i, j int) bool { return peers[i].Name < peers[j].Name }
+
+func (router *Router) savePeers() {
+	// Until we have connected, there is nothing to save, and we would
+	// lose what we loaded.
+	if state := router.knownPeers(); len(state.Peers) > 0 {
+		if err := router.PeerStore.save(state); err != nil {
+			logRouter.Warn("Unable to save peers:", err)
+		}
+	}
+}
+
+// Reconnect to the peers we knew, and save them from time to time.
+func (router *Router) persistPeers() {
+	addresses, err := router.PeerStore.Load()
+	if err != nil {
+		logRouter.Warn(err)
+	}
+	if len(addresses) > 0 {
+		logRouter.Info("Reconnecting to", len(addresses), "addresses of peers we knew")
+	}
+	for _, address := range addresses {
+		router.ConnectionMaker.Remember(address)
+	}
+	for range time.Tick(PeerStoreInterval) {
+		router.savePeers()
+	}
+}
@@ -0,0 +1,45 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPeerStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weave-peers")
+	wt.AssertNoErr(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "peers.json")
+
+	store := NewPeerStore(path)
+	addresses, err := store.Load()
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(addresses), 0, "addresses without a file")
+
+	state := peerStoreState{Peers: []storedPeer{
+		{Name: "01:00:00:01:00:00", Addresses: []string{"10.0.0.1:6783"}},
+		{Name: "02:00:00:01:00:00", Addresses: []string{"10.0.0.2:6783", "host2:6783"}}}}
+	wt.AssertNoErr(t, store.save(state))
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		wt.Fatalf(t, "Expected no temporary file to be left behind")
+	}
+	addresses, err = NewPeerStore(path).Load()
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, strings.Join(addresses, " "), "10.0.0.1:6783 10.0.0.2:6783 host2:6783", "addresses")
+
+	// Saving the same again doesn't write anything
+	wt.AssertNoErr(t, os.Remove(path))
+	wt.AssertNoErr(t, store.save(state))
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		wt.Fatalf(t, "Expected unchanged peers not to be written")
+	}
+
+	wt.AssertNoErr(t, ioutil.WriteFile(path, []byte("nonsense"), 0600))
+	if _, err := NewPeerStore(path).Load(); err == nil {
+		wt.Fatalf(t, "Expected an error loading an invalid file")
+	}
+}
@@ -0,0 +1,198 @@
+package router
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// Mutual TLS for the connections between peers, where a shared
+// password isn't enough to go by. Each peer has a certificate of its
+// own, issued by a CA all peers trust, naming the peer in its common
+// name. Before the handshake, peers wrap their connection in TLS and
+// check the certificate of the remote against the CA bundle and an
+// optional CRL, which we read afresh every time, so that it can be
+// updated in place; the handshake then checks that the remote peer is
+// the one named. We check the certificates of connected peers again
+// every PeerCertRecheck, so that connections don't outlive the
+// certificates of their peers, nor their revocation.
+//
+// We dial peers by address rather than by name, so we check the
+// certificates ourselves rather than have TLS check them against a
+// host name. TLS protects the control channel; frames are encrypted as
+// usual if there is a password as well.
+
+type PeerTLS struct {
+	cert    tls.Certificate
+	cas     []*x509.Certificate // to check the signature of the CRL
+	roots   *x509.CertPool
+	crlFile string
+}
+
+// What the TLS connection runs over, for the likes of tcpRTT
+type peerTLSConn struct {
+	*tls.Conn
+	conn net.Conn
+}
+
+func NewPeerTLS(caFile, certFile, keyFile, crlFile string) (*PeerTLS, error) {
+	pt := &PeerTLS{roots: x509.NewCertPool(), crlFile: crlFile}
+	caPEM, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	for block, rest := pem.Decode(caPEM); block != nil; block, rest = pem.Decode(rest) {
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate in %s: %v", caFile, err)
+		}
+		pt.cas = append(pt.cas, ca)
+		pt.roots.AddCert(ca)
+	}
+	if len(pt.cas) == 0 {
+		return nil, fmt.Errorf("no CA certificates in %s", caFile)
+	}
+	if pt.cert, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(pt.cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	// Peers check the CRL on every connection, so it had better be
+	// fine to begin with.
+	crl, err := pt.loadCRL()
+	if err != nil {
+		return nil, err
+	}
+	if err := pt.check(leaf, crl); err != nil {
+		return nil, fmt.Errorf("our certificate: %v", err)
+	}
+	return pt, nil
+}
+
+// Wrap a connection in TLS, and check the remote's certificate,
+// returning it.
+func (pt *PeerTLS) wrap(conn net.Conn, client bool) (net.Conn, *x509.Certificate, error) {
+	config := &tls.Config{
+		Certificates:       []tls.Certificate{pt.cert},
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true, // we check certificates ourselves
+		ClientAuth:         tls.RequireAnyClientCert}
+	var tlsConn *tls.Conn
+	if client {
+		tlsConn = tls.Client(conn, config)
+	} else {
+		tlsConn = tls.Server(conn, config)
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, nil, err
+	}
+	cert, err := pt.verify(tlsConn.ConnectionState().PeerCertificates)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &peerTLSConn{tlsConn, conn}, cert, nil
+}
+
+func (pt *PeerTLS) verify(certs []*x509.Certificate) (*x509.Certificate, error) {
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("remote presented no certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         pt.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	if err != nil {
+		return nil, err
+	}
+	crl, err := pt.loadCRL()
+	if err != nil {
+		return nil, err
+	}
+	return certs[0], pt.check(certs[0], crl)
+}
+
+// The CRL, if we have one, once we have checked its signature and
+// that it is current.
+func (pt *PeerTLS) loadCRL() (*pkix.CertificateList, error) {
+	if pt.crlFile == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(pt.crlFile)
+	if err != nil {
+		return nil, err
+	}
+	crl, err := x509.ParseCRL(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CRL in %s: %v", pt.crlFile, err)
+	}
+	if crl.HasExpired(time.Now()) {
+		return nil, fmt.Errorf("CRL in %s expired at %v", pt.crlFile, crl.TBSCertList.NextUpdate)
+	}
+	for _, ca := range pt.cas {
+		if ca.CheckCRLSignature(crl) == nil {
+			return crl, nil
+		}
+	}
+	return nil, fmt.Errorf("CRL in %s is not signed by any of our CAs", pt.crlFile)
+}
+
+// Whether the certificate is current and not revoked; crl may be nil.
+func (pt *PeerTLS) check(cert *x509.Certificate, crl *pkix.CertificateList) error {
+	if now := time.Now(); now.After(cert.NotAfter) || now.Before(cert.NotBefore) {
+		return fmt.Errorf("certificate of %q is only valid from %v to %v", cert.Subject.CommonName, cert.NotBefore, cert.NotAfter)
+	}
+	if crl == nil {
+		return nil
+	}
+	for _, revoked := range crl.TBSCertList.RevokedCertificates {
+		if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return fmt.Errorf("certificate of %q has been revoked", cert.Subject.CommonName)
+		}
+	}
+	return nil
+}
+
+// Wrap the connection in TLS, if we use it, before the handshake.
+func (conn *LocalConnection) startTLS() error {
+	if conn.Router.PeerTLS == nil {
+		return nil
+	}
+	conn.extendReadDeadline()
+	tlsConn, cert, err := conn.Router.PeerTLS.wrap(conn.TCPConn, conn.outbound)
+	if err != nil {
+		return err
+	}
+	conn.TCPConn, conn.peerCert = tlsConn, cert
+	return nil
+}
+
+// Shut down the connections of peers whose certificates have expired
+// or been revoked since they connected.
+func (router *Router) recheckPeerCerts() {
+	for range time.Tick(PeerCertRecheck) {
+		crl, err := router.PeerTLS.loadCRL()
+		if err != nil {
+			logCrypto.Warn("Unable to check peer certificates for revocation:", err)
+		}
+		router.Ourself.ForEachConnection(func(_ PeerName, conn Connection) {
+			localConn, ok := conn.(*LocalConnection)
+			if !ok || localConn.peerCert == nil {
+				return
+			}
+			if err := router.PeerTLS.check(localConn.peerCert, crl); err != nil {
+				localConn.Shutdown(err)
+			}
+		})
+	}
+}
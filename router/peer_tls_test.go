@@ -0,0 +1,135 @@
+package router
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	wt "github.com/zettio/weave/testing"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	wt.AssertNoErr(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "weave CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	wt.AssertNoErr(t, err)
+	cert, err := x509.ParseCertificate(der)
+	wt.AssertNoErr(t, err)
+	return &testCA{cert, key, der}
+}
+
+// Write a certificate for the peer, and its key, returning their files.
+func (ca *testCA) issue(t *testing.T, dir, name string, serial int64) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	wt.AssertNoErr(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	wt.AssertNoErr(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	wt.AssertNoErr(t, err)
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, file, blockType string, der []byte) {
+	wt.AssertNoErr(t, ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+}
+
+func newTestPeerTLS(t *testing.T, ca *testCA, dir, name string, serial int64, crlFile string) *PeerTLS {
+	caFile := filepath.Join(dir, "ca.crt")
+	writePEM(t, caFile, "CERTIFICATE", ca.der)
+	certFile, keyFile := ca.issue(t, dir, name, serial)
+	pt, err := NewPeerTLS(caFile, certFile, keyFile, crlFile)
+	wt.AssertNoErr(t, err)
+	return pt
+}
+
+// Wrap both ends of a connection, returning the errors of each end.
+func tlsConnect(client, server *PeerTLS) (error, error) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	serverErr := make(chan error, 1)
+	go func() {
+		_, _, err := server.wrap(serverConn, false)
+		if err != nil {
+			serverConn.Close()
+		}
+		serverErr <- err
+	}()
+	_, _, err := client.wrap(clientConn, true)
+	if err != nil {
+		clientConn.Close()
+	}
+	return err, <-serverErr
+}
+
+func TestPeerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weave-tls")
+	wt.AssertNoErr(t, err)
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t)
+	crlFile := filepath.Join(dir, "ca.crl")
+	crl, err := ca.cert.CreateCRL(rand.Reader, ca.key,
+		[]pkix.RevokedCertificate{{SerialNumber: big.NewInt(4), RevocationTime: time.Now()}},
+		time.Now(), time.Now().Add(time.Hour))
+	wt.AssertNoErr(t, err)
+	writePEM(t, crlFile, "X509 CRL", crl)
+
+	peer1 := newTestPeerTLS(t, ca, dir, "01:00:00:01:00:00", 2, crlFile)
+	peer2 := newTestPeerTLS(t, ca, dir, "02:00:00:01:00:00", 3, crlFile)
+	clientErr, serverErr := tlsConnect(peer1, peer2)
+	wt.AssertNoErr(t, clientErr)
+	wt.AssertNoErr(t, serverErr)
+
+	// Peers without the CA's blessing don't get in, either way round
+	otherDir := filepath.Join(dir, "other")
+	wt.AssertNoErr(t, os.Mkdir(otherDir, 0700))
+	other := newTestPeerTLS(t, newTestCA(t), otherDir, "03:00:00:01:00:00", 2, "")
+	if _, serverErr := tlsConnect(other, peer1); serverErr == nil {
+		wt.Fatalf(t, "Expected a certificate from another CA to be rejected")
+	}
+	if clientErr, _ := tlsConnect(peer1, other); clientErr == nil {
+		wt.Fatalf(t, "Expected a certificate from another CA to be rejected")
+	}
+
+	// Nor do those with revoked certificates
+	certFile, keyFile := ca.issue(t, dir, "04:00:00:01:00:00", 4)
+	if _, err := NewPeerTLS(filepath.Join(dir, "ca.crt"), certFile, keyFile, crlFile); err == nil {
+		wt.Fatalf(t, "Expected a revoked certificate to be refused")
+	}
+	revoked := newTestPeerTLS(t, ca, dir, "04:00:00:01:00:00", 4, "")
+	if _, serverErr := tlsConnect(revoked, peer1); serverErr == nil {
+		wt.Fatalf(t, "Expected a revoked certificate to be rejected")
+	}
+}
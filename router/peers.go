@@ -12,7 +12,9 @@ type Peers struct {
 	sync.RWMutex
 	ourself *Peer
 	table   map[PeerName]*Peer
+	onAdd   func(*Peer)
 	onGC    func(*Peer)
+	limits  TopologyLimits
 }
 
 type UnknownPeerError struct {
@@ -23,10 +25,11 @@ type NameCollisionError struct {
 	Name PeerName
 }
 
-func NewPeers(ourself *Peer, onGC func(*Peer)) *Peers {
+func NewPeers(ourself *Peer, onAdd, onGC func(*Peer)) *Peers {
 	return &Peers{
 		ourself: ourself,
 		table:   make(map[PeerName]*Peer),
+		onAdd:   onAdd,
 		onGC:    onGC}
 }
 
@@ -45,6 +48,7 @@ func (peers *Peers) FetchWithDefault(peer *Peer) *Peer {
 	}
 	peers.table[peer.Name] = peer
 	peer.IncrementLocalRefCount()
+	peers.onAdd(peer)
 	return peer
 }
 
@@ -91,6 +95,11 @@ func (peers *Peers) ApplyUpdate(update []byte) ([]byte, error) {
 	for _, peerRemoved := range peers.garbageCollect() {
 		delete(newUpdate, peerRemoved.Name)
 	}
+	for name, newPeer := range newPeers {
+		if _, found := peers.table[name]; found {
+			peers.onAdd(newPeer)
+		}
+	}
 
 	// Don't need to hold peers lock any longer
 	peers.Unlock()
@@ -178,7 +187,7 @@ func (peers *Peers) decodeUpdate(update []byte) (newPeers map[PeerName]*Peer, de
 	decoder := gob.NewDecoder(updateBuf)
 
 	for {
-		nameByte, uid, version, connsBuf, decErr := decodePeerNoConns(decoder)
+		nameByte, uid, version, relays, connsBuf, decErr := decodePeerNoConns(decoder)
 		if decErr == io.EOF {
 			break
 		} else if decErr != nil {
@@ -187,6 +196,7 @@ func (peers *Peers) decodeUpdate(update []byte) (newPeers map[PeerName]*Peer, de
 		}
 		name := PeerNameFromBin(nameByte)
 		newPeer := NewPeer(name, uid, version)
+		newPeer.relays = relays
 		decodedUpdate = append(decodedUpdate, newPeer)
 		decodedConns = append(decodedConns, connsBuf)
 		existingPeer, found := peers.table[name]
@@ -198,8 +208,10 @@ func (peers *Peers) decodeUpdate(update []byte) (newPeers map[PeerName]*Peer, de
 		}
 	}
 
-	for _, connsBuf := range decodedConns {
+	connCounts := make([]int, len(decodedConns))
+	for i, connsBuf := range decodedConns {
 		decErr := connsIterator(connsBuf, func(remoteNameByte []byte, _ string, _ bool) {
+			connCounts[i]++
 			remoteName := PeerNameFromBin(remoteNameByte)
 			if _, found := newPeers[remoteName]; found {
 				return
@@ -218,6 +230,7 @@ func (peers *Peers) decodeUpdate(update []byte) (newPeers map[PeerName]*Peer, de
 			return
 		}
 	}
+	err = peers.limits.check(len(peers.table), len(newPeers), connCounts)
 	return
 }
 
@@ -247,6 +260,7 @@ func (peers *Peers) applyUpdate(decodedUpdate []*Peer, decodedConns [][]byte) ma
 		// the router.Peers, so there can be no race here.
 		conns := readConnsMap(peer, connsBuf, peers.table)
 		peer.SetVersionAndConnections(newPeer.Version(), conns)
+		peer.SetRelays(newPeer.relays)
 		newUpdate[name] = peer
 	}
 	return newUpdate
@@ -259,6 +273,11 @@ func (peer *Peer) encode(enc *gob.Encoder) {
 	checkFatal(enc.Encode(peer.NameByte))
 	checkFatal(enc.Encode(peer.UID))
 	checkFatal(enc.Encode(peer.version))
+	relays := make([][]byte, len(peer.relays))
+	for i, relay := range peer.relays {
+		relays[i] = relay.Bin()
+	}
+	checkFatal(enc.Encode(relays))
 
 	connsBuf := new(bytes.Buffer)
 	connsEnc := gob.NewEncoder(connsBuf)
@@ -271,7 +290,7 @@ func (peer *Peer) encode(enc *gob.Encoder) {
 	checkFatal(enc.Encode(connsBuf.Bytes()))
 }
 
-func decodePeerNoConns(dec *gob.Decoder) (nameByte []byte, uid uint64, version uint64, conns []byte, err error) {
+func decodePeerNoConns(dec *gob.Decoder) (nameByte []byte, uid uint64, version uint64, relays []PeerName, conns []byte, err error) {
 	if err = dec.Decode(&nameByte); err != nil {
 		return
 	}
@@ -281,6 +300,13 @@ func decodePeerNoConns(dec *gob.Decoder) (nameByte []byte, uid uint64, version u
 	if err = dec.Decode(&version); err != nil {
 		return
 	}
+	var relaysBytes [][]byte
+	if err = dec.Decode(&relaysBytes); err != nil {
+		return
+	}
+	for _, relayByte := range relaysBytes {
+		relays = append(relays, PeerNameFromBin(relayByte))
+	}
 	if err = dec.Decode(&conns); err != nil {
 		return
 	}
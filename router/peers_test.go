@@ -18,7 +18,7 @@ import (
 
 func newNode(name PeerName) (*Peer, *Peers) {
 	peer := NewPeer(name, 0, 0)
-	peers := NewPeers(peer, func(*Peer) {})
+	peers := NewPeers(peer, func(*Peer) {}, func(*Peer) {})
 	peers.FetchWithDefault(peer)
 	return peer, peers
 }
@@ -111,3 +111,36 @@ func TestPeersGarbageCollection(t *testing.T) {
 	ps1.DeleteTestConnection(p3)
 	checkPeerArray(t, ps1.GarbageCollect(), p3)
 }
+
+func TestTopologyLimits(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	name3, _ := PeerNameFromString("03:00:00:01:00:00")
+	_, peers1 := newNode(name1)
+	peer2, peers2 := newNode(name2)
+	peer3, _ := newNode(name3)
+	peers1.AddTestConnection(peer2)
+	peers2.AddTestConnection(peer3)
+	peers2.AddTestConnection(peers1.ourself)
+
+	// Peer 2's topology brings peer 3 into ours, and peer 2 has two connections
+	peers1.limits = TopologyLimits{Peers: 2}
+	if _, err := peers1.ApplyUpdate(peers2.EncodeAllPeers()); err == nil {
+		wt.Fatalf(t, "Expected update beyond peer limit to be rejected")
+	} else if _, ok := err.(TopologyLimitError); !ok {
+		wt.Fatalf(t, "Expected topology limit error; got %v", err)
+	}
+	if _, found := peers1.Fetch(name3); found {
+		wt.Fatalf(t, "Expected rejected update not to be applied")
+	}
+	peers1.limits = TopologyLimits{Connections: 1}
+	if _, err := peers1.ApplyUpdate(peers2.EncodeAllPeers()); err == nil {
+		wt.Fatalf(t, "Expected update beyond connection limit to be rejected")
+	}
+	peers1.limits = TopologyLimits{Peers: 3, Connections: 2}
+	_, err := peers1.ApplyUpdate(peers2.EncodeAllPeers())
+	wt.AssertNoErr(t, err)
+	if _, found := peers1.Fetch(name3); !found {
+		wt.Fatalf(t, "Expected update within limits to be applied")
+	}
+}
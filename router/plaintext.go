@@ -0,0 +1,121 @@
+package router
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Mixed mode. With a password, every connection authenticates the
+// remote peer with it, and encrypts the control channel with the
+// session key, as ever. Frames, however, may go between particular
+// peers unencrypted, e.g. those on a trusted LAN, to save the CPU
+// encryption takes, while those between sites stay encrypted. Each
+// peer lists the peers, by name or by the subnet of their underlay
+// address, it trusts so, and a connection only carries frames
+// unencrypted where the peers at both ends trust each other; where
+// either doesn't, or doesn't know about mixed mode, it encrypts them.
+//
+// The peers tell each other whether they trust the other with a proof
+// over the session key, after agreeing on it in the handshake, so
+// that nobody in between can talk them out of encrypting.
+
+type PlaintextPeers struct {
+	peers   map[PeerName]bool
+	subnets []*net.IPNet
+}
+
+// Parse a comma-separated list of peer names and CIDRs
+func ParsePlaintextPeers(spec string) (*PlaintextPeers, error) {
+	trusted := &PlaintextPeers{peers: make(map[PeerName]bool)}
+	if spec == "" {
+		return trusted, nil
+	}
+	for _, target := range strings.Split(spec, ",") {
+		if _, subnet, err := net.ParseCIDR(target); err == nil {
+			trusted.subnets = append(trusted.subnets, subnet)
+			continue
+		}
+		name, err := PeerNameFromUserInput(target)
+		if err != nil {
+			return nil, fmt.Errorf("%s is neither a peer name nor a CIDR", target)
+		}
+		trusted.peers[name] = true
+	}
+	return trusted, nil
+}
+
+// Whether to exchange frames unencrypted with the peer at the
+// underlay IP, should it agree.
+func (trusted *PlaintextPeers) Contains(name PeerName, ip net.IP) bool {
+	if trusted == nil {
+		return false
+	}
+	if trusted.peers[name] {
+		return true
+	}
+	for _, subnet := range trusted.subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (trusted *PlaintextPeers) Empty() bool {
+	return trusted == nil || len(trusted.peers)+len(trusted.subnets) == 0
+}
+
+func (trusted *PlaintextPeers) String() string {
+	var targets []string
+	for name := range trusted.peers {
+		targets = append(targets, name.String())
+	}
+	sort.Strings(targets)
+	for _, subnet := range trusted.subnets {
+		targets = append(targets, subnet.String())
+	}
+	var buf bytes.Buffer
+	for _, target := range targets {
+		buf.WriteString(fmt.Sprintln(target))
+	}
+	return buf.String()
+}
+
+// What a peer sends to show it trusts the remote, which only someone
+// with the session key can produce.
+func plaintextProof(key *[32]byte, senderName []byte) string {
+	proof := sha256.Sum256(Concat([]byte("weave plaintext proof"), key[:], senderName))
+	return hex.EncodeToString(proof[:])
+}
+
+// In the handshake, once we agreed on the session key, find out
+// whether both we and the remote peer trust each other enough to
+// exchange frames unencrypted.
+func (conn *LocalConnection) agreePlaintext(enc *gob.Encoder, dec *gob.Decoder, remoteName PeerName) (bool, error) {
+	trusted := conn.Router.Plaintext.Contains(remoteName, conn.underlayIP())
+	plaintextSend := map[string]string{}
+	if trusted {
+		plaintextSend["PlaintextProof"] = plaintextProof(conn.SessionKey, conn.local.NameByte)
+	}
+	if err := enc.Encode(plaintextSend); err != nil {
+		return false, err
+	}
+	plaintextRecv := map[string]string{}
+	if err := dec.Decode(&plaintextRecv); err != nil {
+		return false, err
+	}
+	proof, found := plaintextRecv["PlaintextProof"]
+	if !found {
+		return false, nil
+	}
+	if proof != plaintextProof(conn.SessionKey, remoteName.Bin()) {
+		return false, fmt.Errorf("Invalid plaintext proof from remote")
+	}
+	return trusted, nil
+}
@@ -0,0 +1,85 @@
+package router
+
+import (
+	"encoding/gob"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+)
+
+func TestPlaintextPeers(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	trusted, err := ParsePlaintextPeers("192.168.1.0/24," + name1.String())
+	wt.AssertNoErr(t, err)
+	if !trusted.Contains(name1, net.ParseIP("10.0.0.1")) || !trusted.Contains(name2, net.ParseIP("192.168.1.20")) {
+		wt.Fatalf(t, "Expected peers listed by name or subnet to be trusted")
+	}
+	if trusted.Contains(name2, net.ParseIP("10.0.0.1")) {
+		wt.Fatalf(t, "Expected other peers not to be trusted")
+	}
+	var none *PlaintextPeers
+	if none.Contains(name1, net.ParseIP("192.168.1.20")) || !none.Empty() {
+		wt.Fatalf(t, "Expected no peers to be trusted without a list")
+	}
+	if _, err := ParsePlaintextPeers("lan"); err == nil {
+		wt.Fatalf(t, "Expected an error parsing a list with neither a peer name nor a CIDR")
+	}
+}
+
+func TestPlaintextProof(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	key1, key2 := &[32]byte{1}, &[32]byte{2}
+	if plaintextProof(key1, name1.Bin()) == plaintextProof(key1, name2.Bin()) ||
+		plaintextProof(key1, name1.Bin()) == plaintextProof(key2, name1.Bin()) {
+		wt.Fatalf(t, "Expected proofs to depend on the session key and the sender")
+	}
+}
+
+// Two ends of a connection, over loopback TCP, agreeing on whether to
+// go unencrypted, by the peers they trust.
+func agreePlaintextPair(t *testing.T, trusted1, trusted2 string) (bool, bool) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	wt.AssertNoErr(t, err)
+	defer listener.Close()
+	tcpConn1, err := net.Dial("tcp", listener.Addr().String())
+	wt.AssertNoErr(t, err)
+	defer tcpConn1.Close()
+	tcpConn2, err := listener.Accept()
+	wt.AssertNoErr(t, err)
+	defer tcpConn2.Close()
+
+	newConn := func(name PeerName, trusted string, tcpConn net.Conn) *LocalConnection {
+		plaintext, err := ParsePlaintextPeers(trusted)
+		wt.AssertNoErr(t, err)
+		conn := &LocalConnection{Router: &Router{RouterConfig: RouterConfig{Plaintext: plaintext}},
+			TCPConn: tcpConn, SessionKey: &[32]byte{7}}
+		conn.local = NewPeer(name, 0, 0)
+		return conn
+	}
+	conn1, conn2 := newConn(name1, trusted1, tcpConn1), newConn(name2, trusted2, tcpConn2)
+	var plaintext2 bool
+	var err2 error
+	done := make(chan struct{})
+	go func() {
+		plaintext2, err2 = conn2.agreePlaintext(gob.NewEncoder(tcpConn2), gob.NewDecoder(tcpConn2), name1)
+		close(done)
+	}()
+	plaintext1, err := conn1.agreePlaintext(gob.NewEncoder(tcpConn1), gob.NewDecoder(tcpConn1), name2)
+	wt.AssertNoErr(t, err)
+	<-done
+	wt.AssertNoErr(t, err2)
+	return plaintext1, plaintext2
+}
+
+func TestAgreePlaintext(t *testing.T) {
+	if plaintext1, plaintext2 := agreePlaintextPair(t, "127.0.0.0/8", "01:00:00:01:00:00"); !plaintext1 || !plaintext2 {
+		wt.Fatalf(t, "Expected peers trusting each other to go unencrypted")
+	}
+	if plaintext1, plaintext2 := agreePlaintextPair(t, "127.0.0.0/8", ""); plaintext1 || plaintext2 {
+		wt.Fatalf(t, "Expected peers to encrypt unless both trust each other")
+	}
+}
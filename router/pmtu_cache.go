@@ -0,0 +1,70 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// The PMTU towards a peer is a property of the path to its underlay
+// IP, not of any particular connection. Remembering the PMTUs we have
+// verified lets new connections and reconnects to the same IP start
+// from the last known good value, rather than having to work their
+// way down from DefaultPMTU all over again.
+
+type PMTUCacheEntry struct {
+	pmtu     int
+	verified time.Time
+}
+
+type PMTUCache struct {
+	sync.RWMutex
+	table  map[string]*PMTUCacheEntry
+	maxAge time.Duration
+}
+
+func NewPMTUCache(maxAge time.Duration) *PMTUCache {
+	return &PMTUCache{
+		table:  make(map[string]*PMTUCacheEntry),
+		maxAge: maxAge}
+}
+
+func (cache *PMTUCache) Enter(ip net.IP, pmtu int) {
+	if cache.maxAge <= 0 {
+		return
+	}
+	cache.Lock()
+	defer cache.Unlock()
+	cache.table[ip.String()] = &PMTUCacheEntry{pmtu: pmtu, verified: time.Now()}
+}
+
+func (cache *PMTUCache) Lookup(ip net.IP) (int, bool) {
+	key := ip.String()
+	cache.RLock()
+	entry, found := cache.table[key]
+	cache.RUnlock()
+	if !found {
+		return 0, false
+	}
+	if time.Now().After(entry.verified.Add(cache.maxAge)) {
+		cache.Lock()
+		if cache.table[key] == entry {
+			delete(cache.table, key)
+		}
+		cache.Unlock()
+		return 0, false
+	}
+	return entry.pmtu, true
+}
+
+func (cache *PMTUCache) String() string {
+	var buf bytes.Buffer
+	cache.RLock()
+	defer cache.RUnlock()
+	for key, entry := range cache.table {
+		buf.WriteString(fmt.Sprintf("%s -> %d (%v)\n", key, entry.pmtu, entry.verified))
+	}
+	return buf.String()
+}
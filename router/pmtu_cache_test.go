@@ -0,0 +1,36 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPMTUCache(t *testing.T) {
+	const maxAge = 50 * time.Millisecond
+	cache := NewPMTUCache(maxAge)
+	ip := net.ParseIP("10.0.0.1")
+	if _, found := cache.Lookup(ip); found {
+		wt.Fatalf(t, "Unexpected PMTU in empty cache")
+	}
+	cache.Enter(ip, 1438)
+	pmtu, found := cache.Lookup(ip)
+	if !found {
+		wt.Fatalf(t, "Expected to find PMTU")
+	}
+	wt.AssertEqualInt(t, pmtu, 1438, "PMTU")
+	if _, found := cache.Lookup(net.ParseIP("10.0.0.2")); found {
+		wt.Fatalf(t, "Unexpected PMTU for other IP")
+	}
+	time.Sleep(2 * maxAge)
+	if _, found := cache.Lookup(ip); found {
+		wt.Fatalf(t, "Expected PMTU to have expired")
+	}
+
+	disabled := NewPMTUCache(0)
+	disabled.Enter(ip, 1438)
+	if _, found := disabled.Lookup(ip); found {
+		wt.Fatalf(t, "Unexpected PMTU in disabled cache")
+	}
+}
@@ -0,0 +1,123 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Where ICMP is filtered on the underlay, PMTU discovery can settle
+// on the wrong value. Overrides pin the effective PMTU of connections
+// to particular peers, or to peers in particular underlay subnets,
+// bypassing discovery altogether. An override for a peer takes
+// precedence over subnet ones, and of those the most specific wins.
+
+type pmtuSubnetOverride struct {
+	subnet *net.IPNet
+	pmtu   int
+}
+
+type PMTUOverrides struct {
+	sync.RWMutex
+	peers   map[PeerName]int
+	subnets []pmtuSubnetOverride
+}
+
+func NewPMTUOverrides() *PMTUOverrides {
+	return &PMTUOverrides{peers: make(map[PeerName]int)}
+}
+
+// Pin the effective PMTU for the target, which is either a peer name
+// or a CIDR. A PMTU of 0 removes the override.
+func (overrides *PMTUOverrides) Set(target string, pmtu int) error {
+	if pmtu != 0 && (pmtu < MinPinnedPMTU || pmtu > DefaultPMTU) {
+		return fmt.Errorf("PMTU %d for %s out of range %d-%d", pmtu, target, MinPinnedPMTU, DefaultPMTU)
+	}
+	overrides.Lock()
+	defer overrides.Unlock()
+	if _, subnet, err := net.ParseCIDR(target); err == nil {
+		for i, override := range overrides.subnets {
+			if override.subnet.String() == subnet.String() {
+				overrides.subnets = append(overrides.subnets[:i], overrides.subnets[i+1:]...)
+				break
+			}
+		}
+		if pmtu != 0 {
+			overrides.subnets = append(overrides.subnets, pmtuSubnetOverride{subnet, pmtu})
+		}
+		return nil
+	}
+	name, err := PeerNameFromUserInput(target)
+	if err != nil {
+		return fmt.Errorf("%s is neither a peer name nor a CIDR", target)
+	}
+	if pmtu == 0 {
+		delete(overrides.peers, name)
+	} else {
+		overrides.peers[name] = pmtu
+	}
+	return nil
+}
+
+// The pinned PMTU for the peer with the given underlay IP; 0 if none.
+func (overrides *PMTUOverrides) Lookup(name PeerName, ip net.IP) int {
+	overrides.RLock()
+	defer overrides.RUnlock()
+	if pmtu, found := overrides.peers[name]; found {
+		return pmtu
+	}
+	pmtu, bestPrefix := 0, -1
+	for _, override := range overrides.subnets {
+		if prefix, _ := override.subnet.Mask.Size(); prefix > bestPrefix && override.subnet.Contains(ip) {
+			pmtu, bestPrefix = override.pmtu, prefix
+		}
+	}
+	return pmtu
+}
+
+func (overrides *PMTUOverrides) String() string {
+	var buf bytes.Buffer
+	overrides.RLock()
+	defer overrides.RUnlock()
+	for name, pmtu := range overrides.peers {
+		buf.WriteString(fmt.Sprintf("%s -> %d\n", name, pmtu))
+	}
+	for _, override := range overrides.subnets {
+		buf.WriteString(fmt.Sprintf("%s -> %d\n", override.subnet, override.pmtu))
+	}
+	return buf.String()
+}
+
+// Change an override at runtime, applying it to existing connections.
+func (router *Router) SetPMTUOverride(target string, pmtu int) error {
+	if err := router.PMTUOverrides.Set(target, pmtu); err != nil {
+		return err
+	}
+	router.Ourself.ForEachConnection(func(_ PeerName, conn Connection) {
+		if localConn, ok := conn.(*LocalConnection); ok {
+			localConn.PinPMTU(router.PMTUOverrides.Lookup(localConn.remote.Name, localConn.underlayIP()))
+		}
+	})
+	return nil
+}
+
+func (conn *LocalConnection) underlayIP() net.IP {
+	return conn.TCPConn.RemoteAddr().(*net.TCPAddr).IP
+}
+
+// Async. Pin the effective PMTU of the connection, or with 0, go back
+// to discovering it.
+func (conn *LocalConnection) PinPMTU(pmtu int) {
+	conn.RLock()
+	pinPMTU := conn.pinPMTU
+	conn.RUnlock()
+	if pinPMTU == nil {
+		return
+	}
+	select {
+	case pinPMTU <- pmtu:
+	default:
+		conn.logger(logPMTU).Warn("Unable to pin PMTU to", pmtu, "- forwarder busy")
+	}
+}
@@ -0,0 +1,34 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+)
+
+func TestPMTUOverrides(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	ip := net.ParseIP("10.0.1.1")
+	overrides := NewPMTUOverrides()
+	wt.AssertEqualInt(t, overrides.Lookup(name1, ip), 0, "PMTU without overrides")
+
+	wt.AssertNoErr(t, overrides.Set("10.0.0.0/16", 1400))
+	wt.AssertNoErr(t, overrides.Set("10.0.1.0/24", 1300))
+	wt.AssertNoErr(t, overrides.Set(name1.String(), 1200))
+	wt.AssertEqualInt(t, overrides.Lookup(name1, ip), 1200, "PMTU pinned for peer")
+	wt.AssertEqualInt(t, overrides.Lookup(name2, ip), 1300, "PMTU pinned for most specific subnet")
+	wt.AssertEqualInt(t, overrides.Lookup(name2, net.ParseIP("10.0.2.1")), 1400, "PMTU pinned for subnet")
+	wt.AssertEqualInt(t, overrides.Lookup(name2, net.ParseIP("10.1.0.1")), 0, "PMTU outside subnets")
+
+	wt.AssertNoErr(t, overrides.Set("10.0.1.0/24", 0))
+	wt.AssertNoErr(t, overrides.Set(name1.String(), 0))
+	wt.AssertEqualInt(t, overrides.Lookup(name1, ip), 1400, "PMTU after removing overrides")
+
+	if overrides.Set("10.0.0.0/8", 100) == nil {
+		wt.Fatalf(t, "Expected too small PMTU to be rejected")
+	}
+	if overrides.Set("nonsense", 1400) == nil {
+		wt.Fatalf(t, "Expected invalid target to be rejected")
+	}
+}
@@ -0,0 +1,407 @@
+package router
+
+import (
+	"bytes"
+	"code.google.com/p/gopacket/layers"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Network policy: rules allowing or denying frames which arrive from
+// other peers for our local hosts, by the peer they come from, their
+// source MAC, their source and destination IP subnets, and their IP
+// protocol and TCP/UDP destination port. The first rule matching a
+// frame decides what happens to it, and frames no rule matches are
+// allowed, so a final plain "deny" denies everything not allowed.
+//
+// Each peer has local rules, which only apply to it, and all peers
+// share global rules, which they gossip, the most recently set winning.
+// Local rules come before global ones.
+//
+// With connection tracking, rules can also go by the state of the
+// connection frames belong to, e.g. allowing replies to connections
+// local hosts opened; see conntrack.go.
+//
+// Policy only applies to the frames we inject into the bridge; those
+// we relay on to other peers, including broadcasts, still reach them,
+// for their policy to decide on. IP fragments other than the first
+// carry no ports, and are no use to hosts without the first, so they
+// are always allowed. Frames peers send over the fast path bypass us,
+// and with it policy.
+
+type PolicyRule struct {
+	hits   uint64 // frames matched, updated atomically; first, for alignment
+	Allow  bool
+	Peer   *PeerName        // nil for any
+	SrcMAC net.HardwareAddr // nil for any
+	Src    *net.IPNet       // nil for any
+	Dst    *net.IPNet       // nil for any
+	Proto  int              // IP protocol number; -1 for any
+	Ports  [2]uint16        // range of TCP/UDP destination ports; 0-0 for any
+	States uint8            // bitmask of 1<<TrackedState; 0 for any
+}
+
+var policyProtos = map[string]int{"icmp": 1, "tcp": 6, "udp": 17, "icmpv6": 58}
+
+// Parse a rule of the form
+//
+//	allow|deny [peer=<name>] [mac=<mac>] [src=<cidr>] [dst=<cidr>]
+//	  [proto=tcp|udp|icmp|icmpv6|<number>] [port=<port>[-<port>]]
+//	  [state=new|established|related[,...]]
+//
+// where a port needs proto=tcp or proto=udp.
+func ParsePolicyRule(text string) (*PolicyRule, error) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty policy rule")
+	}
+	rule := &PolicyRule{Proto: -1}
+	switch fields[0] {
+	case "allow":
+		rule.Allow = true
+	case "deny":
+	default:
+		return nil, fmt.Errorf("policy rule %q doesn't start with allow or deny", text)
+	}
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid condition %q in policy rule %q", field, text)
+		}
+		var err error
+		switch kv[0] {
+		case "peer":
+			var name PeerName
+			if name, err = PeerNameFromUserInput(kv[1]); err == nil {
+				rule.Peer = &name
+			}
+		case "mac":
+			rule.SrcMAC, err = net.ParseMAC(kv[1])
+		case "src":
+			_, rule.Src, err = net.ParseCIDR(kv[1])
+		case "dst":
+			_, rule.Dst, err = net.ParseCIDR(kv[1])
+		case "proto":
+			if proto, found := policyProtos[kv[1]]; found {
+				rule.Proto = proto
+			} else if rule.Proto, err = strconv.Atoi(kv[1]); err == nil && (rule.Proto < 0 || rule.Proto > 255) {
+				err = fmt.Errorf("out of range")
+			}
+		case "port":
+			ports := strings.SplitN(kv[1], "-", 2)
+			for i := range rule.Ports {
+				var port uint64
+				if port, err = strconv.ParseUint(ports[i%len(ports)], 10, 16); err != nil {
+					break
+				}
+				rule.Ports[i] = uint16(port)
+			}
+			if err == nil && (rule.Ports[0] == 0 || rule.Ports[0] > rule.Ports[1]) {
+				err = fmt.Errorf("invalid range")
+			}
+		case "state":
+			for _, name := range strings.Split(kv[1], ",") {
+				var state TrackedState
+				if state, err = ParseTrackedState(name); err != nil {
+					break
+				}
+				rule.States |= 1 << state
+			}
+		default:
+			err = fmt.Errorf("unknown condition")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid condition %q in policy rule %q: %v", field, text, err)
+		}
+	}
+	if rule.Ports[0] != 0 && rule.Proto != 6 && rule.Proto != 17 {
+		return nil, fmt.Errorf("policy rule %q has a port but not proto=tcp or proto=udp", text)
+	}
+	return rule, nil
+}
+
+// Parse rules, one per line, skipping blank lines and comments
+// starting with #.
+func ParsePolicyRules(text string) ([]*PolicyRule, error) {
+	var rules []*PolicyRule
+	for _, line := range strings.Split(text, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		rule, err := ParsePolicyRule(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (rule *PolicyRule) String() string {
+	fields := []string{"deny"}
+	if rule.Allow {
+		fields[0] = "allow"
+	}
+	if rule.Peer != nil {
+		fields = append(fields, fmt.Sprint("peer=", *rule.Peer))
+	}
+	if rule.SrcMAC != nil {
+		fields = append(fields, fmt.Sprint("mac=", rule.SrcMAC))
+	}
+	if rule.Src != nil {
+		fields = append(fields, fmt.Sprint("src=", rule.Src))
+	}
+	if rule.Dst != nil {
+		fields = append(fields, fmt.Sprint("dst=", rule.Dst))
+	}
+	if rule.Proto >= 0 {
+		proto := strconv.Itoa(rule.Proto)
+		for name, number := range policyProtos {
+			if number == rule.Proto {
+				proto = name
+			}
+		}
+		fields = append(fields, "proto="+proto)
+	}
+	if rule.Ports[0] == rule.Ports[1] && rule.Ports[0] != 0 {
+		fields = append(fields, fmt.Sprint("port=", rule.Ports[0]))
+	} else if rule.Ports[0] != 0 {
+		fields = append(fields, fmt.Sprintf("port=%d-%d", rule.Ports[0], rule.Ports[1]))
+	}
+	if rule.States != 0 {
+		var states []string
+		for _, state := range []TrackedState{TrackedNew, TrackedEstablished, TrackedRelated} {
+			if rule.States&(1<<state) != 0 {
+				states = append(states, state.String())
+			}
+		}
+		fields = append(fields, "state="+strings.Join(states, ","))
+	}
+	return strings.Join(fields, " ")
+}
+
+// The parts of a frame rules look at
+type policyFrame struct {
+	srcPeer  PeerName
+	srcMAC   net.HardwareAddr
+	srcIP    net.IP // nil if not IP
+	dstIP    net.IP
+	proto    int
+	port     uint16 // 0 if not TCP or UDP
+	fragment bool   // not the first fragment of a packet
+	state    TrackedState
+}
+
+func (dec *EthernetDecoder) policyFrame(srcPeer PeerName) policyFrame {
+	frame := policyFrame{srcPeer: srcPeer, srcMAC: dec.eth.SrcMAC, proto: -1, state: dec.state}
+	var payload []byte
+	switch {
+	case dec.IsIPv4():
+		frame.srcIP, frame.dstIP, frame.proto = dec.ip.SrcIP, dec.ip.DstIP, int(dec.ip.Protocol)
+		frame.fragment = dec.ip.FragOffset != 0
+		payload = dec.ip.Payload
+	case dec.IsIPv6():
+		frame.srcIP, frame.dstIP, frame.proto = dec.ip6.SrcIP, dec.ip6.DstIP, int(dec.ip6.NextHeader)
+		payload = dec.ip6.Payload
+	}
+	if !frame.fragment && (frame.proto == int(layers.IPProtocolTCP) || frame.proto == int(layers.IPProtocolUDP)) && len(payload) >= 4 {
+		frame.port = binary.BigEndian.Uint16(payload[2:4])
+	}
+	return frame
+}
+
+func (rule *PolicyRule) matches(frame *policyFrame) bool {
+	switch {
+	case rule.Peer != nil && *rule.Peer != frame.srcPeer:
+	case rule.SrcMAC != nil && !bytes.Equal(rule.SrcMAC, frame.srcMAC):
+	case rule.Src != nil && (frame.srcIP == nil || !rule.Src.Contains(frame.srcIP)):
+	case rule.Dst != nil && (frame.dstIP == nil || !rule.Dst.Contains(frame.dstIP)):
+	case rule.Proto >= 0 && rule.Proto != frame.proto:
+	case rule.Ports[0] != 0 && (frame.port < rule.Ports[0] || frame.port > rule.Ports[1]):
+	case rule.States != 0 && rule.States&(1<<frame.state) == 0:
+	default:
+		return true
+	}
+	return false
+}
+
+type Policy struct {
+	denied uint64 // updated atomically; first, for alignment
+	sync.RWMutex
+	ourName PeerName
+	gossip  Gossip
+	local   []*PolicyRule
+	global  globalPolicy
+}
+
+type globalPolicy struct {
+	version uint64
+	origin  PeerName // the peer which set the rules
+	rules   []*PolicyRule
+}
+
+// What we gossip about the global rules
+type GlobalPolicy struct {
+	Version uint64
+	Origin  PeerName
+	Rules   []string
+}
+
+func NewPolicy(ourName PeerName) *Policy {
+	return &Policy{ourName: ourName, global: globalPolicy{origin: ourName}}
+}
+
+func (policy *Policy) Empty() bool {
+	policy.RLock()
+	defer policy.RUnlock()
+	return len(policy.local) == 0 && len(policy.global.rules) == 0
+}
+
+// Whether to inject the frame, from the peer, into the bridge.
+func (policy *Policy) Allow(srcPeer PeerName, dec *EthernetDecoder) bool {
+	policy.RLock()
+	defer policy.RUnlock()
+	if len(policy.local) == 0 && len(policy.global.rules) == 0 {
+		return true
+	}
+	frame := dec.policyFrame(srcPeer)
+	if frame.fragment {
+		return true
+	}
+	for _, rules := range [][]*PolicyRule{policy.local, policy.global.rules} {
+		for _, rule := range rules {
+			if rule.matches(&frame) {
+				atomic.AddUint64(&rule.hits, 1)
+				if !rule.Allow {
+					atomic.AddUint64(&policy.denied, 1)
+				}
+				return rule.Allow
+			}
+		}
+	}
+	return true
+}
+
+func (policy *Policy) SetLocalRules(rules []*PolicyRule) {
+	policy.Lock()
+	defer policy.Unlock()
+	policy.local = rules
+}
+
+// Replace the global rules, and tell everyone.
+func (policy *Policy) SetGlobalRules(rules []*PolicyRule) {
+	policy.Lock()
+	policy.global = globalPolicy{version: NextGossipVersion(policy.global.version), origin: policy.ourName, rules: rules}
+	update := policy.global.encode()
+	gossip := policy.gossip
+	policy.Unlock()
+	if gossip != nil {
+		checkWarn(gossip.GossipBroadcast(update))
+	}
+}
+
+func (policy *Policy) LocalRules() []*PolicyRule {
+	policy.RLock()
+	defer policy.RUnlock()
+	return policy.local
+}
+
+func (policy *Policy) GlobalRules() []*PolicyRule {
+	policy.RLock()
+	defer policy.RUnlock()
+	return policy.global.rules
+}
+
+func (policy *Policy) OnGossipUnicast(sender PeerName, msg []byte) error {
+	return fmt.Errorf("unexpected policy gossip unicast from %s", sender)
+}
+
+func (policy *Policy) OnGossipBroadcast(msg []byte) error {
+	_, err := policy.merge(msg)
+	return err
+}
+
+func (policy *Policy) Gossip() []byte {
+	policy.RLock()
+	defer policy.RUnlock()
+	return policy.global.encode()
+}
+
+func (policy *Policy) OnGossip(buf []byte) ([]byte, error) {
+	if changed, err := policy.merge(buf); err != nil || !changed {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Take on the global rules if they were set more recently than ours,
+// or at the same time by a peer with a lower name, returning whether
+// we did. Peers which never set any gossip version 0. Unlike the
+// entries of a gossip table (see gossip_table.go), the rules belong to
+// no peer in particular, and outlive the one which set them leaving or
+// restarting.
+func (policy *Policy) merge(buf []byte) (bool, error) {
+	var received GlobalPolicy
+	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&received); err != nil {
+		return false, err
+	}
+	rules := make([]*PolicyRule, 0, len(received.Rules))
+	for _, text := range received.Rules {
+		rule, err := ParsePolicyRule(text)
+		if err != nil {
+			return false, err
+		}
+		rules = append(rules, rule)
+	}
+	policy.Lock()
+	defer policy.Unlock()
+	if received.Version == 0 || received.Version < policy.global.version ||
+		(received.Version == policy.global.version && received.Origin >= policy.global.origin) {
+		return false, nil
+	}
+	policy.global = globalPolicy{version: received.Version, origin: received.Origin, rules: rules}
+	logRouter.Info("Took on", len(rules), "global policy rules from", received.Origin)
+	return true, nil
+}
+
+func (global *globalPolicy) encode() []byte {
+	update := GlobalPolicy{Version: global.version, Origin: global.origin, Rules: make([]string, len(global.rules))}
+	for i, rule := range global.rules {
+		update.Rules[i] = rule.String()
+	}
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(update); err != nil {
+		log.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func (policy *Policy) String() string {
+	var buf bytes.Buffer
+	policy.RLock()
+	defer policy.RUnlock()
+	writeRules := func(title string, rules []*PolicyRule) {
+		buf.WriteString(fmt.Sprintf("%s:\n", title))
+		for _, rule := range rules {
+			buf.WriteString(fmt.Sprintf("%s (%d frames)\n", rule, atomic.LoadUint64(&rule.hits)))
+		}
+	}
+	writeRules("Local rules", policy.local)
+	if len(policy.global.rules) > 0 {
+		writeRules(fmt.Sprint("Global rules, set by ", policy.global.origin), policy.global.rules)
+	} else {
+		writeRules("Global rules", nil)
+	}
+	buf.WriteString(fmt.Sprintf("Denied %d frames\n", atomic.LoadUint64(&policy.denied)))
+	return buf.String()
+}
@@ -0,0 +1,124 @@
+package router
+
+import (
+	"code.google.com/p/gopacket/layers"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+)
+
+func policyTestFrame(t *testing.T, src string, proto layers.IPProtocol, port uint16) *EthernetDecoder {
+	dec := decodeTestFrame(t, &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: proto,
+		SrcIP: net.ParseIP(src), DstIP: net.ParseIP("10.0.0.2")}, layers.EthernetTypeIPv4, 20)
+	dec.ip.Payload = []byte{0x80, 0, byte(port >> 8), byte(port), 0, 20, 0, 0}
+	return dec
+}
+
+func TestPolicyRuleParsing(t *testing.T) {
+	for _, text := range []string{
+		"deny",
+		"allow peer=01:00:00:01:00:00 mac=00:11:22:33:44:55",
+		"allow src=10.0.0.0/8 dst=10.1.0.0/16 proto=icmp",
+		"deny proto=tcp port=22",
+		"allow proto=udp port=8000-8100",
+		"deny proto=47",
+		"allow proto=tcp state=established,related",
+	} {
+		rule, err := ParsePolicyRule(text)
+		wt.AssertNoErr(t, err)
+		wt.AssertEqualString(t, rule.String(), text, "rule")
+	}
+	for _, text := range []string{
+		"",
+		"permit",
+		"allow port=22",
+		"allow proto=tcp port=100-99",
+		"deny src=10.0.0.0",
+		"deny proto=300",
+		"deny colour=blue",
+		"allow state=closed",
+	} {
+		if _, err := ParsePolicyRule(text); err == nil {
+			wt.Fatalf(t, "Expected an error parsing %q", text)
+		}
+	}
+	rules, err := ParsePolicyRules("# comment\n\nallow proto=tcp port=80 # web\ndeny\n")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(rules), 2, "rules")
+}
+
+func TestPolicyAllow(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	policy := NewPolicy(name1)
+	web := policyTestFrame(t, "10.0.0.1", layers.IPProtocolTCP, 80)
+	ssh := policyTestFrame(t, "10.0.0.1", layers.IPProtocolTCP, 22)
+	dns := policyTestFrame(t, "10.9.0.1", layers.IPProtocolUDP, 53)
+	if !policy.Allow(name2, ssh) {
+		wt.Fatalf(t, "Expected everything to be allowed without rules")
+	}
+
+	global, err := ParsePolicyRules("allow proto=tcp port=80\nallow src=10.9.0.0/16\ndeny")
+	wt.AssertNoErr(t, err)
+	policy.SetGlobalRules(global)
+	if !policy.Allow(name2, web) || !policy.Allow(name2, dns) {
+		wt.Fatalf(t, "Expected allowed frames to be allowed")
+	}
+	if policy.Allow(name2, ssh) {
+		wt.Fatalf(t, "Expected other frames to be denied")
+	}
+
+	// Local rules come first
+	local, err := ParsePolicyRules("allow peer=02:00:00:01:00:00 proto=tcp port=22\ndeny src=10.9.0.0/16")
+	wt.AssertNoErr(t, err)
+	policy.SetLocalRules(local)
+	if !policy.Allow(name2, ssh) || policy.Allow(name1, ssh) {
+		wt.Fatalf(t, "Expected ssh to be allowed from peer 2 only")
+	}
+	if policy.Allow(name2, dns) {
+		wt.Fatalf(t, "Expected local rule to override global one")
+	}
+
+	// Later fragments are left to the first
+	ssh.ip.FragOffset = 10
+	if !policy.Allow(name1, ssh) {
+		wt.Fatalf(t, "Expected later fragment to be allowed")
+	}
+}
+
+func TestPolicyGossip(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	policy1 := NewPolicy(name1)
+	policy2 := NewPolicy(name2)
+
+	// Nothing to take on from peers which never set rules
+	update, err := policy2.OnGossip(policy1.Gossip())
+	wt.AssertNoErr(t, err)
+	if update != nil {
+		wt.Fatalf(t, "Expected nothing new")
+	}
+
+	rules, err := ParsePolicyRules("deny proto=tcp port=22")
+	wt.AssertNoErr(t, err)
+	policy1.SetGlobalRules(rules)
+	update, err = policy2.OnGossip(policy1.Gossip())
+	wt.AssertNoErr(t, err)
+	if update == nil {
+		wt.Fatalf(t, "Expected new rules to be passed on")
+	}
+	wt.AssertEqualInt(t, len(policy2.GlobalRules()), 1, "global rules")
+	wt.AssertEqualString(t, policy2.GlobalRules()[0].String(), "deny proto=tcp port=22", "rule")
+	update, err = policy2.OnGossip(policy1.Gossip())
+	wt.AssertNoErr(t, err)
+	if update != nil {
+		wt.Fatalf(t, "Expected nothing new")
+	}
+
+	// The most recently set rules win, even when they're none
+	policy2.SetGlobalRules(nil)
+	wt.AssertNoErr(t, policy1.OnGossipBroadcast(policy2.Gossip()))
+	if !policy1.Empty() {
+		wt.Fatalf(t, "Expected rules to be cleared")
+	}
+}
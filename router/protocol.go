@@ -1,8 +1,9 @@
 package router
 
 const (
-	Protocol        = "weave"
-	ProtocolVersion = 12
+	Protocol           = "weave"
+	ProtocolVersion    = 13
+	ProtocolMinVersion = 13 // the oldest version we can still speak
 )
 
 type ProtocolTag byte
@@ -16,6 +17,19 @@ const (
 	ProtocolGossip
 	ProtocolGossipUnicast
 	ProtocolGossipBroadcast
+	ProtocolRekeyRequest
+	ProtocolRekeyResponse
+	ProtocolRekeyCommit
+	ProtocolGoingAway
+	ProtocolTCPFallback
+	ProtocolTCPFrames
+	ProtocolNATCandidates
+	ProtocolPasswordChanged
+	ProtocolWireGuardKey
+	ProtocolThroughputQuery
+	ProtocolThroughputReport
+	ProtocolCongestion
+	ProtocolCompressed
 )
 
 type ProtocolMsg struct {
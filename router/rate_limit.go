@@ -0,0 +1,117 @@
+package router
+
+import (
+	"sync"
+	"time"
+)
+
+// A TokenBucket limits the rate at which a connection sends. Tokens,
+// i.e. bytes we may send, accrue at the configured rate, up to
+// RateLimitBurst's worth. Both forwarders of a connection share the
+// connection's bucket.
+//
+// Packets which would overdraw the bucket get dropped rather than
+// delayed, the way a policer on the uplink would. That leaves it to
+// the overlay's TCP flows to back off, and keeps queues from building
+// up in the forwarders.
+//
+// A bucket with a rate of 0 lets everything through, and only
+// measures the rate at which we send, for ECN to slow down from; see
+// ecn.go.
+type TokenBucket struct {
+	sync.Mutex
+	rate        float64 // bytes per second
+	capacity    float64
+	tokens      float64
+	last        time.Time
+	windowStart time.Time
+	windowBytes float64 // taken since windowStart
+	measured    float64 // bytes per second taken in the last complete RateWindow
+}
+
+func NewTokenBucket(rate int64) *TokenBucket {
+	now := time.Now()
+	capacity := bucketCapacity(float64(rate))
+	return &TokenBucket{
+		rate:        float64(rate),
+		capacity:    capacity,
+		tokens:      capacity,
+		last:        now,
+		windowStart: now}
+}
+
+func bucketCapacity(rate float64) float64 {
+	capacity := rate * RateLimitBurst.Seconds()
+	if capacity < MaxUDPPacketSize {
+		// must allow at least one packet of any size
+		capacity = MaxUDPPacketSize
+	}
+	return capacity
+}
+
+// Take n tokens from the bucket. Returns false, and takes nothing, if
+// there aren't enough.
+func (tb *TokenBucket) Take(n int) bool {
+	tb.Lock()
+	defer tb.Unlock()
+	now := time.Now()
+	tb.refill(now)
+	if tb.rate > 0 {
+		if tb.tokens < float64(n) {
+			return false
+		}
+		tb.tokens -= float64(n)
+	}
+	if elapsed := now.Sub(tb.windowStart); elapsed >= RateWindow {
+		tb.measured = tb.windowBytes / elapsed.Seconds()
+		tb.windowStart, tb.windowBytes = now, 0
+	}
+	tb.windowBytes += float64(n)
+	return true
+}
+
+func (tb *TokenBucket) refill(now time.Time) {
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.capacity {
+		tb.tokens = tb.capacity
+	}
+	tb.last = now
+}
+
+// The limit in bytes per second; 0 if unlimited
+func (tb *TokenBucket) Rate() int64 {
+	tb.Lock()
+	defer tb.Unlock()
+	return int64(tb.rate)
+}
+
+// Change the limit, keeping the tokens saved up so far, as far as
+// they fit.
+func (tb *TokenBucket) SetRate(rate int64) {
+	tb.Lock()
+	defer tb.Unlock()
+	tb.refill(time.Now())
+	if tb.rate == 0 {
+		tb.tokens = bucketCapacity(float64(rate))
+	}
+	tb.rate, tb.capacity = float64(rate), bucketCapacity(float64(rate))
+	if tb.tokens > tb.capacity {
+		tb.tokens = tb.capacity
+	}
+}
+
+// The rate at which we have been sending, in bytes per second
+func (tb *TokenBucket) Measured() int64 {
+	tb.Lock()
+	defer tb.Unlock()
+	return int64(tb.measured)
+}
+
+// The rate limit applying to connections to the named peer; 0 if
+// none.
+func (router *Router) RateLimitFor(name PeerName) int64 {
+	if limit, found := router.PeerRateLimits[name]; found {
+		return limit
+	}
+	return router.RateLimit
+}
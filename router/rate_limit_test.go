@@ -0,0 +1,33 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	const rate = 100
+	tb := NewTokenBucket(rate * MaxUDPPacketSize)
+	wt.AssertEqualInt(t, int(tb.Rate()), rate*MaxUDPPacketSize, "rate")
+	burst := int(rate * RateLimitBurst.Seconds())
+	// starts out full
+	for i := 0; i < burst; i++ {
+		if !tb.Take(MaxUDPPacketSize) {
+			wt.Fatalf(t, "Expected burst of %d packets to be allowed; refused packet %d", burst, i)
+		}
+	}
+	if tb.Take(MaxUDPPacketSize) {
+		wt.Fatalf(t, "Expected empty bucket to refuse packet")
+	}
+	// refills at the rate, up to its capacity
+	tb.last = tb.last.Add(-time.Hour)
+	for i := 0; i < burst; i++ {
+		if !tb.Take(MaxUDPPacketSize) {
+			wt.Fatalf(t, "Expected refilled bucket to allow packet %d", i)
+		}
+	}
+	if tb.Take(MaxUDPPacketSize) {
+		wt.Fatalf(t, "Expected bucket to hold no more than its capacity")
+	}
+}
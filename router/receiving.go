@@ -0,0 +1,48 @@
+package router
+
+// Decrypting and decoding the packets the UDP listener receives is
+// most of its work. Instead, the listener can hand them to a pool of
+// workers, carrying on receiving in the meantime. Packets from each
+// peer always go to the same worker, so that they are handled in the
+// order they arrived: frames of a flow don't get reordered, and
+// decryptors, which some encryption schemes need to see packets in
+// order, are only ever used by one worker.
+
+type recvPool struct {
+	queues []chan *ReceivedPacket
+}
+
+func (router *Router) newRecvPool(workers int, po PacketSink) *recvPool {
+	pool := &recvPool{queues: make([]chan *ReceivedPacket, workers)}
+	for i := range pool.queues {
+		queue := make(chan *ReceivedPacket, ChannelSize)
+		pool.queues[i] = queue
+		go router.recvWorker(queue, po)
+	}
+	return pool
+}
+
+func (router *Router) recvWorker(queue <-chan *ReceivedPacket, po PacketSink) {
+	dec := NewEthernetDecoder()
+	handleUDPPacket := router.handleUDPPacketFunc(dec, po)
+	for packet := range queue {
+		router.handleReceivedPacket(packet, dec, handleUDPPacket)
+		packet.fb.Release()
+	}
+}
+
+// Queue the packet for the worker of the peer it is from, blocking
+// while that worker is too busy to take any more.
+func (pool *recvPool) dispatch(packet *ReceivedPacket) {
+	pool.queues[recvShard(packet.Bytes(), len(pool.queues))] <- packet
+}
+
+// Which of n workers gets packets from the peer named at the start of
+// the packet, by an FNV-1a hash of the name. Packets too short to
+// carry a name all go to the first.
+func recvShard(packet []byte, n int) int {
+	if len(packet) < NameSize {
+		return 0
+	}
+	return int(fnvAdd(fnvOffset, packet[:NameSize]) % uint32(n))
+}
@@ -0,0 +1,194 @@
+package router
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session key rotation.
+//
+// Either peer can initiate a rekey, once its interval has elapsed or
+// it has sent enough data under the current key. The exchange runs
+// over the (encrypted) control channel:
+//
+//   initiator                          responder
+//   RekeyRequest(new public key) -->
+//                                      forms new key, accepts it for
+//                                      decryption
+//                                <-- RekeyResponse(new public key)
+//   forms new key, accepts it for
+//   decryption, encrypts with it
+//   RekeyCommit                  -->
+//                                      encrypts with new key
+//
+// Each side only starts encrypting with the new key once it knows the
+// other side can decrypt with it. Decryptors keep accepting the old
+// key for a while, since packets encrypted with it may still be in
+// flight.
+
+// Old keys are retained for decryption until this many newer keys
+// have been added.
+const maxDecryptionKeys = 3
+
+// A KeyRing holds the keys a decryptor accepts, in whatever form the
+// decryptor needs them, most recently successful first.
+type KeyRing struct {
+	sync.Mutex
+	derive func(*[32]byte) interface{}
+	keys   []interface{}
+}
+
+func NewKeyRing(key *[32]byte, derive func(*[32]byte) interface{}) *KeyRing {
+	return &KeyRing{derive: derive, keys: []interface{}{derive(key)}}
+}
+
+// Called by the connection actor process.
+func (kr *KeyRing) Add(key *[32]byte) {
+	derived := kr.derive(key)
+	kr.Lock()
+	defer kr.Unlock()
+	if len(kr.keys) >= maxDecryptionKeys {
+		kr.keys = kr.keys[:maxDecryptionKeys-1]
+	}
+	kr.keys = append(kr.keys, derived)
+}
+
+// Call fun with each key in turn, until it returns true. Returns
+// whether any call did. Called by the udp listener process.
+func (kr *KeyRing) Try(fun func(interface{}) bool) bool {
+	kr.Lock()
+	defer kr.Unlock()
+	for i, key := range kr.keys {
+		if fun(key) {
+			if i > 0 {
+				// the other side has switched to this key
+				copy(kr.keys[1:i+1], kr.keys[:i])
+				kr.keys[0] = key
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Connection handlers for rekeying. These run in the connection actor
+// process.
+
+func (conn *LocalConnection) rekeyDue() bool {
+	if conn.rekeyPrivate != nil || conn.rekeyPending != nil {
+		return false // already rekeying
+	}
+	router := conn.Router
+	return (router.RekeyInterval > 0 && time.Since(conn.lastRekey) >= router.RekeyInterval) ||
+		(router.RekeyBytes > 0 && conn.ConnectionStats().BytesForwarded-conn.lastRekeyBytes >= router.RekeyBytes)
+}
+
+func (conn *LocalConnection) handleRekeyCheck() error {
+	if !conn.rekeyDue() {
+		return nil
+	}
+	return conn.startRekey()
+}
+
+// Async. Ask for a new key, whether or not one is due, e.g. because
+// the counters of the current one are running out. Called by the
+// encryptors.
+func (conn *LocalConnection) RequestRekey() {
+	conn.sendQuery(CRekeyNow, nil)
+}
+
+func (conn *LocalConnection) handleRekeyNow() error {
+	switch {
+	case !conn.canRekey:
+		conn.logger(logCrypto).Warn("Unable to rotate session key: remote peer doesn't support it")
+		return nil
+	case conn.rekeyPrivate != nil || conn.rekeyPending != nil:
+		return nil // already rekeying
+	}
+	return conn.startRekey()
+}
+
+func (conn *LocalConnection) startRekey() error {
+	public, private, err := GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+	conn.rekeyPrivate = private
+	return conn.handleSendProtocolMsg(ProtocolMsg{ProtocolRekeyRequest, public[:]})
+}
+
+func (conn *LocalConnection) handleRekeyMsg(m ProtocolMsg) error {
+	switch m.tag {
+	case ProtocolRekeyRequest:
+		if conn.rekeyPrivate != nil {
+			// Both of us started rekeying at the same time. The
+			// peer with the lower name gets to carry on.
+			if conn.local.Name < conn.remote.Name {
+				return nil
+			}
+			conn.rekeyPrivate = nil
+		}
+		remotePublic, err := rekeyPublicKey(m.msg)
+		if err != nil {
+			return err
+		}
+		public, private, err := GenerateKeyPair()
+		if err != nil {
+			return err
+		}
+		key := FormSessionKey(remotePublic, private, &conn.password)
+		conn.Router.KeyLog.Log(conn, key)
+		conn.Decryptor.AddKey(key)
+		conn.rekeyPending = key
+		return conn.handleSendProtocolMsg(ProtocolMsg{ProtocolRekeyResponse, public[:]})
+	case ProtocolRekeyResponse:
+		if conn.rekeyPrivate == nil {
+			return fmt.Errorf("unexpected rekey response")
+		}
+		remotePublic, err := rekeyPublicKey(m.msg)
+		if err != nil {
+			return err
+		}
+		key := FormSessionKey(remotePublic, conn.rekeyPrivate, &conn.password)
+		conn.Router.KeyLog.Log(conn, key)
+		conn.rekeyPrivate = nil
+		conn.Decryptor.AddKey(key)
+		if err := conn.rekeyForwarders(key); err != nil {
+			return err
+		}
+		return conn.handleSendProtocolMsg(ProtocolMsg{ProtocolRekeyCommit, []byte{}})
+	case ProtocolRekeyCommit:
+		if conn.rekeyPending == nil {
+			return fmt.Errorf("unexpected rekey commit")
+		}
+		key := conn.rekeyPending
+		conn.rekeyPending = nil
+		return conn.rekeyForwarders(key)
+	}
+	return nil
+}
+
+func (conn *LocalConnection) rekeyForwarders(key *[32]byte) error {
+	if err := conn.ensureForwarders(); err != nil {
+		return err
+	}
+	for _, ch := range conn.rekeyChans {
+		ch <- key
+	}
+	conn.lastRekey = time.Now()
+	conn.lastRekeyBytes = conn.ConnectionStats().BytesForwarded
+	atomic.AddUint64(&conn.stats.Rekeys, 1)
+	conn.logger(logCrypto).Info("Session key rotated")
+	return nil
+}
+
+func rekeyPublicKey(msg []byte) (*[32]byte, error) {
+	if len(msg) != 32 {
+		return nil, fmt.Errorf("rekey message has wrong length; expected 32 bytes, received %d", len(msg))
+	}
+	key := [32]byte{}
+	copy(key[:], msg)
+	return &key, nil
+}
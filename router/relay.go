@@ -0,0 +1,37 @@
+package router
+
+// Peers which can't reach, or be reached by, most other peers can
+// designate relays. Such a peer only connects to its relays, and the
+// others don't try to connect to it, but for its relays. Everyone
+// learns of the designation from the topology, and frames between
+// the peer and everyone else get routed through the relays. They
+// carry the names of the peers they are from and to in the same
+// header as any other forwarded frame, so relays simply forward them
+// on to the next hop.
+//
+// Without designating relays, connections which never get
+// established aren't used for routing either, so frames take a
+// detour through other peers anyway. But we keep trying to connect.
+
+func designatesRelay(peer *Peer, relay PeerName) bool {
+	for _, name := range peer.Relays() {
+		if name == relay {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether we should try to connect to the peer, by relay designation
+func (cm *ConnectionMaker) mayConnectTo(peer *Peer) bool {
+	if peer == nil {
+		return true
+	}
+	switch {
+	case len(cm.ourself.Relays()) > 0:
+		return designatesRelay(cm.ourself.Peer, peer.Name)
+	case len(peer.Relays()) > 0:
+		return designatesRelay(peer, cm.ourself.Name)
+	}
+	return true
+}
@@ -0,0 +1,46 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"testing"
+)
+
+func TestRelaysGossip(t *testing.T) {
+	hubName, _ := PeerNameFromString("01:00:00:01:00:00")
+	spokeName, _ := PeerNameFromString("02:00:00:01:00:00")
+	otherName, _ := PeerNameFromString("03:00:00:01:00:00")
+	hub, hubPeers := newNode(hubName)
+	spoke, spokePeers := newNode(spokeName)
+	_, otherPeers := newNode(otherName)
+	spoke.SetRelays([]PeerName{hubName})
+	spokePeers.AddTestConnection(hub)
+	hubPeers.AddTestConnection(spoke)
+
+	// The hub has heard about the spoke's relays when it connected,
+	// and passes them on.
+	_, err := hubPeers.ApplyUpdate(spokePeers.EncodeAllPeers())
+	wt.AssertNoErr(t, err)
+	otherPeers.AddTestConnection(hub)
+	_, err = otherPeers.ApplyUpdate(hubPeers.EncodeAllPeers())
+	wt.AssertNoErr(t, err)
+	learnt, found := otherPeers.Fetch(spokeName)
+	if !found {
+		wt.Fatalf(t, "Expected to learn of spoke")
+	}
+	relays := learnt.Relays()
+	if len(relays) != 1 || relays[0] != hubName {
+		wt.Fatalf(t, "Expected spoke to relay through %s; got %v", hubName, relays)
+	}
+
+	other := NewConnectionMaker(&LocalPeer{Peer: otherPeers.ourself}, otherPeers)
+	if other.mayConnectTo(learnt) {
+		wt.Fatalf(t, "Expected not to connect to spoke")
+	}
+	if !other.mayConnectTo(hub) {
+		wt.Fatalf(t, "Expected to connect to hub")
+	}
+	fromSpoke := NewConnectionMaker(&LocalPeer{Peer: spoke}, spokePeers)
+	if fromSpoke.mayConnectTo(otherPeers.ourself) || !fromSpoke.mayConnectTo(hub) {
+		wt.Fatalf(t, "Expected spoke to connect to hub only")
+	}
+}
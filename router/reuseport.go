@@ -0,0 +1,39 @@
+package router
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// Several UDP sockets can listen on our port with SO_REUSEPORT, each
+// read by a goroutine of its own, and the kernel spreads the packets
+// arriving over them by a hash of their addresses and ports. That
+// spreads receiving over several cores, while keeping the packets
+// from each peer on one socket, in order. Should packets of a
+// connection arrive on several sockets regardless, e.g. when the
+// remote's address changes, connections serialise their handling.
+
+// From <asm-generic/socket.h>; not defined in the syscall package for
+// all platforms
+const soReusePort = 15 // SO_REUSEPORT
+
+func listenUDPReusePort(addr *net.UDPAddr, reusePort bool) (*net.UDPConn, error) {
+	if !reusePort {
+		return net.ListenUDP("udp", addr)
+	}
+	config := net.ListenConfig{Control: func(_, _ string, rawConn syscall.RawConn) error {
+		var err error
+		if controlErr := rawConn.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		}); controlErr != nil {
+			return controlErr
+		}
+		return err
+	}}
+	conn, err := config.ListenPacket(context.Background(), "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
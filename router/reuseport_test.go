@@ -0,0 +1,45 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListenUDPReusePort(t *testing.T) {
+	conn1, err := listenUDPReusePort(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, true)
+	wt.AssertNoErr(t, err)
+	defer conn1.Close()
+	addr := conn1.LocalAddr().(*net.UDPAddr)
+	conn2, err := listenUDPReusePort(addr, true)
+	wt.AssertNoErr(t, err)
+	defer conn2.Close()
+	if conn3, err := listenUDPReusePort(addr, false); err == nil {
+		conn3.Close()
+		wt.Fatalf(t, "Expected error listening on the port without SO_REUSEPORT")
+	}
+
+	// Packets from each sender arrive on one socket or the other,
+	// and all of them arrive
+	const numSenders = 8
+	for i := 0; i < numSenders; i++ {
+		sender, err := net.DialUDP("udp4", nil, addr)
+		wt.AssertNoErr(t, err)
+		_, err = sender.Write([]byte("hello"))
+		sender.Close()
+		wt.AssertNoErr(t, err)
+	}
+	received := 0
+	buf := make([]byte, 100)
+	for _, conn := range []*net.UDPConn{conn1, conn2} {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		for {
+			if _, _, err := conn.ReadFromUDP(buf); err != nil {
+				break
+			}
+			received++
+		}
+	}
+	wt.AssertEqualInt(t, received, numSenders, "packets received")
+}
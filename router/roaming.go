@@ -0,0 +1,234 @@
+package router
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Connections between peers which both support it survive changes of
+// the underlay addresses at either end, e.g. with a DHCP renewal or a
+// failover IP moving. The data plane follows the remote by itself:
+// packets which decrypt with the session key show where the remote
+// now is, so we move RemoteUDPAddr there and give the DF forwarders
+// senders for the new address. The control connection, however, is
+// TCP, which can't move, so when it fails the way it does when either
+// end's address changes, we keep the connection, and its forwarders,
+// running and queue control messages for up to RoamingTimeout. In the
+// meantime the peer which dialed the connection dials the remote
+// again, at its latest address, and performs a handshake in which it
+// proves it knows the existing connection's session key. The remote
+// then hands the new TCP connection to the existing one, which sends
+// the queued messages and carries on. Messages which were in flight
+// on the old TCP connection are lost; gossip recovers from that.
+//
+// Roaming needs a password, to authenticate the resumption, and a
+// detachable encryption scheme, so that packets can be decrypted
+// while the control connection is down.
+
+type controlLoss struct {
+	tcpConn net.Conn // nil for the current one
+	err     error
+}
+
+type resumption struct {
+	resumer *LocalConnection // whose handshake authenticated the new TCP connection
+	dec     *gob.Decoder
+	done    chan<- struct{}
+}
+
+// Async. The control connection failed, or we have reason to think
+// it's dead.
+func (conn *LocalConnection) controlLost(tcpConn net.Conn, err error) {
+	conn.sendQuery(CControlLost, &controlLoss{tcpConn: tcpConn, err: err})
+}
+
+// Sync. Hand the TCP connection of the resumer, which proved it
+// belongs to the same remote, to this connection. Returns whether
+// this connection took it.
+func (conn *LocalConnection) Resume(resumer *LocalConnection, dec *gob.Decoder) bool {
+	done := make(chan struct{})
+	conn.sendQuery(CResume, &resumption{resumer: resumer, dec: dec, done: done})
+	select {
+	case <-done:
+		return true
+	case <-conn.finished:
+		return false
+	}
+}
+
+// Holds on to control messages while we wait for the control
+// connection to resume.
+type detachedTCPSender struct {
+	msgs [][]byte
+}
+
+func (sender *detachedTCPSender) Send(msg []byte) error {
+	if len(sender.msgs) >= MaxDetachedMsgs {
+		return fmt.Errorf("too many control messages queued waiting for the control connection to resume")
+	}
+	sender.msgs = append(sender.msgs, msg)
+	return nil
+}
+
+// Whether the control connection failed the way it does when an
+// underlay address at either end changes, rather than because the
+// remote closed it.
+func underlayLost(err error) bool {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	switch PosixError(err) {
+	case syscall.ETIMEDOUT, syscall.EHOSTUNREACH, syscall.ENETUNREACH, syscall.EADDRNOTAVAIL:
+		return true
+	}
+	return false
+}
+
+// Proves to the remote that we hold the session key of the connection
+// we resume, bound to the handshake we do so in, so it can't be
+// replayed.
+func resumeProof(key *[32]byte, connID, publicKey string) string {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte("resume " + connID + " " + publicKey))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// The connection to the peer which the remote wants to resume, as
+// requested in its handshake fields.
+func (conn *LocalConnection) resumedConnection(name PeerName, fields map[string]string) (*LocalConnection, error) {
+	existing, found := conn.local.ConnectionTo(name)
+	if !found {
+		return nil, fmt.Errorf("No connection to %s to resume", name)
+	}
+	resumed := existing.(*LocalConnection)
+	if !resumed.roaming || fields["ResumeConnUID"] != fmt.Sprint(resumed.uid) {
+		return nil, fmt.Errorf("No connection to %s to resume", name)
+	}
+	proof := resumeProof(resumed.SessionKey, fields["ConnID"], fields["PublicKey"])
+	if !hmac.Equal([]byte(fields["ResumeProof"]), []byte(proof)) {
+		return nil, fmt.Errorf("Invalid proof for resuming connection to %s", name)
+	}
+	return resumed, nil
+}
+
+func (conn *LocalConnection) handleControlLost(loss *controlLoss) error {
+	if loss.tcpConn != nil && loss.tcpConn != conn.TCPConn {
+		return nil // one we have replaced since
+	}
+	if conn.roamTimeout != nil {
+		return nil // already waiting
+	}
+	if !conn.established || conn.sendingOverTCP || (loss.tcpConn != nil && !underlayLost(loss.err)) {
+		return loss.err
+	}
+	conn.log("lost control connection:", loss.err, "- waiting up to", RoamingTimeout, "for it to resume")
+	conn.TCPConn.Close()
+	conn.tcpSender = &detachedTCPSender{}
+	conn.roamTimeout = time.NewTimer(RoamingTimeout)
+	atomic.StoreInt32(&conn.detached, 1)
+	conn.setState(ConnDegraded, "lost control connection")
+	if conn.outbound {
+		go conn.redial(time.Now().Add(RoamingTimeout))
+	}
+	return nil
+}
+
+func (conn *LocalConnection) handleResume(r *resumption) error {
+	defer close(r.done)
+	// Closing the old TCP connection makes its receiver exit, if it
+	// hasn't yet.
+	conn.TCPConn.Close()
+	var queued [][]byte
+	if detached, ok := conn.tcpSender.(*detachedTCPSender); ok {
+		queued = detached.msgs
+	}
+	conn.Lock()
+	conn.TCPConn = r.resumer.TCPConn
+	conn.Unlock()
+	conn.tcpSender = r.resumer.tcpSender
+	conn.tcpReceiver = r.resumer.tcpReceiver
+	stopTimer(conn.roamTimeout)
+	conn.roamTimeout = nil
+	atomic.StoreInt32(&conn.detached, 0)
+	conn.log("control connection resumed from", conn.TCPConn.RemoteAddr())
+	conn.setState(conn.establishedState(), "control connection resumed")
+	go conn.receiveTCP(conn.TCPConn, r.dec)
+	for _, msg := range queued {
+		if err := conn.tcpSender.Send(msg); err != nil {
+			return err
+		}
+	}
+	// Our own underlay address may have changed.
+	conn.retargetDF()
+	return nil
+}
+
+// Dial the remote at its latest address, and resume the connection
+// over the new TCP connection, until that works or we run out of time.
+func (conn *LocalConnection) redial(deadline time.Time) {
+	for atomic.LoadInt32(&conn.detached) == 1 && time.Now().Before(deadline) {
+		dialer := &net.Dialer{Timeout: RedialInterval}
+		if local := conn.Router.localTCPAddr(); local != nil {
+			dialer.LocalAddr = local
+		}
+		tcpConn, err := dialer.Dial("tcp", conn.redialAddr())
+		if err != nil {
+			conn.log("unable to resume control connection:", err)
+			time.Sleep(RedialInterval)
+			continue
+		}
+		connRemote := NewRemoteConnection(conn.local, nil, tcpConn.RemoteAddr().String(), false)
+		resumer := NewLocalConnection(connRemote, tcpConn, nil, conn.Router)
+		resumer.resumes = conn
+		resumer.outbound = true
+		resumer.Start(false)
+		<-resumer.finished
+		time.Sleep(RedialInterval)
+	}
+}
+
+// The remote's port is where we dialed it originally, while its
+// address is where we last heard from it.
+func (conn *LocalConnection) redialAddr() string {
+	host, port, _ := net.SplitHostPort(conn.remoteTCPAddr)
+	if remoteUDPAddr := conn.RemoteUDPAddr(); remoteUDPAddr != nil {
+		host = remoteUDPAddr.IP.String()
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// The remote's underlay address changed, so our DF senders need to go
+// to the new one. Where the remote was at the address of our control
+// connection before, that is likely dead now, even if we can't tell
+// yet, so if we dialed the remote, we dial it again.
+func (conn *LocalConnection) handleRemoteMoved(oldRemoteUDPAddr *net.UDPAddr) error {
+	conn.retargetDF()
+	if conn.roaming && conn.outbound && oldRemoteUDPAddr.IP.Equal(conn.underlayIP()) {
+		return conn.handleControlLost(&controlLoss{err: fmt.Errorf("remote moved to %v", conn.remoteUDPAddr)})
+	}
+	return nil
+}
+
+// Give the DF forwarders senders for the remote's current underlay
+// address, e.g. after it, or we, moved.
+func (conn *LocalConnection) retargetDF() {
+	for i, ch := range conn.newSendersDF {
+		sender, err := conn.newUDPSenderDF(i)
+		if err != nil {
+			conn.log("unable to retarget DF sender:", err)
+			return
+		}
+		select {
+		case ch <- sender:
+		default:
+			sender.Shutdown()
+		}
+	}
+}
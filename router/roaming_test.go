@@ -0,0 +1,32 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"testing"
+)
+
+func TestResumeProof(t *testing.T) {
+	key1, key2 := &[32]byte{1}, &[32]byte{2}
+	proof := resumeProof(key1, "42", "abcd")
+	wt.AssertEqualString(t, resumeProof(key1, "42", "abcd"), proof, "proof")
+	for _, other := range []string{
+		resumeProof(key2, "42", "abcd"),
+		resumeProof(key1, "43", "abcd"),
+		resumeProof(key1, "42", "abce"),
+	} {
+		if other == proof {
+			wt.Fatalf(t, "Expected proofs to differ")
+		}
+	}
+}
+
+func TestDetachedTCPSender(t *testing.T) {
+	sender := &detachedTCPSender{}
+	for i := 0; i < MaxDetachedMsgs; i++ {
+		wt.AssertNoErr(t, sender.Send([]byte{byte(i)}))
+	}
+	if sender.Send([]byte{0}) == nil {
+		wt.Fatalf(t, "Expected sending to fail once the queue is full")
+	}
+	wt.AssertEqualInt(t, len(sender.msgs), MaxDetachedMsgs, "messages queued")
+}
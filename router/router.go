@@ -6,8 +6,10 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -17,20 +19,116 @@ const macMaxAge = 10 * time.Minute // [1]
 // [1] should be greater than typical ARP cache expiries, i.e. > 3/2 *
 // /proc/sys/net/ipv4_neigh/*/base_reachable_time_ms on Linux
 
+type RouterConfig struct {
+	Iface          *net.Interface
+	Password       []byte
+	ConnLimit      int
+	BufSz          int
+	Capture        CaptureBackend
+	CaptureReaders int // goroutines capturing frames with AF_PACKET; frames of a flow always go to the same one
+	BatchSize      int // max number of UDP packets to send per syscall
+	RecvBatchSize  int // max number of UDP packets to receive per syscall
+	Listeners      int // UDP sockets to receive on, sharing the port with SO_REUSEPORT, so the kernel spreads packets over them
+	Forwarders     int // number of parallel forwarders of each kind per connection
+	DropPolicy     DropPolicy
+	MaxSndBuf      int                // grow UDP socket send buffers up to this size on ENOBUFS; 0 to disable
+	PMTUMaxAge     time.Duration      // how long to remember verified PMTUs for; 0 to disable
+	RekeyInterval  time.Duration      // rotate session keys this often; 0 to disable
+	RekeyBytes     uint64             // rotate session keys after sending this much; 0 to disable
+	FastPathDev    string             // kernel VXLAN device to offload unencrypted traffic to; "" to disable
+	FastPathXDP    bool               // send fast path traffic to the device with XDP, bypassing the capture
+	WireGuardDev   string             // kernel WireGuard device to send fast path traffic through; "" to disable
+	WireGuardPort  int                // port for the WireGuard device to listen on
+	RateLimit      int64              // max bytes per second sent over each connection; 0 for unlimited
+	PeerRateLimits map[PeerName]int64 // overrides RateLimit for connections to particular peers
+	TCPFallback    bool               // carry frames over TCP when UDP doesn't get through
+	PMTUOverrides  *PMTUOverrides     // effective PMTUs pinned for particular peers
+	IGMPSnooping   bool               // only send multicast frames to peers with receivers in their groups
+	Relays         []PeerName         // only connect to these peers, relaying everything else through them
+	NATTraversal   bool               // punch holes through NATs for UDP
+	BindAddr       net.IP             // local address to listen on and connect to peers from, e.g. of a dedicated NIC; nil for all
+	STUNServers    []string           // host:port of STUN servers to learn our reflexive address from
+	WebSocketPort  int                // port to accept WebSocket connections on; 0 to disable
+	TLSCertFile    string             // certificate for WebSocket connections; "" for a self-signed one
+	TLSKeyFile     string
+	UDPChecksums   bool  // compute UDP checksums for IPv4 packets sent with DF, rather than only where needed
+	PaddingBuckets []int // sizes to pad encrypted packets up to; none to disable padding
+	Compression    CompressionMode
+	Routing        Routing             // how to choose routes; nil for HopCountRouting, or LinkQualityRouting with QualityRouting
+	QualityRouting bool                // prefer routes with lower latency and loss
+	MacPins        map[string]PeerName // MACs, as strings of their bytes, to always send to particular peers
+	ARPProxy       bool                // answer ARP requests and neighbour solicitations for known addresses locally
+	TenantSubnets  []TenantSubnet      // subnets of virtual networks isolated from each other and the default one
+	Encap          Encapsulation       // how to send unencrypted peers frames where they support it
+	EncapPort      int                 // port to exchange frames with unencrypted peers on in Encap
+	VNI            uint32              // VNI of the default network in Encap; that of a tenant is this plus its ID
+	Tuning         Tuning              // queue, socket buffer and heartbeat settings; may change at runtime, see SetTuning
+	Limits         TopologyLimits      // on the topology we accept from peers
+	LoopDetection  LoopAction          // what to do on seeing frames we injected come back; see loop.go
+	SealWorkers    int                 // goroutines sealing NaCl packets for all connections; 0 to seal in the forwarders
+	RecvWorkers    int                 // goroutines decrypting and decoding the UDP packets we receive; 0 to do so in the listener
+	KeyLog         *KeyLog             // where to log the session keys of encrypted connections; nil not to
+	JoinAuth       *JoinAuth           // checks the join tokens of peers; nil not to require any
+	PeerTLS        *PeerTLS            // mutual TLS for the connections between peers; nil not to use it
+	PeerStore      *PeerStore          // where to keep the peers we know across restarts; nil not to
+	FlowAccounting bool                // count traffic by pair of IP addresses, for the top talkers
+	FilterCapture  bool                // have the kernel leave out captured frames we would throw away; see capture_filter.go
+	ConnTracking   bool                // track the connections of local hosts, for policy rules on their state; see conntrack.go
+	SFlow          *SFlowExporter      // where to send sFlow samples of the frames we forward; nil not to
+	Bridge         *Bridge             // the bridge to create and keep configured; nil to leave it to others
+	DSCP           DSCPMarking         // DSCP to mark UDP packets to peers with, by the class of their frames
+	ECN            bool                // mark UDP packets to peers ECN capable, and slow down when they get marked congested
+	Standby        bool                // keep a standby path to peers with several addresses, and switch to it when the active one stops answering
+	MultiPath      bool                // spread flows over all the paths to peers with several addresses
+	ClampMSS       bool                // lower the MSS of TCP SYNs to fit the effective PMTU of the connection they go over
+	Encryption     []string            // encryption schemes to offer peers, in order of preference; none for all of them
+	Plaintext      *PlaintextPeers     // peers to exchange frames with unencrypted, despite the password, where they agree; nil for none
+	Reconnect      ReconnectPolicy
+	PeerKeepalives map[PeerName]time.Duration // overrides NATKeepalive of the Tuning for connections to particular peers
+	LogFrame       func(string, []byte, *layers.Ethernet)
+}
+
 type Router struct {
-	Iface           *net.Interface
+	RouterConfig
 	Ourself         *LocalPeer
-	Macs            *MacCache
+	Macs            *MacCache // of the default network
+	Tenants         *Tenants
+	PMTUs           *PMTUCache
+	ChecksumPaths   *ChecksumPaths
+	Dedup           *DedupCache
+	Loops           *LoopDetector
+	SealPool        *SealPool
+	Events          *Events
+	Taps            *FrameTaps
+	Throughput      *ThroughputTests
+	FastPath        *FastPath
+	WireGuard       *WireGuard
 	Peers           *Peers
 	Routes          *Routes
 	ConnectionMaker *ConnectionMaker
 	GossipChannels  map[uint32]*GossipChannel
 	TopologyGossip  Gossip
-	UDPListener     *net.UDPConn
-	Password        *[]byte
-	ConnLimit       int
-	BufSz           int
-	LogFrame        func(string, []byte, *layers.Ethernet)
+	Multicast       *MulticastGroups
+	Neighbours      *Neighbours
+	Policy          *Policy
+	Conntrack       *ConnTracker // nil unless ConnTracking
+	PeerACL         *PeerACL
+	ConnStates      *ConnectionStates
+	Partitions      *Partitions
+	Flows           *FlowStats // nil unless FlowAccounting
+	LinkQuality     *LinkQualities
+	NAT             *NATTraversal
+	UDPListener     *net.UDPConn   // the one we send from
+	UDPListeners    []*net.UDPConn // UDPListener and those sharing its port; see RouterConfig.Listeners
+	EncapListener   *net.UDPConn
+	injector        PacketSink // shared by the UDP listener and connections falling back to TCP
+	passwordLock    sync.RWMutex
+	tuningLock      sync.RWMutex
+	passwords       Passwords
+	rehandshakes    chan *LocalConnection // connections to re-handshake for a new password
+	localFrames     uint64                // set atomically; captured frames between local MACs
+	captureFilter   atomic.Value          // the *CaptureFilter for the sniffers to install
+	stopping        int32                 // set atomically when we stop forwarding
 }
 
 type PacketSource interface {
@@ -46,122 +144,442 @@ type PacketSourceSink interface {
 	PacketSink
 }
 
-func NewRouter(iface *net.Interface, name PeerName, password []byte, connLimit int, bufSz int, logFrame func(string, []byte, *layers.Ethernet)) *Router {
+// Serialises writes to a PacketSink used by several processes
+type lockedPacketSink struct {
+	sync.Mutex
+	sink PacketSink
+}
+
+func (ls *lockedPacketSink) WritePacket(data []byte) error {
+	ls.Lock()
+	defer ls.Unlock()
+	return ls.sink.WritePacket(data)
+}
+
+func NewRouter(config RouterConfig, name PeerName) *Router {
 	router := &Router{
-		Iface:          iface,
+		RouterConfig:   config,
 		GossipChannels: make(map[uint32]*GossipChannel),
-		ConnLimit:      connLimit,
-		BufSz:          bufSz,
-		LogFrame:       logFrame}
-	if len(password) > 0 {
-		router.Password = &password
+		passwords:      Passwords{current: config.Password},
+		rehandshakes:   make(chan *LocalConnection, MaxRehandshakes)}
+	if router.BatchSize < 1 {
+		router.BatchSize = 1
 	}
-	onMacExpiry := func(mac net.HardwareAddr, peer *Peer) {
-		log.Println("Expired MAC", mac, "at", peer.Name)
+	if router.RecvBatchSize < 1 {
+		router.RecvBatchSize = 1
+	}
+	if router.Listeners < 1 {
+		router.Listeners = 1
+	}
+	sort.Ints(router.PaddingBuckets)
+	if router.PMTUOverrides == nil {
+		router.PMTUOverrides = NewPMTUOverrides()
+	}
+	router.Tuning = router.Tuning.withDefaults()
+	if router.Forwarders < 1 {
+		router.Forwarders = 1
+	} else if router.Forwarders > MaxForwarders {
+		router.Forwarders = MaxForwarders
+	}
+	onMacExpiry := func(mac net.HardwareAddr, peer *Peer, tenant uint16) {
+		logRouter.Info("Expired MAC", mac, "at", peer.Name)
+		router.Tenants.Forget(mac, tenant)
+		if peer == router.Ourself.Peer {
+			router.Multicast.ForgetHost(mac)
+			router.Neighbours.ForgetHost(mac)
+		}
+	}
+	onPeerAdd := func(peer *Peer) {
+		router.Events.Publish(Event{Type: EventPeerAdded, Peer: peer.Name.String()})
 	}
 	onPeerGC := func(peer *Peer) {
-		router.Macs.Delete(peer)
-		log.Println("Removed unreachable", peer)
+		router.Tenants.Delete(peer)
+		router.Multicast.DeletePeer(peer.Name)
+		router.Neighbours.DeletePeer(peer.Name)
+		router.LinkQuality.DeletePeer(peer.Name)
+		logRouter.Info("Removed unreachable", peer)
+		router.Partitions.Lost(peer.Name, time.Now())
+		router.Events.Publish(Event{Type: EventPeerRemoved, Peer: peer.Name.String()})
 	}
 	router.Ourself = NewLocalPeer(name, router)
-	router.Macs = NewMacCache(macMaxAge, onMacExpiry)
-	router.Peers = NewPeers(router.Ourself.Peer, onPeerGC)
+	router.NAT = NewNATTraversal(router)
+	router.Ourself.SetRelays(router.Relays)
+	router.Tenants = NewTenants(router.TenantSubnets, func(tenant uint16) *MacCache {
+		return NewMacCache(macMaxAge,
+			func(mac net.HardwareAddr, peer *Peer) { onMacExpiry(mac, peer, tenant) },
+			func(name PeerName) (*Peer, bool) { return router.Peers.Fetch(name) })
+	})
+	router.Macs = router.Tenants.Macs(0)
+	for mac, peerName := range router.MacPins {
+		router.Macs.Pin(net.HardwareAddr(mac), peerName)
+	}
+	router.PMTUs = NewPMTUCache(router.PMTUMaxAge)
+	router.ChecksumPaths = NewChecksumPaths()
+	router.Dedup = NewDedupCache(DedupTTL)
+	if router.SealWorkers > 0 {
+		router.SealPool = NewSealPool(router.SealWorkers)
+	}
+	router.Events = NewEvents()
+	ifaceName := ""
+	if router.Iface != nil {
+		ifaceName = router.Iface.Name
+	}
+	router.Loops = NewLoopDetector(router.LoopDetection, ifaceName, router.Events)
+	router.Taps = NewFrameTaps()
+	if router.FlowAccounting {
+		router.Flows = NewFlowStats()
+	}
+	if router.ConnTracking {
+		router.Conntrack = NewConnTracker()
+	}
+	router.Throughput = NewThroughputTests()
+	router.Peers = NewPeers(router.Ourself.Peer, onPeerAdd, onPeerGC)
+	router.Peers.limits = router.Limits
 	router.Peers.FetchWithDefault(router.Ourself.Peer)
-	router.Routes = NewRoutes(router.Ourself.Peer, router.Peers)
+	router.LinkQuality = NewLinkQualities(name)
+	if router.Routing == nil && router.QualityRouting {
+		router.Routing = NewLinkQualityRouting(router.LinkQuality)
+		router.LinkQuality.SetOnChange(func() { router.Routes.Recalculate() })
+	} else if router.Routing == nil {
+		router.Routing = NewHopCountRouting()
+	}
+	router.Routes = NewRoutes(router.Ourself.Peer, router.Peers, router.Routing)
 	router.ConnectionMaker = NewConnectionMaker(router.Ourself, router.Peers)
+	router.ConnectionMaker.policy = router.Reconnect.withDefaults()
 	router.TopologyGossip = router.NewGossip("topology", router)
+	// Peers which don't snoop still need the channel, or they would
+	// drop connections on receiving gossip for it.
+	router.Multicast = NewMulticastGroups(name, router.IGMPSnooping)
+	router.Multicast.SetGossip(router.NewGossip("multicast", router.Multicast))
+	router.Neighbours = NewNeighbours(name)
+	router.Neighbours.SetGossip(router.NewGossip("neighbours", router.Neighbours))
+	router.LinkQuality.SetGossip(router.NewGossip("linkquality", router.LinkQuality))
+	router.PeerACL = NewPeerACL()
+	router.ConnStates = NewConnectionStates()
+	router.Partitions = NewPartitions()
+	router.Policy = NewPolicy(name)
+	router.Policy.gossip = router.NewGossip("policy", router.Policy)
+	// Only peers with join tokens talk to each other, so the others
+	// don't need the channel.
+	if router.JoinAuth != nil {
+		router.JoinAuth.gossip = router.NewGossip("jointokens", router.JoinAuth)
+		router.JoinAuth.onRevoke = router.joinTokenRevoked
+	}
 	return router
 }
 
 func (router *Router) Start() {
-	// we need two pcap handles since they aren't thread-safe
-	pio, err := NewPcapIO(router.Iface.Name, router.BufSz)
-	checkFatal(err)
-	po, err := NewPcapO(router.Iface.Name)
+	sources, po, err := router.openCapture()
 	checkFatal(err)
+	if router.FastPathDev != "" {
+		router.FastPath, err = NewFastPath(router.FastPathDev)
+		checkFatal(err)
+		if router.FastPathXDP {
+			checkFatal(router.FastPath.EnableXDP(router.Iface))
+		}
+		if router.WireGuardDev != "" {
+			router.WireGuard, err = NewWireGuard(router.WireGuardDev, router.WireGuardPort)
+			checkFatal(err)
+		}
+	}
+	if router.Bridge != nil {
+		checkFatal(router.Bridge.Start(router))
+	}
 	router.Ourself.Start()
-	router.Macs.Start()
+	router.Tenants.Start()
 	router.Routes.Start()
 	router.ConnectionMaker.Start()
-	router.UDPListener = router.listenUDP(Port, po)
+	go router.rehandshakeLoop()
+	if router.PeerTLS != nil {
+		go router.recheckPeerCerts()
+	}
+	go router.gossipLinkQuality()
+	go router.watchPartitions()
+	if router.PeerStore != nil {
+		go router.persistPeers()
+	}
+	if router.SFlow != nil {
+		router.SFlow.Start()
+	}
+	router.injector = &lockedPacketSink{sink: po}
+	router.UDPListener = router.listenUDP(Port, router.injector)
+	if router.Encap != EncapWeave && !router.UsingPassword() {
+		router.EncapListener = router.listenEncap(router.EncapPort, router.injector)
+	}
+	if router.FilterCapture {
+		go router.filterCapture()
+	}
+	router.NAT.Start()
 	router.listenTCP(Port)
-	router.sniff(pio)
+	if router.WebSocketPort > 0 {
+		router.listenWebSocket(router.WebSocketPort)
+	}
+	router.sniff(sources)
+}
+
+// Open the handles to capture frames with, each read by a sniffing
+// goroutine of its own, and a handle to inject frames with.
+func (router *Router) openCapture() ([]PacketSourceSink, PacketSink, error) {
+	if router.Capture == CaptureAFPacket {
+		return openAFPacket(router.Iface, router.BufSz, router.CaptureReaders)
+	}
+	// we need two pcap handles since they aren't thread-safe
+	pio, err := NewPcapIO(router.Iface.Name, router.BufSz)
+	if err != nil {
+		return nil, nil, err
+	}
+	po, err := NewPcapO(router.Iface.Name)
+	return []PacketSourceSink{pio}, po, err
 }
 
-func (router *Router) UsingPassword() bool {
-	return router.Password != nil
+// Stop forwarding frames, and shut down all connections gracefully,
+// giving them until the timeout to send the frames already queued for
+// them. For rolling restarts, so we don't drop frames in flight.
+func (router *Router) Stop(timeout time.Duration) {
+	atomic.StoreInt32(&router.stopping, 1)
+	// The XDP program would outlive us, sending frames to the fast
+	// path device with no-one to keep its entries up to date.
+	if router.FastPath != nil {
+		checkWarn(router.FastPath.DisableXDP())
+	}
+	// While we still have our connections
+	if router.PeerStore != nil {
+		router.savePeers()
+	}
+	deadline := time.Now().Add(timeout)
+	var wg sync.WaitGroup
+	router.Ourself.ForEachConnection(func(_ PeerName, conn Connection) {
+		if localConn, ok := conn.(*LocalConnection); ok {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				localConn.GoAway(deadline)
+			}()
+		}
+	})
+	wg.Wait()
+}
+
+func (router *Router) Stopping() bool {
+	return atomic.LoadInt32(&router.stopping) != 0
 }
 
 func (router *Router) Status() string {
 	var buf bytes.Buffer
 	buf.WriteString(fmt.Sprintln("Our name is", router.Ourself.Name))
-	buf.WriteString(fmt.Sprintln("Sniffing traffic on", router.Iface))
+	buf.WriteString(fmt.Sprintln("Sniffing traffic on", router.Iface, "with", router.Capture))
+	if filter := router.CaptureFilter(); filter != nil {
+		buf.WriteString(fmt.Sprintf("Capture filter: %s", filter))
+	}
 	buf.WriteString(fmt.Sprintf("MACs:\n%s", router.Macs))
+	buf.WriteString(fmt.Sprintln("Frames between local MACs, left to the bridge:", router.LocalFrames()))
+	if !router.Tenants.Empty() {
+		buf.WriteString(router.Tenants.String())
+	}
 	buf.WriteString(fmt.Sprintf("Peers:\n%s", router.Peers))
 	buf.WriteString(fmt.Sprintf("Routes:\n%s", router.Routes))
+	if len(router.Relays) > 0 {
+		buf.WriteString(fmt.Sprintln("Relaying through", router.Relays))
+	}
+	buf.WriteString(fmt.Sprintf("PMTUs:\n%s", router.PMTUs))
+	if router.NATTraversal {
+		buf.WriteString(fmt.Sprintf("NAT traversal candidates: %s", router.NAT))
+	}
+	if router.SFlow != nil {
+		buf.WriteString(fmt.Sprintf("sFlow: %s", router.SFlow))
+	}
+	if router.Bridge != nil {
+		buf.WriteString(fmt.Sprintf("Bridge: %s", router.Bridge))
+	}
+	if !router.DSCP.Empty() {
+		buf.WriteString(fmt.Sprintln("Marking packets to peers with DSCP", router.DSCP))
+	}
+	buf.WriteString(fmt.Sprintf("Pinned PMTUs:\n%s", router.PMTUOverrides))
+	buf.WriteString(fmt.Sprintln("Tuning:", router.CurrentTuning()))
+	if !router.UDPChecksums {
+		buf.WriteString(fmt.Sprintf("Paths needing UDP checksums:\n%s", router.ChecksumPaths))
+	}
+	buf.WriteString(fmt.Sprintf("Multicast groups:\n%s", router.Multicast))
+	if router.ARPProxy {
+		buf.WriteString(fmt.Sprintf("Neighbours:\n%s", router.Neighbours))
+	}
+	buf.WriteString(fmt.Sprintf("Link quality:\n%s", router.LinkQuality))
+	if !router.Policy.Empty() {
+		buf.WriteString(fmt.Sprintf("Policy:\n%s", router.Policy))
+	}
+	if router.Conntrack != nil {
+		buf.WriteString(fmt.Sprintf("Tracked connections:\n%s", router.Conntrack))
+	}
+	if !router.PeerACL.Empty() {
+		buf.WriteString(fmt.Sprintf("Peer rules:\n%s", router.PeerACL))
+	}
+	if !router.Plaintext.Empty() {
+		buf.WriteString(fmt.Sprintf("Unencrypted frames with:\n%s", router.Plaintext))
+	}
+	if router.LoopDetection != LoopIgnore {
+		buf.WriteString(fmt.Sprintf("Loop detection: %s", router.Loops))
+	}
+	if !router.Limits.Empty() {
+		buf.WriteString(fmt.Sprintln("Topology limits:", router.Limits))
+	}
+	if !router.Partitions.Empty() {
+		buf.WriteString(fmt.Sprintf("Partitions:\n%s", router.Partitions))
+	}
+	if router.FastPath != nil {
+		buf.WriteString(fmt.Sprintln("Fast path via", router.FastPath))
+	}
+	if router.WireGuard != nil {
+		buf.WriteString(fmt.Sprintln("WireGuard via", router.WireGuard))
+	}
+	if router.EncapListener != nil {
+		buf.WriteString(fmt.Sprintf("Encapsulation %s on port %d, VNI %d\n", router.Encap, router.EncapPort, router.VNI))
+	}
 	buf.WriteString(fmt.Sprintf("Reconnects:\n%s", router.ConnectionMaker))
+	buf.WriteString(fmt.Sprintf("Connections:\n%s", router.ConnStates))
+	buf.WriteString(fmt.Sprintln("Connection stats:"))
+	router.Ourself.ForEachConnection(func(name PeerName, conn Connection) {
+		if localConn, ok := conn.(*LocalConnection); ok {
+			buf.WriteString(fmt.Sprintf("%s: %v", name, localConn.ConnectionStats()))
+			if localConn.UsingTCPFallback() {
+				buf.WriteString(", over TCP")
+			}
+			if localConn.plaintext {
+				buf.WriteString(", unencrypted")
+			}
+			if since, ok := localConn.SinceLastHeartbeat(); ok {
+				buf.WriteString(fmt.Sprintf(", last heartbeat %v ago", since))
+			}
+			if limiter := localConn.RateLimiter(); limiter != nil && limiter.Rate() > 0 {
+				buf.WriteString(fmt.Sprintf(", rate limit %d B/s", limiter.Rate()))
+			}
+			buf.WriteString("\n")
+		}
+	})
 	return buf.String()
 }
 
-func (router *Router) sniff(pio PacketSourceSink) {
-	log.Println("Sniffing traffic on", router.Iface)
+func (router *Router) sniff(sources []PacketSourceSink) {
+	logRouter.Info("Sniffing traffic on", router.Iface, "with", router.Capture)
 
-	dec := NewEthernetDecoder()
-	injectFrame := func(frame []byte) error { return pio.WritePacket(frame) }
-	checkFrameTooBig := func(err error) error { return dec.CheckFrameTooBig(err, injectFrame) }
 	mac := router.Iface.HardwareAddr
 	if router.Macs.Enter(mac, router.Ourself.Peer) {
-		log.Println("Discovered our MAC", mac)
+		logRouter.Info("Discovered our MAC", mac)
 	}
-	go func() {
-		for {
-			pkt, err := pio.ReadPacket()
-			checkFatal(err)
-			router.LogFrame("Sniffed", pkt, nil)
-			checkWarn(router.handleCapturedPacket(pkt, dec, checkFrameTooBig))
+	for _, pio := range sources {
+		go router.sniffFrom(pio)
+	}
+}
+
+func (router *Router) sniffFrom(pio PacketSourceSink) {
+	dec := NewEthernetDecoder()
+	injectFrame := func(frame []byte) error {
+		router.Loops.Injected(frame)
+		return pio.WritePacket(frame)
+	}
+	checkFrameTooBig := func(err error) error { return dec.CheckFrameTooBig(err, injectFrame) }
+	var filter *CaptureFilter
+	for {
+		if router.FilterCapture {
+			filter = router.installCaptureFilter(pio, filter)
 		}
-	}()
+		pkt, err := pio.ReadPacket()
+		checkFatal(err)
+		router.LogFrame("Sniffed", pkt, nil)
+		checkWarn(router.handleCapturedPacket(pkt, dec, injectFrame, checkFrameTooBig))
+	}
+}
+
+// How many captured frames we didn't forward since both their MACs
+// are local, so the bridge delivered them itself
+func (router *Router) LocalFrames() uint64 {
+	return atomic.LoadUint64(&router.localFrames)
 }
 
-func (router *Router) handleCapturedPacket(frameData []byte, dec *EthernetDecoder, checkFrameTooBig func(error) error) error {
+func (router *Router) handleCapturedPacket(frameData []byte, dec *EthernetDecoder, injectFrame func([]byte) error, checkFrameTooBig func(error) error) error {
 	dec.DecodeLayers(frameData)
 	decodedLen := len(dec.decoded)
 	if decodedLen == 0 {
 		return nil
 	}
+	tenant, consistent := router.Tenants.Classify(dec)
+	if !consistent {
+		router.LogFrame("Refusing", frameData, &dec.eth)
+		return nil
+	}
+	dec.tenant = tenant
+	macs := router.Tenants.Macs(tenant)
 	srcMac := dec.eth.SrcMAC
-	srcPeer, found := router.Macs.Lookup(srcMac)
+	srcPeer, found := macs.Lookup(srcMac)
 	// We need to filter out frames we injected ourselves. For such
 	// frames, the srcMAC will have been recorded as associated with a
 	// different peer.
 	if found && srcPeer != router.Ourself.Peer {
+		router.Loops.Captured(frameData)
 		return nil
 	}
-	if router.Macs.Enter(srcMac, router.Ourself.Peer) {
-		log.Println("Discovered local MAC", srcMac)
+	if macs.Enter(srcMac, router.Ourself.Peer) {
+		logRouter.Info("Discovered local MAC", srcMac)
+		router.Tenants.Learn(srcMac, tenant)
+		if router.FastPath != nil {
+			checkWarn(router.FastPath.DeleteMAC(srcMac))
+		}
 	}
 	if dec.DropFrame() {
 		return nil
 	}
+	if router.Flows != nil {
+		router.Flows.Frame(dec, len(frameData))
+	}
+	if router.Multicast.Snooping() {
+		router.snoopGroupChanges(dec)
+	}
+	if router.ARPProxy && router.proxyNeighbours(dec, injectFrame) {
+		return nil
+	}
+	if dec.IsLocal(macs, router.Ourself.Peer) {
+		// The bridge delivered it already
+		atomic.AddUint64(&router.localFrames, 1)
+		return nil
+	}
 	dstMac := dec.eth.DstMAC
-	dstPeer, found := router.Macs.Lookup(dstMac)
-	if found && dstPeer == router.Ourself.Peer {
+	dstPeer, found := macs.Lookup(dstMac)
+	if (found && dstPeer == router.Ourself.Peer) || router.Stopping() || router.Loops.Suspended() {
 		return nil
 	}
-	df := decodedLen == 2 && (dec.ip.Flags&layers.IPv4DontFragment != 0)
+	if router.Conntrack != nil && found {
+		router.Conntrack.Outbound(dstPeer.Name, dec)
+	}
+	if router.SFlow != nil {
+		dstName := UnknownPeerName
+		if found {
+			dstName = dstPeer.Name
+		}
+		router.SFlow.Sample(frameData, dec, router.Ourself.Name, dstName)
+	}
+	if router.ClampMSS {
+		// Broadcasts, with no dstPeer, fit all connections
+		dec.ClampMSS(router.effectivePMTU(dstPeer))
+	}
+	df := dec.DF()
 	if df {
 		router.LogFrame("Forwarding DF", frameData, &dec.eth)
 	} else {
 		router.LogFrame("Forwarding", frameData, &dec.eth)
 	}
 	// at this point we are handing over the frame to forwarders, so
-	// we need to make a copy of it in order to prevent the next
-	// capture from overwriting the data
-	frameLen := len(frameData)
-	frameCopy := make([]byte, frameLen, frameLen)
-	copy(frameCopy, frameData)
+	// we need to copy it, into a pooled buffer, in order to prevent
+	// the next capture from overwriting the data
+	fb := NewFrameBuffer()
+	frameCopy := fb.Copy(frameData)
+	dec.buf = fb
+	defer func() {
+		dec.buf = nil
+		fb.Release()
+	}()
 
-	if !found {
+	if !found && dec.IsSnoopableMulticast() && router.Multicast.Snooping() {
+		return checkFrameTooBig(router.Ourself.Multicast(df, frameCopy, dec))
+	} else if !found {
 		return checkFrameTooBig(router.Ourself.Broadcast(df, frameCopy, dec))
 	} else {
 		return checkFrameTooBig(router.Ourself.Forward(dstPeer, df, frameCopy, dec))
@@ -169,16 +587,16 @@ func (router *Router) handleCapturedPacket(frameData []byte, dec *EthernetDecode
 }
 
 func (router *Router) listenTCP(localPort int) {
-	localAddr, err := net.ResolveTCPAddr("tcp4", fmt.Sprint(":", localPort))
+	localAddr, err := net.ResolveTCPAddr("tcp", router.listenAddr(localPort))
 	checkFatal(err)
-	ln, err := net.ListenTCP("tcp4", localAddr)
+	ln, err := net.ListenTCP("tcp", localAddr)
 	checkFatal(err)
 	go func() {
 		defer ln.Close()
 		for {
 			tcpConn, err := ln.AcceptTCP()
 			if err != nil {
-				log.Println(err)
+				logConnection.Warn(err)
 				continue
 			}
 			router.acceptTCP(tcpConn)
@@ -191,26 +609,49 @@ func (router *Router) acceptTCP(tcpConn *net.TCPConn) {
 	// on Port and we wait for them to send us something on UDP to
 	// start.
 	remoteAddrStr := tcpConn.RemoteAddr().String()
-	log.Printf("->[%s] connection accepted\n", remoteAddrStr)
+	if !router.PeerACL.AllowAddr(tcpConn.RemoteAddr().(*net.TCPAddr).IP) {
+		logConnection.With("addr", remoteAddrStr).Info("connection rejected by peer rules")
+		tcpConn.Close()
+		return
+	}
+	logConnection.With("addr", remoteAddrStr).Info("connection accepted")
 	connRemote := NewRemoteConnection(router.Ourself.Peer, nil, remoteAddrStr, false)
 	connLocal := NewLocalConnection(connRemote, tcpConn, nil, router)
 	connLocal.Start(true)
 }
 
+// Listen on the port, with as many sockets as Listeners, each read by
+// a goroutine of its own, returning the first, which we send from.
 func (router *Router) listenUDP(localPort int, po PacketSink) *net.UDPConn {
-	localAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprint(":", localPort))
-	checkFatal(err)
-	conn, err := net.ListenUDP("udp4", localAddr)
-	checkFatal(err)
-	f, err := conn.File()
-	defer f.Close()
+	localAddr, err := net.ResolveUDPAddr("udp", router.listenAddr(localPort))
 	checkFatal(err)
-	fd := int(f.Fd())
-	// This one makes sure all packets we send out do not have DF set on them.
-	err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DONT)
-	checkFatal(err)
-	go router.udpReader(conn, po)
-	return conn
+	for i := 0; i < router.Listeners; i++ {
+		conn, err := listenUDPReusePort(localAddr, router.Listeners > 1)
+		checkFatal(err)
+		router.setupUDPListener(conn)
+		router.UDPListeners = append(router.UDPListeners, conn)
+		go router.udpReader(conn, po)
+	}
+	return router.UDPListeners[0]
+}
+
+func (router *Router) setupUDPListener(conn *net.UDPConn) {
+	tuning := router.CurrentTuning()
+	checkFatal(controlSocket(conn, func(fd int) error {
+		// This one makes sure all packets we send out do not have DF set on them.
+		if err := setPMTUDiscovery(fd, false); err != nil {
+			return err
+		}
+		if err := setTOS(fd, router.DSCP.socketTOS()); err != nil {
+			return err
+		}
+		if router.ECN {
+			if err := setRecvTOS(fd); err != nil {
+				return err
+			}
+		}
+		return setSocketBuffers(fd, tuning.SndBuf, tuning.RcvBuf)
+	}))
 }
 
 type UDPPacket struct {
@@ -225,46 +666,103 @@ func (packet UDPPacket) String() string {
 
 func (router *Router) udpReader(conn *net.UDPConn, po PacketSink) {
 	defer conn.Close()
-	dec := NewEthernetDecoder()
-	handleUDPPacket := router.handleUDPPacketFunc(dec, po)
-	buf := make([]byte, MaxUDPPacketSize)
+	// With ECN, packets come with their TOS
+	oobSize := 0
+	if router.ECN {
+		oobSize = syscall.CmsgSpace(4)
+	}
+	reader, err := NewMMsgReader(conn, router.RecvBatchSize, oobSize)
+	checkFatal(err)
+	var handle func(*ReceivedPacket)
+	if router.RecvWorkers > 0 {
+		handle = router.newRecvPool(router.RecvWorkers, po).dispatch
+	} else {
+		dec := NewEthernetDecoder()
+		handleUDPPacket := router.handleUDPPacketFunc(dec, po)
+		handle = func(packet *ReceivedPacket) {
+			router.handleReceivedPacket(packet, dec, handleUDPPacket)
+			packet.fb.Release()
+		}
+	}
 	for {
-		n, sender, err := conn.ReadFromUDP(buf)
+		n, err := reader.Read()
 		if err == io.EOF {
 			return
 		} else if err != nil {
-			log.Println("ignoring UDP read error", err)
-			continue
-		} else if n < NameSize {
-			log.Println("ignoring too short UDP packet from", sender)
+			logForwarder.Warn("ignoring UDP read error", err)
 			continue
 		}
-		name := PeerNameFromBin(buf[:NameSize])
-		packet := make([]byte, n-NameSize)
-		copy(packet, buf[NameSize:n])
-		udpPacket := &UDPPacket{
-			Name:   name,
-			Packet: packet,
-			Sender: sender}
-		peerConn, found := router.Ourself.ConnectionTo(name)
-		if !found {
-			continue
+		for i := 0; i < n; i++ {
+			handle(reader.Packet(i))
 		}
-		relayConn, ok := peerConn.(*LocalConnection)
-		if !ok {
-			continue
+	}
+}
+
+// Hand a packet to the connection it came in on.
+func (router *Router) handleReceivedPacket(received *ReceivedPacket, dec *EthernetDecoder, handleUDPPacket FrameConsumer) {
+	buf, sender := received.Bytes(), received.sender
+	if router.NAT.HandlePacket(buf, sender) {
+		return
+	} else if len(buf) < NameSize {
+		logForwarder.Info("ignoring too short UDP packet from", sender)
+		return
+	}
+	name := PeerNameFromBin(buf[:NameSize])
+	peerConn, found := router.Ourself.ConnectionTo(name)
+	if !found {
+		return
+	}
+	relayConn, ok := peerConn.(*LocalConnection)
+	if !ok || relayConn.UsingTCPFallback() {
+		return
+	}
+	packet, ok := relayConn.stripConnUID(buf[NameSize:])
+	if !ok {
+		return
+	}
+	udpPacket := &UDPPacket{
+		Name:   name,
+		Packet: packet,
+		Sender: sender}
+	router.Taps.Packet(relayConn, false, Port, sender, buf)
+	// Only the frames of unencrypted packets are in the packet's
+	// buffer; decryption puts the others in buffers of their own.
+	if _, ok := relayConn.Decryptor.(*NonDecryptor); ok {
+		dec.buf = received.fb
+		defer func() { dec.buf = nil }()
+	}
+	if !relayConn.receivePacket(handleUDPPacket, udpPacket) {
+		return
+	}
+	if relayConn.ecn && received.congested {
+		relayConn.congestionMarked()
+	}
+	if relayConn.connUIDs {
+		if remoteUDPAddr := relayConn.RemoteUDPAddr(); remoteUDPAddr != nil && remoteUDPAddr.String() != sender.String() && !relayConn.knownPath(sender) {
+			relayConn.ReceivedHeartbeat(sender, relayConn.uid)
 		}
-		err = relayConn.Decryptor.IterateFrames(handleUDPPacket, udpPacket)
-		if pde, ok := err.(PacketDecodingError); ok {
-			if pde.Fatal {
-				relayConn.Shutdown(pde)
-			} else {
-				relayConn.log(pde.Error())
-			}
+	}
+}
+
+// Decrypt a packet received from the remote peer, and hand the frames
+// it contains to the consumer, returning whether it decrypted.
+// Decryptors aren't thread-safe, and packets are best handled in the
+// order they arrived, so this handles one packet at a time, whichever
+// socket it arrived on.
+func (conn *LocalConnection) receivePacket(consume FrameConsumer, packet *UDPPacket) bool {
+	conn.receiving.Lock()
+	err := conn.Decryptor.IterateFrames(consume, packet)
+	conn.receiving.Unlock()
+	if pde, ok := err.(PacketDecodingError); ok {
+		if pde.Fatal {
+			conn.Shutdown(pde)
 		} else {
-			checkWarn(err)
+			conn.logger(logForwarder).Info(pde.Error())
 		}
+		return false
 	}
+	checkWarn(err)
+	return true
 }
 
 func (router *Router) handleUDPPacketFunc(dec *EthernetDecoder, po PacketSink) FrameConsumer {
@@ -274,11 +772,16 @@ func (router *Router) handleUDPPacketFunc(dec *EthernetDecoder, po PacketSink) F
 		}
 		return dec.CheckFrameTooBig(err,
 			func(icmpFrame []byte) error {
-				return router.Ourself.Forward(srcPeer, false, icmpFrame, nil)
+				// The ICMP packet goes back on the frame's tenant
+				var icmpDec *EthernetDecoder
+				if dec.tenant != 0 {
+					icmpDec = &EthernetDecoder{tenant: dec.tenant}
+				}
+				return router.Ourself.Forward(srcPeer, false, icmpFrame, icmpDec)
 			})
 	}
 
-	return func(relayConn *LocalConnection, sender *net.UDPAddr, srcNameByte, dstNameByte []byte, frameLen uint16, frame []byte) error {
+	return func(relayConn *LocalConnection, sender *net.UDPAddr, srcNameByte, dstNameByte []byte, tenant uint16, hops uint8, frameLen uint16, frame []byte) error {
 		srcName := PeerNameFromBin(srcNameByte)
 		dstName := PeerNameFromBin(dstNameByte)
 		srcPeer, found := router.Peers.Fetch(srcName)
@@ -310,7 +813,10 @@ func (router *Router) handleUDPPacketFunc(dec *EthernetDecoder, po PacketSink) F
 				return nil
 			}
 			switch {
-			case frameLen == EthernetOverhead+8:
+			case frameLen == EthernetOverhead+heartbeatUIDSize:
+				relayConn.ReceivedHeartbeat(sender, binary.BigEndian.Uint64(frame[EthernetOverhead:]))
+			case frameLen == EthernetOverhead+heartbeatQualitySize:
+				relayConn.ReceivedQualityHeartbeat(frame[EthernetOverhead:])
 				relayConn.ReceivedHeartbeat(sender, binary.BigEndian.Uint64(frame[EthernetOverhead:]))
 			case frameLen == FragTestSize && bytes.Equal(frame, FragTest):
 				relayConn.SendProtocolMsg(ProtocolMsg{ProtocolFragmentationReceived, nil})
@@ -322,11 +828,38 @@ func (router *Router) handleUDPPacketFunc(dec *EthernetDecoder, po PacketSink) F
 			}
 			return nil
 		}
+		// Nor are the frames of throughput tests for our hosts.
+		if decodedLen == 1 && dec.IsThroughputTest() {
+			if srcPeer == relayConn.Remote() && dstPeer == router.Ourself.Peer && relayConn.throughputTests {
+				router.Throughput.Received(relayConn, frame)
+			}
+			return nil
+		}
+		router.Taps.Frame(relayConn, false, srcName, frame, dec)
+		relayConn.countFrameSize(false, int(frameLen))
+		if router.Flows != nil {
+			router.Flows.Frame(dec, int(frameLen))
+		}
+		if router.SFlow != nil {
+			router.SFlow.Sample(frame, dec, srcName, dstName)
+		}
 
-		df := decodedLen == 2 && (dec.ip.Flags&layers.IPv4DontFragment != 0)
+		// Frames on the wrong tenant go no further, lest they reach
+		// the hosts of that tenant.
+		if !router.Tenants.Allow(dec, tenant) {
+			router.LogFrame("Refusing", frame, &dec.eth)
+			return nil
+		}
+		dec.tenant = tenant
+		dec.hops = hops
+
+		df := dec.DF()
 
 		if dstPeer != router.Ourself.Peer {
 			// it's not for us, we're just relaying it
+			if router.Stopping() || !relayConn.withinHopLimit(hops) {
+				return nil
+			}
 			if df {
 				router.LogFrame("Relaying DF", frame, &dec.eth)
 			} else {
@@ -338,14 +871,46 @@ func (router *Router) handleUDPPacketFunc(dec *EthernetDecoder, po PacketSink) F
 		srcMac := dec.eth.SrcMAC
 		dstMac := dec.eth.DstMAC
 
-		if router.Macs.Enter(srcMac, srcPeer) {
-			log.Println("Discovered remote MAC", srcMac, "at", srcName)
+		if dstMac[0]&1 == 1 && router.Dedup.Seen(srcNameByte, frame) {
+			atomic.AddUint64(&relayConn.stats.DuplicateDrops, 1)
+			return nil
+		}
+
+		macs := router.Tenants.Macs(tenant)
+		if macs == nil {
+			// None of our hosts can be on a tenant we don't know of
+			return nil
+		}
+		if macs.Enter(srcMac, srcPeer) {
+			logRouter.Info("Discovered remote MAC", srcMac, "at", srcName)
+			router.Tenants.Learn(srcMac, tenant)
+			router.updateFastPath(srcMac, srcPeer, relayConn)
+		}
+		if router.ClampMSS {
+			// The hosts here answer over the route back to the source
+			dec.ClampMSS(router.effectivePMTU(srcPeer))
+		}
+		if router.Conntrack != nil {
+			dec.state = router.Conntrack.Inbound(dec)
+		}
+		if router.Policy.Allow(srcName, dec) {
+			if router.Conntrack != nil {
+				router.Conntrack.Allowed(srcName, dec)
+			}
+			router.LogFrame("Injecting", frame, &dec.eth)
+			router.Loops.Injected(frame)
+			checkWarn(po.WritePacket(frame))
+		} else {
+			router.LogFrame("Denying", frame, &dec.eth)
 		}
-		router.LogFrame("Injecting", frame, &dec.eth)
-		checkWarn(po.WritePacket(frame))
 
-		dstPeer, found = router.Macs.Lookup(dstMac)
-		if !found || dstPeer != router.Ourself.Peer {
+		// Snooping peers send multicast frames straight to every
+		// peer which wants them.
+		if dec.IsSnoopableMulticast() && router.Multicast.SnoopingPeer(srcName) {
+			return nil
+		}
+		dstPeer, found = macs.Lookup(dstMac)
+		if (!found || dstPeer != router.Ourself.Peer) && !router.Stopping() && relayConn.withinHopLimit(hops) {
 			return checkFrameTooBig(router.Ourself.RelayBroadcast(srcPeer, df, frame, dec), srcPeer)
 		}
 
@@ -353,6 +918,21 @@ func (router *Router) handleUDPPacketFunc(dec *EthernetDecoder, po PacketSink) F
 	}
 }
 
+// Point the kernel fast path at the peer we have just seen the MAC
+// at, if it sent the frame to us directly and our connection to it
+// can use the fast path. Otherwise make sure the fast path no longer
+// claims the MAC, so the bridge hands frames for it to us.
+func (router *Router) updateFastPath(mac net.HardwareAddr, srcPeer *Peer, relayConn *LocalConnection) {
+	if router.FastPath == nil {
+		return
+	}
+	if ip := relayConn.fastPathDstFor(srcPeer); ip != nil {
+		checkWarn(router.FastPath.AddMAC(mac, ip))
+	} else {
+		checkWarn(router.FastPath.DeleteMAC(mac))
+	}
+}
+
 // Gossiper methods - the Router is the topology Gossiper
 
 func (router *Router) OnGossipUnicast(sender PeerName, msg []byte) error {
@@ -377,7 +957,7 @@ func (router *Router) OnGossip(buf []byte) ([]byte, error) {
 		// itself included in the update, and we didn't know about
 		// already. We ignore this; eventually we should receive an
 		// update containing a complete topology.
-		log.Println("Topology gossip:", err)
+		logGossip.Warn("Topology gossip:", err)
 		return nil, nil
 	}
 	if err != nil {
@@ -4,26 +4,41 @@ import (
 	"bytes"
 	"fmt"
 	"log"
-	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Routes struct {
-	sync.RWMutex
 	ourself   *Peer
 	peers     *Peers
-	unicast   map[PeerName]PeerName
-	broadcast map[PeerName][]PeerName
+	table     atomic.Value // *RoutingTable
+	routing   Routing
 	queryChan chan<- *Interaction
 }
 
-func NewRoutes(ourself *Peer, peers *Peers) *Routes {
+// The routes as calculated on one change of topology, along with the
+// connection frames for each destination go over. Tables never change
+// once built: every recalculation builds a new one, and swaps it in
+// atomically, so forwarding looks routes up without any locking, and
+// never sees a table half updated.
+type RoutingTable struct {
+	Generation uint64 // counting recalculations
+	Calculated time.Time
+	unicast    map[PeerName]PeerName
+	broadcast  map[PeerName][]PeerName
+	relays     map[PeerName]*LocalConnection // destination -> connection to the next hop
+}
+
+func NewRoutes(ourself *Peer, peers *Peers, routing Routing) *Routes {
 	routes := &Routes{
-		ourself:   ourself,
-		peers:     peers,
-		unicast:   make(map[PeerName]PeerName),
-		broadcast: make(map[PeerName][]PeerName)}
-	routes.unicast[ourself.Name] = UnknownPeerName
-	routes.broadcast[ourself.Name] = []PeerName{}
+		ourself: ourself,
+		peers:   peers,
+		routing: routing}
+	routes.table.Store(&RoutingTable{
+		Calculated: time.Now(),
+		unicast:    map[PeerName]PeerName{ourself.Name: UnknownPeerName},
+		broadcast:  map[PeerName][]PeerName{ourself.Name: {}},
+		relays:     make(map[PeerName]*LocalConnection)})
 	return routes
 }
 
@@ -33,17 +48,24 @@ func (routes *Routes) Start() {
 	go routes.queryLoop(queryChan)
 }
 
+// The routes currently in use
+func (routes *Routes) Table() *RoutingTable {
+	return routes.table.Load().(*RoutingTable)
+}
+
 func (routes *Routes) Unicast(name PeerName) (PeerName, bool) {
-	routes.RLock()
-	defer routes.RUnlock()
-	hop, found := routes.unicast[name]
+	hop, found := routes.Table().unicast[name]
 	return hop, found
 }
 
+// The connection to send frames for the peer over
+func (routes *Routes) Relay(name PeerName) (*LocalConnection, bool) {
+	conn, found := routes.Table().relays[name]
+	return conn, found
+}
+
 func (routes *Routes) Broadcast(name PeerName) []PeerName {
-	routes.RLock()
-	defer routes.RUnlock()
-	hops, found := routes.broadcast[name]
+	hops, found := routes.Table().broadcast[name]
 	if !found {
 		return []PeerName{}
 	}
@@ -52,14 +74,14 @@ func (routes *Routes) Broadcast(name PeerName) []PeerName {
 
 func (routes *Routes) String() string {
 	var buf bytes.Buffer
-	routes.RLock()
-	defer routes.RUnlock()
+	table := routes.Table()
+	buf.WriteString(fmt.Sprintf("generation %d, calculated %s\n", table.Generation, table.Calculated.Format(time.RFC3339)))
 	buf.WriteString(fmt.Sprintln("unicast:"))
-	for name, hop := range routes.unicast {
+	for name, hop := range table.unicast {
 		buf.WriteString(fmt.Sprintf("%s -> %s\n", name, hop))
 	}
 	buf.WriteString(fmt.Sprintln("broadcast:"))
-	for name, hops := range routes.broadcast {
+	for name, hops := range table.broadcast {
 		buf.WriteString(fmt.Sprintf("%s -> %v\n", name, hops))
 	}
 	return buf.String()
@@ -86,67 +108,30 @@ func (routes *Routes) queryLoop(queryChan <-chan *Interaction) {
 		}
 		switch query.code {
 		case RRecalculate:
-			unicast := routes.calculateUnicast()
-			broadcast := routes.calculateBroadcast()
-			routes.Lock()
-			routes.unicast = unicast
-			routes.broadcast = broadcast
-			routes.Unlock()
+			routes.table.Store(routes.calculate(routes.Table().Generation + 1))
 		default:
 			log.Fatal("Unexpected routes query:", query)
 		}
 	}
 }
 
-// Calculate all the routes for the question: if *we* want to send a
-// packet to Peer X, what is the next hop?
-//
-// When we sniff a packet, we determine the destination peer
-// ourself. Consequently, we can relay the packet via any
-// arbitrary peers - the intermediate peers do not have to have
-// any knowledge of the MAC address at all. Thus there's no need
-// to exchange knowledge of MAC addresses, nor any constraints on
-// the routes that we construct.
-func (routes *Routes) calculateUnicast() map[PeerName]PeerName {
-	_, unicast := routes.ourself.Routes(nil, true)
-	return unicast
-}
-
-// Calculate all the routes for the question: if we receive a
-// broadcast originally from Peer X, which peers should we pass the
-// frames on to?
-//
-// When the topology is stable, and thus all peers perform route
-// calculations based on the same data, the algorithm ensures that
-// broadcasts reach every peer exactly once.
-//
-// This is largely due to properties of the Peer.Routes algorithm. In
-// particular:
-//
-// ForAll X,Y,Z in Peers.
-//     X.Routes(Y) <= X.Routes(Z) \/
-//     X.Routes(Z) <= X.Routes(Y)
-// ForAll X,Y,Z in Peers.
-//     Y =/= Z /\ X.Routes(Y) <= X.Routes(Z) =>
-//     X.Routes(Y) u [P | Y.HasSymmetricConnectionTo(P)] <= X.Routes(Z)
-// where <= is the subset relationship on keys of the returned map.
-func (routes *Routes) calculateBroadcast() map[PeerName][]PeerName {
-	broadcast := make(map[PeerName][]PeerName)
-	ourself := routes.ourself
-
-	routes.peers.ForEach(func(name PeerName, peer *Peer) {
-		hops := []PeerName{}
-		if found, reached := peer.Routes(ourself, true); found {
-			ourself.ForEachConnection(func(remoteName PeerName, conn Connection) {
-				if _, found := reached[remoteName]; found {
-					return
-				}
-				if _, found := conn.Remote().ConnectionTo(ourself.Name); found {
-					hops = append(hops, remoteName)
-				}
-			})
+func (routes *Routes) calculate(generation uint64) *RoutingTable {
+	table := &RoutingTable{
+		Generation: generation,
+		unicast:    routes.routing.Unicast(routes.ourself, routes.peers),
+		broadcast:  routes.routing.Broadcast(routes.ourself, routes.peers),
+		relays:     make(map[PeerName]*LocalConnection)}
+	conns := make(map[PeerName]*LocalConnection)
+	routes.ourself.ForEachConnection(func(name PeerName, conn Connection) {
+		if localConn, ok := conn.(*LocalConnection); ok {
+			conns[name] = localConn
 		}
-		broadcast[name] = hops
 	})
-	return broadcast
+	for name, hop := range table.unicast {
+		if conn, found := conns[hop]; found {
+			table.relays[name] = conn
+		}
+	}
+	table.Calculated = time.Now()
+	return table
 }
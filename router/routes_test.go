@@ -0,0 +1,95 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"testing"
+	"time"
+)
+
+func TestRoutingTable(t *testing.T) {
+	peers, table := newTestTopology(3, [][2]int{{0, 1}, {1, 2}})
+	conn := &LocalConnection{RemoteConnection: RemoteConnection{local: peers[0], remote: peers[1], established: true}}
+	peers[0].SetVersionAndConnections(peers[0].Version()+1, map[PeerName]Connection{peers[1].Name: conn})
+
+	routes := NewRoutes(peers[0], table, NewHopCountRouting())
+	if _, found := routes.Relay(peers[2].Name); found {
+		wt.Fatalf(t, "Expected no relay before calculating routes")
+	}
+	routes.Start()
+	routes.Recalculate()
+	for start := time.Now(); routes.Table().Generation == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			wt.Fatalf(t, "Routes not recalculated")
+		}
+	}
+	for _, peer := range peers[1:] {
+		if relay, found := routes.Relay(peer.Name); !found || relay != conn {
+			wt.Fatalf(t, "Expected frames for %s to go over the connection to %s", peer.Name, peers[1].Name)
+		}
+		if hop, _ := routes.Unicast(peer.Name); hop != peers[1].Name {
+			wt.Fatalf(t, "Expected next hop to %s to be %s; got %s", peer.Name, peers[1].Name, hop)
+		}
+	}
+	status := routes.status()
+	wt.AssertEqualInt(t, int(status.Generation), 1, "generation")
+	wt.AssertEqualInt(t, len(status.Unicast), 3, "unicast routes")
+}
+
+// Routes as the test says, whatever the topology
+type fixedRouting struct {
+	unicast   map[PeerName]PeerName
+	broadcast map[PeerName][]PeerName
+	calls     int
+}
+
+func (routing *fixedRouting) Unicast(ourself *Peer, peers *Peers) map[PeerName]PeerName {
+	routing.calls++
+	return routing.unicast
+}
+
+func (routing *fixedRouting) Broadcast(ourself *Peer, peers *Peers) map[PeerName][]PeerName {
+	return routing.broadcast
+}
+
+func TestRoutingStrategy(t *testing.T) {
+	peers, table := newTestTopology(3, [][2]int{{0, 1}, {0, 2}, {1, 2}})
+	conn1 := &LocalConnection{RemoteConnection: RemoteConnection{local: peers[0], remote: peers[1], established: true}}
+	conn2 := &LocalConnection{RemoteConnection: RemoteConnection{local: peers[0], remote: peers[2], established: true}}
+	peers[0].SetVersionAndConnections(peers[0].Version()+1, map[PeerName]Connection{peers[1].Name: conn1, peers[2].Name: conn2})
+
+	// The long way round to peer 2, which hop count wouldn't take
+	routing := &fixedRouting{
+		unicast:   map[PeerName]PeerName{peers[0].Name: UnknownPeerName, peers[1].Name: peers[1].Name, peers[2].Name: peers[1].Name},
+		broadcast: map[PeerName][]PeerName{peers[0].Name: {peers[1].Name}}}
+	routes := NewRoutes(peers[0], table, routing)
+	routes.table.Store(routes.calculate(1))
+	wt.AssertEqualInt(t, routing.calls, 1, "routing calculations")
+	for _, peer := range peers[1:] {
+		if relay, _ := routes.Relay(peer.Name); relay != conn1 {
+			wt.Fatalf(t, "Expected frames for %s to go over the connection the routing chose", peer.Name)
+		}
+	}
+	if hops := routes.Broadcast(peers[0].Name); len(hops) != 1 || hops[0] != peers[1].Name {
+		wt.Fatalf(t, "Expected the broadcast routes the routing chose; got %v", hops)
+	}
+
+	routes = NewRoutes(peers[0], table, NewHopCountRouting())
+	routes.table.Store(routes.calculate(1))
+	if relay, _ := routes.Relay(peers[2].Name); relay != conn2 {
+		wt.Fatalf(t, "Expected frames for %s to go directly with hop count routing", peers[2].Name)
+	}
+}
+
+func TestRouterRouting(t *testing.T) {
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	if _, ok := NewRouter(RouterConfig{}, name).Routing.(HopCountRouting); !ok {
+		wt.Fatalf(t, "Expected hop count routing by default")
+	}
+	if _, ok := NewRouter(RouterConfig{QualityRouting: true}, name).Routing.(LinkQualityRouting); !ok {
+		wt.Fatalf(t, "Expected link quality routing with QualityRouting")
+	}
+	routing := &fixedRouting{}
+	if router := NewRouter(RouterConfig{Routing: routing, QualityRouting: true}, name); router.Routing != routing {
+		wt.Fatalf(t, "Expected the routing given to take precedence; got %T", router.Routing)
+	}
+}
@@ -0,0 +1,124 @@
+package router
+
+// How routes get chosen through the topology is up to a Routing
+// strategy, which the Routes actor consults whenever the topology
+// changes. It works out, from our point of view:
+//
+// - for unicast, the next hop on the way to each peer reachable from
+//   us, i.e. NextHop(ourself, dstPeer) for every dstPeer, and
+//
+// - for broadcast, the set of peers to pass on frames originating at
+//   each peer, i.e. BroadcastSet(srcPeer) for every srcPeer.
+//
+// Strategies may weigh connections however they like for unicast,
+// but broadcast routes must be such that every peer receives each
+// broadcast exactly once when the topology is stable, and every peer
+// must agree on them, so strategies had best leave broadcast to
+// HopCountRouting unless they know what they are doing.
+
+type Routing interface {
+	Unicast(ourself *Peer, peers *Peers) map[PeerName]PeerName     // destination -> next hop
+	Broadcast(ourself *Peer, peers *Peers) map[PeerName][]PeerName // source -> next hops
+}
+
+// Routes with the fewest hops, over established, symmetric
+// connections. This is the default.
+type HopCountRouting struct {
+	trees *SpanningTrees // kept across recalculations; nil to compute them afresh every time
+}
+
+func NewHopCountRouting() HopCountRouting {
+	return HopCountRouting{trees: NewSpanningTrees()}
+}
+
+// Calculate all the routes for the question: if *we* want to send a
+// packet to Peer X, what is the next hop?
+//
+// When we sniff a packet, we determine the destination peer
+// ourself. Consequently, we can relay the packet via any
+// arbitrary peers - the intermediate peers do not have to have
+// any knowledge of the MAC address at all. Thus there's no need
+// to exchange knowledge of MAC addresses, nor any constraints on
+// the routes that we construct.
+func (HopCountRouting) Unicast(ourself *Peer, peers *Peers) map[PeerName]PeerName {
+	_, unicast := ourself.Routes(nil, true)
+	return unicast
+}
+
+// Calculate all the routes for the question: if we receive a
+// broadcast originally from Peer X, which peers should we pass the
+// frames on to? Our children in the spanning tree of X; see
+// spanning_tree.go.
+//
+// When the topology is stable, and thus all peers perform route
+// calculations based on the same data, the trees ensure that
+// broadcasts reach every peer exactly once.
+func (routing HopCountRouting) Broadcast(ourself *Peer, peers *Peers) map[PeerName][]PeerName {
+	trees := routing.trees
+	if trees == nil {
+		trees = NewSpanningTrees()
+	}
+	return trees.Broadcast(ourself, peers)
+}
+
+// Unicast routes with the lowest cost, by the link qualities the
+// peers measured, over established, symmetric connections. Broadcast
+// routes are those of HopCountRouting, since they must be the same
+// everywhere, and peers may not all have heard the same measurements.
+type LinkQualityRouting struct {
+	qualities *LinkQualities
+	broadcast HopCountRouting
+}
+
+func NewLinkQualityRouting(qualities *LinkQualities) LinkQualityRouting {
+	return LinkQualityRouting{qualities: qualities, broadcast: NewHopCountRouting()}
+}
+
+func (routing LinkQualityRouting) Unicast(ourself *Peer, peers *Peers) map[PeerName]PeerName {
+	links := make(map[PeerName]map[PeerName]bool)
+	peers.ForEach(func(name PeerName, peer *Peer) {
+		links[name] = make(map[PeerName]bool)
+		peer.ForEachConnection(func(remoteName PeerName, conn Connection) {
+			if conn.Established() {
+				links[name][remoteName] = true
+			}
+		})
+	})
+	// Dijkstra's algorithm, remembering the first hop of the way to
+	// each peer, rather than the one before it.
+	unicast := map[PeerName]PeerName{ourself.Name: UnknownPeerName}
+	costs := map[PeerName]float64{ourself.Name: 0}
+	done := make(map[PeerName]bool)
+	for {
+		var cur PeerName
+		found := false
+		for name, cost := range costs {
+			if !done[name] && (!found || cost < costs[cur] || (cost == costs[cur] && name < cur)) {
+				cur, found = name, true
+			}
+		}
+		if !found {
+			return unicast
+		}
+		done[cur] = true
+		for remoteName := range links[cur] {
+			if done[remoteName] || !links[remoteName][cur] {
+				continue
+			}
+			cost := costs[cur] + routing.qualities.Cost(cur, remoteName)
+			if existing, found := costs[remoteName]; found && existing <= cost {
+				continue
+			}
+			costs[remoteName] = cost
+			if cur == ourself.Name {
+				unicast[remoteName] = remoteName
+			} else {
+				unicast[remoteName] = unicast[cur]
+			}
+		}
+	}
+}
+
+func (routing LinkQualityRouting) Broadcast(ourself *Peer, peers *Peers) map[PeerName][]PeerName {
+	return routing.broadcast.Broadcast(ourself, peers)
+}
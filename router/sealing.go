@@ -0,0 +1,80 @@
+package router
+
+// Sealing packets with NaCl is what limits the throughput of a
+// connection using it, and, since NaCl doesn't support several
+// encryption streams per connection, parallel forwarders are no help.
+// Instead, forwarders can hand the sealing of the packets they
+// assemble to a pool of workers shared by all connections, carrying
+// on with the next packet in the meantime. Each forwarder sends its
+// packets in the order it assembled them, whatever order they get
+// sealed in, so frames of a flow don't get reordered.
+
+// Encryptors which can leave the sealing of packets to someone else
+type DeferredEncryptor interface {
+	DeferredBytes() func() []byte
+}
+
+type SealPool struct {
+	jobs chan *sealJob
+}
+
+type sealJob struct {
+	seal       func() []byte
+	packet     []byte
+	done       chan struct{}
+	frames     int // frames in the packet
+	frameBytes int // bytes of those frames
+	heartbeat  bool
+	class      TrafficClass // the most urgent of the frames'
+}
+
+func NewSealPool(workers int) *SealPool {
+	pool := &SealPool{jobs: make(chan *sealJob, workers*ChannelSize)}
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+	return pool
+}
+
+func (pool *SealPool) work() {
+	for job := range pool.jobs {
+		job.packet = job.seal()
+		close(job.done)
+	}
+}
+
+// Queue the sealing, blocking while the workers are too busy to take
+// any more.
+func (pool *SealPool) Seal(job *sealJob) {
+	job.done = make(chan struct{})
+	pool.jobs <- job
+}
+
+// A forwarder's packets in the order it assembled them, while they get
+// sealed
+type sealQueue []*sealJob
+
+func (queue *sealQueue) push(job *sealJob) {
+	*queue = append(*queue, job)
+}
+
+// Take the packet at the head of the queue, if there is one, waiting
+// for its sealing to finish if wait is set.
+func (queue *sealQueue) pop(wait bool) (*sealJob, bool) {
+	if len(*queue) == 0 {
+		return nil, false
+	}
+	job := (*queue)[0]
+	if wait {
+		<-job.done
+	} else {
+		select {
+		case <-job.done:
+		default:
+			return nil, false
+		}
+	}
+	(*queue)[0] = nil
+	*queue = (*queue)[1:]
+	return job, true
+}
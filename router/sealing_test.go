@@ -0,0 +1,51 @@
+package router
+
+import (
+	"code.google.com/p/go.crypto/nacl/secretbox"
+	"encoding/binary"
+	wt "github.com/zettio/weave/testing"
+	"testing"
+)
+
+func TestSealPool(t *testing.T) {
+	conn, _ := newTestGCMConnPair()
+	finished := make(chan struct{})
+	close(finished)
+	conn.finished = finished // so that sending nonces to the remote peer doesn't block
+	enc := NewNaClEncryptor(conn.local.NameByte, conn, false)
+	pool := NewSealPool(4)
+	var queue sealQueue
+	frame := &ForwardedFrame{srcPeer: conn.local, dstPeer: conn.remote, frame: []byte("hello world")}
+	var packets [][]byte
+	for i := 0; i < 8; i++ {
+		enc.AppendFrame(frame)
+		if i%2 == 0 {
+			packets = append(packets, append([]byte{}, enc.Bytes()...))
+			continue
+		}
+		// Sealed packets come off the queue in order
+		job := &sealJob{seal: enc.DeferredBytes(), frames: i}
+		pool.Seal(job)
+		queue.push(job)
+		job, ok := queue.pop(true)
+		if !ok || job.frames != i {
+			wt.Fatalf(t, "Expected sealed packet %d", i)
+		}
+		packets = append(packets, job.packet)
+	}
+	if _, ok := queue.pop(true); ok {
+		wt.Fatalf(t, "Expected empty queue")
+	}
+	prefixLen := len(conn.local.NameByte)
+	for i, packet := range packets {
+		offset := binary.BigEndian.Uint16(packet[prefixLen:])
+		wt.AssertEqualInt(t, int(offset), i, "nonce offset")
+		nonce := *enc.nonce
+		SetNonceLow15Bits(&nonce, offset)
+		plaintext, ok := secretbox.Open(nil, packet[prefixLen+2:], &nonce, conn.SessionKey)
+		if !ok {
+			wt.Fatalf(t, "Unable to open packet %d", i)
+		}
+		wt.AssertEqualInt(t, len(plaintext), enc.FrameOverhead()+len(frame.frame), "plaintext length")
+	}
+}
@@ -0,0 +1,273 @@
+package router
+
+import (
+	"bytes"
+	"code.google.com/p/gopacket/layers"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Export of a sample of the frames we forward as sFlow version 5, so
+// that overlay traffic shows up in the network monitoring pipelines
+// which already collect sFlow from switches. We pick one in every
+// rate frames at random, and send the collector the first
+// SFlowHeaderSize bytes of each, with its inner IP addresses and ports
+// decoded, and the peers it is from and to as the source and
+// destination users, for want of anywhere better in the standard
+// records. Samples are sent SFlowMaxSamples to a datagram, or after
+// SFlowInterval; those which don't fit in the queue are counted as
+// dropped, as sFlow expects, rather than holding up forwarding.
+
+const (
+	sflowVersion       = 5
+	sflowFlowSample    = 1
+	sflowSampledHeader = 1
+	sflowSampledIPv4   = 3
+	sflowSampledIPv6   = 4
+	sflowExtendedUser  = 1004
+	sflowEthernet      = 1
+	sflowUTF8          = 106
+)
+
+type SFlowExporter struct {
+	sync.Mutex
+	collector string
+	conn      *net.UDPConn
+	agent     net.IP
+	rate      int
+	started   time.Time
+	random    *rand.Rand
+	skip      int    // frames to go until the next sample
+	pool      uint32 // frames we could have sampled
+	drops     uint32 // samples which didn't fit in the queue
+	sequence  uint32 // of samples
+	sent      uint64 // samples sent to the collector
+	samples   chan []byte
+}
+
+// Sample one in every rate frames, sending them to the collector at
+// host:port.
+func NewSFlowExporter(collector string, rate int) (*SFlowExporter, error) {
+	if rate < 1 {
+		return nil, fmt.Errorf("Invalid sFlow sampling rate %d", rate)
+	}
+	addr, err := net.ResolveUDPAddr("udp", collector)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	exp := &SFlowExporter{
+		collector: collector,
+		conn:      conn,
+		agent:     conn.LocalAddr().(*net.UDPAddr).IP,
+		rate:      rate,
+		started:   time.Now(),
+		random:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		samples:   make(chan []byte, SFlowQueueSize)}
+	exp.skip = exp.nextSkip()
+	return exp, nil
+}
+
+func (exp *SFlowExporter) Start() {
+	go exp.run()
+}
+
+// Random, averaging the rate, so that sampling doesn't fall into step
+// with periodic traffic.
+func (exp *SFlowExporter) nextSkip() int {
+	return exp.random.Intn(2*exp.rate-1) + 1
+}
+
+// Called for every frame we forward, with the peers it is from and to,
+// the latter unknown for broadcasts.
+func (exp *SFlowExporter) Sample(frame []byte, dec *EthernetDecoder, src, dst PeerName) {
+	exp.Lock()
+	exp.pool++
+	if exp.skip--; exp.skip > 0 {
+		exp.Unlock()
+		return
+	}
+	exp.skip = exp.nextSkip()
+	exp.sequence++
+	sample := exp.flowSample(exp.sequence, exp.pool, exp.drops, frame, dec, src, dst)
+	select {
+	case exp.samples <- sample:
+	default:
+		exp.drops++
+	}
+	exp.Unlock()
+}
+
+func (exp *SFlowExporter) run() {
+	ticker := time.NewTicker(SFlowInterval)
+	var samples [][]byte
+	var sequence uint32
+	for {
+		select {
+		case sample := <-exp.samples:
+			if samples = append(samples, sample); len(samples) < SFlowMaxSamples {
+				continue
+			}
+		case <-ticker.C:
+			if len(samples) == 0 {
+				continue
+			}
+		}
+		sequence++
+		if _, err := exp.conn.Write(exp.datagram(sequence, time.Now(), samples)); err != nil {
+			logRouter.With("collector", exp.collector).Debug("Unable to send sFlow samples:", err)
+		} else {
+			exp.Lock()
+			exp.sent += uint64(len(samples))
+			exp.Unlock()
+		}
+		samples = samples[:0]
+	}
+}
+
+func (exp *SFlowExporter) String() string {
+	exp.Lock()
+	defer exp.Unlock()
+	return fmt.Sprintf("sampling 1 in %d frames to %s; %d samples sent, %d dropped\n", exp.rate, exp.collector, exp.sent, exp.drops)
+}
+
+// sFlow is in XDR
+type xdrWriter struct {
+	bytes.Buffer
+}
+
+func (w *xdrWriter) u32(v uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	w.Write(buf[:])
+}
+
+// Variable length opaque data, padded to a multiple of four bytes
+func (w *xdrWriter) opaque(data []byte) {
+	w.u32(uint32(len(data)))
+	w.Write(data)
+	w.Write(make([]byte, (4-len(data)%4)%4))
+}
+
+// A record, or sample, of the format, prefixed with its length
+func (w *xdrWriter) record(format uint32, data []byte) {
+	w.u32(format)
+	w.opaque(data)
+}
+
+func (exp *SFlowExporter) datagram(sequence uint32, now time.Time, samples [][]byte) []byte {
+	var w xdrWriter
+	w.u32(sflowVersion)
+	if ip4 := exp.agent.To4(); ip4 != nil {
+		w.u32(1)
+		w.Write(ip4)
+	} else {
+		w.u32(2)
+		w.Write(exp.agent.To16())
+	}
+	w.u32(0) // sub-agent
+	w.u32(sequence)
+	w.u32(uint32(now.Sub(exp.started) / time.Millisecond))
+	w.u32(uint32(len(samples)))
+	for _, sample := range samples {
+		w.record(sflowFlowSample, sample)
+	}
+	return w.Bytes()
+}
+
+func (exp *SFlowExporter) flowSample(sequence, pool, drops uint32, frame []byte, dec *EthernetDecoder, src, dst PeerName) []byte {
+	var w xdrWriter
+	w.u32(sequence)
+	w.u32(0) // source: the router as a whole rather than an interface
+	w.u32(uint32(exp.rate))
+	w.u32(pool)
+	w.u32(drops)
+	w.u32(0) // input and output interfaces, unknown
+	w.u32(0)
+
+	var records xdrWriter
+	count := uint32(0)
+	header := frame
+	if len(header) > SFlowHeaderSize {
+		header = header[:SFlowHeaderSize]
+	}
+	var rec xdrWriter
+	rec.u32(sflowEthernet)
+	rec.u32(uint32(len(frame)) + 4) // with the FCS, as on the wire
+	rec.u32(4)                      // stripped: the FCS
+	rec.opaque(header)
+	records.record(sflowSampledHeader, rec.Bytes())
+	count++
+
+	if format, data := sampledIP(dec); data != nil {
+		records.record(format, data)
+		count++
+	}
+
+	rec.Reset()
+	rec.u32(sflowUTF8)
+	rec.opaque([]byte(peerNameOrEmpty(src)))
+	rec.u32(sflowUTF8)
+	rec.opaque([]byte(peerNameOrEmpty(dst)))
+	records.record(sflowExtendedUser, rec.Bytes())
+	count++
+
+	w.u32(count)
+	w.Write(records.Bytes())
+	return w.Bytes()
+}
+
+func peerNameOrEmpty(name PeerName) string {
+	if name == UnknownPeerName {
+		return ""
+	}
+	return name.String()
+}
+
+// The inner IP addresses and ports of the frame, if it is IP
+func sampledIP(dec *EthernetDecoder) (uint32, []byte) {
+	var w xdrWriter
+	var format uint32
+	var protocol layers.IPProtocol
+	var payload []byte
+	var tos uint8
+	switch {
+	case dec.IsIPv4():
+		format, protocol, payload, tos = sflowSampledIPv4, dec.ip.Protocol, dec.ip.Payload, dec.ip.TOS
+		if dec.ip.FragOffset != 0 {
+			payload = nil
+		}
+		w.u32(uint32(dec.ip.Length))
+		w.u32(uint32(protocol))
+		w.Write(dec.ip.SrcIP.To4())
+		w.Write(dec.ip.DstIP.To4())
+	case dec.IsIPv6():
+		format, protocol, payload, tos = sflowSampledIPv6, dec.ip6.NextHeader, dec.ip6.Payload, dec.ip6.TrafficClass
+		w.u32(uint32(dec.ip6.Length) + 40)
+		w.u32(uint32(protocol))
+		w.Write(dec.ip6.SrcIP.To16())
+		w.Write(dec.ip6.DstIP.To16())
+	default:
+		return 0, nil
+	}
+	var srcPort, dstPort, tcpFlags uint32
+	if (protocol == layers.IPProtocolTCP || protocol == layers.IPProtocolUDP) && len(payload) >= 4 {
+		srcPort = uint32(binary.BigEndian.Uint16(payload[0:2]))
+		dstPort = uint32(binary.BigEndian.Uint16(payload[2:4]))
+		if protocol == layers.IPProtocolTCP && len(payload) >= 14 {
+			tcpFlags = uint32(payload[13])
+		}
+	}
+	w.u32(srcPort)
+	w.u32(dstPort)
+	w.u32(tcpFlags)
+	w.u32(uint32(tos))
+	return format, w.Bytes()
+}
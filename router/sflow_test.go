@@ -0,0 +1,58 @@
+package router
+
+import (
+	"code.google.com/p/gopacket"
+	"code.google.com/p/gopacket/layers"
+	"encoding/binary"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSFlowExport(t *testing.T) {
+	collector, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	wt.AssertNoErr(t, err)
+	defer collector.Close()
+	exp, err := NewSFlowExporter(collector.LocalAddr().String(), 1)
+	wt.AssertNoErr(t, err)
+	exp.Start()
+
+	buf := gopacket.NewSerializeBuffer()
+	wt.AssertNoErr(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.Ethernet{SrcMAC: net.HardwareAddr{2, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{2, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4},
+		&layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(10, 0, 0, 2)},
+		&layers.UDP{SrcPort: 1234, DstPort: 53},
+		gopacket.Payload(make([]byte, 200))))
+	frame := buf.Bytes()
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(frame)
+	for i := 0; i < SFlowMaxSamples; i++ {
+		exp.Sample(frame, dec, PeerName(1), UnknownPeerName)
+	}
+
+	datagram := make([]byte, 65536)
+	collector.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := collector.Read(datagram)
+	wt.AssertNoErr(t, err)
+	datagram = datagram[:n]
+	u32 := func(offset int) uint32 { return binary.BigEndian.Uint32(datagram[offset:]) }
+	wt.AssertEqualInt(t, int(u32(0)), sflowVersion, "version")
+	wt.AssertEqualString(t, net.IP(datagram[8:12]).String(), "127.0.0.1", "agent address")
+	wt.AssertEqualInt(t, int(u32(24)), SFlowMaxSamples, "samples")
+
+	// The first sample, and its records
+	wt.AssertEqualInt(t, int(u32(28)), sflowFlowSample, "sample format")
+	sample := datagram[36 : 36+u32(32)]
+	wt.AssertEqualInt(t, int(binary.BigEndian.Uint32(sample[8:])), 1, "sampling rate")
+	wt.AssertEqualInt(t, int(binary.BigEndian.Uint32(sample[28:])), 3, "records")
+	header := sample[32:]
+	wt.AssertEqualInt(t, int(binary.BigEndian.Uint32(header)), sflowSampledHeader, "header record format")
+	wt.AssertEqualInt(t, int(binary.BigEndian.Uint32(header[12:])), len(frame)+4, "frame length")
+	wt.AssertEqualInt(t, int(binary.BigEndian.Uint32(header[20:])), SFlowHeaderSize, "header length")
+	ip := header[8+binary.BigEndian.Uint32(header[4:]):]
+	wt.AssertEqualInt(t, int(binary.BigEndian.Uint32(ip)), sflowSampledIPv4, "IP record format")
+	wt.AssertEqualString(t, net.IP(ip[16:20]).String()+" "+net.IP(ip[20:24]).String(), "10.0.0.1 10.0.0.2", "addresses")
+	wt.AssertEqualInt(t, int(binary.BigEndian.Uint32(ip[24:])), 1234, "source port")
+	wt.AssertEqualInt(t, int(binary.BigEndian.Uint32(ip[28:])), 53, "destination port")
+}
@@ -0,0 +1,154 @@
+package router
+
+import (
+	"sort"
+)
+
+// Broadcast routing over spanning trees. For each source of
+// broadcasts, every peer works out the same spanning tree of the
+// topology: the shortest paths from the source, over established,
+// symmetric connections, with each peer receiving broadcasts from the
+// lowest named of its neighbours one hop closer to the source. We pass
+// on a broadcast only to our children in the tree of its source, so
+// that every peer receives it exactly once, however richly connected
+// the mesh, while the topology is stable.
+//
+// The trees only depend on the links between peers, so we keep them
+// across recalculations, and only recompute those of the sources which
+// a change of links might affect: a link between two peers the same
+// number of hops from the source is on none of the shortest paths
+// from it, and so can come and go without changing its tree.
+
+// The neighbours of each peer over established, symmetric
+// connections, in order of their names
+type linkGraph map[PeerName][]PeerName
+
+type spanningTree struct {
+	hops    map[PeerName]int      // from the source, of every peer it reaches
+	parents map[PeerName]PeerName // the peer each receives broadcasts from
+}
+
+type SpanningTrees struct {
+	graph linkGraph
+	trees map[PeerName]*spanningTree
+}
+
+func NewSpanningTrees() *SpanningTrees {
+	return &SpanningTrees{graph: make(linkGraph), trees: make(map[PeerName]*spanningTree)}
+}
+
+type peerNames []PeerName
+
+func (names peerNames) Len() int           { return len(names) }
+func (names peerNames) Swap(i, j int)      { names[i], names[j] = names[j], names[i] }
+func (names peerNames) Less(i, j int) bool { return names[i] < names[j] }
+
+func topologyGraph(peers *Peers) linkGraph {
+	links := make(map[PeerName]map[PeerName]bool)
+	peers.ForEach(func(name PeerName, peer *Peer) {
+		links[name] = make(map[PeerName]bool)
+		peer.ForEachConnection(func(remoteName PeerName, conn Connection) {
+			if conn.Established() {
+				links[name][remoteName] = true
+			}
+		})
+	})
+	graph := make(linkGraph)
+	for name, remotes := range links {
+		neighbours := []PeerName{}
+		for remoteName := range remotes {
+			if links[remoteName][name] {
+				neighbours = append(neighbours, remoteName)
+			}
+		}
+		sort.Sort(peerNames(neighbours))
+		graph[name] = neighbours
+	}
+	return graph
+}
+
+// The links, as pairs of peers with the lower named first, in one
+// graph but not the other
+func changedLinks(graph1, graph2 linkGraph) [][2]PeerName {
+	var changed [][2]PeerName
+	diff := func(from, to linkGraph) {
+		for name, neighbours := range from {
+			for _, remoteName := range neighbours {
+				if name < remoteName && !to.linked(name, remoteName) {
+					changed = append(changed, [2]PeerName{name, remoteName})
+				}
+			}
+		}
+	}
+	diff(graph1, graph2)
+	diff(graph2, graph1)
+	return changed
+}
+
+func (graph linkGraph) linked(name1, name2 PeerName) bool {
+	neighbours := graph[name1]
+	i := sort.Search(len(neighbours), func(i int) bool { return neighbours[i] >= name2 })
+	return i < len(neighbours) && neighbours[i] == name2
+}
+
+// Breadth first from the source, level by level
+func (graph linkGraph) spanningTree(source PeerName) *spanningTree {
+	tree := &spanningTree{
+		hops:    map[PeerName]int{source: 0},
+		parents: make(map[PeerName]PeerName)}
+	level := []PeerName{source}
+	for hops := 1; len(level) > 0; hops++ {
+		sort.Sort(peerNames(level))
+		next := []PeerName{}
+		for _, name := range level {
+			for _, remoteName := range graph[name] {
+				if _, found := tree.hops[remoteName]; !found {
+					tree.hops[remoteName] = hops
+					tree.parents[remoteName] = name
+					next = append(next, remoteName)
+				}
+			}
+		}
+		level = next
+	}
+	return tree
+}
+
+// Whether the tree holds, despite the links changing
+func (tree *spanningTree) unaffectedBy(changed [][2]PeerName) bool {
+	for _, link := range changed {
+		hops1, found1 := tree.hops[link[0]]
+		hops2, found2 := tree.hops[link[1]]
+		if !found1 || !found2 || hops1 != hops2 {
+			return false
+		}
+	}
+	return true
+}
+
+// Bring the trees up to date with the topology, and return the peers
+// to pass on broadcasts from each source to.
+func (trees *SpanningTrees) Broadcast(ourself *Peer, peers *Peers) map[PeerName][]PeerName {
+	graph := topologyGraph(peers)
+	changed := changedLinks(trees.graph, graph)
+	updated := make(map[PeerName]*spanningTree)
+	for name := range graph {
+		if tree, found := trees.trees[name]; found && tree.unaffectedBy(changed) {
+			updated[name] = tree
+		} else {
+			updated[name] = graph.spanningTree(name)
+		}
+	}
+	trees.graph, trees.trees = graph, updated
+	broadcast := make(map[PeerName][]PeerName)
+	for name, tree := range updated {
+		hops := []PeerName{}
+		for _, remoteName := range graph[ourself.Name] {
+			if parent, found := tree.parents[remoteName]; found && parent == ourself.Name {
+				hops = append(hops, remoteName)
+			}
+		}
+		broadcast[name] = hops
+	}
+	return broadcast
+}
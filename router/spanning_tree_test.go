@@ -0,0 +1,113 @@
+package router
+
+import (
+	"fmt"
+	wt "github.com/zettio/weave/testing"
+	"math/rand"
+	"testing"
+)
+
+// A topology of the peers, with the links between them
+func newTestTopology(n int, links [][2]int) ([]*Peer, *Peers) {
+	peers := make([]*Peer, n)
+	name, _ := PeerNameFromString("00:00:00:01:00:00")
+	peers[0] = NewPeer(name, 0, 0)
+	table := NewPeers(peers[0], func(*Peer) {}, func(*Peer) {})
+	table.FetchWithDefault(peers[0])
+	for i := 1; i < n; i++ {
+		name, _ := PeerNameFromString(fmt.Sprintf("%02d:00:00:01:00:00", i))
+		peers[i] = table.FetchWithDefault(NewPeer(name, 0, 0))
+	}
+	setTestLinks(peers, links)
+	return peers, table
+}
+
+func setTestLinks(peers []*Peer, links [][2]int) {
+	conns := make([]map[PeerName]Connection, len(peers))
+	for i := range peers {
+		conns[i] = make(map[PeerName]Connection)
+	}
+	for _, link := range links {
+		from, to := peers[link[0]], peers[link[1]]
+		conns[link[0]][to.Name] = NewRemoteConnection(from, to, "", true)
+		conns[link[1]][from.Name] = NewRemoteConnection(to, from, "", true)
+	}
+	for i, peer := range peers {
+		peer.SetVersionAndConnections(peer.Version()+1, conns[i])
+	}
+}
+
+func TestSpanningTrees(t *testing.T) {
+	peers, table := newTestTopology(4, [][2]int{{0, 1}, {0, 2}, {1, 2}, {1, 3}, {2, 3}})
+	trees := make([]*SpanningTrees, len(peers))
+	broadcast := make([]map[PeerName][]PeerName, len(peers))
+	for i, peer := range peers {
+		trees[i] = NewSpanningTrees()
+		broadcast[i] = trees[i].Broadcast(peer, table)
+	}
+	// Peer 3 receives broadcasts from peer 0 via the lower named of
+	// peers 1 and 2 only
+	wt.AssertEqualString(t, fmt.Sprint(broadcast[0][peers[0].Name]), fmt.Sprint([]PeerName{peers[1].Name, peers[2].Name}), "hops of peer 0")
+	wt.AssertEqualString(t, fmt.Sprint(broadcast[1][peers[0].Name]), fmt.Sprint([]PeerName{peers[3].Name}), "hops of peer 1")
+	wt.AssertEqualInt(t, len(broadcast[2][peers[0].Name]), 0, "hops of peer 2")
+
+	// Dropping the link between peers 1 and 2, equally far from peer
+	// 0, leaves the tree of the latter as it is
+	tree0 := trees[1].trees[peers[0].Name]
+	tree1 := trees[1].trees[peers[1].Name]
+	setTestLinks(peers, [][2]int{{0, 1}, {0, 2}, {1, 3}, {2, 3}})
+	trees[1].Broadcast(peers[1], table)
+	if trees[1].trees[peers[0].Name] != tree0 {
+		wt.Fatalf(t, "Expected unaffected tree to be kept")
+	}
+	if trees[1].trees[peers[1].Name] == tree1 {
+		wt.Fatalf(t, "Expected affected tree to be recomputed")
+	}
+}
+
+// However we mesh peers, broadcasts reach each of them exactly once
+func TestSpanningTreesDeliverOnce(t *testing.T) {
+	const numPeers = 10
+	rng := rand.New(rand.NewSource(1))
+	trees := make([]*SpanningTrees, numPeers)
+	for i := range trees {
+		trees[i] = NewSpanningTrees()
+	}
+	peers, table := newTestTopology(numPeers, nil)
+	for round := 0; round < 20; round++ {
+		var links [][2]int
+		for i := 1; i < numPeers; i++ {
+			// Connected, and then some
+			links = append(links, [2]int{rng.Intn(i), i})
+			for j := 0; j < i; j++ {
+				if rng.Intn(3) == 0 {
+					links = append(links, [2]int{j, i})
+				}
+			}
+		}
+		setTestLinks(peers, links)
+		index := make(map[PeerName]int)
+		routes := make([]map[PeerName][]PeerName, numPeers)
+		for i, peer := range peers {
+			routes[i] = trees[i].Broadcast(peer, table)
+			index[peer.Name] = i
+		}
+		for _, src := range peers {
+			received := map[PeerName]int{src.Name: 1}
+			pending := []PeerName{src.Name}
+			for len(pending) > 0 {
+				cur := pending[0]
+				pending = pending[1:]
+				for _, hop := range routes[index[cur]][src.Name] {
+					received[hop]++
+					pending = append(pending, hop)
+				}
+			}
+			for _, peer := range peers {
+				if received[peer.Name] != 1 {
+					wt.Fatalf(t, "Round %d: broadcast from %s reached %s %d times", round, src.Name, peer.Name, received[peer.Name])
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package router
+
+import (
+	"net"
+	"time"
+)
+
+// Standby paths. Where both peers run with -standby, and the remote
+// told us more than one address (see multihoming.go), an established
+// connection keeps a standby path, to another of the remote's
+// addresses, besides the active one it sends over. Every StandbyProbe
+// it sends a STUN binding request down each path, which the remote
+// answers as it does when punching holes through NATs; see nat.go.
+// Once the active path has gone unanswered for StandbyTimeout while
+// the standby path answers, the connection switches over, and the old
+// active path becomes the standby one. That takes well under a
+// heartbeat interval, where without a standby path it takes
+// FailoverHeartbeats slow ones, and as before the connection, its
+// forwarders and session keys, carry on as they are.
+
+type standbyPaths struct {
+	probe    *time.Ticker
+	addr     *net.UDPAddr         // of the standby path; nil while the remote has no other
+	answered map[string]time.Time // when each of the remote's addresses last answered a probe
+	since    time.Time            // when we started probing
+}
+
+func newStandbyPaths(now time.Time) *standbyPaths {
+	return &standbyPaths{answered: make(map[string]time.Time), since: now}
+}
+
+// Whether the path to the address went unanswered for StandbyTimeout
+func (paths *standbyPaths) unanswered(addr *net.UDPAddr, now time.Time) bool {
+	last := paths.answered[addr.String()]
+	if last.Before(paths.since) {
+		last = paths.since
+	}
+	return now.Sub(last) > StandbyTimeout
+}
+
+// Whether to switch from the active path to the standby one
+func (paths *standbyPaths) shouldSwitch(active *net.UDPAddr, now time.Time) bool {
+	return paths.addr != nil && paths.unanswered(active, now) && !paths.unanswered(paths.addr, now)
+}
+
+func (conn *LocalConnection) startStandby() {
+	if !(conn.standbyPaths || conn.multiPath) || conn.sendingOverTCP || conn.encap != EncapWeave || conn.standby != nil {
+		return
+	}
+	conn.standby = newStandbyPaths(time.Now())
+	conn.standby.probe = time.NewTicker(StandbyProbe)
+	conn.probePaths()
+}
+
+func (conn *LocalConnection) standbyProbe() *time.Ticker {
+	if conn.standby == nil {
+		return nil
+	}
+	return conn.standby.probe
+}
+
+func (conn *LocalConnection) stopStandby() {
+	if conn.standby != nil {
+		stopTicker(conn.standby.probe)
+		conn.standby = nil
+		conn.setPaths(nil)
+	}
+}
+
+// Called on every StandbyProbe
+func (conn *LocalConnection) probePaths() {
+	paths := conn.standby
+	active := conn.remoteUDPAddr
+	if conn.sendingOverTCP || active == nil {
+		conn.stopStandby()
+		return
+	}
+	if paths.addr == nil || paths.addr.String() == active.String() {
+		// The remote moved, perhaps to the standby address
+		paths.addr = nextRemoteAddr(conn.remoteAddrs, active)
+	}
+	if now := time.Now(); paths.shouldSwitch(active, now) {
+		conn.logger(logConnection).Info("Path to", active, "unanswered for", StandbyTimeout, "- switching to standby path to", paths.addr)
+		conn.failOver(paths.addr)
+		paths.addr, active = active, paths.addr
+	}
+	probed := []*net.UDPAddr{active, paths.addr}
+	if conn.multiPath {
+		// All paths need to answer to carry flows
+		conn.updatePaths(time.Now())
+		probed = append(probed, conn.remoteAddrs...)
+	}
+	sent := make(map[string]bool)
+	for _, addr := range probed {
+		if addr == nil || sent[addr.String()] {
+			continue
+		}
+		sent[addr.String()] = true
+		// Paths we can't send down are simply unanswered
+		conn.Router.UDPListener.WriteToUDP(formSTUN(stunBindingRequest, conn.punchTxID(), nil), addr)
+	}
+}
+
+// Async. The remote answered a STUN binding request we sent it,
+// whether to punch through NATs, or to probe a path.
+func (conn *LocalConnection) ProbeAnswered(remoteUDPAddr *net.UDPAddr) {
+	conn.sendQuery(CProbeAnswered, remoteUDPAddr)
+}
+
+func (conn *LocalConnection) handleProbeAnswered(remoteUDPAddr *net.UDPAddr) error {
+	if conn.standby != nil {
+		conn.standby.answered[remoteUDPAddr.String()] = time.Now()
+	}
+	return conn.handlePunchedThrough(remoteUDPAddr)
+}
+
+// Whether to ignore the remote's packets arriving from the address
+// as a sign it moved there: not when we switched away from it since it
+// stopped answering, for fear of flapping between paths.
+func (conn *LocalConnection) pathUnanswered(remoteUDPAddr *net.UDPAddr) bool {
+	paths := conn.standby
+	return paths != nil && paths.addr != nil && paths.addr.String() == remoteUDPAddr.String() &&
+		paths.unanswered(remoteUDPAddr, time.Now())
+}
@@ -0,0 +1,68 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"testing"
+	"time"
+)
+
+func TestStandbySwitch(t *testing.T) {
+	addrs, err := decodeCandidates([]byte("10.0.0.1:6783,10.0.1.1:6783"))
+	wt.AssertNoErr(t, err)
+	active, standby := addrs[0], addrs[1]
+	start := time.Now()
+	paths := newStandbyPaths(start)
+	paths.addr = standby
+
+	// Neither path has answered yet; give them time to
+	paths.answered[standby.String()] = start
+	if paths.shouldSwitch(active, start.Add(StandbyTimeout)) {
+		wt.Fatalf(t, "Unexpected switch before the timeout")
+	}
+
+	// Both answer
+	now := start.Add(2 * StandbyTimeout)
+	paths.answered[active.String()], paths.answered[standby.String()] = now, now
+	if paths.shouldSwitch(active, now) {
+		wt.Fatalf(t, "Unexpected switch while the active path answers")
+	}
+
+	// The active path stops answering
+	now = now.Add(StandbyTimeout + StandbyProbe)
+	paths.answered[standby.String()] = now
+	if !paths.shouldSwitch(active, now) {
+		wt.Fatalf(t, "Expected switch once the active path stops answering")
+	}
+
+	// Not to a standby path which stopped answering too
+	now = now.Add(2 * StandbyTimeout)
+	if paths.shouldSwitch(active, now) {
+		wt.Fatalf(t, "Unexpected switch to an unanswering standby path")
+	}
+}
+
+func TestStandbyFailOver(t *testing.T) {
+	conn, _ := newTestGCMConnPair()
+	conn.stats = &ConnectionStats{}
+	conn.remoteAddrs, _ = decodeCandidates([]byte("10.0.0.1:6783,10.0.1.1:6783"))
+	active, standby := conn.remoteAddrs[0], conn.remoteAddrs[1]
+	conn.remoteUDPAddr = active
+	conn.standby = newStandbyPaths(time.Now().Add(-2 * StandbyTimeout))
+	conn.standby.addr = standby
+	conn.standby.answered[standby.String()] = time.Now()
+
+	conn.failOver(standby)
+	conn.standby.addr = active
+	wt.AssertEqualString(t, conn.RemoteUDPAddr().String(), standby.String(), "address after switching")
+	wt.AssertEqualuint64(t, conn.ConnectionStats().Failovers, 1, "failovers")
+
+	// Packets still arriving from the path we switched away from don't
+	// move us back to it
+	if !conn.pathUnanswered(active) {
+		wt.Fatalf(t, "Expected old path unanswered")
+	}
+	conn.standby.answered[active.String()] = time.Now()
+	if conn.pathUnanswered(active) {
+		wt.Fatalf(t, "Unexpected old path answering again")
+	}
+}
@@ -0,0 +1,180 @@
+package router
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+)
+
+// The router's view of the network as JSON, for tools which would
+// otherwise have to scrape the text status.
+
+type RouterStatus struct {
+	Name        string
+	Encryption  bool
+	Peers       []PeerStatus
+	Connections []LocalConnectionStatus
+	Routes      RoutesStatus
+	Reconnects  []TargetStatus
+	Partitions  PartitionStatus
+	Tuning      Tuning
+}
+
+type PeerStatus struct {
+	Name        string
+	UID         uint64
+	Version     uint64
+	Relays      []string `json:",omitempty"`
+	Connections []PeerConnectionStatus
+}
+
+// A connection as gossiped in the topology
+type PeerConnectionStatus struct {
+	Name        string
+	Address     string
+	Family      string `json:",omitempty"` // of the address: ipv4 or ipv6
+	Established bool
+}
+
+// One of our own connections
+type LocalConnectionStatus struct {
+	Peer             string
+	Address          string
+	UDPAddress       string `json:",omitempty"`
+	Established      bool
+	State            string // see connection_state.go
+	EffectivePMTU    int
+	EncryptionScheme string `json:",omitempty"`
+	TCPFallback      bool
+	Compressing      bool
+	Link             LinkMetrics
+	SinceHeartbeat   time.Duration // since we last received a heartbeat from the remote; 0 if we never have
+	Version          int
+	Capabilities     []string
+	Stats            ConnectionStats
+}
+
+type RoutesStatus struct {
+	Generation uint64              // of the routing table, counting recalculations
+	Calculated time.Time           // when the routing table was
+	Unicast    map[string]string   // destination -> next hop
+	Broadcast  map[string][]string // source -> next hops
+}
+
+type TargetStatus struct {
+	Address    string
+	Attempting bool
+	TryAfter   time.Time
+	Failures   int  // failed attempts in a row
+	GaveUp     bool // whether we have stopped trying, having failed too often
+}
+
+func (router *Router) WriteStatusJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(router.StatusJSON())
+}
+
+func (router *Router) StatusJSON() *RouterStatus {
+	status := &RouterStatus{
+		Name:        router.Ourself.Name.String(),
+		Encryption:  router.UsingPassword(),
+		Peers:       []PeerStatus{},
+		Connections: []LocalConnectionStatus{},
+		Routes:      router.Routes.status(),
+		Reconnects:  router.ConnectionMaker.Targets(),
+		Partitions:  router.Partitions.Status(),
+		Tuning:      router.CurrentTuning()}
+	router.Peers.ForEach(func(_ PeerName, peer *Peer) {
+		status.Peers = append(status.Peers, peer.status())
+	})
+	sort.Sort(peerStatusByName(status.Peers))
+	router.Ourself.ForEachConnection(func(_ PeerName, conn Connection) {
+		if localConn, ok := conn.(*LocalConnection); ok {
+			status.Connections = append(status.Connections, localConn.status())
+		}
+	})
+	sort.Sort(connectionStatusByPeer(status.Connections))
+	return status
+}
+
+func (peer *Peer) status() PeerStatus {
+	status := PeerStatus{
+		Name:        peer.Name.String(),
+		UID:         peer.UID,
+		Version:     peer.Version(),
+		Connections: []PeerConnectionStatus{}}
+	for _, relay := range peer.Relays() {
+		status.Relays = append(status.Relays, relay.String())
+	}
+	peer.ForEachConnection(func(name PeerName, conn Connection) {
+		status.Connections = append(status.Connections, PeerConnectionStatus{
+			Name:        name.String(),
+			Address:     conn.RemoteTCPAddr(),
+			Family:      addressFamily(conn.RemoteTCPAddr()),
+			Established: conn.Established()})
+	})
+	sort.Sort(peerConnectionStatusByName(status.Connections))
+	return status
+}
+
+func (conn *LocalConnection) status() LocalConnectionStatus {
+	status := LocalConnectionStatus{
+		Peer:          conn.Remote().Name.String(),
+		Address:       conn.RemoteTCPAddr(),
+		Established:   conn.Established(),
+		EffectivePMTU: conn.EffectivePMTU(),
+		TCPFallback:   conn.UsingTCPFallback(),
+		Compressing:   conn.compressing,
+		Link:          conn.LinkMetrics(),
+		Version:       conn.version,
+		Capabilities:  conn.capabilities.Names(),
+		Stats:         conn.ConnectionStats()}
+	if remoteUDPAddr := conn.RemoteUDPAddr(); remoteUDPAddr != nil {
+		status.UDPAddress = remoteUDPAddr.String()
+	}
+	status.SinceHeartbeat, _ = conn.SinceLastHeartbeat()
+	state, _ := conn.State()
+	status.State = state.String()
+	if conn.EncryptionScheme != nil && !conn.plaintext {
+		status.EncryptionScheme = conn.EncryptionScheme.Name
+	}
+	return status
+}
+
+func (routes *Routes) status() RoutesStatus {
+	table := routes.Table()
+	status := RoutesStatus{
+		Generation: table.Generation,
+		Calculated: table.Calculated,
+		Unicast:    make(map[string]string, len(table.unicast)),
+		Broadcast:  make(map[string][]string, len(table.broadcast))}
+	for name, hop := range table.unicast {
+		status.Unicast[name.String()] = hop.String()
+	}
+	for name, hops := range table.broadcast {
+		hopNames := make([]string, len(hops))
+		for i, hop := range hops {
+			hopNames[i] = hop.String()
+		}
+		status.Broadcast[name.String()] = hopNames
+	}
+	return status
+}
+
+type peerStatusByName []PeerStatus
+
+func (s peerStatusByName) Len() int           { return len(s) }
+func (s peerStatusByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s peerStatusByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+type peerConnectionStatusByName []PeerConnectionStatus
+
+func (s peerConnectionStatusByName) Len() int           { return len(s) }
+func (s peerConnectionStatusByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s peerConnectionStatusByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+type connectionStatusByPeer []LocalConnectionStatus
+
+func (s connectionStatusByPeer) Len() int           { return len(s) }
+func (s connectionStatusByPeer) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s connectionStatusByPeer) Less(i, j int) bool { return s[i].Peer < s[j].Peer }
@@ -0,0 +1,53 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	wt "github.com/zettio/weave/testing"
+	"testing"
+)
+
+func TestStatusJSON(t *testing.T) {
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	relay, _ := PeerNameFromString("02:00:00:01:00:00")
+	router := NewRouter(RouterConfig{Password: []byte("secret"), Relays: []PeerName{relay}}, name)
+	router.ConnectionMaker.Start()
+
+	var buf bytes.Buffer
+	wt.AssertNoErr(t, router.WriteStatusJSON(&buf))
+	var status RouterStatus
+	wt.AssertNoErr(t, json.Unmarshal(buf.Bytes(), &status))
+	wt.AssertEqualString(t, status.Name, name.String(), "name")
+	if !status.Encryption {
+		wt.Fatalf(t, "Expected encryption to be on")
+	}
+	wt.AssertEqualInt(t, len(status.Peers), 1, "peers")
+	wt.AssertEqualString(t, status.Peers[0].Name, name.String(), "peer name")
+	wt.AssertEqualInt(t, len(status.Peers[0].Relays), 1, "relays")
+	wt.AssertEqualString(t, status.Peers[0].Relays[0], relay.String(), "relay")
+	wt.AssertEqualInt(t, len(status.Connections), 0, "connections")
+	if _, found := status.Routes.Unicast[name.String()]; !found {
+		wt.Fatalf(t, "Expected a unicast route to ourself")
+	}
+}
+
+func TestConnectionStatusJSON(t *testing.T) {
+	peer1 := NewPeer(PeerName(1), 0, 0)
+	peer2 := NewPeer(PeerName(2), 0, 0)
+	router := &Router{ConnStates: NewConnectionStates(), Events: NewEvents()}
+	conn := &LocalConnection{RemoteConnection: RemoteConnection{local: peer1, remote: peer2, remoteTCPAddr: "10.0.0.2:6783"}, Router: router, stats: &ConnectionStats{}}
+	router.ConnStates.add(conn)
+
+	conn.setState(ConnHandshaking, "")
+	wt.AssertEqualString(t, conn.status().State, "handshaking", "state")
+	conn.sendingOverTCP = true
+	conn.setState(ConnAwaitingUDP, "")
+	conn.setState(conn.establishedState(), "")
+
+	buf, err := json.Marshal(conn.status())
+	wt.AssertNoErr(t, err)
+	var status LocalConnectionStatus
+	wt.AssertNoErr(t, json.Unmarshal(buf, &status))
+	wt.AssertEqualString(t, status.State, "degraded", "state")
+	wt.AssertEqualString(t, status.Address, "10.0.0.2:6783", "address")
+}
@@ -0,0 +1,209 @@
+package router
+
+import (
+	"code.google.com/p/gopacket"
+	"code.google.com/p/gopacket/layers"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Taps get copies of what travels over the connections to peers, for
+// as long as they want them, so that operators can see it without
+// instrumenting the underlay, e.g. as a pcap; see capture.go. A tap
+// either gets the frames we exchange with the peer, in the clear, i.e.
+// before we encrypt them and after we decrypt them, or the packets
+// carrying them, as they are on the wire. Taps which don't keep up
+// miss frames, rather than hold up the router.
+
+type TapStage int
+
+const (
+	TapFrames TapStage = iota
+	TapPackets
+)
+
+var tapStageNames = map[TapStage]string{
+	TapFrames:  "frames",
+	TapPackets: "packets"}
+
+func ParseTapStage(name string) (TapStage, error) {
+	for stage, stageName := range tapStageNames {
+		if stageName == name {
+			return stage, nil
+		}
+	}
+	return TapFrames, fmt.Errorf("Unknown tap stage: %s", name)
+}
+
+func (stage TapStage) String() string {
+	return tapStageNames[stage]
+}
+
+// Parse a filter of frames, in the form of the conditions of a policy
+// rule (see policy.go), e.g. "src=10.0.1.0/24 proto=tcp port=80"; nil
+// for an empty one.
+func ParseTapFilter(text string) (*PolicyRule, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return ParsePolicyRule("allow " + text)
+}
+
+const tapQueueSize = 1024
+
+type tappedFrame struct {
+	time     time.Time
+	frame    []byte
+	outbound bool
+}
+
+type FrameTap struct {
+	dropped uint64   // updated atomically; first, for alignment
+	peer    PeerName // only the connection to this peer; UnknownPeerName for all
+	stage   TapStage
+	filter  *PolicyRule // what frames have to match; nil for all
+	frames  chan tappedFrame
+}
+
+type FrameTaps struct {
+	sync.RWMutex
+	taps   map[*FrameTap]struct{}
+	count  int32 // of taps, for checking without the lock
+	files  map[int]*FileCapture
+	lastID int
+}
+
+func NewFrameTaps() *FrameTaps {
+	return &FrameTaps{taps: make(map[*FrameTap]struct{}), files: make(map[int]*FileCapture)}
+}
+
+// Start tapping the connection to the peer, or all connections with
+// UnknownPeerName. Packets can't be filtered.
+func (taps *FrameTaps) Add(peer PeerName, stage TapStage, filter *PolicyRule) (*FrameTap, error) {
+	if stage == TapPackets && filter != nil {
+		return nil, fmt.Errorf("only frames can be filtered")
+	}
+	tap := &FrameTap{peer: peer, stage: stage, filter: filter, frames: make(chan tappedFrame, tapQueueSize)}
+	taps.Lock()
+	defer taps.Unlock()
+	taps.taps[tap] = struct{}{}
+	atomic.StoreInt32(&taps.count, int32(len(taps.taps)))
+	return tap, nil
+}
+
+// Whether there are no taps; true of nil ones.
+func (taps *FrameTaps) Empty() bool {
+	return taps == nil || atomic.LoadInt32(&taps.count) == 0
+}
+
+func (taps *FrameTaps) Remove(tap *FrameTap) {
+	taps.Lock()
+	defer taps.Unlock()
+	delete(taps.taps, tap)
+	atomic.StoreInt32(&taps.count, int32(len(taps.taps)))
+}
+
+// Hand a copy of the frame, from the source peer, which we are about
+// to send over the connection or have received over it, to the taps
+// which want it.
+func (taps *FrameTaps) Frame(conn *LocalConnection, outbound bool, srcPeer PeerName, frame []byte, dec *EthernetDecoder) {
+	if taps.Empty() {
+		return
+	}
+	var (
+		frameCopy []byte
+		pf        *policyFrame
+	)
+	now := time.Now()
+	taps.RLock()
+	defer taps.RUnlock()
+	for tap := range taps.taps {
+		if tap.stage != TapFrames || (tap.peer != UnknownPeerName && tap.peer != conn.remote.Name) {
+			continue
+		}
+		if tap.filter != nil {
+			if pf == nil {
+				f := dec.policyFrame(srcPeer)
+				pf = &f
+			}
+			if !tap.filter.matches(pf) {
+				continue
+			}
+		}
+		if frameCopy == nil {
+			frameCopy = make([]byte, len(frame))
+			copy(frameCopy, frame)
+		}
+		tap.push(tappedFrame{now, frameCopy, outbound})
+	}
+}
+
+// Hand the UDP packet, which we are about to send from the local port
+// to the remote address, or have received from there, to the taps
+// which want it, as an IP datagram.
+func (taps *FrameTaps) Packet(conn *LocalConnection, outbound bool, localPort int, remote *net.UDPAddr, packet []byte) {
+	if taps.Empty() || remote == nil {
+		return
+	}
+	var datagram []byte
+	now := time.Now()
+	taps.RLock()
+	defer taps.RUnlock()
+	for tap := range taps.taps {
+		if tap.stage != TapPackets || (tap.peer != UnknownPeerName && tap.peer != conn.remote.Name) {
+			continue
+		}
+		if datagram == nil {
+			local := &net.UDPAddr{IP: conn.TCPConn.LocalAddr().(*net.TCPAddr).IP, Port: localPort}
+			if outbound {
+				datagram = udpDatagram(local, remote, packet)
+			} else {
+				datagram = udpDatagram(remote, local, packet)
+			}
+			if datagram == nil {
+				return
+			}
+		}
+		tap.push(tappedFrame{now, datagram, outbound})
+	}
+}
+
+func (tap *FrameTap) push(tf tappedFrame) {
+	select {
+	case tap.frames <- tf:
+	default:
+		atomic.AddUint64(&tap.dropped, 1)
+	}
+}
+
+// How many frames the tap missed.
+func (tap *FrameTap) Dropped() uint64 {
+	return atomic.LoadUint64(&tap.dropped)
+}
+
+// The payload as a raw IP datagram from src to dst, for capture
+// formats which want whole packets.
+func udpDatagram(src, dst *net.UDPAddr, payload []byte) []byte {
+	udp := &layers.UDP{SrcPort: layers.UDPPort(src.Port), DstPort: layers.UDPPort(dst.Port)}
+	var ip gopacket.SerializableLayer
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		ip4 := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: src4, DstIP: dst4}
+		udp.SetNetworkLayerForChecksum(ip4)
+		ip = ip4
+	} else {
+		ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: src.IP.To16(), DstIP: dst.IP.To16()}
+		udp.SetNetworkLayerForChecksum(ip6)
+		ip = ip6
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload(payload)); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,115 @@
+package router
+
+import (
+	"bytes"
+	"code.google.com/p/gopacket/layers"
+	"encoding/binary"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFrameTaps(t *testing.T) {
+	conn1, conn2 := newTestGCMConnPair()
+	taps := NewFrameTaps()
+	dec := decodeTestFrame(t, &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP,
+		SrcIP: net.ParseIP("10.0.0.1"), DstIP: net.ParseIP("10.0.0.2")}, layers.EthernetTypeIPv4, 20)
+	// Nothing to do without taps
+	taps.Frame(conn1, false, conn1.remote.Name, []byte("hello"), dec)
+
+	all, err := taps.Add(UnknownPeerName, TapFrames, nil)
+	wt.AssertNoErr(t, err)
+	fromPeer1, err := taps.Add(conn2.remote.Name, TapFrames, nil)
+	wt.AssertNoErr(t, err)
+	filter, err := ParseTapFilter("src=10.9.0.0/16")
+	wt.AssertNoErr(t, err)
+	filtered, err := taps.Add(UnknownPeerName, TapFrames, filter)
+	wt.AssertNoErr(t, err)
+	if _, err := taps.Add(UnknownPeerName, TapPackets, filter); err == nil {
+		wt.Fatalf(t, "Expected packets not to be filtered")
+	}
+	frame := []byte("hello")
+	taps.Frame(conn1, false, conn1.remote.Name, frame, dec)
+	taps.Frame(conn2, true, conn2.local.Name, []byte("world"), dec)
+	frame[0] = 'j'
+	wt.AssertEqualInt(t, len(all.frames), 2, "frames tapped from all connections")
+	wt.AssertEqualInt(t, len(fromPeer1.frames), 1, "frames tapped from peer 1")
+	wt.AssertEqualInt(t, len(filtered.frames), 0, "frames matching filter")
+	tf := <-all.frames
+	wt.AssertEqualString(t, string(tf.frame), "hello", "tapped frame")
+	if tf.outbound {
+		wt.Fatalf(t, "Expected received frame to be inbound")
+	}
+	tf = <-fromPeer1.frames
+	wt.AssertEqualString(t, string(tf.frame), "world", "tapped frame")
+	if !tf.outbound {
+		wt.Fatalf(t, "Expected sent frame to be outbound")
+	}
+
+	// Taps which don't keep up miss frames
+	for i := 0; i < tapQueueSize+3; i++ {
+		taps.Frame(conn1, false, conn1.remote.Name, frame, dec)
+	}
+	wt.AssertEqualInt(t, int(all.Dropped()), 4, "dropped frames")
+	for _, tap := range []*FrameTap{all, fromPeer1, filtered} {
+		taps.Remove(tap)
+	}
+	if !taps.Empty() {
+		wt.Fatalf(t, "Expected no taps")
+	}
+}
+
+func TestUDPDatagram(t *testing.T) {
+	src := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: Port}
+	dst := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1234}
+	datagram := udpDatagram(src, dst, []byte("hello"))
+	wt.AssertEqualInt(t, len(datagram), 20+8+5, "IPv4 datagram length")
+	wt.AssertEqualString(t, net.IP(datagram[12:16]).String(), "10.0.0.1", "source")
+	wt.AssertEqualInt(t, int(binary.BigEndian.Uint16(datagram[22:24])), 1234, "destination port")
+	dst.IP = net.ParseIP("fd00::2")
+	datagram = udpDatagram(src, dst, []byte("hello"))
+	wt.AssertEqualInt(t, len(datagram), 40+8+5, "IPv6 datagram length")
+	wt.AssertEqualString(t, string(datagram[len(datagram)-5:]), "hello", "payload")
+}
+
+// Write the frames as a capture in the format, stopping once they are
+// all written.
+func testCapture(t *testing.T, format CaptureFormat, frames ...tappedFrame) []byte {
+	tap := &FrameTap{frames: make(chan tappedFrame, len(frames))}
+	for _, tf := range frames {
+		tap.frames <- tf
+	}
+	stop := make(chan time.Time, 1)
+	go func() {
+		for len(tap.frames) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+		stop <- time.Now()
+	}()
+	var buf bytes.Buffer
+	wt.AssertNoErr(t, tap.WriteCapture(&buf, format, stop))
+	return buf.Bytes()
+}
+
+func TestCapturePcap(t *testing.T) {
+	pcap := testCapture(t, PcapFormat, tappedFrame{time.Now(), []byte("hello"), false})
+	// File header, then a packet header and the frame
+	wt.AssertEqualInt(t, len(pcap), 24+16+5, "pcap length")
+	wt.AssertEqualString(t, string(pcap[len(pcap)-5:]), "hello", "frame")
+}
+
+func TestCapturePcapng(t *testing.T) {
+	pcapng := testCapture(t, PcapngFormat, tappedFrame{time.Unix(1, 0), []byte("hello"), true})
+	// Section header, interface description, then the packet, padded
+	wt.AssertEqualInt(t, len(pcapng), 28+20+pcapngEnhancedOverhead+8, "pcapng length")
+	wt.AssertEqualInt(t, int(binary.LittleEndian.Uint32(pcapng[8:12])), pcapngByteOrderMagic, "byte order magic")
+	wt.AssertEqualInt(t, int(binary.LittleEndian.Uint16(pcapng[36:38])), int(layers.LinkTypeEthernet), "link type")
+	epb := pcapng[48:]
+	wt.AssertEqualInt(t, int(binary.LittleEndian.Uint32(epb[0:4])), pcapngEnhancedPacket, "block type")
+	wt.AssertEqualInt(t, int(binary.LittleEndian.Uint32(epb[4:8])), len(epb), "block length")
+	wt.AssertEqualInt(t, int(binary.LittleEndian.Uint32(epb[16:20])), 1000000, "timestamp")
+	wt.AssertEqualString(t, string(epb[28:33]), "hello", "frame")
+	wt.AssertEqualInt(t, int(binary.LittleEndian.Uint32(epb[40:44])), pcapngFlagOutbound, "flags")
+	wt.AssertEqualInt(t, int(binary.LittleEndian.Uint32(epb[len(epb)-4:])), len(epb), "trailing block length")
+}
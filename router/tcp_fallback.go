@@ -0,0 +1,137 @@
+package router
+
+import (
+	"fmt"
+	"net"
+)
+
+// Some networks block UDP entirely. When UDP heartbeats fail to
+// establish a connection, and both peers support it, we fall back to
+// carrying the packets the forwarders produce over the connection's
+// TCP stream, as ProtocolTCPFrames messages. Everything else stays
+// the same: the packets are encrypted and framed as they would be for
+// UDP, and the receiving end decodes them the same way.
+//
+// Either peer can initiate the fallback, by telling the other with a
+// ProtocolTCPFallback message. Both then send and receive frames over
+// TCP only, so that a connection's decryptor is never used by the UDP
+// listener and the TCP receiver at the same time.
+
+type TCPFallbackSender struct {
+	conn *LocalConnection
+}
+
+func NewTCPFallbackSender(conn *LocalConnection) *TCPFallbackSender {
+	return &TCPFallbackSender{conn: conn}
+}
+
+// NB: the TCP senders are safe for use by several processes, so we
+// can call them from the forwarders without going through the
+// connection's actor.
+func (sender *TCPFallbackSender) Send(msg []byte) error {
+	return sender.conn.tcpSender.Send(Concat([]byte{byte(ProtocolTCPFrames)}, msg))
+}
+
+func (sender *TCPFallbackSender) Flush() error {
+	return nil
+}
+
+func (sender *TCPFallbackSender) GrowSendBuffer(max int) (int, bool, error) {
+	return 0, false, nil
+}
+
+func (sender *TCPFallbackSender) Shutdown() error {
+	return nil
+}
+
+// Read by the forwarder processes, the UDP listener, and the
+// connection's TCP receiver process.
+func (conn *LocalConnection) UsingTCPFallback() bool {
+	conn.RLock()
+	defer conn.RUnlock()
+	return conn.tcpFallback
+}
+
+func (conn *LocalConnection) setTCPFallback() {
+	conn.Lock()
+	defer conn.Unlock()
+	conn.tcpFallback = true
+}
+
+// The address we pretend frames received over TCP came from; it is
+// where the remote would have sent UDP from, as far as we know.
+func (conn *LocalConnection) tcpFallbackAddr() *net.UDPAddr {
+	tcpAddr := conn.TCPConn.RemoteAddr().(*net.TCPAddr)
+	return &net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port, Zone: tcpAddr.Zone}
+}
+
+// Called by the connection's actor process when UDP connectivity
+// fails to materialise in time.
+func (conn *LocalConnection) startTCPFallback() error {
+	if conn.UsingTCPFallback() {
+		return nil
+	}
+	conn.setTCPFallback()
+	if err := conn.handleSendSimpleProtocolMsg(ProtocolTCPFallback); err != nil {
+		return err
+	}
+	return conn.handleTCPFallback()
+}
+
+// Switch the forwarders to sending over TCP, and start heartbeating
+// over TCP, which establishes the connection as usual.
+func (conn *LocalConnection) handleTCPFallback() error {
+	if conn.sendingOverTCP {
+		return nil
+	}
+	conn.sendingOverTCP = true
+	conn.log("no UDP connectivity, falling back to TCP")
+	if conn.established {
+		conn.setState(ConnDegraded, "falling back to TCP")
+	}
+	if ip := conn.fastPathDst(); ip != nil {
+		// The kernel fast path is UDP too
+		checkWarn(conn.Router.FastPath.DeletePeer(ip))
+	}
+	conn.forwardersOverTCP()
+	stopTicker(conn.heartbeat)
+	return conn.sendFastHeartbeats()
+}
+
+// Have the forwarders, if we have any yet, send over TCP from now on.
+// They keep their encryptors, whose state the remote's decryptor goes
+// by. Where we have none, those we start will send over TCP anyway.
+func (conn *LocalConnection) forwardersOverTCP() {
+	if conn.forwardOverTCP != nil {
+		close(conn.forwardOverTCP)
+		conn.forwardOverTCP = nil
+	}
+	// The address the remote is at no longer matters
+	conn.newSendersDF = nil
+}
+
+// Called by the connection's TCP receiver process.
+func (conn *LocalConnection) handleTCPFrames(packet []byte) error {
+	if !conn.UsingTCPFallback() {
+		return fmt.Errorf("unexpected frames on TCP")
+	}
+	if len(packet) < NameSize {
+		return fmt.Errorf("too short TCP frames message")
+	}
+	name := PeerNameFromBin(packet[:NameSize])
+	if name != conn.remote.Name {
+		return fmt.Errorf("TCP frames message from unexpected peer %s", name)
+	}
+	if conn.tcpFrameConsumer == nil {
+		conn.tcpFrameConsumer = conn.Router.handleUDPPacketFunc(NewEthernetDecoder(), conn.Router.injector)
+	}
+	frames, ok := conn.stripConnUID(packet[NameSize:])
+	if !ok {
+		return fmt.Errorf("TCP frames message for another connection")
+	}
+	conn.receivePacket(conn.tcpFrameConsumer, &UDPPacket{
+		Name:   name,
+		Packet: frames,
+		Sender: conn.tcpFallbackAddr()})
+	return nil
+}
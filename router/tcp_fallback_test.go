@@ -0,0 +1,96 @@
+package router
+
+import (
+	"bytes"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+)
+
+type mockTCPSender struct {
+	msgs [][]byte
+}
+
+func (sender *mockTCPSender) Send(msg []byte) error {
+	sender.msgs = append(sender.msgs, msg)
+	return nil
+}
+
+// Packets sent by a TCPFallbackSender at one end arrive as frames at
+// the other.
+func TestTCPFallbackFrames(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	peer1, peer2 := NewPeer(name1, 0, 0), NewPeer(name2, 0, 0)
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	wt.AssertNoErr(t, err)
+	defer ln.Close()
+	tcpConn, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	wt.AssertNoErr(t, err)
+	defer tcpConn.Close()
+
+	tcpSender := &mockTCPSender{}
+	sendingConn := &LocalConnection{RemoteConnection: RemoteConnection{local: peer2, remote: peer1}, tcpSender: tcpSender}
+	enc := NewNonEncryptor(peer2.NameByte)
+	frame := []byte("a frame carried over TCP")
+	enc.AppendFrame(&ForwardedFrame{srcPeer: peer2, dstPeer: peer1, frame: frame})
+	wt.AssertNoErr(t, NewTCPFallbackSender(sendingConn).Send(enc.Bytes()))
+	wt.AssertEqualInt(t, len(tcpSender.msgs), 1, "messages sent")
+	msg := tcpSender.msgs[0]
+	wt.AssertEqualInt(t, int(msg[0]), int(ProtocolTCPFrames), "protocol tag")
+
+	var received [][]byte
+	conn := &LocalConnection{RemoteConnection: RemoteConnection{local: peer1, remote: peer2}, TCPConn: tcpConn}
+	conn.Decryptor = NewNonDecryptor(conn)
+	conn.tcpFrameConsumer = func(relayConn *LocalConnection, sender *net.UDPAddr, srcNameByte, dstNameByte []byte, tenant uint16, hops uint8, frameLen uint16, frame []byte) error {
+		received = append(received, frame)
+		return nil
+	}
+	if conn.handleTCPFrames(msg[1:]) == nil {
+		wt.Fatalf(t, "Expected frames to be rejected before falling back to TCP")
+	}
+	conn.setTCPFallback()
+	wt.AssertNoErr(t, conn.handleTCPFrames(msg[1:]))
+	wt.AssertEqualInt(t, len(received), 1, "frames received")
+	if !bytes.Equal(received[0], frame) {
+		wt.Fatalf(t, "Received frame %q, expected %q", received[0], frame)
+	}
+}
+
+// Falling back to TCP keeps the forwarders, so packets carry on from
+// the nonces those sent over UDP reached.
+func TestTCPFallbackKeepsEncryptors(t *testing.T) {
+	conn1, conn2, sent, closeConn := newTestForwardingConn(t)
+	defer closeConn()
+	remote, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	wt.AssertNoErr(t, err)
+	defer remote.Close()
+	conn1.remoteUDPAddr = remote.LocalAddr().(*net.UDPAddr)
+	dec := NewGCMDecryptor(conn2)
+	frame := func() *ForwardedFrame {
+		return &ForwardedFrame{srcPeer: conn1.local, dstPeer: conn1.remote, frame: []byte("hello")}
+	}
+
+	wt.AssertNoErr(t, conn1.ensureForwarders())
+	defer conn1.stopForwarders()
+	conn1.Forward(false, frame(), nil)
+	overUDP := receiveUDPPacket(t, remote)
+	_, err = dec.decrypt(overUDP)
+	wt.AssertNoErr(t, err)
+
+	forwardChans := conn1.forwardChans
+	conn1.sendingOverTCP = true
+	conn1.forwardersOverTCP()
+	if &conn1.forwardChans[0] != &forwardChans[0] {
+		wt.Fatalf(t, "Expected to keep the forwarders")
+	}
+	conn1.Forward(false, frame(), nil)
+	overTCP := receiveTCPPacket(t, sent)
+	if bytes.Equal(overTCP[:gcmHeaderSize], overUDP[:gcmHeaderSize]) {
+		wt.Fatalf(t, "Header repeated after falling back to TCP")
+	}
+	// which the replay window would reject otherwise
+	_, err = dec.decrypt(overTCP)
+	wt.AssertNoErr(t, err)
+}
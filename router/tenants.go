@@ -0,0 +1,232 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Several virtual networks, or tenants, can share the peer mesh,
+// isolated from one another. Each tenant has an ID from 1 to 65535
+// and owns some IPv4 subnets; everything else is on the default
+// network, with ID 0. Between peers which both support it, every
+// frame carries the ID of its tenant, and each tenant has a MAC cache
+// of its own.
+//
+// We put captured frames on the tenant of their source address, or
+// for frames without one, such as DHCP requests and IPv6, on the
+// tenant we last saw their source MAC on. Frames whose addresses
+// belong to different tenants are dropped, as are received frames
+// whose addresses belong to a tenant other than the one they are
+// tagged with, so frames never get bridged from one tenant to another.
+// Frames of tenants are never sent to peers which can't tag them.
+//
+// All peers need the same tenants. The hosts of all tenants on a peer
+// share its bridge, so isolating them from each other locally is up to
+// the bridge, e.g. with ebtables.
+
+type TenantSubnet struct {
+	ID     uint16
+	Subnet *net.IPNet
+}
+
+type Tenants struct {
+	sync.RWMutex
+	subnets []TenantSubnet
+	macs    map[uint16]*MacCache
+	hosts   map[uint64]uint16 // tenant each MAC was last discovered on
+}
+
+// Parse tenants of the form <id>=<cidr>,..., where an ID can appear
+// more than once.
+func ParseTenants(spec string) ([]TenantSubnet, error) {
+	var subnets []TenantSubnet
+	for _, field := range strings.Split(spec, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid tenant %q; expected <id>=<cidr>", field)
+		}
+		id, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("invalid tenant ID %q; expected 1-65535", parts[0])
+		}
+		_, subnet, err := net.ParseCIDR(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if subnet.IP.To4() == nil {
+			return nil, fmt.Errorf("tenant subnet %v is not IPv4", subnet)
+		}
+		for _, other := range subnets {
+			if other.Subnet.Contains(subnet.IP) || subnet.Contains(other.Subnet.IP) {
+				return nil, fmt.Errorf("tenant subnet %v overlaps %v", subnet, other.Subnet)
+			}
+		}
+		subnets = append(subnets, TenantSubnet{ID: uint16(id), Subnet: subnet})
+	}
+	return subnets, nil
+}
+
+// newMacCache makes the MAC cache of each tenant, including the
+// default network.
+func NewTenants(subnets []TenantSubnet, newMacCache func(uint16) *MacCache) *Tenants {
+	tenants := &Tenants{
+		subnets: subnets,
+		macs:    map[uint16]*MacCache{0: newMacCache(0)},
+		hosts:   make(map[uint64]uint16)}
+	for _, ts := range subnets {
+		if _, found := tenants.macs[ts.ID]; !found {
+			tenants.macs[ts.ID] = newMacCache(ts.ID)
+		}
+	}
+	return tenants
+}
+
+func (tenants *Tenants) Empty() bool {
+	return len(tenants.subnets) == 0
+}
+
+// The MAC cache of the tenant; nil if we don't know of it.
+func (tenants *Tenants) Macs(id uint16) *MacCache {
+	return tenants.macs[id]
+}
+
+func (tenants *Tenants) Start() {
+	for _, macs := range tenants.macs {
+		macs.Start()
+	}
+}
+
+// Forget the MACs at the peer on all tenants.
+func (tenants *Tenants) Delete(peer *Peer) {
+	for _, macs := range tenants.macs {
+		macs.Delete(peer)
+	}
+}
+
+// The MACs at the peer on all tenants, and the sum of the generations
+// of their MAC caches, which changes whenever any of theirs does.
+func (tenants *Tenants) PeerMacs(peer *Peer) ([]net.HardwareAddr, uint64) {
+	var (
+		all        []net.HardwareAddr
+		generation uint64
+	)
+	for _, macs := range tenants.macs {
+		generation += macs.Generation()
+		all = append(all, macs.PeerMacs(peer)...)
+	}
+	return all, generation
+}
+
+// The sum of the generations of the MAC caches of all tenants
+func (tenants *Tenants) Generation() uint64 {
+	var generation uint64
+	for _, macs := range tenants.macs {
+		generation += macs.Generation()
+	}
+	return generation
+}
+
+// Remember the tenant we discovered the MAC on, for classifying
+// frames from it without addresses.
+func (tenants *Tenants) Learn(mac net.HardwareAddr, id uint16) {
+	if tenants.Empty() {
+		return
+	}
+	tenants.Lock()
+	defer tenants.Unlock()
+	tenants.hosts[macint(mac)] = id
+}
+
+// Forget the MAC, unless it has moved to another tenant meanwhile.
+func (tenants *Tenants) Forget(mac net.HardwareAddr, id uint16) {
+	tenants.Lock()
+	defer tenants.Unlock()
+	if tenants.hosts[macint(mac)] == id {
+		delete(tenants.hosts, macint(mac))
+	}
+}
+
+// The tenant a captured frame is on, and whether its addresses agree
+// on that.
+func (tenants *Tenants) Classify(dec *EthernetDecoder) (uint16, bool) {
+	if tenants.Empty() {
+		return 0, true
+	}
+	id, found, consistent := tenants.addressTenant(dec)
+	if found || !consistent {
+		return id, consistent
+	}
+	tenants.RLock()
+	defer tenants.RUnlock()
+	return tenants.hosts[macint(dec.eth.SrcMAC)], true
+}
+
+// Whether the addresses of a frame received on the tenant allow it
+// to be on that tenant. Frames without addresses are left to the
+// sending peer's classification.
+func (tenants *Tenants) Allow(dec *EthernetDecoder, id uint16) bool {
+	if tenants.Empty() {
+		return id == 0
+	}
+	addrID, found, consistent := tenants.addressTenant(dec)
+	return consistent && (!found || addrID == id)
+}
+
+// The tenant of the frame's unicast IPv4 or ARP addresses, if it has
+// any, and whether they all belong to the same one.
+func (tenants *Tenants) addressTenant(dec *EthernetDecoder) (id uint16, found bool, consistent bool) {
+	var src, dst net.IP
+	switch {
+	case dec.IsIPv4():
+		src, dst = dec.ip.SrcIP, dec.ip.DstIP
+	case dec.IsARP():
+		src, dst = net.IP(dec.arp.SourceProtAddress), net.IP(dec.arp.DstProtAddress)
+	default:
+		return 0, false, true
+	}
+	for _, ip := range []net.IP{src, dst} {
+		if len(ip) == 0 || ip.IsUnspecified() || ip.IsMulticast() || ip.Equal(net.IPv4bcast) {
+			continue
+		}
+		ipID := tenants.subnetTenant(ip)
+		if found && ipID != id {
+			return id, true, false
+		}
+		id, found = ipID, true
+	}
+	return id, found, true
+}
+
+func (tenants *Tenants) subnetTenant(ip net.IP) uint16 {
+	for _, ts := range tenants.subnets {
+		if ts.Subnet.Contains(ip) {
+			return ts.ID
+		}
+	}
+	return 0
+}
+
+func (tenants *Tenants) String() string {
+	ids := []int{}
+	subnets := make(map[uint16][]string)
+	for _, ts := range tenants.subnets {
+		if _, found := subnets[ts.ID]; !found {
+			ids = append(ids, int(ts.ID))
+		}
+		subnets[ts.ID] = append(subnets[ts.ID], ts.Subnet.String())
+	}
+	sort.Ints(ids)
+	var buf bytes.Buffer
+	for _, id := range ids {
+		buf.WriteString(fmt.Sprintf("Tenant %d on %s, MACs:\n%s", id, strings.Join(subnets[uint16(id)], ", "), tenants.macs[uint16(id)]))
+	}
+	return buf.String()
+}
@@ -0,0 +1,117 @@
+package router
+
+import (
+	"code.google.com/p/gopacket/layers"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+	"time"
+)
+
+func tenantTestFrame(t *testing.T, src, dst string) *EthernetDecoder {
+	return decodeTestFrame(t, &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP,
+		SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}, layers.EthernetTypeIPv4, 20)
+}
+
+func newTestTenants(t *testing.T, spec string) *Tenants {
+	subnets, err := ParseTenants(spec)
+	wt.AssertNoErr(t, err)
+	return NewTenants(subnets, func(uint16) *MacCache {
+		return NewMacCache(time.Minute, func(net.HardwareAddr, *Peer) {}, func(PeerName) (*Peer, bool) { return nil, false })
+	})
+}
+
+func TestTenantsParsing(t *testing.T) {
+	subnets, err := ParseTenants("1=10.1.0.0/16, 2=10.2.0.0/16,1=10.3.0.0/24")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(subnets), 3, "subnets")
+	wt.AssertEqualInt(t, int(subnets[2].ID), 1, "tenant ID")
+	wt.AssertEqualString(t, subnets[2].Subnet.String(), "10.3.0.0/24", "subnet")
+	for _, spec := range []string{
+		"10.1.0.0/16",
+		"0=10.1.0.0/16",
+		"65536=10.1.0.0/16",
+		"1=10.1.0.0",
+		"1=fd00::/64",
+		"1=10.1.0.0/16,2=10.1.2.0/24",
+	} {
+		if _, err := ParseTenants(spec); err == nil {
+			wt.Fatalf(t, "Expected an error parsing %q", spec)
+		}
+	}
+}
+
+func TestTenantsClassify(t *testing.T) {
+	tenants := newTestTenants(t, "1=10.1.0.0/16,2=10.2.0.0/16")
+	for _, c := range []struct {
+		src, dst   string
+		tenant     uint16
+		consistent bool
+	}{
+		{"10.1.0.1", "10.1.0.2", 1, true},
+		{"10.2.0.1", "10.2.255.255", 2, true},
+		{"10.1.0.1", "224.0.0.251", 1, true},
+		{"0.0.0.0", "255.255.255.255", 0, true},
+		{"10.9.0.1", "10.9.0.2", 0, true},
+		{"10.1.0.1", "10.2.0.1", 1, false},
+		{"10.9.0.1", "10.1.0.1", 0, false},
+	} {
+		dec := tenantTestFrame(t, c.src, c.dst)
+		tenant, consistent := tenants.Classify(dec)
+		if tenant != c.tenant || consistent != c.consistent {
+			wt.Fatalf(t, "Expected %s -> %s to be on tenant %d (%v), got %d (%v)", c.src, c.dst, c.tenant, c.consistent, tenant, consistent)
+		}
+	}
+
+	// Frames without addresses are on the tenant of their source MAC
+	dhcp := tenantTestFrame(t, "0.0.0.0", "255.255.255.255")
+	tenants.Learn(dhcp.eth.SrcMAC, 2)
+	if tenant, _ := tenants.Classify(dhcp); tenant != 2 {
+		wt.Fatalf(t, "Expected frame to be on the tenant of its MAC, got %d", tenant)
+	}
+	tenants.Forget(dhcp.eth.SrcMAC, 1)
+	if tenant, _ := tenants.Classify(dhcp); tenant != 2 {
+		wt.Fatalf(t, "Expected MAC to stay on its tenant, got %d", tenant)
+	}
+	tenants.Forget(dhcp.eth.SrcMAC, 2)
+	if tenant, _ := tenants.Classify(dhcp); tenant != 0 {
+		wt.Fatalf(t, "Expected forgotten MAC to be on the default network, got %d", tenant)
+	}
+}
+
+func TestTenantsAllow(t *testing.T) {
+	tenants := newTestTenants(t, "1=10.1.0.0/16,2=10.2.0.0/16")
+	frame := tenantTestFrame(t, "10.1.0.1", "10.1.0.2")
+	if !tenants.Allow(frame, 1) {
+		wt.Fatalf(t, "Expected frame to be allowed on its own tenant")
+	}
+	if tenants.Allow(frame, 2) || tenants.Allow(frame, 0) {
+		wt.Fatalf(t, "Expected frame to be refused on other tenants")
+	}
+	if !tenants.Allow(tenantTestFrame(t, "0.0.0.0", "255.255.255.255"), 2) {
+		wt.Fatalf(t, "Expected frame without addresses to be allowed")
+	}
+	if newTestTenants(t, "").Allow(frame, 1) {
+		wt.Fatalf(t, "Expected tagged frame to be refused without tenants")
+	}
+}
+
+func TestTenantTagging(t *testing.T) {
+	conn1, conn2 := newTestGCMConnPair()
+	conn1.tenantTags, conn2.tenantTags = true, true
+	enc := NewNonEncryptor(conn1.local.NameByte)
+	enc.tenants = true
+	frame := &ForwardedFrame{srcPeer: conn1.local, dstPeer: conn1.remote, frame: []byte("hello world"), tenant: 258}
+	enc.AppendFrame(frame)
+	packet := enc.Bytes()
+	wt.AssertEqualInt(t, len(packet), NameSize+enc.FrameOverhead()+len(frame.frame), "packet length")
+	received := 0
+	err := NewNonDecryptor(conn2).IterateFrames(func(_ *LocalConnection, _ *net.UDPAddr, _, _ []byte, tenant uint16, _ uint8, _ uint16, payload []byte) error {
+		wt.AssertEqualInt(t, int(tenant), 258, "tenant")
+		wt.AssertEqualString(t, string(payload), string(frame.frame), "frame")
+		received++
+		return nil
+	}, &UDPPacket{Packet: packet[NameSize:]})
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, received, 1, "frames received")
+}
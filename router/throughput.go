@@ -0,0 +1,294 @@
+package router
+
+import (
+	"code.google.com/p/gopacket/layers"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Operators can measure what the data plane achieves between us and a
+// peer we are connected to, without any hosts: we send the peer
+// synthetic frames at a target rate for a while, and it counts them.
+// Test frames are Ethernet frames with zero MACs and the IEEE local
+// experimental EtherType, so they go the way frames of hosts do,
+// through the forwarders, encryption and encapsulation, but the
+// remote never injects them. Every throughputEchoEvery'th frame asks
+// the remote to echo it, from which we work out the round trip time;
+// the echoes jump the remote's queue, like heartbeats, so it's the
+// latency on the way out that gets measured. Once we're done, we ask
+// the remote over the control channel how much it received.
+
+const (
+	throughputEtherType     = layers.EthernetType(0x88B5)
+	throughputHeaderSize    = 8 + 4 + 8 + 1 // test ID, sequence number, sent at, flags
+	throughputEchoEvery     = 64
+	throughputTick          = time.Millisecond
+	throughputDrain         = 500 * time.Millisecond // how long to wait for frames in flight before asking for the report
+	throughputReportTimeout = 5 * time.Second
+	throughputMaxAge        = 1 * time.Minute // after which we forget the counts of tests nobody asked about
+	MinThroughputFrameSize  = EthernetOverhead + throughputHeaderSize
+	MaxThroughputFrameSize  = 9000
+	MaxThroughputDuration   = 1 * time.Minute
+)
+
+const (
+	throughputEcho   byte = 1 << iota // the remote should echo the frame
+	throughputEchoed                  // the frame is an echo
+)
+
+type ThroughputResult struct {
+	Peer          PeerName
+	Duration      time.Duration // spent sending
+	Sent          uint64        // frames
+	SentBytes     uint64
+	Received      uint64 // frames
+	ReceivedBytes uint64
+	Echoes        int
+	MinRTT        time.Duration // of the echoed frames; 0 if none came back
+	AvgRTT        time.Duration
+	MaxRTT        time.Duration
+}
+
+// Bits per second the remote received.
+func (result *ThroughputResult) Throughput() float64 {
+	if result.Duration <= 0 {
+		return 0
+	}
+	return float64(result.ReceivedBytes) * 8 / result.Duration.Seconds()
+}
+
+func (result *ThroughputResult) Loss() float64 {
+	if result.Sent == 0 || result.Received >= result.Sent {
+		return 0
+	}
+	return float64(result.Sent-result.Received) / float64(result.Sent)
+}
+
+func (result *ThroughputResult) String() string {
+	return fmt.Sprintf("%s: sent %d frames (%d bytes) in %v, received %d (%d bytes); %.1f Mbit/s, loss %.1f%%, RTT min/avg/max %v/%v/%v over %d echoes",
+		result.Peer, result.Sent, result.SentBytes, result.Duration, result.Received, result.ReceivedBytes,
+		result.Throughput()/1e6, result.Loss()*100, result.MinRTT, result.AvgRTT, result.MaxRTT, result.Echoes)
+}
+
+type throughputKey struct {
+	peer PeerName
+	id   uint64
+}
+
+// What the remote received of a test
+type throughputCounts struct {
+	frames, bytes uint64
+	last          time.Time
+}
+
+// A test we are running
+type throughputTest struct {
+	echoes   int
+	totalRTT time.Duration
+	minRTT   time.Duration
+	maxRTT   time.Duration
+	report   chan throughputCounts
+}
+
+type ThroughputTests struct {
+	sync.Mutex
+	lastID   uint64
+	running  map[uint64]*throughputTest
+	received map[throughputKey]*throughputCounts
+}
+
+func NewThroughputTests() *ThroughputTests {
+	return &ThroughputTests{
+		lastID:   uint64(time.Now().UnixNano()),
+		running:  make(map[uint64]*throughputTest),
+		received: make(map[throughputKey]*throughputCounts)}
+}
+
+func makeThroughputFrame(size int, id uint64, seq uint32, sentAt time.Time, flags byte) []byte {
+	frame := make([]byte, size) // with zero MACs
+	binary.BigEndian.PutUint16(frame[12:14], uint16(throughputEtherType))
+	header := frame[EthernetOverhead:]
+	binary.BigEndian.PutUint64(header[0:8], id)
+	binary.BigEndian.PutUint32(header[8:12], seq)
+	binary.BigEndian.PutUint64(header[12:20], uint64(sentAt.UnixNano()))
+	header[20] = flags
+	return frame
+}
+
+// Send test frames to the remote of the connection, at rate bits per
+// second, for the duration, and report what it received.
+func (tests *ThroughputTests) Run(conn *LocalConnection, rate uint64, size int, duration time.Duration) (*ThroughputResult, error) {
+	test := &throughputTest{report: make(chan throughputCounts, 1)}
+	tests.Lock()
+	tests.lastID++
+	id := tests.lastID
+	tests.running[id] = test
+	tests.Unlock()
+	defer func() {
+		tests.Lock()
+		delete(tests.running, id)
+		tests.Unlock()
+	}()
+
+	result := &ThroughputResult{Peer: conn.remote.Name}
+	dec := NewEthernetDecoder()
+	ticker := time.NewTicker(throughputTick)
+	start := time.Now()
+	for now := start; now.Sub(start) < duration; now = <-ticker.C {
+		due := uint64(now.Sub(start).Seconds() * float64(rate) / float64(size*8))
+		for ; result.Sent < due; result.Sent++ {
+			var flags byte
+			if result.Sent%throughputEchoEvery == 0 {
+				flags = throughputEcho
+			}
+			frame := makeThroughputFrame(size, id, uint32(result.Sent), time.Now(), flags)
+			if result.Sent == 0 {
+				dec.DecodeLayers(frame)
+			}
+			if err := conn.Forward(false, &ForwardedFrame{srcPeer: conn.local, dstPeer: conn.remote, frame: frame}, dec); err != nil {
+				ticker.Stop()
+				return nil, err
+			}
+			result.SentBytes += uint64(size)
+		}
+	}
+	ticker.Stop()
+	result.Duration = time.Since(start)
+
+	time.Sleep(throughputDrain)
+	query := make([]byte, 8)
+	binary.BigEndian.PutUint64(query, id)
+	conn.SendProtocolMsg(ProtocolMsg{ProtocolThroughputQuery, query})
+	var counts throughputCounts
+	select {
+	case counts = <-test.report:
+	case <-time.After(throughputReportTimeout):
+		return nil, fmt.Errorf("no report from %s", conn.remote.Name)
+	}
+	result.Received, result.ReceivedBytes = counts.frames, counts.bytes
+	tests.Lock()
+	defer tests.Unlock()
+	result.Echoes, result.MinRTT, result.MaxRTT = test.echoes, test.minRTT, test.maxRTT
+	if test.echoes > 0 {
+		result.AvgRTT = test.totalRTT / time.Duration(test.echoes)
+	}
+	return result, nil
+}
+
+// A test frame the remote sent us: we count it, and echo it if asked
+// to, or, if it's an echo, time it.
+func (tests *ThroughputTests) Received(conn *LocalConnection, frame []byte) {
+	header := frame[EthernetOverhead:]
+	id := binary.BigEndian.Uint64(header[0:8])
+	flags := header[20]
+	if flags&throughputEchoed != 0 {
+		tests.echoed(id, time.Unix(0, int64(binary.BigEndian.Uint64(header[12:20]))), time.Now())
+		return
+	}
+	tests.count(conn.remote.Name, id, len(frame), time.Now())
+	if flags&throughputEcho != 0 {
+		echo := make([]byte, MinThroughputFrameSize)
+		copy(echo, frame)
+		echo[EthernetOverhead+20] = throughputEchoed
+		conn.Forward(false, &ForwardedFrame{srcPeer: conn.local, dstPeer: conn.remote, frame: echo}, nil)
+	}
+}
+
+func (tests *ThroughputTests) count(peer PeerName, id uint64, size int, now time.Time) {
+	tests.Lock()
+	defer tests.Unlock()
+	key := throughputKey{peer, id}
+	counts, found := tests.received[key]
+	if !found {
+		for other, otherCounts := range tests.received {
+			if now.Sub(otherCounts.last) > throughputMaxAge {
+				delete(tests.received, other)
+			}
+		}
+		counts = &throughputCounts{}
+		tests.received[key] = counts
+	}
+	counts.frames++
+	counts.bytes += uint64(size)
+	counts.last = now
+}
+
+func (tests *ThroughputTests) echoed(id uint64, sentAt, now time.Time) {
+	tests.Lock()
+	defer tests.Unlock()
+	test, found := tests.running[id]
+	if !found {
+		return
+	}
+	rtt := now.Sub(sentAt)
+	if test.echoes == 0 || rtt < test.minRTT {
+		test.minRTT = rtt
+	}
+	if rtt > test.maxRTT {
+		test.maxRTT = rtt
+	}
+	test.echoes++
+	test.totalRTT += rtt
+}
+
+// What we received of the test the remote asks about, which we then
+// forget.
+func (tests *ThroughputTests) report(peer PeerName, query []byte) ([]byte, error) {
+	if len(query) != 8 {
+		return nil, fmt.Errorf("invalid throughput query")
+	}
+	id := binary.BigEndian.Uint64(query)
+	tests.Lock()
+	key := throughputKey{peer, id}
+	counts := tests.received[key]
+	delete(tests.received, key)
+	tests.Unlock()
+	report := make([]byte, 24)
+	binary.BigEndian.PutUint64(report[0:8], id)
+	if counts != nil {
+		binary.BigEndian.PutUint64(report[8:16], counts.frames)
+		binary.BigEndian.PutUint64(report[16:24], counts.bytes)
+	}
+	return report, nil
+}
+
+func (tests *ThroughputTests) receivedReport(report []byte) error {
+	if len(report) != 24 {
+		return fmt.Errorf("invalid throughput report")
+	}
+	tests.Lock()
+	defer tests.Unlock()
+	if test, found := tests.running[binary.BigEndian.Uint64(report[0:8])]; found {
+		select {
+		case test.report <- throughputCounts{
+			frames: binary.BigEndian.Uint64(report[8:16]),
+			bytes:  binary.BigEndian.Uint64(report[16:24])}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Measure the throughput to the peer, which we must be connected to;
+// see ThroughputTests.Run.
+func (router *Router) TestThroughput(name PeerName, rate uint64, size int, duration time.Duration) (*ThroughputResult, error) {
+	switch {
+	case rate == 0:
+		return nil, fmt.Errorf("rate must be positive")
+	case size < MinThroughputFrameSize || size > MaxThroughputFrameSize:
+		return nil, fmt.Errorf("frame size must be from %d to %d", MinThroughputFrameSize, MaxThroughputFrameSize)
+	case duration <= 0 || duration > MaxThroughputDuration:
+		return nil, fmt.Errorf("duration must be positive and at most %v", MaxThroughputDuration)
+	}
+	conn, found := router.Ourself.ConnectionTo(name)
+	if !found || !conn.Established() {
+		return nil, fmt.Errorf("not connected to %s", name)
+	}
+	localConn := conn.(*LocalConnection)
+	if !localConn.throughputTests {
+		return nil, fmt.Errorf("%s does not support throughput tests", name)
+	}
+	return router.Throughput.Run(localConn, rate, size, duration)
+}
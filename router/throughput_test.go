@@ -0,0 +1,68 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"testing"
+	"time"
+)
+
+func TestThroughputFrames(t *testing.T) {
+	frame := makeThroughputFrame(1400, 42, 7, time.Now(), throughputEcho)
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(frame)
+	wt.AssertEqualInt(t, len(dec.decoded), 1, "decoded layers")
+	if !dec.IsThroughputTest() || dec.IsSpecial() {
+		wt.Fatalf(t, "Expected a throughput test frame")
+	}
+	if tenantTestFrame(t, "10.0.0.1", "10.0.0.2").IsThroughputTest() {
+		wt.Fatalf(t, "Expected other frames not to be throughput test frames")
+	}
+}
+
+func TestThroughputReports(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	sender, receiver := NewThroughputTests(), NewThroughputTests()
+	test := &throughputTest{report: make(chan throughputCounts, 1)}
+	sender.running[42] = test
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		receiver.count(name1, 42, 1000, now)
+	}
+	receiver.count(name2, 42, 1000, now) // another peer's test
+	sender.echoed(42, now.Add(-3*time.Millisecond), now)
+	sender.echoed(42, now.Add(-time.Millisecond), now)
+	sender.echoed(43, now.Add(-time.Second), now) // not ours
+
+	report, err := receiver.report(name1, []byte{0, 0, 0, 0, 0, 0, 0, 42})
+	wt.AssertNoErr(t, err)
+	wt.AssertNoErr(t, sender.receivedReport(report))
+	counts := <-test.report
+	wt.AssertEqualInt(t, int(counts.frames), 10, "frames received")
+	wt.AssertEqualInt(t, int(counts.bytes), 10000, "bytes received")
+	wt.AssertEqualInt(t, test.echoes, 2, "echoes")
+	if test.minRTT != time.Millisecond || test.maxRTT != 3*time.Millisecond {
+		wt.Fatalf(t, "Expected RTTs from 1ms to 3ms, got %v to %v", test.minRTT, test.maxRTT)
+	}
+
+	// Once reported, a test is forgotten
+	report, err = receiver.report(name1, []byte{0, 0, 0, 0, 0, 0, 0, 42})
+	wt.AssertNoErr(t, err)
+	wt.AssertNoErr(t, sender.receivedReport(report))
+	wt.AssertEqualInt(t, int((<-test.report).frames), 0, "frames received")
+
+	// Stale counts get dropped when another test starts
+	receiver.count(name1, 44, 1000, now.Add(2*throughputMaxAge))
+	wt.AssertEqualInt(t, len(receiver.received), 1, "tests received")
+}
+
+func TestThroughputResult(t *testing.T) {
+	result := &ThroughputResult{Duration: 2 * time.Second, Sent: 100, Received: 75, ReceivedBytes: 1000000}
+	if result.Throughput() != 4e6 {
+		wt.Fatalf(t, "Expected 4 Mbit/s, got %v", result.Throughput())
+	}
+	if result.Loss() != 0.25 {
+		wt.Fatalf(t, "Expected 25%% loss, got %v", result.Loss())
+	}
+}
@@ -0,0 +1,79 @@
+package router
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Limits on the topology we accept from peers, so that a misbehaving
+// or malicious peer can't blow up our memory, and that of every peer
+// we would pass it on to, by gossiping a huge fake topology. Topology
+// updates which would take us beyond the limits get rejected as a
+// whole, and neither applied nor passed on. As with other bad gossip,
+// we drop the connection it came over, and like any connection that
+// fails, only retry it with growing intervals, which throttles a peer
+// that keeps at it. The limits should therefore be the same throughout
+// the network, and leave room for its legitimate growth.
+type TopologyLimits struct {
+	Peers       int // peers in the topology; 0 for unlimited
+	Connections int // connections of each peer; 0 for unlimited
+	GossipSize  int // bytes of each gossip message, decompressed; 0 for MaxGossipSize
+}
+
+type TopologyLimitError struct {
+	Desc string
+}
+
+func (tle TopologyLimitError) Error() string {
+	return fmt.Sprint("Topology limit exceeded: ", tle.Desc)
+}
+
+func (limits TopologyLimits) Validate() error {
+	if limits.Peers < 0 || limits.Connections < 0 || limits.GossipSize < 0 {
+		return fmt.Errorf("topology limits must not be negative")
+	}
+	if limits.GossipSize > MaxGossipSize {
+		return fmt.Errorf("gossip size limit must not exceed %d", MaxGossipSize)
+	}
+	return nil
+}
+
+func (limits TopologyLimits) Empty() bool {
+	return limits.Peers == 0 && limits.Connections == 0 && limits.GossipSize == 0
+}
+
+// The most bytes a gossip message may have
+func (limits TopologyLimits) gossipSize() int {
+	if limits.GossipSize == 0 {
+		return MaxGossipSize
+	}
+	return limits.GossipSize
+}
+
+// Check an update, of the peers new to us and the connections of each
+// peer in it, against the limits
+func (limits TopologyLimits) check(knownPeers, newPeers int, conns []int) error {
+	if limits.Peers > 0 && knownPeers+newPeers > limits.Peers {
+		return TopologyLimitError{fmt.Sprintf("%d new peers on top of the %d we know exceed %d", newPeers, knownPeers, limits.Peers)}
+	}
+	if limits.Connections > 0 {
+		for _, count := range conns {
+			if count > limits.Connections {
+				return TopologyLimitError{fmt.Sprintf("peer with %d connections exceeds %d", count, limits.Connections)}
+			}
+		}
+	}
+	return nil
+}
+
+func (limits TopologyLimits) String() string {
+	var parts []string
+	if limits.Peers > 0 {
+		parts = append(parts, fmt.Sprint(limits.Peers, " peers"))
+	}
+	if limits.Connections > 0 {
+		parts = append(parts, fmt.Sprint(limits.Connections, " connections per peer"))
+	}
+	parts = append(parts, fmt.Sprint(limits.gossipSize(), " bytes per gossip message"))
+	return strings.Join(parts, ", ")
+}
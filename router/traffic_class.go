@@ -0,0 +1,83 @@
+package router
+
+// Frames queue for the forwarders in one of several classes, so that
+// latency-sensitive traffic doesn't wait behind bulk transfers on a
+// congested connection. Forwarders take frames from the classes in
+// weighted turns, so that the lower classes don't starve.
+
+type TrafficClass int
+
+const (
+	ClassInteractive TrafficClass = iota // DNS, health checks, heartbeats, ...
+	ClassDefault
+	ClassBulk
+	NumTrafficClasses
+)
+
+var trafficClassNames = []string{"interactive", "default", "bulk"}
+
+func (class TrafficClass) String() string {
+	return trafficClassNames[class]
+}
+
+// How many frames of each class a forwarder takes per turn, when
+// frames of all classes are queued.
+var trafficClassWeights = [NumTrafficClasses]int{8, 4, 1}
+
+// A forwarder's queues, one per class
+type forwardQueues [NumTrafficClasses]chan *ForwardedFrame
+
+func newForwardQueues(size int) forwardQueues {
+	var queues forwardQueues
+	for class := range queues {
+		queues[class] = make(chan *ForwardedFrame, size)
+	}
+	return queues
+}
+
+func (queues *forwardQueues) len() int {
+	n := 0
+	for _, ch := range queues {
+		n += len(ch)
+	}
+	return n
+}
+
+// Take the next frame to send, if any is queued, according to the
+// weights of the classes. Classes with nothing queued don't hold up
+// the others.
+func (fwd *Forwarder) nextFrame() (*ForwardedFrame, bool) {
+	for turn := 0; turn < 2; turn++ {
+		for class, ch := range fwd.queues {
+			if fwd.classCredits[class] == 0 {
+				continue
+			}
+			select {
+			case frame := <-ch:
+				fwd.classCredits[class]--
+				return frame, true
+			default:
+			}
+		}
+		// Start another turn
+		fwd.classCredits = trafficClassWeights
+	}
+	return nil, false
+}
+
+// Discard everything queued
+func (fwd *Forwarder) drain() {
+	// We want to drain before exiting otherwise we could get the
+	// packet sniffer or udp listener blocked on sending to a full
+	// chan
+	for _, ch := range fwd.queues {
+		for drained := false; !drained; {
+			select {
+			case frame := <-ch:
+				frame.buf.Release()
+			default:
+				drained = true
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package router
+
+import (
+	"code.google.com/p/gopacket/layers"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+)
+
+func checkTrafficClass(t *testing.T, dec *EthernetDecoder, expected TrafficClass) {
+	wt.AssertEqualString(t, dec.TrafficClass().String(), expected.String(), "traffic class")
+}
+
+func TestTrafficClassification(t *testing.T) {
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	ipv4 := func(tos uint8, proto layers.IPProtocol) *layers.IPv4 {
+		return &layers.IPv4{Version: 4, IHL: 5, TTL: 64, TOS: tos, Protocol: proto, SrcIP: src, DstIP: dst}
+	}
+	checkTrafficClass(t, decodeTestFrame(t, ipv4(0, layers.IPProtocolTCP), layers.EthernetTypeIPv4, 20), ClassDefault)
+	checkTrafficClass(t, decodeTestFrame(t, ipv4(46<<2, layers.IPProtocolUDP), layers.EthernetTypeIPv4, 20), ClassInteractive)
+	checkTrafficClass(t, decodeTestFrame(t, ipv4(8<<2, layers.IPProtocolTCP), layers.EthernetTypeIPv4, 20), ClassBulk)
+	checkTrafficClass(t, decodeTestFrame(t, &layers.IPv6{Version: 6, TrafficClass: 34 << 2, NextHeader: layers.IPProtocolTCP,
+		HopLimit: 64, SrcIP: net.ParseIP("fd00::1"), DstIP: net.ParseIP("fd00::2")}, layers.EthernetTypeIPv6, 20), ClassInteractive)
+
+	// DNS, even when marked as bulk
+	dns := decodeTestFrame(t, ipv4(8<<2, layers.IPProtocolUDP), layers.EthernetTypeIPv4, 20)
+	dns.ip.Payload = []byte{0x80, 0, 0, 53, 0, 20, 0, 0}
+	checkTrafficClass(t, dns, ClassInteractive)
+}
+
+func TestForwarderWeightedQueues(t *testing.T) {
+	fwd := &Forwarder{queues: newForwardQueues(ChannelSize)}
+	for i := 0; i < ChannelSize; i++ {
+		for class := range fwd.queues {
+			fwd.queues[class] <- &ForwardedFrame{frame: []byte{byte(class)}}
+		}
+	}
+	counts := make([]int, NumTrafficClasses)
+	for i := 0; i < 26; i++ {
+		frame, ok := fwd.nextFrame()
+		if !ok {
+			wt.Fatalf(t, "Expected a frame")
+		}
+		counts[frame.frame[0]]++
+	}
+	for class, weight := range trafficClassWeights {
+		wt.AssertEqualInt(t, counts[class], 2*weight, TrafficClass(class).String()+" frames")
+	}
+
+	// Lower classes get what the higher ones don't use
+	fwd.drain()
+	wt.AssertEqualInt(t, fwd.queues.len(), 0, "queued after drain")
+	fwd.queues[ClassBulk] <- &ForwardedFrame{frame: []byte{byte(ClassBulk)}}
+	fwd.queues[ClassBulk] <- &ForwardedFrame{frame: []byte{byte(ClassBulk)}}
+	for i := 0; i < 2; i++ {
+		if _, ok := fwd.nextFrame(); !ok {
+			wt.Fatalf(t, "Expected a bulk frame")
+		}
+	}
+	if _, ok := fwd.nextFrame(); ok {
+		wt.Fatalf(t, "Expected no more frames")
+	}
+}
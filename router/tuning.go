@@ -0,0 +1,139 @@
+package router
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// Settings which can be changed while the router runs. Zero values
+// stand for the defaults.
+//
+// New queue sizes only apply to forwarders started afterwards, i.e.
+// for new connections. Socket buffer sizes apply to the shared UDP
+// socket straight away, and to the sockets of connections set up
+// afterwards. Heartbeat settings apply to all connections straight
+// away, as do NAT keepalive intervals. New flush delays, like queue
+// sizes, only apply to forwarders started afterwards.
+//
+// Connections only notice missing heartbeats if the remote peer sends
+// them at least as often as our SlowHeartbeat, so peers with
+// HeartbeatLoss set should agree on the heartbeat intervals.
+type Tuning struct {
+	QueueSize     int           // frames each forwarder queues per traffic class
+	SndBuf        int           // UDP socket send buffer size in bytes; 0 for the system default
+	RcvBuf        int           // likewise for the receive buffer of the shared socket
+	FastHeartbeat time.Duration // heartbeat interval while connections get established
+	SlowHeartbeat time.Duration // heartbeat interval once they are
+	HeartbeatLoss int           // slow heartbeats in a row an established connection may miss before we drop it; 0 to never
+	FlushDelay    time.Duration // longest a frame may wait in a forwarder for others to fill its packet or batch
+	NATKeepalive  time.Duration // interval of keepalives to peers, for NATs on the way not to forget the flow; 0 for none
+}
+
+func (tuning Tuning) withDefaults() Tuning {
+	if tuning.QueueSize == 0 {
+		tuning.QueueSize = ChannelSize
+	}
+	if tuning.FastHeartbeat == 0 {
+		tuning.FastHeartbeat = FastHeartbeat
+	}
+	if tuning.SlowHeartbeat == 0 {
+		tuning.SlowHeartbeat = SlowHeartbeat
+	}
+	if tuning.FlushDelay == 0 {
+		tuning.FlushDelay = FlushDelay
+	}
+	return tuning
+}
+
+func (tuning Tuning) Validate() error {
+	switch {
+	case tuning.QueueSize < 0 || tuning.QueueSize > MaxQueueSize:
+		return fmt.Errorf("queue size must be between 0 and %d", MaxQueueSize)
+	case tuning.SndBuf < 0 || tuning.RcvBuf < 0:
+		return fmt.Errorf("socket buffer sizes must not be negative")
+	case tuning.FastHeartbeat < 0 || tuning.SlowHeartbeat < 0:
+		return fmt.Errorf("heartbeat intervals must not be negative")
+	case tuning.HeartbeatLoss < 0:
+		return fmt.Errorf("heartbeat loss threshold must not be negative")
+	case tuning.FastHeartbeat > 0 && tuning.FastHeartbeat < MinHeartbeat,
+		tuning.SlowHeartbeat > 0 && tuning.SlowHeartbeat < MinHeartbeat:
+		return fmt.Errorf("heartbeat intervals must be at least %v", MinHeartbeat)
+	case tuning.FlushDelay != 0 && (tuning.FlushDelay < MinFlushDelay || tuning.FlushDelay > MaxFlushDelay):
+		return fmt.Errorf("flush delay must be between %v and %v", MinFlushDelay, MaxFlushDelay)
+	case tuning.NATKeepalive < 0 || tuning.NATKeepalive > 0 && tuning.NATKeepalive < MinKeepalive:
+		return fmt.Errorf("NAT keepalive interval must be 0, or at least %v", MinKeepalive)
+	}
+	if defaulted := tuning.withDefaults(); defaulted.FastHeartbeat > defaulted.SlowHeartbeat {
+		return fmt.Errorf("fast heartbeat interval %v exceeds slow one %v", defaulted.FastHeartbeat, defaulted.SlowHeartbeat)
+	}
+	return nil
+}
+
+func (tuning Tuning) String() string {
+	return fmt.Sprintf("queue size %d, sndbuf %d, rcvbuf %d, heartbeats %v/%v, heartbeat loss %d, flush delay %v, NAT keepalive %v",
+		tuning.QueueSize, tuning.SndBuf, tuning.RcvBuf, tuning.FastHeartbeat, tuning.SlowHeartbeat, tuning.HeartbeatLoss, tuning.FlushDelay, tuning.NATKeepalive)
+}
+
+func (router *Router) CurrentTuning() Tuning {
+	router.tuningLock.RLock()
+	defer router.tuningLock.RUnlock()
+	return router.Tuning
+}
+
+// Install new settings, applying them where they take effect straight
+// away.
+func (router *Router) SetTuning(tuning Tuning) error {
+	if err := tuning.Validate(); err != nil {
+		return err
+	}
+	tuning = tuning.withDefaults()
+	router.tuningLock.Lock()
+	old := router.Tuning
+	router.Tuning = tuning
+	router.tuningLock.Unlock()
+	logRouter.Info("Tuning:", tuning)
+	if tuning.SndBuf != old.SndBuf || tuning.RcvBuf != old.RcvBuf {
+		for _, conn := range router.UDPListeners {
+			if err := controlSocket(conn, func(fd int) error {
+				return setSocketBuffers(fd, tuning.SndBuf, tuning.RcvBuf)
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	if tuning.FastHeartbeat != old.FastHeartbeat || tuning.SlowHeartbeat != old.SlowHeartbeat || tuning.NATKeepalive != old.NATKeepalive {
+		router.Ourself.ForEachConnection(func(_ PeerName, conn Connection) {
+			if localConn, ok := conn.(*LocalConnection); ok {
+				localConn.Retune()
+			}
+		})
+	}
+	return nil
+}
+
+// Set the sizes of the socket's buffers, leaving those given as 0
+// alone. The kernel doubles the sizes we ask for, to allow for
+// bookkeeping overhead.
+func setSocketBuffers(fd int, sndBuf, rcvBuf int) error {
+	// We usually have CAP_NET_ADMIN, which lets us exceed
+	// wmem_max and rmem_max
+	if sndBuf > 0 {
+		if err := setSockoptForced(fd, syscall.SO_SNDBUFFORCE, syscall.SO_SNDBUF, sndBuf); err != nil {
+			return err
+		}
+	}
+	if rcvBuf > 0 {
+		if err := setSockoptForced(fd, syscall.SO_RCVBUFFORCE, syscall.SO_RCVBUF, rcvBuf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setSockoptForced(fd, forced, opt, value int) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, forced, value); err != nil {
+		return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, opt, value)
+	}
+	return nil
+}
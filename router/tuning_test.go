@@ -0,0 +1,68 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"testing"
+	"time"
+)
+
+func TestTuningValidate(t *testing.T) {
+	for _, tuning := range []Tuning{
+		{},
+		{QueueSize: 1024, SndBuf: 1 << 20, RcvBuf: 1 << 20},
+		{FastHeartbeat: 100 * time.Millisecond, SlowHeartbeat: time.Second},
+		{SlowHeartbeat: FastHeartbeat},
+		{FlushDelay: 200 * time.Microsecond},
+		{NATKeepalive: 5 * time.Second}} {
+		wt.AssertNoErr(t, tuning.Validate())
+	}
+	for _, tuning := range []Tuning{
+		{QueueSize: -1},
+		{QueueSize: MaxQueueSize + 1},
+		{SndBuf: -1},
+		{HeartbeatLoss: -1},
+		{FastHeartbeat: time.Millisecond},
+		{FastHeartbeat: time.Minute},
+		{FastHeartbeat: time.Second, SlowHeartbeat: 100 * time.Millisecond},
+		{FlushDelay: -time.Millisecond},
+		{FlushDelay: time.Second},
+		{NATKeepalive: -time.Second},
+		{NATKeepalive: time.Millisecond}} {
+		if tuning.Validate() == nil {
+			wt.Fatalf(t, "Expected %v to be invalid", tuning)
+		}
+	}
+}
+
+func TestTuningDefaults(t *testing.T) {
+	tuning := Tuning{SndBuf: 4096, SlowHeartbeat: time.Minute}.withDefaults()
+	wt.AssertEqualInt(t, tuning.QueueSize, ChannelSize, "queue size")
+	wt.AssertEqualInt(t, tuning.SndBuf, 4096, "send buffer")
+	wt.AssertEqualInt(t, int(tuning.FastHeartbeat), int(FastHeartbeat), "fast heartbeat")
+	wt.AssertEqualInt(t, int(tuning.SlowHeartbeat), int(time.Minute), "slow heartbeat")
+	wt.AssertEqualInt(t, int(tuning.FlushDelay), int(FlushDelay), "flush delay")
+}
+
+func TestCheckHeartbeats(t *testing.T) {
+	router := &Router{RouterConfig: RouterConfig{Tuning: Tuning{SlowHeartbeat: time.Second, HeartbeatLoss: 3}}}
+	conn := &LocalConnection{Router: router}
+	conn.established = true
+	conn.establishedAt = time.Now().Add(-time.Minute)
+	if _, ok := conn.SinceLastHeartbeat(); ok {
+		wt.Fatalf(t, "Expected no heartbeat yet")
+	}
+	if conn.checkHeartbeats() == nil {
+		wt.Fatalf(t, "Expected connection without heartbeats to be dead")
+	}
+	conn.lastHeartbeat = time.Now().Add(-2 * time.Second)
+	wt.AssertNoErr(t, conn.checkHeartbeats())
+	if since, ok := conn.SinceLastHeartbeat(); !ok || since < 2*time.Second {
+		wt.Fatalf(t, "Expected last heartbeat 2s ago, got %v", since)
+	}
+	conn.lastHeartbeat = time.Now().Add(-4 * time.Second)
+	if conn.checkHeartbeats() == nil {
+		wt.Fatalf(t, "Expected connection missing 3 heartbeats to be dead")
+	}
+	router.Tuning.HeartbeatLoss = 0
+	wt.AssertNoErr(t, conn.checkHeartbeats())
+}
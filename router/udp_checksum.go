@@ -0,0 +1,91 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Our raw sockets for DF sending leave the UDP checksum out of IPv4
+// packets, as the checksum is optional there. Some middleboxes drop
+// UDP with a zero checksum regardless. Frames we don't send with DF
+// go out with checksums computed by the kernel, so we can tell such a
+// path by PMTU verification failing even with packets small enough
+// for any path, while heartbeats get through. We then compute
+// checksums for the connection from there on, and remember the
+// remote's underlay IP, so that later connections to it start out
+// computing them.
+
+type ChecksumPaths struct {
+	sync.RWMutex
+	ips map[string]bool
+}
+
+func NewChecksumPaths() *ChecksumPaths {
+	return &ChecksumPaths{ips: make(map[string]bool)}
+}
+
+func (paths *ChecksumPaths) Add(ip net.IP) {
+	paths.Lock()
+	defer paths.Unlock()
+	paths.ips[ip.String()] = true
+}
+
+func (paths *ChecksumPaths) Contains(ip net.IP) bool {
+	paths.RLock()
+	defer paths.RUnlock()
+	return paths.ips[ip.String()]
+}
+
+func (paths *ChecksumPaths) String() string {
+	paths.RLock()
+	ips := make([]string, 0, len(paths.ips))
+	for ip := range paths.ips {
+		ips = append(ips, ip)
+	}
+	paths.RUnlock()
+	sort.Strings(ips)
+	var buf bytes.Buffer
+	for _, ip := range ips {
+		buf.WriteString(fmt.Sprintln(ip))
+	}
+	return buf.String()
+}
+
+// Whether packets we send with DF need UDP checksums
+func (conn *LocalConnection) UDPChecksums() bool {
+	return conn.Router.UDPChecksums || atomic.LoadInt32(&conn.udpChecksums) != 0
+}
+
+// Compute UDP checksums from now on, returning whether we weren't
+// already.
+func (conn *LocalConnection) requireUDPChecksums() bool {
+	if !atomic.CompareAndSwapInt32(&conn.udpChecksums, 0, 1) || conn.Router.UDPChecksums {
+		return false
+	}
+	conn.Router.ChecksumPaths.Add(conn.underlayIP())
+	conn.log("path drops UDP without checksums; computing them from now on")
+	return true
+}
+
+// Called when PMTU verification has failed. If nothing got through,
+// not even packets small enough for any path, while our DF packets
+// lack UDP checksums, start computing them, and verify from the top
+// again, returning true.
+func (fwd *Forwarder) checksumsNeeded() bool {
+	if _, raw := fwd.udpSender.(*RawUDPSender); !raw || fwd.highestGoodPMTU > 8 ||
+		fwd.unverifiedPMTU+fwd.effectiveOverhead() > MinPathMTU ||
+		!fwd.conn.requireUDPChecksums() {
+		return false
+	}
+	pmtu := fwd.maxEffectivePMTU()
+	if pmtu == 0 {
+		pmtu = DefaultPMTU - fwd.effectiveOverhead()
+	}
+	fwd.lowestBadPMTU = pmtu + 1
+	fwd.verifyEffectivePMTU(pmtu)
+	return true
+}
@@ -0,0 +1,82 @@
+package router
+
+import (
+	"code.google.com/p/gopacket"
+	"code.google.com/p/gopacket/layers"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+)
+
+// The ones' complement sum over the pseudo-header and UDP packet is
+// all ones when the checksum is right.
+func udpChecksumOK(src, dst net.IP, packet []byte) bool {
+	pseudo := append(append(append([]byte{}, src.To4()...), dst.To4()...), 0, byte(layers.IPProtocolUDP), byte(len(packet)>>8), byte(len(packet)))
+	sum := uint32(0)
+	for _, data := range [][]byte{pseudo, packet} {
+		for i := 0; i+1 < len(data); i += 2 {
+			sum += uint32(data[i])<<8 | uint32(data[i+1])
+		}
+		if len(data)%2 == 1 {
+			sum += uint32(data[len(data)-1]) << 8
+		}
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return sum == 0xffff
+}
+
+func TestRawUDPSenderChecksums(t *testing.T) {
+	local, remote := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	conn := &LocalConnection{remoteUDPAddr: &net.UDPAddr{IP: remote, Port: Port}}
+	conn.Router = &Router{}
+	sender := &RawUDPSender{
+		ipBuf:     gopacket.NewSerializeBuffer(),
+		opts:      gopacket.SerializeOptions{FixLengths: true},
+		udpHeader: &layers.UDP{SrcPort: layers.UDPPort(Port)},
+		conn:      conn}
+	wt.AssertNoErr(t, setChecksumPseudoHeader(sender.udpHeader, local, remote, false))
+	msg := []byte("some payload")
+
+	packet, err := sender.serialize(msg)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, int(packet[6])<<8|int(packet[7]), 0, "checksum when not required")
+
+	conn.udpChecksums = 1
+	packet, err = sender.serialize(msg)
+	wt.AssertNoErr(t, err)
+	if !udpChecksumOK(local, remote, packet) {
+		wt.Fatalf(t, "Bad UDP checksum %x", packet[6:8])
+	}
+
+	// A payload whose checksum works out as zero
+	sum := uint32(0)
+	for _, word := range []uint32{0x0a00, 0x0001, 0x0a00, 0x0002, uint32(layers.IPProtocolUDP), 10, Port, Port, 10} {
+		sum += word
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	filler := 0xffff - sum
+	packet, err = sender.serialize([]byte{byte(filler >> 8), byte(filler)})
+	wt.AssertNoErr(t, err)
+	if packet[6] != 0xff || packet[7] != 0xff {
+		wt.Fatalf(t, "Expected zero checksum to be sent as all ones; got %x", packet[6:8])
+	}
+	if !udpChecksumOK(local, remote, packet) {
+		wt.Fatalf(t, "Bad UDP checksum %x", packet[6:8])
+	}
+}
+
+func TestChecksumPaths(t *testing.T) {
+	paths := NewChecksumPaths()
+	ip := net.ParseIP("192.168.1.1")
+	if paths.Contains(ip) {
+		wt.Fatalf(t, "Expected path not to need checksums")
+	}
+	paths.Add(ip)
+	if !paths.Contains(net.IPv4(192, 168, 1, 1)) {
+		wt.Fatalf(t, "Expected path to need checksums")
+	}
+}
@@ -3,42 +3,157 @@ package router
 import (
 	"code.google.com/p/gopacket"
 	"code.google.com/p/gopacket/layers"
-	"log"
 	"net"
+	"strings"
+	"sync/atomic"
 	"syscall"
 )
 
+// Senders may hold on to packets passed to Send, in order to send
+// several of them at once. Flush sends any such pending packets.
+//
+// When Send or Flush fail with ENOBUFS, the packets which couldn't be
+// sent are kept, and are retried by the next Send or Flush.
 type UDPSender interface {
 	Send([]byte) error
+	Flush() error
+	GrowSendBuffer(max int) (size int, grown bool, err error)
 	Shutdown() error
 }
 
 type SimpleUDPSender struct {
 	conn    *LocalConnection
 	udpConn *net.UDPConn
+	batch   *MMsgBatch
+	worker  int // the forwarder worker we send for, which picks the path; see multipath.go
+}
+
+// Hand a packet to a batch, sending the batch when it is full. If the
+// batch is still full of packets retained after a failed send, and
+// sending them fails again, the new packet is dropped.
+func sendBatched(batch *MMsgBatch, msg []byte, addr *net.UDPAddr) error {
+	if batch.IsFull() {
+		if err := batch.Send(); err != nil {
+			return err
+		}
+	}
+	batch.Append(msg, addr)
+	if batch.IsFull() {
+		return batch.Send()
+	}
+	return nil
+}
+
+func flushBatch(batch *MMsgBatch) error {
+	if batch.IsEmpty() {
+		return nil
+	}
+	return batch.Send()
+}
+
+// Run f on the socket's fd. Unlike going through File, this neither
+// duplicates the fd nor switches the socket to blocking mode.
+func controlSocket(conn syscall.Conn, f func(fd int) error) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	if err := rawConn.Control(func(fd uintptr) { ferr = f(int(fd)) }); err != nil {
+		return err
+	}
+	return ferr
+}
+
+// A batch sending on the socket
+func newSocketBatch(conn syscall.Conn, size int) (*MMsgBatch, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	return NewMMsgBatch(rawConn, size), nil
+}
+
+// Double the socket's send buffer, up to max bytes. Returns the
+// resulting size, and whether it changed.
+func growSendBuffer(conn syscall.Conn, max int) (size int, grown bool, err error) {
+	cerr := controlSocket(conn, func(fd int) error {
+		size, grown, err = growSocketSendBuffer(fd, max)
+		return nil
+	})
+	if cerr != nil {
+		return 0, false, cerr
+	}
+	return
+}
+
+func growSocketSendBuffer(fd int, max int) (int, bool, error) {
+	// The kernel doubles the value we set, to allow for
+	// bookkeeping overhead, and reports the doubled value back.
+	size, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	if err != nil {
+		return 0, false, err
+	}
+	if size >= max {
+		return size, false, nil
+	}
+	newSize := size
+	if 2*newSize > max {
+		newSize = max / 2
+	}
+	// We usually have CAP_NET_ADMIN, which lets us exceed wmem_max
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUFFORCE, newSize); err != nil {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, newSize); err != nil {
+			return size, false, err
+		}
+	}
+	newSize, err = syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	return newSize, err == nil && newSize > size, err
 }
 
 type RawUDPSender struct {
 	ipBuf     gopacket.SerializeBuffer
 	opts      gopacket.SerializeOptions
 	udpHeader *layers.UDP
+	ipv6      bool
 	socket    *net.IPConn
 	conn      *LocalConnection
+	batch     *MMsgBatch
 }
 
 type MsgTooBigError struct {
 	PMTU int // actual pmtu, i.e. what the kernel told us
 }
 
-func NewSimpleUDPSender(conn *LocalConnection) *SimpleUDPSender {
-	return &SimpleUDPSender{udpConn: conn.Router.UDPListener, conn: conn}
+func NewSimpleUDPSender(conn *LocalConnection) (*SimpleUDPSender, error) {
+	batch, err := newSocketBatch(conn.Router.UDPListener, conn.Router.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	return &SimpleUDPSender{
+		udpConn: conn.Router.UDPListener,
+		conn:    conn,
+		batch:   batch}, nil
 }
 
 func (sender *SimpleUDPSender) Send(msg []byte) error {
-	_, err := sender.udpConn.WriteToUDP(msg, sender.conn.RemoteUDPAddr())
-	return err
+	return sendBatched(sender.batch, msg, sender.conn.pathFor(sender.worker))
+}
+
+func (sender *SimpleUDPSender) SetTOS(tos int) {
+	sender.batch.SetTOS(tos)
+}
+
+func (sender *SimpleUDPSender) Flush() error {
+	return flushBatch(sender.batch)
+}
+
+// NB: this socket is shared by all connections
+func (sender *SimpleUDPSender) GrowSendBuffer(max int) (int, bool, error) {
+	return growSendBuffer(sender.udpConn, max)
 }
 
+// The socket is shared, so there's nothing for us to close
 func (sender *SimpleUDPSender) Shutdown() error {
 	return nil
 }
@@ -50,46 +165,107 @@ func NewRawUDPSender(conn *LocalConnection) (*RawUDPSender, error) {
 	}
 	udpHeader := &layers.UDP{SrcPort: layers.UDPPort(Port)}
 	ipBuf := gopacket.NewSerializeBuffer()
-	opts := gopacket.SerializeOptions{
-		FixLengths: true,
-		// UDP header is calculated with a phantom IP
-		// header. Yes, it's totally nuts. Thankfully, for UDP
-		// over IPv4, the checksum is optional. It's not
-		// optional for IPv6, but we'll ignore that for
-		// now. TODO
-		ComputeChecksums: false}
+	// UDP header is calculated with a phantom IP
+	// header. Yes, it's totally nuts. Thankfully, for UDP
+	// over IPv4, the checksum is optional, so we only compute it
+	// where the path needs it; see ChecksumPaths. It's not
+	// optional for IPv6, so there we always need to compute it.
+	opts := gopacket.SerializeOptions{FixLengths: true}
+	ipv6 := underlayIPv6(conn.TCPConn.RemoteAddr())
+	local, remote := ipSocket.LocalAddr().(*net.IPAddr), ipSocket.RemoteAddr().(*net.IPAddr)
+	if err := setChecksumPseudoHeader(udpHeader, local.IP, remote.IP, ipv6); err != nil {
+		ipSocket.Close()
+		return nil, err
+	}
+	if conn.Router.ChecksumPaths.Contains(conn.underlayIP()) {
+		atomic.StoreInt32(&conn.udpChecksums, 1)
+	}
 
+	sndBuf := conn.Router.CurrentTuning().SndBuf
+	if err := controlSocket(ipSocket, func(fd int) error { return setSocketBuffers(fd, sndBuf, 0) }); err != nil {
+		ipSocket.Close()
+		return nil, err
+	}
+	batch, err := newSocketBatch(ipSocket, conn.Router.BatchSize)
+	if err != nil {
+		ipSocket.Close()
+		return nil, err
+	}
 	return &RawUDPSender{
 		ipBuf:     ipBuf,
 		opts:      opts,
 		udpHeader: udpHeader,
+		ipv6:      ipv6,
 		socket:    ipSocket,
-		conn:      conn}, nil
+		conn:      conn,
+		batch:     batch}, nil
 }
 
 func (sender *RawUDPSender) Send(msg []byte) error {
+	packet, err := sender.serialize(msg)
+	if err != nil {
+		return err
+	}
+	return sender.checkMsgSize(sendBatched(sender.batch, packet, nil), len(packet), len(msg))
+}
+
+func (sender *RawUDPSender) serialize(msg []byte) ([]byte, error) {
 	payload := gopacket.Payload(msg)
 	sender.udpHeader.DstPort = layers.UDPPort(sender.conn.RemoteUDPAddr().Port)
+	sender.opts.ComputeChecksums = sender.ipv6 || sender.conn.UDPChecksums()
 
 	err := gopacket.SerializeLayers(sender.ipBuf, sender.opts, sender.udpHeader, &payload)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	packet := sender.ipBuf.Bytes()
-	_, err = sender.socket.Write(packet)
-	if err == nil || PosixError(err) != syscall.EMSGSIZE {
-		return err
+	// A computed checksum of zero goes out as all ones, since zero
+	// means there isn't one.
+	if sender.opts.ComputeChecksums && packet[6] == 0 && packet[7] == 0 {
+		packet[6], packet[7] = 0xff, 0xff
 	}
-	f, err := sender.socket.File()
-	if err != nil {
+	return packet, nil
+}
+
+func setChecksumPseudoHeader(udpHeader *layers.UDP, local, remote net.IP, ipv6 bool) error {
+	if ipv6 {
+		return udpHeader.SetNetworkLayerForChecksum(&layers.IPv6{
+			SrcIP:      local,
+			DstIP:      remote,
+			NextHeader: layers.IPProtocolUDP})
+	}
+	return udpHeader.SetNetworkLayerForChecksum(&layers.IPv4{
+		SrcIP:    local,
+		DstIP:    remote,
+		Protocol: layers.IPProtocolUDP})
+}
+
+func (sender *RawUDPSender) SetTOS(tos int) {
+	sender.batch.SetTOS(tos)
+}
+
+func (sender *RawUDPSender) Flush() error {
+	return sender.checkMsgSize(flushBatch(sender.batch), 0, 0)
+}
+
+func (sender *RawUDPSender) GrowSendBuffer(max int) (int, bool, error) {
+	return growSendBuffer(sender.socket, max)
+}
+
+// Translate EMSGSIZE into a MsgTooBigError carrying the PMTU the
+// kernel has discovered. The packet sizes are for logging only, and
+// are zero when not known.
+func (sender *RawUDPSender) checkMsgSize(err error, packetLen, msgLen int) error {
+	if err == nil || PosixError(err) != syscall.EMSGSIZE {
 		return err
 	}
-	defer f.Close()
-	fd := int(f.Fd())
-	log.Println("EMSGSIZE on send, expecting PMTU update (IP packet was",
-		len(packet), "bytes, payload was", len(msg), "bytes)")
-	pmtu, err := syscall.GetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU)
-	if err != nil {
+	logPMTU.Info("EMSGSIZE on send, expecting PMTU update (IP packet was",
+		packetLen, "bytes, payload was", msgLen, "bytes)")
+	var pmtu int
+	if err := controlSocket(sender.socket, func(fd int) (err error) {
+		pmtu, err = getPMTU(fd)
+		return
+	}); err != nil {
 		return err
 	}
 	return MsgTooBigError{PMTU: pmtu}
@@ -100,39 +276,112 @@ func (sender *RawUDPSender) Shutdown() error {
 	return sender.socket.Close()
 }
 
+// A raw socket to send UDP packets to the remote on, from the address
+// the control connection is from, which is where we bind to, if we do.
 func dialIP(conn *LocalConnection) (*net.IPConn, error) {
 	ipLocalAddr, err := ipAddr(conn.TCPConn.LocalAddr())
 	if err != nil {
 		return nil, err
 	}
+	if bindAddr := conn.Router.BindAddr; bindAddr != nil {
+		ipLocalAddr = &net.IPAddr{IP: bindAddr}
+	}
 	ipRemoteAddr, err := ipAddr(conn.TCPConn.RemoteAddr())
 	if err != nil {
 		return nil, err
 	}
-	ipSocket, err := net.DialIP("ip4:UDP", ipLocalAddr, ipRemoteAddr)
-	if err != nil {
-		return nil, err
+	network := "ip4:UDP"
+	if underlayIPv6(conn.TCPConn.RemoteAddr()) {
+		network = "ip6:UDP"
 	}
-	f, err := ipSocket.File()
+	ipSocket, err := net.DialIP(network, ipLocalAddr, ipRemoteAddr)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	fd := int(f.Fd())
-	// This Makes sure all packets we send out have DF set on them.
-	err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
-	if err != nil {
+	tos := conn.Router.DSCP.socketTOS()
+	if err := controlSocket(ipSocket, func(fd int) error {
+		// This Makes sure all packets we send out have DF set on them.
+		if err := setPMTUDiscovery(fd, true); err != nil {
+			return err
+		}
+		return setTOS(fd, tos)
+	}); err != nil {
+		ipSocket.Close()
 		return nil, err
 	}
 	return ipSocket, nil
 }
 
+// Control whether the kernel performs PMTU discovery, and thus sets DF,
+// for packets sent on the socket. Dual-stack sockets need both the
+// IPv6 and the IPv4 option set.
+func setPMTUDiscovery(fd int, df bool) error {
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return err
+	}
+	ipv4Mode, ipv6Mode := syscall.IP_PMTUDISC_DONT, syscall.IPV6_PMTUDISC_DONT
+	if df {
+		ipv4Mode, ipv6Mode = syscall.IP_PMTUDISC_DO, syscall.IPV6_PMTUDISC_DO
+	}
+	if _, ok := sa.(*syscall.SockaddrInet6); !ok {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, ipv4Mode)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, ipv6Mode); err != nil {
+		return err
+	}
+	// raw IPv6 sockets don't do IPv4 at all, and say so
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, ipv4Mode); err != nil && err != syscall.ENOPROTOOPT {
+		return err
+	}
+	return nil
+}
+
+func getPMTU(fd int) (int, error) {
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := sa.(*syscall.SockaddrInet6); ok {
+		return syscall.GetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MTU)
+	}
+	return syscall.GetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU)
+}
+
+func underlayIPv6(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(stripZone(host))
+	return ip != nil && ip.To4() == nil
+}
+
+// Overhead of the IP and UDP headers on the underlay of conn
+func udpOverhead(conn *LocalConnection) int {
+	if underlayIPv6(conn.TCPConn.RemoteAddr()) {
+		return UDPOverheadIPv6
+	}
+	return UDPOverhead
+}
+
 func ipAddr(addr net.Addr) (*net.IPAddr, error) {
 	host, _, err := net.SplitHostPort(addr.String())
 	if err != nil {
 		return nil, err
 	}
+	zone := ""
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		zone = host[i+1:]
+	}
 	return &net.IPAddr{
-		IP:   net.ParseIP(host),
-		Zone: ""}, nil
+		IP:   net.ParseIP(stripZone(host)),
+		Zone: zone}, nil
+}
+
+func stripZone(host string) string {
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		return host[:i]
+	}
+	return host
 }
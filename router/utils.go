@@ -8,6 +8,7 @@ import (
 	"hash/fnv"
 	"log"
 	"net"
+	"strings"
 )
 
 type Interaction struct {
@@ -23,7 +24,7 @@ func checkFatal(e error) {
 
 func checkWarn(e error) {
 	if e != nil {
-		log.Println(e)
+		logRouter.Warn(e)
 	}
 }
 
@@ -38,6 +39,27 @@ func PosixError(err error) error {
 	return operr.Err
 }
 
+// The MTU of the interface with the given address, or 0 if there is
+// no such interface.
+func InterfaceMTU(ip net.IP) int {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return 0
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return iface.MTU
+			}
+		}
+	}
+	return 0
+}
+
 func (mtbe MsgTooBigError) Error() string {
 	return fmt.Sprint("Msg too big error. PMTU is ", mtbe.PMTU)
 }
@@ -66,6 +88,13 @@ func Concat(elems ...[]byte) []byte {
 	return res
 }
 
+func randBytes(n int) []byte {
+	buf := make([]byte, n)
+	_, err := rand.Read(buf)
+	checkFatal(err)
+	return buf
+}
+
 func randUint64() (r uint64) {
 	buf := make([]byte, 8)
 	_, err := rand.Read(buf)
@@ -121,13 +150,45 @@ func (lop ListOfPeers) Less(i, j int) bool {
 	return lop[i].Name < lop[j].Name
 }
 
-// given an address like '1.2.3.4:567', return the address if it has a port,
-// otherwise return the address with weave's standard port number
+// given an address like '1.2.3.4:567' or '[fe80::1]:567', return the
+// address if it has a port, otherwise return the address with weave's
+// standard port number
 func NormalisePeerAddr(peerAddr string) string {
+	if isWebSocketAddr(peerAddr) {
+		return WebSocketScheme + normaliseHostPort(strings.TrimPrefix(peerAddr, WebSocketScheme), WebSocketPort)
+	}
+	return normaliseHostPort(peerAddr, Port)
+}
+
+// Whether the peer address, once normalised, is something we can dial,
+// i.e. its host is an IP address or host name, rather than, say, a
+// peer name.
+func isDialablePeerAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(strings.TrimPrefix(addr, WebSocketScheme))
+	return err == nil && (net.ParseIP(host) != nil || !strings.Contains(host, ":"))
+}
+
+func normaliseHostPort(peerAddr string, port int) string {
 	_, _, err := net.SplitHostPort(peerAddr)
 	if err == nil {
 		return peerAddr
 	} else {
-		return fmt.Sprintf("%s:%d", peerAddr, Port)
+		return net.JoinHostPort(strings.Trim(peerAddr, "[]"), fmt.Sprint(port))
+	}
+}
+
+// Resolve a peer address, as given by the user, to the form we
+// connect to. Hostnames stay as they are; see resolveHostPort.
+func ResolvePeerAddr(peerAddr string) (string, error) {
+	addrStr := NormalisePeerAddr(peerAddr)
+	scheme := ""
+	if isWebSocketAddr(addrStr) {
+		scheme = WebSocketScheme
+		addrStr = strings.TrimPrefix(addrStr, WebSocketScheme)
+	}
+	addr, err := resolveHostPort(addrStr)
+	if err != nil {
+		return "", err
 	}
+	return scheme + addr, nil
 }
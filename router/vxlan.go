@@ -0,0 +1,30 @@
+package router
+
+import (
+	"encoding/binary"
+)
+
+// VXLAN (RFC 7348) headers are just a flag and the VNI, so VXLAN only
+// carries the frames we send to a remote for its own hosts, whose
+// source and destination peers are implied; see encap.go.
+
+const (
+	VXLANPort       = 4789 // as assigned by IANA
+	VXLANHeaderSize = 8
+	vxlanFlagVNI    = 0x08 // the VNI is valid
+)
+
+func putVXLANHeader(buf []byte, vni uint32) int {
+	binary.BigEndian.PutUint32(buf[0:4], vxlanFlagVNI<<24)
+	binary.BigEndian.PutUint32(buf[4:8], vni<<8)
+	return VXLANHeaderSize
+}
+
+// The VNI of a VXLAN packet and its frame, and whether it has a valid
+// VNI.
+func parseVXLANHeader(packet []byte) (uint32, []byte, bool) {
+	if len(packet) < VXLANHeaderSize || packet[0]&vxlanFlagVNI == 0 {
+		return 0, nil, false
+	}
+	return binary.BigEndian.Uint32(packet[4:8]) >> 8, packet[VXLANHeaderSize:], true
+}
@@ -0,0 +1,202 @@
+package router
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Peers behind firewalls or proxies which only let HTTPS out can
+// connect to us over WebSocket on TLS, by giving our address as
+// wss://<host>[:<port>]. Such connections carry everything, frames
+// included, in the one stream, exactly like a connection which has
+// fallen back to TCP; see tcp_fallback.go.
+//
+// TLS only serves to get us through firewalls and proxies. We don't
+// verify certificates; peers authenticate each other with the
+// password, as on any other connection.
+
+const (
+	WebSocketScheme = "wss://"
+	webSocketPath   = "/weave"
+)
+
+// A WebSocket connection as a stream, whose addresses are those of
+// the underlying TCP connection rather than URLs, since that is what
+// the rest of the router expects.
+type webSocketConn struct {
+	*websocket.Conn
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func (conn *webSocketConn) LocalAddr() net.Addr {
+	return conn.localAddr
+}
+
+func (conn *webSocketConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+// Connect to a peer at host:port over WebSocket, through the HTTPS
+// proxy configured in the environment, if any.
+func DialWebSocket(address string) (net.Conn, error) {
+	remoteAddr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	target := &url.URL{Scheme: "https", Host: address}
+	proxy, err := http.ProxyFromEnvironment(&http.Request{URL: target})
+	if err != nil {
+		return nil, err
+	}
+	dialAddr := address
+	if proxy != nil {
+		dialAddr = proxy.Host
+	}
+	tcpConn, err := net.DialTimeout("tcp", dialAddr, WebSocketTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if proxy != nil {
+		if err := proxyConnect(tcpConn, address, proxy); err != nil {
+			tcpConn.Close()
+			return nil, err
+		}
+	}
+	tlsConn := tls.Client(tcpConn, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+	config, err := websocket.NewConfig(WebSocketScheme+address+webSocketPath, target.String())
+	if err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	tcpConn.SetDeadline(time.Now().Add(WebSocketTimeout))
+	ws, err := websocket.NewClient(config, tlsConn)
+	if err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	tcpConn.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+	return &webSocketConn{Conn: ws, localAddr: tcpConn.LocalAddr(), remoteAddr: remoteAddr}, nil
+}
+
+// Ask an HTTP proxy for a tunnel to address.
+func proxyConnect(conn net.Conn, address string, proxy *url.URL) error {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header)}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		req.SetBasicAuth(proxy.User.Username(), password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+	conn.SetDeadline(time.Now().Add(WebSocketTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	// The proxy doesn't send anything beyond its response until we
+	// do, so the reader can't consume any of the tunnelled stream.
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy %s refused to connect to %s: %s", proxy.Host, address, resp.Status)
+	}
+	return nil
+}
+
+func (router *Router) listenWebSocket(localPort int) {
+	cert, err := router.webSocketCertificate()
+	checkFatal(err)
+	mux := http.NewServeMux()
+	mux.Handle(webSocketPath, websocket.Server{Handler: router.acceptWebSocket})
+	server := &http.Server{
+		Addr:      router.listenAddr(localPort),
+		Handler:   mux,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}
+	ln, err := net.Listen("tcp", server.Addr)
+	checkFatal(err)
+	logConnection.Info("Listening for WebSocket connections on", server.Addr)
+	go func() {
+		checkFatal(server.Serve(tls.NewListener(ln, server.TLSConfig)))
+	}()
+}
+
+// The server runs the handler in a goroutine of its own, and closes
+// the connection when it returns, so we wait for the connection to
+// finish.
+func (router *Router) acceptWebSocket(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	req := ws.Request()
+	remoteAddr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr)
+	if err != nil {
+		logConnection.Warn("Unable to accept WebSocket connection:", err)
+		return
+	}
+	if !router.PeerACL.AllowAddr(remoteAddr.IP) {
+		logConnection.With("addr", req.RemoteAddr).Info("WebSocket connection rejected by peer rules")
+		return
+	}
+	localAddr, _ := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	logConnection.With("addr", req.RemoteAddr).Info("WebSocket connection accepted")
+	wsConn := &webSocketConn{Conn: ws, localAddr: localAddr, remoteAddr: remoteAddr}
+	connRemote := NewRemoteConnection(router.Ourself.Peer, nil, req.RemoteAddr, false)
+	connLocal := NewLocalConnection(connRemote, wsConn, nil, router)
+	connLocal.Start(true)
+	<-connLocal.finished
+}
+
+// The configured certificate, or a self-signed one if there isn't
+// one; see above for why the latter is fine.
+func (router *Router) webSocketCertificate() (tls.Certificate, error) {
+	if router.TLSCertFile != "" {
+		return tls.LoadX509KeyPair(router.TLSCertFile, router.TLSKeyFile)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: router.Ourself.Name.String()},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func isWebSocketAddr(peerAddr string) bool {
+	return strings.HasPrefix(peerAddr, WebSocketScheme)
+}
@@ -0,0 +1,46 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"golang.org/x/net/websocket"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormaliseWebSocketAddr(t *testing.T) {
+	wt.AssertEqualString(t, NormalisePeerAddr("wss://10.0.0.1"), "wss://10.0.0.1:443", "default port")
+	wt.AssertEqualString(t, NormalisePeerAddr("wss://10.0.0.1:8443"), "wss://10.0.0.1:8443", "explicit port")
+	wt.AssertEqualString(t, NormalisePeerAddr("wss://[::1]"), "wss://[::1]:443", "IPv6")
+	wt.AssertEqualString(t, NormalisePeerAddr("10.0.0.1"), "10.0.0.1:6783", "TCP")
+	addr, err := ResolvePeerAddr("wss://127.0.0.1")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, addr, "wss://127.0.0.1:443", "resolved address")
+}
+
+func TestDialWebSocket(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle(webSocketPath, websocket.Server{Handler: func(ws *websocket.Conn) {
+		ws.PayloadType = websocket.BinaryFrame
+		io.Copy(ws, ws)
+	}})
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+
+	conn, err := DialWebSocket(strings.TrimPrefix(server.URL, "https://"))
+	wt.AssertNoErr(t, err)
+	defer conn.Close()
+	if _, ok := conn.RemoteAddr().(*net.TCPAddr); !ok {
+		wt.Fatalf(t, "Expected a TCP remote address, got %v", conn.RemoteAddr())
+	}
+	msg := []byte("hello over WebSocket")
+	_, err = conn.Write(msg)
+	wt.AssertNoErr(t, err)
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, buf)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, string(buf), string(msg), "echoed message")
+}
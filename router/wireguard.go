@@ -0,0 +1,260 @@
+package router
+
+import (
+	"code.google.com/p/go.crypto/nacl/box"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	weavenet "github.com/zettio/weave/net"
+	"net"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// The WireGuard datapath encrypts the traffic the fast path (see
+// fastpath.go) offloads to the kernel, so that peers using a password
+// get it too. Rather than at the underlay IPs of peers, we point the
+// fast path's VXLAN device at their addresses on a kernel WireGuard
+// device, so the VXLAN packets travel through WireGuard tunnels. The
+// device has to be created beforehand, with an IPv4 address unique to
+// this peer in a subnet shared by all peers, e.g.
+//
+//   ip link add weave-wg type wireguard
+//   ip addr add 10.40.0.1/16 dev weave-wg
+//   ip link set weave-wg up
+//
+// We give the device a fresh key pair whenever we start. Peers with a
+// WireGuard device of their own exchange their public keys, ports and
+// tunnel addresses over the control channel of their connection, which
+// the password encrypts, and each adds the other as a WireGuard peer.
+// Topology, broadcasts and everything else the fast path doesn't carry
+// stay with the router.
+
+const (
+	WireGuardPort       = 51820
+	wireGuardKeyMsgSize = 32 + 2 + 4 // public key, port, tunnel IP
+)
+
+type WireGuard struct {
+	sync.Mutex
+	iface    *net.Interface
+	family   uint16 // of generic netlink
+	tunnelIP net.IP
+	port     int
+	public   *[32]byte
+	peers    map[PeerName]*wireGuardPeer
+}
+
+type wireGuardPeer struct {
+	uid      uint64 // of the connection which added it
+	public   [32]byte
+	tunnelIP net.IP
+}
+
+func NewWireGuard(devName string, port int) (*WireGuard, error) {
+	iface, err := net.InterfaceByName(devName)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find WireGuard device %s: %v", devName, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var tunnelIP net.IP
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			tunnelIP = ipnet.IP.To4()
+			break
+		}
+	}
+	if tunnelIP == nil {
+		return nil, fmt.Errorf("WireGuard device %s has no IPv4 address", devName)
+	}
+	family, err := weavenet.GenlFamily(wgGenlName)
+	if err != nil {
+		return nil, err
+	}
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	wg := &WireGuard{
+		iface:    iface,
+		family:   family,
+		tunnelIP: tunnelIP,
+		port:     port,
+		public:   public,
+		peers:    make(map[PeerName]*wireGuardPeer)}
+	// Peers from before we started have no idea of our new key
+	err = wg.setDevice(
+		weavenet.NetlinkAttr(wgDeviceAPrivateKey, private[:]),
+		uint16Attr(wgDeviceAListenPort, uint16(port)),
+		uint32Attr(wgDeviceAFlags, wgDeviceFReplacePeers))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to configure WireGuard device %s: %v", devName, err)
+	}
+	return wg, nil
+}
+
+// Add the peer, at the endpoint and with the tunnel address, or
+// replace what we had for it.
+func (wg *WireGuard) AddPeer(name PeerName, uid uint64, public *[32]byte, endpoint *net.UDPAddr, tunnelIP net.IP) error {
+	wg.Lock()
+	defer wg.Unlock()
+	for otherName, other := range wg.peers {
+		if otherName != name && other.tunnelIP.Equal(tunnelIP) {
+			return fmt.Errorf("WireGuard tunnel address %v of %s is already that of %s", tunnelIP, name, otherName)
+		}
+	}
+	if tunnelIP.Equal(wg.tunnelIP) {
+		return fmt.Errorf("WireGuard tunnel address %v of %s is ours", tunnelIP, name)
+	}
+	if existing, found := wg.peers[name]; found && existing.public != *public {
+		if err := wg.removePeer(&existing.public); err != nil {
+			return err
+		}
+	}
+	err := wg.setDevice(weavenet.NetlinkNestedAttr(wgDeviceAPeers, weavenet.NetlinkNestedAttr(0,
+		weavenet.NetlinkAttr(wgPeerAPublicKey, public[:]),
+		uint32Attr(wgPeerAFlags, wgPeerFReplaceAllowedIPs),
+		weavenet.NetlinkAttr(wgPeerAEndpoint, sockaddrBytes(endpoint)),
+		weavenet.NetlinkNestedAttr(wgPeerAAllowedIPs, weavenet.NetlinkNestedAttr(0,
+			uint16Attr(wgAllowedIPAFamily, syscall.AF_INET),
+			weavenet.NetlinkAttr(wgAllowedIPAIPAddr, tunnelIP.To4()),
+			weavenet.NetlinkAttr(wgAllowedIPACIDRMask, []byte{32}))))))
+	if err != nil {
+		return err
+	}
+	wg.peers[name] = &wireGuardPeer{uid: uid, public: *public, tunnelIP: tunnelIP}
+	return nil
+}
+
+// Remove the peer, unless a later connection to it has added it since.
+func (wg *WireGuard) DeletePeer(name PeerName, uid uint64) error {
+	wg.Lock()
+	defer wg.Unlock()
+	peer, found := wg.peers[name]
+	if !found || peer.uid != uid {
+		return nil
+	}
+	delete(wg.peers, name)
+	return wg.removePeer(&peer.public)
+}
+
+// The peer's address on the tunnel; nil if we don't have one for it.
+func (wg *WireGuard) TunnelIP(name PeerName) net.IP {
+	wg.Lock()
+	defer wg.Unlock()
+	if peer, found := wg.peers[name]; found {
+		return peer.tunnelIP
+	}
+	return nil
+}
+
+func (wg *WireGuard) String() string {
+	wg.Lock()
+	defer wg.Unlock()
+	return fmt.Sprintf("%s (%v, port %d, %d peers)", wg.iface.Name, wg.tunnelIP, wg.port, len(wg.peers))
+}
+
+// What we tell peers about ourselves.
+func (wg *WireGuard) keyMsg() []byte {
+	msg := make([]byte, wireGuardKeyMsgSize)
+	copy(msg, wg.public[:])
+	binary.BigEndian.PutUint16(msg[32:34], uint16(wg.port))
+	copy(msg[34:], wg.tunnelIP)
+	return msg
+}
+
+func decodeWireGuardKeyMsg(msg []byte) (public *[32]byte, port int, tunnelIP net.IP, err error) {
+	if len(msg) != wireGuardKeyMsgSize {
+		return nil, 0, nil, fmt.Errorf("WireGuard key message has length %d; expected %d", len(msg), wireGuardKeyMsgSize)
+	}
+	public = new([32]byte)
+	copy(public[:], msg)
+	return public, int(binary.BigEndian.Uint16(msg[32:34])), net.IP(append([]byte{}, msg[34:]...)), nil
+}
+
+func (conn *LocalConnection) sendWireGuardKey() error {
+	return conn.handleSendProtocolMsg(ProtocolMsg{ProtocolWireGuardKey, conn.Router.WireGuard.keyMsg()})
+}
+
+// The remote's WireGuard device is at the port on the IP it connected
+// to us from, or we to it.
+func (conn *LocalConnection) receivedWireGuardKey(msg []byte) error {
+	public, port, tunnelIP, err := decodeWireGuardKeyMsg(msg)
+	if err != nil {
+		return err
+	}
+	endpoint := &net.UDPAddr{IP: conn.TCPConn.RemoteAddr().(*net.TCPAddr).IP, Port: port}
+	if err := conn.Router.WireGuard.AddPeer(conn.remote.Name, conn.uid, public, endpoint, tunnelIP); err != nil {
+		conn.log("unable to add WireGuard peer:", err)
+		return nil
+	}
+	conn.log("added WireGuard peer at", endpoint, "with tunnel address", tunnelIP)
+	return nil
+}
+
+// Generic netlink plumbing for WireGuard devices, from
+// <linux/wireguard.h>.
+
+const (
+	wgGenlName               = "wireguard"
+	wgGenlVersion            = 1
+	wgCmdSetDevice           = 1
+	wgDeviceAIfIndex         = 1
+	wgDeviceAPrivateKey      = 3
+	wgDeviceAFlags           = 5
+	wgDeviceAListenPort      = 6
+	wgDeviceAPeers           = 8
+	wgDeviceFReplacePeers    = 1
+	wgPeerAPublicKey         = 1
+	wgPeerAFlags             = 3
+	wgPeerAEndpoint          = 4
+	wgPeerAAllowedIPs        = 9
+	wgPeerFRemoveMe          = 1
+	wgPeerFReplaceAllowedIPs = 2
+	wgAllowedIPAFamily       = 1
+	wgAllowedIPAIPAddr       = 2
+	wgAllowedIPACIDRMask     = 3
+)
+
+func (wg *WireGuard) setDevice(attrs ...[]byte) error {
+	return weavenet.GenlRequest(wg.family, wgCmdSetDevice, wgGenlVersion,
+		append([][]byte{uint32Attr(wgDeviceAIfIndex, uint32(wg.iface.Index))}, attrs...)...)
+}
+
+func (wg *WireGuard) removePeer(public *[32]byte) error {
+	return wg.setDevice(weavenet.NetlinkNestedAttr(wgDeviceAPeers, weavenet.NetlinkNestedAttr(0,
+		weavenet.NetlinkAttr(wgPeerAPublicKey, public[:]),
+		uint32Attr(wgPeerAFlags, wgPeerFRemoveMe))))
+}
+
+func uint16Attr(attrType uint16, value uint16) []byte {
+	data := make([]byte, 2)
+	*(*uint16)(unsafe.Pointer(&data[0])) = value
+	return weavenet.NetlinkAttr(attrType, data)
+}
+
+func uint32Attr(attrType uint16, value uint32) []byte {
+	data := make([]byte, 4)
+	*(*uint32)(unsafe.Pointer(&data[0])) = value
+	return weavenet.NetlinkAttr(attrType, data)
+}
+
+// A struct sockaddr_in or sockaddr_in6 for the address.
+func sockaddrBytes(addr *net.UDPAddr) []byte {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		sa := make([]byte, syscall.SizeofSockaddrInet4)
+		*(*uint16)(unsafe.Pointer(&sa[0])) = syscall.AF_INET
+		binary.BigEndian.PutUint16(sa[2:4], uint16(addr.Port))
+		copy(sa[4:8], ip4)
+		return sa
+	}
+	sa := make([]byte, syscall.SizeofSockaddrInet6)
+	*(*uint16)(unsafe.Pointer(&sa[0])) = syscall.AF_INET6
+	binary.BigEndian.PutUint16(sa[2:4], uint16(addr.Port))
+	copy(sa[8:24], addr.IP.To16())
+	return sa
+}
@@ -0,0 +1,30 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"testing"
+)
+
+func TestWireGuardKeyMsg(t *testing.T) {
+	wg := &WireGuard{tunnelIP: net.ParseIP("10.40.0.1").To4(), port: WireGuardPort, public: &[32]byte{1, 2, 3}}
+	public, port, tunnelIP, err := decodeWireGuardKeyMsg(wg.keyMsg())
+	wt.AssertNoErr(t, err)
+	if *public != *wg.public {
+		wt.Fatalf(t, "Expected public key %v, got %v", wg.public, public)
+	}
+	wt.AssertEqualInt(t, port, WireGuardPort, "port")
+	wt.AssertEqualString(t, tunnelIP.String(), "10.40.0.1", "tunnel IP")
+	if _, _, _, err := decodeWireGuardKeyMsg(wg.keyMsg()[:32]); err == nil {
+		wt.Fatalf(t, "Expected an error decoding a short message")
+	}
+}
+
+func TestSockaddrBytes(t *testing.T) {
+	sa := sockaddrBytes(&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 0x1234})
+	wt.AssertEqualInt(t, len(sa), 16, "sockaddr_in length")
+	wt.AssertEqualString(t, string(sa[2:8]), "\x12\x34\x0a\x00\x00\x01", "port and address")
+	sa = sockaddrBytes(&net.UDPAddr{IP: net.ParseIP("fd00::1"), Port: 0x1234})
+	wt.AssertEqualInt(t, len(sa), 28, "sockaddr_in6 length")
+	wt.AssertEqualString(t, net.IP(sa[8:24]).String(), "fd00::1", "address")
+}
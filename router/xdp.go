@@ -0,0 +1,256 @@
+package router
+
+import (
+	"fmt"
+	weavenet "github.com/zettio/weave/net"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// With the fast path, the kernel encapsulates unicast frames between
+// unencrypted peers, but they still get captured by us on their way
+// to the VXLAN device. An XDP program on the interface we sniff on can
+// send them straight to the device instead, before they ever reach
+// the capture: it looks up the destination MAC of each frame in a map
+// we keep in step with the fast path's forwarding entries, redirecting
+// the frame to the device if the MAC is there, and letting it through
+// to us as usual otherwise. Broadcast and multicast frames are never
+// in the map.
+//
+// VXLAN devices can't take frames from native XDP, so the program
+// runs in generic mode, which needs Linux 4.12 or later.
+
+type XDPFilter struct {
+	iface  *net.Interface // where the program is attached
+	mapFD  int            // destination MAC -> ifindex of the device to redirect to
+	progFD int
+}
+
+// From <linux/bpf.h> and <linux/if_link.h>; not defined in the
+// syscall package
+const (
+	bpfMapCreate      = 0
+	bpfMapUpdateElem  = 2
+	bpfMapDeleteElem  = 3
+	bpfProgLoad       = 5
+	bpfMapTypeHash    = 1
+	bpfProgTypeXDP    = 6
+	bpfPseudoMapFD    = 1
+	bpfFuncMapLookup  = 1
+	bpfFuncRedirect   = 23
+	xdpPass           = 2
+	xdpFlagsSKBMode   = 2
+	iflaXDP           = 43
+	iflaXDPFD         = 1
+	iflaXDPFlags      = 3
+	nlaFNested        = 0x8000
+	sizeofIfInfomsg   = 16
+	xdpMaxMACs        = 65536
+	xdpVerifierLogLen = 64 * 1024
+)
+
+// Load the program, and attach it to the interface, letting all frames
+// through until we add MACs.
+func NewXDPFilter(iface *net.Interface) (*XDPFilter, error) {
+	xdp := &XDPFilter{iface: iface, mapFD: -1, progFD: -1}
+	var err error
+	if xdp.mapFD, err = bpfCreateHashMap(6, 4, xdpMaxMACs); err != nil {
+		return nil, os.NewSyscallError("bpf map create", err)
+	}
+	if xdp.progFD, err = bpfLoadXDP(xdpProgram(xdp.mapFD)); err != nil {
+		xdp.close()
+		return nil, err
+	}
+	if err := xdp.attach(xdp.progFD); err != nil {
+		xdp.close()
+		return nil, fmt.Errorf("Unable to attach XDP program to %s: %v", iface.Name, err)
+	}
+	return xdp, nil
+}
+
+func (xdp *XDPFilter) Add(mac net.HardwareAddr, target *net.Interface) error {
+	ifindex := uint32(target.Index)
+	return os.NewSyscallError("bpf map update", bpfMapOp(bpfMapUpdateElem, xdp.mapFD,
+		unsafe.Pointer(&mac[0]), unsafe.Pointer(&ifindex)))
+}
+
+func (xdp *XDPFilter) Delete(mac net.HardwareAddr) error {
+	err := bpfMapOp(bpfMapDeleteElem, xdp.mapFD, unsafe.Pointer(&mac[0]), nil)
+	if err == syscall.ENOENT {
+		return nil
+	}
+	return os.NewSyscallError("bpf map delete", err)
+}
+
+// Detach the program, so all frames reach us again.
+func (xdp *XDPFilter) Close() error {
+	err := xdp.attach(-1)
+	xdp.close()
+	return err
+}
+
+func (xdp *XDPFilter) close() {
+	if xdp.progFD >= 0 {
+		syscall.Close(xdp.progFD)
+	}
+	if xdp.mapFD >= 0 {
+		syscall.Close(xdp.mapFD)
+	}
+}
+
+// Attach the program to the interface in generic mode, or detach
+// whatever is attached for an fd of -1; the equivalent of 'ip link set
+// <iface> xdpgeneric obj ...'.
+func (xdp *XDPFilter) attach(progFD int) error {
+	body := make([]byte, sizeofIfInfomsg)
+	body[0] = syscall.AF_UNSPEC
+	*(*int32)(unsafe.Pointer(&body[4])) = int32(xdp.iface.Index)
+	fd, flags := make([]byte, 4), make([]byte, 4)
+	*(*int32)(unsafe.Pointer(&fd[0])) = int32(progFD)
+	*(*uint32)(unsafe.Pointer(&flags[0])) = xdpFlagsSKBMode
+	nested := append(weavenet.NetlinkAttr(iflaXDPFD, fd), weavenet.NetlinkAttr(iflaXDPFlags, flags)...)
+	body = append(body, weavenet.NetlinkAttr(iflaXDP|nlaFNested, nested)...)
+	return weavenet.NetlinkRequest(syscall.RTM_SETLINK, 0, body)
+}
+
+// A BPF instruction, as in struct bpf_insn
+type bpfInsn struct {
+	code uint8
+	regs uint8 // src << 4 | dst
+	off  int16
+	imm  int32
+}
+
+func insn(code uint8, dst, src uint8, off int16, imm int32) bpfInsn {
+	return bpfInsn{code: code, regs: src<<4 | dst, off: off, imm: imm}
+}
+
+// Opcodes, from <linux/bpf.h> and <linux/bpf_common.h>
+const (
+	bpfMov64Reg  = 0xbf
+	bpfMov64Imm  = 0xb7
+	bpfAdd64Imm  = 0x07
+	bpfLdxW      = 0x61
+	bpfLdxH      = 0x69
+	bpfStxW      = 0x63
+	bpfStxH      = 0x6b
+	bpfLdImm64   = 0x18
+	bpfJgtReg    = 0x2d
+	bpfJeqImm    = 0x15
+	bpfCall      = 0x85
+	bpfExit      = 0x95
+	bpfRegFP     = 10
+	xdpPassInsn  = 20 // index of the instruction letting frames through
+	xdpCheckInsn = 5  // index of the bounds check
+	xdpFoundInsn = 15 // index of the check for a map entry
+)
+
+// The program, in C:
+//
+//	if (ctx->data + 6 > ctx->data_end)
+//	        return XDP_PASS;
+//	__u32 *ifindex = bpf_map_lookup_elem(&macs, (void *)ctx->data);
+//	if (!ifindex)
+//	        return XDP_PASS;
+//	return bpf_redirect(*ifindex, 0);
+//
+// except that the key gets copied to the stack, since map lookups
+// can't take keys from the packet.
+func xdpProgram(mapFD int) []bpfInsn {
+	return []bpfInsn{
+		insn(bpfMov64Reg, 6, 1, 0, 0),                        // r6 = ctx
+		insn(bpfLdxW, 2, 6, 0, 0),                            // r2 = ctx->data
+		insn(bpfLdxW, 3, 6, 4, 0),                            // r3 = ctx->data_end
+		insn(bpfMov64Reg, 4, 2, 0, 0),                        // r4 = r2
+		insn(bpfAdd64Imm, 4, 0, 0, 6),                        // r4 += 6
+		insn(bpfJgtReg, 4, 3, xdpPassInsn-xdpCheckInsn-1, 0), // if r4 > r3 goto pass
+		insn(bpfLdxW, 5, 2, 0, 0),                            // r5 = first 4 bytes of the MAC
+		insn(bpfStxW, bpfRegFP, 5, -8, 0),                    // store them at fp-8
+		insn(bpfLdxH, 5, 2, 4, 0),                            // r5 = last 2 bytes
+		insn(bpfStxH, bpfRegFP, 5, -4, 0),                    // store them at fp-4
+		insn(bpfLdImm64, 1, bpfPseudoMapFD, 0, int32(mapFD)), // r1 = map
+		insn(0, 0, 0, 0, 0),                                  // (second half of the above)
+		insn(bpfMov64Reg, 2, bpfRegFP, 0, 0),                 // r2 = fp
+		insn(bpfAdd64Imm, 2, 0, 0, -8),                       // r2 -= 8, i.e. the key
+		insn(bpfCall, 0, 0, 0, bpfFuncMapLookup),             // r0 = lookup
+		insn(bpfJeqImm, 0, 0, xdpPassInsn-xdpFoundInsn-1, 0), // if !r0 goto pass
+		insn(bpfLdxW, 1, 0, 0, 0),                            // r1 = *r0, the ifindex
+		insn(bpfMov64Imm, 2, 0, 0, 0),                        // r2 = 0
+		insn(bpfCall, 0, 0, 0, bpfFuncRedirect),              // r0 = redirect
+		insn(bpfExit, 0, 0, 0, 0),                            // return r0
+		insn(bpfMov64Imm, 0, 0, 0, xdpPass),                  // pass: r0 = XDP_PASS
+		insn(bpfExit, 0, 0, 0, 0)}                            // return r0
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := syscall.Syscall(sysBPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+func bpfCreateHashMap(keySize, valueSize, maxEntries uint32) (int, error) {
+	attr := struct {
+		mapType, keySize, valueSize, maxEntries, mapFlags uint32
+	}{bpfMapTypeHash, keySize, valueSize, maxEntries, 0}
+	return bpf(bpfMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+func bpfMapOp(cmd int, mapFD int, key, value unsafe.Pointer) error {
+	attr := struct {
+		mapFD uint32
+		_     uint32
+		key   uint64
+		value uint64
+		flags uint64
+	}{mapFD: uint32(mapFD), key: uint64(uintptr(key)), value: uint64(uintptr(value))}
+	_, err := bpf(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	return err
+}
+
+// Load the program, returning the verifier's complaints if it rejects
+// it.
+func bpfLoadXDP(prog []bpfInsn) (int, error) {
+	license := []byte("GPL\x00")
+	verifierLog := make([]byte, xdpVerifierLogLen)
+	attr := struct {
+		progType    uint32
+		insnCnt     uint32
+		insns       uint64
+		license     uint64
+		logLevel    uint32
+		logSize     uint32
+		logBuf      uint64
+		kernVersion uint32
+		progFlags   uint32
+	}{
+		progType: bpfProgTypeXDP,
+		insnCnt:  uint32(len(prog)),
+		insns:    uint64(uintptr(unsafe.Pointer(&prog[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel: 1,
+		logSize:  uint32(len(verifierLog)),
+		logBuf:   uint64(uintptr(unsafe.Pointer(&verifierLog[0])))}
+	fd, err := bpf(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(prog)
+	runtime.KeepAlive(license)
+	if err != nil {
+		return -1, fmt.Errorf("Unable to load XDP program: %v: %s", err, cString(verifierLog))
+	}
+	return fd, nil
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
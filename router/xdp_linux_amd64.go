@@ -0,0 +1,4 @@
+package router
+
+// syscall doesn't define SYS_BPF for this platform
+const sysBPF = 321
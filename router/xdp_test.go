@@ -0,0 +1,23 @@
+package router
+
+import (
+	wt "github.com/zettio/weave/testing"
+	"testing"
+	"unsafe"
+)
+
+func TestXDPProgram(t *testing.T) {
+	wt.AssertEqualInt(t, int(unsafe.Sizeof(bpfInsn{})), 8, "instruction size")
+	prog := xdpProgram(7)
+	wt.AssertEqualInt(t, int(prog[10].imm), 7, "map fd")
+	wt.AssertEqualInt(t, int(prog[10].regs), bpfPseudoMapFD<<4|1, "map load registers")
+	// Both checks must land on the instructions letting frames through
+	for _, i := range []int{xdpCheckInsn, xdpFoundInsn} {
+		target := i + 1 + int(prog[i].off)
+		wt.AssertEqualInt(t, int(prog[target].code), bpfMov64Imm, "jump target opcode")
+		wt.AssertEqualInt(t, int(prog[target].imm), xdpPass, "jump target verdict")
+	}
+	if last := prog[len(prog)-1]; last.code != bpfExit {
+		wt.Fatalf(t, "Expected program to end with exit")
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+// A CNI plugin, attaching the containers of Kubernetes pods, and
+// those of anything else speaking CNI, to the weave network. The
+// runtime runs it with the command, the container and its network
+// namespace in the environment, and the network configuration on
+// stdin, e.g.
+//
+//   {"cniVersion": "0.3.1", "name": "weave", "type": "weavecni"}
+//
+// and it prints the result, or an error, on stdout.
+//
+// On ADD, it gets an address for the container from the router,
+// creates a veth pair with one end on the weave bridge and the other
+// in the container, and routes multicast through it, along with
+// everything else if the bridge has an address in the container's
+// subnet, i.e. the host was exposed with 'weave expose'. DEL undoes
+// that, and is fine with there being nothing to undo.
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	weavenet "github.com/zettio/weave/net"
+	weave "github.com/zettio/weave/router"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var version = "(unreleased version)"
+
+var supportedVersions = []string{"0.3.0", "0.3.1"}
+
+const (
+	MTU = 65535 // as with 'weave attach'
+
+	// Error codes from the CNI spec, and our own from 100 up
+	errIncompatibleVersion = 1
+	errInvalidEnvironment  = 4
+	errDecodingFailure     = 6
+	errPlugin              = 100
+)
+
+type netConf struct {
+	CNIVersion string `json:"cniVersion"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Bridge     string `json:"bridge"` // defaults to weave
+	Router     string `json:"router"` // <host>:<port> of the router's HTTP API, defaults to 127.0.0.1:6784
+}
+
+type cniError struct {
+	CNIVersion string `json:"cniVersion"`
+	Code       uint   `json:"code"`
+	Msg        string `json:"msg"`
+	Details    string `json:"details,omitempty"`
+}
+
+func (err *cniError) Error() string {
+	return err.Msg
+}
+
+type cniInterface struct {
+	Name    string `json:"name"`
+	Mac     string `json:"mac,omitempty"`
+	Sandbox string `json:"sandbox,omitempty"`
+}
+
+type cniIP struct {
+	Version   string `json:"version"`
+	Address   string `json:"address"`
+	Gateway   string `json:"gateway,omitempty"`
+	Interface int    `json:"interface"`
+}
+
+type cniRoute struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw,omitempty"`
+}
+
+type cniResult struct {
+	CNIVersion string         `json:"cniVersion"`
+	Interfaces []cniInterface `json:"interfaces"`
+	IPs        []cniIP        `json:"ips"`
+	Routes     []cniRoute     `json:"routes"`
+	DNS        struct{}       `json:"dns"`
+}
+
+func main() {
+	var justVersion bool
+	flag.BoolVar(&justVersion, "version", false, "print version and exit")
+	flag.Parse()
+	if justVersion {
+		fmt.Printf("weave CNI plugin %s\n", version)
+		os.Exit(0)
+	}
+
+	result, err := run(os.Getenv("CNI_COMMAND"), os.Stdin)
+	if err != nil {
+		cniErr, ok := err.(*cniError)
+		if !ok {
+			cniErr = &cniError{Code: errPlugin, Msg: err.Error()}
+		}
+		if cniErr.CNIVersion == "" {
+			cniErr.CNIVersion = supportedVersions[len(supportedVersions)-1]
+		}
+		json.NewEncoder(os.Stdout).Encode(cniErr)
+		os.Exit(1)
+	}
+	if result != nil {
+		json.NewEncoder(os.Stdout).Encode(result)
+	}
+}
+
+func run(command string, stdin io.Reader) (interface{}, error) {
+	if command == "VERSION" {
+		return map[string]interface{}{
+			"cniVersion":        supportedVersions[len(supportedVersions)-1],
+			"supportedVersions": supportedVersions}, nil
+	}
+	conf, err := readConf(stdin)
+	if err != nil {
+		return nil, err
+	}
+	containerID, ifName, netNS := os.Getenv("CNI_CONTAINERID"), os.Getenv("CNI_IFNAME"), os.Getenv("CNI_NETNS")
+	if containerID == "" {
+		return nil, &cniError{Code: errInvalidEnvironment, Msg: "CNI_CONTAINERID is not set"}
+	}
+	switch command {
+	case "ADD":
+		if ifName == "" || netNS == "" {
+			return nil, &cniError{Code: errInvalidEnvironment, Msg: "CNI_IFNAME and CNI_NETNS need to be set"}
+		}
+		return add(conf, containerID, ifName, netNS)
+	case "DEL":
+		return nil, del(conf, containerID)
+	default:
+		return nil, &cniError{Code: errInvalidEnvironment, Msg: fmt.Sprintf("unknown CNI_COMMAND %q", command)}
+	}
+}
+
+func readConf(stdin io.Reader) (*netConf, error) {
+	var conf netConf
+	if err := json.NewDecoder(stdin).Decode(&conf); err != nil {
+		return nil, &cniError{Code: errDecodingFailure, Msg: fmt.Sprint("unable to parse network configuration: ", err)}
+	}
+	supported := false
+	for _, v := range supportedVersions {
+		supported = supported || conf.CNIVersion == v
+	}
+	if !supported {
+		return nil, &cniError{Code: errIncompatibleVersion, Msg: fmt.Sprintf("unsupported CNI version %q, only %s", conf.CNIVersion, strings.Join(supportedVersions, ", "))}
+	}
+	if conf.Bridge == "" {
+		conf.Bridge = "weave"
+	}
+	if conf.Router == "" {
+		conf.Router = fmt.Sprintf("127.0.0.1:%d", weave.HttpPort)
+	}
+	return &conf, nil
+}
+
+// Interface names are limited to 15 characters; the local one needs
+// to stay the same so DEL can find it.
+func vethNames(containerID string) (string, string) {
+	if len(containerID) > 7 {
+		containerID = containerID[:7]
+	}
+	return "vethwepl" + containerID, "vethwepg" + containerID
+}
+
+func add(conf *netConf, containerID, ifName, netNS string) (result *cniResult, err error) {
+	addr, err := allocate(conf, containerID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			release(conf, containerID)
+		}
+	}()
+	ns, err := os.Open(netNS)
+	if err != nil {
+		return nil, err
+	}
+	defer ns.Close()
+
+	local, guest := vethNames(containerID)
+	if err := weavenet.CreateVeth(local, guest, MTU, conf.Bridge); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			weavenet.DeleteLink(local)
+		}
+	}()
+	bridgeIface, err := net.InterfaceByName(conf.Bridge)
+	if err != nil {
+		return nil, err
+	}
+	localIface, err := net.InterfaceByName(local)
+	if err != nil {
+		return nil, err
+	}
+	gateway := bridgeAddress(bridgeIface, addr)
+	if err := weavenet.SetLinkNetNS(guest, ns); err != nil {
+		return nil, err
+	}
+
+	result = newResult(conf, bridgeIface, localIface, addr, gateway)
+	err = weavenet.WithNetNS(netNS, func() error {
+		if err := weavenet.RenameLink(guest, ifName); err != nil {
+			return err
+		}
+		if err := weavenet.AddAddress(ifName, addr); err != nil {
+			return err
+		}
+		if err := weavenet.SetLinkUp(ifName); err != nil {
+			return err
+		}
+		for _, route := range result.Routes {
+			_, dst, _ := net.ParseCIDR(route.Dst)
+			if err := weavenet.AddRoute(dst, net.ParseIP(route.GW), ifName); err != nil {
+				return fmt.Errorf("Unable to add route to %s: %v", route.Dst, err)
+			}
+		}
+		iface, err := net.InterfaceByName(ifName)
+		if err != nil {
+			return err
+		}
+		result.Interfaces = append(result.Interfaces, cniInterface{Name: ifName, Mac: iface.HardwareAddr.String(), Sandbox: netNS})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// The result of an ADD, but for the container's interface, which goes
+// last once it is in place; the address is on that.
+func newResult(conf *netConf, bridge, local *net.Interface, addr *net.IPNet, gateway net.IP) *cniResult {
+	result := &cniResult{
+		CNIVersion: conf.CNIVersion,
+		Interfaces: []cniInterface{
+			{Name: bridge.Name, Mac: bridge.HardwareAddr.String()},
+			{Name: local.Name, Mac: local.HardwareAddr.String()}},
+		IPs:    []cniIP{{Version: "4", Address: addr.String(), Interface: 2}},
+		Routes: []cniRoute{{Dst: "224.0.0.0/4"}}}
+	if gateway != nil {
+		result.IPs[0].Gateway = gateway.String()
+		result.Routes = append(result.Routes, cniRoute{Dst: "0.0.0.0/0", GW: gateway.String()})
+	}
+	return result
+}
+
+// The address of the bridge in the container's subnet, if it has one.
+func bridgeAddress(bridge *net.Interface, addr *net.IPNet) net.IP {
+	addrs, err := bridge.Addrs()
+	if err != nil {
+		return nil
+	}
+	subnet := &net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil && subnet.Contains(ipnet.IP) {
+			return ipnet.IP
+		}
+	}
+	return nil
+}
+
+func del(conf *netConf, containerID string) error {
+	// Deleting our end of the veth deletes the container's too, if the
+	// container's namespace hasn't already gone and taken them both
+	local, _ := vethNames(containerID)
+	if _, err := net.InterfaceByName(local); err == nil {
+		if err := weavenet.DeleteLink(local); err != nil {
+			return err
+		}
+	}
+	return release(conf, containerID)
+}
+
+// Ask the router for the container's address, which it hands out
+// again if the runtime retries an ADD.
+func allocate(conf *netConf, containerID string) (*net.IPNet, error) {
+	body, err := routerCall(conf, "POST", containerID)
+	if err != nil {
+		return nil, err
+	}
+	ip, ipnet, err := net.ParseCIDR(strings.TrimSpace(body))
+	if err != nil {
+		return nil, fmt.Errorf("Unexpected address from router: %v", err)
+	}
+	ipnet.IP = ip
+	return ipnet, nil
+}
+
+func release(conf *netConf, containerID string) error {
+	if _, err := routerCall(conf, "DELETE", containerID); err != nil && err != errNotFound {
+		return err
+	}
+	return nil
+}
+
+var errNotFound = errors.New("not found")
+
+func routerCall(conf *netConf, method, containerID string) (string, error) {
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s/ip/%s", conf.Router, containerID), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", &cniError{Code: errPlugin, Msg: "Unable to contact the weave router; is it running, and is 'router' in the network configuration right?", Details: err.Error()}
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return string(body), nil
+	case http.StatusNotFound:
+		return "", errNotFound
+	default:
+		return "", fmt.Errorf("%s /ip/%s: %s", method, containerID, strings.TrimSpace(string(body)))
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	wt "github.com/zettio/weave/testing"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// A router which hands out the address given, and answers releases
+// with the status given, noting the requests it gets
+func testRouter(addr string, releaseStatus int) (*httptest.Server, *[]string) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch r.Method {
+		case "POST":
+			w.Write([]byte(addr + "\n"))
+		case "DELETE":
+			w.WriteHeader(releaseStatus)
+		}
+	}))
+	return server, &requests
+}
+
+func runCNI(command, conf string, env map[string]string) (interface{}, error) {
+	for _, name := range []string{"CNI_CONTAINERID", "CNI_IFNAME", "CNI_NETNS"} {
+		os.Setenv(name, env[name])
+		defer os.Unsetenv(name)
+	}
+	return run(command, strings.NewReader(conf))
+}
+
+func assertCNIError(t *testing.T, err error, code uint, desc string) {
+	cniErr, ok := err.(*cniError)
+	if !ok {
+		wt.Fatalf(t, "Expected a CNI error for %s; got %v", desc, err)
+	}
+	wt.AssertEqualInt(t, int(cniErr.Code), int(code), desc+" error code")
+}
+
+func TestRunErrors(t *testing.T) {
+	const conf = `{"cniVersion": "0.3.1", "name": "weave", "type": "weavecni"}`
+	env := map[string]string{"CNI_CONTAINERID": "abcdef0123456789", "CNI_IFNAME": "eth0", "CNI_NETNS": "/proc/1/ns/net"}
+
+	result, err := runCNI("VERSION", "", nil)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, result.(map[string]interface{})["cniVersion"].(string), "0.3.1", "version")
+
+	_, err = runCNI("ADD", "{", env)
+	assertCNIError(t, err, errDecodingFailure, "bad configuration")
+	_, err = runCNI("ADD", `{"cniVersion": "0.2.0"}`, env)
+	assertCNIError(t, err, errIncompatibleVersion, "old version")
+	_, err = runCNI("ADD", conf, map[string]string{"CNI_IFNAME": "eth0", "CNI_NETNS": "/proc/1/ns/net"})
+	assertCNIError(t, err, errInvalidEnvironment, "missing container")
+	_, err = runCNI("ADD", conf, map[string]string{"CNI_CONTAINERID": "abcdef0123456789"})
+	assertCNIError(t, err, errInvalidEnvironment, "missing namespace")
+	_, err = runCNI("CHECK", conf, env)
+	assertCNIError(t, err, errInvalidEnvironment, "unknown command")
+
+	// Without a router, we say so
+	_, err = runCNI("ADD", `{"cniVersion": "0.3.1", "router": "127.0.0.1:1"}`, env)
+	assertCNIError(t, err, errPlugin, "no router")
+}
+
+func TestAddFailureReleases(t *testing.T) {
+	server, requests := testRouter("10.2.1.3/24", http.StatusOK)
+	defer server.Close()
+	conf := `{"cniVersion": "0.3.1", "router": "` + strings.TrimPrefix(server.URL, "http://") + `"}`
+	_, err := runCNI("ADD", conf, map[string]string{"CNI_CONTAINERID": "abcdef0123456789", "CNI_IFNAME": "eth0", "CNI_NETNS": "/nonexistent"})
+	if err == nil {
+		wt.Fatalf(t, "Expected ADD into a missing namespace to fail")
+	}
+	wt.AssertEqualString(t, strings.Join(*requests, ", "), "POST /ip/abcdef0123456789, DELETE /ip/abcdef0123456789", "router requests")
+}
+
+func TestDel(t *testing.T) {
+	env := map[string]string{"CNI_CONTAINERID": "abcdef0123456789"}
+	// Deleting what isn't there is fine...
+	server, requests := testRouter("", http.StatusNotFound)
+	defer server.Close()
+	result, err := runCNI("DEL", `{"cniVersion": "0.3.1", "router": "`+strings.TrimPrefix(server.URL, "http://")+`"}`, env)
+	wt.AssertNoErr(t, err)
+	if result != nil {
+		wt.Fatalf(t, "Expected no result from DEL; got %v", result)
+	}
+	wt.AssertEqualString(t, strings.Join(*requests, ", "), "DELETE /ip/abcdef0123456789", "router requests")
+
+	// ...but the router failing isn't
+	server, _ = testRouter("", http.StatusInternalServerError)
+	defer server.Close()
+	if _, err = runCNI("DEL", `{"cniVersion": "0.3.1", "router": "`+strings.TrimPrefix(server.URL, "http://")+`"}`, env); err == nil {
+		wt.Fatalf(t, "Expected DEL to fail when the router does")
+	}
+}
+
+func TestAddResult(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	bridge := &net.Interface{Name: "weave", HardwareAddr: mac}
+	local := &net.Interface{Name: "vethwepl0123456", HardwareAddr: mac}
+	ip, addr, _ := net.ParseCIDR("10.2.1.3/24")
+	addr.IP = ip
+	conf := &netConf{CNIVersion: "0.3.0"}
+
+	result := newResult(conf, bridge, local, addr, nil)
+	wt.AssertEqualString(t, result.CNIVersion, "0.3.0", "result version")
+	wt.AssertEqualInt(t, len(result.Interfaces), 2, "interfaces")
+	wt.AssertEqualString(t, result.IPs[0].Address, "10.2.1.3/24", "address")
+	wt.AssertEqualString(t, result.IPs[0].Gateway, "", "gateway")
+	if len(result.Routes) != 1 || result.Routes[0].Dst != "224.0.0.0/4" {
+		wt.Fatalf(t, "Expected only a multicast route without a gateway; got %v", result.Routes)
+	}
+
+	// With the host exposed, everything goes through it
+	result = newResult(conf, bridge, local, addr, net.IPv4(10, 2, 1, 1))
+	wt.AssertEqualString(t, result.IPs[0].Gateway, "10.2.1.1", "gateway")
+	if len(result.Routes) != 2 || result.Routes[1].Dst != "0.0.0.0/0" || result.Routes[1].GW != "10.2.1.1" {
+		wt.Fatalf(t, "Expected a default route through the gateway; got %v", result.Routes)
+	}
+
+	// The spec wants all the fields, even empty
+	encoded, err := json.Marshal(result)
+	wt.AssertNoErr(t, err)
+	var fields map[string]interface{}
+	wt.AssertNoErr(t, json.Unmarshal(encoded, &fields))
+	for _, field := range []string{"cniVersion", "interfaces", "ips", "routes", "dns"} {
+		if _, found := fields[field]; !found {
+			wt.Fatalf(t, "Expected %s in result %s", field, encoded)
+		}
+	}
+}
+
+func TestBridgeAddress(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("No loopback interface")
+	}
+	_, subnet, _ := net.ParseCIDR("127.1.2.3/8")
+	if gateway := bridgeAddress(lo, subnet); !gateway.Equal(net.IPv4(127, 0, 0, 1)) {
+		wt.Fatalf(t, "Expected the bridge's address in the subnet; got %v", gateway)
+	}
+	_, subnet, _ = net.ParseCIDR("10.2.1.3/24")
+	if gateway := bridgeAddress(lo, subnet); gateway != nil {
+		wt.Fatalf(t, "Expected no address outside the bridge's subnets; got %v", gateway)
+	}
+}
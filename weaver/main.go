@@ -3,23 +3,36 @@ package main
 import (
 	"code.google.com/p/gopacket/layers"
 	"crypto/sha256"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/davecheney/profile"
+	"github.com/zettio/weave/bgp"
+	"github.com/zettio/weave/discovery"
+	"github.com/zettio/weave/ipam"
+	"github.com/zettio/weave/nameserver"
 	weavenet "github.com/zettio/weave/net"
+	"github.com/zettio/weave/plugin"
 	weave "github.com/zettio/weave/router"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 var version = "(unreleased version)"
 
+// Frames logged with -debug, which the level of "frame" can quieten
+var frameLog = weave.NewLogger("frame")
+
 func main() {
 
 	log.SetPrefix(weave.Protocol + " ")
@@ -35,26 +48,221 @@ func main() {
 
 	var (
 		justVersion bool
+		cryptoBench int
 		ifaceName   string
 		routerName  string
 		password    string
+		joinKey     string
+		joinToken   string
 		wait        int
 		debug       bool
 		prof        string
 		peers       []string
 		connLimit   int
 		bufSz       int
+		capture     string
+		captureRdrs int
+		captureFilt bool
+		batchSz     int
+		recvBatchSz int
+		listeners   int
+		dropPolicy  string
+		maxSndBuf   int
+		queueSize   int
+		sndBuf      int
+		rcvBuf      int
+		fastBeat    time.Duration
+		slowBeat    time.Duration
+		beatLoss    int
+		flushDelay  time.Duration
+		keepalive   time.Duration
+		peerAlives  string
+		reconnect   weave.ReconnectPolicy
+		limits      weave.TopologyLimits
+		pmtuMaxAge  time.Duration
+		rekeyIntvl  time.Duration
+		rekeyMB     uint64
+		fastPathDev string
+		fastPathXDP bool
+		wgDev       string
+		wgPort      int
+		rateLimit   int
+		peerLimits  string
+		workers     int
+		sealWorkers int
+		recvWorkers int
+		keyLogFile  string
+		captureAPI  bool
+		drainTime   time.Duration
+		tcpFallback bool
+		igmpSnoop   bool
+		arpProxy    bool
+		relayNames  string
+		natTraverse bool
+		bindAddr    string
+		stunServers string
+		transport   string
+		wsPort      int
+		tlsCert     string
+		tlsKey      string
+		peerCA      string
+		peerCert    string
+		peerKey     string
+		peerCRL     string
+		pinnedPMTUs string
+		policyFile  string
+		peerRules   string
+		logLevel    string
+		logJSON     bool
+		checksums   bool
+		padding     string
+		compression string
+		loopAction  string
+		dscp        string
+		ecn         bool
+		standby     bool
+		multiPath   bool
+		clampMSS    bool
+		encryption  string
+		plaintext   string
+		encap       string
+		encapPort   int
+		vni         uint
+		qualityRte  bool
+		macPins     string
+		tenants     string
+		ipRange     string
+		ipStateFile string
+		peersFile   string
+		flowStats   bool
+		conntrack   bool
+		sflowColl   string
+		sflowRate   int
+		dnsPort     int
+		dockerAPI   string
+		pluginSock  string
+		pluginBr    string
+		hostNetNS   string
+		bridgeName  string
+		bridgeMTU   string
+		gatewayAddr string
+		bgpAS       string
+		bgpPeers    string
+		bgpRouterID string
+		bgpNextHop  string
+		discover    string
+		discoverInt time.Duration
 	)
 
 	flag.BoolVar(&justVersion, "version", false, "print version and exit")
+	flag.IntVar(&cryptoBench, "crypto-bench", 0, "measure how fast this machine encrypts with each encryption scheme, print the settings to send at this many Mbit/s with them, and exit (defaults to 0, i.e. don't)")
 	flag.StringVar(&ifaceName, "iface", "", "name of interface to read from")
 	flag.StringVar(&routerName, "name", "", "name of router (defaults to MAC)")
 	flag.StringVar(&password, "password", "", "network password")
+	flag.StringVar(&joinKey, "join-key", "", "key to issue and check the join tokens peers need to connect with, beyond the password (defaults to $WEAVE_JOIN_KEY, or none, i.e. no tokens needed)")
+	flag.StringVar(&joinToken, "join-token", "", "join token to connect to peers with, issued by a peer with -join-key (defaults to none)")
 	flag.IntVar(&wait, "wait", 0, "number of seconds to wait for interface to be created and come up (defaults to 0, i.e. don't wait)")
 	flag.BoolVar(&debug, "debug", false, "enable debug logging")
 	flag.StringVar(&prof, "profile", "", "enable profiling and write profiles to given path")
 	flag.IntVar(&connLimit, "connlimit", 10, "connection limit (defaults to 10, set to 0 for unlimited)")
 	flag.IntVar(&bufSz, "bufsz", 8, "capture buffer size in MB (defaults to 8MB)")
+	flag.StringVar(&capture, "capture", "pcap", "how to capture frames from the interface: pcap, or afpacket for AF_PACKET sockets with memory-mapped rings (defaults to pcap)")
+	flag.BoolVar(&captureFilt, "capture-filter", false, "have the kernel leave out captured frames the router would throw away, i.e. those between local containers, which the bridge delivers, and its own UDP packets to peers (defaults to false)")
+	flag.IntVar(&captureRdrs, "capture-readers", 1, "number of goroutines capturing frames with -capture=afpacket; frames of a flow always go to the same one (defaults to 1)")
+	flag.IntVar(&batchSz, "batchsz", 32, "max number of UDP packets to send per syscall (defaults to 32, set to 1 to disable batching)")
+	flag.IntVar(&sealWorkers, "encryption-workers", 0, "number of workers sealing packets for connections using NaCl encryption, in parallel with the forwarders assembling them (defaults to 0, i.e. the forwarders seal packets themselves)")
+	flag.IntVar(&recvBatchSz, "recvbatchsz", 32, "max number of UDP packets to receive per syscall (defaults to 32, set to 1 to disable batching)")
+	flag.IntVar(&listeners, "udp-listeners", 1, "number of UDP sockets to receive packets from peers on, sharing the port with SO_REUSEPORT, so the kernel spreads packets over as many cores; packets from a peer always arrive on the same one (defaults to 1)")
+	flag.IntVar(&recvWorkers, "receive-workers", 0, "number of workers decrypting and decoding the UDP packets received from peers, in parallel with receiving them; packets from a peer always go to the same one (defaults to 0, i.e. the UDP listener does so itself)")
+	flag.StringVar(&keyLogFile, "keylog", "", "file to append the session keys of encrypted connections to, for decrypting captures of traffic between peers; anyone who can read it can read that traffic, so only use it for debugging (defaults to none)")
+	flag.BoolVar(&captureAPI, "capture-api", false, "capture the traffic over connections to peers on request to /capture, including the frames of encrypted connections in the clear; only use it for debugging (defaults to false)")
+	flag.IntVar(&workers, "forwarder-workers", 1, "number of parallel forwarders per connection; frames of a flow always go to the same one (defaults to 1)")
+	flag.IntVar(&queueSize, "queuesize", weave.ChannelSize, "number of frames each forwarder queues per traffic class (defaults to 16)")
+	flag.IntVar(&sndBuf, "sndbuf", 0, "UDP socket send buffer size in KB (defaults to 0, i.e. the system default)")
+	flag.IntVar(&rcvBuf, "rcvbuf", 0, "UDP socket receive buffer size in KB (defaults to 0, i.e. the system default)")
+	flag.DurationVar(&fastBeat, "fastheartbeat", weave.FastHeartbeat, "interval between heartbeats while connections get established (defaults to 500ms)")
+	flag.DurationVar(&slowBeat, "slowheartbeat", weave.SlowHeartbeat, "interval between heartbeats on established connections (defaults to 10s)")
+	flag.IntVar(&beatLoss, "heartbeatloss", 0, "number of heartbeats in a row a peer may miss before we drop our connection to it and route around it; peers should use the same -slowheartbeat (defaults to 0, i.e. never)")
+	flag.DurationVar(&flushDelay, "flushdelay", weave.FlushDelay, "longest a frame may wait for others to fill the packet, or batch of packets, it is sent in while the forwarder is busy (defaults to 1ms)")
+	flag.DurationVar(&keepalive, "nat-keepalive", weave.NATKeepalive, "interval of keepalives to peers, whether or not frames flow, so NATs on the way don't forget about the connection (defaults to 15s, set to 0 to disable)")
+	flag.StringVar(&peerAlives, "peer-nat-keepalives", "", "comma-separated list of <peer name>=<interval>, overriding -nat-keepalive for those peers (defaults to none)")
+	flag.IntVar(&maxSndBuf, "maxsndbuf", 0, "grow UDP socket send buffers up to this size in MB when sends fail with ENOBUFS (defaults to 0, i.e. never grow)")
+	flag.DurationVar(&pmtuMaxAge, "pmtucacheage", weave.PMTUCacheMaxAge, "how long to remember verified PMTUs of peer addresses for (defaults to 10m, set to 0 to disable)")
+	flag.DurationVar(&rekeyIntvl, "rekeyinterval", 1*time.Hour, "how often to rotate session keys when using a password (defaults to 1h, set to 0 to disable)")
+	flag.Uint64Var(&rekeyMB, "rekeymb", 0, "rotate session keys after sending this many MB when using a password (defaults to 0, i.e. no limit)")
+	flag.StringVar(&fastPathDev, "fastpath", "", "name of a kernel VXLAN device, attached to the same bridge as the interface, to offload unicast traffic between unencrypted peers to (defaults to none)")
+	flag.StringVar(&wgDev, "wireguard", "", "name of a kernel WireGuard device, with an IPv4 address unique to this peer, to send -fastpath traffic through, so that it is encrypted, also between peers using a password (defaults to none)")
+	flag.IntVar(&wgPort, "wireguard-port", weave.WireGuardPort, "UDP port for the -wireguard device to listen on (defaults to 51820)")
+	flag.BoolVar(&fastPathXDP, "fastpath-xdp", false, "send traffic for the -fastpath device to it with an XDP program on the interface, so it bypasses the capture and userspace altogether; needs Linux 4.12 or later (defaults to false)")
+	flag.IntVar(&rateLimit, "ratelimit", 0, "max Mbit/s to send to each peer (defaults to 0, i.e. unlimited)")
+	flag.StringVar(&peerLimits, "peerratelimits", "", "comma-separated list of <peer name>=<Mbit/s>, overriding -ratelimit for those peers")
+	flag.StringVar(&peerRules, "peer-rules", "", "file of rules, one per line, allowing or denying connections with peers by their address and name (defaults to none, i.e. allow all peers)")
+	flag.StringVar(&policyFile, "policy", "", "file of local policy rules, one per line, allowing or denying frames from other peers for local hosts (defaults to none, i.e. allow everything not denied by global rules)")
+	flag.StringVar(&pinnedPMTUs, "pmtu", "", "comma-separated list of <peer name or CIDR>=<PMTU>, pinning the PMTU of connections to those peers rather than discovering it")
+	flag.DurationVar(&reconnect.InitialInterval, "reconnect-initial", weave.InitialInterval, "longest wait before retrying a peer address we failed to connect to for the first time (defaults to 5s)")
+	flag.DurationVar(&reconnect.MaxInterval, "reconnect-max", weave.MaxInterval, "longest wait between attempts to connect to a peer address (defaults to 10m)")
+	flag.Float64Var(&reconnect.Multiplier, "reconnect-multiplier", weave.BackoffFactor, "how much longer, on average, to wait after each failed attempt to connect to a peer address than after the previous one (defaults to 1.5)")
+	flag.IntVar(&reconnect.MaxAttempts, "reconnect-attempts", 0, "failed attempts in a row to connect to a peer address after which to give up on it, until asked to retry (defaults to 0, i.e. never give up)")
+	flag.IntVar(&limits.Peers, "max-peers", 0, "most peers to accept in the topology gossiped to us, rejecting updates which would take it beyond (defaults to 0, i.e. unlimited)")
+	flag.IntVar(&limits.Connections, "max-peer-connections", 0, "most connections of any peer to accept in the topology gossiped to us (defaults to 0, i.e. unlimited)")
+	flag.IntVar(&limits.GossipSize, "max-gossip-size", 0, "most bytes of any gossip message to accept, after decompression (defaults to 0, i.e. 64MB)")
+	flag.DurationVar(&drainTime, "draintimeout", weave.DrainTimeout, "how long to keep sending frames already queued when stopping on SIGTERM or SIGINT (defaults to 5s)")
+	flag.BoolVar(&tcpFallback, "tcpfallback", true, "carry frames over the TCP connection to peers which UDP doesn't get through to (defaults to true)")
+	flag.BoolVar(&arpProxy, "arpproxy", false, "answer ARP requests and IPv6 neighbour solicitations from local hosts for addresses known to be elsewhere, rather than flooding them to every peer (defaults to false)")
+	flag.BoolVar(&igmpSnoop, "igmpsnooping", false, "snoop IGMP/MLD reports, and only send multicast frames to peers with receivers in their groups (defaults to false)")
+	flag.StringVar(&relayNames, "relays", "", "comma-separated list of names of peers to connect to exclusively, relaying traffic for all other peers through them (defaults to none, i.e. connect to every peer)")
+	flag.StringVar(&macPins, "pinmacs", "", "comma-separated list of <MAC>=<peer name> pairs, sending frames for those MACs to those peers rather than learning where they are (defaults to none)")
+	flag.StringVar(&tenants, "tenants", "", "comma-separated list of <ID>=<CIDR>, putting hosts in those subnets on virtual networks isolated from each other and from everything else; all peers need the same (defaults to none)")
+	flag.BoolVar(&qualityRte, "qualityrouting", false, "prefer routes with lower latency and loss, as measured by heartbeats, over those with fewer hops (defaults to false)")
+	flag.BoolVar(&natTraverse, "nattraversal", true, "punch holes through NATs so peers behind them can exchange UDP directly (defaults to true)")
+	flag.StringVar(&bindAddr, "bind", "", "local IP address, or interface, whose first address is taken, to listen for peers on and connect to them from, e.g. of a NIC dedicated to weave traffic (defaults to none, i.e. all addresses)")
+	flag.StringVar(&stunServers, "stun", "", "comma-separated list of <host>:<port> of STUN servers to learn our address beyond NAT from (defaults to none)")
+	flag.StringVar(&transport, "transport", "tcp", "how to connect to the peers given on the command line, unless their address says otherwise: tcp, or websocket for wss://<peer>[:<port>] (defaults to tcp)")
+	flag.IntVar(&wsPort, "wsport", 0, "port to accept WebSocket connections from peers on, usually 443 (defaults to 0, i.e. don't accept them)")
+	flag.StringVar(&tlsCert, "tlscert", "", "TLS certificate file for accepting WebSocket connections (defaults to a self-signed certificate)")
+	flag.StringVar(&tlsKey, "tlskey", "", "TLS key file for the certificate given with -tlscert")
+	flag.StringVar(&peerCA, "peer-ca", "", "CA bundle file to check the certificates of peers against, for mutual TLS between peers (defaults to none, i.e. no TLS)")
+	flag.StringVar(&peerCert, "peer-cert", "", "certificate file of this peer for mutual TLS, naming the peer in its common name")
+	flag.StringVar(&peerKey, "peer-key", "", "key file for the certificate given with -peer-cert")
+	flag.StringVar(&peerCRL, "peer-crl", "", "CRL file, from the -peer-ca, to check the certificates of peers against (defaults to none)")
+	flag.BoolVar(&checksums, "udpchecksums", false, "compute UDP checksums for all packets to peers over IPv4, rather than only on paths found to drop packets without them (defaults to false)")
+	flag.StringVar(&padding, "padding", "", "comma-separated list of sizes in bytes to pad encrypted packets up to, hiding their exact lengths (defaults to none, i.e. no padding)")
+	flag.StringVar(&encap, "encap", "weave", "how to encapsulate frames sent to unencrypted peers: weave, or vxlan or geneve, i.e. as standard VXLAN or Geneve to -encap-port, where the peer supports it (defaults to weave)")
+	flag.IntVar(&encapPort, "encap-port", 0, "UDP port to exchange VXLAN or Geneve with peers on (defaults to 4789 for VXLAN and 6081 for Geneve)")
+	flag.UintVar(&vni, "vni", 1, "VXLAN or Geneve VNI of the default network; tenants have this plus their ID (defaults to 1)")
+	flag.StringVar(&dscp, "dscp", "", "DSCP to mark UDP packets to peers with, so the underlay can apply QoS: one for all traffic, e.g. 46, or a comma-separated list of <class>=<dscp>, for the interactive, default and bulk classes of frames (defaults to none, i.e. 0)")
+	flag.BoolVar(&ecn, "ecn", false, "mark UDP packets to peers which also have -ecn as ECN capable, and slow down when the network marks them congested (defaults to false)")
+	flag.BoolVar(&standby, "standby", false, "keep a standby path to peers which also have -standby and several addresses, and switch to it as soon as the active path stops answering (defaults to false)")
+	flag.BoolVar(&multiPath, "multipath", false, "spread flows over all the paths to peers which also have -multipath and several addresses, by forwarder worker; see -forwarder-workers (defaults to false)")
+	flag.BoolVar(&clampMSS, "clamp-mss", false, "lower the MSS option of TCP SYNs between containers to fit the effective PMTU, so they needn't rely on ICMP to discover it (defaults to false)")
+	flag.StringVar(&encryption, "encryption", "", "comma-separated list of encryption schemes to offer peers, when using a password, in order of preference: aes-gcm, nacl-ctr or nacl (defaults to all of them, in that order)")
+	flag.StringVar(&plaintext, "plaintext-peers", "", "comma-separated list of peer names and CIDRs of peers' addresses, e.g. on a trusted LAN, to exchange frames with unencrypted, despite the password, where they list us likewise (defaults to none)")
+	flag.StringVar(&loopAction, "loop-detection", "alert", "what to do on seeing frames injected into the bridge come back, e.g. with a NIC bridged to it making a loop: off, alert, i.e. log a warning and publish an event, or disable, i.e. also stop forwarding captured frames for a minute (defaults to alert)")
+	flag.StringVar(&compression, "compress", "off", "whether to compress encrypted packets with LZ4: on, off, or auto, i.e. only on connections with high round trip times (defaults to off)")
+	flag.StringVar(&ipRange, "ipalloc-range", "", "CIDR to allocate addresses to containers from, shared with the other peers, which need the same one (defaults to none, i.e. don't allocate addresses)")
+	flag.StringVar(&ipStateFile, "ipalloc-db", "", "file to keep address allocations in across restarts (defaults to none)")
+	flag.StringVar(&peersFile, "peers-db", "", "file to keep the peers we know, and their addresses, in across restarts, so we reconnect to them on starting (defaults to none)")
+	flag.BoolVar(&flowStats, "flowstats", false, "count traffic by pair of IP addresses, for the top talkers in /flows (defaults to false)")
+	flag.BoolVar(&conntrack, "conntrack", false, "track the connections between local hosts and those at other peers, for policy rules with state= conditions, and for /conntrack (defaults to false, i.e. every frame is new)")
+	flag.StringVar(&sflowColl, "sflow", "", "host:port of an sFlow collector to send samples of the frames we forward to (defaults to none)")
+	flag.IntVar(&sflowRate, "sflow-rate", 1000, "sample one in this many frames for -sflow, on average (defaults to 1000)")
+	flag.IntVar(&dnsPort, "dnsport", 0, "port to answer DNS queries for names in weave.local on, from records registered over HTTP with any peer (defaults to 0, i.e. don't answer them)")
+	flag.StringVar(&dockerAPI, "docker-api", "", "Docker API socket to watch for containers dying, so their DNS records go, e.g. unix:///var/run/docker.sock (defaults to none)")
+	flag.StringVar(&pluginSock, "plugin", "", "socket to serve Docker's network and IPAM plugin requests on, for 'docker network create -d weave', e.g. /run/docker/plugins/weave.sock; needs -ipalloc-range (defaults to none)")
+	flag.StringVar(&pluginBr, "plugin-bridge", "weave", "bridge to attach the containers of Docker networks created with the plugin to (defaults to weave)")
+	flag.StringVar(&hostNetNS, "host-netns", "", "network namespace of the host, e.g. a bind mount of /proc/1/ns/net, to create the plugin's devices in when running in another one (defaults to none, i.e. ours)")
+	flag.StringVar(&bridgeName, "bridge", "", "bridge to create, in the -host-netns, and keep configured, repairing any drift, and to attach containers to over /bridge/attach (defaults to none, i.e. leave that to the weave script)")
+	flag.StringVar(&gatewayAddr, "gateway", "", "comma-separated addresses, of the form <ip>/<prefix length>, to give the -bridge, in the overlay subnets the host is to route to and from other networks, turning on IP forwarding (defaults to none)")
+	flag.StringVar(&bgpPeers, "bgp-neighbours", "", "comma-separated list of <ip>[:<port>]=<AS> of BGP neighbours, e.g. top-of-rack routers, to announce the blocks of the allocation range we own, and any -gateway subnets, to, so they route to them directly rather than through the overlay (defaults to none)")
+	flag.StringVar(&bgpAS, "bgp-as", "", "our AS number, for -bgp-neighbours")
+	flag.StringVar(&bgpRouterID, "bgp-router-id", "", "IPv4 address to identify ourselves to -bgp-neighbours with (defaults to the local address of each session)")
+	flag.StringVar(&bgpNextHop, "bgp-next-hop", "", "IPv4 address of the host for -bgp-neighbours to route to, needed where our connections to them get NATed, e.g. from a container (defaults to the local address of each session)")
+	flag.StringVar(&bridgeMTU, "bridge-mtu", "65535", "MTU of the -bridge and the veths attached to it, or auto for the lowest effective PMTU of our connections (defaults to 65535)")
+	flag.StringVar(&discover, "discovery", "", "comma-separated list of ways to discover peers: aws:<tag key>=<tag value> for the EC2 instances with the tag in our region, gce:<zone>/<instance group> for the members of a GCE instance group, lan[:<network name>] for the peers announcing themselves on our LANs (defaults to none)")
+	flag.DurationVar(&discoverInt, "discovery-interval", discovery.DefaultInterval, "how often to ask the -discovery providers for peers (defaults to 1m)")
+	flag.StringVar(&logLevel, "log-level", "info", "comma-separated list of [<subsystem>=]<level>, the level on its own applying to the subsystems not listed; subsystems are router, connection, forwarder, crypto, gossip, pmtu, nat and, with -debug, frame, and levels debug, info, warn and error (defaults to info)")
+	flag.BoolVar(&logJSON, "log-json", false, "log messages as JSON objects, one per line, rather than text (defaults to false)")
+	flag.StringVar(&dropPolicy, "droppolicy", "block", "what to do with frames when a connection's forwarder is busy: block, drop-oldest or drop-newest (defaults to block)")
 	flag.Parse()
 	peers = flag.Args()
 
@@ -63,10 +271,25 @@ func main() {
 		os.Exit(0)
 	}
 
+	if cryptoBench > 0 {
+		if err := runCryptoBench(os.Stdout, float64(cryptoBench)*1e6); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	if debug {
+		weave.SetLogLevel("frame", weave.LogDebug)
+	}
+	if err := weave.SetLogLevels(logLevel); err != nil {
+		log.Fatal(err)
+	}
+	weave.SetLogJSON(logJSON)
+
 	options := make(map[string]string)
 	flag.Visit(func(f *flag.Flag) {
 		value := f.Value.String()
-		if f.Name == "password" {
+		if f.Name == "password" || f.Name == "join-key" || f.Name == "join-token" {
 			value = "<elided>"
 		}
 		options[f.Name] = value
@@ -96,9 +319,13 @@ func main() {
 		password = os.Getenv("WEAVE_PASSWORD")
 	}
 	if password == "" {
-		log.Println("Communication between peers is unencrypted.")
+		log.Println("Communication between peers is unencrypted. Control traffic is encrypted where peers support it, " +
+			"but without a password peers can't authenticate each other, so that only protects it from passive observers.")
 	} else {
 		log.Println("Communication between peers is encrypted.")
+		if err := weave.SelfTestEncryption(); err != nil {
+			log.Fatal("Encryption self-test failed: ", err)
+		}
 	}
 
 	var logFrame func(string, []byte, *layers.Ethernet)
@@ -106,9 +333,9 @@ func main() {
 		logFrame = func(prefix string, frame []byte, eth *layers.Ethernet) {
 			h := fmt.Sprintf("%x", sha256.Sum256(frame))
 			if eth == nil {
-				log.Println(prefix, len(frame), "bytes (", h, ")")
+				frameLog.Debug(prefix, len(frame), "bytes (", h, ")")
 			} else {
-				log.Println(prefix, len(frame), "bytes (", h, "):", eth.SrcMAC, "->", eth.DstMAC)
+				frameLog.Debug(prefix, len(frame), "bytes (", h, "):", eth.SrcMAC, "->", eth.DstMAC)
 			}
 		}
 	} else {
@@ -121,23 +348,641 @@ func main() {
 		defer profile.Start(&p).Stop()
 	}
 
-	router := weave.NewRouter(iface, ourName, []byte(password), connLimit, bufSz*1024*1024, logFrame)
+	policy, err := weave.ParseDropPolicy(dropPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	captureBackend, err := weave.ParseCaptureBackend(capture)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	compressionMode, err := weave.ParseCompressionMode(compression)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	loopDetection, err := weave.ParseLoopAction(loopAction)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dscpMarking, err := weave.ParseDSCPMarking(dscp)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	encryptionSchemes, err := weave.ParseEncryptionSchemes(encryption)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	plaintextPeers, err := weave.ParsePlaintextPeers(plaintext)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	bindIP, err := weave.ParseBindAddr(bindAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	encapsulation, err := weave.ParseEncapsulation(encap)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if encapsulation != weave.EncapWeave {
+		if password != "" {
+			log.Fatalf("-encap %s needs communication between peers to be unencrypted", encapsulation)
+		}
+		if encapPort == 0 {
+			encapPort = encapsulation.Port()
+		}
+		if encapPort < 0 || encapPort > 65535 || encapPort == weave.Port {
+			log.Fatal("Invalid -encap-port: ", encapPort)
+		}
+		if vni > weave.MaxVNI-0xffff {
+			log.Fatalf("-vni must be at most %d, leaving room for tenants", weave.MaxVNI-0xffff)
+		}
+	}
+
+	pmtuOverrides, err := parsePMTUOverrides(pinnedPMTUs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if fastPathXDP && fastPathDev == "" {
+		log.Fatal("-fastpath-xdp needs a -fastpath device")
+	}
+	if wgDev != "" {
+		if fastPathDev == "" {
+			log.Fatal("-wireguard needs a -fastpath device")
+		}
+		if wgPort <= 0 || wgPort > 65535 || wgPort == weave.Port {
+			log.Fatal("Invalid -wireguard-port: ", wgPort)
+		}
+	}
+
+	if joinKey == "" {
+		joinKey = os.Getenv("WEAVE_JOIN_KEY")
+	}
+	var joinAuth *weave.JoinAuth
+	switch {
+	case joinKey != "" && joinToken != "":
+		log.Fatal("-join-key and -join-token are mutually exclusive")
+	case joinKey != "":
+		if joinAuth, err = weave.NewJoinAuthWithKey([]byte(joinKey)); err != nil {
+			log.Fatal(err)
+		}
+	case joinToken != "":
+		if joinAuth, err = weave.NewJoinAuthWithToken(joinToken); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if joinAuth != nil && password == "" {
+		log.Fatal("Join tokens need a password")
+	}
+
+	var peerTLS *weave.PeerTLS
+	if peerCA != "" {
+		if peerCert == "" || peerKey == "" {
+			log.Fatal("-peer-ca needs -peer-cert and -peer-key")
+		}
+		if peerTLS, err = weave.NewPeerTLS(peerCA, peerCert, peerKey, peerCRL); err != nil {
+			log.Fatal(err)
+		}
+	} else if peerCert != "" || peerKey != "" || peerCRL != "" {
+		log.Fatal("-peer-cert, -peer-key and -peer-crl need -peer-ca")
+	}
+
+	var peerStore *weave.PeerStore
+	if peersFile != "" {
+		peerStore = weave.NewPeerStore(peersFile)
+	}
+
+	var sflow *weave.SFlowExporter
+	if sflowColl != "" {
+		if sflow, err = weave.NewSFlowExporter(sflowColl, sflowRate); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var bridge *weave.Bridge
+	if bridgeName != "" {
+		mtu, auto, err := weave.ParseBridgeMTU(bridgeMTU, weave.DefaultPMTU)
+		if err != nil {
+			log.Fatal(err)
+		}
+		bridge = weave.NewBridge(bridgeName, mtu, auto, hostNetNS)
+	}
+	if gatewayAddr != "" {
+		if bridge == nil {
+			log.Fatal("-gateway requires -bridge")
+		}
+		addrs, err := weave.ParseGatewayAddrs(gatewayAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		bridge.SetGateway(addrs)
+	}
+
+	var keyLog *weave.KeyLog
+	if keyLogFile != "" {
+		if keyLog, err = weave.NewKeyLog(keyLogFile); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("WARNING: logging session keys to", keyLogFile)
+	}
+
+	var peerACLRules []*weave.PeerACLRule
+	if peerRules != "" {
+		text, err := ioutil.ReadFile(peerRules)
+		if err == nil {
+			peerACLRules, err = weave.ParsePeerACLRules(string(text))
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var policyRules []*weave.PolicyRule
+	if policyFile != "" {
+		text, err := ioutil.ReadFile(policyFile)
+		if err == nil {
+			policyRules, err = weave.ParsePolicyRules(string(text))
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if fastPathDev != "" {
+			log.Println("WARNING: frames peers send over the fast path bypass policy")
+		}
+		for _, rule := range policyRules {
+			if rule.States != 0 && !conntrack {
+				log.Println("WARNING: without -conntrack every frame is new, as far as policy rules go")
+				break
+			}
+		}
+	}
+
+	tenantSubnets, err := weave.ParseTenants(tenants)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(tenantSubnets) > 0 && fastPathDev != "" {
+		log.Println("WARNING: frames sent over the fast path don't carry their tenant")
+	}
+
+	if transport != "tcp" && transport != "websocket" {
+		log.Fatal("Unknown transport: ", transport)
+	}
+
+	peerRateLimits, err := parsePeerRateLimits(peerLimits)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	peerKeepalives, err := parsePeerKeepalives(peerAlives)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	relays, err := parsePeerNames(relayNames)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pinnedMacs, err := parseMacPins(macPins)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tuning := weave.Tuning{
+		QueueSize:     queueSize,
+		SndBuf:        sndBuf * 1024,
+		RcvBuf:        rcvBuf * 1024,
+		FastHeartbeat: fastBeat,
+		SlowHeartbeat: slowBeat,
+		HeartbeatLoss: beatLoss,
+		FlushDelay:    flushDelay,
+		NATKeepalive:  keepalive}
+	if err := tuning.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := reconnect.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := limits.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	paddingBuckets, err := parseSizes(padding)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var allocRange *net.IPNet
+	if ipRange != "" {
+		if _, allocRange, err = net.ParseCIDR(ipRange); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if pluginSock != "" && allocRange == nil {
+		log.Fatal("The Docker plugin needs -ipalloc-range")
+	}
+
+	router := weave.NewRouter(weave.RouterConfig{
+		Iface:          iface,
+		Password:       []byte(password),
+		ConnLimit:      connLimit,
+		BufSz:          bufSz * 1024 * 1024,
+		Capture:        captureBackend,
+		CaptureReaders: captureRdrs,
+		BatchSize:      batchSz,
+		RecvBatchSize:  recvBatchSz,
+		Listeners:      listeners,
+		Forwarders:     workers,
+		SealWorkers:    sealWorkers,
+		RecvWorkers:    recvWorkers,
+		KeyLog:         keyLog,
+		JoinAuth:       joinAuth,
+		PeerTLS:        peerTLS,
+		PeerStore:      peerStore,
+		FlowAccounting: flowStats,
+		FilterCapture:  captureFilt,
+		ConnTracking:   conntrack,
+		SFlow:          sflow,
+		Bridge:         bridge,
+		DropPolicy:     policy,
+		MaxSndBuf:      maxSndBuf * 1024 * 1024,
+		PMTUMaxAge:     pmtuMaxAge,
+		RekeyInterval:  rekeyIntvl,
+		RekeyBytes:     rekeyMB * 1024 * 1024,
+		FastPathDev:    fastPathDev,
+		FastPathXDP:    fastPathXDP,
+		WireGuardDev:   wgDev,
+		WireGuardPort:  wgPort,
+		RateLimit:      int64(rateLimit) * 1000 * 1000 / 8,
+		PeerRateLimits: peerRateLimits,
+		TCPFallback:    tcpFallback,
+		IGMPSnooping:   igmpSnoop,
+		Relays:         relays,
+		NATTraversal:   natTraverse,
+		BindAddr:       bindIP,
+		STUNServers:    splitList(stunServers),
+		PMTUOverrides:  pmtuOverrides,
+		WebSocketPort:  wsPort,
+		TLSCertFile:    tlsCert,
+		TLSKeyFile:     tlsKey,
+		UDPChecksums:   checksums,
+		PaddingBuckets: paddingBuckets,
+		Compression:    compressionMode,
+		LoopDetection:  loopDetection,
+		DSCP:           dscpMarking,
+		ECN:            ecn,
+		Standby:        standby,
+		MultiPath:      multiPath,
+		ClampMSS:       clampMSS,
+		Encryption:     encryptionSchemes,
+		Plaintext:      plaintextPeers,
+		Encap:          encapsulation,
+		EncapPort:      encapPort,
+		VNI:            uint32(vni),
+		QualityRouting: qualityRte,
+		MacPins:        pinnedMacs,
+		ARPProxy:       arpProxy,
+		TenantSubnets:  tenantSubnets,
+		Tuning:         tuning,
+		Reconnect:      reconnect,
+		Limits:         limits,
+		PeerKeepalives: peerKeepalives,
+		LogFrame:       logFrame}, ourName)
 	log.Println("Our name is", router.Ourself.Name)
+	router.Policy.SetLocalRules(policyRules)
+	router.PeerACL.SetRules(peerACLRules)
+	// Peers which don't allocate addresses still need the channel, or
+	// they would drop connections on receiving gossip for it.
+	allocator, err := ipam.NewAllocator(router.Ourself.Name, router.Peers, allocRange, ipStateFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	allocator.SetGossip(router.NewGossip("ipam", allocator))
+	// Likewise for DNS
+	zone := nameserver.NewGossipZone(router.Ourself.Name)
+	zone.SetGossip(router.NewGossip("dns", zone))
+	go forgetRemovedPeers(router, zone)
 	router.Start()
+	if dnsPort != 0 {
+		if dockerAPI != "" {
+			if err := nameserver.StartUpdater(dockerAPI, zone); err != nil {
+				log.Fatal(err)
+			}
+		}
+		nameserver.HandleNames(nameserver.LOCAL_DOMAIN, zone)
+		http.HandleFunc("/dns", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, zone.String())
+		})
+		go func() {
+			log.Fatal("Unable to answer DNS queries: ", nameserver.StartZoneServer(zone, dnsPort))
+		}()
+	}
+	if pluginSock != "" {
+		driver := plugin.NewDriver(allocator, pluginBr, hostNetNS)
+		go func() {
+			log.Fatal("Unable to serve Docker plugin: ", driver.Listen(pluginSock))
+		}()
+	}
 	for _, peer := range peers {
-		if addr, err := net.ResolveTCPAddr("tcp4", weave.NormalisePeerAddr(peer)); err == nil {
-			router.ConnectionMaker.InitiateConnection(addr.String())
+		if transport == "websocket" && !strings.Contains(peer, "://") {
+			peer = weave.WebSocketScheme + peer
+		}
+		if addr, err := weave.ResolvePeerAddr(peer); err == nil {
+			router.ConnectionMaker.InitiateConnection(addr)
 		} else {
 			log.Fatal(err)
 		}
 	}
-	go handleHttp(router)
-	handleSignals(router)
+	if discover != "" {
+		providers, err := discovery.ParseProviders(discover)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if discoverInt <= 0 {
+			log.Fatal("-discovery-interval must be positive")
+		}
+		discovery.NewDiscoverer(providers, discoverInt, weave.Port,
+			router.ConnectionMaker.InitiateConnection, router.ConnectionMaker.ForgetConnection).Start()
+	}
+	var speaker *bgp.Speaker
+	if bgpPeers != "" {
+		if speaker, err = newBGPSpeaker(bgpAS, bgpRouterID, bgpNextHop, bgpPeers, allocator, bridge); err != nil {
+			log.Fatal(err)
+		}
+		speaker.Start()
+	}
+	go handleHttp(router, allocator, speaker, captureAPI)
+	handleSignals(router, speaker, drainTime)
+}
+
+// A speaker announcing the blocks of the allocation range we own, and
+// the subnets we are the gateway to, to BGP neighbours.
+func newBGPSpeaker(asSpec, routerIDSpec, nextHopSpec, neighboursSpec string, allocator *ipam.Allocator, bridge *weave.Bridge) (*bgp.Speaker, error) {
+	if asSpec == "" {
+		return nil, fmt.Errorf("-bgp-neighbours requires -bgp-as")
+	}
+	as, err := bgp.ParseAS(asSpec)
+	if err != nil {
+		return nil, err
+	}
+	routerID, err := parseOptionalIPv4(routerIDSpec, "BGP router ID")
+	if err != nil {
+		return nil, err
+	}
+	nextHop, err := parseOptionalIPv4(nextHopSpec, "BGP next hop")
+	if err != nil {
+		return nil, err
+	}
+	neighbours, err := bgp.ParseNeighbours(neighboursSpec)
+	if err != nil {
+		return nil, err
+	}
+	if allocator.Universe() == nil && len(bridge.GatewaySubnets()) == 0 {
+		log.Println("WARNING: nothing to announce to BGP neighbours without an allocation range or -gateway")
+	}
+	return bgp.NewSpeaker(as, routerID, nextHop, neighbours, func() []*net.IPNet {
+		return append(allocator.OwnedPrefixes(), bridge.GatewaySubnets()...)
+	}), nil
+}
+
+func parseOptionalIPv4(s, desc string) (net.IP, error) {
+	if s == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid %s %q; expected an IPv4 address", desc, s)
+	}
+	return ip, nil
+}
+
+// Drop the DNS records of peers which leave the topology
+func runCryptoBench(w io.Writer, rate float64) error {
+	if err := weave.SelfTestEncryption(); err != nil {
+		return fmt.Errorf("Encryption self-test failed: %s", err)
+	}
+	results, err := weave.BenchmarkEncryption(weave.CryptoBenchTime, weave.CryptoBenchFrameSizes)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%-8s %10s %10s %14s %14s\n", "SCHEME", "FRAME", "OVERHEAD", "SEAL MBIT/S", "OPEN MBIT/S")
+	for _, result := range results {
+		fmt.Fprintf(w, "%-8s %10d %10d %14.0f %14.0f\n", result.Scheme, result.FrameSize, result.Overhead,
+			result.SealRate*8/1e6, result.OpenRate*8/1e6)
+	}
+	fmt.Fprintf(w, "\nTo send at %.0f Mbit/s on each connection:\n", rate/1e6)
+	for _, settings := range weave.RecommendCryptoSettings(results, rate) {
+		workers := fmt.Sprintf("-encryption-workers %d", settings.Workers)
+		if scheme, _ := weave.LookupEncryptionScheme(settings.Scheme); scheme.Streams {
+			workers = fmt.Sprintf("-forwarder-workers %d", settings.Workers)
+		}
+		fmt.Fprintf(w, "%-8s %s -batchsz %d\n", settings.Scheme, workers, settings.BatchSize)
+	}
+	return nil
 }
 
-func handleHttp(router *weave.Router) {
+func forgetRemovedPeers(router *weave.Router, zone *nameserver.GossipZone) {
+	for event := range router.Events.Subscribe() {
+		if event.Type != weave.EventPeerRemoved {
+			continue
+		}
+		if name, err := weave.PeerNameFromString(event.Peer); err == nil {
+			zone.DeletePeer(name)
+		}
+	}
+}
+
+// Parse <peer name>=<Mbit/s> pairs into limits in bytes per second
+func splitList(spec string) []string {
+	if spec == "" {
+		return nil
+	}
+	return strings.Split(spec, ",")
+}
+
+func parsePeerNames(spec string) ([]weave.PeerName, error) {
+	var names []weave.PeerName
+	if spec == "" {
+		return names, nil
+	}
+	for _, nameStr := range strings.Split(spec, ",") {
+		name, err := weave.PeerNameFromUserInput(nameStr)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func parseMacPins(spec string) (map[string]weave.PeerName, error) {
+	pins := make(map[string]weave.PeerName)
+	for _, pair := range splitList(spec) {
+		fields := strings.SplitN(pair, "=", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid MAC pin %q; expected <MAC>=<peer name>", pair)
+		}
+		mac, err := net.ParseMAC(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC pin %q: %v", pair, err)
+		}
+		name, err := weave.PeerNameFromUserInput(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC pin %q: %v", pair, err)
+		}
+		pins[string(mac)] = name
+	}
+	return pins, nil
+}
+
+// Apply the settings given in the request's form to the current ones.
+// Buffer sizes are in bytes, heartbeat intervals are durations, and
+// the heartbeat loss threshold is a count.
+func parseTuning(tuning weave.Tuning, r *http.Request) (weave.Tuning, error) {
+	for name, field := range map[string]*int{
+		"queuesize":     &tuning.QueueSize,
+		"sndbuf":        &tuning.SndBuf,
+		"rcvbuf":        &tuning.RcvBuf,
+		"heartbeatloss": &tuning.HeartbeatLoss} {
+		if value := r.FormValue(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return tuning, fmt.Errorf("invalid %s %q", name, value)
+			}
+			*field = n
+		}
+	}
+	for name, field := range map[string]*time.Duration{
+		"fastheartbeat": &tuning.FastHeartbeat,
+		"slowheartbeat": &tuning.SlowHeartbeat,
+		"flushdelay":    &tuning.FlushDelay,
+		"natkeepalive":  &tuning.NATKeepalive} {
+		if value := r.FormValue(name); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return tuning, fmt.Errorf("invalid %s %q", name, value)
+			}
+			*field = d
+		}
+	}
+	return tuning, nil
+}
+
+func parseSizes(spec string) ([]int, error) {
+	var sizes []int
+	for _, sizeStr := range splitList(spec) {
+		size, err := strconv.Atoi(sizeStr)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid size %q", sizeStr)
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+func parsePeerRateLimits(spec string) (map[weave.PeerName]int64, error) {
+	limits := make(map[weave.PeerName]int64)
+	if spec == "" {
+		return limits, nil
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		fields := strings.SplitN(pair, "=", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid peer rate limit %q; expected <peer name>=<Mbit/s>", pair)
+		}
+		name, err := weave.PeerNameFromUserInput(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		mbps, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer rate limit %q: %v", pair, err)
+		}
+		limits[name] = int64(mbps) * 1000 * 1000 / 8
+	}
+	return limits, nil
+}
+
+func parsePeerKeepalives(spec string) (map[weave.PeerName]time.Duration, error) {
+	intervals := make(map[weave.PeerName]time.Duration)
+	if spec == "" {
+		return intervals, nil
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		fields := strings.SplitN(pair, "=", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid peer NAT keepalive %q; expected <peer name>=<interval>", pair)
+		}
+		name, err := weave.PeerNameFromUserInput(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		interval, err := time.ParseDuration(fields[1])
+		if err == nil && interval != 0 && interval < weave.MinKeepalive {
+			err = fmt.Errorf("must be 0, or at least %v", weave.MinKeepalive)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer NAT keepalive %q: %v", pair, err)
+		}
+		intervals[name] = interval
+	}
+	return intervals, nil
+}
+
+func parsePMTUOverrides(spec string) (*weave.PMTUOverrides, error) {
+	overrides := weave.NewPMTUOverrides()
+	if spec == "" {
+		return overrides, nil
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		fields := strings.SplitN(pair, "=", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid PMTU override %q; expected <peer name or CIDR>=<PMTU>", pair)
+		}
+		pmtu, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid PMTU override %q: %v", pair, err)
+		}
+		if err := overrides.Set(fields[0], pmtu); err != nil {
+			return nil, err
+		}
+	}
+	return overrides, nil
+}
+
+// The peer, stage and filter of a capture request; the peer is
+// UnknownPeerName if not given.
+func parseCapture(r *http.Request) (peer weave.PeerName, stage weave.TapStage, filter *weave.PolicyRule, err error) {
+	peer = weave.UnknownPeerName
+	if peerStr := r.FormValue("peer"); peerStr != "" {
+		if peer, err = weave.PeerNameFromUserInput(peerStr); err != nil {
+			return
+		}
+	}
+	if stageStr := r.FormValue("stage"); stageStr != "" {
+		if stage, err = weave.ParseTapStage(stageStr); err != nil {
+			return
+		}
+	}
+	filter, err = weave.ParseTapFilter(r.FormValue("filter"))
+	return
+}
+
+func handleHttp(router *weave.Router, allocator *ipam.Allocator, speaker *bgp.Speaker, captureAPI bool) {
 	encryption := "off"
-	if router.Password != nil && len(*router.Password) > 0 {
+	if router.UsingPassword() {
 		encryption = "on"
 	}
 	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
@@ -145,14 +990,464 @@ func handleHttp(router *weave.Router) {
 		io.WriteString(w, fmt.Sprintln("Encryption", encryption))
 		io.WriteString(w, router.Status())
 	})
+	http.HandleFunc("/status/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := router.WriteStatusJSON(w); err != nil {
+			log.Println("Error writing JSON status:", err)
+		}
+	})
+	http.Handle("/events", router.Events)
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := router.WriteMetrics(w); err != nil {
+			log.Println("Error writing metrics:", err)
+		}
+	})
+	http.HandleFunc("/flows", func(w http.ResponseWriter, r *http.Request) {
+		top := 10
+		if r.FormValue("top") != "" {
+			var err error
+			if top, err = strconv.Atoi(r.FormValue("top")); err != nil || top < 0 {
+				http.Error(w, "invalid top: "+r.FormValue("top"), http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(router.FlowReport(top)); err != nil {
+			log.Println("Error writing flows:", err)
+		}
+	})
+	if router.Conntrack != nil {
+		http.HandleFunc("/conntrack", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(router.Conntrack.Connections()); err != nil {
+				log.Println("Error writing tracked connections:", err)
+			}
+		})
+	}
 	http.HandleFunc("/connect", func(w http.ResponseWriter, r *http.Request) {
 		peer := r.FormValue("peer")
-		if addr, err := net.ResolveTCPAddr("tcp4", weave.NormalisePeerAddr(peer)); err == nil {
-			router.ConnectionMaker.InitiateConnection(addr.String())
+		if addr, err := weave.ResolvePeerAddr(peer); err == nil {
+			router.ConnectionMaker.InitiateConnection(addr)
 		} else {
 			http.Error(w, fmt.Sprint("invalid peer address: ", err), http.StatusBadRequest)
 		}
 	})
+	http.HandleFunc("/forget", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST the name or address of a peer", http.StatusMethodNotAllowed)
+			return
+		}
+		peer := r.FormValue("peer")
+		if peer == "" {
+			http.Error(w, "missing peer", http.StatusBadRequest)
+			return
+		}
+		if !router.ForgetPeer(peer) {
+			io.WriteString(w, fmt.Sprintln("not connected to", peer))
+		}
+	})
+	http.HandleFunc("/reconnects", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(router.ConnectionMaker.Targets()); err != nil {
+				log.Println("Error writing reconnects:", err)
+			}
+			return
+		}
+		// Without a peer, retry every address
+		address := r.FormValue("peer")
+		if address != "" {
+			var err error
+			if address, err = weave.ResolvePeerAddr(address); err != nil {
+				http.Error(w, fmt.Sprint("invalid peer address: ", err), http.StatusBadRequest)
+				return
+			}
+		}
+		if !router.ConnectionMaker.RetryNow(address) {
+			http.Error(w, "nothing to retry", http.StatusNotFound)
+		}
+	})
+	http.HandleFunc("/pmtu", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			io.WriteString(w, router.PMTUOverrides.String())
+			return
+		}
+		// A PMTU of 0 removes the override
+		pmtu, err := strconv.Atoi(r.FormValue("pmtu"))
+		if err == nil {
+			err = router.SetPMTUOverride(r.FormValue("peer"), pmtu)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprint("invalid PMTU override: ", err), http.StatusBadRequest)
+		}
+	})
+	http.HandleFunc("/macs", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(router.Macs.Entries()); err != nil {
+				log.Println("Error writing MACs:", err)
+			}
+			return
+		}
+		// An empty peer unpins the MAC
+		if err := router.SetMac(r.FormValue("mac"), r.FormValue("peer"), r.FormValue("seed") == "true"); err != nil {
+			http.Error(w, fmt.Sprint("invalid MAC mapping: ", err), http.StatusBadRequest)
+		}
+	})
+	http.HandleFunc("/tuning", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(router.CurrentTuning()); err != nil {
+				log.Println("Error writing tuning:", err)
+			}
+			return
+		}
+		// Settings not given keep their current values
+		tuning, err := parseTuning(router.CurrentTuning(), r)
+		if err == nil {
+			err = router.SetTuning(tuning)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprint("invalid tuning: ", err), http.StatusBadRequest)
+		}
+	})
+	http.HandleFunc("/password", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST a password, and optionally a grace period", http.StatusMethodNotAllowed)
+			return
+		}
+		grace := weave.PasswordGrace
+		if graceStr := r.FormValue("grace"); graceStr != "" {
+			var err error
+			if grace, err = time.ParseDuration(graceStr); err != nil {
+				http.Error(w, fmt.Sprint("invalid grace period: ", err), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := router.SetPassword([]byte(r.FormValue("password")), grace); err != nil {
+			http.Error(w, fmt.Sprint("unable to set password: ", err), http.StatusBadRequest)
+		}
+	})
+	http.HandleFunc("/peerrules", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			io.WriteString(w, router.PeerACL.String())
+			return
+		}
+		// Rules, one per line, replace the current ones; none clears
+		// them
+		rules, err := weave.ParsePeerACLRules(r.FormValue("rules"))
+		if err != nil {
+			http.Error(w, fmt.Sprint("invalid peer rules: ", err), http.StatusBadRequest)
+			return
+		}
+		router.SetPeerACLRules(rules)
+	})
+	// Sets the levels of subsystems, as with -log-level
+	http.HandleFunc("/loglevel", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			if err := weave.SetLogLevels(r.FormValue("level")); err != nil {
+				http.Error(w, fmt.Sprint("invalid log level: ", err), http.StatusBadRequest)
+				return
+			}
+		}
+		io.WriteString(w, weave.LogLevels())
+	})
+	// Issues a join token, for the given time or forever, or revokes
+	// one by its ID
+	http.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if router.JoinAuth == nil {
+			http.Error(w, "not using join tokens", http.StatusNotFound)
+			return
+		}
+		if r.Method != "POST" {
+			io.WriteString(w, router.JoinAuth.String())
+			return
+		}
+		if id := r.FormValue("revoke"); id != "" {
+			if err := router.JoinAuth.Revoke(id); err != nil {
+				http.Error(w, fmt.Sprint("unable to revoke join token: ", err), http.StatusBadRequest)
+			}
+			return
+		}
+		var ttl time.Duration
+		if ttlStr := r.FormValue("ttl"); ttlStr != "" {
+			var err error
+			if ttl, err = time.ParseDuration(ttlStr); err != nil || ttl < 0 {
+				http.Error(w, fmt.Sprint("invalid ttl: ", ttlStr), http.StatusBadRequest)
+				return
+			}
+		}
+		token, err := router.JoinAuth.Issue(ttl)
+		if err != nil {
+			http.Error(w, fmt.Sprint("unable to issue join token: ", err), http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, fmt.Sprintln(token))
+	})
+	http.HandleFunc("/policy", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			io.WriteString(w, router.Policy.String())
+			return
+		}
+		// Rules, one per line, replace the local or global ones; none
+		// clears them
+		rules, err := weave.ParsePolicyRules(r.FormValue("rules"))
+		if err != nil {
+			http.Error(w, fmt.Sprint("invalid policy: ", err), http.StatusBadRequest)
+			return
+		}
+		switch r.FormValue("scope") {
+		case "", "local":
+			router.Policy.SetLocalRules(rules)
+		case "global":
+			router.Policy.SetGlobalRules(rules)
+		default:
+			http.Error(w, "scope must be local or global", http.StatusBadRequest)
+		}
+	})
+	// Sends the peer test frames at the rate, in Mbit/s, and reports
+	// what got through
+	http.HandleFunc("/throughput", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST the name of a peer, and optionally a rate, frame size and seconds", http.StatusMethodNotAllowed)
+			return
+		}
+		peer, err := weave.PeerNameFromUserInput(r.FormValue("peer"))
+		mbps, size, seconds := 100.0, 1400, 10
+		if rateStr := r.FormValue("rate"); err == nil && rateStr != "" {
+			mbps, err = strconv.ParseFloat(rateStr, 64)
+		}
+		if sizeStr := r.FormValue("size"); err == nil && sizeStr != "" {
+			size, err = strconv.Atoi(sizeStr)
+		}
+		if secondsStr := r.FormValue("seconds"); err == nil && secondsStr != "" {
+			seconds, err = strconv.Atoi(secondsStr)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprint("invalid throughput test: ", err), http.StatusBadRequest)
+			return
+		}
+		result, err := router.TestThroughput(peer, uint64(mbps*1e6), size, time.Duration(seconds)*time.Second)
+		if err != nil {
+			http.Error(w, fmt.Sprint("throughput test failed: ", err), http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, fmt.Sprintln(result))
+	})
+	if router.Bridge != nil {
+		http.HandleFunc("/bridge", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, router.Bridge.String())
+		})
+		// Create a veth pair for a container, attached to the bridge
+		http.HandleFunc("/bridge/attach", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				http.Error(w, "POST the names of the local and guest ends of a veth", http.StatusMethodNotAllowed)
+				return
+			}
+			local, guest := r.FormValue("local"), r.FormValue("guest")
+			if local == "" || guest == "" {
+				http.Error(w, "missing local or guest", http.StatusBadRequest)
+				return
+			}
+			if err := router.Bridge.AttachVeth(local, guest); err != nil {
+				http.Error(w, fmt.Sprint("unable to attach veth: ", err), http.StatusBadRequest)
+			}
+		})
+		http.HandleFunc("/bridge/detach", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				http.Error(w, "POST the name of the local end of a veth", http.StatusMethodNotAllowed)
+				return
+			}
+			if err := router.Bridge.DetachVeth(r.FormValue("local")); err != nil {
+				http.Error(w, fmt.Sprint("unable to detach veth: ", err), http.StatusBadRequest)
+			}
+		})
+		// Attach a container, given the pid of a process in it, or
+		// the path of its network namespace, with the address given,
+		// or else the one allocated to it, allocating one if need be
+		http.HandleFunc("/attach", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				http.Error(w, "POST the ID of a container, and pid or netns", http.StatusMethodNotAllowed)
+				return
+			}
+			containerID, netNS, ifName := r.FormValue("container"), r.FormValue("netns"), r.FormValue("ifname")
+			var err error
+			if pidStr := r.FormValue("pid"); pidStr != "" && netNS == "" {
+				var pid int
+				if pid, err = strconv.Atoi(pidStr); err == nil {
+					netNS = weave.ProcessNetNS(pid)
+				}
+			}
+			if err == nil && (containerID == "" || netNS == "") {
+				err = fmt.Errorf("missing container, or pid or netns")
+			}
+			if ifName == "" {
+				ifName = weave.DefaultContainerIfName
+			}
+			var addr *net.IPNet
+			if cidr := r.FormValue("ip"); err == nil && cidr != "" {
+				var ip net.IP
+				if ip, addr, err = net.ParseCIDR(cidr); err == nil {
+					addr.IP = ip
+				}
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprint("invalid attach: ", err), http.StatusBadRequest)
+				return
+			}
+			allocated := false
+			if addr == nil {
+				_, found := allocator.Lookup(containerID)
+				if addr, err = allocator.Allocate(containerID, ipam.AllocateTimeout); err != nil {
+					http.Error(w, fmt.Sprint("unable to allocate address: ", err), http.StatusServiceUnavailable)
+					return
+				}
+				allocated = !found
+			}
+			if err := router.Bridge.AttachContainer(containerID, netNS, ifName, addr); err != nil {
+				if allocated {
+					allocator.Free(containerID)
+				}
+				http.Error(w, fmt.Sprint("unable to attach container: ", err), http.StatusBadRequest)
+				return
+			}
+			io.WriteString(w, addr.String())
+		})
+		// Detach a container, releasing the address allocated to it
+		http.HandleFunc("/detach", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				http.Error(w, "POST the ID of a container", http.StatusMethodNotAllowed)
+				return
+			}
+			containerID := r.FormValue("container")
+			if containerID == "" {
+				http.Error(w, "missing container", http.StatusBadRequest)
+				return
+			}
+			if err := router.Bridge.DetachContainer(containerID); err != nil {
+				http.Error(w, fmt.Sprint("unable to detach container: ", err), http.StatusBadRequest)
+				return
+			}
+			// There may be none, e.g. with the address given on attaching
+			allocator.Free(containerID)
+		})
+	}
+	if captureAPI {
+		http.HandleFunc("/capture", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				io.WriteString(w, router.Taps.String())
+				return
+			}
+			peer, stage, filter, err := parseCapture(r)
+			if err == nil && peer == weave.UnknownPeerName {
+				err = fmt.Errorf("missing peer")
+			}
+			if err == nil && r.FormValue("file") == "" {
+				err = fmt.Errorf("missing file")
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprint("invalid capture: ", err), http.StatusBadRequest)
+				return
+			}
+			capture, err := router.Taps.StartFileCapture(peer, stage, filter, r.FormValue("file"))
+			if err != nil {
+				http.Error(w, fmt.Sprint("unable to start capture: ", err), http.StatusBadRequest)
+				return
+			}
+			io.WriteString(w, fmt.Sprintln(capture.ID))
+		})
+		http.HandleFunc("/capture/stop", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				http.Error(w, "POST the ID of a capture", http.StatusMethodNotAllowed)
+				return
+			}
+			id, err := strconv.Atoi(r.FormValue("id"))
+			if err == nil {
+				err = router.Taps.StopFileCapture(id)
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprint("unable to stop capture: ", err), http.StatusBadRequest)
+			}
+		})
+		// A capture of the peer, or all peers, for some seconds
+		http.HandleFunc("/capture/stream", func(w http.ResponseWriter, r *http.Request) {
+			peer, stage, filter, err := parseCapture(r)
+			format := weave.PcapngFormat
+			if err == nil && r.FormValue("format") != "" {
+				format, err = weave.ParseCaptureFormat(r.FormValue("format"))
+			}
+			seconds := 10
+			if secondsStr := r.FormValue("seconds"); err == nil && secondsStr != "" {
+				if seconds, err = strconv.Atoi(secondsStr); err == nil && (seconds <= 0 || seconds > 300) {
+					err = fmt.Errorf("seconds must be from 1 to 300")
+				}
+			}
+			var tap *weave.FrameTap
+			if err == nil {
+				tap, err = router.Taps.Add(peer, stage, filter)
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprint("invalid capture: ", err), http.StatusBadRequest)
+				return
+			}
+			defer router.Taps.Remove(tap)
+			if format == weave.PcapngFormat {
+				w.Header().Set("Content-Type", "application/x-pcapng")
+			} else {
+				w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+			}
+			if err := tap.WriteCapture(w, format, time.After(time.Duration(seconds)*time.Second)); err != nil {
+				log.Println("Error writing capture:", err)
+			}
+			if dropped := tap.Dropped(); dropped > 0 {
+				log.Println("Capture missed", dropped, "frames")
+			}
+		})
+	}
+	http.HandleFunc("/ip", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, allocator.String())
+	})
+	if speaker != nil {
+		http.HandleFunc("/bgp", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, speaker.String())
+		})
+	}
+	// /ip/<container id>, or /ip/<container id>/<address> to claim
+	// an address
+	http.HandleFunc("/ip/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/ip/"), "/")
+		ident := parts[0]
+		switch {
+		case ident == "" || len(parts) > 2:
+			http.Error(w, "invalid URL: "+r.URL.Path, http.StatusBadRequest)
+		case r.Method == "GET" && len(parts) == 1:
+			if addr, found := allocator.Lookup(ident); found {
+				io.WriteString(w, addr.String())
+			} else {
+				http.Error(w, fmt.Sprint("no address for ", ident), http.StatusNotFound)
+			}
+		case r.Method == "POST" && len(parts) == 1:
+			if addr, err := allocator.Allocate(ident, ipam.AllocateTimeout); err == nil {
+				io.WriteString(w, addr.String())
+			} else {
+				http.Error(w, fmt.Sprint("unable to allocate address: ", err), http.StatusServiceUnavailable)
+			}
+		case r.Method == "PUT" && len(parts) == 2:
+			ip := net.ParseIP(parts[1])
+			if ip == nil {
+				http.Error(w, fmt.Sprint("invalid address: ", parts[1]), http.StatusBadRequest)
+			} else if err := allocator.Claim(ident, ip); err != nil {
+				http.Error(w, fmt.Sprint("unable to claim address: ", err), http.StatusConflict)
+			}
+		case r.Method == "DELETE" && len(parts) == 1:
+			if err := allocator.Free(ident); err != nil {
+				http.Error(w, fmt.Sprint("unable to release address: ", err), http.StatusNotFound)
+			}
+		default:
+			http.Error(w, "GET, POST or DELETE /ip/<container id>, or PUT /ip/<container id>/<address>", http.StatusMethodNotAllowed)
+		}
+	})
 	address := fmt.Sprintf(":%d", weave.HttpPort)
 	err := http.ListenAndServe(address, nil)
 	if err != nil {
@@ -160,9 +1455,9 @@ func handleHttp(router *weave.Router) {
 	}
 }
 
-func handleSignals(router *weave.Router) {
+func handleSignals(router *weave.Router, speaker *bgp.Speaker, drainTime time.Duration) {
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGQUIT, syscall.SIGUSR1)
+	signal.Notify(sigs, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGTERM, syscall.SIGINT)
 	buf := make([]byte, 1<<20)
 	for {
 		sig := <-sigs
@@ -172,6 +1467,15 @@ func handleSignals(router *weave.Router) {
 			log.Printf("=== received SIGQUIT ===\n*** goroutine dump...\n%s\n*** end\n", buf[:stacklen])
 		case syscall.SIGUSR1:
 			log.Printf("=== received SIGUSR1 ===\n*** status...\n%s\n*** end\n", router.Status())
+		case syscall.SIGTERM, syscall.SIGINT:
+			log.Printf("=== received %v ===\n*** draining connections...\n", sig)
+			// Neighbours should stop routing to us before we go
+			if speaker != nil {
+				speaker.Stop()
+			}
+			router.Stop(drainTime)
+			log.Println("*** stopped")
+			os.Exit(0)
 		}
 	}
 }